@@ -0,0 +1,82 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// dns-config-migrate converts the kube-dns ConfigMap to the v2 schema of its
+// keys. It reads a ConfigMap manifest, e.g. the output of
+//
+//	kubectl -n kube-system get configmap kube-dns -o yaml
+//
+// and writes it with its configuration keys migrated.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/dns/pkg/dns/config"
+	"sigs.k8s.io/yaml"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [configmap.yaml]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Converts the keys of a kube-dns ConfigMap to the %v schema."+
+			" The manifest is read from the file, or the standard input if omitted.\n", config.SchemaV2)
+	}
+	flag.Parse()
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0), os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(path string, stdin io.Reader, stdout io.Writer) error {
+	in := stdin
+	if path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	manifest, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	var cm v1.ConfigMap
+	if err := yaml.UnmarshalStrict(manifest, &cm); err != nil {
+		return fmt.Errorf("failed to read the ConfigMap: %w", err)
+	}
+	if cm.Data, err = config.MigrateToV2(cm.Data); err != nil {
+		return fmt.Errorf("failed to migrate %v: %w", cm.Name, err)
+	}
+	out, err := yaml.Marshal(&cm)
+	if err != nil {
+		return err
+	}
+	_, err = stdout.Write(out)
+	return err
+}
@@ -22,6 +22,7 @@ import (
 	"os"
 	"time"
 
+	"k8s.io/dns/pkg/configcheck"
 	"k8s.io/dns/pkg/dns/config"
 	"k8s.io/dns/pkg/dnsmasq"
 	"k8s.io/klog/v2"
@@ -33,6 +34,7 @@ var (
 		configDir     string
 		syncInterval  time.Duration
 		kubednsServer string
+		validateOnly  bool
 	}{
 		RunNannyOpts: dnsmasq.RunNannyOpts{
 			DnsmasqExec:     "/usr/sbin/dnsmasq",
@@ -69,6 +71,13 @@ Any arguments given after "--" will be passed directly to dnsmasq itself.
 		"interval to check for configuration updates")
 	flag.StringVar(&opts.kubednsServer, "kubednsServer", opts.kubednsServer,
 		"local kubedns instance address for non-IP name resolution")
+	flag.StringVar(&opts.MetricsAddress, "metricsAddress", opts.MetricsAddress,
+		"if set, address to serve the metrics of the nanny itself on, e.g. 0.0.0.0:10055,"+
+			" distinct from the dnsmasq statistics exported by the sidecar")
+	opts.MetricsAccess.AddGoFlags(flag.CommandLine)
+	flag.BoolVar(&opts.validateOnly, "validateOnly", opts.validateOnly,
+		"if true, validate the configuration and the dnsmasq arguments built from it with"+
+			" dnsmasq --test, print a report and exit, with a non-zero status if they are invalid")
 	klog.InitFlags(nil)
 	flag.Parse()
 }
@@ -78,6 +87,12 @@ func main() {
 	klog.V(0).Infof("opts: %v", opts)
 
 	sync := config.NewFileSync(opts.configDir, opts.syncInterval)
+	if opts.validateOnly {
+		report := configcheck.NewReport(os.Stdout)
+		dnsmasq.ValidateNanny(sync, opts.RunNannyOpts, opts.kubednsServer, report)
+		klog.Flush()
+		os.Exit(report.Done())
+	}
 
 	dnsmasq.RunNanny(sync, opts.RunNannyOpts, opts.kubednsServer)
 }
@@ -29,18 +29,118 @@ import (
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/dns/pkg/dns/features"
 	fed "k8s.io/dns/pkg/dns/federation"
+	"k8s.io/dns/pkg/dns/mirror"
+	"k8s.io/dns/pkg/httpaccess"
 )
 
 type KubeDNSConfig struct {
 	ClusterDomain      string
+	ExtraDomains       []string
 	KubeConfigFile     string
 	KubeMasterURL      string
 	InitialSyncTimeout time.Duration
-
-	HealthzPort    int
+	ResyncPeriod       time.Duration
+	// KubeAPIContentType is the encoding requested from the API server,
+	// "protobuf" or "json".
+	KubeAPIContentType string
+
+	HealthzPort int
+	// Admin restricts the access to the healthz, metrics and admin
+	// endpoints.
+	Admin          httpaccess.Config
 	DNSBindAddress string
 	DNSPort        int
+	DisableUDP     bool
+	DisableTCP     bool
+	// ReusePort sets SO_REUSEPORT on the DNS and HTTP sockets, so that a
+	// replacement process can bind them before this one exits.
+	ReusePort bool
+	// SocketActivation serves DNS on the sockets passed by systemd rather
+	// than on DNSBindAddress and DNSPort.
+	SocketActivation bool
+	// DoHPort, if not 0, serves DNS over HTTPS on it, with the TLS
+	// certificate in DoHCertFile and DoHKeyFile.
+	DoHPort     int
+	DoHCertFile string
+	DoHKeyFile  string
+	// DoHTokenReview requires the DNS over HTTPS clients to present a
+	// bearer token, reviewed by the API server for DoHTokenAudiences and
+	// cached for DoHTokenCacheTTL. DoHAllowedGroups, if not empty, are the
+	// groups allowed.
+	DoHTokenReview    bool
+	DoHTokenAudiences []string
+	DoHAllowedGroups  []string
+	DoHTokenCacheTTL  time.Duration
+	// DoTPort, if not 0, serves DNS over TLS on it, with the TLS
+	// certificate in DoTCertFile and DoTKeyFile or in the DoTSecret
+	// namespace/name, reloaded every DoTCertReloadPeriod.
+	DoTPort             int
+	DoTCertFile         string
+	DoTKeyFile          string
+	DoTSecret           string
+	DoTCertReloadPeriod time.Duration
+	// GRPCPort, if not 0, serves the DNS queries of the CoreDNS grpc
+	// plugin protocol on it, over TLS with the certificate in GRPCCertFile
+	// and GRPCKeyFile if set, requiring client certificates signed by
+	// GRPCClientCAFile if set.
+	GRPCPort         int
+	GRPCCertFile     string
+	GRPCKeyFile      string
+	GRPCClientCAFile string
+	// DNSSECKeySecret, if set, is the namespace/name of the Secret holding
+	// the zone signing key of the cluster domain, whose answers are then
+	// signed for the clients asking for DNSSEC. Names and types are denied
+	// with DNSSECDenial records: nsec or nsec3 white lies.
+	DNSSECKeySecret string
+	DNSSECDenial    string
+	// DisableCompression turns off name compression in responses.
+	DisableCompression bool
+	// ReverseCIDRs are the CIDRs whose reverse names are answered locally.
+	ReverseCIDRs []string
+	// TransferCIDRs are the CIDRs of the clients allowed to transfer the
+	// cluster domain with AXFR.
+	TransferCIDRs []string
+	// TransferIXFRJournal is the number of changes of the cluster domain
+	// kept for IXFR, and TransferNotify the secondaries notified of them,
+	// compared every TransferJournalInterval, by the replica holding the
+	// Lease TransferNotifyLease of ConfigMapNs.
+	TransferIXFRJournal     int
+	TransferNotify          []string
+	TransferNotifyLease     string
+	TransferJournalInterval time.Duration
+	// TsigSecret, if set, is the namespace/name of the Secret holding the
+	// TSIG keys, by name. TransferTsigKeys are the keys the transfers must
+	// be signed with, and ForwardTsigKey the one signing forwarded queries.
+	TsigSecret       string
+	TransferTsigKeys []string
+	ForwardTsigKey   string
+	// ECSForward is what is done with the EDNS Client Subnet options of the
+	// forwarded queries: pass, strip or replace them with the subnet of the
+	// client truncated to ECSPrefixV4 or ECSPrefixV6.
+	ECSForward  string
+	ECSPrefixV4 int
+	ECSPrefixV6 int
+	// ChaseCNAME adds the addresses of the targets of ExternalName services
+	// to the replies to CNAME queries.
+	ChaseCNAME bool
+	// AnswerOrder is how the A and AAAA records of replies are ordered.
+	AnswerOrder string
+	// MaxAnswers limits the records answered over UDP, 0 for no limit.
+	MaxAnswers int
+
+	UpstreamConns       int
+	UpstreamPipeline    int
+	UpstreamIdleTimeout time.Duration
+	RaceUpstreams       bool
+	// UpstreamTLSServerName, if set, is the name the certificates of the
+	// upstream nameservers are verified for, the queries then being
+	// forwarded to them over TLS.
+	UpstreamTLSServerName string
+	// UpstreamTLSCAFile holds the CA verifying them, the system roots if
+	// unset.
+	UpstreamTLSCAFile string
 
 	Federations map[string]string
 
@@ -52,6 +152,163 @@ type KubeDNSConfig struct {
 
 	NameServers string
 	Profiling   bool
+
+	ValidateOnly bool
+
+	AuditLogPath string
+	RecordWatch  bool
+	RecordLeases bool
+
+	GuardrailMinRecords int
+	GuardrailMaxRecords int
+	GuardrailMaxDeletes int
+	GuardrailWindow     time.Duration
+
+	FederationHealthCheck        bool
+	FederationHealthCheckTTL     time.Duration
+	FederationHealthCheckTimeout time.Duration
+
+	PeerClusters        bool
+	PeerClustersTTL     time.Duration
+	PeerClustersTimeout time.Duration
+
+	DropTerminatingEndpoints    bool
+	ServingTerminatingEndpoints bool
+
+	PodIndex     bool
+	PodsVerified bool
+
+	PodReverseRecords bool
+
+	TopologyAwareAnswers bool
+
+	MultiClusterDomain string
+
+	TenantZones bool
+	// TenantTrustedForwarderCIDRs are the CIDRs of the forwarders, e.g. the
+	// node-local-dns caches, whose queries are not restricted by the
+	// tenantAccess configuration.
+	TenantTrustedForwarderCIDRs []string
+
+	NodeRecords bool
+
+	DisableWildcards bool
+
+	// WildcardQueryTimeout, if positive, bounds the time the wildcards of
+	// a query are expanded for. WildcardQueryTimeoutAction answers the
+	// queries timing out: "truncate" or "servfail".
+	WildcardQueryTimeout       time.Duration
+	WildcardQueryTimeoutAction string
+
+	// NegativeCacheTTL, if positive, is how long the names found to have
+	// no record are answered NXDOMAIN without walking the records again,
+	// for NegativeCacheSize names at most.
+	NegativeCacheTTL  time.Duration
+	NegativeCacheSize int
+	// SOAMinimumTTL is the MINIMUM of the SOA records, for which the
+	// negative answers are cached by the resolvers, and SOASerial their
+	// serial, the start of the current hour if 0.
+	SOAMinimumTTL time.Duration
+	SOASerial     uint32
+
+	// CustomRecordStore is where custom records are read from besides the
+	// configuration: "configmap", "crd", "etcd", or empty for nowhere. The
+	// etcd cluster is reached over TLS if CustomRecordEtcdCAFile or
+	// CustomRecordEtcdCertFile and CustomRecordEtcdKeyFile are set.
+	CustomRecordStore         string
+	CustomRecordNamespace     string
+	CustomRecordEtcdEndpoints []string
+	CustomRecordEtcdPrefix    string
+	CustomRecordEtcdCAFile    string
+	CustomRecordEtcdCertFile  string
+	CustomRecordEtcdKeyFile   string
+
+	// ACMEChallengeZone, if set, publishes the ACME challenges, shared by
+	// the replicas in the ConfigMap ACMEChallengeConfigMap of ConfigMapNs.
+	ACMEChallengeZone      string
+	ACMEChallengeConfigMap string
+
+	CanaryInterval time.Duration
+
+	JanitorInterval time.Duration
+
+	// CacheMemoryInterval is the period at which the memory held by the
+	// records is estimated, and CacheMemoryLimit, a quantity such as
+	// 512Mi, what it is expected to stay under.
+	CacheMemoryInterval time.Duration
+	CacheMemoryLimit    string
+
+	// InventoryInterval is the period at which the numbers of records and
+	// services are exported as the kubedns_inventory_* metrics.
+	InventoryInterval time.Duration
+
+	// RecordsSnapshotFile, if set, is where the records are saved every
+	// RecordsSnapshotInterval, and loaded from at startup unless older than
+	// RecordsSnapshotMaxAge.
+	RecordsSnapshotFile     string
+	RecordsSnapshotInterval time.Duration
+	RecordsSnapshotMaxAge   time.Duration
+
+	// WarmStandbyPort, if not 0, is the port on which the records are
+	// served over gRPC to the replicas starting with WarmStandbyPeer, the
+	// address of the others, to answer from until they are synced. Both
+	// ends authenticate with the certificate in WarmStandbyCertFile and
+	// WarmStandbyKeyFile, signed by one of the CAs in WarmStandbyCAFile.
+	// The records are served to the clients in WarmStandbyAllowedCIDRs
+	// only, if set.
+	WarmStandbyPort         int
+	WarmStandbyPeer         string
+	WarmStandbyTimeout      time.Duration
+	WarmStandbyCertFile     string
+	WarmStandbyKeyFile      string
+	WarmStandbyCAFile       string
+	WarmStandbyAllowedCIDRs []string
+
+	// ResponseCacheSize, if not 0, caches that many replies for
+	// ResponseCacheTTL.
+	ResponseCacheSize int
+	ResponseCacheTTL  time.Duration
+	// CacheInvalidationPort, if not 0, is the UDP port on which the
+	// replicas broadcast the names of the changed records to each other to
+	// invalidate their cached replies. CacheInvalidationPeers is the name
+	// of the headless service selecting the replicas, and
+	// CacheInvalidationSecret the namespace/name of the Secret holding the
+	// key authenticating their messages.
+	CacheInvalidationPort   int
+	CacheInvalidationPeers  string
+	CacheInvalidationSecret string
+
+	EventWorkers        int
+	EventCoalescePeriod time.Duration
+	EndpointsDebounce   time.Duration
+
+	// LazySRVRecords generates the SRV records of the endpoints of
+	// headless services when they are queried.
+	LazySRVRecords bool
+
+	HeadlessReverseRecords string
+
+	// EndpointNaming names the records of the endpoints of headless
+	// services without hostname: "hash" or "ip".
+	EndpointNaming string
+
+	// UnknownPortProtocols selects the SRV records of the ports whose
+	// protocol is not TCP, UDP or SCTP: "skip", "lowercase" or "tcp".
+	UnknownPortProtocols string
+
+	QuerySamplerRate   int
+	QuerySamplerTop    int
+	QuerySamplerWindow time.Duration
+
+	Mirror mirror.Config
+
+	// SearchPathMetrics counts the search path expansions of external
+	// names sent by the pods of every namespace, over windows of
+	// SearchPathWindow, and SearchPathLogOffenders logs the pods sending
+	// the most.
+	SearchPathMetrics      bool
+	SearchPathWindow       time.Duration
+	SearchPathLogOffenders bool
 }
 
 func NewKubeDNSConfig() *KubeDNSConfig {
@@ -61,16 +318,80 @@ func NewKubeDNSConfig() *KubeDNSConfig {
 		DNSBindAddress:     "0.0.0.0",
 		DNSPort:            53,
 		InitialSyncTimeout: 60 * time.Second,
+		ResyncPeriod:       5 * time.Minute,
+		KubeAPIContentType: "protobuf",
 
 		Federations: make(map[string]string),
 
 		ConfigMapNs: metav1.NamespaceSystem,
 		ConfigMap:   "", // default to using command line flags
 
+		ACMEChallengeConfigMap: "kube-dns-acme-challenges",
+
 		ConfigPeriod: 10 * time.Second,
 		ConfigDir:    "",
 
 		NameServers: "",
+
+		UpstreamPipeline:    16,
+		UpstreamIdleTimeout: 30 * time.Second,
+
+		GuardrailWindow: time.Minute,
+
+		CacheMemoryInterval: time.Minute,
+
+		InventoryInterval: time.Minute,
+
+		TransferNotifyLease:     "kube-dns-notify",
+		TransferJournalInterval: time.Second,
+
+		ECSForward:  "pass",
+		ECSPrefixV4: 24,
+		ECSPrefixV6: 56,
+
+		ResponseCacheTTL: time.Minute,
+
+		RecordsSnapshotInterval: time.Minute,
+		RecordsSnapshotMaxAge:   time.Hour,
+
+		WarmStandbyTimeout: 30 * time.Second,
+
+		EventWorkers:        2,
+		EventCoalescePeriod: 250 * time.Millisecond,
+
+		HeadlessReverseRecords: "named",
+		EndpointNaming:         "hash",
+		UnknownPortProtocols:   "skip",
+
+		WildcardQueryTimeoutAction: "truncate",
+
+		NegativeCacheSize: 10000,
+
+		SOAMinimumTTL: time.Minute,
+
+		AnswerOrder: "none",
+
+		CustomRecordNamespace:  metav1.NamespaceSystem,
+		CustomRecordEtcdPrefix: "/kube-dns/custom-records/",
+
+		DoHTokenCacheTTL: time.Minute,
+
+		DoTCertReloadPeriod: time.Minute,
+
+		DNSSECDenial: "nsec",
+
+		QuerySamplerTop:    20,
+		QuerySamplerWindow: time.Minute,
+
+		Mirror: mirror.DefaultConfig(),
+
+		SearchPathWindow: time.Minute,
+
+		FederationHealthCheckTTL:     30 * time.Second,
+		FederationHealthCheckTimeout: 2 * time.Second,
+
+		PeerClustersTTL:     30 * time.Second,
+		PeerClustersTimeout: 2 * time.Second,
 	}
 }
 
@@ -101,6 +422,30 @@ func (m clusterDomainVar) Type() string {
 	return "string"
 }
 
+type clusterDomainsVar struct {
+	val *[]string
+}
+
+func (m clusterDomainsVar) Set(v string) error {
+	var domains []string
+	for _, domain := range strings.Split(v, ",") {
+		if err := (clusterDomainVar{&domain}).Set(domain); err != nil {
+			return err
+		}
+		domains = append(domains, domain)
+	}
+	*m.val = domains
+	return nil
+}
+
+func (m clusterDomainsVar) String() string {
+	return strings.Join(*m.val, ",")
+}
+
+func (m clusterDomainsVar) Type() string {
+	return "strings"
+}
+
 type kubeMasterURLVar struct {
 	val *string
 }
@@ -148,6 +493,9 @@ func (fv federationsVar) Type() string {
 func (s *KubeDNSConfig) AddFlags(fs *pflag.FlagSet) {
 	fs.Var(clusterDomainVar{&s.ClusterDomain}, "domain",
 		"domain under which to create names")
+	fs.Var(clusterDomainsVar{&s.ExtraDomains}, "extra-domains",
+		"comma separated list of domains, e.g. prod.internal, answered identically to the domain:"+
+			" my-svc.my-ns.svc.prod.internal resolves as my-svc.my-ns.svc.cluster.local.")
 
 	fs.StringVar(&s.NameServers, "nameservers", s.NameServers,
 		"List of ip:port, separated by commas of nameservers to forward queries to. "+
@@ -161,11 +509,153 @@ func (s *KubeDNSConfig) AddFlags(fs *pflag.FlagSet) {
 	fs.Var(kubeMasterURLVar{&s.KubeMasterURL}, "kube-master-url",
 		"URL to reach kubernetes master. Env variables in this flag will be expanded.")
 
+	fs.StringVar(&s.KubeAPIContentType, "kube-api-content-type", s.KubeAPIContentType,
+		"encoding requested from the Kubernetes API server for the objects watched: protobuf, or json"+
+			" to fall back to JSON, e.g. through proxies that only handle JSON.")
 	fs.IntVar(&s.HealthzPort, "healthz-port", s.HealthzPort,
 		"port on which to serve a kube-dns HTTP readiness probe.")
+	s.Admin.AddFlags(fs)
+	fs.BoolVar(&s.ValidateOnly, "validate-only", s.ValidateOnly,
+		"if true, validate the flags and the configuration directory, print a report and exit,"+
+			" with a non-zero status if they are invalid.")
 	fs.StringVar(&s.DNSBindAddress, "dns-bind-address", s.DNSBindAddress,
 		"address on which to serve DNS requests.")
 	fs.IntVar(&s.DNSPort, "dns-port", s.DNSPort, "port on which to serve DNS requests.")
+	fs.BoolVar(&s.DisableUDP, "disable-udp", s.DisableUDP, "if true, do not serve DNS requests over UDP.")
+	fs.BoolVar(&s.DisableTCP, "disable-tcp", s.DisableTCP, "if true, do not serve DNS requests over TCP.")
+	fs.BoolVar(&s.ReusePort, "reuse-port", s.ReusePort,
+		"if true, set SO_REUSEPORT on the DNS, healthz and metrics sockets, so that a new kube-dns"+
+			" process can bind them while the old one still serves, e.g. for in-place binary upgrades.")
+	fs.BoolVar(&s.SocketActivation, "socket-activation", s.SocketActivation,
+		"if true, serve DNS on the UDP and TCP sockets passed by systemd socket activation instead"+
+			" of binding --dns-bind-address and --dns-port.")
+	fs.IntVar(&s.DoHPort, "doh-port", s.DoHPort,
+		"if not 0, port on which to serve DNS over HTTPS requests (RFC 8484) at /dns-query. Requires"+
+			" --doh-tls-cert-file and --doh-tls-key-file.")
+	fs.StringVar(&s.DoHCertFile, "doh-tls-cert-file", s.DoHCertFile,
+		"certificate of the DNS over HTTPS endpoint.")
+	fs.StringVar(&s.DoHKeyFile, "doh-tls-key-file", s.DoHKeyFile,
+		"key of the certificate given with --doh-tls-cert-file.")
+	fs.BoolVar(&s.DoHTokenReview, "doh-token-review", s.DoHTokenReview,
+		"if true, require the DNS over HTTPS clients to present a bearer token, validated with the"+
+			" TokenReview API. kube-dns must be allowed to create TokenReviews, e.g. with the"+
+			" system:auth-delegator cluster role.")
+	fs.StringSliceVar(&s.DoHTokenAudiences, "doh-token-audiences", s.DoHTokenAudiences,
+		"comma-separated audiences the DNS over HTTPS bearer tokens must be issued for. Empty"+
+			" accepts the audiences of the API server.")
+	fs.StringSliceVar(&s.DoHAllowedGroups, "doh-allowed-groups", s.DoHAllowedGroups,
+		"comma-separated groups allowed to query over DNS over HTTPS. Empty allows every user"+
+			" with a valid token.")
+	fs.DurationVar(&s.DoHTokenCacheTTL, "doh-token-cache-ttl", s.DoHTokenCacheTTL,
+		"how long the reviews of the DNS over HTTPS bearer tokens are cached.")
+	fs.IntVar(&s.DoTPort, "dot-port", s.DoTPort,
+		"if not 0, port on which to serve DNS over TLS requests (RFC 7858). Requires either"+
+			" --dot-tls-cert-file and --dot-tls-key-file, or --dot-tls-secret.")
+	fs.StringVar(&s.DoTCertFile, "dot-tls-cert-file", s.DoTCertFile,
+		"certificate of the DNS over TLS endpoint.")
+	fs.StringVar(&s.DoTKeyFile, "dot-tls-key-file", s.DoTKeyFile,
+		"key of the certificate given with --dot-tls-cert-file.")
+	fs.StringVar(&s.DoTSecret, "dot-tls-secret", s.DoTSecret,
+		"namespace/name of the kubernetes.io/tls Secret holding the certificate of the DNS over"+
+			" TLS endpoint. kube-dns must be allowed to get it.")
+	fs.DurationVar(&s.DoTCertReloadPeriod, "dot-tls-reload-period", s.DoTCertReloadPeriod,
+		"how often the DNS over TLS certificate is reloaded, so that renewed certificates are"+
+			" served without a restart.")
+	fs.IntVar(&s.GRPCPort, "grpc-port", s.GRPCPort,
+		"if not 0, port on which to serve DNS queries over gRPC, with the protocol of the CoreDNS"+
+			" grpc plugin, e.g. for the sidecar proxies forwarding DNS over their gRPC channels.")
+	fs.StringVar(&s.GRPCCertFile, "grpc-tls-cert-file", s.GRPCCertFile,
+		"if set, serve the gRPC DNS queries over TLS with this certificate.")
+	fs.StringVar(&s.GRPCKeyFile, "grpc-tls-key-file", s.GRPCKeyFile,
+		"key of the certificate given with --grpc-tls-cert-file.")
+	fs.StringVar(&s.GRPCClientCAFile, "grpc-client-ca-file", s.GRPCClientCAFile,
+		"if set, require the gRPC DNS clients to present a certificate signed by one of the CAs in"+
+			" this file. Requires --grpc-tls-cert-file.")
+	fs.StringVar(&s.DNSSECKeySecret, "dnssec-key-secret", s.DNSSECKeySecret,
+		"if set, namespace/name of the Secret holding the zone signing key of the cluster domain, as"+
+			" generated by dnssec-keygen, in zsk.key and zsk.private. The answers in the cluster"+
+			" domain are then signed for the clients setting the DO bit. kube-dns must be allowed"+
+			" to get the Secret.")
+	fs.StringVar(&s.DNSSECDenial, "dnssec-denial", s.DNSSECDenial,
+		"records denying the names and types of the cluster domain when signing: nsec or nsec3"+
+			" white lies.")
+	fs.BoolVar(&s.DisableCompression, "disable-compression", s.DisableCompression,
+		"if true, do not compress names in DNS responses. Some embedded clients mishandle"+
+			" compressed names, e.g. in SRV targets.")
+	fs.BoolVar(&s.ChaseCNAME, "chase-cname", s.ChaseCNAME,
+		"if true, resolve the external targets of CNAME records, e.g. of ExternalName services,"+
+			" through the upstream nameservers and return their A and AAAA records in the"+
+			" additional section of the replies to CNAME queries.")
+	fs.StringVar(&s.AnswerOrder, "answer-order", s.AnswerOrder,
+		"order of the A and AAAA records in replies: \"none\" to keep the order of the records,"+
+			" \"random\" to shuffle them, or \"round-robin\" to rotate them by one position per reply,"+
+			" so that repeated lookups of services with several endpoints spread the load.")
+	fs.IntVar(&s.MaxAnswers, "max-answers", s.MaxAnswers,
+		"if non-zero, answer at most this many A, AAAA or SRV records over UDP, e.g. for headless"+
+			" services with hundreds of endpoints. The limited UDP replies have the TC bit set, so that"+
+			" the clients wanting every record retry over TCP, where replies are complete.")
+	fs.StringSliceVar(&s.ReverseCIDRs, "reverse-cidrs", s.ReverseCIDRs,
+		"comma separated list of CIDRs, typically the service and pod CIDRs, for which PTR"+
+			" queries without a record are answered with NXDOMAIN instead of being forwarded"+
+			" upstream. Reverse names outside of these CIDRs are always forwarded.")
+	fs.StringSliceVar(&s.TransferCIDRs, "transfer-allowed-cidrs", s.TransferCIDRs,
+		"comma separated list of CIDRs of the clients allowed to transfer the cluster domain with"+
+			" AXFR over TCP or IXFR, e.g. secondary nameservers or audit tools. Empty refuses the transfers."+
+			" The pod records, generated when queried, are not transferred.")
+	fs.IntVar(&s.TransferIXFRJournal, "transfer-ixfr-journal", s.TransferIXFRJournal,
+		"number of changes of the records of the cluster domain kept for the incremental zone"+
+			" transfers (IXFR). The serial of the cluster domain is then the time of its last change."+
+			" Each replica keeps its own journal: the secondaries must transfer from a single replica,"+
+			" e.g. through the address of a pod. 0 answers IXFR with the whole domain.")
+	fs.StringSliceVar(&s.TransferNotify, "transfer-notify", s.TransferNotify,
+		"comma separated list of host:port of the secondary nameservers notified (NOTIFY) when the"+
+			" records of the cluster domain change.")
+	fs.StringVar(&s.TransferNotifyLease, "transfer-notify-lease", s.TransferNotifyLease,
+		"name of the Lease of --config-map-namespace whose holder is the replica notifying the"+
+			" secondaries of --transfer-notify, so that they are notified once. kube-dns must be allowed"+
+			" to get, create and update the Lease.")
+	fs.DurationVar(&s.TransferJournalInterval, "transfer-journal-interval", s.TransferJournalInterval,
+		"how often the records of the cluster domain are compared to the last ones, with"+
+			" --transfer-ixfr-journal or --transfer-notify.")
+	fs.StringVar(&s.TsigSecret, "tsig-secret", s.TsigSecret,
+		"if set, namespace/name of the Secret holding the TSIG keys (RFC 8945): each key of the"+
+			" Secret is the name of a TSIG key, and its value the secret. The signed queries are"+
+			" then verified, and their replies signed. kube-dns must be allowed to get the Secret.")
+	fs.StringSliceVar(&s.TransferTsigKeys, "transfer-tsig-keys", s.TransferTsigKeys,
+		"comma separated list of the TSIG keys of --tsig-secret the zone transfers must be signed"+
+			" with, in addition to coming from --transfer-allowed-cidrs. The NOTIFY messages are"+
+			" signed with the first one.")
+	fs.StringVar(&s.ForwardTsigKey, "forward-tsig-key", s.ForwardTsigKey,
+		"if set, TSIG key of --tsig-secret signing the queries forwarded to the upstream"+
+			" nameservers, with hmac-sha256. Incompatible with --upstream-conns.")
+	fs.StringVar(&s.ECSForward, "ecs-forward", s.ECSForward,
+		"what is done with the EDNS Client Subnet options (RFC 7871) of the queries forwarded"+
+			" upstream: pass them as they are, strip them, or replace them with the subnet of the"+
+			" client truncated to --ecs-prefix-v4 or --ecs-prefix-v6. The replies specific to a"+
+			" subnet are not cached.")
+	fs.IntVar(&s.ECSPrefixV4, "ecs-prefix-v4", s.ECSPrefixV4,
+		"source prefix of the IPv4 client subnets forwarded with --ecs-forward=replace.")
+	fs.IntVar(&s.ECSPrefixV6, "ecs-prefix-v6", s.ECSPrefixV6,
+		"source prefix of the IPv6 client subnets forwarded with --ecs-forward=replace.")
+	fs.IntVar(&s.UpstreamConns, "upstream-conns", s.UpstreamConns,
+		"if non-zero, queries forwarded over TCP are pipelined on up to this many persistent"+
+			" connections per upstream nameserver, instead of dialing a connection per query.")
+	fs.IntVar(&s.UpstreamPipeline, "upstream-pipeline", s.UpstreamPipeline,
+		"number of queries in flight on a persistent upstream connection before another"+
+			" connection is opened, at most 1024.")
+	fs.DurationVar(&s.UpstreamIdleTimeout, "upstream-idle-timeout", s.UpstreamIdleTimeout,
+		"persistent upstream connections idle for longer than this are closed.")
+	fs.StringVar(&s.UpstreamTLSServerName, "upstream-tls-server-name", s.UpstreamTLSServerName,
+		"if set, queries are forwarded to the upstream nameservers over TLS (DNS over TLS, RFC"+
+			" 7858), typically on their port 853, whose certificates must be valid for this name."+
+			" The connections are pooled with --upstream-conns. The stub domains are still"+
+			" queried over UDP and TCP.")
+	fs.StringVar(&s.UpstreamTLSCAFile, "upstream-tls-ca-file", s.UpstreamTLSCAFile,
+		"CA file verifying the certificates of the upstream nameservers with"+
+			" --upstream-tls-server-name, the system roots if unset.")
+	fs.BoolVar(&s.RaceUpstreams, "race-upstreams", s.RaceUpstreams,
+		"if true, send forwarded queries to the two historically fastest upstream nameservers at"+
+			" once and answer with the first valid reply, rather than trying them in turn.")
 
 	fs.Var(federationsVar{s.Federations}, "federations",
 		"a comma separated list of the federation names and their corresponding"+
@@ -182,6 +672,9 @@ func (s *KubeDNSConfig) AddFlags(fs *pflag.FlagSet) {
 			"dynamically adjustable configuration.")
 	fs.DurationVar(&s.InitialSyncTimeout, "initial-sync-timeout", s.InitialSyncTimeout,
 		"Timeout for initial resource sync.")
+	fs.DurationVar(&s.ResyncPeriod, "resync-period", s.ResyncPeriod,
+		"period at which the services and endpoints are replayed to kube-dns, and the records of the"+
+			" objects that no longer exist removed, in case their events were missed. 0 disables resyncs.")
 
 	fs.StringVar(&s.ConfigDir, "config-dir", s.ConfigDir,
 		"directory to read config values from. Cannot be "+
@@ -189,4 +682,224 @@ func (s *KubeDNSConfig) AddFlags(fs *pflag.FlagSet) {
 	fs.DurationVar(&s.ConfigPeriod, "config-period", s.ConfigPeriod,
 		"period at which to check for updates in config-dir.")
 	fs.BoolVar(&s.Profiling, "profiling", s.Profiling, "specifies whether to enable profiling")
+	fs.StringVar(&s.AuditLogPath, "audit-log-path", s.AuditLogPath,
+		"if set, write a JSON line for every DNS record added, updated or deleted,"+
+			" along with the object that caused the change, to this file."+
+			" Use '-' for stdout.")
+	fs.BoolVar(&s.RecordWatch, "record-watch", s.RecordWatch,
+		"if true, stream the DNS records served and their changes as JSON lines on /admin/records/watch.")
+	fs.BoolVar(&s.RecordLeases, "record-leases", s.RecordLeases,
+		"if true, let controllers publish custom records for as long as they renew their lease"+
+			" on /admin/records/leases, see the k8s.io/dns/pkg/dns/leases client. The leases are held by"+
+			" the client certificate or the bearer token, e.g. of a ServiceAccount, authenticating the"+
+			" controller, and shared by the replicas as the coordination.k8s.io Leases of"+
+			" --config-map-namespace labeled dns.kubernetes.io/record-lease.")
+	fs.IntVar(&s.GuardrailMinRecords, "guardrail-min-records", s.GuardrailMinRecords,
+		"if non-zero, report not ready while fewer than this many records are served.")
+	fs.IntVar(&s.GuardrailMaxRecords, "guardrail-max-records", s.GuardrailMaxRecords,
+		"if non-zero, report not ready while more than this many records are served.")
+	fs.IntVar(&s.GuardrailMaxDeletes, "guardrail-max-deletes", s.GuardrailMaxDeletes,
+		"if non-zero, hold back service and headless endpoints deletions that would remove more than this many"+
+			" records within guardrail-window, until released via /admin/guardrails/override.")
+	fs.DurationVar(&s.GuardrailWindow, "guardrail-window", s.GuardrailWindow,
+		"window over which deleted records are counted against guardrail-max-deletes.")
+	fs.BoolVar(&s.FederationHealthCheck, "federation-health-check", s.FederationHealthCheck,
+		"if true, only redirect federation queries to federations whose domain resolves"+
+			" through the upstream nameservers. Otherwise answer with the local service,"+
+			" or SERVFAIL if there is none.")
+	fs.DurationVar(&s.FederationHealthCheckTTL, "federation-health-check-ttl", s.FederationHealthCheckTTL,
+		"duration for which the result of a federation health check is cached.")
+	fs.DurationVar(&s.FederationHealthCheckTimeout, "federation-health-check-timeout", s.FederationHealthCheckTimeout,
+		"timeout of a federation health check query to a single upstream nameserver.")
+	fs.BoolVar(&s.PeerClusters, "peer-clusters", s.PeerClusters,
+		"if true, resolve <service>.<namespace>.<peer>.remote.<domain> by forwarding the"+
+			" query to the kube-dns of the peer cluster, as listed in the peerClusters"+
+			" of the configuration.")
+	fs.DurationVar(&s.PeerClustersTTL, "peer-clusters-ttl", s.PeerClustersTTL,
+		"maximum duration for which the answers and health checks of the peer clusters are cached.")
+	fs.DurationVar(&s.PeerClustersTimeout, "peer-clusters-timeout", s.PeerClustersTimeout,
+		"timeout of a query to a single nameserver of a peer cluster.")
+	fs.BoolVar(&s.DropTerminatingEndpoints, "drop-terminating-endpoints", s.DropTerminatingEndpoints,
+		"if true, watch EndpointSlices and remove the endpoints that are terminating"+
+			" from headless service records before they are removed from the Endpoints.")
+	fs.BoolVar(&s.ServingTerminatingEndpoints, "serving-terminating-endpoints", s.ServingTerminatingEndpoints,
+		"if true, watch EndpointSlices and keep publishing the not ready endpoints of headless"+
+			" services that are terminating but still serving, e.g. during rollouts."+
+			" Incompatible with --drop-terminating-endpoints.")
+	fs.BoolVar(&s.PodIndex, "pod-index", s.PodIndex,
+		"if true, watch pods to map client IPs to their namespace and pod, as required"+
+			" by features depending on the identity of the client.")
+	fs.StringVar(&s.HeadlessReverseRecords, "headless-reverse-records", s.HeadlessReverseRecords,
+		"which endpoints of headless services get PTR records: \"named\" for the endpoints"+
+			" with a hostname only, \"service\" to also point the others at the service name,"+
+			" or \"endpoint\" to point them at the generated name of their A record.")
+	fs.StringVar(&s.EndpointNaming, "endpoint-naming", s.EndpointNaming,
+		"how the records of the endpoints of headless services without hostname are named, e.g. the"+
+			" targets of their SRV records: \"hash\" for a hash of the record, or \"ip\" for the IP"+
+			" of the endpoint, its dots or colons replaced with dashes, e.g. 10-0-0-1.my-svc.my-ns.svc.cluster.local.")
+	fs.StringVar(&s.UnknownPortProtocols, "unknown-port-protocols", s.UnknownPortProtocols,
+		"SRV records of the named ports whose protocol is not TCP, UDP or SCTP: \"skip\" for none,"+
+			" \"lowercase\" to publish them under the protocol in lower case, or \"tcp\" under _tcp."+
+			" The Services are warned about with an Event for the ports skipped.")
+	fs.DurationVar(&s.CanaryInterval, "canary-interval", s.CanaryInterval,
+		"if non-zero, serve a dns-canary.kube-system.svc TXT record holding the time it was"+
+			" last written through the record cache, rewritten at this interval. Black-box"+
+			" probers can check its age to tell whether records are still being updated.")
+	fs.Var(clusterDomainVar{&s.MultiClusterDomain}, "multicluster-domain",
+		"if set, e.g. clusterset.local, serve the services imported from the clusterset in this domain,"+
+			" from the ServiceImports and EndpointSlices of the Multi-Cluster Services API.")
+	fs.BoolVar(&s.NodeRecords, "node-records", s.NodeRecords,
+		"if true, watch nodes and serve their internal IPs as A and AAAA records,"+
+			" e.g. my-node.node.cluster.local.")
+	fs.BoolVar(&s.DisableWildcards, "disable-wildcards", s.DisableWildcards,
+		"if true, answer the queries with a \"*\" label, e.g. *.default.svc.cluster.local,"+
+			" with NXDOMAIN rather than every matching record, so that services cannot be enumerated.")
+	fs.DurationVar(&s.WildcardQueryTimeout, "wildcard-query-timeout", s.WildcardQueryTimeout,
+		"if non-zero, e.g. 100ms, the time the wildcards of a query are expanded for at most, so that"+
+			" a query matching most records, e.g. *.*.svc.cluster.local, cannot hold the server.")
+	fs.StringVar(&s.WildcardQueryTimeoutAction, "wildcard-query-timeout-action", s.WildcardQueryTimeoutAction,
+		"answer to the wildcard queries timing out: \"truncate\" for the records found so far with the"+
+			" TC bit set, or \"servfail\" for SERVFAIL.")
+	fs.DurationVar(&s.NegativeCacheTTL, "negative-cache-ttl", s.NegativeCacheTTL,
+		"if non-zero, e.g. 5s, how long the names found to have no record, e.g. the search path expansions"+
+			" of the names outside of the cluster, are answered NXDOMAIN without walking the records again."+
+			" The names are forgotten whenever the records change.")
+	fs.IntVar(&s.NegativeCacheSize, "negative-cache-size", s.NegativeCacheSize,
+		"number of names remembered by the negative cache at most, see --negative-cache-ttl.")
+	fs.DurationVar(&s.SOAMinimumTTL, "soa-minimum-ttl", s.SOAMinimumTTL,
+		"MINIMUM field of the SOA records in the authority section of the negative answers, for which"+
+			" the resolvers cache that a name or type does not exist (RFC 2308). Whole seconds.")
+	fs.Uint32Var(&s.SOASerial, "soa-serial", s.SOASerial,
+		"serial of the SOA records. 0 uses the start of the current hour, in Unix time.")
+	fs.StringVar(&s.CustomRecordStore, "custom-record-store", s.CustomRecordStore,
+		"if set, also serve the custom records held by: \"configmap\", the ConfigMaps labeled"+
+			" dns.kubernetes.io/custom-records, one record set per key; \"crd\", the CustomRecordSets"+
+			" of dns.kubernetes.io/v1alpha1, whose CustomResourceDefinition is in"+
+			" pkg/dns/customrecords/customrecordsets.yaml; or \"etcd\", the values of the keys under"+
+			" --custom-record-etcd-prefix. Record sets are in the format of the customRecords ConfigMap key.")
+	fs.StringVar(&s.CustomRecordNamespace, "custom-record-namespace", s.CustomRecordNamespace,
+		"namespace of the ConfigMaps or CustomRecordSets holding custom records, empty for every namespace.")
+	fs.StringSliceVar(&s.CustomRecordEtcdEndpoints, "custom-record-etcd-endpoints", s.CustomRecordEtcdEndpoints,
+		"comma-separated endpoints of the etcd cluster holding custom records.")
+	fs.StringVar(&s.CustomRecordEtcdPrefix, "custom-record-etcd-prefix", s.CustomRecordEtcdPrefix,
+		"etcd prefix of the keys holding custom records.")
+	fs.StringVar(&s.CustomRecordEtcdCAFile, "custom-record-etcd-ca-file", s.CustomRecordEtcdCAFile,
+		"if set, the CA certificates the etcd cluster of --custom-record-etcd-endpoints is verified with,"+
+			" reached over TLS.")
+	fs.StringVar(&s.CustomRecordEtcdCertFile, "custom-record-etcd-cert-file", s.CustomRecordEtcdCertFile,
+		"if set, the client certificate kube-dns authenticates with to the etcd cluster, reached over TLS.")
+	fs.StringVar(&s.CustomRecordEtcdKeyFile, "custom-record-etcd-key-file", s.CustomRecordEtcdKeyFile,
+		"key of the certificate given with --custom-record-etcd-cert-file.")
+	fs.StringVar(&s.ACMEChallengeZone, "acme-challenge-zone", s.ACMEChallengeZone,
+		"if set, e.g. acme, the subdomain of the cluster domain where ACME DNS-01 solvers publish"+
+			" _acme-challenge TXT records through /admin/acme-challenges, removed once their TTL expires.")
+	fs.StringVar(&s.ACMEChallengeConfigMap, "acme-challenge-configmap", s.ACMEChallengeConfigMap,
+		"ConfigMap of --config-map-namespace holding the ACME challenges published by every replica,"+
+			" created as needed.")
+	fs.BoolVar(&s.TenantZones, "tenant-zones", s.TenantZones,
+		"if true, also serve the services of the namespaces labeled dns.kubernetes.io/tenant=<tenant>"+
+			" in the zone of their tenant, e.g. my-svc.my-ns.svc.<tenant>.cluster.local, and refuse"+
+			" the queries of other tenants as configured by the tenantAccess ConfigMap key. Implies --pod-index.")
+	fs.StringSliceVar(&s.TenantTrustedForwarderCIDRs, "tenant-trusted-forwarder-cidrs", s.TenantTrustedForwarderCIDRs,
+		"comma separated list of CIDRs of the forwarders, e.g. the node IPs of the node-local-dns caches,"+
+			" whose queries are not restricted by the tenantAccess ConfigMap key: they forward the queries"+
+			" of the pods of every tenant, which are refused otherwise.")
+	fs.IntVar(&s.EventWorkers, "event-workers", s.EventWorkers,
+		"if non-zero, handle service and endpoints events with this many workers from a"+
+			" rate-limited queue, serialized per service, retrying failed events with backoff."+
+			" Otherwise, events are handled as they are received.")
+	fs.DurationVar(&s.EventCoalescePeriod, "event-coalesce-period", s.EventCoalescePeriod,
+		"how long the events of a service are held before they are handled, so that a burst of"+
+			" endpoints updates, e.g. during a rolling update, rebuilds its records once. Requires"+
+			" --event-workers.")
+	fs.BoolVar(&s.LazySRVRecords, "lazy-srv-records", s.LazySRVRecords,
+		"if true, generate the SRV records of the endpoints of headless services when they are"+
+			" queried rather than keeping them in memory, trading some CPU per SRV query for the"+
+			" memory of the records of every named port of every endpoint.")
+	fs.DurationVar(&s.EndpointsDebounce, "endpoints-debounce", s.EndpointsDebounce,
+		"if non-zero, e.g. 200ms, hold the updates of the endpoints of a service for this long and"+
+			" only apply the last one, so that flapping endpoints, e.g. of crash-looping pods, do not"+
+			" rebuild the records of the service at each update.")
+	fs.DurationVar(&s.CacheMemoryInterval, "cache-memory-interval", s.CacheMemoryInterval,
+		"if non-zero, estimate the memory held by the records at this interval and export it as"+
+			" the kubedns_cache_memory_bytes metric.")
+	fs.DurationVar(&s.InventoryInterval, "inventory-interval", s.InventoryInterval,
+		"if non-zero, export the numbers of records by type, of services by type and of records by"+
+			" namespace at this interval, as the kubedns_inventory_* metrics.")
+	fs.StringVar(&s.CacheMemoryLimit, "cache-memory-limit", s.CacheMemoryLimit,
+		"if set, e.g. 512Mi, log a warning when the estimated memory held by the records exceeds it."+
+			" Requires --cache-memory-interval.")
+	fs.StringVar(&s.RecordsSnapshotFile, "records-snapshot-file", s.RecordsSnapshotFile,
+		"if set, save the records to this file every --records-snapshot-interval, and answer from it"+
+			" at startup, with a short TTL, the names missing until the records are synced.")
+	fs.DurationVar(&s.RecordsSnapshotInterval, "records-snapshot-interval", s.RecordsSnapshotInterval,
+		"interval at which the records are saved to --records-snapshot-file.")
+	fs.DurationVar(&s.RecordsSnapshotMaxAge, "records-snapshot-max-age", s.RecordsSnapshotMaxAge,
+		"if non-zero, ignore the --records-snapshot-file saved longer ago than this at startup.")
+	fs.IntVar(&s.WarmStandbyPort, "warm-standby-port", s.WarmStandbyPort,
+		"if not 0, serve the records over gRPC on this port, once synced, to the replicas starting with"+
+			" --warm-standby-peer. The records are served over TLS to the clients presenting a certificate"+
+			" signed by --warm-standby-ca-file. Requires --warm-standby-tls-cert-file and --warm-standby-tls-key-file.")
+	fs.StringVar(&s.WarmStandbyPeer, "warm-standby-peer", s.WarmStandbyPeer,
+		"if set, the address, host:port, of the --warm-standby-port of the other replicas, e.g. of a Service"+
+			" selecting the ready ones, to receive the records from at startup and answer from, with a"+
+			" short TTL, and be ready while the records are synced.")
+	fs.DurationVar(&s.WarmStandbyTimeout, "warm-standby-timeout", s.WarmStandbyTimeout,
+		"how long to wait for the records of the --warm-standby-peer before syncing them without.")
+	fs.StringVar(&s.WarmStandbyCertFile, "warm-standby-tls-cert-file", s.WarmStandbyCertFile,
+		"certificate the replicas authenticate with to each other on --warm-standby-port, valid for the"+
+			" host of --warm-standby-peer.")
+	fs.StringVar(&s.WarmStandbyKeyFile, "warm-standby-tls-key-file", s.WarmStandbyKeyFile,
+		"key of the certificate given with --warm-standby-tls-cert-file.")
+	fs.StringVar(&s.WarmStandbyCAFile, "warm-standby-ca-file", s.WarmStandbyCAFile,
+		"CAs signing the certificates of the replicas, see --warm-standby-tls-cert-file.")
+	fs.StringSliceVar(&s.WarmStandbyAllowedCIDRs, "warm-standby-allowed-cidrs", s.WarmStandbyAllowedCIDRs,
+		"if set, comma-separated CIDRs of the replicas allowed on --warm-standby-port, e.g. the pod network.")
+	fs.IntVar(&s.ResponseCacheSize, "response-cache-size", s.ResponseCacheSize,
+		"if non-zero, cache up to this many replies for --response-cache-ttl.")
+	fs.DurationVar(&s.ResponseCacheTTL, "response-cache-ttl", s.ResponseCacheTTL,
+		"how long the replies are cached, see --response-cache-size.")
+	fs.IntVar(&s.CacheInvalidationPort, "cache-invalidation-port", s.CacheInvalidationPort,
+		"if not 0, UDP port on which the kube-dns replicas broadcast the names of the changed records"+
+			" to each other, so that every replica invalidates its cached replies within milliseconds."+
+			" Requires --response-cache-size, --cache-invalidation-peers and --cache-invalidation-secret.")
+	fs.StringVar(&s.CacheInvalidationPeers, "cache-invalidation-peers", s.CacheInvalidationPeers,
+		"name of the headless service selecting the kube-dns replicas, e.g."+
+			" kube-dns-peers.kube-system.svc.cluster.local, see --cache-invalidation-port.")
+	fs.StringVar(&s.CacheInvalidationSecret, "cache-invalidation-secret", s.CacheInvalidationSecret,
+		"namespace/name of the Secret whose \"key\", of at least 32 bytes, authenticates the cache"+
+			" invalidations of the replicas with HMAC-SHA256, see --cache-invalidation-port. kube-dns"+
+			" must be allowed to get the Secret.")
+	fs.DurationVar(&s.JanitorInterval, "janitor-interval", s.JanitorInterval,
+		"if non-zero, purge the records of services that no longer exist at this interval,"+
+			" in case their delete event was missed, and remove the names and reverse records"+
+			" of no service from the cache. Purges are subject to the record guardrails.")
+	fs.BoolVar(&s.PodsVerified, "pods-verified", s.PodsVerified,
+		"if true, only answer pod queries, e.g. 1-2-3-4.default.pod.cluster.local, when a pod"+
+			" with that IP exists in the namespace, returning NXDOMAIN otherwise. Implies --pod-index.")
+	fs.BoolVar(&s.PodReverseRecords, "pod-reverse-records", s.PodReverseRecords,
+		"if true, answer the PTR queries of pod IPs with their pod record, e.g."+
+			" 1-2-3-4.default.pod.cluster.local, unless a service record claims the IP. Implies --pod-index.")
+	fs.BoolVar(&s.TopologyAwareAnswers, "topology-aware-answers", s.TopologyAwareAnswers,
+		"if true, watch EndpointSlices and answer pods with the endpoints of headless services"+
+			" on their node first, then in their zone, keeping only the endpoints hinted for"+
+			" their zone when the slices carry topology hints. The pods are found by their address,"+
+			" or the one of the EDNS Client Subnet of their query. Implies --pod-index.")
+	fs.IntVar(&s.QuerySamplerRate, "query-sampler-rate", s.QuerySamplerRate,
+		"if non-zero, sample one query out of this many to find the most queried names,"+
+			" wildcard patterns and NXDOMAIN sources, reported on /admin/querysampler.")
+	fs.IntVar(&s.QuerySamplerTop, "query-sampler-top", s.QuerySamplerTop,
+		"number of names, wildcard patterns and NXDOMAIN sources kept by the query sampler.")
+	fs.DurationVar(&s.QuerySamplerWindow, "query-sampler-window", s.QuerySamplerWindow,
+		"duration of the windows over which the query sampler reports.")
+	s.Mirror.AddFlags(fs)
+	fs.BoolVar(&s.SearchPathMetrics, "search-path-metrics", s.SearchPathMetrics,
+		"if true, export the queries of the pods that are search path expansions of external names,"+
+			" and the resulting amplification factor, by namespace. Watches the pods.")
+	fs.DurationVar(&s.SearchPathWindow, "search-path-window", s.SearchPathWindow,
+		"window over which the search path amplification factors are computed.")
+	fs.BoolVar(&s.SearchPathLogOffenders, "search-path-log-offenders", s.SearchPathLogOffenders,
+		"if true, log the pods that sent the most search path expansions at the end of every"+
+			" --search-path-window. Requires --search-path-metrics.")
+	features.DefaultMutableFeatureGate.AddFlag(fs)
 }
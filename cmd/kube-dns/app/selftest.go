@@ -0,0 +1,36 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"k8s.io/dns/cmd/kube-dns/app/options"
+	"k8s.io/dns/pkg/configcheck"
+	"k8s.io/dns/pkg/selftest"
+)
+
+// SelfTest starts a kube-dns server for the cluster domain against a fake
+// clientset holding fixture objects, and reports the result of a battery
+// of lookups sent to it, for the self-test subcommand.
+func SelfTest(config *options.KubeDNSConfig, report *configcheck.Report) {
+	s, err := selftest.StartKubeDNS(config.ClusterDomain)
+	report.Check("kube-dns server", err)
+	if err != nil {
+		return
+	}
+	defer s.Stop()
+	selftest.Run(s.Addr, selftest.Lookups(config.ClusterDomain), report)
+}
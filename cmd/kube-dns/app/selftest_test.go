@@ -0,0 +1,39 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/dns/cmd/kube-dns/app/options"
+	"k8s.io/dns/pkg/configcheck"
+)
+
+func TestSelfTest(t *testing.T) {
+	config := options.NewKubeDNSConfig()
+	config.ClusterDomain = "example.local."
+
+	var out bytes.Buffer
+	report := configcheck.NewReport(&out)
+	SelfTest(config, report)
+	assert.False(t, report.Failed(), out.String())
+	assert.Contains(t, out.String(), "OK    kube-dns server\n")
+	assert.Contains(t, out.String(), "OK    A web.default.svc.example.local\n")
+}
@@ -17,23 +17,58 @@ limitations under the License.
 package app
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	miekgdns "github.com/miekg/dns"
 	"github.com/spf13/pflag"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 	"k8s.io/dns/third_party/forked/skydns/metrics"
 	"k8s.io/dns/third_party/forked/skydns/server"
 
 	"k8s.io/dns/cmd/kube-dns/app/options"
 	"k8s.io/dns/pkg/dns"
 	dnsconfig "k8s.io/dns/pkg/dns/config"
+	"k8s.io/dns/pkg/dns/customrecords"
+	"k8s.io/dns/pkg/dns/features"
+	"k8s.io/dns/pkg/dns/leases"
+	"k8s.io/dns/pkg/dns/mcs"
+	"k8s.io/dns/pkg/dns/mirror"
+	"k8s.io/dns/pkg/dns/podindex"
+	"k8s.io/dns/pkg/dns/sampler"
+	"k8s.io/dns/pkg/dns/searchpath"
+	"k8s.io/dns/pkg/dns/treecache"
+	"k8s.io/dns/pkg/dns/util"
+	"k8s.io/dns/pkg/effectiveconfig"
+	"k8s.io/dns/pkg/httpaccess"
+	"k8s.io/dns/pkg/tlscert"
 
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -45,22 +80,110 @@ const profilingPort = "6060"
 
 type KubeDNSServer struct {
 	// DNS domain name.
-	domain         string
-	healthzPort    int
+	domain      string
+	healthzPort int
+	// admin guards the healthz, metrics and admin endpoints.
+	admin          *httpaccess.Guard
 	dnsBindAddress string
 	dnsPort        int
+	disableUDP     bool
+	disableTCP     bool
+	noCompress     bool
+	chaseCNAME     bool
+	answerOrder    server.AnswerOrder
+	maxAnswers     int
+	reverseCIDRs   []string
+	transferCIDRs  []string
 	nameServers    string
-	kd             *dns.KubeDNS
-	profiling      bool
+	// reusePort and socketActivation set how the DNS sockets are bound.
+	reusePort        bool
+	socketActivation bool
+	// doh, if set, guards the DNS over HTTPS endpoint on dohPort, and
+	// dohTokenReviewer, if set, authenticates its clients.
+	dohPort          int
+	doh              *httpaccess.Guard
+	dohTokenReviewer *httpaccess.TokenReviewer
+	// recordLeaseTokenReviewer authenticates the holders of the record
+	// leases presenting a bearer token.
+	recordLeaseTokenReviewer *httpaccess.TokenReviewer
+	// dot, if set, is the certificate of the DNS over TLS endpoint on
+	// dotPort, reloaded every dotReloadPeriod.
+	dotPort         int
+	dot             *tlscert.Source
+	dotReloadPeriod time.Duration
+	// dnssecKey and dnssecSigner, if set, sign the answers of the cluster
+	// domain, denying with NSEC rather than NSEC3 if dnssecNSEC.
+	dnssecKey    *miekgdns.DNSKEY
+	dnssecSigner crypto.Signer
+	dnssecNSEC   bool
+	// soaMinimumTTL and soaSerial set the SOA records.
+	soaMinimumTTL time.Duration
+	soaSerial     uint32
+	// grpc, if set, guards the gRPC DNS endpoint on grpcPort.
+	grpcPort int
+	grpc     *httpaccess.Guard
+	// ixfrJournal, notify and journalInterval set the journal of the
+	// changes of the cluster domain, for IXFR and NOTIFY, notifyLeader the
+	// replica notifying the secondaries.
+	ixfrJournal     int
+	notify          []string
+	notifyLeader    *dns.NotifyLeader
+	journalInterval time.Duration
+	// tsigSecret are the TSIG keys, by name, transferKeys sign the transfers
+	// and forwardKey the forwarded queries.
+	tsigSecret   map[string]string
+	transferKeys []string
+	forwardKey   string
+	// ecsForward is what is done with the client subnets forwarded,
+	// truncated to ecsPrefixV4 and ecsPrefixV6 when replaced.
+	ecsForward  server.SubnetPolicy
+	ecsPrefixV4 int
+	ecsPrefixV6 int
+	// responseCacheSize replies are cached for responseCacheTTL.
+	responseCacheSize int
+	responseCacheTTL  time.Duration
+	// Persistent TCP connections to the upstream nameservers.
+	upstreamConns       int
+	upstreamPipeline    int
+	upstreamIdleTimeout time.Duration
+	raceUpstreams       bool
+	// upstreamTLS, if set, forwards the queries to the upstream
+	// nameservers over TLS.
+	upstreamTLS *tls.Config
+	kd          *dns.KubeDNS
+	// backend routes queries to the Backend of their zone, kd answers
+	// every other name.
+	backend   *server.BackendMux
+	profiling bool
+	// sampler, if set, samples the queries served.
+	sampler *sampler.Sampler
+	// mirror, if set, mirrors a sample of the queries to a sink.
+	mirror *mirror.Mirror
+	// searchPath, if set, detects the search path expansions.
+	searchPath *searchpath.Detector
+	// forwardOverrides are the forwarders of zones overridden through the
+	// admin API.
+	forwardOverrides *server.ForwardOverrides
+	// configSource is where the dynamic configuration comes from.
+	configSource effectiveconfig.Source
+	// warmStandbyPort, if not 0, serves the records to the starting
+	// replicas, through the warmStandby Guard.
+	warmStandbyPort int
+	warmStandby     *httpaccess.Guard
 }
 
 func NewKubeDNSServerDefault(config *options.KubeDNSConfig) *KubeDNSServer {
-	kubeClient, err := newKubeClient(config)
+	restConfig, err := newRestConfig(config)
+	if err != nil {
+		klog.Fatalf("Failed to create a kubernetes client: %v", err)
+	}
+	kubeClient, err := kubernetes.NewForConfig(restConfig)
 	if err != nil {
 		klog.Fatalf("Failed to create a kubernetes client: %v", err)
 	}
 
 	var configSync dnsconfig.Sync
+	configSource := effectiveconfig.ConfigMap
 	switch {
 	case config.ConfigMap != "" && config.ConfigDir != "":
 		klog.Fatal("Cannot use both ConfigMap and ConfigDir")
@@ -75,25 +198,772 @@ func NewKubeDNSServerDefault(config *options.KubeDNSConfig) *KubeDNSServer {
 
 	default:
 		klog.V(0).Infof("ConfigMap and ConfigDir not configured, using values from command line flags")
+		configSource = effectiveconfig.Flag
 		conf := dnsconfig.Config{Federations: config.Federations}
 		if len(config.NameServers) > 0 {
 			conf.UpstreamNameservers = strings.Split(config.NameServers, ",")
 		}
 		configSync = dnsconfig.NewNopSync(&conf)
 	}
+	applyInitialFeatureGates(configSync)
+
+	kd := dns.NewKubeDNS(kubeClient, config.ClusterDomain, config.InitialSyncTimeout, configSync)
+	if config.AuditLogPath != "" {
+		kd.AuditLog = newAuditLog(config.AuditLogPath)
+	}
+	if config.RecordWatch {
+		kd.RecordWatch = dns.NewRecordWatch()
+	}
+	kd.RecordLeases = config.RecordLeases
+	var recordLeaseTokenReviewer *httpaccess.TokenReviewer
+	if config.RecordLeases {
+		kd.RecordLeaseStore = dns.NewRecordLeaseStore(kubeClient, config.ConfigMapNs)
+		recordLeaseTokenReviewer = httpaccess.NewTokenReviewer(kubeClient.AuthenticationV1().TokenReviews(), nil, nil, recordLeaseTokenCacheTTL)
+	}
+	if config.GuardrailMinRecords > 0 || config.GuardrailMaxRecords > 0 || config.GuardrailMaxDeletes > 0 {
+		klog.V(0).Infof("Record guardrails enabled (min records: %d, max records: %d, max deletes: %d per %v)",
+			config.GuardrailMinRecords, config.GuardrailMaxRecords, config.GuardrailMaxDeletes, config.GuardrailWindow)
+		kd.Guardrails = dns.NewGuardrails(config.GuardrailMinRecords, config.GuardrailMaxRecords,
+			config.GuardrailMaxDeletes, config.GuardrailWindow)
+	}
+	if config.DropTerminatingEndpoints && config.ServingTerminatingEndpoints {
+		klog.Fatalf("--drop-terminating-endpoints and --serving-terminating-endpoints are mutually exclusive")
+	}
+	if err := checkEndpointSlices(config); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	kd.DropTerminatingEndpoints = config.DropTerminatingEndpoints
+	kd.ServingTerminatingEndpoints = config.ServingTerminatingEndpoints
+	kd.CanaryInterval = config.CanaryInterval
+	kd.ResyncPeriod = config.ResyncPeriod
+	kd.JanitorInterval = config.JanitorInterval
+	kd.CacheMemoryInterval = config.CacheMemoryInterval
+	kd.InventoryInterval = config.InventoryInterval
+	if kd.CacheMemoryLimit, err = parseCacheMemoryLimit(config); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	if err := checkCacheInvalidation(config); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	if config.CacheInvalidationPort != 0 {
+		if kd.RecordWatch == nil {
+			kd.RecordWatch = dns.NewRecordWatch()
+		}
+		key, err := loadCacheInvalidationKey(config, kubeClient)
+		if err != nil {
+			klog.Fatalf("Invalid cache invalidation configuration: %v", err)
+		}
+		if kd.CacheInvalidation, err = dns.NewCacheInvalidation(config.CacheInvalidationPort, config.CacheInvalidationPeers, key); err != nil {
+			klog.Fatalf("%v", err)
+		}
+	}
+	if config.RecordsSnapshotFile != "" && config.RecordsSnapshotInterval <= 0 {
+		klog.Fatalf("--records-snapshot-interval must be positive")
+	}
+	warmStandby, err := newWarmStandbyGuard(config)
+	if err != nil {
+		klog.Fatalf("Invalid warm standby configuration: %v", err)
+	}
+	kd.WarmStandbyPeer = config.WarmStandbyPeer
+	kd.WarmStandbyTimeout = config.WarmStandbyTimeout
+	if warmStandby != nil {
+		kd.WarmStandbyTLS = warmStandby.PeerTLSConfig()
+	}
+	kd.RecordsSnapshotFile = config.RecordsSnapshotFile
+	kd.RecordsSnapshotInterval = config.RecordsSnapshotInterval
+	kd.RecordsSnapshotMaxAge = config.RecordsSnapshotMaxAge
+	kd.EventWorkers = config.EventWorkers
+	kd.EventCoalescePeriod = config.EventCoalescePeriod
+	kd.EndpointsDebounce = config.EndpointsDebounce
+	kd.LazySRV = config.LazySRVRecords
+	if kd.HeadlessReverseRecords, err = dns.ParseHeadlessReverseRecords(config.HeadlessReverseRecords); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	if kd.EndpointNaming, err = dns.ParseEndpointNaming(config.EndpointNaming); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	if kd.UnknownProtocols, err = dns.ParseUnknownProtocolPolicy(config.UnknownPortProtocols); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	if config.PodIndex || config.PodsVerified || config.PodReverseRecords || config.TopologyAwareAnswers || config.TenantZones ||
+		config.SearchPathMetrics || features.Enabled(features.Autopath) {
+		kd.PodIndex = podindex.NewPodIndex(kubeClient, 0)
+	}
+	kd.PodsVerified = config.PodsVerified
+	kd.PodReverseRecords = config.PodReverseRecords
+	kd.TopologyAwareAnswers = config.TopologyAwareAnswers
+	kd.TenantZones = config.TenantZones
+	if kd.TrustedForwarders, err = parseCIDRs(config.TenantTrustedForwarderCIDRs); err != nil {
+		klog.Fatalf("Invalid --tenant-trusted-forwarder-cidrs: %v", err)
+	}
+	kd.NodeRecords = config.NodeRecords
+	kd.DisableWildcards = config.DisableWildcards
+	kd.WildcardQueryTimeout = config.WildcardQueryTimeout
+	kd.NegativeCacheTTL = config.NegativeCacheTTL
+	kd.NegativeCacheSize = config.NegativeCacheSize
+	if kd.WildcardTimeoutAction, err = dns.ParseWildcardTimeoutAction(config.WildcardQueryTimeoutAction); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	if err := checkExtraDomains(config); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	if len(config.ExtraDomains) > 0 {
+		klog.V(0).Infof("Serving the cluster domain in %v as well", config.ExtraDomains)
+		kd.ExtraDomains = config.ExtraDomains
+	}
+	if config.MultiClusterDomain != "" {
+		klog.V(0).Infof("Serving the services imported from the clusterset in %v", config.MultiClusterDomain)
+		kd.MultiClusterDomain = config.MultiClusterDomain
+		if kd.MultiClusterClient, err = mcs.NewForConfig(restConfig); err != nil {
+			klog.Fatalf("Failed to create a multicluster client: %v", err)
+		}
+	}
+	if err := checkACMEChallengeZone(config); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	kd.ACMEChallengeZone = strings.ToLower(strings.Trim(config.ACMEChallengeZone, "."))
+	if kd.ACMEChallengeZone != "" {
+		kd.ACMEChallengeStore = dns.NewACMEChallengeStore(kubeClient, config.ConfigMapNs, config.ACMEChallengeConfigMap)
+	}
+	if kd.CustomRecordStore, err = newCustomRecordStore(config, kubeClient, restConfig); err != nil {
+		klog.Fatalf("Failed to create the custom record store: %v", err)
+	}
+	if config.FederationHealthCheck {
+		kd.FederationHealth = dns.NewFederationHealthCheck(config.FederationHealthCheckTTL, config.FederationHealthCheckTimeout)
+	}
+	if config.PeerClusters {
+		kd.PeerClusters = dns.NewPeerClusters(config.PeerClustersTTL, config.PeerClustersTimeout)
+	}
+
+	answerOrder, err := server.ParseAnswerOrder(config.AnswerOrder)
+	if err != nil {
+		klog.Fatalf("%v", err)
+	}
+
+	adminConfig := config.Admin
+	adminConfig.ReusePort = config.ReusePort
+	admin, err := httpaccess.New(adminConfig)
+	if err != nil {
+		klog.Fatalf("Invalid access configuration of the HTTP endpoints: %v", err)
+	}
+
+	doh, err := newDoHGuard(config)
+	if err != nil {
+		klog.Fatalf("Invalid DNS over HTTPS configuration: %v", err)
+	}
+	var dohTokenReviewer *httpaccess.TokenReviewer
+	if config.DoHTokenReview {
+		dohTokenReviewer = httpaccess.NewTokenReviewer(kubeClient.AuthenticationV1().TokenReviews(),
+			config.DoHTokenAudiences, config.DoHAllowedGroups, config.DoHTokenCacheTTL)
+	}
+
+	dot, err := newDoTSource(config, kubeClient)
+	if err != nil {
+		klog.Fatalf("Invalid DNS over TLS configuration: %v", err)
+	}
+	dnssecKey, dnssecSigner, err := loadDNSSECKey(config, kubeClient)
+	if err != nil {
+		klog.Fatalf("Invalid DNSSEC configuration: %v", err)
+	}
+	tsigSecret, err := loadTsigSecret(config, kubeClient)
+	if err != nil {
+		klog.Fatalf("Invalid TSIG configuration: %v", err)
+	}
+	grpcGuard, err := newGRPCGuard(config)
+	if err != nil {
+		klog.Fatalf("Invalid gRPC DNS configuration: %v", err)
+	}
+	upstreamTLS, err := loadUpstreamTLS(config)
+	if err != nil {
+		klog.Fatalf("Invalid upstream TLS configuration: %v", err)
+	}
+	var notifyLeader *dns.NotifyLeader
+	if len(config.TransferNotify) > 0 {
+		identity, err := os.Hostname()
+		if err != nil {
+			klog.Fatalf("Failed to get the hostname identifying the replica: %v", err)
+		}
+		notifyLeader = dns.NewNotifyLeader(kubeClient, config.ConfigMapNs, config.TransferNotifyLease, identity)
+	}
+
+	var querySampler *sampler.Sampler
+	if config.QuerySamplerRate > 0 {
+		querySampler = sampler.NewSampler(config.QuerySamplerRate, config.QuerySamplerTop,
+			config.QuerySamplerWindow, resolvePodName(kd.PodIndex))
+	}
+
+	var searchPath *searchpath.Detector
+	if config.SearchPathMetrics {
+		if config.SearchPathWindow <= 0 {
+			klog.Fatalf("--search-path-window must be positive")
+		}
+		searchPath = searchpath.NewDetector(config.ClusterDomain, config.SearchPathWindow,
+			resolvePodName(kd.PodIndex), config.SearchPathLogOffenders)
+	}
+
+	var queryMirror *mirror.Mirror
+	if config.Mirror.Sink != "" {
+		if err := config.Mirror.Validate(); err != nil {
+			klog.Fatalf("%v", err)
+		}
+		sink, err := mirror.NewSink(config.Mirror.Sink)
+		if err != nil {
+			klog.Fatalf("%v", err)
+		}
+		queryMirror = mirror.NewMirror(config.Mirror, sink)
+	}
 
 	return &KubeDNSServer{
 		domain:         config.ClusterDomain,
 		healthzPort:    config.HealthzPort,
+		admin:          admin,
 		dnsBindAddress: config.DNSBindAddress,
 		dnsPort:        config.DNSPort,
+		disableUDP:     config.DisableUDP,
+		disableTCP:     config.DisableTCP,
+		noCompress:     config.DisableCompression,
+		chaseCNAME:     config.ChaseCNAME,
+		answerOrder:    answerOrder,
+		maxAnswers:     config.MaxAnswers,
+		reverseCIDRs:   config.ReverseCIDRs,
+		transferCIDRs:  config.TransferCIDRs,
 		nameServers:    config.NameServers,
-		kd:             dns.NewKubeDNS(kubeClient, config.ClusterDomain, config.InitialSyncTimeout, configSync),
+		kd:             kd,
+		backend:        server.NewBackendMux(kd),
 		profiling:      config.Profiling,
+		sampler:        querySampler,
+		mirror:         queryMirror,
+		searchPath:     searchPath,
+
+		reusePort:        config.ReusePort,
+		socketActivation: config.SocketActivation,
+
+		dohPort:          config.DoHPort,
+		doh:              doh,
+		dohTokenReviewer: dohTokenReviewer,
+
+		recordLeaseTokenReviewer: recordLeaseTokenReviewer,
+
+		dotPort:         config.DoTPort,
+		dot:             dot,
+		dotReloadPeriod: config.DoTCertReloadPeriod,
+
+		dnssecKey:    dnssecKey,
+		dnssecSigner: dnssecSigner,
+		dnssecNSEC:   config.DNSSECDenial == "nsec",
+
+		soaMinimumTTL: config.SOAMinimumTTL,
+		soaSerial:     config.SOASerial,
+
+		grpcPort: config.GRPCPort,
+		grpc:     grpcGuard,
+
+		ixfrJournal:     config.TransferIXFRJournal,
+		notify:          config.TransferNotify,
+		notifyLeader:    notifyLeader,
+		journalInterval: config.TransferJournalInterval,
+
+		tsigSecret:   tsigSecret,
+		transferKeys: config.TransferTsigKeys,
+		forwardKey:   config.ForwardTsigKey,
+
+		ecsForward:  server.SubnetPolicy(config.ECSForward),
+		ecsPrefixV4: config.ECSPrefixV4,
+		ecsPrefixV6: config.ECSPrefixV6,
+
+		responseCacheSize: config.ResponseCacheSize,
+		responseCacheTTL:  config.ResponseCacheTTL,
+
+		forwardOverrides:    server.NewForwardOverrides(),
+		configSource:        configSource,
+		upstreamConns:       config.UpstreamConns,
+		upstreamPipeline:    config.UpstreamPipeline,
+		upstreamIdleTimeout: config.UpstreamIdleTimeout,
+		raceUpstreams:       config.RaceUpstreams,
+		upstreamTLS:         upstreamTLS,
+
+		warmStandbyPort: config.WarmStandbyPort,
+		warmStandby:     warmStandby,
+	}
+}
+
+// resolvePodName returns a function naming the pod of a client IP, nil if
+// there is no pod index.
+func resolvePodName(index *podindex.PodIndex) func(string) (string, bool) {
+	if index == nil {
+		return nil
+	}
+	return func(ip string) (string, bool) {
+		pod, ok := index.Lookup(ip)
+		return pod.Namespace + "/" + pod.Name, ok
+	}
+}
+
+func newAuditLog(path string) *dns.AuditLog {
+	if path == "-" {
+		klog.V(0).Infof("Writing record audit log to stdout")
+		return dns.NewAuditLog(os.Stdout)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		klog.Fatalf("Failed to open audit log %q: %v", path, err)
+	}
+	klog.V(0).Infof("Writing record audit log to %v", path)
+	return dns.NewAuditLog(f)
+}
+
+// checkCustomRecordStore returns an error if the custom record store flags
+// are invalid.
+func checkCustomRecordStore(config *options.KubeDNSConfig) error {
+	etcdTLS := config.CustomRecordEtcdCAFile != "" || config.CustomRecordEtcdCertFile != "" || config.CustomRecordEtcdKeyFile != ""
+	switch config.CustomRecordStore {
+	case "", "configmap", "crd":
+		if etcdTLS {
+			return fmt.Errorf("--custom-record-etcd-ca-file, --custom-record-etcd-cert-file and --custom-record-etcd-key-file require --custom-record-store=etcd")
+		}
+		return nil
+	case "etcd":
+		if len(config.CustomRecordEtcdEndpoints) == 0 {
+			return fmt.Errorf("--custom-record-store=etcd requires --custom-record-etcd-endpoints")
+		}
+		if (config.CustomRecordEtcdCertFile == "") != (config.CustomRecordEtcdKeyFile == "") {
+			return fmt.Errorf("--custom-record-etcd-cert-file and --custom-record-etcd-key-file must be set together")
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid --custom-record-store %q, must be configmap, crd or etcd", config.CustomRecordStore)
+}
+
+// checkACMEChallengeZone returns an error if the ACME challenge zone is not
+// a subdomain of the cluster domain that kube-dns can dedicate to the
+// challenges.
+func checkACMEChallengeZone(config *options.KubeDNSConfig) error {
+	zone := strings.ToLower(strings.Trim(config.ACMEChallengeZone, "."))
+	if zone == "" {
+		return nil
+	}
+	if errs := validation.IsDNS1123Subdomain(zone); len(errs) > 0 {
+		return fmt.Errorf("invalid --acme-challenge-zone %q: %s", config.ACMEChallengeZone, strings.Join(errs, ", "))
+	}
+	top := zone[strings.LastIndex(zone, ".")+1:]
+	if top == "svc" || top == "pod" || (config.NodeRecords && top == "node") {
+		return fmt.Errorf("--acme-challenge-zone %q overlaps with the %s records", config.ACMEChallengeZone, top)
+	}
+	if errs := validation.IsDNS1123Subdomain(config.ACMEChallengeConfigMap); len(errs) > 0 {
+		return fmt.Errorf("invalid --acme-challenge-configmap %q: %s", config.ACMEChallengeConfigMap, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// parseCacheMemoryLimit returns the limit of the memory held by the records
+// in bytes, 0 if there is none.
+func parseCacheMemoryLimit(config *options.KubeDNSConfig) (int64, error) {
+	if config.CacheMemoryLimit == "" {
+		return 0, nil
+	}
+	limit, err := resource.ParseQuantity(config.CacheMemoryLimit)
+	if err != nil {
+		return 0, fmt.Errorf("invalid --cache-memory-limit %q: %w", config.CacheMemoryLimit, err)
+	}
+	if limit.Sign() <= 0 {
+		return 0, fmt.Errorf("--cache-memory-limit must be positive")
+	}
+	if config.CacheMemoryInterval <= 0 {
+		return 0, fmt.Errorf("--cache-memory-limit requires --cache-memory-interval")
+	}
+	return limit.Value(), nil
+}
+
+// checkCacheInvalidation returns an error if the response cache and cache
+// invalidation flags are invalid.
+func checkCacheInvalidation(config *options.KubeDNSConfig) error {
+	if config.ResponseCacheSize < 0 {
+		return fmt.Errorf("--response-cache-size cannot be negative")
+	}
+	if config.ResponseCacheSize > 0 && config.ResponseCacheTTL < time.Second {
+		return fmt.Errorf("--response-cache-ttl must be at least 1s")
+	}
+	if config.CacheInvalidationPort == 0 {
+		return nil
+	}
+	if config.CacheInvalidationPort < 0 || config.CacheInvalidationPort > 65535 {
+		return fmt.Errorf("invalid --cache-invalidation-port %d", config.CacheInvalidationPort)
+	}
+	if config.ResponseCacheSize == 0 {
+		return fmt.Errorf("--cache-invalidation-port requires --response-cache-size")
+	}
+	if config.CacheInvalidationPeers == "" {
+		return fmt.Errorf("--cache-invalidation-port requires --cache-invalidation-peers")
+	}
+	if config.CacheInvalidationSecret == "" {
+		return fmt.Errorf("--cache-invalidation-port requires --cache-invalidation-secret")
+	}
+	_, _, err := splitSecretName("--cache-invalidation-secret", config.CacheInvalidationSecret)
+	return err
+}
+
+// cacheInvalidationKeySize is the smallest key authenticating the cache
+// invalidations, the size of their HMAC-SHA256.
+const cacheInvalidationKeySize = 32
+
+// loadCacheInvalidationKey returns the key authenticating the cache
+// invalidations, from the Secret given with --cache-invalidation-secret.
+func loadCacheInvalidationKey(config *options.KubeDNSConfig, kubeClient kubernetes.Interface) ([]byte, error) {
+	namespace, name, err := splitSecretName("--cache-invalidation-secret", config.CacheInvalidationSecret)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := kubeClient.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the cache invalidation key: %w", err)
+	}
+	key := secret.Data["key"]
+	if len(key) < cacheInvalidationKeySize {
+		return nil, fmt.Errorf("the key of Secret %s must be at least %d bytes", config.CacheInvalidationSecret, cacheInvalidationKeySize)
+	}
+	return key, nil
+}
+
+// checkWarmStandby returns an error if the warm standby flags are invalid.
+func checkWarmStandby(config *options.KubeDNSConfig) error {
+	if config.WarmStandbyPort < 0 || config.WarmStandbyPort > 65535 {
+		return fmt.Errorf("invalid --warm-standby-port %d", config.WarmStandbyPort)
+	}
+	if config.WarmStandbyPort == 0 && config.WarmStandbyPeer == "" {
+		if config.WarmStandbyCertFile != "" || config.WarmStandbyKeyFile != "" || config.WarmStandbyCAFile != "" || len(config.WarmStandbyAllowedCIDRs) > 0 {
+			return fmt.Errorf("--warm-standby-tls-cert-file, --warm-standby-tls-key-file, --warm-standby-ca-file and --warm-standby-allowed-cidrs require --warm-standby-port or --warm-standby-peer")
+		}
+		return nil
+	}
+	if config.WarmStandbyCertFile == "" || config.WarmStandbyKeyFile == "" || config.WarmStandbyCAFile == "" {
+		return fmt.Errorf("--warm-standby-port and --warm-standby-peer require --warm-standby-tls-cert-file, --warm-standby-tls-key-file and --warm-standby-ca-file")
+	}
+	if config.WarmStandbyPeer == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(config.WarmStandbyPeer); err != nil {
+		return fmt.Errorf("invalid --warm-standby-peer %q: %w", config.WarmStandbyPeer, err)
+	}
+	if config.WarmStandbyTimeout <= 0 {
+		return fmt.Errorf("--warm-standby-timeout must be positive")
+	}
+	return nil
+}
+
+// newWarmStandbyGuard returns the Guard of the warm standby port and of the
+// connections to the peers, nil if neither is set.
+func newWarmStandbyGuard(config *options.KubeDNSConfig) (*httpaccess.Guard, error) {
+	if err := checkWarmStandby(config); err != nil {
+		return nil, err
+	}
+	if config.WarmStandbyPort == 0 && config.WarmStandbyPeer == "" {
+		return nil, nil
+	}
+	return httpaccess.New(httpaccess.Config{
+		AllowedCIDRs: config.WarmStandbyAllowedCIDRs,
+		CertFile:     config.WarmStandbyCertFile,
+		KeyFile:      config.WarmStandbyKeyFile,
+		ClientCAFile: config.WarmStandbyCAFile,
+		ReusePort:    config.ReusePort,
+	})
+}
+
+// applyInitialFeatureGates applies the feature gates of the initial
+// configuration, so that the gates read at startup, e.g. DNSOverTLS, take
+// their value from the ConfigMap as well as from --feature-gates.
+func applyInitialFeatureGates(configSync dnsconfig.Sync) {
+	initialConfig, err := configSync.Once()
+	if err != nil {
+		klog.Errorf("Error getting initial ConfigMap: %v, starting with the --feature-gates flag", err)
+		return
+	}
+	if err := features.ApplyConfig(initialConfig.FeatureGates); err != nil {
+		klog.Errorf("Invalid feature gates %v: %v", initialConfig.FeatureGates, err)
+		return
+	}
+	klog.V(0).Infof("Feature gates: %v", features.String())
+}
+
+// checkEndpointSlices returns an error if the flags watching EndpointSlices
+// are set while the EndpointSlices feature gate is disabled.
+func checkEndpointSlices(config *options.KubeDNSConfig) error {
+	if features.Enabled(features.EndpointSlices) {
+		return nil
+	}
+	if config.DropTerminatingEndpoints || config.ServingTerminatingEndpoints || config.TopologyAwareAnswers || config.MultiClusterDomain != "" {
+		return fmt.Errorf("--drop-terminating-endpoints, --serving-terminating-endpoints, --topology-aware-answers and --multicluster-domain require the EndpointSlices feature gate")
+	}
+	return nil
+}
+
+// checkDoT returns an error if the DNS over TLS flags are invalid.
+func checkDoT(config *options.KubeDNSConfig) error {
+	if config.DoTPort < 0 || config.DoTPort > 65535 {
+		return fmt.Errorf("invalid --dot-port %d", config.DoTPort)
+	}
+	files := config.DoTCertFile != "" || config.DoTKeyFile != ""
+	if config.DoTPort != 0 && !features.Enabled(features.DNSOverTLS) {
+		return fmt.Errorf("--dot-port requires the DNSOverTLS feature gate")
+	}
+	if config.DoTPort == 0 {
+		if files || config.DoTSecret != "" {
+			return fmt.Errorf("--dot-tls-cert-file, --dot-tls-key-file and --dot-tls-secret require --dot-port")
+		}
+		return nil
+	}
+	switch {
+	case files && config.DoTSecret != "":
+		return fmt.Errorf("--dot-tls-secret cannot be set with --dot-tls-cert-file and --dot-tls-key-file")
+	case files && (config.DoTCertFile == "" || config.DoTKeyFile == ""):
+		return fmt.Errorf("--dot-tls-cert-file and --dot-tls-key-file must be set together")
+	case !files && config.DoTSecret == "":
+		return fmt.Errorf("--dot-port requires --dot-tls-cert-file and --dot-tls-key-file, or --dot-tls-secret")
+	}
+	if config.DoTSecret != "" {
+		if _, _, err := splitSecretName("--dot-tls-secret", config.DoTSecret); err != nil {
+			return err
+		}
+	}
+	if config.DoTCertReloadPeriod <= 0 {
+		return fmt.Errorf("--dot-tls-reload-period must be positive")
+	}
+	return nil
+}
+
+// newDoTSource returns the certificate of the DNS over TLS endpoint, nil if
+// it is not enabled, or an error if its flags are invalid or it cannot be
+// loaded.
+func newDoTSource(config *options.KubeDNSConfig, kubeClient kubernetes.Interface) (*tlscert.Source, error) {
+	if err := checkDoT(config); err != nil {
+		return nil, err
+	}
+	if config.DoTPort == 0 {
+		return nil, nil
+	}
+	if config.DoTSecret == "" {
+		return tlscert.NewFileSource(config.DoTCertFile, config.DoTKeyFile)
+	}
+	namespace, name, _ := strings.Cut(config.DoTSecret, "/")
+	return tlscert.NewSecretSource(kubeClient, namespace, name)
+}
+
+// splitSecretName returns the namespace and name of the Secret given with
+// flag, or an error if it is not namespace/name.
+func splitSecretName(flag, secret string) (string, string, error) {
+	namespace, name, ok := strings.Cut(secret, "/")
+	if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return "", "", fmt.Errorf("invalid %s %q, must be namespace/name", flag, secret)
+	}
+	return namespace, name, nil
+}
+
+// checkDNSSEC returns an error if the DNSSEC flags are invalid.
+func checkDNSSEC(config *options.KubeDNSConfig) error {
+	if config.DNSSECDenial != "nsec" && config.DNSSECDenial != "nsec3" {
+		return fmt.Errorf("invalid --dnssec-denial %q, must be nsec or nsec3", config.DNSSECDenial)
+	}
+	if config.DNSSECKeySecret == "" {
+		return nil
+	}
+	_, _, err := splitSecretName("--dnssec-key-secret", config.DNSSECKeySecret)
+	return err
+}
+
+// loadDNSSECKey returns the zone signing key in the Secret given with
+// --dnssec-key-secret, nil if it is not set, or an error if the flags are
+// invalid or the key cannot be loaded.
+func loadDNSSECKey(config *options.KubeDNSConfig, kubeClient kubernetes.Interface) (*miekgdns.DNSKEY, crypto.Signer, error) {
+	if err := checkDNSSEC(config); err != nil || config.DNSSECKeySecret == "" {
+		return nil, nil, err
+	}
+	namespace, name, _ := splitSecretName("--dnssec-key-secret", config.DNSSECKeySecret)
+	secret, err := kubeClient.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get the zone signing key: %w", err)
+	}
+	key, signer, err := server.ParseKey(secret.Data["zsk.key"], secret.Data["zsk.private"], "zsk")
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid zone signing key in Secret %s: %w", config.DNSSECKeySecret, err)
+	}
+	klog.V(0).Infof("Signing the answers of %s with the key %d of Secret %s", key.Hdr.Name, key.KeyTag(), config.DNSSECKeySecret)
+	return key, signer, nil
+}
+
+// checkTsig returns an error if the TSIG flags are invalid.
+func checkTsig(config *options.KubeDNSConfig) error {
+	if config.TsigSecret == "" {
+		if len(config.TransferTsigKeys) > 0 || config.ForwardTsigKey != "" {
+			return fmt.Errorf("--transfer-tsig-keys and --forward-tsig-key require --tsig-secret")
+		}
+		return nil
+	}
+	if config.ForwardTsigKey != "" && config.UpstreamConns > 0 {
+		return fmt.Errorf("--forward-tsig-key and --upstream-conns are mutually exclusive")
 	}
+	_, _, err := splitSecretName("--tsig-secret", config.TsigSecret)
+	return err
 }
 
-func newKubeClient(dnsConfig *options.KubeDNSConfig) (kubernetes.Interface, error) {
+// loadUpstreamTLS returns the TLS configuration the queries are forwarded
+// to the upstream nameservers with, nil if --upstream-tls-server-name is
+// not set, or an error if the flags are invalid or the CA cannot be loaded.
+func loadUpstreamTLS(config *options.KubeDNSConfig) (*tls.Config, error) {
+	if config.UpstreamTLSServerName == "" {
+		if config.UpstreamTLSCAFile != "" {
+			return nil, fmt.Errorf("--upstream-tls-ca-file requires --upstream-tls-server-name")
+		}
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{ServerName: config.UpstreamTLSServerName, MinVersion: tls.VersionTLS12}
+	if config.UpstreamTLSCAFile != "" {
+		pem, err := os.ReadFile(config.UpstreamTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in the CA %q", config.UpstreamTLSCAFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// loadTsigSecret returns the secrets, base64, of the TSIG keys in the
+// Secret given with --tsig-secret, nil if it is not set, or an error if the
+// flags are invalid or the keys cannot be loaded.
+func loadTsigSecret(config *options.KubeDNSConfig, kubeClient kubernetes.Interface) (map[string]string, error) {
+	if err := checkTsig(config); err != nil || config.TsigSecret == "" {
+		return nil, err
+	}
+	namespace, name, _ := splitSecretName("--tsig-secret", config.TsigSecret)
+	secret, err := kubeClient.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the TSIG keys: %w", err)
+	}
+	if len(secret.Data) == 0 {
+		return nil, fmt.Errorf("no TSIG key in Secret %s", config.TsigSecret)
+	}
+	secrets := make(map[string]string, len(secret.Data))
+	for key, value := range secret.Data {
+		secrets[miekgdns.CanonicalName(key)] = base64.StdEncoding.EncodeToString(value)
+	}
+	for _, key := range append([]string{config.ForwardTsigKey}, config.TransferTsigKeys...) {
+		if _, ok := secrets[miekgdns.CanonicalName(key)]; key != "" && !ok {
+			return nil, fmt.Errorf("no TSIG key %s in Secret %s", key, config.TsigSecret)
+		}
+	}
+	klog.V(0).Infof("Verifying the TSIG records with the %d keys of Secret %s", len(secrets), config.TsigSecret)
+	return secrets, nil
+}
+
+// newDoHGuard returns the Guard of the DNS over HTTPS endpoint, nil if it is
+// not enabled, or an error if its flags are invalid.
+func newDoHGuard(config *options.KubeDNSConfig) (*httpaccess.Guard, error) {
+	if config.DoHPort == 0 {
+		if config.DoHTokenReview {
+			return nil, fmt.Errorf("--doh-token-review requires --doh-port")
+		}
+		return nil, nil
+	}
+	if config.DoHCertFile == "" || config.DoHKeyFile == "" {
+		return nil, fmt.Errorf("--doh-port requires --doh-tls-cert-file and --doh-tls-key-file")
+	}
+	if len(config.DoHAllowedGroups) > 0 && !config.DoHTokenReview {
+		return nil, fmt.Errorf("--doh-allowed-groups requires --doh-token-review")
+	}
+	if config.DoHTokenReview && config.DoHTokenCacheTTL <= 0 {
+		return nil, fmt.Errorf("--doh-token-cache-ttl must be positive")
+	}
+	return httpaccess.New(httpaccess.Config{
+		CertFile:  config.DoHCertFile,
+		KeyFile:   config.DoHKeyFile,
+		ReusePort: config.ReusePort,
+	})
+}
+
+// newGRPCGuard returns the Guard of the gRPC DNS endpoint, nil if it is not
+// enabled, or an error if its flags are invalid.
+func newGRPCGuard(config *options.KubeDNSConfig) (*httpaccess.Guard, error) {
+	if config.GRPCPort < 0 || config.GRPCPort > 65535 {
+		return nil, fmt.Errorf("invalid --grpc-port %d", config.GRPCPort)
+	}
+	if config.GRPCPort == 0 {
+		if config.GRPCCertFile != "" || config.GRPCKeyFile != "" || config.GRPCClientCAFile != "" {
+			return nil, fmt.Errorf("--grpc-tls-cert-file, --grpc-tls-key-file and --grpc-client-ca-file require --grpc-port")
+		}
+		return nil, nil
+	}
+	return httpaccess.New(httpaccess.Config{
+		CertFile:     config.GRPCCertFile,
+		KeyFile:      config.GRPCKeyFile,
+		ClientCAFile: config.GRPCClientCAFile,
+		ReusePort:    config.ReusePort,
+	})
+}
+
+// checkExtraDomains returns an error if an extra domain overlaps with the
+// cluster domain, the multicluster domain or another extra domain.
+func checkExtraDomains(config *options.KubeDNSConfig) error {
+	domains := []string{config.ClusterDomain}
+	if config.MultiClusterDomain != "" {
+		domains = append(domains, config.MultiClusterDomain)
+	}
+	for _, extra := range config.ExtraDomains {
+		extra = strings.ToLower(strings.TrimSuffix(extra, "."))
+		for _, domain := range domains {
+			domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+			if extra == domain || strings.HasSuffix(extra, "."+domain) || strings.HasSuffix(domain, "."+extra) {
+				return fmt.Errorf("--extra-domains %q overlaps with %q", extra, domain)
+			}
+		}
+		domains = append(domains, extra)
+	}
+	return nil
+}
+
+// parseCIDRs returns the networks of cidrs.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var ipNets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+// newCustomRecordStore returns the store of custom records selected by the
+// flags, nil if none.
+func newCustomRecordStore(config *options.KubeDNSConfig, kubeClient kubernetes.Interface, restConfig *rest.Config) (customrecords.Store, error) {
+	if err := checkCustomRecordStore(config); err != nil {
+		return nil, err
+	}
+	switch config.CustomRecordStore {
+	case "configmap":
+		klog.V(0).Infof("Serving the custom records of the ConfigMaps labeled %v", customrecords.ConfigMapLabel)
+		return customrecords.NewConfigMapStore(kubeClient, config.CustomRecordNamespace), nil
+	case "crd":
+		klog.V(0).Infof("Serving the custom records of the CustomRecordSets")
+		client, err := customrecords.NewForConfig(restConfig)
+		if err != nil {
+			return nil, err
+		}
+		return customrecords.NewCRDStore(client, config.CustomRecordNamespace), nil
+	case "etcd":
+		klog.V(0).Infof("Serving the custom records under %v in etcd", config.CustomRecordEtcdPrefix)
+		tlsConfig, err := customrecords.EtcdTLSConfig(config.CustomRecordEtcdCAFile, config.CustomRecordEtcdCertFile, config.CustomRecordEtcdKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return customrecords.NewEtcdStore(config.CustomRecordEtcdEndpoints, config.CustomRecordEtcdPrefix, tlsConfig)
+	}
+	return nil, nil
+}
+
+// newRestConfig returns the configuration of the Kubernetes clients.
+func newRestConfig(dnsConfig *options.KubeDNSConfig) (*rest.Config, error) {
 	var config *rest.Config
 	var err error
 
@@ -110,11 +980,21 @@ func newKubeClient(dnsConfig *options.KubeDNSConfig) (kubernetes.Interface, erro
 			return nil, err
 		}
 	}
-	// Use protobufs for communication with apiserver.
-	config.ContentType = "application/vnd.kubernetes.protobuf"
+	switch dnsConfig.KubeAPIContentType {
+	case "", "protobuf":
+		// Use protobufs for communication with apiserver, core/v1 and
+		// discovery/v1 support it. JSON remains accepted for the
+		// resources that do not.
+		config.ContentType = kruntime.ContentTypeProtobuf
+		config.AcceptContentTypes = kruntime.ContentTypeProtobuf + "," + kruntime.ContentTypeJSON
+	case "json":
+		config.ContentType = kruntime.ContentTypeJSON
+	default:
+		return nil, fmt.Errorf("invalid Kubernetes API content type %q, must be protobuf or json", dnsConfig.KubeAPIContentType)
+	}
 	config.UserAgent = userAgent()
 
-	return kubernetes.NewForConfig(config)
+	return config, nil
 }
 
 func userAgent() string {
@@ -127,17 +1007,25 @@ func (server *KubeDNSServer) Run() {
 	})
 	setupSignalHandlers()
 	server.startSkyDNSServer()
-	server.kd.Start()
+	// The status port is served during the initial sync, /readiness
+	// reporting what it waits for.
 	server.setupHandlers()
 	if server.profiling {
 		go server.setupProfiling()
 	}
 
 	klog.V(0).Infof("Status HTTP port %v", server.healthzPort)
+	go func() {
+		klog.Fatal(server.admin.ListenAndServe(fmt.Sprintf(":%d", server.healthzPort), nil))
+	}()
+	if server.warmStandbyPort != 0 {
+		go server.serveWarmStandby()
+	}
+	server.kd.Start()
 	if server.nameServers != "" {
 		klog.V(0).Infof("Upstream nameservers: %s", server.nameServers)
 	}
-	klog.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", server.healthzPort), nil))
+	select {}
 }
 
 func (server *KubeDNSServer) setupProfiling() {
@@ -149,19 +1037,364 @@ func (server *KubeDNSServer) setupProfiling() {
 func (server *KubeDNSServer) setupHandlers() {
 	klog.V(0).Infof("Setting up Healthz Handler (/readiness)")
 	http.HandleFunc("/readiness", func(w http.ResponseWriter, req *http.Request) {
+		// Until the records of every service and endpoints are generated,
+		// existing names would be answered NXDOMAIN.
+		// The records of a peer are answered meanwhile in warm standby.
+		if pending := server.kd.InitialSyncPending(); len(pending) > 0 && !server.kd.WarmStandby() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "initial sync: waiting for %s\n", strings.Join(pending, ", "))
+			return
+		}
+		if status := server.kd.GuardrailsStatus(); !status.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "guardrails: %s\n", status.NotReadyReason)
+			return
+		}
 		fmt.Fprintf(w, "ok\n")
 	})
 
 	klog.V(0).Infof("Setting up cache handler (/cache)")
-	http.HandleFunc("/cache", func(w http.ResponseWriter, req *http.Request) {
-		serializedJSON, err := server.kd.GetCacheAsJSON()
-		if err == nil {
-			fmt.Fprint(w, serializedJSON)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
+	dumpCache := func(w http.ResponseWriter, req *http.Request) {
+		// The format defaults to the tree of the cache, e.g. ?format=zone
+		// dumps its records as a zone file.
+		format := treecache.Format(req.FormValue("format"))
+		if format == "" {
+			format = treecache.FormatTree
+		}
+		var dump bytes.Buffer
+		if err := server.kd.DumpCache(&dump, format); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, treecache.ErrUnknownFormat) {
+				status = http.StatusBadRequest
+			}
+			w.WriteHeader(status)
 			fmt.Fprint(w, err)
+			return
+		}
+		if format != treecache.FormatZone {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Write(dump.Bytes())
+	}
+	// The other formats, ready to be loaded elsewhere, are only served to
+	// restricted clients.
+	dumpCacheFormat := server.admin.Restrict(http.HandlerFunc(dumpCache))
+	http.HandleFunc("/cache", func(w http.ResponseWriter, req *http.Request) {
+		if req.FormValue("format") != "" {
+			dumpCacheFormat.ServeHTTP(w, req)
+			return
+		}
+		dumpCache(w, req)
+	})
+
+	klog.V(0).Infof("Setting up cache generation handler (/cache/generation)")
+	http.HandleFunc("/cache/generation", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "%d\n", server.kd.Generation())
+	})
+
+	klog.V(0).Infof("Setting up effective configuration handler (%s)", effectiveconfig.Path)
+	// The configuration may hold the addresses of internal services, it is
+	// only served to restricted clients.
+	http.Handle(effectiveconfig.Path, server.admin.Restrict(effectiveconfig.Handler(func() effectiveconfig.Config {
+		effective := effectiveconfig.Config{}
+		effective.AddFlags(pflag.CommandLine)
+		effective.AddConfig(server.kd.Config(), server.configSource)
+		return effective
+	})))
+
+	klog.V(0).Infof("Setting up guardrails handlers (/admin/guardrails)")
+	http.HandleFunc("/admin/guardrails", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(server.kd.GuardrailsStatus()); err != nil {
+			klog.Errorf("Failed to write guardrails status: %v", err)
+		}
+	})
+	http.HandleFunc("/admin/guardrails/override", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
 		}
+		applied := server.kd.OverrideGuardrails()
+		klog.V(0).Infof("Guardrails overridden, applied %d held deletions", applied)
+		fmt.Fprintf(w, "applied %d held deletions\n", applied)
 	})
+
+	klog.V(0).Infof("Setting up forwarder overrides handler (/admin/forwarders)")
+	http.HandleFunc("/admin/forwarders", server.handleForwardOverrides)
+
+	if server.kd.RecordWatch != nil {
+		klog.V(0).Infof("Setting up record watch handler (/admin/records/watch)")
+		http.HandleFunc("/admin/records/watch", server.handleRecordWatch)
+	}
+
+	if server.kd.RecordLeases {
+		klog.V(0).Infof("Setting up record leases handler (%s)", leases.Path)
+		http.HandleFunc(leases.Path, server.handleRecordLeases)
+	}
+
+	if server.kd.ACMEChallengeZone != "" {
+		klog.V(0).Infof("Setting up ACME challenges handler (/admin/acme-challenges)")
+		http.HandleFunc("/admin/acme-challenges", server.handleACMEChallenges)
+	}
+
+	if server.sampler != nil {
+		klog.V(0).Infof("Setting up query sampler handler (/admin/querysampler)")
+		http.HandleFunc("/admin/querysampler", func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(server.sampler.Report()); err != nil {
+				klog.Errorf("Failed to write query sampler report: %v", err)
+			}
+		})
+	}
+}
+
+// handleForwardOverrides lists the forwarder overrides on GET, sets the
+// override of a zone on POST and removes it on DELETE. A POST takes the zone,
+// the comma separated nameservers and the ttl of the override, e.g.
+// zone=corp.example.com&nameservers=10.0.0.1,10.0.0.2:5353&ttl=30m, see
+// server.ForwardOverrides.Set for the zones and ttls allowed.
+func (server *KubeDNSServer) handleForwardOverrides(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		zone := strings.ToLower(req.FormValue("zone"))
+		if !strings.HasSuffix(zone, ".") {
+			zone += "."
+		}
+		domain := strings.ToLower(server.domain)
+		if !strings.HasSuffix(domain, ".") {
+			domain += "."
+		}
+		if zone == domain || strings.HasSuffix(zone, "."+domain) {
+			http.Error(w, fmt.Sprintf("zone %q is served by kube-dns", zone), http.StatusBadRequest)
+			return
+		}
+		var nameservers []string
+		for _, ns := range strings.Split(req.FormValue("nameservers"), ",") {
+			if ns = strings.TrimSpace(ns); ns == "" {
+				continue
+			}
+			ip, port, err := util.ValidateNameserverIpAndPort(ns)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid nameserver %q: %v", ns, err), http.StatusBadRequest)
+				return
+			}
+			nameservers = append(nameservers, net.JoinHostPort(ip, port))
+		}
+		ttl, err := time.ParseDuration(req.FormValue("ttl"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid ttl: %v", err), http.StatusBadRequest)
+			return
+		}
+		override, err := server.forwardOverrides.Set(zone, nameservers, ttl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		klog.V(0).Infof("Forwarding zone %s to %v until %v", override.Zone, override.Nameservers, override.Expires)
+	case http.MethodDelete:
+		zone := req.FormValue("zone")
+		if !server.forwardOverrides.Delete(zone) {
+			http.Error(w, fmt.Sprintf("no override of zone %q", zone), http.StatusNotFound)
+			return
+		}
+		klog.V(0).Infof("Removed the forwarder override of zone %s", zone)
+	default:
+		w.Header().Set("Allow", strings.Join([]string{http.MethodGet, http.MethodPost, http.MethodDelete}, ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(server.forwardOverrides.List()); err != nil {
+		klog.Errorf("Failed to write forwarder overrides: %v", err)
+	}
+}
+
+// handleACMEChallenges lists the ACME challenges on GET, publishes one on
+// POST and removes them on DELETE. A POST takes the name, the value and the
+// ttl of the challenge, e.g.
+// name=_acme-challenge.my-svc.acme.cluster.local&value=abc&ttl=10m. A DELETE
+// takes the name and optionally the value, removing every value without.
+func (server *KubeDNSServer) handleACMEChallenges(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		ttl, err := time.ParseDuration(req.FormValue("ttl"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid ttl: %v", err), http.StatusBadRequest)
+			return
+		}
+		challenge, err := server.kd.SetACMEChallenge(req.FormValue("name"), req.FormValue("value"), ttl)
+		if err != nil {
+			http.Error(w, err.Error(), acmeChallengeErrorStatus(err))
+			return
+		}
+		klog.V(0).Infof("Publishing ACME challenge %s until %v", challenge.Name, challenge.Expires)
+	case http.MethodDelete:
+		name := req.FormValue("name")
+		deleted, err := server.kd.DeleteACMEChallenge(name, req.FormValue("value"))
+		if err != nil {
+			http.Error(w, err.Error(), acmeChallengeErrorStatus(err))
+			return
+		}
+		if !deleted {
+			http.Error(w, fmt.Sprintf("no challenge at %q", name), http.StatusNotFound)
+			return
+		}
+		klog.V(0).Infof("Removed ACME challenge %s", name)
+	default:
+		w.Header().Set("Allow", strings.Join([]string{http.MethodGet, http.MethodPost, http.MethodDelete}, ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(server.kd.ACMEChallenges()); err != nil {
+		klog.Errorf("Failed to write ACME challenges: %v", err)
+	}
+}
+
+// acmeChallengeErrorStatus returns the HTTP status of an error publishing
+// or removing an ACME challenge.
+func acmeChallengeErrorStatus(err error) int {
+	if errors.Is(err, server.ErrBackendUnavailable) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+// handleRecordLeases lists the record leases on GET, acquires, updates or
+// renews one on POST, with the id, records and ttl form values, and
+// releases one on DELETE, with the id form value. The holder is the
+// authenticated client, see recordLeaseHolder.
+func (server *KubeDNSServer) handleRecordLeases(w http.ResponseWriter, req *http.Request) {
+	var result interface{}
+	switch req.Method {
+	case http.MethodGet:
+		result = server.kd.ListRecordLeases()
+	case http.MethodPost:
+		ttl, err := time.ParseDuration(req.FormValue("ttl"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid ttl: %v", err), http.StatusBadRequest)
+			return
+		}
+		holder, err := server.recordLeaseHolder(req)
+		if err != nil {
+			http.Error(w, err.Error(), recordLeaseStatus(err))
+			return
+		}
+		lease, err := server.kd.SetRecordLease(req.FormValue("id"), holder, req.FormValue("records"), ttl)
+		if err != nil {
+			http.Error(w, err.Error(), recordLeaseStatus(err))
+			return
+		}
+		if req.FormValue("records") != "" {
+			klog.V(2).Infof("Publishing the records of lease %q of %q until %v", lease.ID, lease.Holder, lease.Expires)
+		}
+		result = lease
+	case http.MethodDelete:
+		id := req.FormValue("id")
+		holder, err := server.recordLeaseHolder(req)
+		if err != nil {
+			http.Error(w, err.Error(), recordLeaseStatus(err))
+			return
+		}
+		if err := server.kd.DeleteRecordLease(id, holder); err != nil {
+			http.Error(w, err.Error(), recordLeaseStatus(err))
+			return
+		}
+		klog.V(2).Infof("Released record lease %q", id)
+		result = struct{}{}
+	default:
+		w.Header().Set("Allow", strings.Join([]string{http.MethodGet, http.MethodPost, http.MethodDelete}, ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		klog.Errorf("Failed to write record leases: %v", err)
+	}
+}
+
+// recordLeaseTokenCacheTTL is how long the reviews of the bearer tokens of
+// the holders of record leases are cached.
+const recordLeaseTokenCacheTTL = time.Minute
+
+// errHolderMismatch is returned for the requests on the record leases of
+// another holder than the authenticated client.
+var errHolderMismatch = errors.New("the holder is not the authenticated client")
+
+// recordLeaseHolder returns the holder of the record leases of req, as
+// authenticated by its client certificate, the common name of its subject,
+// or else by its bearer token, the name of its user. The holder of the
+// form, if any, must be the same.
+func (d *KubeDNSServer) recordLeaseHolder(req *http.Request) (string, error) {
+	var holder string
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+		holder = req.TLS.VerifiedChains[0][0].Subject.CommonName
+	} else if token := httpaccess.BearerToken(req); token != "" && d.recordLeaseTokenReviewer != nil {
+		user, err := d.recordLeaseTokenReviewer.Authenticate(req.Context(), token)
+		if errors.Is(err, httpaccess.ErrUnauthenticated) {
+			return "", err
+		}
+		if err != nil {
+			return "", fmt.Errorf("%v: %w", err, server.ErrBackendUnavailable)
+		}
+		holder = user.Username
+	}
+	if holder == "" {
+		return "", fmt.Errorf("a client certificate or a bearer token is required: %w", httpaccess.ErrUnauthenticated)
+	}
+	if form := req.FormValue("holder"); form != "" && form != holder {
+		return "", fmt.Errorf("authenticated as %q, not %q: %w", holder, form, errHolderMismatch)
+	}
+	return holder, nil
+}
+
+// recordLeaseStatus returns the HTTP status of an error of a record lease,
+// as the leases client expects it.
+func recordLeaseStatus(err error) int {
+	switch {
+	case errors.Is(err, leases.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, leases.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, httpaccess.ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, errHolderMismatch):
+		return http.StatusForbidden
+	case errors.Is(err, server.ErrBackendUnavailable):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// handleRecordWatch streams a JSON line for each record served, then for
+// each change of the records, until the client goes away. The stream ends
+// early if the client does not keep up, it then has to watch again.
+func (server *KubeDNSServer) handleRecordWatch(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	events, err := server.kd.WatchRecords(req.Context().Done())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	for event := range events {
+		if err := enc.Encode(&event); err != nil {
+			klog.V(2).Infof("Record watcher %v went away: %v", req.RemoteAddr, err)
+			return
+		}
+		if len(events) == 0 {
+			flusher.Flush()
+		}
+	}
 }
 
 // setupSignalHandlers installs signal handler to ignore SIGINT and
@@ -183,11 +1416,100 @@ func (d *KubeDNSServer) startSkyDNSServer() {
 	skydnsConfig := &server.Config{
 		Domain:  d.domain,
 		DnsAddr: fmt.Sprintf("%s:%d", d.dnsBindAddress, d.dnsPort),
+		NoUDP:   d.disableUDP,
+		NoTCP:   d.disableTCP,
+
+		ReusePort: d.reusePort,
+		Systemd:   d.socketActivation,
+
+		NoCompress:   d.noCompress,
+		ChaseCNAME:   d.chaseCNAME,
+		AnswerOrder:  d.answerOrder,
+		MaxAnswers:   d.maxAnswers,
+		ReverseCIDRs: d.reverseCIDRs,
+
+		TransferCIDRs:   d.transferCIDRs,
+		IXFRJournal:     d.ixfrJournal,
+		Notify:          d.notify,
+		JournalInterval: d.journalInterval,
+
+		TsigSecret:   d.tsigSecret,
+		TransferKeys: d.transferKeys,
+		ForwardKey:   d.forwardKey,
+
+		SubnetForward:  d.ecsForward,
+		SubnetPrefixV4: d.ecsPrefixV4,
+		SubnetPrefixV6: d.ecsPrefixV6,
+
+		UpstreamConns:       d.upstreamConns,
+		UpstreamPipeline:    d.upstreamPipeline,
+		UpstreamIdleTimeout: d.upstreamIdleTimeout,
+		RaceUpstreams:       d.raceUpstreams,
+		UpstreamTLS:         d.upstreamTLS,
+
+		RCache:    d.responseCacheSize,
+		RCacheTtl: int(d.responseCacheTTL / time.Second),
+
+		MinTtl:    uint32(d.soaMinimumTTL / time.Second),
+		SOASerial: d.soaSerial,
+
+		Overrides:   d.forwardOverrides,
+		Fallthrough: server.NewFallthroughZones(),
+		Rewrites:    server.NewRewrites(),
+		LocalZones:  server.NewZones(),
+	}
+	var observers []server.QueryObserver
+	if d.sampler != nil {
+		observers = append(observers, d.sampler.Observe)
+	}
+	if d.mirror != nil {
+		go d.mirror.Run(wait.NeverStop)
+		observers = append(observers, d.mirror.Observe)
 	}
+	if d.searchPath != nil {
+		go d.searchPath.Run(wait.NeverStop)
+		observers = append(observers, d.searchPath.Observe)
+	}
+	switch len(observers) {
+	case 0:
+	case 1:
+		skydnsConfig.Observer = observers[0]
+	default:
+		skydnsConfig.Observer = server.ChainObservers(observers...)
+	}
+	if d.kd.TopologyAwareAnswers {
+		skydnsConfig.Sorter = d.kd.SortAnswers
+	}
+	if d.kd.TenantZones {
+		skydnsConfig.Authorizer = d.kd.Authorize
+	}
+	if features.Enabled(features.Autopath) {
+		skydnsConfig.SearchPath = d.kd.SearchPath
+	}
+	if d.notifyLeader != nil {
+		go d.notifyLeader.Run(wait.NeverStop)
+		skydnsConfig.NotifyLeader = d.notifyLeader.IsLeader
+	}
+	if d.dot != nil {
+		go d.dot.Run(d.dotReloadPeriod, wait.NeverStop)
+		skydnsConfig.DoTAddr = net.JoinHostPort(d.dnsBindAddress, strconv.Itoa(d.dotPort))
+		skydnsConfig.TLSConfig = server.NewDoTConfig(d.dot.GetCertificate)
+	}
+	if d.dnssecKey != nil {
+		skydnsConfig.PubKey = d.dnssecKey
+		skydnsConfig.PrivKey = d.dnssecSigner
+		skydnsConfig.NSEC = d.dnssecNSEC
+	}
+	if d.kd.MultiClusterDomain != "" {
+		// The services imported from the clusterset are answered by kd.
+		skydnsConfig.ExtraDomains = []string{d.kd.MultiClusterDomain}
+	}
+	skydnsConfig.ExtraDomains = append(skydnsConfig.ExtraDomains, d.kd.ExtraDomains...)
 	if err := server.SetDefaults(skydnsConfig); err != nil {
 		klog.Fatalf("Failed to set defaults for Skydns server: %s", err)
 	}
-	s := server.New(d.kd, skydnsConfig)
+	s := server.New(d.backend, skydnsConfig)
+	metrics.ListenAndServe = d.admin.ListenAndServe
 	if err := metrics.Metrics(); err != nil {
 		klog.Fatalf("Skydns metrics error: %s", err)
 	} else if metrics.Port != "" {
@@ -197,5 +1519,73 @@ func (d *KubeDNSServer) startSkyDNSServer() {
 	}
 
 	d.kd.SkyDNSConfig = skydnsConfig
-	go s.Run()
+	if d.kd.CacheInvalidation != nil {
+		d.kd.CacheInvalidation.Invalidate = s.InvalidateCache
+	}
+	go func() {
+		if err := s.Run(); err != nil {
+			klog.Fatalf("Failed to serve DNS: %v", err)
+		}
+	}()
+	if d.doh != nil {
+		go d.serveDoH(s.DoHHandler())
+	}
+	if d.grpc != nil {
+		g := d.newGRPCServer()
+		s.RegisterGRPC(g)
+		go d.serveGRPC(g)
+	}
+}
+
+// newGRPCServer returns the server of the gRPC DNS queries.
+func (d *KubeDNSServer) newGRPCServer() *grpc.Server {
+	if tlsConfig := d.grpc.TLSConfig(); tlsConfig != nil {
+		return grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	return grpc.NewServer()
+}
+
+// serveGRPC serves the DNS queries over gRPC with g.
+func (d *KubeDNSServer) serveGRPC(g *grpc.Server) {
+	ln, err := d.grpc.Listen(net.JoinHostPort(d.dnsBindAddress, strconv.Itoa(d.grpcPort)))
+	if err != nil {
+		klog.Fatalf("Failed to listen for the gRPC DNS queries: %v", err)
+	}
+	klog.V(0).Infof("Serving DNS over gRPC (%v)", ln.Addr())
+	klog.Fatal(g.Serve(ln))
+}
+
+// serveWarmStandby serves the records to the starting replicas, over
+// mutual TLS.
+func (d *KubeDNSServer) serveWarmStandby() {
+	lis, err := d.warmStandby.Listen(fmt.Sprintf(":%d", d.warmStandbyPort))
+	if err != nil {
+		klog.Fatalf("Failed to listen for the warm standby replicas: %v", err)
+	}
+	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(d.warmStandby.TLSConfig())), grpc.StreamInterceptor(allowedPeers(d.warmStandby)))
+	d.kd.RegisterWarmStandby(s)
+	klog.V(0).Infof("Serving the records to the warm standby replicas on %v", lis.Addr())
+	klog.Fatal(s.Serve(lis))
+}
+
+// allowedPeers refuses the streams of the clients outside of the CIDRs
+// allowed by g.
+func allowedPeers(g *httpaccess.Guard) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if p, ok := peer.FromContext(ss.Context()); !ok || !g.Allowed(p.Addr.String()) {
+			return status.Error(codes.PermissionDenied, "client not allowed")
+		}
+		return handler(srv, ss)
+	}
+}
+
+// serveDoH serves the DNS over HTTPS queries with h.
+func (d *KubeDNSServer) serveDoH(h http.Handler) {
+	if d.dohTokenReviewer != nil {
+		klog.V(0).Infof("Serving DNS over HTTPS (%v:%v) to the clients with a valid bearer token", d.dnsBindAddress, d.dohPort)
+		h = d.dohTokenReviewer.Handler(h)
+	} else {
+		klog.V(0).Infof("Serving DNS over HTTPS (%v:%v)", d.dnsBindAddress, d.dohPort)
+	}
+	klog.Fatal(d.doh.ListenAndServe(net.JoinHostPort(d.dnsBindAddress, strconv.Itoa(d.dohPort)), h))
 }
@@ -0,0 +1,88 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"k8s.io/dns/pkg/httpaccess"
+)
+
+func TestRecordLeaseHolder(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "controller-token" {
+			review.Status = authenticationv1.TokenReviewStatus{
+				Authenticated: true,
+				User:          authenticationv1.UserInfo{Username: "system:serviceaccount:default:controller"},
+			}
+		}
+		return true, review, nil
+	})
+	server := &KubeDNSServer{
+		recordLeaseTokenReviewer: httpaccess.NewTokenReviewer(client.AuthenticationV1().TokenReviews(), nil, nil, time.Minute),
+	}
+	request := func(holder, token string, cert *x509.Certificate) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/admin/records/leases", strings.NewReader("holder="+holder))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		return req
+	}
+	controllerCert := &x509.Certificate{Subject: pkix.Name{CommonName: "controller-a"}}
+
+	for _, test := range []struct {
+		desc, holder, token string
+		cert                *x509.Certificate
+		expected            string
+		status              int
+	}{
+		{desc: "client certificate", cert: controllerCert, expected: "controller-a"},
+		{desc: "matching holder", holder: "controller-a", cert: controllerCert, expected: "controller-a"},
+		{desc: "bearer token", token: "controller-token", expected: "system:serviceaccount:default:controller"},
+		{desc: "anonymous", holder: "controller-a", status: http.StatusUnauthorized},
+		{desc: "invalid token", holder: "controller-a", token: "forged", status: http.StatusUnauthorized},
+		{desc: "other holder", holder: "controller-b", cert: controllerCert, status: http.StatusForbidden},
+	} {
+		holder, err := server.recordLeaseHolder(request(test.holder, test.token, test.cert))
+		if test.status != 0 {
+			assert.Equal(t, test.status, recordLeaseStatus(err), "%s: %v", test.desc, err)
+			continue
+		}
+		require.NoError(t, err, test.desc)
+		assert.Equal(t, test.expected, holder, test.desc)
+	}
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"k8s.io/dns/cmd/kube-dns/app/options"
+	"k8s.io/dns/pkg/configcheck"
+	"k8s.io/dns/pkg/dns"
+	dnsconfig "k8s.io/dns/pkg/dns/config"
+	"k8s.io/dns/pkg/dns/customrecords"
+	"k8s.io/dns/pkg/httpaccess"
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+// ValidateConfig checks the flags and the configuration they point to, as
+// far as possible without reaching the API server, for --validate-only.
+func ValidateConfig(config *options.KubeDNSConfig, report *configcheck.Report) {
+	var err error
+	if config.ConfigMap != "" && config.ConfigDir != "" {
+		err = fmt.Errorf("cannot use both --config-map and --config-dir")
+	}
+	report.Check("configuration source", err)
+
+	switch {
+	case config.ConfigMap != "":
+		report.Skip(fmt.Sprintf("ConfigMap %s/%s", config.ConfigMapNs, config.ConfigMap),
+			"read from the API server at runtime, validate it with --config-dir on a copy of its data")
+	case config.ConfigDir != "":
+		_, err := dnsconfig.NewFileSync(config.ConfigDir, config.ConfigPeriod).Once()
+		report.Check(fmt.Sprintf("configuration directory %s", config.ConfigDir), err)
+	default:
+		conf := dnsconfig.Config{Federations: config.Federations}
+		if len(config.NameServers) > 0 {
+			conf.UpstreamNameservers = strings.Split(config.NameServers, ",")
+		}
+		report.Check("--federations and --nameservers", conf.Validate())
+	}
+
+	report.Check("--extra-domains", checkExtraDomains(config))
+
+	_, err = dns.ParseHeadlessReverseRecords(config.HeadlessReverseRecords)
+	report.Check("--headless-reverse-records", err)
+
+	_, err = dns.ParseEndpointNaming(config.EndpointNaming)
+	report.Check("--endpoint-naming", err)
+
+	_, err = dns.ParseUnknownProtocolPolicy(config.UnknownPortProtocols)
+	report.Check("--unknown-port-protocols", err)
+
+	_, err = dns.ParseWildcardTimeoutAction(config.WildcardQueryTimeoutAction)
+	if err == nil && config.WildcardQueryTimeout < 0 {
+		err = fmt.Errorf("--wildcard-query-timeout must not be negative")
+	}
+	report.Check("wildcard query timeout", err)
+
+	err = nil
+	if config.NegativeCacheTTL < 0 {
+		err = fmt.Errorf("--negative-cache-ttl must not be negative")
+	} else if config.NegativeCacheTTL > 0 && config.NegativeCacheSize <= 0 {
+		err = fmt.Errorf("--negative-cache-size must be positive")
+	}
+	report.Check("negative cache", err)
+
+	err = nil
+	if config.SOAMinimumTTL < time.Second || config.SOAMinimumTTL%time.Second != 0 {
+		err = fmt.Errorf("--soa-minimum-ttl must be a positive number of seconds")
+	}
+	report.Check("--soa-minimum-ttl", err)
+
+	err = nil
+	if config.DropTerminatingEndpoints && config.ServingTerminatingEndpoints {
+		err = fmt.Errorf("--drop-terminating-endpoints and --serving-terminating-endpoints are mutually exclusive")
+	}
+	report.Check("terminating endpoints", err)
+	report.Check("EndpointSlices", checkEndpointSlices(config))
+
+	err = nil
+	for _, cidr := range config.ReverseCIDRs {
+		if _, _, cidrErr := net.ParseCIDR(cidr); cidrErr != nil {
+			err = cidrErr
+			break
+		}
+	}
+	report.Check("--reverse-cidrs", err)
+
+	err = nil
+	for _, cidr := range config.TransferCIDRs {
+		if _, _, cidrErr := net.ParseCIDR(cidr); cidrErr != nil {
+			err = cidrErr
+			break
+		}
+	}
+	report.Check("--transfer-allowed-cidrs", err)
+
+	_, err = parseCIDRs(config.TenantTrustedForwarderCIDRs)
+	report.Check("--tenant-trusted-forwarder-cidrs", err)
+
+	err = nil
+	if config.TransferIXFRJournal < 0 {
+		err = fmt.Errorf("--transfer-ixfr-journal must not be negative")
+	} else if (config.TransferIXFRJournal > 0 || len(config.TransferNotify) > 0) && config.TransferJournalInterval <= 0 {
+		err = fmt.Errorf("--transfer-journal-interval must be positive")
+	}
+	for _, target := range config.TransferNotify {
+		if _, _, splitErr := net.SplitHostPort(target); splitErr != nil {
+			err = splitErr
+			break
+		}
+	}
+	if len(config.TransferNotify) > 0 {
+		if errs := validation.IsDNS1123Subdomain(config.TransferNotifyLease); len(errs) > 0 {
+			err = fmt.Errorf("--transfer-notify-lease %q: %s", config.TransferNotifyLease, strings.Join(errs, ", "))
+		}
+	}
+	report.Check("IXFR journal", err)
+
+	err = nil
+	if config.PeerClusters && (config.PeerClustersTTL <= 0 || config.PeerClustersTimeout <= 0) {
+		err = fmt.Errorf("--peer-clusters-ttl and --peer-clusters-timeout must be positive")
+	}
+	report.Check("peer clusters", err)
+
+	_, err = server.ParseAnswerOrder(config.AnswerOrder)
+	report.Check("--answer-order", err)
+
+	_, err = server.ParseSubnetPolicy(config.ECSForward)
+	if config.ECSPrefixV4 <= 0 || config.ECSPrefixV4 > 32 || config.ECSPrefixV6 <= 0 || config.ECSPrefixV6 > 128 {
+		err = fmt.Errorf("--ecs-prefix-v4 must be within 1 and 32, and --ecs-prefix-v6 within 1 and 128")
+	}
+	report.Check("EDNS Client Subnet", err)
+
+	err = checkCustomRecordStore(config)
+	if err == nil && config.CustomRecordStore == "etcd" {
+		_, err = customrecords.EtcdTLSConfig(config.CustomRecordEtcdCAFile, config.CustomRecordEtcdCertFile, config.CustomRecordEtcdKeyFile)
+	}
+	report.Check("custom record store", err)
+	report.Check("--acme-challenge-zone", checkACMEChallengeZone(config))
+
+	if config.Mirror.Sink != "" {
+		report.Check("query mirror", config.Mirror.Validate())
+	}
+
+	_, err = httpaccess.New(config.Admin)
+	report.Check("access to the HTTP endpoints", err)
+
+	err = nil
+	if config.SearchPathMetrics && config.SearchPathWindow <= 0 {
+		err = fmt.Errorf("--search-path-window must be positive")
+	} else if config.SearchPathLogOffenders && !config.SearchPathMetrics {
+		err = fmt.Errorf("--search-path-log-offenders requires --search-path-metrics")
+	}
+	report.Check("search path metrics", err)
+
+	_, err = parseCacheMemoryLimit(config)
+	report.Check("--cache-memory-limit", err)
+
+	_, err = newDoHGuard(config)
+	report.Check("DNS over HTTPS", err)
+
+	report.Check("DNS over TLS", checkDoT(config))
+
+	report.Check("DNSSEC", checkDNSSEC(config))
+
+	report.Check("TSIG", checkTsig(config))
+	_, err = loadUpstreamTLS(config)
+	if config.UpstreamPipeline > 1024 {
+		err = fmt.Errorf("--upstream-pipeline must be at most 1024")
+	}
+	report.Check("upstream connections", err)
+
+	_, err = newGRPCGuard(config)
+	report.Check("gRPC DNS", err)
+
+	report.Check("cache invalidation", checkCacheInvalidation(config))
+
+	_, err = newWarmStandbyGuard(config)
+	report.Check("warm standby", err)
+
+	err = nil
+	if config.RecordsSnapshotFile != "" && config.RecordsSnapshotInterval <= 0 {
+		err = fmt.Errorf("--records-snapshot-interval must be positive")
+	}
+	report.Check("records snapshot", err)
+
+	err = nil
+	if config.ResyncPeriod < 0 {
+		err = fmt.Errorf("--resync-period must not be negative")
+	}
+	report.Check("--resync-period", err)
+
+	err = nil
+	if config.EndpointsDebounce < 0 {
+		err = fmt.Errorf("--endpoints-debounce must not be negative")
+	}
+	report.Check("--endpoints-debounce", err)
+
+	err = nil
+	if config.InventoryInterval < 0 {
+		err = fmt.Errorf("--inventory-interval must not be negative")
+	}
+	report.Check("--inventory-interval", err)
+}
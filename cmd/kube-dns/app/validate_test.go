@@ -0,0 +1,147 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/dns/cmd/kube-dns/app/options"
+	"k8s.io/dns/pkg/configcheck"
+	"k8s.io/dns/pkg/dns/features"
+)
+
+func validate(config *options.KubeDNSConfig) (string, bool) {
+	var out bytes.Buffer
+	report := configcheck.NewReport(&out)
+	ValidateConfig(config, report)
+	return out.String(), report.Failed()
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := options.NewKubeDNSConfig()
+	out, failed := validate(config)
+	assert.False(t, failed, out)
+
+	config.ConfigDir = t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(config.ConfigDir, "upstreamNameservers"), []byte(`["1.2.3.4"]`), 0644))
+	out, failed = validate(config)
+	assert.False(t, failed, out)
+	assert.Contains(t, out, "OK    configuration directory")
+
+	require.NoError(t, os.WriteFile(filepath.Join(config.ConfigDir, "stubDomains"), []byte(`{"acme.local": ["not an ip"]}`), 0644))
+	out, failed = validate(config)
+	assert.True(t, failed, out)
+	assert.Contains(t, out, "FAIL  configuration directory")
+
+	config = options.NewKubeDNSConfig()
+	config.ConfigMap = "kube-dns"
+	config.HeadlessReverseRecords = "unknown"
+	config.EndpointNaming = "unknown"
+	config.UnknownPortProtocols = "udp"
+	config.WildcardQueryTimeoutAction = "refuse"
+	config.NegativeCacheTTL = -time.Second
+	config.DropTerminatingEndpoints = true
+	config.ServingTerminatingEndpoints = true
+	config.ReverseCIDRs = []string{"10.0.0.0"}
+	config.TransferCIDRs = []string{"secondary"}
+	config.TransferNotify = []string{"10.0.0.53"}
+	config.CustomRecordStore = "etcd"
+	config.PeerClusters = true
+	config.PeerClustersTimeout = 0
+	config.ExtraDomains = []string{"prod.internal.", "svc.cluster.local."}
+	config.AnswerOrder = "sorted"
+	config.ECSForward = "anonymize"
+	config.ACMEChallengeZone = "acme.svc"
+	config.Mirror.Sink = "kafka://analytics:9092"
+	config.DoHTokenReview = true
+	config.SearchPathLogOffenders = true
+	config.CacheMemoryLimit = "lots"
+	config.CacheInvalidationPort = 10054
+	config.RecordsSnapshotFile = "/var/lib/kube-dns/records.json"
+	config.RecordsSnapshotInterval = 0
+	config.ResyncPeriod = -time.Minute
+	config.EndpointsDebounce = -time.Second
+	config.InventoryInterval = -time.Minute
+	config.WarmStandbyPeer = "kube-dns-peers"
+	config.DoTPort = 853
+	config.DoTSecret = "kube-dns-tls"
+	config.GRPCClientCAFile = "/etc/kube-dns/ca.crt"
+	config.DNSSECDenial = "nsec5"
+	config.ForwardTsigKey = "forward"
+	config.SOAMinimumTTL = 1500 * time.Millisecond
+	out, failed = validate(config)
+	assert.True(t, failed, out)
+	assert.Contains(t, out, "SKIP  ConfigMap kube-system/kube-dns")
+	assert.Contains(t, out, "FAIL  --extra-domains")
+	assert.Contains(t, out, "FAIL  --headless-reverse-records")
+	assert.Contains(t, out, "FAIL  --endpoint-naming")
+	assert.Contains(t, out, "FAIL  --unknown-port-protocols")
+	assert.Contains(t, out, "FAIL  wildcard query timeout")
+	assert.Contains(t, out, "FAIL  negative cache")
+	assert.Contains(t, out, "FAIL  terminating endpoints")
+	assert.Contains(t, out, "FAIL  --reverse-cidrs")
+	assert.Contains(t, out, "FAIL  --transfer-allowed-cidrs")
+	assert.Contains(t, out, "FAIL  IXFR journal")
+	assert.Contains(t, out, "FAIL  peer clusters")
+	assert.Contains(t, out, "FAIL  custom record store")
+	assert.Contains(t, out, "FAIL  --answer-order")
+	assert.Contains(t, out, "FAIL  --acme-challenge-zone")
+	assert.Contains(t, out, "FAIL  query mirror")
+	assert.Contains(t, out, "FAIL  search path metrics")
+	assert.Contains(t, out, "FAIL  --cache-memory-limit")
+	assert.Contains(t, out, "FAIL  DNS over HTTPS")
+	assert.Contains(t, out, "FAIL  DNS over TLS")
+	assert.Contains(t, out, "FAIL  gRPC DNS")
+	assert.Contains(t, out, "FAIL  DNSSEC")
+	assert.Contains(t, out, "FAIL  TSIG")
+	assert.Contains(t, out, "FAIL  EDNS Client Subnet")
+	assert.Contains(t, out, "FAIL  --soa-minimum-ttl")
+	assert.Contains(t, out, "FAIL  cache invalidation")
+	assert.Contains(t, out, "FAIL  records snapshot")
+	assert.Contains(t, out, "FAIL  --resync-period")
+	assert.Contains(t, out, "FAIL  --endpoints-debounce")
+	assert.Contains(t, out, "FAIL  --inventory-interval")
+	assert.Contains(t, out, "FAIL  warm standby")
+}
+
+func TestValidateFeatureGates(t *testing.T) {
+	t.Cleanup(func() {
+		require.NoError(t, features.DefaultMutableFeatureGate.Set("DNSOverTLS=false,EndpointSlices=true"))
+	})
+
+	config := options.NewKubeDNSConfig()
+	config.DoTPort = 853
+	config.DoTSecret = "kube-system/kube-dns-tls"
+	config.TopologyAwareAnswers = true
+	out, failed := validate(config)
+	assert.True(t, failed, out)
+	assert.Contains(t, out, "FAIL  DNS over TLS")
+	assert.Contains(t, out, "OK    EndpointSlices")
+
+	require.NoError(t, features.DefaultMutableFeatureGate.Set("DNSOverTLS=true,EndpointSlices=false"))
+	out, failed = validate(config)
+	assert.True(t, failed, out)
+	assert.Contains(t, out, "OK    DNS over TLS")
+	assert.Contains(t, out, "FAIL  EndpointSlices")
+}
@@ -18,6 +18,7 @@ package main
 
 import (
 	goflag "flag"
+	"os"
 
 	"github.com/spf13/pflag"
 
@@ -27,6 +28,7 @@ import (
 	_ "k8s.io/component-base/metrics/prometheus/version"    // for version metric registration
 	"k8s.io/dns/cmd/kube-dns/app"
 	"k8s.io/dns/cmd/kube-dns/app/options"
+	"k8s.io/dns/pkg/configcheck"
 	"k8s.io/dns/pkg/version"
 	"k8s.io/klog/v2"
 )
@@ -46,6 +48,20 @@ func main() {
 
 	version.PrintAndExitIfRequested()
 
+	if pflag.Arg(0) == "self-test" {
+		report := configcheck.NewReport(os.Stdout)
+		app.SelfTest(config, report)
+		logs.FlushLogs()
+		os.Exit(report.DoneWith("self-test passed"))
+	}
+
+	if config.ValidateOnly {
+		report := configcheck.NewReport(os.Stdout)
+		app.ValidateConfig(config, report)
+		logs.FlushLogs()
+		os.Exit(report.Done())
+	}
+
 	klog.V(0).Infof("version: %+v", version.VERSION)
 
 	server := app.NewKubeDNSServerDefault(config)
@@ -17,6 +17,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coredns/coredns/coremain"
@@ -24,6 +25,8 @@ import (
 
 	"k8s.io/dns/cmd/kube-dns/app/options"
 	"k8s.io/dns/pkg/dns/config"
+	"k8s.io/dns/pkg/effectiveconfig"
+	"k8s.io/dns/pkg/httpaccess"
 	"k8s.io/dns/pkg/netif"
 	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
 	utilexec "k8s.io/utils/exec"
@@ -46,7 +49,11 @@ type ConfigParams struct {
 	UpstreamSvcName      string        // Name of the service whose clusterIP is the upstream for node-cache for cluster domain
 	HealthPort           string        // port for the healthcheck
 	SetupIptables        bool
-	SkipTeardown         bool // Indicates whether the iptables rules and interface should be torn down
+	SkipTeardown         bool              // Indicates whether the iptables rules and interface should be torn down
+	ClientCIDRs          []*net.IPNet      // if not empty, only the clients in these networks are intercepted
+	MetricsAccess        httpaccess.Config // Restricts the access to the metrics endpoint
+	NodeName             string            // Name of the node, whose labels select the node pool of the kube-dns configuration
+	HandoffLockFile      string            // If set, the networking is torn down only by the last node-cache process holding this file
 }
 
 type iptablesRule struct {
@@ -64,6 +71,18 @@ type CacheApp struct {
 	kubednsConfig *options.KubeDNSConfig
 	exitChan      chan struct{} // Channel to terminate background goroutines
 	clusterDNSIP  net.IP
+	// nodeLabels gets the labels of the node, to select its node pool. Nil
+	// without a node name.
+	nodeLabels     func() (map[string]string, error)
+	lastNodeLabels map[string]string
+	// handoff, if set, is held while running to leave the networking in
+	// place on exit for the processes still holding it.
+	handoff *handoffLock
+	// dnsConfig and corefile are the kube-dns configuration and the
+	// Corefile last written. Access is coordinated using configLock.
+	dnsConfig  *config.Config
+	corefile   string
+	configLock sync.Mutex
 }
 
 func isLockedErr(err error) bool {
@@ -72,13 +91,20 @@ func isLockedErr(err error) bool {
 
 // Init initializes the parameters and networking setup necessary to run node-cache
 func (c *CacheApp) Init() {
+	if c.params.HandoffLockFile != "" {
+		handoff, err := acquireHandoffLock(c.params.HandoffLockFile)
+		if err != nil {
+			clog.Errorf("Networking will be torn down on exit regardless of other node-cache processes: %v", err)
+		}
+		c.handoff = handoff
+	}
 	if c.params.SetupInterface {
 		c.netifHandle = netif.NewNetifManager(c.params.LocalIPs)
 	}
 	if c.params.SetupIptables {
 		c.initIptables()
 	}
-	initMetrics(c.params.MetricsListenAddress)
+	initMetrics(c.params.MetricsListenAddress, c.params.MetricsAccess, effectiveconfig.Handler(c.effectiveConfig))
 	// Write the config file from template.
 	// this is required in case there is no or erroneous kube-dns configpath specified.
 	c.updateCorefile(&config.Config{})
@@ -103,35 +129,60 @@ func (c *CacheApp) isIPv6() bool {
 }
 
 func (c *CacheApp) initIptables() {
+	// Without client CIDRs, every client is intercepted. With them, the rules match the given source networks
+	// for requests and destination networks for responses.
+	clients := []string{""}
+	if len(c.params.ClientCIDRs) > 0 {
+		clients = nil
+		for _, cidr := range c.params.ClientCIDRs {
+			clients = append(clients, cidr.String())
+		}
+	}
+	match := func(flag, client string) []string {
+		if client == "" {
+			return nil
+		}
+		return []string{flag, client}
+	}
 	// using the localIPStr param since we need ip strings here
 	for _, localIP := range strings.Split(c.params.LocalIPStr, ",") {
+		for _, client := range clients {
+			src, dst := match("-s", client), match("-d", client)
+			c.iptablesRules = append(c.iptablesRules, []iptablesRule{
+				// Match traffic destined for localIp:localPort and set the flows to be NOTRACKED, this skips connection tracking
+				{utiliptables.Table("raw"), utiliptables.ChainPrerouting, append(src, "-p", "tcp", "-d", localIP,
+					"--dport", c.params.LocalPort, "-j", "NOTRACK")},
+				{utiliptables.Table("raw"), utiliptables.ChainPrerouting, append(src, "-p", "udp", "-d", localIP,
+					"--dport", c.params.LocalPort, "-j", "NOTRACK")},
+				// There are rules in filter table to allow tracked connections to be accepted. Since we skipped connection tracking,
+				// need these additional filter table rules.
+				{utiliptables.TableFilter, utiliptables.ChainInput, append(src, "-p", "tcp", "-d", localIP,
+					"--dport", c.params.LocalPort, "-j", "ACCEPT")},
+				{utiliptables.TableFilter, utiliptables.ChainInput, append(src, "-p", "udp", "-d", localIP,
+					"--dport", c.params.LocalPort, "-j", "ACCEPT")},
+				// Match traffic from localIp:localPort and set the flows to be NOTRACKED, this skips connection tracking
+				{utiliptables.Table("raw"), utiliptables.ChainOutput, append(dst, "-p", "tcp", "-s", localIP,
+					"--sport", c.params.LocalPort, "-j", "NOTRACK")},
+				{utiliptables.Table("raw"), utiliptables.ChainOutput, append(dst, "-p", "udp", "-s", localIP,
+					"--sport", c.params.LocalPort, "-j", "NOTRACK")},
+				// Additional filter table rules for traffic frpm localIp:localPort
+				{utiliptables.TableFilter, utiliptables.ChainOutput, append(dst, "-p", "tcp", "-s", localIP,
+					"--sport", c.params.LocalPort, "-j", "ACCEPT")},
+				{utiliptables.TableFilter, utiliptables.ChainOutput, append(dst, "-p", "udp", "-s", localIP,
+					"--sport", c.params.LocalPort, "-j", "ACCEPT")},
+			}...)
+		}
+		if len(c.params.ClientCIDRs) == 0 {
+			c.iptablesRules = append(c.iptablesRules, []iptablesRule{
+				// Skip connection tracking for requests to nodelocalDNS that are locally generated, example - by hostNetwork pods.
+				// With client CIDRs, these are left alone so that host processes keep using the node's resolver path.
+				{utiliptables.Table("raw"), utiliptables.ChainOutput, []string{"-p", "tcp", "-d", localIP,
+					"--dport", c.params.LocalPort, "-j", "NOTRACK"}},
+				{utiliptables.Table("raw"), utiliptables.ChainOutput, []string{"-p", "udp", "-d", localIP,
+					"--dport", c.params.LocalPort, "-j", "NOTRACK"}},
+			}...)
+		}
 		c.iptablesRules = append(c.iptablesRules, []iptablesRule{
-			// Match traffic destined for localIp:localPort and set the flows to be NOTRACKED, this skips connection tracking
-			{utiliptables.Table("raw"), utiliptables.ChainPrerouting, []string{"-p", "tcp", "-d", localIP,
-				"--dport", c.params.LocalPort, "-j", "NOTRACK"}},
-			{utiliptables.Table("raw"), utiliptables.ChainPrerouting, []string{"-p", "udp", "-d", localIP,
-				"--dport", c.params.LocalPort, "-j", "NOTRACK"}},
-			// There are rules in filter table to allow tracked connections to be accepted. Since we skipped connection tracking,
-			// need these additional filter table rules.
-			{utiliptables.TableFilter, utiliptables.ChainInput, []string{"-p", "tcp", "-d", localIP,
-				"--dport", c.params.LocalPort, "-j", "ACCEPT"}},
-			{utiliptables.TableFilter, utiliptables.ChainInput, []string{"-p", "udp", "-d", localIP,
-				"--dport", c.params.LocalPort, "-j", "ACCEPT"}},
-			// Match traffic from localIp:localPort and set the flows to be NOTRACKED, this skips connection tracking
-			{utiliptables.Table("raw"), utiliptables.ChainOutput, []string{"-p", "tcp", "-s", localIP,
-				"--sport", c.params.LocalPort, "-j", "NOTRACK"}},
-			{utiliptables.Table("raw"), utiliptables.ChainOutput, []string{"-p", "udp", "-s", localIP,
-				"--sport", c.params.LocalPort, "-j", "NOTRACK"}},
-			// Additional filter table rules for traffic frpm localIp:localPort
-			{utiliptables.TableFilter, utiliptables.ChainOutput, []string{"-p", "tcp", "-s", localIP,
-				"--sport", c.params.LocalPort, "-j", "ACCEPT"}},
-			{utiliptables.TableFilter, utiliptables.ChainOutput, []string{"-p", "udp", "-s", localIP,
-				"--sport", c.params.LocalPort, "-j", "ACCEPT"}},
-			// Skip connection tracking for requests to nodelocalDNS that are locally generated, example - by hostNetwork pods
-			{utiliptables.Table("raw"), utiliptables.ChainOutput, []string{"-p", "tcp", "-d", localIP,
-				"--dport", c.params.LocalPort, "-j", "NOTRACK"}},
-			{utiliptables.Table("raw"), utiliptables.ChainOutput, []string{"-p", "udp", "-d", localIP,
-				"--dport", c.params.LocalPort, "-j", "NOTRACK"}},
 			// skip connection tracking for healthcheck requests generated by liveness probe to health plugin
 			{utiliptables.Table("raw"), utiliptables.ChainOutput, []string{"-p", "tcp", "-d", localIP,
 				"--dport", c.params.HealthPort, "-j", "NOTRACK"}},
@@ -170,6 +221,10 @@ func (c *CacheApp) TeardownNetworking() error {
 		// exitChan is a buffered channel of size 1, so this will not block
 		c.exitChan <- struct{}{}
 	}
+	if c.handoff != nil && !c.handoff.last() {
+		clog.Infof("Another node-cache process holds %s, leaving the iptables rules and interface in place", c.params.HandoffLockFile)
+		return nil
+	}
 	var err error
 	if c.params.SetupInterface {
 		err = c.netifHandle.RemoveDummyDevice(c.params.InterfaceName)
@@ -276,6 +331,9 @@ func NewCacheApp(params *ConfigParams) (*CacheApp, error) {
 	if c.clusterDNSIP == nil {
 		clog.Warningf("Unable to lookup IP address of Upstream service %s, env %s `%s`", params.UpstreamSvcName, toSvcEnv(params.UpstreamSvcName), os.ExpandEnv(toSvcEnv(params.UpstreamSvcName)))
 	}
+	if params.NodeName != "" {
+		c.nodeLabels = inClusterNodeLabels(params.NodeName)
+	}
 	return c, nil
 }
 
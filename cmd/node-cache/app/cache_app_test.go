@@ -16,6 +16,7 @@ package app
 import (
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"sort"
@@ -24,6 +25,7 @@ import (
 	"time"
 
 	"k8s.io/dns/pkg/dns/config"
+	"k8s.io/dns/pkg/effectiveconfig"
 )
 
 const (
@@ -275,3 +277,68 @@ func TestUpdateIPv6CoreFile(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestEffectiveConfig(t *testing.T) {
+	baseDir := t.TempDir()
+	c, err := NewCacheApp(&ConfigParams{LocalIPStr: "169.254.20.10",
+		LocalPort:     "53",
+		BaseCoreFile:  filepath.Join(baseDir, templateCoreFileName),
+		CoreFile:      filepath.Join(baseDir, coreFileName),
+		KubednsCMPath: filepath.Join(baseDir, cmDirName),
+	})
+	if err != nil {
+		t.Fatalf("Failed to obtain CacheApp instance, err %v", err)
+	}
+	createBaseFiles(t, c.params)
+	c.updateCorefile(&config.Config{StubDomains: map[string][]string{"acme.local": {"1.2.3.4"}}})
+
+	effective := c.effectiveConfig()
+	if got := effective["stubDomains"]; got.Source != effectiveconfig.ConfigMap {
+		t.Errorf("Expected the stub domains from the ConfigMap, got %+v", got)
+	}
+	if got := effective["upstreamNameservers"]; got.Source != effectiveconfig.Default {
+		t.Errorf("Expected the default upstream nameservers, got %+v", got)
+	}
+	if corefile, _ := effective["Corefile"].Value.(string); !strings.Contains(corefile, "acme.local:53") {
+		t.Errorf("Expected the Corefile written, got %q", corefile)
+	}
+}
+
+func TestInitIptablesClientCIDRs(t *testing.T) {
+	hasRule := func(c *CacheApp, chain string, args string) bool {
+		for _, rule := range c.iptablesRules {
+			if string(rule.chain) == chain && strings.Join(rule.args, " ") == args {
+				return true
+			}
+		}
+		return false
+	}
+	params := &ConfigParams{LocalIPStr: "169.254.20.10", LocalPort: "53", HealthPort: "8080"}
+	c := &CacheApp{params: params}
+	c.initIptables()
+	if !hasRule(c, "PREROUTING", "-p udp -d 169.254.20.10 --dport 53 -j NOTRACK") {
+		t.Errorf("Expected requests from every client to be intercepted, got %v", c.iptablesRules)
+	}
+	if !hasRule(c, "OUTPUT", "-p udp -d 169.254.20.10 --dport 53 -j NOTRACK") {
+		t.Errorf("Expected requests from host processes to be intercepted, got %v", c.iptablesRules)
+	}
+
+	_, pods, _ := net.ParseCIDR("10.4.0.0/14")
+	params.ClientCIDRs = []*net.IPNet{pods}
+	c = &CacheApp{params: params}
+	c.initIptables()
+	if !hasRule(c, "PREROUTING", "-s 10.4.0.0/14 -p udp -d 169.254.20.10 --dport 53 -j NOTRACK") {
+		t.Errorf("Expected requests from the client CIDR to be intercepted, got %v", c.iptablesRules)
+	}
+	if !hasRule(c, "OUTPUT", "-d 10.4.0.0/14 -p udp -s 169.254.20.10 --sport 53 -j NOTRACK") {
+		t.Errorf("Expected responses to the client CIDR to skip connection tracking, got %v", c.iptablesRules)
+	}
+	for _, rule := range c.iptablesRules {
+		if rule.chain == "PREROUTING" && rule.args[0] != "-s" {
+			t.Errorf("Unexpected rule intercepting every client %v", rule)
+		}
+	}
+	if hasRule(c, "OUTPUT", "-p udp -d 169.254.20.10 --dport 53 -j NOTRACK") {
+		t.Errorf("Expected requests from host processes not to be intercepted, got %v", c.iptablesRules)
+	}
+}
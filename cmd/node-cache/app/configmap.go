@@ -15,6 +15,8 @@ package app
 
 import (
 	"bytes"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
@@ -24,6 +26,7 @@ import (
 
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"k8s.io/dns/pkg/dns/config"
+	"k8s.io/dns/pkg/effectiveconfig"
 )
 
 const (
@@ -82,20 +85,66 @@ func getStubDomainStr(stubDomainMap map[string][]string, info *stubDomainInfo) s
 }
 
 func (c *CacheApp) updateCorefile(dnsConfig *config.Config) {
-	if err := dnsConfig.ValidateNodeLocalCacheConfig(); err != nil {
-		clog.Errorf("Invalid config: %v", err)
+	newConfig, err := c.generateCorefile(dnsConfig)
+	if err != nil {
+		clog.Errorf("%v", err)
 		setupErrCount.WithLabelValues("configmap").Inc()
 		return
 	}
-	// construct part of the Corefile
-	baseConfig, err := ioutil.ReadFile(c.params.BaseCoreFile)
-	if err != nil {
-		clog.Errorf("Failed to read node-cache coreFile %s - %v", c.params.BaseCoreFile, err)
+	if err := ioutil.WriteFile(c.params.CoreFile, newConfig, 0666); err != nil {
+		clog.Errorf("Failed to write config file %s - err %v", c.params.CoreFile, err)
 		setupErrCount.WithLabelValues("configmap").Inc()
 		return
 	}
+	c.configLock.Lock()
+	c.dnsConfig, c.corefile = dnsConfig, string(newConfig)
+	c.configLock.Unlock()
+	clog.Infof("Updated Corefile with %d custom stubdomains and upstream servers %s", len(dnsConfig.StubDomains), strings.Join(dnsConfig.UpstreamNameservers, " "))
+	clog.Infof("Using config file:\n%s", newConfig)
+}
+
+// effectiveConfig returns the configuration node-cache runs with: the
+// flags, the kube-dns configuration and the Corefile generated from them.
+func (c *CacheApp) effectiveConfig() effectiveconfig.Config {
+	effective := effectiveconfig.Config{}
+	effective.AddGoFlags(flag.CommandLine)
+	c.configLock.Lock()
+	defer c.configLock.Unlock()
+	effective.AddConfig(c.dnsConfig, effectiveconfig.ConfigMap)
+	effective["Corefile"] = effectiveconfig.Field{Value: c.corefile, Source: effectiveconfig.ConfigMap}
+	return effective
+}
 
-	stubDomainStr := getStubDomainStr(dnsConfig.StubDomains, &stubDomainInfo{Port: c.params.LocalPort, CacheTTL: defaultTTL,
+// generateCorefile returns the Corefile generated from the template and the
+// kube-dns configuration.
+func (c *CacheApp) generateCorefile(dnsConfig *config.Config) ([]byte, error) {
+	if err := dnsConfig.ValidateNodeLocalCacheConfig(); err != nil {
+		return nil, fmt.Errorf("Invalid config: %v", err)
+	}
+	// construct part of the Corefile
+	baseConfig, err := ioutil.ReadFile(c.params.BaseCoreFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read node-cache coreFile %s - %v", c.params.BaseCoreFile, err)
+	}
+	pool := c.nodePool(dnsConfig)
+	dnsConfig = dnsConfig.ForNodePool(pool)
+	cacheTTL := defaultTTL
+	if pool != nil && pool.CacheTTL > 0 {
+		cacheTTL = pool.CacheTTL
+	}
+	stubDomains := dnsConfig.StubDomains
+	if zones := dnsConfig.KubeDNSZones(); len(zones) > 0 {
+		// kube-dns answers the fallthrough zones, forwarding the names it
+		// does not know itself, and the namespace domains.
+		stubDomains = make(map[string][]string, len(dnsConfig.StubDomains)+len(zones))
+		for domain, servers := range dnsConfig.StubDomains {
+			stubDomains[domain] = servers
+		}
+		for _, zone := range zones {
+			stubDomains[zone] = []string{c.clusterDNSIP.String()}
+		}
+	}
+	stubDomainStr := getStubDomainStr(stubDomains, &stubDomainInfo{Port: c.params.LocalPort, CacheTTL: cacheTTL,
 		LocalIP: strings.Replace(c.params.LocalIPStr, ",", " ", -1)})
 	upstreamServers := strings.Join(dnsConfig.UpstreamNameservers, " ")
 	if upstreamServers == "" {
@@ -126,13 +175,7 @@ func (c *CacheApp) updateCorefile(dnsConfig *config.Config) {
 	newConfig := bytes.Buffer{}
 	newConfig.WriteString(string(baseConfig))
 	newConfig.WriteString(stubDomainStr)
-	if err := ioutil.WriteFile(c.params.CoreFile, newConfig.Bytes(), 0666); err != nil {
-		clog.Errorf("Failed to write config file %s - err %v", c.params.CoreFile, err)
-		setupErrCount.WithLabelValues("configmap").Inc()
-		return
-	}
-	clog.Infof("Updated Corefile with %d custom stubdomains and upstream servers %s", len(dnsConfig.StubDomains), upstreamServers)
-	clog.Infof("Using config file:\n%s", newConfig.String())
+	return newConfig.Bytes(), nil
 }
 
 // syncInfo contains all parameters needed to watch a configmap directory for updates
@@ -0,0 +1,49 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// handoffLock lets the node-cache processes of a node, e.g. the old and the
+// new one of an in-place upgrade, share the networking setup. Each process
+// holds a shared lock on the same file while it runs, and only the last one
+// to exit tears down the iptables rules and the interface.
+type handoffLock struct {
+	file *os.File
+}
+
+// acquireHandoffLock takes a shared lock on the file at path, creating it if
+// needed. The lock is held until the process exits.
+func acquireHandoffLock(path string) (*handoffLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the handoff lock: %w", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_SH); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return &handoffLock{file: file}, nil
+}
+
+// last returns whether no other process holds the lock. The shared lock is
+// turned into an exclusive one if so, and may be lost otherwise, so it is
+// only called on exit.
+func (l *handoffLock) last() bool {
+	return syscall.Flock(int(l.file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil
+}
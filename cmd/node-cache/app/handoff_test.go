@@ -0,0 +1,43 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestHandoffLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodelocaldns.lock")
+	old, err := acquireHandoffLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacement, err := acquireHandoffLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The replacement still runs, so the old process leaves the networking
+	// in place.
+	c := &CacheApp{params: &ConfigParams{SetupInterface: true, SetupIptables: true, HandoffLockFile: path}, handoff: old}
+	if err := c.TeardownNetworking(); err != nil {
+		t.Errorf("TeardownNetworking() = %v", err)
+	}
+
+	old.file.Close()
+	if !replacement.last() {
+		t.Errorf("the replacement should be the last process holding the lock")
+	}
+}
@@ -14,13 +14,15 @@ limitations under the License.
 package app
 
 import (
-	"net"
 	"net/http"
 
 	"github.com/coredns/coredns/plugin"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/plugin/pkg/reuseport"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/dns/pkg/effectiveconfig"
+	"k8s.io/dns/pkg/httpaccess"
 )
 
 var setupErrCount = prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -30,8 +32,8 @@ var setupErrCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Help:      "The number of errors during periodic network setup for node-cache",
 }, []string{"errortype"})
 
-func initMetrics(ipport string) {
-	if err := serveMetrics(ipport); err != nil {
+func initMetrics(ipport string, access httpaccess.Config, effective http.Handler) {
+	if err := serveMetrics(ipport, access, effective); err != nil {
 		clog.Errorf("Failed to start metrics handler: %s", err)
 		return
 	}
@@ -51,17 +53,25 @@ func publishErrorMetric(label string) {
 	setupErrCount.WithLabelValues(label).Inc()
 }
 
-func serveMetrics(ipport string) error {
-	ln, err := net.Listen("tcp", ipport)
+// serveMetrics serves the metrics on ipport, and the effective configuration
+// to the clients restricted by access.
+func serveMetrics(ipport string, access httpaccess.Config, effective http.Handler) error {
+	admin, err := httpaccess.New(access)
+	if err != nil {
+		return err
+	}
+	// Like the listeners of CoreDNS, the metrics listener reuses the port, so
+	// that a new node-cache process can bind it before the old one exits.
+	ln, err := reuseport.Listen("tcp", ipport)
 	if err != nil {
 		return err
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
-	srv := &http.Server{Handler: mux}
+	mux.Handle(effectiveconfig.Path, admin.Restrict(effective))
 	go func() {
-		srv.Serve(ln)
+		admin.Serve(ln, mux)
 	}()
 	return nil
 }
@@ -0,0 +1,78 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+// nodeLabelsTimeout bounds the request for the labels of the node.
+const nodeLabelsTimeout = 10 * time.Second
+
+// inClusterNodeLabels returns a function getting the labels of the node
+// from the API server, with the service account of node-cache.
+func inClusterNodeLabels(nodeName string) func() (map[string]string, error) {
+	return func() (map[string]string, error) {
+		restConfig, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, err
+		}
+		client, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), nodeLabelsTimeout)
+		defer cancel()
+		node, err := client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get node %s: %v", nodeName, err)
+		}
+		return node.Labels, nil
+	}
+}
+
+// nodePool returns the node pool of the kube-dns configuration that selects
+// this node, nil if there is none. The labels of the node are fetched again
+// for each configuration, the last ones known are used if that fails.
+func (c *CacheApp) nodePool(dnsConfig *config.Config) *config.NodePool {
+	if len(dnsConfig.NodePools) == 0 {
+		return nil
+	}
+	if c.nodeLabels == nil {
+		clog.Warningf("Ignoring the %d node pools of the kube-dns configuration, the node name is not set", len(dnsConfig.NodePools))
+		return nil
+	}
+	labels, err := c.nodeLabels()
+	if err != nil {
+		clog.Errorf("Failed to get the labels of the node, using the last ones known - %v", err)
+		setupErrCount.WithLabelValues("configmap").Inc()
+		labels = c.lastNodeLabels
+	} else {
+		c.lastNodeLabels = labels
+	}
+	pool := dnsConfig.SelectNodePool(labels)
+	if pool != nil {
+		clog.Infof("Using the configuration of the node pool %s", pool.Name)
+	}
+	return pool
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func TestNodePools(t *testing.T) {
+	baseDir := t.TempDir()
+	params := &ConfigParams{
+		LocalIPStr:   "169.254.20.10",
+		LocalPort:    "53",
+		BaseCoreFile: filepath.Join(baseDir, templateCoreFileName),
+	}
+	if err := ioutil.WriteFile(params.BaseCoreFile, []byte(templateCoreFileContents), 0666); err != nil {
+		t.Fatalf("Failed to write template config file - %v", err)
+	}
+	c := &CacheApp{params: params, clusterDNSIP: net.ParseIP("10.0.0.10")}
+	dnsConfig := &config.Config{
+		StubDomains:         map[string][]string{"acme.local": {"1.1.1.1"}},
+		UpstreamNameservers: []string{"8.8.8.8"},
+		NodePools: []config.NodePool{{
+			Name:                "edge",
+			NodeSelector:        map[string]string{"pool": "edge"},
+			StubDomains:         map[string][]string{"acme.local": {"192.168.0.53"}},
+			UpstreamNameservers: []string{"192.168.0.54"},
+			CacheTTL:            300,
+		}},
+	}
+
+	for _, tc := range []struct {
+		name       string
+		nodeLabels func() (map[string]string, error)
+		want       []string
+		notWant    []string
+	}{
+		{
+			name:    "no node name",
+			want:    []string{"forward . 8.8.8.8", "forward . 1.1.1.1", "cache 30\n"},
+			notWant: []string{"192.168.0.5"},
+		},
+		{
+			name:       "other pool",
+			nodeLabels: func() (map[string]string, error) { return map[string]string{"pool": "gpu"}, nil },
+			want:       []string{"forward . 8.8.8.8", "forward . 1.1.1.1"},
+			notWant:    []string{"192.168.0.5"},
+		},
+		{
+			name:       "edge pool",
+			nodeLabels: func() (map[string]string, error) { return map[string]string{"pool": "edge"}, nil },
+			want:       []string{"forward . 192.168.0.54", "forward . 192.168.0.53", "cache 300\n"},
+			notWant:    []string{"8.8.8.8", "1.1.1.1"},
+		},
+		{
+			name:       "labels unavailable",
+			nodeLabels: func() (map[string]string, error) { return nil, errors.New("unauthorized") },
+			// The labels of the previous case are still known.
+			want:    []string{"forward . 192.168.0.54", "forward . 192.168.0.53"},
+			notWant: []string{"8.8.8.8", "1.1.1.1"},
+		},
+	} {
+		c.nodeLabels = tc.nodeLabels
+		corefile, err := c.generateCorefile(dnsConfig)
+		if err != nil {
+			t.Fatalf("%s: generateCorefile() = %v", tc.name, err)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(string(corefile), want) {
+				t.Errorf("%s: %q not found in the Corefile:\n%s", tc.name, want, corefile)
+			}
+		}
+		for _, notWant := range tc.notWant {
+			if strings.Contains(string(corefile), notWant) {
+				t.Errorf("%s: unexpected %q in the Corefile:\n%s", tc.name, notWant, corefile)
+			}
+		}
+	}
+	if len(dnsConfig.StubDomains) != 1 || dnsConfig.StubDomains["acme.local"][0] != "1.1.1.1" {
+		t.Errorf("The kube-dns configuration was modified: %v", dnsConfig.StubDomains)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	// The plugins of the self-test Corefile.
+	_ "github.com/coredns/coredns/plugin/bind"
+	_ "github.com/coredns/coredns/plugin/cache"
+	_ "github.com/coredns/coredns/plugin/errors"
+	_ "github.com/coredns/coredns/plugin/forward"
+
+	"k8s.io/dns/pkg/configcheck"
+	"k8s.io/dns/pkg/selftest"
+)
+
+const (
+	selfTestDomain = "cluster.local."
+
+	// selfTestCoreFile caches and forwards the queries to kube-dns over
+	// TCP, as the cluster domain block of the node-cache template does.
+	selfTestCoreFile = `%[1]s:%[2]d in-addr.arpa:%[2]d ip6.arpa:%[2]d {
+    errors
+    cache 30
+    bind 127.0.0.1
+    forward . %[3]s {
+            force_tcp
+    }
+}
+`
+)
+
+// SelfTest starts a kube-dns server against a fake clientset holding
+// fixture objects, and a node-cache in front of it on a loopback address,
+// and reports the result of a battery of lookups sent to the node-cache,
+// for the self-test subcommand. The Corefile of the node is not used.
+func SelfTest(report *configcheck.Report) {
+	s, err := selftest.StartKubeDNS(selfTestDomain)
+	report.Check("kube-dns server", err)
+	if err != nil {
+		return
+	}
+	defer s.Stop()
+
+	port, err := freeLoopbackPort()
+	if err == nil {
+		// The report is the only output on stdout.
+		caddy.Quiet, dnsserver.Quiet = true, true
+		var instance *caddy.Instance
+		instance, err = caddy.Start(caddy.CaddyfileInput{
+			Filepath:       "Corefile.selftest",
+			Contents:       []byte(fmt.Sprintf(selfTestCoreFile, selfTestDomain, port, s.Addr)),
+			ServerTypeName: "dns",
+		})
+		if err == nil {
+			defer instance.Stop()
+		}
+	}
+	report.Check("node-cache server", err)
+	if err != nil {
+		return
+	}
+	selftest.Run(fmt.Sprintf("127.0.0.1:%d", port), selftest.Lookups(selfTestDomain), report)
+}
+
+// freeLoopbackPort returns a loopback port that was free for UDP.
+func freeLoopbackPort() (int, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
@@ -0,0 +1,34 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"k8s.io/dns/pkg/configcheck"
+)
+
+func TestSelfTest(t *testing.T) {
+	var out bytes.Buffer
+	report := configcheck.NewReport(&out)
+	SelfTest(report)
+	if report.Failed() {
+		t.Fatalf("self-test failed:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "OK    node-cache server\n") {
+		t.Errorf("expected the node-cache server to start, got:\n%s", out.String())
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/caddy/caddyfile"
+	"k8s.io/dns/pkg/configcheck"
+	"k8s.io/dns/pkg/dns/config"
+)
+
+// ValidateConfig checks the kube-dns configuration and the Corefile
+// generated from the template, for --validate-only. Nothing is written.
+func ValidateConfig(params *ConfigParams, report *configcheck.Report) {
+	c, err := NewCacheApp(params)
+	if err != nil {
+		report.Check("node-cache parameters", err)
+		return
+	}
+	if c.clusterDNSIP == nil {
+		report.Skip(fmt.Sprintf("upstream service %s", params.UpstreamSvcName),
+			fmt.Sprintf("%s is not set, its cluster IP is substituted at runtime", toSvcEnv(params.UpstreamSvcName)))
+	}
+
+	dnsConfig := &config.Config{}
+	cmPath := params.KubednsCMPath
+	if cmPath == "" {
+		if _, err := os.Stat(DefaultKubednsCMPath); err == nil {
+			cmPath = DefaultKubednsCMPath
+		}
+	}
+	if cmPath != "" {
+		dnsConfig, err = config.NewFileSync(cmPath, 0).Once()
+		report.Check(fmt.Sprintf("kube-dns configuration directory %s", cmPath), err)
+		if err != nil {
+			return
+		}
+	}
+
+	corefile, err := c.generateCorefile(dnsConfig)
+	if err == nil && bytes.Contains(corefile, []byte("__PILLAR__")) {
+		err = fmt.Errorf("unknown placeholder left in %q", corefile)
+	}
+	if err == nil {
+		directives := caddy.ValidDirectives("dns")
+		if len(directives) == 0 {
+			directives = nil
+		}
+		_, err = caddyfile.Parse(params.BaseCoreFile, bytes.NewReader(corefile), directives)
+	}
+	report.Check(fmt.Sprintf("Corefile generated from %s", params.BaseCoreFile), err)
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/dns/pkg/configcheck"
+)
+
+func TestValidateConfig(t *testing.T) {
+	baseDir := t.TempDir()
+	params := &ConfigParams{LocalIPStr: "169.254.20.10",
+		LocalPort:       "53",
+		BaseCoreFile:    filepath.Join(baseDir, templateCoreFileName),
+		CoreFile:        filepath.Join(baseDir, coreFileName),
+		KubednsCMPath:   filepath.Join(baseDir, cmDirName),
+		UpstreamSvcName: UpstreamClusterDNS,
+	}
+	createBaseFiles(t, params)
+
+	validate := func() (string, bool) {
+		var out bytes.Buffer
+		report := configcheck.NewReport(&out)
+		ValidateConfig(params, report)
+		return out.String(), report.Failed()
+	}
+	if out, failed := validate(); failed {
+		t.Errorf("Expected the configuration to be valid, got:\n%s", out)
+	}
+	if _, err := os.Stat(params.CoreFile); !os.IsNotExist(err) {
+		t.Errorf("Expected no Corefile to be written, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(params.KubednsCMPath, stubDomainFileName),
+		[]byte(`{"acme.local": ["not an ip"]}`), os.ModePerm); err != nil {
+		t.Fatalf("Failed to write stubDomains file, err %v", err)
+	}
+	if out, failed := validate(); !failed || !strings.Contains(out, "FAIL  kube-dns configuration directory") {
+		t.Errorf("Expected the stub domains to be invalid, got:\n%s", out)
+	}
+	os.Remove(filepath.Join(params.KubednsCMPath, stubDomainFileName))
+
+	updateBaseFile(t, params, []byte(templateCoreFileContents+"\n__PILLAR__UNKNOWN__ {\n}\n"))
+	if out, failed := validate(); !failed || !strings.Contains(out, "FAIL  Corefile generated") {
+		t.Errorf("Expected the Corefile template to be invalid, got:\n%s", out)
+	}
+	updateBaseFile(t, params, []byte(templateCoreFileContents+"\n.:53 {\n    errors\n"))
+	if out, failed := validate(); !failed || !strings.Contains(out, "FAIL  Corefile generated") {
+		t.Errorf("Expected the unterminated block to be invalid, got:\n%s", out)
+	}
+}
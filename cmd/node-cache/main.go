@@ -22,6 +22,7 @@ import (
 	"strings"
 
 	"k8s.io/dns/cmd/node-cache/app"
+	"k8s.io/dns/pkg/configcheck"
 
 	corednsmain "github.com/coredns/coredns/coremain"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
@@ -51,11 +52,28 @@ import (
 	"k8s.io/dns/pkg/version"
 )
 
-var cache *app.CacheApp
+var (
+	cache        *app.CacheApp
+	validateOnly bool
+)
 
 func init() {
 	clog.Infof("Starting node-cache image: %+v", version.VERSION)
 	params, err := parseAndValidateFlags()
+	if flag.Arg(0) == "self-test" {
+		// The self-test does not depend on the flags of the node.
+		report := configcheck.NewReport(os.Stdout)
+		app.SelfTest(report)
+		os.Exit(report.DoneWith("self-test passed"))
+	}
+	if validateOnly {
+		report := configcheck.NewReport(os.Stdout)
+		report.Check("flags", err)
+		if err == nil {
+			app.ValidateConfig(params, report)
+		}
+		os.Exit(report.Done())
+	}
 	if err != nil {
 		clog.Fatalf("Error parsing flags - %s, Exiting", err)
 	}
@@ -71,7 +89,7 @@ func init() {
 
 func parseAndValidateFlags() (*app.ConfigParams, error) {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage of %s [self-test]:\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Runs CoreDNS v%s as a nodelocal cache listening on the specified ip:port\n\n", corednsmain.CoreVersion)
 		flag.PrintDefaults()
 	}
@@ -90,6 +108,16 @@ func parseAndValidateFlags() (*app.ConfigParams, error) {
 	flag.StringVar(&params.UpstreamSvcName, "upstreamsvc", "kube-dns", "Service name whose cluster IP is upstream for node-cache")
 	flag.StringVar(&params.HealthPort, "health-port", "8080", "port used by health plugin")
 	flag.BoolVar(&params.SkipTeardown, "skipteardown", false, "indicates whether iptables rules should be torn down on exit")
+	clientCIDRs := flag.String("client-cidrs", "", "comma-separated CIDRs of the pods to intercept the DNS requests of."+
+		" Other clients, including host-network processes, keep using the node's resolver path. Empty intercepts every client")
+	flag.StringVar(&params.NodeName, "node-name", "", "name of the node, usually set from spec.nodeName with the downward API."+
+		" Its labels select the node pool of the kube-dns configuration. Node pools are ignored if empty")
+	flag.StringVar(&params.HandoffLockFile, "handoff-lock-file", "", "if set, a file on the host, e.g. next to the xtables lock,"+
+		" locked by every node-cache process of the node. The iptables rules and interface are only torn down by the last"+
+		" one to exit, so that a new node-cache can take over before the old one exits, e.g. during an in-place upgrade")
+	params.MetricsAccess.AddGoFlags(flag.CommandLine)
+	flag.BoolVar(&validateOnly, "validate-only", false, "validate the flags, the kube-dns configuration and the Corefile"+
+		" generated from the template, print a report and exit, with a non-zero status if they are invalid")
 	flag.Parse()
 
 	for _, ipstr := range strings.Split(params.LocalIPStr, ",") {
@@ -106,6 +134,19 @@ func parseAndValidateFlags() (*app.ConfigParams, error) {
 			return params, fmt.Errorf("unexpected IP Family for localIP - %q, want IPv6=%v", ip, utilnet.IsIPv6(params.LocalIPs[0]))
 		}
 	}
+	for _, cidr := range strings.Split(*clientCIDRs, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return params, fmt.Errorf("invalid client CIDR specified - %q", cidr)
+		}
+		if utilnet.IsIPv6CIDR(ipNet) != utilnet.IsIPv6(params.LocalIPs[0]) {
+			return params, fmt.Errorf("unexpected IP Family for client CIDR - %q, want IPv6=%v", cidr, utilnet.IsIPv6(params.LocalIPs[0]))
+		}
+		params.ClientCIDRs = append(params.ClientCIDRs, ipNet)
+	}
 	// lookup specified dns port
 	f := flag.Lookup("dns.port")
 	if f == nil {
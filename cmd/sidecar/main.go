@@ -112,6 +112,12 @@ func (po *probeOptions) Set(value string) error {
 			option.Type = dns.TypeANY
 		case "SRV":
 			option.Type = dns.TypeSRV
+		case "PTR":
+			option.Type = dns.TypePTR
+			// The name may be given as the address to look up.
+			if reverse, err := dns.ReverseAddr(strings.TrimSuffix(option.Name, ".")); err == nil {
+				option.Name = reverse
+			}
 		default:
 			return fmt.Errorf("invalid type for DNS: %v", splits[4])
 		}
@@ -146,8 +152,20 @@ func configureFlags(opt *sidecar.Options, flagSet *pflag.FlagSet) {
 			" Healthcheck url will be exported under /healthcheck/<label>."+
 			" interval_seconds is optional."+
 			" This option may be specified multiple times to check multiple servers."+
-			" <type> is one of ANY, A, AAAA, SRV."+
+			" <type> is one of ANY, A, AAAA, SRV, PTR. The name of a PTR probe may be an IP."+
 			" Example: 'mydns,127.0.0.1:53,example.com,10,A'.")
+	flagSet.StringVar(
+		&opt.ReverseProbeServer, "reverse-probe-server", opt.ReverseProbeServer,
+		"if set, e.g. 127.0.0.1:53, probe the reverse lookups of the ClusterIPs of the kubernetes"+
+			" and kube-dns services on this DNS server, read from the KUBERNETES_SERVICE_HOST and"+
+			" KUBE_DNS_SERVICE_HOST environment variables, and check that they point at the service"+
+			" names. Healthcheck urls are exported under /healthcheck/kubernetes_ptr and /healthcheck/kubedns_ptr.")
+	flagSet.DurationVar(
+		&opt.ReverseProbeInterval, "reverse-probe-interval", opt.ReverseProbeInterval,
+		"interval of the reverse lookup probes")
+	flagSet.StringVar(
+		&opt.ClusterDomain, "cluster-domain", opt.ClusterDomain,
+		"cluster domain the names of the services are checked in by the reverse lookup probes")
 	flagSet.StringVar(
 		&opt.PrometheusAddr, "prometheus-addr", opt.PrometheusAddr,
 		"http address to bind metrics server to")
@@ -160,4 +178,5 @@ func configureFlags(opt *sidecar.Options, flagSet *pflag.FlagSet) {
 	flagSet.StringVar(
 		&opt.PrometheusNamespace, "prometheus-namespace", opt.PrometheusNamespace,
 		"prometheus metric namespace")
+	opt.Admin.AddFlags(flagSet)
 }
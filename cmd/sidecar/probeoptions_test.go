@@ -116,3 +116,20 @@ func TestProbeOptionsSet(t *testing.T) {
 		}
 	}
 }
+
+func TestProbeOptionsSetPTR(t *testing.T) {
+	var options probeOptions
+	for _, configStr := range []string{
+		"kubernetes,127.0.0.1:53,10.96.0.1,5,PTR",
+		"kubernetes,127.0.0.1:53,1.0.96.10.in-addr.arpa,5,PTR",
+	} {
+		if err := options.Set(configStr); err != nil {
+			t.Fatalf("Unexpected error for '%s': %v", configStr, err)
+		}
+	}
+	for _, option := range options {
+		if option.Type != dns.TypePTR || option.Name != "1.0.96.10.in-addr.arpa." {
+			t.Errorf("Incorrect PTR probe %+v", option)
+		}
+	}
+}
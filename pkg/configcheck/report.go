@@ -0,0 +1,71 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package configcheck reports the validation of the flags and configuration
+// of a binary, for its --validate-only mode.
+package configcheck
+
+import (
+	"fmt"
+	"io"
+)
+
+// Report prints the result of each check as it is made.
+type Report struct {
+	w      io.Writer
+	failed int
+}
+
+// NewReport returns a Report printing to w.
+func NewReport(w io.Writer) *Report {
+	return &Report{w: w}
+}
+
+// Check records the result of checking what, failed if err is not nil.
+func (r *Report) Check(what string, err error) {
+	if err != nil {
+		r.failed++
+		fmt.Fprintf(r.w, "FAIL  %s: %v\n", what, err)
+		return
+	}
+	fmt.Fprintf(r.w, "OK    %s\n", what)
+}
+
+// Skip records that what could not be checked, and why.
+func (r *Report) Skip(what, reason string) {
+	fmt.Fprintf(r.w, "SKIP  %s: %s\n", what, reason)
+}
+
+// Failed returns whether any check failed.
+func (r *Report) Failed() bool {
+	return r.failed > 0
+}
+
+// Done prints a summary and returns the exit code of the validation: 1 if
+// any check failed, 0 otherwise.
+func (r *Report) Done() int {
+	return r.DoneWith("configuration is valid")
+}
+
+// DoneWith is Done, printing passed as the summary if no check failed.
+func (r *Report) DoneWith(passed string) int {
+	if r.Failed() {
+		fmt.Fprintf(r.w, "%d check(s) failed\n", r.failed)
+		return 1
+	}
+	fmt.Fprintf(r.w, "%s\n", passed)
+	return 0
+}
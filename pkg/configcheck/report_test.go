@@ -0,0 +1,48 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package configcheck
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReport(t *testing.T) {
+	var out bytes.Buffer
+	r := NewReport(&out)
+	r.Check("flags", nil)
+	r.Skip("config map", "read at runtime")
+	assert.False(t, r.Failed())
+	r.Check("config directory", errors.New("invalid stub domain"))
+	assert.True(t, r.Failed())
+	assert.Equal(t, 1, r.Done())
+	assert.Equal(t, "OK    flags\n"+
+		"SKIP  config map: read at runtime\n"+
+		"FAIL  config directory: invalid stub domain\n"+
+		"1 check(s) failed\n", out.String())
+
+	out.Reset()
+	assert.Equal(t, 0, NewReport(&out).Done())
+	assert.Equal(t, "configuration is valid\n", out.String())
+
+	out.Reset()
+	assert.Equal(t, 0, NewReport(&out).DoneWith("self-test passed"))
+	assert.Equal(t, "self-test passed\n", out.String())
+}
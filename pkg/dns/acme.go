@@ -0,0 +1,246 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/util"
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+const (
+	// acmeChallengeLabel is the first label of the names of DNS-01
+	// challenges.
+	acmeChallengeLabel = "_acme-challenge"
+	// acmeChallengeTTL is the TTL of the challenge records, short so that
+	// the CA does not validate against a value cached from a previous
+	// challenge.
+	acmeChallengeTTL = 10
+	// maxACMEChallengeLifetime caps how long a challenge is published.
+	maxACMEChallengeLifetime = 24 * time.Hour
+	// acmeExpiryPeriod is how often the expired challenges are removed.
+	acmeExpiryPeriod = 10 * time.Second
+)
+
+// ACMEChallenge is a TXT record published for an ACME DNS-01 challenge
+// until it expires.
+type ACMEChallenge struct {
+	Name    string    `json:"name"`
+	Value   string    `json:"value"`
+	Expires time.Time `json:"expires"`
+}
+
+// acmeZone returns the fully qualified subtree of the cluster domain the
+// challenges are published in.
+func (kd *KubeDNS) acmeZone() string {
+	return dns.Fqdn(strings.ToLower(kd.ACMEChallengeZone + "." + kd.domain))
+}
+
+// inACMEZone returns whether the fully qualified name is in the ACME
+// challenge zone, if there is one.
+func (kd *KubeDNS) inACMEZone(name string) bool {
+	return kd.ACMEChallengeZone != "" && dns.IsSubDomain(kd.acmeZone(), name)
+}
+
+// SetACMEChallenge publishes a TXT record holding value at name, e.g.
+// _acme-challenge.my-svc.acme.cluster.local, for ttl. A name may hold
+// several values at once, e.g. for a wildcard and its base domain. The
+// challenge is published by every replica sharing the ACMEChallengeStore.
+func (kd *KubeDNS) SetACMEChallenge(name, value string, ttl time.Duration) (ACMEChallenge, error) {
+	if kd.ACMEChallengeZone == "" {
+		return ACMEChallenge{}, fmt.Errorf("ACME challenges are disabled")
+	}
+	name = dns.Fqdn(strings.ToLower(name))
+	if _, ok := dns.IsDomainName(name); !ok || !strings.HasPrefix(name, acmeChallengeLabel+".") || !kd.inACMEZone(name) {
+		return ACMEChallenge{}, fmt.Errorf("invalid challenge name %q, must be %s.<name>.%s", name, acmeChallengeLabel, kd.acmeZone())
+	}
+	if value == "" || len(value) > 255 {
+		return ACMEChallenge{}, fmt.Errorf("invalid challenge value %q", value)
+	}
+	if ttl <= 0 || ttl > maxACMEChallengeLifetime {
+		return ACMEChallenge{}, fmt.Errorf("challenge TTL must be positive and at most %v, got %v", maxACMEChallengeLifetime, ttl)
+	}
+	challenge := ACMEChallenge{Name: name, Value: value, Expires: time.Now().Add(ttl)}
+	if kd.ACMEChallengeStore != nil {
+		if err := kd.ACMEChallengeStore.add(challenge); err != nil {
+			return ACMEChallenge{}, fmt.Errorf("failed to store the challenge: %v: %w", err, server.ErrBackendUnavailable)
+		}
+	}
+
+	kd.cacheLock.Lock()
+	defer kd.unlockCache()
+	if kd.acmeChallenges == nil {
+		kd.acmeChallenges = make(map[string]map[string]time.Time)
+	}
+	if kd.acmeChallenges[name] == nil {
+		kd.acmeChallenges[name] = make(map[string]time.Time)
+	}
+	kd.acmeChallenges[name][value] = challenge.Expires
+	kd.writeACMEChallenges(name)
+	return challenge, nil
+}
+
+// DeleteACMEChallenge removes the challenge with the given value at name,
+// every challenge at name if value is empty, from every replica sharing the
+// ACMEChallengeStore. It returns whether there was any.
+func (kd *KubeDNS) DeleteACMEChallenge(name, value string) (bool, error) {
+	name = dns.Fqdn(strings.ToLower(name))
+	stored := false
+	if kd.ACMEChallengeStore != nil {
+		var err error
+		stored, err = kd.ACMEChallengeStore.remove(func(challenge ACMEChallenge) bool {
+			return challenge.Name == name && (value == "" || challenge.Value == value)
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to remove the challenge: %v: %w", err, server.ErrBackendUnavailable)
+		}
+	}
+
+	kd.cacheLock.Lock()
+	defer kd.unlockCache()
+	values, ok := kd.acmeChallenges[name]
+	if !ok {
+		return stored, nil
+	}
+	if value == "" {
+		delete(kd.acmeChallenges, name)
+	} else {
+		if _, ok := values[value]; !ok {
+			return stored, nil
+		}
+		delete(values, value)
+		if len(values) == 0 {
+			delete(kd.acmeChallenges, name)
+		}
+	}
+	kd.writeACMEChallenges(name)
+	return true, nil
+}
+
+// setACMEChallenges replaces the challenges with those of the
+// ACMEChallengeStore, dropping the expired ones.
+func (kd *KubeDNS) setACMEChallenges(challenges []ACMEChallenge) {
+	now := time.Now()
+	next := make(map[string]map[string]time.Time)
+	for _, challenge := range challenges {
+		if !now.Before(challenge.Expires) || !kd.inACMEZone(challenge.Name) {
+			continue
+		}
+		if next[challenge.Name] == nil {
+			next[challenge.Name] = make(map[string]time.Time)
+		}
+		next[challenge.Name][challenge.Value] = challenge.Expires
+	}
+
+	kd.cacheLock.Lock()
+	defer kd.unlockCache()
+	previous := kd.acmeChallenges
+	kd.acmeChallenges = next
+	for name := range previous {
+		if _, ok := next[name]; !ok {
+			kd.writeACMEChallenges(name)
+		}
+	}
+	for name := range next {
+		kd.writeACMEChallenges(name)
+	}
+}
+
+// ACMEChallenges returns the challenges published, by name and value.
+func (kd *KubeDNS) ACMEChallenges() []ACMEChallenge {
+	kd.cacheLock.RLock()
+	defer kd.cacheLock.RUnlock()
+	challenges := []ACMEChallenge{}
+	for name, values := range kd.acmeChallenges {
+		for value, expires := range values {
+			challenges = append(challenges, ACMEChallenge{Name: name, Value: value, Expires: expires})
+		}
+	}
+	sort.Slice(challenges, func(i, j int) bool {
+		if challenges[i].Name != challenges[j].Name {
+			return challenges[i].Name < challenges[j].Name
+		}
+		return challenges[i].Value < challenges[j].Value
+	})
+	return challenges
+}
+
+// runACMEExpiry removes the expired challenges until stopCh is closed.
+func (kd *KubeDNS) runACMEExpiry(stopCh <-chan struct{}) {
+	klog.V(0).Infof("Serving ACME challenges in %s", kd.acmeZone())
+	wait.Until(func() { kd.expireACMEChallenges(time.Now()) }, acmeExpiryPeriod, stopCh)
+}
+
+// expireACMEChallenges removes the challenges expired at now, from the
+// ACMEChallengeStore too.
+func (kd *KubeDNS) expireACMEChallenges(now time.Time) {
+	if kd.expireLocalACMEChallenges(now) && kd.ACMEChallengeStore != nil {
+		if _, err := kd.ACMEChallengeStore.remove(expiredACMEChallenges(now)); err != nil {
+			klog.Errorf("Failed to remove the expired ACME challenges: %v", err)
+		}
+	}
+}
+
+// expireLocalACMEChallenges removes the challenges expired at now from the
+// cache, and returns whether there was any.
+func (kd *KubeDNS) expireLocalACMEChallenges(now time.Time) bool {
+	kd.cacheLock.Lock()
+	defer kd.unlockCache()
+	removed := false
+	for name, values := range kd.acmeChallenges {
+		expired := false
+		for value, expires := range values {
+			if !now.Before(expires) {
+				delete(values, value)
+				expired = true
+			}
+		}
+		if !expired {
+			continue
+		}
+		removed = true
+		if len(values) == 0 {
+			delete(kd.acmeChallenges, name)
+		}
+		klog.V(2).Infof("Expired ACME challenges of %s", name)
+		kd.writeACMEChallenges(name)
+	}
+	return removed
+}
+
+// writeACMEChallenges replaces the records of name in the cache with its
+// challenges. The caller must hold cacheLock.
+func (kd *KubeDNS) writeACMEChallenges(name string) {
+	path := customRecordPath(name)
+	kd.cache.DeletePath(path...)
+	for value := range kd.acmeChallenges[name] {
+		// Pointing the record at itself leaves A and AAAA queries
+		// without answers, as for the canary.
+		record := util.NewServiceRecord(strings.TrimSuffix(name, "."), 0)
+		record.Ttl = acmeChallengeTTL
+		record.Text = value
+		kd.cache.SetEntry(util.HashServiceRecord(record), record, name, path...)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	clientset "k8s.io/client-go/kubernetes"
+	kcache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+// ACMEChallengeStore shares the ACME challenges between the replicas: they
+// are held in the data of a ConfigMap, each key a JSON ACMEChallenge, which
+// every replica watches and serves.
+type ACMEChallengeStore struct {
+	client    clientset.Interface
+	namespace string
+	name      string
+
+	lock       sync.Mutex
+	controller kcache.Controller
+}
+
+// NewACMEChallengeStore returns an ACMEChallengeStore holding the challenges
+// in the ConfigMap name of namespace, created as needed.
+func NewACMEChallengeStore(client clientset.Interface, namespace, name string) *ACMEChallengeStore {
+	return &ACMEChallengeStore{client: client, namespace: namespace, name: name}
+}
+
+// Run calls handler with the challenges of the ConfigMap whenever it
+// changes, until stopCh is closed.
+func (s *ACMEChallengeStore) Run(stopCh <-chan struct{}, handler func([]ACMEChallenge)) {
+	selector := fields.OneTermEqualSelector("metadata.name", s.name).String()
+	update := func(obj interface{}) {
+		if cm, ok := obj.(*v1.ConfigMap); ok && cm.Name == s.name {
+			handler(acmeChallengesOf(cm.Data))
+		}
+	}
+	_, controller := kcache.NewInformer(&kcache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return s.client.CoreV1().ConfigMaps(s.namespace).List(context.TODO(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return s.client.CoreV1().ConfigMaps(s.namespace).Watch(context.TODO(), options)
+		},
+	}, &v1.ConfigMap{}, 0, kcache.ResourceEventHandlerFuncs{
+		AddFunc:    update,
+		UpdateFunc: func(oldObj, newObj interface{}) { update(newObj) },
+		DeleteFunc: func(obj interface{}) { handler(nil) },
+	})
+	s.lock.Lock()
+	s.controller = controller
+	s.lock.Unlock()
+	controller.Run(stopCh)
+}
+
+// HasSynced returns true once Run handled the initial challenges.
+func (s *ACMEChallengeStore) HasSynced() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.controller != nil && s.controller.HasSynced()
+}
+
+// add adds challenge, replacing the one with the same name and value.
+func (s *ACMEChallengeStore) add(challenge ACMEChallenge) error {
+	value, err := json.Marshal(challenge)
+	if err != nil {
+		return err
+	}
+	return s.update(func(data map[string]string) bool {
+		data[acmeChallengeKey(challenge.Name, challenge.Value)] = string(value)
+		return true
+	})
+}
+
+// remove removes the challenges matched by match, and returns whether there
+// was any.
+func (s *ACMEChallengeStore) remove(match func(ACMEChallenge) bool) (bool, error) {
+	removed := false
+	err := s.update(func(data map[string]string) bool {
+		removed = false
+		for key, value := range data {
+			var challenge ACMEChallenge
+			if err := json.Unmarshal([]byte(value), &challenge); err != nil || match(challenge) {
+				delete(data, key)
+				removed = true
+			}
+		}
+		return removed
+	})
+	return removed, err
+}
+
+// update applies mutate to the data of the ConfigMap, and writes it if
+// mutate returns true, retrying on the concurrent writes of the other
+// replicas.
+func (s *ACMEChallengeStore) update(mutate func(data map[string]string) bool) error {
+	configMaps := s.client.CoreV1().ConfigMaps(s.namespace)
+	retriable := func(err error) bool { return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) }
+	return retry.OnError(retry.DefaultRetry, retriable, func() error {
+		cm, err := configMaps.Get(context.TODO(), s.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm = &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: s.name, Namespace: s.namespace}}
+			if cm.Data = map[string]string{}; !mutate(cm.Data) {
+				return nil
+			}
+			_, err = configMaps.Create(context.TODO(), cm, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		if !mutate(cm.Data) {
+			return nil
+		}
+		_, err = configMaps.Update(context.TODO(), cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// acmeChallengeKey returns the key of the challenge with the given name and
+// value in the data of the ConfigMap.
+func acmeChallengeKey(name, value string) string {
+	sum := sha256.Sum256([]byte(name + "\x00" + value))
+	return hex.EncodeToString(sum[:16])
+}
+
+// acmeChallengesOf returns the challenges held in the data of the
+// ConfigMap, ignoring those that cannot be decoded.
+func acmeChallengesOf(data map[string]string) []ACMEChallenge {
+	challenges := make([]ACMEChallenge, 0, len(data))
+	for key, value := range data {
+		var challenge ACMEChallenge
+		if err := json.Unmarshal([]byte(value), &challenge); err != nil {
+			klog.Errorf("Invalid ACME challenge %s: %v", key, err)
+			continue
+		}
+		challenges = append(challenges, challenge)
+	}
+	return challenges
+}
+
+// expiredACMEChallenges returns a match of the challenges expired at now,
+// for remove.
+func expiredACMEChallenges(now time.Time) func(ACMEChallenge) bool {
+	return func(challenge ACMEChallenge) bool { return !now.Before(challenge.Expires) }
+}
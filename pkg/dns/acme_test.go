@@ -0,0 +1,135 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	kcache "k8s.io/client-go/tools/cache"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func recordTexts(t *testing.T, kd *KubeDNS, name string) []string {
+	records, err := kd.Records(name, false)
+	if err != nil {
+		return nil
+	}
+	var texts []string
+	for _, record := range records {
+		texts = append(texts, record.Text)
+	}
+	return texts
+}
+
+func TestACMEChallenges(t *testing.T) {
+	kd := newKubeDNS()
+	_, err := kd.SetACMEChallenge("_acme-challenge.web.acme."+testDomain, "token", time.Minute)
+	assert.Error(t, err, "challenges are disabled without a zone")
+
+	kd.ACMEChallengeZone = "acme"
+	name := "_acme-challenge.web.acme." + testDomain
+	_, err = kd.SetACMEChallenge(name, "token-1", time.Minute)
+	require.NoError(t, err)
+	_, err = kd.SetACMEChallenge(name, "token-2", time.Hour)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"token-1", "token-2"}, recordTexts(t, kd, name))
+	assert.Len(t, kd.ACMEChallenges(), 2)
+
+	for _, invalid := range []string{
+		"web.acme." + testDomain,
+		"_acme-challenge.web.default.svc." + testDomain,
+		"_acme-challenge.example.com.",
+	} {
+		_, err = kd.SetACMEChallenge(invalid, "token", time.Minute)
+		assert.Error(t, err, invalid)
+	}
+	_, err = kd.SetACMEChallenge(name, "token", 48*time.Hour)
+	assert.Error(t, err)
+
+	// Challenges expire on their own.
+	kd.expireACMEChallenges(time.Now().Add(2 * time.Minute))
+	assert.ElementsMatch(t, []string{"token-2"}, recordTexts(t, kd, name))
+
+	deleted, err := kd.DeleteACMEChallenge(name, "token-1")
+	require.NoError(t, err)
+	assert.False(t, deleted)
+	deleted, err = kd.DeleteACMEChallenge(name, "")
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	assert.Empty(t, recordTexts(t, kd, name))
+	assert.Empty(t, kd.ACMEChallenges())
+
+	// Custom records cannot shadow the challenges.
+	next := config.NewDefaultConfig()
+	next.CustomRecords = name + " TXT \"forged\""
+	kd.updateConfig(next)
+	assert.Empty(t, recordTexts(t, kd, name))
+}
+
+func TestACMEChallengesShared(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	replicas := make([]*KubeDNS, 2)
+	for i := range replicas {
+		kd := newKubeDNS()
+		kd.ACMEChallengeZone = "acme"
+		kd.ACMEChallengeStore = NewACMEChallengeStore(client, "kube-system", "kube-dns-acme-challenges")
+		go kd.ACMEChallengeStore.Run(stopCh, kd.setACMEChallenges)
+		require.True(t, kcache.WaitForCacheSync(stopCh, kd.ACMEChallengeStore.HasSynced))
+		replicas[i] = kd
+	}
+	name := "_acme-challenge.web.acme." + testDomain
+
+	// A challenge published through a replica is served by the others.
+	_, err := replicas[0].SetACMEChallenge(name, "token-1", time.Minute)
+	require.NoError(t, err)
+	_, err = replicas[1].SetACMEChallenge(name, "token-2", time.Minute)
+	require.NoError(t, err)
+	for _, kd := range replicas {
+		kd := kd
+		assert.Eventually(t, func() bool {
+			return len(recordTexts(t, kd, name)) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	cm, err := client.CoreV1().ConfigMaps("kube-system").Get(context.TODO(), "kube-dns-acme-challenges", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Len(t, cm.Data, 2)
+
+	// So is its removal.
+	deleted, err := replicas[1].DeleteACMEChallenge(name, "token-1")
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	assert.Eventually(t, func() bool {
+		texts := recordTexts(t, replicas[0], name)
+		return len(texts) == 1 && texts[0] == "token-2"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// And its expiry.
+	replicas[0].expireACMEChallenges(time.Now().Add(2 * time.Minute))
+	assert.Eventually(t, func() bool {
+		return len(recordTexts(t, replicas[1], name)) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, replicas[1].ACMEChallenges())
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	kcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/util"
+)
+
+// AliasesAnnotation lists, comma-separated, additional names of a service
+// in its namespace. Each alias resolves like the service itself, e.g.
+// db.default.svc.cluster.local for a service annotated with "db". An alias
+// never shadows a service with the same name, nor the alias of another
+// service published first.
+const AliasesAnnotation = "dns.kubernetes.io/aliases"
+
+// serviceAliases returns the valid aliases of a service.
+func serviceAliases(service *v1.Service) []string {
+	value, ok := service.Annotations[AliasesAnnotation]
+	if !ok {
+		return nil
+	}
+	aliases := sets.NewString()
+	for _, alias := range strings.Split(value, ",") {
+		alias = strings.ToLower(strings.TrimSpace(alias))
+		if alias == "" || alias == service.Name {
+			continue
+		}
+		if errs := validation.IsDNS1035Label(alias); len(errs) > 0 {
+			klog.Warningf("Ignoring invalid alias %q of service %s/%s: %s",
+				alias, service.Namespace, service.Name, strings.Join(errs, ", "))
+			continue
+		}
+		aliases.Insert(alias)
+	}
+	return aliases.List()
+}
+
+// updateAliases publishes the aliases of service with publish, which
+// stores the records of the service under the given alias, and removes
+// the aliases it no longer has. A nil publish removes every alias. Must be
+// called with the cacheLock held.
+func (kd *KubeDNS) updateAliases(service *v1.Service, publish func(alias string)) {
+	key, err := kcache.MetaNamespaceKeyFunc(service)
+	if err != nil {
+		return
+	}
+	// The records of the service replaced those of any alias with its name.
+	delete(kd.aliasOwners, key)
+
+	published := sets.NewString()
+	if publish != nil {
+		for _, alias := range serviceAliases(service) {
+			aliasKey := service.Namespace + "/" + alias
+			if owner, ok := kd.aliasOwners[aliasKey]; ok && owner != key {
+				klog.Warningf("Not publishing alias %q of service %s: already an alias of %s", alias, key, owner)
+				continue
+			}
+			if kd.serviceExists(aliasKey) {
+				klog.Warningf("Not publishing alias %q of service %s: a service has this name", alias, key)
+				continue
+			}
+			kd.aliasOwners[aliasKey] = key
+			publish(alias)
+			published.Insert(alias)
+		}
+	}
+
+	for _, alias := range kd.serviceAliases[key] {
+		if published.Has(alias) {
+			continue
+		}
+		aliasKey := service.Namespace + "/" + alias
+		if kd.aliasOwners[aliasKey] != key {
+			continue
+		}
+		delete(kd.aliasOwners, aliasKey)
+		if !kd.serviceExists(aliasKey) {
+			kd.cache.DeletePath(append(kd.domainPath, serviceSubdomain, service.Namespace, alias)...)
+		}
+	}
+	if published.Len() == 0 {
+		delete(kd.serviceAliases, key)
+		return
+	}
+	kd.serviceAliases[key] = published.List()
+}
+
+// aliasFQDN returns the fqdn of an alias in namespace.
+func (kd *KubeDNS) aliasFQDN(namespace, alias string) string {
+	domainLabels := append(kd.domainPath, serviceSubdomain, namespace, alias)
+	return dns.Fqdn(strings.Join(util.ReverseArray(domainLabels), "."))
+}
+
+// serviceExists returns whether the service with the given namespace/name
+// is in the services store.
+func (kd *KubeDNS) serviceExists(key string) bool {
+	_, exists, err := kd.servicesStore.GetByKey(key)
+	return err == nil && exists
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// named returns a service with the namespace of s and the given name, to
+// query the records of an alias of s.
+func named(s *v1.Service, name string) *v1.Service {
+	return &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: s.Namespace, Name: name}}
+}
+
+func TestServiceAliases(t *testing.T) {
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	assert.Nil(t, serviceAliases(s))
+	s.Annotations = map[string]string{AliasesAnnotation: " db, Legacy-DB,,db," + testService + ",not_valid,-db"}
+	assert.Equal(t, []string{"db", "legacy-db"}, serviceAliases(s))
+}
+
+func TestClusterIPServiceAliases(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	s.Annotations = map[string]string{AliasesAnnotation: "db,legacy-db"}
+	require.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	assertDNSForClusterIP(t, "", kd, s, []string{"1.2.3.4"})
+	assertDNSForClusterIP(t, "", kd, named(s, "db"), []string{"1.2.3.4"})
+	assertDNSForClusterIP(t, "", kd, named(s, "legacy-db"), []string{"1.2.3.4"})
+	// SRV records of aliases target the canonical name.
+	records, err := kd.Records(getSRVFQDN(kd, named(s, "db"), "http"), false)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, getServiceFQDN(kd.domain, s), records[0].Host)
+
+	// Removing an alias removes its records only.
+	updated := *s
+	updated.Annotations = map[string]string{AliasesAnnotation: "db"}
+	require.NoError(t, kd.servicesStore.Update(&updated))
+	kd.updateService(s, &updated)
+	assertDNSForClusterIP(t, "", kd, named(s, "db"), []string{"1.2.3.4"})
+	assertNoDNSForClusterIP(t, kd, named(s, "legacy-db"))
+
+	require.NoError(t, kd.servicesStore.Delete(&updated))
+	kd.removeService(&updated)
+	assertNoDNSForClusterIP(t, kd, s)
+	assertNoDNSForClusterIP(t, kd, named(s, "db"))
+	assert.Empty(t, kd.serviceAliases)
+	assert.Empty(t, kd.aliasOwners)
+}
+
+func TestAliasConflicts(t *testing.T) {
+	kd := newKubeDNS()
+	db := newService(testNamespace, "db", "1.2.3.5", "http", 80)
+	require.NoError(t, kd.servicesStore.Add(db))
+	kd.newService(db)
+
+	// An alias does not shadow a service.
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	s.Annotations = map[string]string{AliasesAnnotation: "db,cache"}
+	require.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	assertDNSForClusterIP(t, "", kd, db, []string{"1.2.3.5"})
+	assertDNSForClusterIP(t, "", kd, named(s, "cache"), []string{"1.2.3.4"})
+
+	// Nor the alias of another service.
+	other := newService(testNamespace, "other", "1.2.3.6", "http", 80)
+	other.Annotations = map[string]string{AliasesAnnotation: "cache"}
+	require.NoError(t, kd.servicesStore.Add(other))
+	kd.newService(other)
+	assertDNSForClusterIP(t, "", kd, named(s, "cache"), []string{"1.2.3.4"})
+
+	// A service created with the name of an alias replaces it, and keeps
+	// its records when the aliased service goes away.
+	cache := newService(testNamespace, "cache", "1.2.3.7", "http", 80)
+	require.NoError(t, kd.servicesStore.Add(cache))
+	kd.newService(cache)
+	assertDNSForClusterIP(t, "", kd, cache, []string{"1.2.3.7"})
+	require.NoError(t, kd.servicesStore.Delete(s))
+	kd.removeService(s)
+	assertDNSForClusterIP(t, "", kd, cache, []string{"1.2.3.7"})
+	assertDNSForClusterIP(t, "", kd, db, []string{"1.2.3.5"})
+}
+
+func TestHeadlessServiceAliases(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	s.Annotations = map[string]string{AliasesAnnotation: "db"}
+	require.NoError(t, kd.servicesStore.Add(s))
+	e := newEndpoints(s, newSubsetWithOnePort("", 80, "10.0.0.1", "10.0.0.2"))
+	require.NoError(t, kd.endpointsStore.Add(e))
+	kd.newService(s)
+	assertDNSForClusterIP(t, "", kd, named(s, "db"), []string{"10.0.0.1", "10.0.0.2"})
+
+	e.Subsets = []v1.EndpointSubset{newSubsetWithOnePort("", 80, "10.0.0.3")}
+	kd.handleEndpointAdd(e)
+	assertDNSForClusterIP(t, "", kd, named(s, "db"), []string{"10.0.0.3"})
+}
+
+func TestExternalNameServiceAliases(t *testing.T) {
+	kd := newKubeDNS()
+	s := newExternalNameService()
+	s.Annotations = map[string]string{AliasesAnnotation: "db"}
+	require.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	records, err := kd.Records(getServiceFQDN(kd.domain, named(s, "db")), false)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, s.Spec.ExternalName, records[0].Host)
+
+	kd.removeService(s)
+	_, err = kd.Records(getServiceFQDN(kd.domain, named(s, "db")), false)
+	assert.Error(t, err)
+}
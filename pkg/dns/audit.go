@@ -0,0 +1,209 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/dns/pkg/dns/util"
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// AuditOpAdd is logged when a record name starts being served.
+	AuditOpAdd = "add"
+	// AuditOpUpdate is logged when the value served for a name changes.
+	AuditOpUpdate = "update"
+	// AuditOpDelete is logged when a record name stops being served.
+	AuditOpDelete = "delete"
+
+	auditKindService   = "Service"
+	auditKindEndpoints = "Endpoints"
+)
+
+// AuditEvent is a single record change as written to the audit log, one
+// JSON object per line.
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	Op   string    `json:"op"`
+	// Name is the fully qualified DNS name of the record.
+	Name string `json:"name"`
+	// Record is the value served after the change. For deletes it is the
+	// value that was served before the change.
+	Record skymsg.Service `json:"record"`
+	// Previous holds the value served before an update.
+	Previous *skymsg.Service `json:"previous,omitempty"`
+
+	// The Kubernetes object that caused the change.
+	Kind            string `json:"kind"`
+	Namespace       string `json:"namespace"`
+	ObjectName      string `json:"objectName"`
+	UID             string `json:"uid"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// AuditLog writes a structured stream of record changes so that the history
+// of a name can be reconstructed after the fact. It keeps the last set of
+// records generated for each owning object in order to compute the
+// per-record add/update/delete events. An AuditLog is safe for concurrent use.
+type AuditLog struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+	// records maps an owner key (kind/namespace/name) to the records it
+	// last generated, keyed by fqdn.
+	records map[string]recordSet
+}
+
+// NewAuditLog returns an AuditLog writing JSON lines to w.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{
+		enc:     json.NewEncoder(w),
+		records: make(map[string]recordSet),
+	}
+}
+
+func auditOwnerKey(kind string, obj metav1.Object) string {
+	return kind + "/" + obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// recordSet collects the records generated for a single owning object,
+// keyed by fqdn. recordSet methods are no-ops on a nil set.
+type recordSet map[string]skymsg.Service
+
+func (rs recordSet) add(fqdn string, record *skymsg.Service) {
+	if rs != nil {
+		rs[fqdn] = *record
+	}
+}
+
+// addReverse adds the PTR record served for ip.
+func (rs recordSet) addReverse(ip string, record *skymsg.Service) {
+	if rs == nil {
+		return
+	}
+	if name, err := dns.ReverseAddr(ip); err == nil {
+		rs[name] = *record
+	}
+}
+
+// update replaces the records generated by the given object and logs the
+// differences with the previously generated records.
+func (a *AuditLog) update(kind string, obj metav1.Object, records recordSet) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.apply(auditOwnerKey(kind, obj), kind, obj, records)
+}
+
+// delete logs the removal of every record owned by the ownerKind object
+// with the same namespace and name as obj. obj is the object whose change
+// caused the removal.
+func (a *AuditLog) delete(ownerKind string, kind string, obj metav1.Object) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.apply(auditOwnerKey(ownerKind, obj), kind, obj, nil)
+}
+
+// deleteReverse logs the removal of the PTR records generated by the given
+// object, leaving its forward records in place.
+func (a *AuditLog) deleteReverse(kind string, obj metav1.Object) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	key := auditOwnerKey(kind, obj)
+	remaining := recordSet{}
+	for name, record := range a.records[key] {
+		if !isReverseName(name) {
+			remaining[name] = record
+		}
+	}
+	a.apply(key, kind, obj, remaining)
+}
+
+// apply must be called with the lock held.
+func (a *AuditLog) apply(key string, kind string, obj metav1.Object, records recordSet) {
+	previous := a.records[key]
+	now := time.Now()
+	diffRecords(previous, records, func(op, name string, record skymsg.Service, old *skymsg.Service) {
+		a.write(AuditEvent{Time: now, Op: op, Name: name, Record: record, Previous: old}, kind, obj)
+	})
+	if len(records) == 0 {
+		delete(a.records, key)
+		return
+	}
+	a.records[key] = records
+}
+
+// diffRecords calls change with each difference between the previous and
+// the current records of an owner, by name: the additions and updates
+// first, then the deletions. old is only set for updates.
+func diffRecords(previous, records recordSet, change func(op, name string, record skymsg.Service, old *skymsg.Service)) {
+	for _, name := range sortedNames(records) {
+		record := records[name]
+		old, existed := previous[name]
+		switch {
+		case !existed:
+			change(AuditOpAdd, name, record, nil)
+		case old != record:
+			change(AuditOpUpdate, name, record, &old)
+		}
+	}
+	for _, name := range sortedNames(previous) {
+		if _, ok := records[name]; !ok {
+			change(AuditOpDelete, name, previous[name], nil)
+		}
+	}
+}
+
+func (a *AuditLog) write(event AuditEvent, kind string, obj metav1.Object) {
+	event.Kind = kind
+	event.Namespace = obj.GetNamespace()
+	event.ObjectName = obj.GetName()
+	event.UID = string(obj.GetUID())
+	event.ResourceVersion = obj.GetResourceVersion()
+	if err := a.enc.Encode(&event); err != nil {
+		klog.Errorf("Failed to write audit event for %q: %v", event.Name, err)
+	}
+}
+
+func isReverseName(name string) bool {
+	return strings.HasSuffix(name, util.ArpaSuffix) || strings.HasSuffix(name, util.ArpaSuffixV6)
+}
+
+func sortedNames(records recordSet) []string {
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
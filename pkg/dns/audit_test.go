@@ -0,0 +1,149 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+)
+
+func readAuditEvents(t *testing.T, buf *bytes.Buffer) []AuditEvent {
+	var events []AuditEvent
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var event AuditEvent
+		require.NoError(t, dec.Decode(&event))
+		events = append(events, event)
+	}
+	return events
+}
+
+func countAuditOps(events []AuditEvent) map[string]int {
+	ops := map[string]int{}
+	for _, event := range events {
+		ops[event.Op]++
+	}
+	return ops
+}
+
+func TestAuditLogPortalService(t *testing.T) {
+	buf := &bytes.Buffer{}
+	kd := newKubeDNS()
+	kd.AuditLog = NewAuditLog(buf)
+
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	s.UID = "uid-1"
+	s.ResourceVersion = "10"
+	kd.newService(s)
+
+	events := readAuditEvents(t, buf)
+	// A record, SRV record and PTR record.
+	require.Equal(t, 3, len(events))
+	for _, event := range events {
+		assert.Equal(t, AuditOpAdd, event.Op)
+		assert.Equal(t, "Service", event.Kind)
+		assert.Equal(t, "uid-1", event.UID)
+		assert.Equal(t, "10", event.ResourceVersion)
+	}
+	assert.Equal(t, "4.3.2.1.in-addr.arpa.", events[0].Name)
+	assert.Equal(t, "testservice.default.svc.cluster.local.", events[0].Record.Host)
+
+	// Re-applying the same service is not a change.
+	kd.newService(s)
+	assert.Empty(t, readAuditEvents(t, buf))
+
+	// Changing the port updates the SRV record in place.
+	s.ResourceVersion = "11"
+	s.Spec.Ports[0].Port = 8080
+	kd.updateService(s, s)
+	events = readAuditEvents(t, buf)
+	require.Equal(t, 1, len(events))
+	assert.Equal(t, AuditOpUpdate, events[0].Op)
+	assert.Equal(t, 8080, events[0].Record.Port)
+	assert.Equal(t, 80, events[0].Previous.Port)
+	assert.Equal(t, "11", events[0].ResourceVersion)
+
+	kd.removeService(s)
+	assert.Equal(t, map[string]int{AuditOpDelete: 3}, countAuditOps(readAuditEvents(t, buf)))
+}
+
+func TestAuditLogHeadlessService(t *testing.T) {
+	buf := &bytes.Buffer{}
+	kd := newKubeDNS()
+	kd.AuditLog = NewAuditLog(buf)
+
+	s := newHeadlessService()
+	assert.NoError(t, kd.servicesStore.Add(s))
+	e := newEndpoints(s, newSubsetWithOnePortWithHostname("", 80, true, "10.0.0.1", "10.0.0.2"))
+	e.UID = "endpoints-uid"
+	kd.handleEndpointAdd(e)
+
+	events := readAuditEvents(t, buf)
+	// Two A records and two PTR records for the named endpoints.
+	assert.Equal(t, map[string]int{AuditOpAdd: 4}, countAuditOps(events))
+	for _, event := range events {
+		assert.Equal(t, "Endpoints", event.Kind)
+		assert.Equal(t, "endpoints-uid", event.UID)
+	}
+
+	newEndpoints := e.DeepCopy()
+	newEndpoints.Subsets = []v1.EndpointSubset{newSubsetWithOnePortWithHostname("", 80, true, "10.0.0.1")}
+	kd.handleEndpointUpdate(e, newEndpoints)
+	assert.Equal(t, map[string]int{AuditOpDelete: 2}, countAuditOps(readAuditEvents(t, buf)))
+
+	// The PTR record, then the A record, of the remaining endpoint.
+	kd.handleEndpointDelete(newEndpoints)
+	events = readAuditEvents(t, buf)
+	require.Equal(t, 2, len(events))
+	assert.Equal(t, AuditOpDelete, events[0].Op)
+	assert.Equal(t, "1.0.0.10.in-addr.arpa.", events[0].Name)
+	assert.Equal(t, AuditOpDelete, events[1].Op)
+}
+
+func TestAuditLogDisabled(t *testing.T) {
+	buf := &bytes.Buffer{}
+	kd := newKubeDNS()
+	kd.AuditLog = NewAuditLog(buf)
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	kd.newService(s)
+	require.NotEmpty(t, readAuditEvents(t, buf))
+
+	// Once disabled, the records are neither collected nor written, while
+	// they are still served.
+	kd.AuditLog = nil
+	assert.Nil(t, kd.newRecordSet())
+	other := newService(testNamespace, "other", "1.2.3.5", "http", 80)
+	kd.newService(other)
+	kd.removeService(s)
+	headless := newHeadlessService()
+	headless.Name = "headless"
+	assert.NoError(t, kd.servicesStore.Add(headless))
+	e := newEndpoints(headless, newSubsetWithOnePortWithHostname("", 80, true, "10.0.0.1"))
+	kd.handleEndpointAdd(e)
+	assertDNSForHeadlessService(t, kd, e)
+	kd.handleEndpointDelete(e)
+
+	assertDNSForClusterIP(t, "disabled", kd, other, []string{other.Spec.ClusterIP})
+	assertNoDNSForClusterIP(t, kd, s)
+	assertNoDNSForHeadlessService(t, kd, headless)
+	assert.Zero(t, buf.Len())
+}
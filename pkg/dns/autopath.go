@@ -0,0 +1,52 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"k8s.io/dns/pkg/dns/features"
+)
+
+// SearchPath returns the search domains of the pod at remote, as set by
+// the kubelet for the ClusterFirst DNS policy: <namespace>.svc.<domain>,
+// svc.<domain> and <domain>. The search domains of the node are not known,
+// the names are tried as is after them. It returns nil, so that the query
+// is not expanded, if the Autopath feature gate is disabled or remote is
+// not a pod. It is a server.SearchPath.
+func (kd *KubeDNS) SearchPath(remote net.Addr) []string {
+	if kd.PodIndex == nil || !features.Enabled(features.Autopath) {
+		return nil
+	}
+	ip := remoteIP(remote)
+	if ip == nil {
+		return nil
+	}
+	pod, ok := kd.PodIndex.Lookup(ip.String())
+	if !ok {
+		return nil
+	}
+	domain := dns.Fqdn(strings.ToLower(kd.domain))
+	return []string{
+		pod.Namespace + "." + serviceSubdomain + "." + domain,
+		serviceSubdomain + "." + domain,
+		domain,
+	}
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/dns/pkg/dns/features"
+)
+
+func TestSearchPath(t *testing.T) {
+	kd := newTenantKubeDNS(t)
+	pod := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4242}
+	node := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 4242}
+
+	// Disabled by default.
+	assert.Nil(t, kd.SearchPath(pod))
+
+	require.NoError(t, features.DefaultMutableFeatureGate.Set("Autopath=true"))
+	defer func() {
+		require.NoError(t, features.DefaultMutableFeatureGate.Set("Autopath=false"))
+	}()
+	assert.Equal(t, []string{"ns-a.svc.cluster.local.", "svc.cluster.local.", "cluster.local."}, kd.SearchPath(pod))
+	assert.Nil(t, kd.SearchPath(node))
+}
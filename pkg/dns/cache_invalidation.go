@@ -0,0 +1,339 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+const (
+	// cacheInvalidationBatchPeriod is how long the names of changed records
+	// are gathered before being invalidated together.
+	cacheInvalidationBatchPeriod = 10 * time.Millisecond
+	// cacheInvalidationMaxNames is the most names sent in a message. The
+	// peers flush their caches rather than receive more.
+	cacheInvalidationMaxNames = 256
+	// cacheInvalidationMaxMessage is the largest message received.
+	cacheInvalidationMaxMessage = 65535
+	// cacheInvalidationMaxAge is how old a message received may be, so
+	// that the messages captured cannot flush the caches over and over.
+	cacheInvalidationMaxAge = time.Minute
+)
+
+var (
+	cacheInvalidationMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kubedns",
+		Subsystem: "cache_invalidation",
+		Name:      "messages_total",
+		Help:      "Cache invalidation messages, by direction: sent or received, and kind: names or flush.",
+	}, []string{"direction", "kind"})
+	cacheInvalidationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kubedns",
+		Subsystem: "cache_invalidation",
+		Name:      "errors_total",
+		Help:      "Cache invalidation messages that could not be sent or were rejected, by direction.",
+	}, []string{"direction"})
+	registerCacheInvalidationMetrics sync.Once
+)
+
+// cacheInvalidationMessage is the message broadcast to the peers, as JSON
+// preceded by its HMAC-SHA256 with the key of the replicas.
+type cacheInvalidationMessage struct {
+	// Names are the names of the changed records. The whole cache is
+	// flushed if there are none.
+	Names []string `json:"names,omitempty"`
+	// Time is when the message was sent, in seconds since the epoch.
+	Time int64 `json:"time"`
+}
+
+// CacheInvalidation invalidates the replies cached by this replica and by
+// its peers, the other replicas behind the same Service, as soon as one of
+// them changes records, so that the replicas do not answer differently
+// until the cached replies expire. The changed names are broadcast over
+// UDP to the peers, the addresses of the headless service Peers, which
+// invalidate their caches in turn. Only the recent messages from peers,
+// authenticated with the key shared by the replicas, are accepted.
+type CacheInvalidation struct {
+	// Invalidate removes the cached replies holding the records of names,
+	// every reply if names is empty. Must be set before Start().
+	Invalidate func(names []string) int
+	// Peers is the name of the headless service selecting the replicas.
+	Peers string
+
+	conn net.PacketConn
+	port int
+	// key authenticates the messages, shared by the replicas.
+	key []byte
+	// local are the addresses of this replica, skipped among the peers.
+	local map[string]bool
+	// resolvePeers returns the addresses of the peers. Replaced in tests.
+	resolvePeers func() []string
+}
+
+// NewCacheInvalidation returns a CacheInvalidation exchanging messages with
+// the peers resolved from the peers headless service on the UDP port,
+// authenticated with key.
+func NewCacheInvalidation(port int, peers string, key []byte) (*CacheInvalidation, error) {
+	conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for cache invalidations: %w", err)
+	}
+	local := map[string]bool{}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				local[ipNet.IP.String()] = true
+			}
+		}
+	} else {
+		klog.Warningf("Failed to list the local addresses, cache invalidations may be sent to self: %v", err)
+	}
+	return &CacheInvalidation{Peers: peers, conn: conn, port: port, key: key, local: local}, nil
+}
+
+// startCacheInvalidation watches the record changes to invalidate them, and
+// receives the invalidations of the peers. It must be called before the
+// records are synced.
+func (kd *KubeDNS) startCacheInvalidation(stopCh <-chan struct{}) {
+	registerCacheInvalidationMetrics.Do(func() {
+		prometheus.MustRegister(cacheInvalidationMessages, cacheInvalidationErrors)
+	})
+	c := kd.CacheInvalidation
+	if c.resolvePeers == nil {
+		c.resolvePeers = kd.cacheInvalidationPeers
+	}
+	events, err := kd.WatchRecords(stopCh)
+	if err != nil {
+		klog.Errorf("Cache invalidation disabled: %v", err)
+		return
+	}
+	klog.V(0).Infof("Broadcasting the cache invalidations to %v on %v", c.Peers, c.conn.LocalAddr())
+	go c.receive(stopCh)
+	go c.run(kd, events, stopCh)
+}
+
+// run invalidates the names of the changed records, read from events, in
+// batches.
+func (c *CacheInvalidation) run(kd *KubeDNS, events <-chan RecordEvent, stopCh <-chan struct{}) {
+	for {
+		c.forward(events)
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+		// The watch lagged behind: the records served are sent again,
+		// which are not changes, and some changes were lost.
+		klog.Warningf("Cache invalidations lagged behind the record changes, flushing the caches")
+		var err error
+		if events, err = kd.WatchRecords(stopCh); err != nil {
+			klog.Errorf("Cache invalidation disabled: %v", err)
+			return
+		}
+		for n := len(events); n > 0; n-- {
+			<-events
+		}
+		c.broadcast(nil)
+	}
+}
+
+// forward invalidates the names of the records changed in events until the
+// channel is closed.
+func (c *CacheInvalidation) forward(events <-chan RecordEvent) {
+	for {
+		event, ok := <-events
+		if !ok {
+			return
+		}
+		names := map[string]bool{event.Name: true}
+		timeout := time.After(cacheInvalidationBatchPeriod)
+	batch:
+		for {
+			select {
+			case event, ok = <-events:
+				if !ok {
+					break batch
+				}
+				names[event.Name] = true
+			case <-timeout:
+				break batch
+			}
+		}
+		sorted := make([]string, 0, len(names))
+		for name := range names {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		c.broadcast(sorted)
+		if !ok {
+			return
+		}
+	}
+}
+
+// broadcast invalidates names locally and sends them to the peers. It
+// flushes the caches if names is empty or too long.
+func (c *CacheInvalidation) broadcast(names []string) {
+	if len(names) > cacheInvalidationMaxNames {
+		names = nil
+	}
+	c.invalidate(names)
+	data, err := json.Marshal(cacheInvalidationMessage{Names: names, Time: time.Now().Unix()})
+	if err != nil {
+		klog.Errorf("Failed to encode the cache invalidation: %v", err)
+		return
+	}
+	data = append(c.mac(data), data...)
+	kind := invalidationKind(names)
+	for _, peer := range c.resolvePeers() {
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err == nil {
+			_, err = c.conn.WriteTo(data, addr)
+		}
+		if err != nil {
+			klog.V(2).Infof("Failed to send the cache invalidation to %v: %v", peer, err)
+			cacheInvalidationErrors.WithLabelValues("sent").Inc()
+			continue
+		}
+		cacheInvalidationMessages.WithLabelValues("sent", kind).Inc()
+	}
+}
+
+// receive invalidates the names received from the peers until stopCh is
+// closed.
+func (c *CacheInvalidation) receive(stopCh <-chan struct{}) {
+	go func() {
+		<-stopCh
+		c.conn.Close()
+	}()
+	buf := make([]byte, cacheInvalidationMaxMessage)
+	for {
+		n, from, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			klog.Errorf("Failed to receive cache invalidations: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if !c.isPeer(from) {
+			klog.V(2).Infof("Ignoring the cache invalidation from %v, which is not a peer", from)
+			cacheInvalidationErrors.WithLabelValues("received").Inc()
+			continue
+		}
+		message, err := c.open(buf[:n], time.Now())
+		if err != nil {
+			klog.V(2).Infof("Ignoring the invalid cache invalidation from %v: %v", from, err)
+			cacheInvalidationErrors.WithLabelValues("received").Inc()
+			continue
+		}
+		cacheInvalidationMessages.WithLabelValues("received", invalidationKind(message.Names)).Inc()
+		c.invalidate(message.Names)
+	}
+}
+
+// mac returns the HMAC-SHA256 of data with the key of the replicas.
+func (c *CacheInvalidation) mac(data []byte) []byte {
+	h := hmac.New(sha256.New, c.key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// open returns the message received in data, or an error if it is not
+// authenticated with the key of the replicas, or was not sent around now.
+func (c *CacheInvalidation) open(data []byte, now time.Time) (cacheInvalidationMessage, error) {
+	var message cacheInvalidationMessage
+	if len(data) < sha256.Size || !hmac.Equal(data[:sha256.Size], c.mac(data[sha256.Size:])) {
+		return message, fmt.Errorf("invalid HMAC")
+	}
+	if err := json.Unmarshal(data[sha256.Size:], &message); err != nil {
+		return message, err
+	}
+	if age := now.Sub(time.Unix(message.Time, 0)); age > cacheInvalidationMaxAge || age < -cacheInvalidationMaxAge {
+		return message, fmt.Errorf("sent %v ago", age)
+	}
+	return message, nil
+}
+
+func (c *CacheInvalidation) invalidate(names []string) {
+	if c.Invalidate == nil {
+		return
+	}
+	removed := c.Invalidate(names)
+	if len(names) == 0 {
+		klog.V(4).Infof("Flushed the cached replies")
+	} else {
+		klog.V(4).Infof("Invalidated %d cached replies for %v", removed, names)
+	}
+}
+
+// isPeer returns whether the message from addr was sent by a peer.
+func (c *CacheInvalidation) isPeer(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	for _, peer := range c.resolvePeers() {
+		host, _, err := net.SplitHostPort(peer)
+		if err == nil && net.ParseIP(host).Equal(udpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheInvalidationPeers returns the addresses of the peers: the endpoints
+// of the Peers service, other than this replica.
+func (kd *KubeDNS) cacheInvalidationPeers() []string {
+	c := kd.CacheInvalidation
+	records, err := kd.Records(c.Peers, false)
+	if err != nil && !server.WithRecords(err) {
+		return nil
+	}
+	var peers []string
+	for _, record := range records {
+		ip := net.ParseIP(record.Host)
+		if ip == nil || c.local[ip.String()] {
+			continue
+		}
+		peers = append(peers, net.JoinHostPort(ip.String(), strconv.Itoa(c.port)))
+	}
+	return peers
+}
+
+func invalidationKind(names []string) string {
+	if len(names) == 0 {
+		return "flush"
+	}
+	return "names"
+}
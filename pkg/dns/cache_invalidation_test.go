@@ -0,0 +1,116 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"crypto/sha256"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCacheInvalidation returns a CacheInvalidation on the loopback
+// address, sending the names it invalidates to invalidated.
+func newTestCacheInvalidation(t *testing.T, invalidated chan<- []string) *CacheInvalidation {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return &CacheInvalidation{
+		Invalidate: func(names []string) int {
+			invalidated <- names
+			return len(names)
+		},
+		conn: conn,
+		key:  []byte("cache-invalidation-test-key"),
+	}
+}
+
+// receiveInvalidation returns the next names invalidated.
+func receiveInvalidation(t *testing.T, invalidated <-chan []string) []string {
+	select {
+	case names := <-invalidated:
+		return names
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a cache invalidation")
+		return nil
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	localInvalidated, peerInvalidated := make(chan []string, 10), make(chan []string, 10)
+	kd := newKubeDNS()
+	kd.RecordWatch = NewRecordWatch()
+	kd.CacheInvalidation = newTestCacheInvalidation(t, localInvalidated)
+	peer := newKubeDNS()
+	peer.RecordWatch = NewRecordWatch()
+	peer.CacheInvalidation = newTestCacheInvalidation(t, peerInvalidated)
+	kd.CacheInvalidation.resolvePeers = func() []string { return []string{peer.CacheInvalidation.conn.LocalAddr().String()} }
+	peer.CacheInvalidation.resolvePeers = func() []string { return []string{kd.CacheInvalidation.conn.LocalAddr().String()} }
+	kd.startCacheInvalidation(stopCh)
+	peer.startCacheInvalidation(stopCh)
+
+	kd.newService(newService(testNamespace, testService, "1.2.3.4", "http", 80))
+	names := receiveInvalidation(t, localInvalidated)
+	assert.Contains(t, names, "4.3.2.1.in-addr.arpa.")
+	assert.Equal(t, names, receiveInvalidation(t, peerInvalidated), "the peer invalidates the same names")
+
+	// The messages of the other hosts are ignored.
+	conn, err := net.ListenPacket("udp", "127.0.0.2:0")
+	if err == nil {
+		defer conn.Close()
+		_, err = conn.WriteTo([]byte(`{"names": ["a.default.svc.cluster.local."]}`), peer.CacheInvalidation.conn.LocalAddr())
+		require.NoError(t, err)
+	}
+	// So are those of the peers not authenticated with the key.
+	forged := append(make([]byte, sha256.Size), `{"names": ["b.default.svc.cluster.local."]}`...)
+	_, err = kd.CacheInvalidation.conn.WriteTo(forged, peer.CacheInvalidation.conn.LocalAddr())
+	require.NoError(t, err)
+	// Flushes are sent as messages without names.
+	kd.CacheInvalidation.broadcast(nil)
+	assert.Empty(t, receiveInvalidation(t, localInvalidated))
+	assert.Empty(t, receiveInvalidation(t, peerInvalidated))
+}
+
+func TestCacheInvalidationOpen(t *testing.T) {
+	c := &CacheInvalidation{key: []byte("cache-invalidation-test-key")}
+	now := time.Unix(1000, 0)
+	seal := func(c *CacheInvalidation, message string) []byte {
+		return append(c.mac([]byte(message)), message...)
+	}
+
+	message, err := c.open(seal(c, `{"names": ["a.default.svc.cluster.local."], "time": 990}`), now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.default.svc.cluster.local."}, message.Names)
+
+	for desc, data := range map[string][]byte{
+		"other key":   seal(&CacheInvalidation{key: []byte("other")}, `{"time": 1000}`),
+		"tampered":    append(seal(c, `{"time": 1000}`), ' '),
+		"too short":   []byte("{}"),
+		"replayed":    seal(c, `{"time": 900}`),
+		"future":      seal(c, `{"time": 1100}`),
+		"not json":    seal(c, `names`),
+		"without mac": []byte(`{"time": 1000}`),
+	} {
+		_, err := c.open(data, now)
+		assert.Error(t, err, desc)
+	}
+}
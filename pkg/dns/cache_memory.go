@@ -0,0 +1,122 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/dns/pkg/dns/treecache"
+	"k8s.io/klog/v2"
+)
+
+var (
+	cacheMemoryBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kubedns",
+		Subsystem: "cache",
+		Name:      "memory_bytes",
+		Help:      "Estimated bytes of memory held by the records, by cache: records, reverse or headless.",
+	}, []string{"cache"})
+	cacheMemoryLimitBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "kubedns",
+		Subsystem: "cache",
+		Name:      "memory_limit_bytes",
+		Help:      "Bytes of memory the records are expected to stay under, 0 for no limit.",
+	})
+	registerCacheMemoryMetrics sync.Once
+)
+
+// headlessRecordSize estimates the bytes held by the map entry of a
+// published record of a headless service, besides its FQDN and path. Its
+// value is held by the cache as well.
+var headlessRecordSize = int64(unsafe.Sizeof("")+unsafe.Sizeof(headlessRecord{})) + 16
+
+// CacheMemory is the estimated memory held by the records of KubeDNS.
+type CacheMemory struct {
+	// Records is held by the cache of the records.
+	Records int64
+	// Reverse is held by the reverse records of the IPs.
+	Reverse int64
+	// Headless is held by the records of the headless services last
+	// published, to diff their updates against.
+	Headless int64
+}
+
+// Total returns the memory held by all the records.
+func (m CacheMemory) Total() int64 {
+	return m.Records + m.Reverse + m.Headless
+}
+
+// EstimateCacheMemory returns an estimate of the memory held by the
+// records. It walks every record, but does not block the queries.
+func (kd *KubeDNS) EstimateCacheMemory() CacheMemory {
+	m := CacheMemory{
+		Records: treecache.EstimateSize(kd.cacheView()),
+		Reverse: kd.ipShards.estimateSize(),
+	}
+	kd.headlessRecordsLock.Lock()
+	services := make([]*headlessRecords, 0, len(kd.headlessRecords))
+	for _, records := range kd.headlessRecords {
+		services = append(services, records)
+	}
+	kd.headlessRecordsLock.Unlock()
+	for _, records := range services {
+		records.lock.Lock()
+		for fqdn, record := range records.records {
+			m.Headless += int64(len(fqdn)) + headlessRecordSize + int64(cap(record.path))*int64(unsafe.Sizeof(""))
+		}
+		records.lock.Unlock()
+	}
+	return m
+}
+
+// runCacheMemoryAccounting periodically estimates the memory held by the
+// records until stopCh is closed.
+func (kd *KubeDNS) runCacheMemoryAccounting(stopCh <-chan struct{}) {
+	registerCacheMemoryMetrics.Do(func() { prometheus.MustRegister(cacheMemoryBytes, cacheMemoryLimitBytes) })
+	cacheMemoryLimitBytes.Set(float64(kd.CacheMemoryLimit))
+	klog.V(0).Infof("Estimating the memory held by the records every %v", kd.CacheMemoryInterval)
+	wait.Until(func() { kd.accountCacheMemory() }, kd.CacheMemoryInterval, stopCh)
+}
+
+// accountCacheMemory exports the estimated memory held by the records, and
+// warns if it exceeds CacheMemoryLimit. Nothing is evicted: every record is
+// authoritative, and evicting one would answer NXDOMAIN for a name that
+// exists.
+func (kd *KubeDNS) accountCacheMemory() CacheMemory {
+	start := time.Now()
+	m := kd.EstimateCacheMemory()
+	cacheMemoryBytes.WithLabelValues("records").Set(float64(m.Records))
+	cacheMemoryBytes.WithLabelValues("reverse").Set(float64(m.Reverse))
+	cacheMemoryBytes.WithLabelValues("headless").Set(float64(m.Headless))
+	klog.V(4).Infof("Estimated the memory held by the records in %v: %+v", time.Since(start), m)
+	if kd.CacheMemoryLimit > 0 && m.Total() > kd.CacheMemoryLimit {
+		klog.Warningf("The records hold an estimated %s of memory, over the limit of %s (records: %s,"+
+			" reverse: %s, headless: %s)", quantity(m.Total()), quantity(kd.CacheMemoryLimit),
+			quantity(m.Records), quantity(m.Reverse), quantity(m.Headless))
+	}
+	return m
+}
+
+// quantity formats bytes for humans, e.g. 512Mi.
+func quantity(bytes int64) string {
+	return resource.NewQuantity(bytes, resource.BinarySI).String()
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateCacheMemory(t *testing.T) {
+	kd := newKubeDNS()
+	empty := kd.EstimateCacheMemory()
+
+	s := newHeadlessService()
+	e := newEndpoints(s, newSubsetWithOnePortWithHostname("", 80, true, "10.0.0.1", "10.0.0.2", "10.0.0.3"))
+	assert.NoError(t, kd.endpointsStore.Add(e))
+	kd.newService(s)
+	withService := kd.EstimateCacheMemory()
+	assert.Greater(t, withService.Records, empty.Records)
+	assert.Greater(t, withService.Reverse, empty.Reverse)
+	assert.Greater(t, withService.Headless, empty.Headless)
+	assert.Equal(t, withService.Records+withService.Reverse+withService.Headless, withService.Total())
+
+	kd.CacheMemoryLimit = 1
+	assert.Equal(t, withService, kd.accountCacheMemory())
+
+	kd.removeService(s)
+	removed := kd.EstimateCacheMemory()
+	assert.Less(t, removed.Records, withService.Records)
+	assert.Equal(t, int64(0), removed.Headless)
+}
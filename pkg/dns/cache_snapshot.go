@@ -0,0 +1,136 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"github.com/miekg/dns"
+
+	"k8s.io/dns/pkg/dns/features"
+	"k8s.io/dns/pkg/dns/treecache"
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+// unlockCache publishes the snapshot of the cache that the queries read and
+// releases cacheLock, held for writing. Taking a snapshot is cheap, the
+// writes that follow copy the parts of the cache they change. The names
+// remembered to have no record are forgotten once the snapshot is
+// published, and the generation incremented. Nothing is published while a
+// batch is running, see batchCache.
+func (kd *KubeDNS) unlockCache() {
+	if kd.cacheBatches == 0 {
+		kd.cacheSnapshot.Store(kd.cache.Snapshot())
+		kd.negativeCache().reset()
+		kd.nextGeneration()
+	}
+	kd.cacheLock.Unlock()
+}
+
+// batchCache runs fn with the writes to the cache going to a transaction,
+// committed and published once fn, and the batches running meanwhile, are
+// done: the queries see the cache as it was before, then as it is after, e.g.
+// never a service deleted to be recreated. The writes of the other informers
+// meanwhile are published along with the batch. The transaction is committed
+// even if fn panics, the queue recovering the panics of its handlers: the
+// cache is published again from then on.
+//
+// The reverse records and the cluster IP services, kept in ipShards under
+// their own locks, are written through, not as part of the transaction. They
+// are keyed by IP rather than by name: a batch replacing the records of a
+// service, e.g. changing its type to or from ExternalName, only ever adds or
+// removes those of its IPs, the PTR queries never seeing an IP without
+// record in between.
+func (kd *KubeDNS) batchCache(fn func()) {
+	kd.cacheLock.Lock()
+	if kd.cacheBatches == 0 {
+		kd.cacheBase = kd.cache
+		kd.cacheTx = kd.cache.Begin()
+		kd.cache = kd.cacheTx
+	}
+	kd.cacheBatches++
+	kd.cacheLock.Unlock()
+
+	defer func() {
+		kd.cacheLock.Lock()
+		kd.cacheBatches--
+		if kd.cacheBatches == 0 {
+			kd.cache = kd.cacheTx.Commit()
+			kd.cacheTx, kd.cacheBase = nil, nil
+		}
+		kd.unlockCache()
+	}()
+	fn()
+}
+
+// cacheView returns the last snapshot of the cache published, to be read
+// without cacheLock: the queries never wait for the informers to update the
+// cache.
+func (kd *KubeDNS) cacheView() treecache.TreeCache {
+	if snapshot, ok := kd.cacheSnapshot.Load().(treecache.TreeCache); ok {
+		return snapshot
+	}
+	// Nothing was written to the cache yet.
+	return treecache.NewTreeCache()
+}
+
+// queryCache returns the cache the queries read: the last snapshot of the
+// cache published, see cacheView, or with the COWTreeCache feature gate
+// disabled, the cache itself, as it was before the batches running if any,
+// with cacheLock held for reading until the caller releases it if locked is
+// true. Either way, the queries never see part of a batch.
+func (kd *KubeDNS) queryCache() (cache treecache.TreeCache, locked bool) {
+	if features.Enabled(features.COWTreeCache) {
+		return kd.cacheView(), false
+	}
+	kd.cacheLock.RLock()
+	if kd.cacheBatches > 0 {
+		return kd.cacheBase, true
+	}
+	return kd.cache, true
+}
+
+// RangeRecords calls fn with the name of each node of the cache holding
+// records, and its records, until fn returns false, see
+// treecache.TreeCache.Range. The records are those of the last snapshot of
+// the cache published: fn sees a consistent cache, without holding
+// cacheLock. The records must not be modified.
+func (kd *KubeDNS) RangeRecords(fn func(fqdn string, records []*skymsg.Service) bool) {
+	kd.cacheView().Range(fn)
+}
+
+// RangeZone calls fn with the names of the cluster domain holding records,
+// and their records, until fn returns false, for the zone transfers. The
+// records are those of the last snapshot of the cache published, see
+// RangeRecords. The pod records, generated when queried, are not ranged
+// over. It returns server.ErrNotFound for the other zones.
+func (kd *KubeDNS) RangeZone(zone string, fn func(name string, records []skymsg.Service) bool) error {
+	zone = dns.CanonicalName(zone)
+	if zone != dns.CanonicalName(kd.domain) {
+		return server.ErrNotFound
+	}
+	kd.RangeRecords(func(fqdn string, services []*skymsg.Service) bool {
+		if !dns.IsSubDomain(zone, fqdn) {
+			return true
+		}
+		records := make([]skymsg.Service, len(services))
+		for i, service := range services {
+			records[i] = *service
+		}
+		return fn(fqdn, records)
+	})
+	return nil
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"k8s.io/dns/pkg/dns/features"
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+	skyserver "k8s.io/dns/third_party/forked/skydns/server"
+)
+
+func TestRecordsDoNotWaitForWriters(t *testing.T) {
+	kd := newKubeDNS()
+	s := newExternalNameService()
+	require.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	name := testService + "." + testNamespace + ".svc.cluster.local."
+
+	kd.cacheLock.Lock()
+	done := make(chan error)
+	go func() {
+		_, err := kd.Records(name, false)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Error("Records waited for cacheLock")
+	}
+
+	// The writes are seen once cacheLock is released.
+	kd.cache.DeletePath("local", "cluster", serviceSubdomain, testNamespace, testService)
+	records, err := kd.Records(name, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{testExternalName}, hosts(records))
+	kd.unlockCache()
+	_, err = kd.Records(name, false)
+	assert.Error(t, err)
+}
+
+func TestRecordsWithoutCOWTreeCache(t *testing.T) {
+	require.NoError(t, features.DefaultMutableFeatureGate.Set("COWTreeCache=false"))
+	defer func() {
+		require.NoError(t, features.DefaultMutableFeatureGate.Set("COWTreeCache=true"))
+	}()
+	kd := newKubeDNS()
+	s := newExternalNameService()
+	require.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	name := testService + "." + testNamespace + ".svc.cluster.local."
+
+	// The queries read the cache itself, waiting for the writers.
+	kd.cacheLock.Lock()
+	done := make(chan error)
+	go func() {
+		_, err := kd.Records(name, false)
+		done <- err
+	}()
+	kd.cache.DeletePath("local", "cluster", serviceSubdomain, testNamespace, testService)
+	select {
+	case <-done:
+		t.Error("Records did not wait for cacheLock")
+	case <-time.After(100 * time.Millisecond):
+	}
+	kd.unlockCache()
+	assert.Error(t, <-done)
+}
+
+func TestRangeRecords(t *testing.T) {
+	kd := newKubeDNS()
+	kd.newService(newService(testNamespace, "web", "10.0.0.1", "http", 80))
+	kd.newService(newService(testNamespace, "db", "10.0.0.2", "", 5432))
+
+	records := map[string][]string{}
+	kd.RangeRecords(func(fqdn string, services []*skymsg.Service) bool {
+		for _, svc := range services {
+			records[fqdn] = append(records[fqdn], svc.Host)
+		}
+		return true
+	})
+	assert.Equal(t, map[string][]string{
+		"db.default.svc.cluster.local.":             {"10.0.0.2"},
+		"web.default.svc.cluster.local.":            {"10.0.0.1"},
+		"_http._tcp.web.default.svc.cluster.local.": {"web.default.svc.cluster.local."},
+	}, records)
+}
+
+func TestRangeZone(t *testing.T) {
+	kd := newKubeDNS()
+	kd.newService(newService(testNamespace, "web", "10.0.0.1", "http", 80))
+
+	names := []string{}
+	require.NoError(t, kd.RangeZone("Cluster.Local", func(name string, records []skymsg.Service) bool {
+		names = append(names, name)
+		return true
+	}))
+	assert.ElementsMatch(t, []string{"web.default.svc.cluster.local.", "_http._tcp.web.default.svc.cluster.local."}, names)
+
+	err := kd.RangeZone("svc.cluster.local.", func(string, []skymsg.Service) bool { return true })
+	assert.True(t, errors.Is(err, skyserver.ErrNotFound), "got %v", err)
+}
+
+func TestBatchCache(t *testing.T) {
+	kd := newKubeDNS()
+	old := newService(testNamespace, testService, "10.0.0.1", "http", 80)
+	require.NoError(t, kd.servicesStore.Add(old))
+	kd.newService(old)
+	name := testService + "." + testNamespace + ".svc.cluster.local."
+
+	// The service becomes an ExternalName one: the queries keep getting its
+	// ClusterIP until its CNAME is published.
+	s := newExternalNameService()
+	kd.batchCache(func() {
+		kd.deleteService(old)
+		records, err := kd.Records(name, false)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.0.0.1"}, hosts(records))
+
+		kd.newService(s)
+		records, err = kd.Records(name, false)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.0.0.1"}, hosts(records))
+	})
+	records, err := kd.Records(name, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{testExternalName}, hosts(records))
+
+	// updateService replaces the records in a batch.
+	kd.updateService(s, old)
+	records, err = kd.Records(name, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1"}, hosts(records))
+	assert.Nil(t, kd.cacheTx)
+}
+
+func TestBatchCacheWithoutCOWTreeCache(t *testing.T) {
+	require.NoError(t, features.DefaultMutableFeatureGate.Set("COWTreeCache=false"))
+	defer func() {
+		require.NoError(t, features.DefaultMutableFeatureGate.Set("COWTreeCache=true"))
+	}()
+	kd := newKubeDNS()
+	old := newService(testNamespace, testService, "10.0.0.1", "http", 80)
+	require.NoError(t, kd.servicesStore.Add(old))
+	kd.newService(old)
+	name := testService + "." + testNamespace + ".svc.cluster.local."
+
+	// The queries read the cache as it was before the batch, never the
+	// service deleted to be recreated.
+	kd.batchCache(func() {
+		kd.deleteService(old)
+		records, err := kd.Records(name, false)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.0.0.1"}, hosts(records))
+		kd.newService(newExternalNameService())
+	})
+	records, err := kd.Records(name, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{testExternalName}, hosts(records))
+	assert.Nil(t, kd.cacheBase)
+}
+
+func TestBatchCachePanic(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "10.0.0.1", "http", 80)
+	require.NoError(t, kd.servicesStore.Add(s))
+	name := testService + "." + testNamespace + ".svc.cluster.local."
+
+	// The queue recovers the panics of its handlers: the batch is
+	// committed, and the cache published again afterwards.
+	assert.Panics(t, func() {
+		kd.batchCache(func() {
+			kd.newService(s)
+			panic("handler")
+		})
+	})
+	assert.Zero(t, kd.cacheBatches)
+	assert.Nil(t, kd.cacheTx)
+	records, err := kd.Records(name, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1"}, hosts(records))
+
+	kd.removeService(s)
+	_, err = kd.Records(name, false)
+	assert.Error(t, err)
+}
+
+func TestGeneration(t *testing.T) {
+	kd := newKubeDNS()
+	generation := kd.Generation()
+
+	s := newService(testNamespace, testService, "10.0.0.1", "http", 80)
+	require.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	assert.Greater(t, kd.Generation(), generation)
+
+	// A batch publishes a single generation.
+	generation = kd.Generation()
+	kd.batchCache(func() {
+		kd.deleteService(s)
+		kd.newService(newExternalNameService())
+		assert.Equal(t, generation, kd.Generation())
+	})
+	assert.Equal(t, generation+1, kd.Generation())
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/dns/pkg/dns/util"
+	"k8s.io/dns/pkg/version"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// CanaryName is the name of the synthetic service record written by
+	// the canary, under the kube-system namespace.
+	CanaryName      = "dns-canary"
+	canaryNamespace = metav1.NamespaceSystem
+)
+
+// runCanary periodically rewrites the canary record until stopCh is
+// closed.
+func (kd *KubeDNS) runCanary(stopCh <-chan struct{}) {
+	klog.V(0).Infof("Writing canary record %s every %v", kd.canaryFQDN(), kd.CanaryInterval)
+	wait.Until(func() { kd.updateCanary(time.Now()) }, kd.CanaryInterval, stopCh)
+}
+
+// updateCanary writes the canary TXT record through the record cache, as
+// records of services are. Its timestamp tells probers when the cache was
+// last written to, and not only whether the server answers.
+func (kd *KubeDNS) updateCanary(now time.Time) {
+	cachePath := append(kd.domainPath, serviceSubdomain, canaryNamespace)
+	fqdn := kd.canaryFQDN()
+
+	kd.cacheLock.Lock()
+	defer kd.unlockCache()
+	record := util.NewServiceRecord(fqdn, 0)
+	// Pointing the record at itself leaves A and AAAA queries without
+	// answers, the TXT record is all there is to the canary.
+	record.Ttl = 0
+	record.Text = fmt.Sprintf("timestamp=%s version=%s records=%d",
+		now.UTC().Format(time.RFC3339), version.VERSION, kd.recordCount)
+	kd.cache.SetEntry(CanaryName, record, fqdn, cachePath...)
+}
+
+func (kd *KubeDNS) canaryFQDN() string {
+	return fmt.Sprintf("%s.%s.%s.%s", CanaryName, canaryNamespace, serviceSubdomain, kd.domain)
+}
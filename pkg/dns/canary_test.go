@@ -0,0 +1,45 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/dns/pkg/version"
+)
+
+func TestCanary(t *testing.T) {
+	kd := newKubeDNS()
+	kd.newService(newService(testNamespace, testService, "1.2.3.4", "", 80))
+
+	kd.updateCanary(time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC))
+	records, err := kd.Records("dns-canary.kube-system.svc."+testDomain, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, "timestamp=2022-03-04T05:06:07Z version="+version.VERSION+" records=1", records[0].Text)
+	assert.Equal(t, uint32(0), records[0].Ttl)
+
+	// The record is rewritten in place.
+	kd.updateCanary(time.Date(2022, 3, 4, 5, 7, 7, 0, time.UTC))
+	records, err = kd.Records("dns-canary.kube-system.svc."+testDomain, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Contains(t, records[0].Text, "timestamp=2022-03-04T05:07:07Z")
+}
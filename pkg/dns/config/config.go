@@ -19,11 +19,15 @@ package config
 import (
 	"fmt"
 	"net"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/coredns/coredns/plugin/pkg/parse"
 	types "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/dns/pkg/dns/features"
 	fed "k8s.io/dns/pkg/dns/federation"
 	"k8s.io/dns/pkg/dns/util"
 )
@@ -48,9 +52,79 @@ type Config struct {
 	// the IP of the nameserver to send DNS request for the given subdomain.
 	StubDomains map[string][]string `json:"stubDomains"`
 
+	// Map of fallthrough zone to nameservers. kube-dns answers the names of
+	// a fallthrough zone it knows, e.g. from custom records, and forwards
+	// the others to the nameservers of the zone, the upstream nameservers
+	// if there are none. The zones cannot be in the cluster domain.
+	FallthroughZones map[string][]string `json:"fallthroughZones"`
+
+	// Map of namespace names to an additional domain their services are
+	// served in, e.g. "team-a": "team-a.corp.example" serves
+	// my-svc.team-a.svc.<cluster domain> as my-svc.team-a.corp.example as
+	// well. The domains cannot be in the cluster domain.
+	NamespaceDomains map[string]string `json:"namespaceDomains"`
+
+	// Map of peer cluster names to their DNS endpoints. The services of a
+	// peer cluster, <service>.<namespace>.<peer>.remote.<cluster domain>,
+	// are resolved by forwarding the query to its kube-dns.
+	PeerClusters map[string]PeerCluster `json:"peerClusters"`
+
 	// List of upstream nameservers to use. Overrides nameservers inherited
 	// from the node.
 	UpstreamNameservers []string `json:"upstreamNameservers"`
+
+	// Map of feature gate names to their state, overriding the
+	// --feature-gates flag.
+	FeatureGates map[string]bool `json:"featureGates"`
+
+	// Static records served in the cluster domain, in zone file or hosts
+	// file format, see ParseCustomRecords. Relative names are relative to
+	// the cluster domain. Names in the svc and pod subdomains are not
+	// allowed.
+	CustomRecords string `json:"customRecords"`
+
+	// Map of tenant names to the other tenants whose clients may resolve
+	// the services of its namespaces, "*" for every tenant. The services
+	// of the tenants missing from the map can be resolved by every client.
+	// Only enforced with --tenant-zones.
+	TenantAccess map[string][]string `json:"tenantAccess"`
+
+	// Node pools whose node-local caches use different stub domains,
+	// upstream nameservers or cache TTL, see NodePool. A node-local cache
+	// uses the first pool selecting its node.
+	NodePools []NodePool `json:"nodePools"`
+
+	// Rules rewriting the names queried, e.g. to serve db.legacy.local as
+	// a service of the cluster. The first rule matching a name applies.
+	RewriteRules []RewriteRule `json:"rewriteRules"`
+}
+
+// PeerCluster is a cluster whose services are resolved through its
+// kube-dns.
+type PeerCluster struct {
+	// Domain of the peer cluster. Defaults to the cluster domain.
+	Domain string `json:"domain,omitempty"`
+	// Nameservers of the peer cluster, as ip or ip:port.
+	Nameservers []string `json:"nameservers"`
+}
+
+// RewriteRule answers the queries for the names matching Name as queries for
+// Replacement, with the names of the answers rewritten back to the name
+// queried.
+type RewriteRule struct {
+	// Name is a regular expression matched against the whole name queried,
+	// without the trailing dot, ignoring case, e.g. "(.*)\\.legacy\\.local".
+	Name string `json:"name"`
+	// Replacement is the name queried instead, where $1 or ${1} is the
+	// text matched by the first group of Name, e.g.
+	// "${1}.default.svc.cluster.local".
+	Replacement string `json:"replacement"`
+}
+
+// Compile returns the regular expression matching the fully qualified names
+// rewritten by the rule.
+func (rule *RewriteRule) Compile() (*regexp.Regexp, error) {
+	return regexp.Compile(`(?i)^(?:` + rule.Name + `)\.$`)
 }
 
 func NewDefaultConfig() *Config {
@@ -70,10 +144,42 @@ func (config *Config) Validate() error {
 		return err
 	}
 
+	if err := config.validateFallthroughZones(); err != nil {
+		return err
+	}
+
+	if err := config.validateNamespaceDomains(); err != nil {
+		return err
+	}
+
+	if err := config.validatePeerClusters(); err != nil {
+		return err
+	}
+
 	if err := config.validateUpstreamNameserver(); err != nil {
 		return err
 	}
 
+	if err := features.Validate(config.FeatureGates); err != nil {
+		return err
+	}
+
+	if _, err := ParseCustomRecords(config.CustomRecords, "."); err != nil {
+		return err
+	}
+
+	if err := config.validateTenantAccess(); err != nil {
+		return err
+	}
+
+	if err := config.validateNodePools(); err != nil {
+		return err
+	}
+
+	if err := config.validateRewriteRules(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -119,6 +225,108 @@ func (config *Config) validateStubDomains() error {
 	return nil
 }
 
+func (config *Config) validateFallthroughZones() error {
+	for zone, nameservers := range config.FallthroughZones {
+		if len(validation.IsDNS1123Subdomain(zone)) != 0 {
+			return fmt.Errorf("invalid fallthrough zone: %q", zone)
+		}
+		if _, ok := config.StubDomains[zone]; ok {
+			return fmt.Errorf("fallthrough zone %q is also a stub domain", zone)
+		}
+		for _, nameserver := range nameservers {
+			if _, _, err := util.ValidateNameserverIpAndPort(nameserver); err != nil {
+				return fmt.Errorf("invalid nameserver %q for the fallthrough zone %q: %w", nameserver, zone, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (config *Config) validateNamespaceDomains() error {
+	namespaces := make(map[string]string, len(config.NamespaceDomains))
+	for namespace, domain := range config.NamespaceDomains {
+		if len(validation.IsDNS1123Label(namespace)) != 0 {
+			return fmt.Errorf("invalid namespace: %q", namespace)
+		}
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if len(validation.IsDNS1123Subdomain(domain)) != 0 {
+			return fmt.Errorf("invalid domain %q for the namespace %q", domain, namespace)
+		}
+		if other, ok := namespaces[domain]; ok {
+			return fmt.Errorf("namespaces %q and %q have the same domain %q", other, namespace, domain)
+		}
+		if _, ok := config.StubDomains[domain]; ok {
+			return fmt.Errorf("domain %q of the namespace %q is also a stub domain", domain, namespace)
+		}
+		if _, ok := config.FallthroughZones[domain]; ok {
+			return fmt.Errorf("domain %q of the namespace %q is also a fallthrough zone", domain, namespace)
+		}
+		namespaces[domain] = namespace
+	}
+	return nil
+}
+
+// KubeDNSZones returns the sorted zones outside of the cluster domain that
+// kube-dns answers: the fallthrough zones and the namespace domains. The
+// caches in front of kube-dns forward them to it.
+func (config *Config) KubeDNSZones() []string {
+	zones := make([]string, 0, len(config.FallthroughZones)+len(config.NamespaceDomains))
+	for zone := range config.FallthroughZones {
+		zones = append(zones, zone)
+	}
+	for _, domain := range config.NamespaceDomains {
+		zones = append(zones, domain)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+func (config *Config) validatePeerClusters() error {
+	for name, peer := range config.PeerClusters {
+		if len(validation.IsDNS1123Label(name)) != 0 {
+			return fmt.Errorf("invalid peer cluster name: %q", name)
+		}
+		if peer.Domain != "" && len(validation.IsDNS1123Subdomain(strings.TrimSuffix(peer.Domain, "."))) != 0 {
+			return fmt.Errorf("invalid domain %q for the peer cluster %q", peer.Domain, name)
+		}
+		if len(peer.Nameservers) == 0 {
+			return fmt.Errorf("peer cluster %q has no nameservers", name)
+		}
+		for _, nameserver := range peer.Nameservers {
+			if _, _, err := util.ValidateNameserverIpAndPort(nameserver); err != nil {
+				return fmt.Errorf("invalid nameserver %q for the peer cluster %q: %w", nameserver, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (config *Config) validateTenantAccess() error {
+	for tenant, allowed := range config.TenantAccess {
+		if len(validation.IsDNS1123Label(tenant)) != 0 {
+			return fmt.Errorf("invalid tenant name: %q", tenant)
+		}
+		for _, other := range allowed {
+			if other != "*" && len(validation.IsDNS1123Label(other)) != 0 {
+				return fmt.Errorf("invalid tenant name %q allowed to resolve tenant %q", other, tenant)
+			}
+		}
+	}
+	return nil
+}
+
+func (config *Config) validateRewriteRules() error {
+	for _, rule := range config.RewriteRules {
+		if _, err := rule.Compile(); err != nil {
+			return fmt.Errorf("invalid rewrite rule name %q: %w", rule.Name, err)
+		}
+		if rule.Replacement == "" {
+			return fmt.Errorf("rewrite rule %q has no replacement", rule.Name)
+		}
+	}
+	return nil
+}
+
 func (config *Config) validateUpstreamNameserver() error {
 	if len(config.UpstreamNameservers) > 3 {
 		return fmt.Errorf("upstreamNameserver cannot have more than three entries")
@@ -143,6 +351,17 @@ func (config *Config) ValidateNodeLocalCacheConfig() error {
 	if err := validateForwardProxy(config.UpstreamNameservers...); err != nil {
 		return fmt.Errorf("invalid upstream nameservers %s: %v", config.UpstreamNameservers, err)
 	}
+	for i := range config.NodePools {
+		pool := &config.NodePools[i]
+		for domain, nameservers := range pool.StubDomains {
+			if err := validateForwardProxy(nameservers...); err != nil {
+				return fmt.Errorf("invalid nameservers %s for the stub domain %s of the node pool %s: %v", nameservers, domain, pool.Name, err)
+			}
+		}
+		if err := validateForwardProxy(pool.UpstreamNameservers...); err != nil {
+			return fmt.Errorf("invalid upstream nameservers %s of the node pool %s: %v", pool.UpstreamNameservers, pool.Name, err)
+		}
+	}
 	return nil
 }
 
@@ -40,11 +40,30 @@ func TestValidate(t *testing.T) {
 			"google.local": {"google-public-dns-a.google.com"},
 			"widget.local": {"[2001:db8:2:2:2::2]:10053", "2001:db8:3:3:3::3"},
 		}},
+		{FallthroughZones: map[string][]string{"corp.example.com": {}}},
+		{FallthroughZones: map[string][]string{"corp.example.com": {"10.0.0.1", "10.0.0.2:5353"}}},
+		{NamespaceDomains: map[string]string{"team-a": "team-a.corp.example", "team-b": "team-b.corp.example."}},
+		{PeerClusters: map[string]PeerCluster{"cluster-b": {Nameservers: []string{"10.1.0.10"}}}},
+		{PeerClusters: map[string]PeerCluster{"cluster-b": {Domain: "b.local", Nameservers: []string{"10.1.0.10:53"}}}},
 		{UpstreamNameservers: []string{}},
 		{UpstreamNameservers: []string{"1.2.3.4"}},
 		{UpstreamNameservers: []string{"1.2.3.4", "8.8.4.4", "8.8.8.8"}},
 		{UpstreamNameservers: []string{"1.2.3.4:53"}},
 		{UpstreamNameservers: []string{"[2001:db8:2:2:2::2]:10053", "2001:db8:3:3:3::3"}},
+		{FeatureGates: map[string]bool{"EndpointSlices": true}},
+		{CustomRecords: "10.0.0.10 registry\nntp A 10.0.0.11"},
+		{TenantAccess: map[string][]string{"team-a": {"team-b"}, "team-b": {"*"}, "team-c": {}}},
+		{NodePools: []NodePool{
+			{Name: "gpu", NodeSelector: map[string]string{"cloud.google.com/gke-accelerator": "nvidia-tesla-t4"},
+				UpstreamNameservers: []string{"10.2.0.53"}, CacheTTL: 300},
+			{Name: "edge", NodeSelector: map[string]string{"pool": "edge"},
+				StubDomains: map[string][]string{"factory.local": {"192.168.0.53"}}},
+			{Name: "default"},
+		}},
+		{RewriteRules: []RewriteRule{
+			{Name: `db\.legacy\.local`, Replacement: "postgres.default.svc.cluster.local"},
+			{Name: `(.*)\.legacy\.local`, Replacement: "${1}.default.svc.cluster.local."},
+		}},
 	} {
 		err := testCase.Validate()
 		assert.Nil(t, err, "should be valid: %+v", testCase)
@@ -57,8 +76,43 @@ func TestValidate(t *testing.T) {
 		{StubDomains: map[string][]string{"$$$$": []string{"1.2.3.4"}}},
 		{StubDomains: map[string][]string{"foo": []string{"$$$$"}}},
 		{StubDomains: map[string][]string{"foo.com": []string{"1.2.3.4:65564"}}},
+		{FallthroughZones: map[string][]string{"$$$$": {}}},
+		{FallthroughZones: map[string][]string{"corp.example.com": {"ns.example.com"}}},
+		{
+			StubDomains:      map[string][]string{"corp.example.com": {"10.0.0.1"}},
+			FallthroughZones: map[string][]string{"corp.example.com": {}},
+		},
+		{NamespaceDomains: map[string]string{"team.a": "team-a.corp.example"}},
+		{NamespaceDomains: map[string]string{"team-a": "$$$$"}},
+		{NamespaceDomains: map[string]string{"team-a": "corp.example", "team-b": "corp.example."}},
+		{
+			StubDomains:      map[string][]string{"corp.example": {"10.0.0.1"}},
+			NamespaceDomains: map[string]string{"team-a": "corp.example"},
+		},
+		{PeerClusters: map[string]PeerCluster{"cluster.b": {Nameservers: []string{"10.1.0.10"}}}},
+		{PeerClusters: map[string]PeerCluster{"cluster-b": {Domain: "$$$$", Nameservers: []string{"10.1.0.10"}}}},
+		{PeerClusters: map[string]PeerCluster{"cluster-b": {}}},
+		{PeerClusters: map[string]PeerCluster{"cluster-b": {Nameservers: []string{"ns.example.com"}}}},
 		{UpstreamNameservers: []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4"}},
 		{UpstreamNameservers: []string{"1.1.1.1:abc", "1.1.1.1:", "1.1.1.1:123456789"}},
+		{FeatureGates: map[string]bool{"NoSuchFeature": true}},
+		{FeatureGates: map[string]bool{"AllAlpha": true}},
+		{CustomRecords: "mx MX 10 mail.example.com."},
+		{TenantAccess: map[string][]string{"team.a": {"team-b"}}},
+		{TenantAccess: map[string][]string{"team-a": {"Team_B"}}},
+		{NodePools: []NodePool{{Name: "GPU"}}},
+		{NodePools: []NodePool{{Name: "gpu"}, {Name: "gpu"}}},
+		{NodePools: []NodePool{{Name: "gpu", NodeSelector: map[string]string{"pool/gpu/a": "x"}}}},
+		{NodePools: []NodePool{{Name: "gpu", NodeSelector: map[string]string{"pool": "a b"}}}},
+		{NodePools: []NodePool{{Name: "gpu", StubDomains: map[string][]string{"foo.com": {"1.1.1.1:abc"}}}}},
+		{NodePools: []NodePool{{Name: "gpu", UpstreamNameservers: []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4"}}}},
+		{NodePools: []NodePool{{Name: "gpu", CacheTTL: -1}}},
+		{
+			FallthroughZones: map[string][]string{"corp.example.com": {}},
+			NodePools:        []NodePool{{Name: "gpu", StubDomains: map[string][]string{"corp.example.com": {"1.1.1.1"}}}},
+		},
+		{RewriteRules: []RewriteRule{{Name: `(.*\.legacy\.local`, Replacement: "${1}.default.svc.cluster.local"}}},
+		{RewriteRules: []RewriteRule{{Name: `db\.legacy\.local`}}},
 	} {
 		err := testCase.Validate()
 		assert.NotNil(t, err, "should not be valid: %+v", testCase)
@@ -98,6 +152,13 @@ func TestValidateNodeLocalCacheConfig(t *testing.T) {
 			},
 			wantError: true,
 		},
+		{
+			name: "invalid config: FQDN upstream name server of a node pool",
+			config: Config{
+				NodePools: []NodePool{{Name: "gpu", UpstreamNameservers: []string{"cluster.local"}}},
+			},
+			wantError: true,
+		},
 	} {
 		err := tc.config.ValidateNodeLocalCacheConfig()
 		gotError := err != nil
@@ -106,3 +167,61 @@ func TestValidateNodeLocalCacheConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestKubeDNSZones(t *testing.T) {
+	config := Config{
+		FallthroughZones: map[string][]string{"corp.example.com": nil},
+		NamespaceDomains: map[string]string{"team-b": "team-b.legacy.example", "team-a": "team-a.legacy.example"},
+	}
+	assert.Equal(t, []string{"corp.example.com", "team-a.legacy.example", "team-b.legacy.example"}, config.KubeDNSZones())
+	assert.Empty(t, NewDefaultConfig().KubeDNSZones())
+}
+
+func TestNodePools(t *testing.T) {
+	config := Config{
+		StubDomains:         map[string][]string{"acme.local": {"1.1.1.1"}, "widget.local": {"2.2.2.2"}},
+		UpstreamNameservers: []string{"8.8.8.8"},
+		NodePools: []NodePool{
+			{Name: "gpu", NodeSelector: map[string]string{"pool": "gpu"}, UpstreamNameservers: []string{"10.2.0.53"}},
+			{Name: "edge", NodeSelector: map[string]string{"pool": "edge", "zone": "a"},
+				StubDomains: map[string][]string{"acme.local": {"192.168.0.53"}, "factory.local": {"192.168.0.54"}}},
+		},
+	}
+
+	assert.Nil(t, config.SelectNodePool(nil))
+	assert.Nil(t, config.SelectNodePool(map[string]string{"pool": "edge"}))
+	assert.Same(t, &config, config.ForNodePool(nil))
+
+	pool := config.SelectNodePool(map[string]string{"pool": "gpu", "zone": "a"})
+	if assert.NotNil(t, pool) {
+		assert.Equal(t, "gpu", pool.Name)
+		gpu := config.ForNodePool(pool)
+		assert.Equal(t, []string{"10.2.0.53"}, gpu.UpstreamNameservers)
+		assert.Equal(t, config.StubDomains, gpu.StubDomains)
+	}
+
+	pool = config.SelectNodePool(map[string]string{"pool": "edge", "zone": "a"})
+	if assert.NotNil(t, pool) {
+		assert.Equal(t, "edge", pool.Name)
+		edge := config.ForNodePool(pool)
+		assert.Equal(t, []string{"8.8.8.8"}, edge.UpstreamNameservers)
+		assert.Equal(t, map[string][]string{
+			"acme.local":    {"192.168.0.53"},
+			"widget.local":  {"2.2.2.2"},
+			"factory.local": {"192.168.0.54"},
+		}, edge.StubDomains)
+	}
+	// The configuration itself is left as is.
+	assert.Equal(t, []string{"1.1.1.1"}, config.StubDomains["acme.local"])
+}
+
+func TestRewriteRuleCompile(t *testing.T) {
+	rule := RewriteRule{Name: `(.*)\.legacy\.local`, Replacement: "${1}.default.svc.cluster.local"}
+	re, err := rule.Compile()
+	if assert.NoError(t, err) {
+		assert.True(t, re.MatchString("db.legacy.local."))
+		assert.True(t, re.MatchString("DB.Legacy.Local."))
+		assert.False(t, re.MatchString("db.legacy.local.example."))
+		assert.False(t, re.MatchString("db.legacy.local"))
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// customRecordTTL is the TTL of the custom records that do not set one.
+const customRecordTTL = 30
+
+// ParseCustomRecords parses custom records, one per line, either in zone
+// file format, e.g. "registry 60 IN A 10.0.0.10", or in hosts file format,
+// e.g. "10.0.0.10 registry registry-mirror". Relative names are relative to
+// origin. Only A, AAAA, CNAME and TXT records are supported. Lines starting
+// with # or ; are comments.
+func ParseCustomRecords(text, origin string) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		var lineRRs []dns.RR
+		var err error
+		if fields := strings.Fields(line); net.ParseIP(fields[0]) != nil {
+			lineRRs, err = parseHostsLine(fields, origin)
+		} else {
+			lineRRs, err = parseZoneLine(line, origin)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid custom record on line %d %q: %w", i+1, line, err)
+		}
+		rrs = append(rrs, lineRRs...)
+	}
+	return rrs, nil
+}
+
+func parseHostsLine(fields []string, origin string) ([]dns.RR, error) {
+	ip := net.ParseIP(fields[0])
+	var rrs []dns.RR
+	for _, name := range fields[1:] {
+		if strings.HasPrefix(name, "#") {
+			break
+		}
+		name = strings.ToLower(name)
+		if len(validation.IsDNS1123Subdomain(strings.TrimSuffix(name, "."))) > 0 {
+			return nil, fmt.Errorf("invalid name %q", name)
+		}
+		if !dns.IsFqdn(name) {
+			name = dns.Fqdn(name + "." + origin)
+		}
+		hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: customRecordTTL}
+		if ip4 := ip.To4(); ip4 != nil {
+			hdr.Rrtype = dns.TypeA
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	if len(rrs) == 0 {
+		return nil, fmt.Errorf("no name for %s", fields[0])
+	}
+	return rrs, nil
+}
+
+func parseZoneLine(line, origin string) ([]dns.RR, error) {
+	zp := dns.NewZoneParser(strings.NewReader(line), origin, "")
+	zp.SetDefaultTTL(customRecordTTL)
+	rr, ok := zp.Next()
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+	switch rr.Header().Rrtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeTXT:
+	default:
+		return nil, fmt.Errorf("unsupported record type %s", dns.TypeToString[rr.Header().Rrtype])
+	}
+	if rr.Header().Class != dns.ClassINET {
+		return nil, fmt.Errorf("unsupported class %s", dns.ClassToString[rr.Header().Class])
+	}
+	if strings.Contains(rr.Header().Name, "*") {
+		return nil, fmt.Errorf("wildcard names are not supported")
+	}
+	rr.Header().Name = strings.ToLower(rr.Header().Name)
+	return []dns.RR{rr}, nil
+}
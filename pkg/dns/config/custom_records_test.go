@@ -0,0 +1,61 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCustomRecords(t *testing.T) {
+	rrs, err := ParseCustomRecords(`
+# Hosts file lines.
+10.0.0.10 registry Registry-Mirror.cluster.local. # trailing comment
+fd00::10  registry
+; Zone file lines.
+ntp 60 IN A 10.0.0.11
+git CNAME git.example.com.
+info TXT "hello world" "again"
+`, "cluster.local.")
+	require.NoError(t, err)
+	var got []string
+	for _, rr := range rrs {
+		got = append(got, rr.String())
+	}
+	assert.Equal(t, []string{
+		"registry.cluster.local.\t30\tIN\tA\t10.0.0.10",
+		"registry-mirror.cluster.local.\t30\tIN\tA\t10.0.0.10",
+		"registry.cluster.local.\t30\tIN\tAAAA\tfd00::10",
+		"ntp.cluster.local.\t60\tIN\tA\t10.0.0.11",
+		"git.cluster.local.\t30\tIN\tCNAME\tgit.example.com.",
+		"info.cluster.local.\t30\tIN\tTXT\t\"hello world\" \"again\"",
+	}, got)
+
+	for _, text := range []string{
+		"10.0.0.10",
+		"10.0.0.10 bad_name!",
+		"mx MX 10 mail.example.com.",
+		"ch CH TXT foo",
+		"*.wild A 10.0.0.10",
+		"broken A not-an-ip",
+	} {
+		_, err := ParseCustomRecords(text, "cluster.local.")
+		assert.Error(t, err, text)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// NodePool holds the configuration of the node-local caches of a pool of
+// nodes, e.g. GPU or edge nodes, that differs from the rest of the
+// cluster. kube-dns itself ignores the node pools.
+type NodePool struct {
+	// Name of the pool, for logging.
+	Name string `json:"name"`
+	// NodeSelector selects the nodes of the pool by their labels. The
+	// pool applies to a node that has all of them; an empty selector
+	// selects every node.
+	NodeSelector map[string]string `json:"nodeSelector"`
+	// StubDomains of the pool, added to those of the configuration and
+	// overriding them for the same domains.
+	StubDomains map[string][]string `json:"stubDomains,omitempty"`
+	// UpstreamNameservers of the pool, replacing those of the
+	// configuration if not empty.
+	UpstreamNameservers []string `json:"upstreamNameservers,omitempty"`
+	// CacheTTL is the maximum TTL in seconds for which the caches of the
+	// pool keep the answers of the stub domains. The default is used if 0.
+	CacheTTL int `json:"cacheTTL,omitempty"`
+}
+
+// selects returns whether the pool selects the node with the given labels.
+func (pool *NodePool) selects(labels map[string]string) bool {
+	for key, value := range pool.NodeSelector {
+		if label, ok := labels[key]; !ok || label != value {
+			return false
+		}
+	}
+	return true
+}
+
+// SelectNodePool returns the first node pool selecting the node with the
+// given labels, nil if there is none.
+func (config *Config) SelectNodePool(labels map[string]string) *NodePool {
+	for i := range config.NodePools {
+		if config.NodePools[i].selects(labels) {
+			return &config.NodePools[i]
+		}
+	}
+	return nil
+}
+
+// ForNodePool returns the configuration of the nodes of pool: the stub
+// domains and upstream nameservers of the pool applied to config. config
+// is returned as is if pool is nil.
+func (config *Config) ForNodePool(pool *NodePool) *Config {
+	if pool == nil {
+		return config
+	}
+	poolConfig := *config
+	if len(pool.StubDomains) > 0 {
+		poolConfig.StubDomains = make(map[string][]string, len(config.StubDomains)+len(pool.StubDomains))
+		for domain, nameservers := range config.StubDomains {
+			poolConfig.StubDomains[domain] = nameservers
+		}
+		for domain, nameservers := range pool.StubDomains {
+			poolConfig.StubDomains[domain] = nameservers
+		}
+	}
+	if len(pool.UpstreamNameservers) > 0 {
+		poolConfig.UpstreamNameservers = pool.UpstreamNameservers
+	}
+	return &poolConfig
+}
+
+func (config *Config) validateNodePools() error {
+	names := make(map[string]bool, len(config.NodePools))
+	for i := range config.NodePools {
+		pool := &config.NodePools[i]
+		if len(validation.IsDNS1123Label(pool.Name)) != 0 {
+			return fmt.Errorf("invalid node pool name: %q", pool.Name)
+		}
+		if names[pool.Name] {
+			return fmt.Errorf("duplicate node pool %q", pool.Name)
+		}
+		names[pool.Name] = true
+		for key, value := range pool.NodeSelector {
+			if errs := validation.IsQualifiedName(key); len(errs) != 0 {
+				return fmt.Errorf("invalid label %q in the selector of the node pool %q: %v", key, pool.Name, errs)
+			}
+			if errs := validation.IsValidLabelValue(value); len(errs) != 0 {
+				return fmt.Errorf("invalid value %q of the label %q in the selector of the node pool %q: %v", value, key, pool.Name, errs)
+			}
+		}
+		poolConfig := config.ForNodePool(pool)
+		if err := poolConfig.validateStubDomains(); err != nil {
+			return fmt.Errorf("node pool %q: %w", pool.Name, err)
+		}
+		if err := poolConfig.validateFallthroughZones(); err != nil {
+			return fmt.Errorf("node pool %q: %w", pool.Name, err)
+		}
+		if err := poolConfig.validateNamespaceDomains(); err != nil {
+			return fmt.Errorf("node pool %q: %w", pool.Name, err)
+		}
+		if err := poolConfig.validateUpstreamNameserver(); err != nil {
+			return fmt.Errorf("node pool %q: %w", pool.Name, err)
+		}
+		if pool.CacheTTL < 0 {
+			return fmt.Errorf("negative cache TTL %d for the node pool %q", pool.CacheTTL, pool.Name)
+		}
+	}
+	return nil
+}
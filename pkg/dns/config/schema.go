@@ -0,0 +1,314 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// The keys of the configuration follow the schema named by the APIVersionKey
+// key. In SchemaV1, the default, each field of Config has its own key, e.g.
+// stubDomains, mostly holding JSON. In SchemaV2, the ConfigV2Key key holds the
+// whole configuration as a YAML ConfigV2.
+const (
+	APIVersionKey = "apiVersion"
+	ConfigV2Key   = "config.yaml"
+
+	SchemaV1 = "v1"
+	SchemaV2 = "v2"
+)
+
+// migrationOrigin is the origin the custom records are parsed relative to
+// when migrating them, so that the relative names can be told apart.
+const migrationOrigin = "kube-dns-migration.invalid."
+
+// ConfigV2 is the configuration in SchemaV2. Unlike SchemaV1, the stub
+// domains, policies and custom records are structured.
+type ConfigV2 struct {
+	// Federations maps federation names to their domains.
+	Federations map[string]string `json:"federations,omitempty"`
+	// StubDomains are the domains forwarded to other nameservers than the
+	// upstream ones, including the fallthrough zones.
+	StubDomains []StubDomainV2 `json:"stubDomains,omitempty"`
+	// NamespaceDomains maps namespace names to an additional domain of
+	// their services, see Config.NamespaceDomains.
+	NamespaceDomains map[string]string `json:"namespaceDomains,omitempty"`
+	// PeerClusters maps peer cluster names to their DNS endpoints.
+	PeerClusters map[string]PeerCluster `json:"peerClusters,omitempty"`
+	// UpstreamNameservers override the nameservers inherited from the node.
+	UpstreamNameservers []string `json:"upstreamNameservers,omitempty"`
+	// FeatureGates override the --feature-gates flag.
+	FeatureGates map[string]bool `json:"featureGates,omitempty"`
+	// Policies restrict which clients may resolve which names.
+	Policies *PoliciesV2 `json:"policies,omitempty"`
+	// CustomRecords are static records served in the cluster domain.
+	CustomRecords []CustomRecordV2 `json:"customRecords,omitempty"`
+	// NodePools configure the node-local caches of pools of nodes.
+	NodePools []NodePool `json:"nodePools,omitempty"`
+	// RewriteRules rewrite the names queried, see Config.RewriteRules.
+	RewriteRules []RewriteRule `json:"rewriteRules,omitempty"`
+}
+
+// StubDomainV2 is a domain forwarded to its own nameservers.
+type StubDomainV2 struct {
+	// Domain is the domain name suffix, e.g. "acme.local".
+	Domain string `json:"domain"`
+	// Nameservers of the domain, as ip or ip:port. A fallthrough domain
+	// without nameservers is forwarded to the upstream nameservers.
+	Nameservers []string `json:"nameservers,omitempty"`
+	// Fallthrough answers the names of the domain kube-dns knows, e.g.
+	// from custom records, and only forwards the others, see
+	// Config.FallthroughZones.
+	Fallthrough bool `json:"fallthrough,omitempty"`
+}
+
+// PoliciesV2 holds the access policies of the configuration.
+type PoliciesV2 struct {
+	// TenantAccess maps tenant names to the other tenants whose clients
+	// may resolve the services of its namespaces, see Config.TenantAccess.
+	TenantAccess map[string][]string `json:"tenantAccess,omitempty"`
+}
+
+// CustomRecordV2 is a static record.
+type CustomRecordV2 struct {
+	// Name of the record, relative to the cluster domain unless it ends
+	// with a dot. @ is the cluster domain itself.
+	Name string `json:"name"`
+	// Type of the record: A, AAAA, CNAME or TXT.
+	Type string `json:"type"`
+	// TTL of the record in seconds, 30 if 0.
+	TTL uint32 `json:"ttl,omitempty"`
+	// Value of the record: an address, the target name or the text.
+	Value string `json:"value"`
+}
+
+// parseData parses the configuration keys in the schema they name.
+func parseData(data map[string]string) (*Config, error) {
+	switch version := data[APIVersionKey]; version {
+	case "", SchemaV1:
+		return parseV1(data)
+	case SchemaV2:
+		for key := range data {
+			if _, ok := v1Fields[key]; ok {
+				klog.Warningf("Ignoring %v, which is not part of the %v schema", key, SchemaV2)
+			}
+		}
+		return parseV2(data[ConfigV2Key])
+	default:
+		return nil, fmt.Errorf("unknown %v %q, expected %v or %v", APIVersionKey, version, SchemaV1, SchemaV2)
+	}
+}
+
+func parseV2(text string) (*Config, error) {
+	var v2 ConfigV2
+	if err := yaml.UnmarshalStrict([]byte(text), &v2); err != nil {
+		return nil, fmt.Errorf("invalid %v: %w", ConfigV2Key, err)
+	}
+	return v2.Config()
+}
+
+// Config returns the configuration. It is not validated.
+func (v2 *ConfigV2) Config() (*Config, error) {
+	config := &Config{
+		Federations:         v2.Federations,
+		NamespaceDomains:    v2.NamespaceDomains,
+		PeerClusters:        v2.PeerClusters,
+		UpstreamNameservers: v2.UpstreamNameservers,
+		FeatureGates:        v2.FeatureGates,
+		NodePools:           v2.NodePools,
+		RewriteRules:        v2.RewriteRules,
+	}
+	if config.Federations == nil {
+		config.Federations = map[string]string{}
+	}
+	config.StubDomains = map[string][]string{}
+	seen := map[string]bool{}
+	for _, stub := range v2.StubDomains {
+		if seen[stub.Domain] {
+			return nil, fmt.Errorf("stub domain %q is listed twice", stub.Domain)
+		}
+		seen[stub.Domain] = true
+		if !stub.Fallthrough {
+			config.StubDomains[stub.Domain] = stub.Nameservers
+			continue
+		}
+		if config.FallthroughZones == nil {
+			config.FallthroughZones = map[string][]string{}
+		}
+		config.FallthroughZones[stub.Domain] = stub.Nameservers
+	}
+	if v2.Policies != nil {
+		config.TenantAccess = v2.Policies.TenantAccess
+	}
+
+	var records strings.Builder
+	for _, record := range v2.CustomRecords {
+		line, err := record.zoneLine()
+		if err != nil {
+			return nil, err
+		}
+		records.WriteString(line)
+		records.WriteByte('\n')
+	}
+	config.CustomRecords = records.String()
+	return config, nil
+}
+
+// zoneLine returns the record in the zone file format of
+// Config.CustomRecords.
+func (record *CustomRecordV2) zoneLine() (string, error) {
+	if record.Name == "" || strings.ContainsAny(record.Name, " \t\n;") {
+		return "", fmt.Errorf("invalid custom record name %q", record.Name)
+	}
+	if strings.ContainsAny(record.Value, "\n") {
+		return "", fmt.Errorf("custom record %q: the value cannot span several lines", record.Name)
+	}
+	value := record.Value
+	switch strings.ToUpper(record.Type) {
+	case "A", "AAAA", "CNAME":
+	case "TXT":
+		value = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+	default:
+		return "", fmt.Errorf("custom record %q: unsupported type %q", record.Name, record.Type)
+	}
+	ttl := record.TTL
+	if ttl == 0 {
+		ttl = customRecordTTL
+	}
+	return fmt.Sprintf("%s %d IN %s %s", record.Name, ttl, strings.ToUpper(record.Type), value), nil
+}
+
+// ToV2 returns the configuration in SchemaV2.
+func (config *Config) ToV2() (*ConfigV2, error) {
+	v2 := &ConfigV2{
+		NamespaceDomains:    config.NamespaceDomains,
+		PeerClusters:        config.PeerClusters,
+		UpstreamNameservers: config.UpstreamNameservers,
+		FeatureGates:        config.FeatureGates,
+		NodePools:           config.NodePools,
+		RewriteRules:        config.RewriteRules,
+	}
+	if len(config.Federations) > 0 {
+		v2.Federations = config.Federations
+	}
+	for domain, nameservers := range config.StubDomains {
+		v2.StubDomains = append(v2.StubDomains, StubDomainV2{Domain: domain, Nameservers: nameservers})
+	}
+	for domain, nameservers := range config.FallthroughZones {
+		v2.StubDomains = append(v2.StubDomains, StubDomainV2{Domain: domain, Nameservers: nameservers, Fallthrough: true})
+	}
+	sort.Slice(v2.StubDomains, func(i, j int) bool { return v2.StubDomains[i].Domain < v2.StubDomains[j].Domain })
+	if len(config.TenantAccess) > 0 {
+		v2.Policies = &PoliciesV2{TenantAccess: config.TenantAccess}
+	}
+
+	rrs, err := ParseCustomRecords(config.CustomRecords, migrationOrigin)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range rrs {
+		record := CustomRecordV2{
+			Name: relativeName(rr.Header().Name),
+			Type: dns.TypeToString[rr.Header().Rrtype],
+		}
+		if rr.Header().Ttl != customRecordTTL {
+			record.TTL = rr.Header().Ttl
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			record.Value = rr.A.String()
+		case *dns.AAAA:
+			record.Value = rr.AAAA.String()
+		case *dns.CNAME:
+			record.Value = relativeName(rr.Target)
+		case *dns.TXT:
+			// The strings of a record are read as one.
+			record.Value = unescapeTXT(strings.Join(rr.Txt, ""))
+		}
+		v2.CustomRecords = append(v2.CustomRecords, record)
+	}
+	return v2, nil
+}
+
+// relativeName returns name relative to the cluster domain if it was
+// relative when migrated.
+func relativeName(name string) string {
+	if name == migrationOrigin {
+		return "@"
+	}
+	return strings.TrimSuffix(name, "."+migrationOrigin)
+}
+
+// unescapeTXT returns the text of a TXT record string in presentation
+// format, where quotes, backslashes and other bytes may be escaped as \X or
+// \DDD.
+func unescapeTXT(s string) string {
+	isDigit := func(c byte) bool { return '0' <= c && c <= '9' }
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+				b.WriteByte((s[i+1]-'0')*100 + (s[i+2]-'0')*10 + s[i+3] - '0')
+				i += 3
+				continue
+			}
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// MigrateToV2 returns the keys of a configuration in SchemaV1 converted to
+// SchemaV2. The keys that are not part of the configuration are kept.
+func MigrateToV2(data map[string]string) (map[string]string, error) {
+	if data[APIVersionKey] == SchemaV2 {
+		return data, nil
+	}
+	config, err := parseData(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	v2, err := config.ToV2()
+	if err != nil {
+		return nil, err
+	}
+	text, err := yaml.Marshal(v2)
+	if err != nil {
+		return nil, err
+	}
+
+	migrated := map[string]string{
+		APIVersionKey: SchemaV2,
+		ConfigV2Key:   string(text),
+	}
+	for key, value := range data {
+		if _, ok := v1Fields[key]; !ok && key != APIVersionKey {
+			migrated[key] = value
+		}
+	}
+	return migrated, nil
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfigV2 = `
+federations:
+  myfed: example.com
+stubDomains:
+- domain: acme.local
+  nameservers: [1.2.3.4, "10.0.0.1:5353"]
+- domain: corp.example.com
+  fallthrough: true
+upstreamNameservers: [8.8.8.8]
+policies:
+  tenantAccess:
+    team-a: [team-b]
+customRecords:
+- {name: registry, type: A, value: 10.0.0.10}
+- {name: ntp, type: A, ttl: 60, value: 10.0.0.11}
+- {name: docs, type: cname, value: registry}
+- {name: info, type: TXT, value: 'hello "world"'}
+nodePools:
+- name: gpu
+  nodeSelector: {pool: gpu}
+  upstreamNameservers: [10.2.0.53]
+rewriteRules:
+- name: '(.*)\.legacy\.local'
+  replacement: '${1}.default.svc.cluster.local'
+`
+
+func TestParseData(t *testing.T) {
+	sync := newSync(newMockSource(syncResult{Version: "1", Data: map[string]string{
+		APIVersionKey: SchemaV2,
+		ConfigV2Key:   testConfigV2,
+	}}, nil))
+	config, err := sync.Once()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"myfed": "example.com"}, config.Federations)
+	assert.Equal(t, map[string][]string{"acme.local": {"1.2.3.4", "10.0.0.1:5353"}}, config.StubDomains)
+	assert.Equal(t, map[string][]string{"corp.example.com": nil}, config.FallthroughZones)
+	assert.Equal(t, []string{"8.8.8.8"}, config.UpstreamNameservers)
+	assert.Equal(t, map[string][]string{"team-a": {"team-b"}}, config.TenantAccess)
+	assert.Equal(t, "registry 30 IN A 10.0.0.10\nntp 60 IN A 10.0.0.11\n"+
+		"docs 30 IN CNAME registry\ninfo 30 IN TXT \"hello \\\"world\\\"\"\n", config.CustomRecords)
+	assert.Equal(t, []NodePool{{Name: "gpu", NodeSelector: map[string]string{"pool": "gpu"},
+		UpstreamNameservers: []string{"10.2.0.53"}}}, config.NodePools)
+	assert.Equal(t, []RewriteRule{{Name: `(.*)\.legacy\.local`, Replacement: "${1}.default.svc.cluster.local"}},
+		config.RewriteRules)
+
+	for _, data := range []map[string]string{
+		{APIVersionKey: "v3"},
+		{APIVersionKey: SchemaV2, ConfigV2Key: "stubDomains: {acme.local: [1.2.3.4]}"},
+		{APIVersionKey: SchemaV2, ConfigV2Key: "noSuchField: true"},
+		{APIVersionKey: SchemaV2, ConfigV2Key: "stubDomains: [{domain: a.local}, {domain: a.local, fallthrough: true}]"},
+		{APIVersionKey: SchemaV2, ConfigV2Key: "customRecords: [{name: mx, type: MX, value: 10 mail}]"},
+		{APIVersionKey: SchemaV2, ConfigV2Key: "customRecords: [{name: a, type: TXT, value: \"a\\nb\"}]"},
+	} {
+		_, err := parseData(data)
+		assert.Error(t, err, "should not be valid: %v", data)
+	}
+}
+
+func TestMigrateToV2(t *testing.T) {
+	v1 := map[string]string{
+		"stubDomains":         `{"acme.local": ["1.2.3.4"]}`,
+		"fallthroughZones":    `{"corp.example.com": ["10.0.0.1"]}`,
+		"upstreamNameservers": `["8.8.8.8"]`,
+		"tenantAccess":        `{"team-a": ["*"]}`,
+		"rewriteRules":        `[{"name": "db\\.legacy\\.local", "replacement": "postgres.default.svc.cluster.local"}]`,
+		"customRecords": "10.0.0.10 registry registry-mirror\n" +
+			"ntp 60 IN A 10.0.0.11\n" +
+			"@ IN TXT \"cluster \\\"zone\\\"\"\n" +
+			"ext IN CNAME example.com.\n",
+		"unrelated": "kept",
+	}
+	migrated, err := MigrateToV2(v1)
+	require.NoError(t, err)
+	assert.Equal(t, SchemaV2, migrated[APIVersionKey])
+	assert.Equal(t, "kept", migrated["unrelated"])
+	assert.NotContains(t, migrated, "stubDomains")
+
+	before, err := parseData(v1)
+	require.NoError(t, err)
+	after, err := parseData(migrated)
+	require.NoError(t, err)
+	require.NoError(t, after.Validate())
+	assert.Equal(t, before.StubDomains, after.StubDomains)
+	assert.Equal(t, before.FallthroughZones, after.FallthroughZones)
+	assert.Equal(t, before.UpstreamNameservers, after.UpstreamNameservers)
+	assert.Equal(t, before.TenantAccess, after.TenantAccess)
+	assert.Equal(t, before.RewriteRules, after.RewriteRules)
+	assert.Len(t, after.RewriteRules, 1)
+	records := func(text string) []string {
+		rrs, err := ParseCustomRecords(text, "cluster.local.")
+		require.NoError(t, err)
+		var records []string
+		for _, rr := range rrs {
+			records = append(records, rr.String())
+		}
+		return records
+	}
+	assert.Equal(t, records(before.CustomRecords), records(after.CustomRecords))
+
+	again, err := MigrateToV2(migrated)
+	require.NoError(t, err)
+	assert.Equal(t, migrated, again)
+}
@@ -18,7 +18,9 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 
+	"k8s.io/dns/pkg/dns/features"
 	fed "k8s.io/dns/pkg/dns/federation"
 	"k8s.io/klog/v2"
 )
@@ -116,23 +118,9 @@ func (sync *kubeSync) processUpdate(result syncResult, buildUnchangedConfig bool
 		return
 	}
 
-	config = &Config{}
-
-	for key, updateFn := range map[string]fieldUpdateFn{
-		"federations":         updateFederations,
-		"stubDomains":         updateStubDomains,
-		"upstreamNameservers": updateUpstreamNameservers,
-	} {
-		value, ok := result.Data[key]
-		if !ok {
-			klog.V(3).Infof("No %v present", key)
-			continue
-		}
-
-		if err = updateFn(key, value, config); err != nil {
-			klog.Errorf("Invalid configuration for %v, ignoring update: %v", key, err)
-			return
-		}
+	if config, err = parseData(result.Data); err != nil {
+		klog.Errorf("Invalid configuration, ignoring update: %v", err)
+		return
 	}
 
 	if err = config.Validate(); err != nil {
@@ -146,6 +134,37 @@ func (sync *kubeSync) processUpdate(result syncResult, buildUnchangedConfig bool
 
 type fieldUpdateFn func(key string, data string, config *Config) error
 
+// v1Fields are the keys of the configuration in SchemaV1.
+var v1Fields = map[string]fieldUpdateFn{
+	"federations":         updateFederations,
+	"stubDomains":         updateStubDomains,
+	"fallthroughZones":    updateFallthroughZones,
+	"namespaceDomains":    updateNamespaceDomains,
+	"peerClusters":        updatePeerClusters,
+	"upstreamNameservers": updateUpstreamNameservers,
+	"featureGates":        updateFeatureGates,
+	"customRecords":       updateCustomRecords,
+	"tenantAccess":        updateTenantAccess,
+	"nodePools":           updateNodePools,
+	"rewriteRules":        updateRewriteRules,
+}
+
+func parseV1(data map[string]string) (*Config, error) {
+	config := &Config{}
+	for key, updateFn := range v1Fields {
+		value, ok := data[key]
+		if !ok {
+			klog.V(3).Infof("No %v present", key)
+			continue
+		}
+
+		if err := updateFn(key, value, config); err != nil {
+			return config, fmt.Errorf("invalid configuration for %v: %w", key, err)
+		}
+	}
+	return config, nil
+}
+
 func updateFederations(key string, value string, config *Config) error {
 	config.Federations = make(map[string]string)
 	if err := fed.ParseFederationsFlag(value, config.Federations); err != nil {
@@ -168,6 +187,39 @@ func updateStubDomains(key string, value string, config *Config) error {
 	return nil
 }
 
+func updateFallthroughZones(key string, value string, config *Config) error {
+	config.FallthroughZones = make(map[string][]string)
+	if err := json.Unmarshal([]byte(value), &config.FallthroughZones); err != nil {
+		klog.Errorf("Invalid JSON %q: %v", value, err)
+		return err
+	}
+	klog.V(2).Infof("Updated %v to %v", key, config.FallthroughZones)
+
+	return nil
+}
+
+func updateNamespaceDomains(key string, value string, config *Config) error {
+	config.NamespaceDomains = make(map[string]string)
+	if err := json.Unmarshal([]byte(value), &config.NamespaceDomains); err != nil {
+		klog.Errorf("Invalid JSON %q: %v", value, err)
+		return err
+	}
+	klog.V(2).Infof("Updated %v to %v", key, config.NamespaceDomains)
+
+	return nil
+}
+
+func updatePeerClusters(key string, value string, config *Config) error {
+	config.PeerClusters = make(map[string]PeerCluster)
+	if err := json.Unmarshal([]byte(value), &config.PeerClusters); err != nil {
+		klog.Errorf("Invalid JSON %q: %v", value, err)
+		return err
+	}
+	klog.V(2).Infof("Updated %v to %v", key, config.PeerClusters)
+
+	return nil
+}
+
 func updateUpstreamNameservers(key string, value string, config *Config) error {
 	if err := json.Unmarshal([]byte(value), &config.UpstreamNameservers); err != nil {
 		klog.Errorf("Invalid JSON %q: %v", value, err)
@@ -177,3 +229,53 @@ func updateUpstreamNameservers(key string, value string, config *Config) error {
 
 	return nil
 }
+
+func updateFeatureGates(key string, value string, config *Config) error {
+	gates, err := features.Parse(value)
+	if err != nil {
+		klog.Errorf("Invalid feature gates %q: %v", value, err)
+		return err
+	}
+	config.FeatureGates = gates
+	klog.V(2).Infof("Updated %v to %v", key, config.FeatureGates)
+
+	return nil
+}
+
+func updateTenantAccess(key string, value string, config *Config) error {
+	config.TenantAccess = make(map[string][]string)
+	if err := json.Unmarshal([]byte(value), &config.TenantAccess); err != nil {
+		klog.Errorf("Invalid JSON %q: %v", value, err)
+		return err
+	}
+	klog.V(2).Infof("Updated %v to %v", key, config.TenantAccess)
+
+	return nil
+}
+
+func updateNodePools(key string, value string, config *Config) error {
+	if err := json.Unmarshal([]byte(value), &config.NodePools); err != nil {
+		klog.Errorf("Invalid JSON %q: %v", value, err)
+		return err
+	}
+	klog.V(2).Infof("Updated %v to %+v", key, config.NodePools)
+
+	return nil
+}
+
+func updateCustomRecords(key string, value string, config *Config) error {
+	config.CustomRecords = value
+	klog.V(2).Infof("Updated %v to %q", key, config.CustomRecords)
+
+	return nil
+}
+
+func updateRewriteRules(key string, value string, config *Config) error {
+	if err := json.Unmarshal([]byte(value), &config.RewriteRules); err != nil {
+		klog.Errorf("Invalid JSON %q: %v", value, err)
+		return err
+	}
+	klog.V(2).Infof("Updated %v to %+v", key, config.RewriteRules)
+
+	return nil
+}
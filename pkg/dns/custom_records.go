@@ -0,0 +1,260 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/config"
+	"k8s.io/dns/pkg/dns/util"
+)
+
+// configRecordSet is the key of the record set of the configuration.
+const configRecordSet = "config"
+
+// setCustomRecords replaces the custom records of the configuration.
+func (kd *KubeDNS) setCustomRecords(text string) {
+	kd.setCustomRecordSet(configRecordSet, text)
+}
+
+// setCustomRecordSet replaces the record set with the given key, removed
+// if text is empty, and updates the records of the names it changes in the
+// cache. The record sets of the CustomRecordStore only reach the cache once
+// it has synced, so that the cache is not updated for each of its initial
+// record sets. It is a customrecords.Handler.
+func (kd *KubeDNS) setCustomRecordSet(key, text string) {
+	domain := dns.Fqdn(strings.ToLower(kd.domain))
+	records := make(map[string][]dns.RR)
+	if text != "" {
+		rrs, err := config.ParseCustomRecords(text, domain)
+		if err != nil {
+			klog.Errorf("Invalid custom records in %s, ignoring them: %v", key, err)
+			rrs = nil
+		}
+		for _, rr := range rrs {
+			name := rr.Header().Name
+			records[name] = append(records[name], rr)
+		}
+	}
+
+	kd.cacheLock.Lock()
+	defer kd.unlockCache()
+	if kd.customRecordSets == nil {
+		kd.customRecordSets = make(map[string]map[string][]dns.RR)
+		kd.customRecordNames = make(map[string][]string)
+		kd.customRecordsServed = make(map[string]bool)
+	}
+	previous := kd.customRecordSets[key]
+	if len(records) == 0 {
+		if previous == nil {
+			return
+		}
+		delete(kd.customRecordSets, key)
+	} else {
+		kd.customRecordSets[key] = records
+	}
+
+	var changed []string
+	for name, rrs := range previous {
+		if _, ok := records[name]; !ok {
+			kd.customRecordNames[name] = removeString(kd.customRecordNames[name], key)
+			if len(kd.customRecordNames[name]) == 0 {
+				delete(kd.customRecordNames, name)
+			}
+			changed = append(changed, name)
+		} else if !sameRecords(rrs, records[name]) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range records {
+		if _, ok := previous[name]; !ok {
+			kd.customRecordNames[name] = insertString(kd.customRecordNames[name], key)
+			changed = append(changed, name)
+		}
+	}
+	if key != configRecordSet && !isRecordLeaseSet(key) && !kd.customRecordStoreSynced {
+		return
+	}
+	kd.updateCustomRecords(changed)
+}
+
+// customRecordStoreHasSynced adds the record sets initially in the
+// CustomRecordStore to the cache.
+func (kd *KubeDNS) customRecordStoreHasSynced() {
+	kd.cacheLock.Lock()
+	defer kd.unlockCache()
+	kd.customRecordStoreSynced = true
+	kd.rebuildCustomRecords()
+}
+
+// rebuildCustomRecords replaces the custom records in the cache with those
+// of every record set, e.g. once the names checkCustomRecordName accepts
+// changed. The caller must hold cacheLock.
+func (kd *KubeDNS) rebuildCustomRecords() {
+	names := make([]string, 0, len(kd.customRecordNames)+len(kd.customRecordsServed))
+	for name := range kd.customRecordNames {
+		names = append(names, name)
+	}
+	for name := range kd.customRecordsServed {
+		if _, ok := kd.customRecordNames[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	kd.updateCustomRecords(names)
+	if len(kd.customRecordsServed) > 0 {
+		klog.V(2).Infof("Serving %d custom record names from %d record sets", len(kd.customRecordsServed), len(kd.customRecordSets))
+	}
+}
+
+// updateCustomRecords replaces the custom records of names in the cache with
+// those of the record sets, ignoring those checkCustomRecordName rejects.
+// The caller must hold cacheLock.
+func (kd *KubeDNS) updateCustomRecords(names []string) {
+	if len(names) == 0 {
+		return
+	}
+	// Deleting the path of a name deletes the names under it as well,
+	// whose records are set again.
+	update := make(map[string]bool, len(names))
+	for _, name := range names {
+		update[name] = true
+	}
+	for served := range kd.customRecordsServed {
+		for _, name := range names {
+			if served != name && dns.IsSubDomain(name, served) {
+				update[served] = true
+				break
+			}
+		}
+	}
+	sorted := make([]string, 0, len(update))
+	for name := range update {
+		sorted = append(sorted, name)
+		if kd.customRecordsServed[name] {
+			kd.cache.DeletePath(customRecordPath(name)...)
+			delete(kd.customRecordsServed, name)
+		}
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		keys := kd.customRecordNames[name]
+		if len(keys) == 0 {
+			continue
+		}
+		if err := kd.checkCustomRecordName(name); err != nil {
+			klog.Warningf("Ignoring the custom records of %v at %q: %v", keys, name, err)
+			continue
+		}
+		path := customRecordPath(name)
+		for _, key := range keys {
+			for _, rr := range kd.customRecordSets[key][name] {
+				record := customRecord(name, rr)
+				kd.cache.SetEntry(util.HashServiceRecord(record), record, name, path...)
+			}
+		}
+		kd.customRecordsServed[name] = true
+	}
+}
+
+// customRecord returns the cache record of the custom record rr of name.
+func customRecord(name string, rr dns.RR) *skymsg.Service {
+	record := util.NewServiceRecord("", 0)
+	record.Ttl = rr.Header().Ttl
+	switch rr := rr.(type) {
+	case *dns.A:
+		record.Host = rr.A.String()
+	case *dns.AAAA:
+		record.Host = rr.AAAA.String()
+	case *dns.CNAME:
+		record.Host = strings.TrimSuffix(rr.Target, ".")
+	case *dns.TXT:
+		// Pointing the record at itself leaves A and AAAA queries
+		// without answers from it, as for the canary.
+		record.Host = strings.TrimSuffix(name, ".")
+		record.Text = strings.Join(rr.Txt, "")
+	}
+	return record
+}
+
+// sameRecords returns whether a and b hold the same records, in the same
+// order.
+func sameRecords(a, b []dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// insertString inserts s into the sorted list, unless it is there already.
+func insertString(list []string, s string) []string {
+	i := sort.SearchStrings(list, s)
+	if i < len(list) && list[i] == s {
+		return list
+	}
+	list = append(list, "")
+	copy(list[i+1:], list[i:])
+	list[i] = s
+	return list
+}
+
+// removeString removes s from the sorted list.
+func removeString(list []string, s string) []string {
+	i := sort.SearchStrings(list, s)
+	if i == len(list) || list[i] != s {
+		return list
+	}
+	return append(list[:i], list[i+1:]...)
+}
+
+// checkCustomRecordName returns an error if custom records cannot be served
+// at name: outside of the cluster domain and of the fallthrough zones, or in
+// the svc and pod subdomains, owned by services and pods. Nor can they be in
+// the node subdomain with NodeRecords, or in the ACMEChallengeZone. The
+// caller must hold cacheLock.
+func (kd *KubeDNS) checkCustomRecordName(name string) error {
+	domain := dns.Fqdn(strings.ToLower(kd.domain))
+	inDomain := name != domain && dns.IsSubDomain(domain, name)
+	if !inDomain && !kd.inFallthroughZone(name) ||
+		dns.IsSubDomain(serviceSubdomain+"."+domain, name) || dns.IsSubDomain(podSubdomain+"."+domain, name) {
+		return fmt.Errorf("names must be in %s, outside of its %s and %s subdomains, or in a fallthrough zone",
+			domain, serviceSubdomain, podSubdomain)
+	}
+	if kd.NodeRecords && dns.IsSubDomain(nodeSubdomain+"."+domain, name) {
+		return fmt.Errorf("the %s subdomain serves the nodes", nodeSubdomain)
+	}
+	if kd.inACMEZone(name) {
+		return fmt.Errorf("%s serves the ACME challenges", kd.acmeZone())
+	}
+	return nil
+}
+
+// customRecordPath returns the cache path of the records of name.
+func customRecordPath(name string) []string {
+	return util.ReverseArray(strings.Split(strings.TrimSuffix(name, "."), "."))
+}
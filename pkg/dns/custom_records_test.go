@@ -0,0 +1,121 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func TestCustomRecords(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	kd.newService(s)
+
+	next := config.NewDefaultConfig()
+	next.CustomRecords = `
+10.0.0.10 registry
+fd00::10 registry
+git CNAME git.example.com.
+info TXT "hello"
+outside.example.com. A 10.0.0.12
+shadow.default.svc A 10.0.0.13
+`
+	kd.updateConfig(next)
+
+	records, err := kd.Records("registry."+testDomain, false)
+	require.NoError(t, err)
+	var hosts []string
+	for _, record := range records {
+		hosts = append(hosts, record.Host)
+	}
+	assert.ElementsMatch(t, []string{"10.0.0.10", "fd00::10"}, hosts)
+
+	records, err = kd.Records("git."+testDomain, false)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "git.example.com", records[0].Host)
+
+	records, err = kd.Records("info."+testDomain, false)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "hello", records[0].Text)
+
+	// Names owned by services are not overridden.
+	_, err = kd.Records("shadow.default.svc."+testDomain, false)
+	assert.Error(t, err)
+	assertDNSForClusterIP(t, "", kd, s, []string{"1.2.3.4"})
+
+	// Records removed from the configuration are removed from the cache.
+	next = config.NewDefaultConfig()
+	next.CustomRecords = "10.0.0.11 registry"
+	kd.updateConfig(next)
+	records, err = kd.Records("registry."+testDomain, false)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "10.0.0.11", records[0].Host)
+	_, err = kd.Records("git."+testDomain, false)
+	assert.Error(t, err)
+	assertDNSForClusterIP(t, "", kd, s, []string{"1.2.3.4"})
+}
+
+func TestCustomRecordSets(t *testing.T) {
+	kd := newKubeDNS()
+	next := config.NewDefaultConfig()
+	next.CustomRecords = "10.0.0.10 registry"
+	kd.updateConfig(next)
+
+	// The record sets of the store are held back until it has synced.
+	kd.setCustomRecordSet("configmap/kube-system/records/a", "10.0.0.11 registry\n10.0.0.20 db")
+	kd.setCustomRecordSet("configmap/kube-system/records/b", "10.0.0.30 cache")
+	_, err := kd.Records("db."+testDomain, false)
+	assert.Error(t, err)
+	kd.customRecordStoreHasSynced()
+	assert.ElementsMatch(t, []string{"10.0.0.10", "10.0.0.11"}, recordHosts(t, kd, "registry."+testDomain))
+	assert.ElementsMatch(t, []string{"10.0.0.20"}, recordHosts(t, kd, "db."+testDomain))
+	assert.ElementsMatch(t, []string{"10.0.0.30"}, recordHosts(t, kd, "cache."+testDomain))
+
+	// Changes apply once synced, and leave the other record sets alone.
+	kd.setCustomRecordSet("configmap/kube-system/records/a", "10.0.0.21 db")
+	assert.ElementsMatch(t, []string{"10.0.0.10"}, recordHosts(t, kd, "registry."+testDomain))
+	assert.ElementsMatch(t, []string{"10.0.0.21"}, recordHosts(t, kd, "db."+testDomain))
+	kd.setCustomRecordSet("configmap/kube-system/records/b", "")
+	_, err = kd.Records("cache."+testDomain, false)
+	assert.Error(t, err)
+
+	// Only the names changed are updated, those under them are kept.
+	kd.setCustomRecordSet("configmap/kube-system/records/c", "10.0.0.40 primary.db")
+	kd.setCustomRecordSet("configmap/kube-system/records/a", "10.0.0.22 db")
+	assert.ElementsMatch(t, []string{"10.0.0.22"}, recordHosts(t, kd, "db."+testDomain))
+	assert.ElementsMatch(t, []string{"10.0.0.40"}, recordHosts(t, kd, "primary.db."+testDomain))
+	kd.setCustomRecordSet("configmap/kube-system/records/a", "")
+	assert.ElementsMatch(t, []string{"10.0.0.40"}, recordHosts(t, kd, "primary.db."+testDomain))
+	kd.setCustomRecordSet("configmap/kube-system/records/a", "10.0.0.21 db")
+	kd.setCustomRecordSet("configmap/kube-system/records/c", "")
+	assert.Equal(t, map[string]bool{"registry." + testDomain: true, "db." + testDomain: true}, kd.customRecordsServed)
+
+	// Updating the configuration keeps the records of the store.
+	next = config.NewDefaultConfig()
+	kd.updateConfig(next)
+	_, err = kd.Records("registry."+testDomain, false)
+	assert.Error(t, err)
+	assert.ElementsMatch(t, []string{"10.0.0.21"}, recordHosts(t, kd, "db."+testDomain))
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package customrecords
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	clientset "k8s.io/client-go/kubernetes"
+	kcache "k8s.io/client-go/tools/cache"
+)
+
+// ConfigMapLabel selects the ConfigMaps holding custom records.
+const ConfigMapLabel = "dns.kubernetes.io/custom-records"
+
+// NewConfigMapStore returns a Store of the record sets held by the
+// ConfigMaps of namespace labeled with ConfigMapLabel, every namespace if
+// empty. Each key of their data is a record set, so that records can be
+// spread over as many ConfigMaps and keys as needed.
+func NewConfigMapStore(client clientset.Interface, namespace string) Store {
+	listOptions := func(options *metav1.ListOptions) {
+		options.LabelSelector = ConfigMapLabel
+	}
+	return &informerStore{
+		listWatch: &kcache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				listOptions(&options)
+				return client.CoreV1().ConfigMaps(namespace).List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				listOptions(&options)
+				return client.CoreV1().ConfigMaps(namespace).Watch(context.TODO(), options)
+			},
+		},
+		objType:    &v1.ConfigMap{},
+		recordSets: configMapRecordSets,
+	}
+}
+
+func configMapRecordSets(obj interface{}) map[string]string {
+	cm, ok := obj.(*v1.ConfigMap)
+	if !ok {
+		return nil
+	}
+	sets := make(map[string]string, len(cm.Data))
+	for key, text := range cm.Data {
+		sets[fmt.Sprintf("configmap/%s/%s/%s", cm.Namespace, cm.Name, key)] = text
+	}
+	return sets
+}
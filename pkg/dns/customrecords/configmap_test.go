@@ -0,0 +1,92 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package customrecords
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+// recorder is a Handler keeping the current record sets.
+type recorder struct {
+	lock sync.Mutex
+	sets map[string]string
+}
+
+func (r *recorder) handle(key, text string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if text == "" {
+		delete(r.sets, key)
+		return
+	}
+	r.sets[key] = text
+}
+
+func (r *recorder) get() map[string]string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sets := make(map[string]string, len(r.sets))
+	for key, text := range r.sets {
+		sets[key] = text
+	}
+	return sets
+}
+
+func TestConfigMapStore(t *testing.T) {
+	labeled := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "records", Namespace: "kube-system", Labels: map[string]string{ConfigMapLabel: "true"}},
+		Data:       map[string]string{"a": "10.0.0.1 a", "b": "10.0.0.2 b"},
+	}
+	unlabeled := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "kube-system"},
+		Data:       map[string]string{"c": "10.0.0.3 c"},
+	}
+	client := fake.NewSimpleClientset(labeled, unlabeled)
+	store := NewConfigMapStore(client, "kube-system")
+	r := &recorder{sets: map[string]string{}}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go store.Run(stopCh, r.handle)
+	require.True(t, cache.WaitForCacheSync(stopCh, store.HasSynced))
+	assert.Equal(t, map[string]string{
+		"configmap/kube-system/records/a": "10.0.0.1 a",
+		"configmap/kube-system/records/b": "10.0.0.2 b",
+	}, r.get())
+
+	// Keys removed from a ConfigMap remove their record set.
+	labeled = labeled.DeepCopy()
+	labeled.Data = map[string]string{"a": "10.0.0.4 a"}
+	_, err := client.CoreV1().ConfigMaps("kube-system").Update(context.TODO(), labeled, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(map[string]string{"configmap/kube-system/records/a": "10.0.0.4 a"}, r.get())
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, client.CoreV1().ConfigMaps("kube-system").Delete(context.TODO(), "records", metav1.DeleteOptions{}))
+	assert.Eventually(t, func() bool { return len(r.get()) == 0 }, 5*time.Second, 10*time.Millisecond)
+}
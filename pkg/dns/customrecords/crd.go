@@ -0,0 +1,131 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package customrecords
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/rest"
+	kcache "k8s.io/client-go/tools/cache"
+)
+
+// GroupVersion of the CustomRecordSets.
+var GroupVersion = schema.GroupVersion{Group: "dns.kubernetes.io", Version: "v1alpha1"}
+
+// CustomRecordSet holds custom records. Its CustomResourceDefinition, in
+// customrecordsets.yaml, is not installed by kube-dns.
+type CustomRecordSet struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec CustomRecordSetSpec `json:"spec,omitempty"`
+}
+
+// CustomRecordSetSpec is the spec of a CustomRecordSet.
+type CustomRecordSetSpec struct {
+	// Records are in the format of the customRecords configuration.
+	Records string `json:"records"`
+}
+
+// CustomRecordSetList is a list of CustomRecordSets.
+type CustomRecordSetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []CustomRecordSet `json:"items"`
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *CustomRecordSet) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+// DeepCopy returns a deep copy of the CustomRecordSet.
+func (in *CustomRecordSet) DeepCopy() *CustomRecordSet {
+	if in == nil {
+		return nil
+	}
+	out := &CustomRecordSet{TypeMeta: in.TypeMeta, Spec: in.Spec}
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *CustomRecordSetList) DeepCopyObject() runtime.Object {
+	if in == nil {
+		return nil
+	}
+	out := &CustomRecordSetList{TypeMeta: in.TypeMeta}
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]CustomRecordSet, len(in.Items))
+		for i := range in.Items {
+			out.Items[i] = *in.Items[i].DeepCopy()
+		}
+	}
+	return out
+}
+
+var (
+	scheme = runtime.NewScheme()
+	codecs = serializer.NewCodecFactory(scheme)
+)
+
+func init() {
+	scheme.AddKnownTypes(GroupVersion, &CustomRecordSet{}, &CustomRecordSetList{})
+	metav1.AddToGroupVersion(scheme, GroupVersion)
+}
+
+// NewForConfig returns a client of the dns.kubernetes.io API, for
+// NewCRDStore.
+func NewForConfig(config *rest.Config) (rest.Interface, error) {
+	config = rest.CopyConfig(config)
+	config.GroupVersion = &GroupVersion
+	config.APIPath = "/apis"
+	// Custom resources are only served as JSON.
+	config.ContentType = runtime.ContentTypeJSON
+	config.AcceptContentTypes = runtime.ContentTypeJSON
+	config.NegotiatedSerializer = codecs.WithoutConversion()
+	return rest.RESTClientFor(config)
+}
+
+// NewCRDStore returns a Store of the CustomRecordSets of namespace, every
+// namespace if empty, each being a record set.
+func NewCRDStore(client rest.Interface, namespace string) Store {
+	if namespace == "" {
+		namespace = v1.NamespaceAll
+	}
+	return &informerStore{
+		listWatch:  kcache.NewListWatchFromClient(client, "customrecordsets", namespace, fields.Everything()),
+		objType:    &CustomRecordSet{},
+		recordSets: crdRecordSets,
+	}
+}
+
+func crdRecordSets(obj interface{}) map[string]string {
+	set, ok := obj.(*CustomRecordSet)
+	if !ok {
+		return nil
+	}
+	return map[string]string{fmt.Sprintf("customrecordset/%s/%s", set.Namespace, set.Name): set.Spec.Records}
+}
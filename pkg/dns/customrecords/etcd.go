@@ -0,0 +1,145 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package customrecords
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// etcdRetryPeriod is how long the etcd store waits before listing the
+// record sets again once the watch fails.
+const etcdRetryPeriod = 5 * time.Second
+
+// EtcdStore is a Store of the record sets held by the values of the etcd
+// keys under a prefix. Its keys are "etcd/" followed by the etcd key.
+type EtcdStore struct {
+	client *clientv3.Client
+	prefix string
+	synced int32
+}
+
+// NewEtcdStore returns a Store of the record sets under prefix in the etcd
+// cluster at endpoints, reached over TLS with tlsConfig if not nil, see
+// EtcdTLSConfig.
+func NewEtcdStore(endpoints []string, prefix string, tlsConfig *tls.Config) (*EtcdStore, error) {
+	client, err := clientv3.New(clientv3.Config{Endpoints: endpoints, DialTimeout: 5 * time.Second, TLS: tlsConfig})
+	if err != nil {
+		return nil, err
+	}
+	return &EtcdStore{client: client, prefix: prefix}, nil
+}
+
+// EtcdTLSConfig returns the TLS configuration of the connections to etcd:
+// the server is verified with the CAs of caFile, the system ones if empty,
+// and the client authenticated with the certificate of certFile and keyFile
+// if set. It returns nil if all are empty, for plain connections.
+func EtcdTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("both a client certificate and key are needed")
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in the CA %q", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func (s *EtcdStore) Run(stopCh <-chan struct{}, handler Handler) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	defer s.client.Close()
+
+	// known are the keys of the record sets passed to handler.
+	known := map[string]bool{}
+	wait.Until(func() {
+		resp, err := s.client.Get(ctx, s.prefix, clientv3.WithPrefix())
+		if err != nil {
+			klog.Errorf("Failed to list the custom records under %q: %v", s.prefix, err)
+			return
+		}
+		current := map[string]bool{}
+		for _, kv := range resp.Kvs {
+			key := etcdKey(kv.Key)
+			current[key] = true
+			handler(key, string(kv.Value))
+		}
+		for key := range known {
+			if !current[key] {
+				handler(key, "")
+			}
+		}
+		known = current
+		atomic.StoreInt32(&s.synced, 1)
+
+		for wresp := range s.client.Watch(ctx, s.prefix, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1)) {
+			if err := wresp.Err(); err != nil {
+				klog.Warningf("Failed to watch the custom records under %q, listing them again: %v", s.prefix, err)
+				return
+			}
+			for _, ev := range wresp.Events {
+				key := etcdKey(ev.Kv.Key)
+				if ev.Type == clientv3.EventTypeDelete {
+					delete(known, key)
+					handler(key, "")
+					continue
+				}
+				known[key] = true
+				handler(key, string(ev.Kv.Value))
+			}
+		}
+	}, etcdRetryPeriod, stopCh)
+}
+
+func (s *EtcdStore) HasSynced() bool {
+	return atomic.LoadInt32(&s.synced) == 1
+}
+
+func etcdKey(key []byte) string {
+	return "etcd/" + strings.TrimPrefix(string(key), "/")
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package customrecords provides stores of custom records, served by
+// kube-dns along with the customRecords of its configuration, so that
+// installations with many static records are not limited by the size of a
+// single ConfigMap.
+package customrecords
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	kcache "k8s.io/client-go/tools/cache"
+)
+
+// Handler is called with the text of a record set, in the format of the
+// customRecords configuration, when it is added or changes, and with an
+// empty text once it is removed. The key identifies the record set across
+// calls.
+type Handler func(key, text string)
+
+// Store holds record sets.
+type Store interface {
+	// Run calls handler with the record sets and their changes until
+	// stopCh is closed. Calls to handler are not concurrent.
+	Run(stopCh <-chan struct{}, handler Handler)
+	// HasSynced returns true once handler was called with the record sets
+	// initially in the store.
+	HasSynced() bool
+}
+
+// informerStore is a Store of the record sets held by API objects.
+type informerStore struct {
+	listWatch kcache.ListerWatcher
+	objType   runtime.Object
+	// recordSets returns the record sets held by an object, by key.
+	recordSets func(obj interface{}) map[string]string
+
+	lock       sync.Mutex
+	controller kcache.Controller
+}
+
+func (s *informerStore) Run(stopCh <-chan struct{}, handler Handler) {
+	// update calls handler with the record sets of newObj, and removes
+	// those of oldObj it no longer holds. Either may be nil.
+	update := func(oldObj, newObj interface{}) {
+		current := map[string]string{}
+		if newObj != nil {
+			current = s.recordSets(newObj)
+		}
+		if oldObj != nil {
+			for key := range s.recordSets(oldObj) {
+				if _, ok := current[key]; !ok {
+					handler(key, "")
+				}
+			}
+		}
+		for key, text := range current {
+			handler(key, text)
+		}
+	}
+	_, controller := kcache.NewInformer(s.listWatch, s.objType, 0, kcache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { update(nil, obj) },
+		UpdateFunc: update,
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(kcache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			update(obj, nil)
+		},
+	})
+	s.lock.Lock()
+	s.controller = controller
+	s.lock.Unlock()
+	controller.Run(stopCh)
+}
+
+func (s *informerStore) HasSynced() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.controller != nil && s.controller.HasSynced()
+}
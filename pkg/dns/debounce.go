@@ -0,0 +1,137 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	kcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+var (
+	endpointsUpdatesSuppressed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "kubedns",
+		Subsystem: "endpoints",
+		Name:      "updates_suppressed_total",
+		Help:      "Number of endpoints updates superseded by a later update of the same endpoints within the debounce window.",
+	})
+	registerDebounceMetrics sync.Once
+)
+
+// endpointsDebouncer holds the updates of each endpoints object for a
+// window, so that the handlers only see the last state of endpoints that
+// flap, e.g. during autoscaling or with crash-looping pods. The window
+// starts at the first update held: endpoints updated continuously are
+// still applied every window.
+type endpointsDebouncer struct {
+	window time.Duration
+
+	// lock is held while the updates are applied, so that the add and
+	// delete events that follow an update are handled after it.
+	lock sync.Mutex
+	// pending holds the updates waiting for their window to elapse, by
+	// namespace/name.
+	pending map[string]*pendingUpdate
+}
+
+// pendingUpdate is the object an endpoints object was last applied as, and
+// the last one it was updated to.
+type pendingUpdate struct {
+	old, new interface{}
+	apply    func(old, new interface{})
+	timer    *time.Timer
+}
+
+func newEndpointsDebouncer(window time.Duration) *endpointsDebouncer {
+	registerDebounceMetrics.Do(func() { prometheus.MustRegister(endpointsUpdatesSuppressed) })
+	return &endpointsDebouncer{
+		window:  window,
+		pending: make(map[string]*pendingUpdate),
+	}
+}
+
+// handlers returns the handlers of the endpoints informer, which hold the
+// updates before passing them to h.
+func (d *endpointsDebouncer) handlers(h kcache.ResourceEventHandler) kcache.ResourceEventHandlerFuncs {
+	return kcache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			d.flush(obj)
+			h.OnAdd(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			d.update(oldObj, newObj, h.OnUpdate)
+		},
+		DeleteFunc: func(obj interface{}) {
+			d.flush(obj)
+			h.OnDelete(obj)
+		},
+	}
+}
+
+// update holds the update from old to new, superseding the update of the
+// same endpoints already held, if any.
+func (d *endpointsDebouncer) update(old, new interface{}, apply func(old, new interface{})) {
+	key, err := kcache.DeletionHandlingMetaNamespaceKeyFunc(new)
+	if err != nil {
+		klog.Errorf("Failed to get the key of %T: %v", new, err)
+		apply(old, new)
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if p, ok := d.pending[key]; ok {
+		p.new = new
+		endpointsUpdatesSuppressed.Inc()
+		return
+	}
+	p := &pendingUpdate{old: old, new: new, apply: apply}
+	p.timer = time.AfterFunc(d.window, func() { d.fire(key, p) })
+	d.pending[key] = p
+}
+
+// fire applies the update p of the endpoints with key once its window
+// elapsed, unless it was flushed in the meantime.
+func (d *endpointsDebouncer) fire(key string, p *pendingUpdate) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.pending[key] != p {
+		return
+	}
+	delete(d.pending, key)
+	p.apply(p.old, p.new)
+}
+
+// flush applies the update held for the endpoints of obj right away, so
+// that the event of obj is handled after it.
+func (d *endpointsDebouncer) flush(obj interface{}) {
+	key, err := kcache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	p, ok := d.pending[key]
+	if !ok {
+		return
+	}
+	p.timer.Stop()
+	delete(d.pending, key)
+	p.apply(p.old, p.new)
+}
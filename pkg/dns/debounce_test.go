@@ -0,0 +1,103 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	kcache "k8s.io/client-go/tools/cache"
+)
+
+// recordedEvents records the events passed to the handlers, as strings.
+type recordedEvents struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (r *recordedEvents) handlers() kcache.ResourceEventHandlerFuncs {
+	record := func(event string, obj interface{}) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.events = append(r.events, event+" "+obj.(*v1.Endpoints).Subsets[0].Addresses[0].IP)
+	}
+	return kcache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { record("add", obj) },
+		UpdateFunc: func(oldObj, newObj interface{}) { record("update", oldObj); record("to", newObj) },
+		DeleteFunc: func(obj interface{}) { record("delete", obj) },
+	}
+}
+
+func (r *recordedEvents) get() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func TestEndpointsDebouncer(t *testing.T) {
+	s := newHeadlessService()
+	endpoints := func(ip string) *v1.Endpoints {
+		return newEndpoints(s, newSubsetWithOnePort("", 80, ip))
+	}
+	recorded := &recordedEvents{}
+	handlers := newEndpointsDebouncer(time.Hour).handlers(recorded.handlers())
+
+	handlers.OnAdd(endpoints("10.0.0.1"))
+	handlers.OnUpdate(endpoints("10.0.0.1"), endpoints("10.0.0.2"))
+	handlers.OnUpdate(endpoints("10.0.0.2"), endpoints("10.0.0.3"))
+	assert.Equal(t, []string{"add 10.0.0.1"}, recorded.get())
+
+	// The delete is handled after the update held, only the last state of
+	// which is applied.
+	handlers.OnDelete(endpoints("10.0.0.3"))
+	assert.Equal(t, []string{"add 10.0.0.1", "update 10.0.0.1", "to 10.0.0.3", "delete 10.0.0.3"}, recorded.get())
+
+	// Once the window elapses, the update is applied.
+	recorded = &recordedEvents{}
+	handlers = newEndpointsDebouncer(10 * time.Millisecond).handlers(recorded.handlers())
+	handlers.OnUpdate(endpoints("10.0.0.1"), endpoints("10.0.0.2"))
+	handlers.OnUpdate(endpoints("10.0.0.2"), endpoints("10.0.0.3"))
+	assert.Eventually(t, func() bool { return len(recorded.get()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"update 10.0.0.1", "to 10.0.0.3"}, recorded.get())
+}
+
+func TestEndpointsDebounce(t *testing.T) {
+	kd := newKubeDNS()
+	kd.debouncer = newEndpointsDebouncer(10 * time.Millisecond)
+	s := newHeadlessService()
+	require.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	e := newEndpoints(s, newSubsetWithOnePortWithHostname("", 80, true, "10.0.0.1"))
+	require.NoError(t, kd.endpointsStore.Add(e))
+	kd.endpointsHandlers().OnAdd(e)
+	assertDNSForHeadlessService(t, kd, e)
+
+	for _, ip := range []string{"10.0.0.2", "10.0.0.3"} {
+		updated := newEndpoints(s, newSubsetWithOnePortWithHostname("", 80, true, ip))
+		require.NoError(t, kd.endpointsStore.Update(updated))
+		kd.endpointsHandlers().OnUpdate(e, updated)
+		e = updated
+	}
+	assert.Eventually(t, func() bool {
+		records, err := kd.Records(getEndpointsFQDN(kd, e), false)
+		return err == nil && len(records) == 1 && records[0].Host == "10.0.0.3"
+	}, time.Second, 5*time.Millisecond)
+}
@@ -18,26 +18,35 @@ package dns
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
 	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	kcache "k8s.io/client-go/tools/cache"
 
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/dns/pkg/dns/config"
+	"k8s.io/dns/pkg/dns/customrecords"
+	"k8s.io/dns/pkg/dns/features"
+	"k8s.io/dns/pkg/dns/leases"
+	"k8s.io/dns/pkg/dns/podindex"
 	"k8s.io/dns/pkg/dns/treecache"
 	"k8s.io/dns/pkg/dns/util"
 
 	"github.com/miekg/dns"
-	etcd "go.etcd.io/etcd/client/v2"
 	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
 	"k8s.io/dns/third_party/forked/skydns/server"
 	"k8s.io/klog/v2"
@@ -50,7 +59,8 @@ const (
 	// A subdomain added to the user specified domain for all pods.
 	podSubdomain = "pod"
 
-	// Resync period for the kube controller loop.
+	// Period at which the informers check whether their handlers are due
+	// a resync, see KubeDNS.ResyncPeriod.
 	resyncPeriod = 5 * time.Minute
 )
 
@@ -59,10 +69,17 @@ var (
 )
 
 type KubeDNS struct {
+	// generation of the records, see Generation. First in the struct, to
+	// be 64-bit aligned for the atomic operations.
+	generation uint64
+
 	// kubeClient makes calls to API Server and registers calls with API Server
 	// to get Endpoints and Service objects.
 	kubeClient clientset.Interface
 
+	// events posts the Events about the objects not fully served.
+	events *eventEmitter
+
 	// skydns points to the skydns server instance for configuration syncing.
 	SkyDNSConfig *server.Config
 
@@ -86,19 +103,77 @@ type KubeDNS struct {
 	// (regular) services and headless Services.  CNAME Records for
 	// ExternalName Services.
 	cache treecache.TreeCache
-	// TODO(nikhiljindal): Remove this. It can be recreated using
-	// clusterIPServiceMap.
-	reverseRecordMap map[string]*skymsg.Service
-	// clusterIPServiceMap to service object. Headless services are not
-	// part of this map. Used to get a service when given its cluster
-	// IP.  Access to this is coordinated using cacheLock. We use the
-	// same lock for cache and this map to ensure that they don't get
-	// out of sync.
-	clusterIPServiceMap map[string]*v1.Service
+	// cacheSnapshot holds the snapshot of cache that the queries read
+	// without locks, published when cacheLock is released.
+	cacheSnapshot atomic.Value
+	// cacheTx, while cacheBatches are running, is the transaction the
+	// writes to cache go to, published at once when the last batch is
+	// done, and cacheBase the cache it was begun on, which the queries read
+	// meanwhile with the COWTreeCache feature gate disabled. Access is
+	// coordinated using cacheLock.
+	cacheTx      treecache.Transaction
+	cacheBase    treecache.TreeCache
+	cacheBatches int
+	// staleCache holds the records loaded from RecordsSnapshotFile, or
+	// received from WarmStandbyPeer, answered until the records are synced.
+	staleCache atomic.Value
+	// warmStandby is 1 while the records received from WarmStandbyPeer
+	// are answered.
+	warmStandby int32
+	// negatives holds the names recently found to have no record, if
+	// NegativeCacheTTL is positive, see negativeCache.
+	negatives     *negativeCache
+	negativesOnce sync.Once
+	// ipShards holds the reverse records and the services of the cluster
+	// IPs. It has its own locks, see ipShards.
+	ipShards *ipShards
+	// headlessRecords are the records of the headless services last
+	// published, by namespace/name, see headlessRecords. Access to the
+	// map is coordinated using headlessRecordsLock.
+	headlessRecords     map[string]*headlessRecords
+	headlessRecordsLock sync.Mutex
+	// recordCounts maps a service namespace/name to the number of records
+	// generated for it, recordCount is the sum over all services. Access
+	// is coordinated using cacheLock.
+	recordCounts map[string]int
+	recordCount  int
+	// recordOwners maps a service namespace/name to the service whose
+	// records are in the cache. Access is coordinated using cacheLock.
+	recordOwners map[string]recordOwner
+	// serviceAliases maps a service namespace/name to the aliases it
+	// published, aliasOwners maps an alias namespace/name to the service
+	// publishing it. Access is coordinated using cacheLock.
+	serviceAliases map[string][]string
+	aliasOwners    map[string]string
+	// customRecordSets are the records of the configuration and of the
+	// CustomRecordStore, by record set key and name. customRecordNames
+	// are the sorted keys of the record sets with records at each name,
+	// and customRecordsServed the names whose records are in the cache.
+	// Access is coordinated using cacheLock.
+	customRecordSets    map[string]map[string][]dns.RR
+	customRecordNames   map[string][]string
+	customRecordsServed map[string]bool
+	// acmeChallenges maps the names of the ACME challenges to the
+	// expiry of each of their values. Access is coordinated using
+	// cacheLock.
+	acmeChallenges map[string]map[string]time.Time
+	// fallthroughZones are the sorted fallthrough zones of the
+	// configuration, whose custom records are served. Access is
+	// coordinated using cacheLock.
+	fallthroughZones []string
+	// recordLeases are the leases publishing custom records, by ID.
+	// recordLeasesLock protects them, it is taken before cacheLock.
+	recordLeases     map[string]leases.Lease
+	recordLeasesLock sync.Mutex
+	// customRecordStoreSynced is set once the records initially in the
+	// CustomRecordStore are in customRecordSets. Access is coordinated
+	// using cacheLock.
+	customRecordStoreSynced bool
 	// cacheLock protecting the cache. caller is responsible for using
 	// the cacheLock before invoking methods on cache the cache is not
 	// thread-safe, and the caller can guarantee thread safety by using
-	// the cacheLock
+	// the cacheLock. Writers release it with unlockCache, which publishes
+	// the cacheSnapshot the queries read instead.
 	cacheLock sync.RWMutex
 
 	// The domain for which this DNS Server is authoritative, in array
@@ -106,33 +181,304 @@ type KubeDNS struct {
 	// domainPath is []string{"local", "cluster"}
 	domainPath []string
 
+	// servicesHandled and endpointsHandled are the keys of the services
+	// and endpoints whose events were handled, until the initial sync
+	// completes.
+	servicesHandled  *handledKeys
+	endpointsHandled *handledKeys
+	// syncPending holds the []string of the resources that the initial
+	// sync waits for, see InitialSyncPending.
+	syncPending atomic.Value
+	// informerFactory creates the informers of the Kubernetes resources,
+	// which share their caches and watches. Started by Start().
+	informerFactory informers.SharedInformerFactory
 	// endpointsController  invokes registered callbacks when endpoints change.
 	endpointsController kcache.Controller
 	// serviceController invokes registered callbacks when services change.
 	serviceController kcache.Controller
+	// endpointSliceController invokes registered callbacks when
+	// endpoint slices change. Only set with DropTerminatingEndpoints,
+	// ServingTerminatingEndpoints, TopologyAwareAnswers or
+	// MultiClusterDomain.
+	endpointSliceController kcache.Controller
+	// endpointSlicesStore holds the endpoint slices, indexed by
+	// ServiceImport.
+	endpointSlicesStore kcache.Indexer
+	// serviceImportController invokes registered callbacks when
+	// ServiceImports change. Only set with MultiClusterDomain.
+	serviceImportController kcache.Controller
+	serviceImportsStore     kcache.Indexer
+	// multiClusterPath is MultiClusterDomain in array format, reversed.
+	multiClusterPath []string
+	// namespaceController invokes registered callbacks when namespaces
+	// change. Only set with TenantZones.
+	namespaceController kcache.Controller
+	namespacesStore     kcache.Store
+	// nodeController invokes registered callbacks when nodes change. Only
+	// set with NodeRecords. Unlike nodesStore, nodeRecordsStore holds
+	// every node.
+	nodeController   kcache.Controller
+	nodeRecordsStore kcache.Store
+	// topology holds the location of the endpoints, from their slices.
+	topology *endpointTopology
+	// debouncer, if set, holds the endpoints updates, see
+	// EndpointsDebounce.
+	debouncer *endpointsDebouncer
+	// queue, if set, holds the service and endpoints events until they
+	// are handled by the workers.
+	queue *eventQueue
+
+	// terminatingEndpoints maps a service namespace/name to the
+	// terminating addresses of each of its endpoint slices.
+	terminatingEndpoints map[string]map[string]sliceConditions
+	// terminatingLock protects terminatingEndpoints.
+	terminatingLock sync.RWMutex
 
 	// config set from the dynamic configuration source.
 	config *config.Config
 	// configLock protects the config below.
 	configLock sync.RWMutex
+	// namespaceDomains maps the lower case, fully qualified, namespace
+	// domains of the config to their namespace.
+	namespaceDomains map[string]string
 	// configSync manages synchronization of the config map
 	configSync config.Sync
 
 	// Initial timeout for endpoints and services to be synced from APIServer
 	initialSyncTimeout time.Duration
+
+	// AuditLog, if set, receives every record change along with the
+	// object that caused it. Must be set before Start().
+	AuditLog *AuditLog
+
+	// RecordWatch, if set, streams every record change to the watchers,
+	// see WatchRecords. Must be set before Start().
+	RecordWatch *RecordWatch
+
+	// CacheInvalidation, if set, invalidates the cached replies of this
+	// replica and its peers when records change. Requires RecordWatch. Must
+	// be set before Start().
+	CacheInvalidation *CacheInvalidation
+
+	// Guardrails, if set, hold back suspicious mass deletions of records
+	// and report when the number of records is out of the expected
+	// bounds. Must be set before Start().
+	Guardrails *Guardrails
+
+	// FederationHealth, if set, is consulted before redirecting a query
+	// to a federation. Must be set before Start().
+	FederationHealth *FederationHealthCheck
+
+	// PeerClusters, if set, resolves the services of the peer clusters of
+	// the configuration under remote.<domain>. Must be set before Start().
+	PeerClusters *PeerClusters
+
+	// ZoneProviders answer the names they handle ahead of the services and
+	// pods of the cluster, after the peer clusters, the federations and the
+	// clusterset. Must be set before Start().
+	ZoneProviders []ZoneProvider
+	// zoneProviders is the chain of the built-in providers and
+	// ZoneProviders, built on the first query.
+	zoneProviders     []ZoneProvider
+	zoneProvidersOnce sync.Once
+
+	// DropTerminatingEndpoints removes the endpoints that EndpointSlices
+	// report as terminating from headless service records, before they
+	// are removed from the Endpoints object. Must be set before Start().
+	DropTerminatingEndpoints bool
+
+	// ServingTerminatingEndpoints publishes the not ready addresses of
+	// headless services that EndpointSlices report as terminating but
+	// still serving, so that they keep being resolved during rollouts
+	// until they stop serving. The not ready addresses of the services
+	// with spec.publishNotReadyAddresses are always published. Must be
+	// set before Start().
+	ServingTerminatingEndpoints bool
+
+	// PodIndex, if set, maps client IPs to pods for the features that
+	// depend on the identity of the client. It is started by Start().
+	PodIndex *podindex.PodIndex
+
+	// HeadlessReverseRecords selects the endpoints of headless services
+	// that get PTR records. Must be set before Start().
+	HeadlessReverseRecords HeadlessReverseRecords
+
+	// EndpointNaming is how the records of the endpoints of headless
+	// services without hostname are named. Must be set before Start().
+	EndpointNaming EndpointNaming
+
+	// PodsVerified only answers pod queries, e.g. 1-2-3-4.ns.pod.cluster.local,
+	// when a pod with that IP exists in the namespace, like the CoreDNS
+	// "pods verified" mode. Requires PodIndex. Must be set before Start().
+	PodsVerified bool
+
+	// PodReverseRecords answers the PTR queries of pod IPs that no service
+	// record claims with the pod record, e.g. 1-2-3-4.ns.pod.cluster.local.
+	// Requires PodIndex. Must be set before Start().
+	PodReverseRecords bool
+
+	// TopologyAwareAnswers filters and orders the address records of
+	// endpoints by the location of the client, see SortAnswers. Requires
+	// PodIndex. Must be set before Start().
+	TopologyAwareAnswers bool
+
+	// EventWorkers, if non-zero, is the number of workers handling the
+	// service and endpoints events from a rate-limited queue, serialized
+	// per service, rather than in the informer goroutines. The events of a
+	// service are held for EventCoalescePeriod, to be handled together.
+	// Must be set before Start().
+	EventWorkers        int
+	EventCoalescePeriod time.Duration
+
+	// LazySRV generates the SRV records of the endpoints of headless
+	// services when they are queried, rather than keeping them in the
+	// cache, see lazySRVZone. Must be set before Start().
+	LazySRV bool
+
+	// EndpointsDebounce, if non-zero, is how long the updates of an
+	// endpoints object are held, only the last one being applied, see
+	// endpointsDebouncer. Must be set before Start().
+	EndpointsDebounce time.Duration
+
+	// CacheMemoryInterval, if non-zero, is the period at which the memory
+	// held by the records is estimated and exported, and a warning logged
+	// if it exceeds CacheMemoryLimit, in bytes, unless 0. Must be set
+	// before Start().
+	CacheMemoryInterval time.Duration
+	CacheMemoryLimit    int64
+
+	// InventoryInterval, if non-zero, is the period at which the numbers
+	// of records by type, of services by type and of records by namespace
+	// are exported, see TakeInventory. Must be set before Start().
+	InventoryInterval time.Duration
+
+	// RecordsSnapshotFile, if set, is where the records are saved every
+	// RecordsSnapshotInterval once synced. Start() loads it, unless it is
+	// older than RecordsSnapshotMaxAge, and answers the names missing from
+	// the records from it, with a short TTL, until the records are synced.
+	// Must be set before Start().
+	RecordsSnapshotFile     string
+	RecordsSnapshotInterval time.Duration
+	RecordsSnapshotMaxAge   time.Duration
+
+	// WarmStandbyPeer, if set, is the address, host:port, of the replicas
+	// to receive the records from at Start(), waiting at most
+	// WarmStandbyTimeout, see bootstrapFromPeer. The replicas are
+	// connected to over TLS with WarmStandbyTLS, required. Must be set
+	// before Start().
+	WarmStandbyPeer    string
+	WarmStandbyTimeout time.Duration
+	WarmStandbyTLS     *tls.Config
+
+	// ResyncPeriod, if non-zero, is the period at which the informers
+	// replay their stores to the handlers and the records are reconciled
+	// against the stores, see reconcileRecords. Must be set before Start().
+	ResyncPeriod time.Duration
+
+	// JanitorInterval, if non-zero, is the period at which the records of
+	// services missing from the services store are purged, and the cache
+	// swept for the names and reverse records of no service, see
+	// sweepCache. Must be set before Start().
+	JanitorInterval time.Duration
+
+	// CanaryInterval, if non-zero, is the period at which the synthetic
+	// dns-canary.kube-system.svc TXT record is rewritten once synced.
+	// Must be set before Start().
+	CanaryInterval time.Duration
+
+	// MultiClusterDomain, if set, e.g. "clusterset.local.", is the domain
+	// the services imported from the clusterset are served in, read from
+	// the ServiceImports with MultiClusterClient. The skydns server must
+	// answer it as well. Must be set before Start().
+	MultiClusterDomain string
+	MultiClusterClient rest.Interface
+
+	// ExtraDomains, e.g. "prod.internal.", are answered identically to the
+	// cluster domain: a name in one of them is resolved as the same name in
+	// the cluster domain. The skydns server must answer them as well. Must
+	// be set before Start().
+	ExtraDomains []string
+
+	// TenantZones also serves the services of the namespaces labeled with
+	// TenantLabel in the zone of their tenant, e.g.
+	// my-svc.my-ns.svc.team-a.cluster.local, and enables the tenantAccess
+	// configuration, see Authorize. Must be set before Start().
+	TenantZones bool
+
+	// TrustedForwarders are the networks of the forwarders, e.g. the
+	// node-local-dns caches, whose queries are not restricted by the
+	// tenantAccess configuration: they forward the queries of the pods of
+	// every tenant. Must be set before Start().
+	TrustedForwarders []*net.IPNet
+
+	// NodeRecords serves the internal IPs of the nodes, e.g. at
+	// my-node.node.cluster.local. Must be set before Start().
+	NodeRecords bool
+
+	// DisableWildcards answers the queries with a "*" label, e.g.
+	// *.my-ns.svc.cluster.local, with NXDOMAIN rather than every matching
+	// record, so that services cannot be enumerated.
+	DisableWildcards bool
+
+	// WildcardQueryTimeout, if positive, bounds the time the wildcards of a
+	// query are expanded for. The queries timing out are answered as
+	// WildcardTimeoutAction says, truncated if empty.
+	WildcardQueryTimeout  time.Duration
+	WildcardTimeoutAction WildcardTimeoutAction
+
+	// NegativeCacheTTL, if positive, is how long the names found to have
+	// no record in the cache are answered NXDOMAIN without walking it
+	// again, for NegativeCacheSize names at most. The names are forgotten
+	// whenever the records or the configuration change. Must be set
+	// before Start().
+	NegativeCacheTTL  time.Duration
+	NegativeCacheSize int
+
+	// CustomRecordStore, if set, holds custom records served along with
+	// those of the configuration. It is started by Start(). Must be set
+	// before Start().
+	CustomRecordStore customrecords.Store
+
+	// ACMEChallengeZone, if set, e.g. "acme", is the subdomain of the
+	// cluster domain where the TXT records of ACME DNS-01 challenges are
+	// published, see SetACMEChallenge. Other records are not served
+	// there. Must be set before Start().
+	ACMEChallengeZone string
+	// ACMEChallengeStore, if set, shares the challenges with the other
+	// replicas. It is started by Start(). Must be set before Start().
+	ACMEChallengeStore *ACMEChallengeStore
+
+	// UnknownProtocols selects the SRV records of the ports whose protocol
+	// is not TCP, UDP or SCTP, none if empty. Must be set before Start().
+	UnknownProtocols UnknownProtocolPolicy
+
+	// RecordLeases enables the leases publishing custom records for as
+	// long as they are renewed, see SetRecordLease. Must be set before
+	// Start().
+	RecordLeases bool
+	// RecordLeaseStore, if set, shares the record leases with the other
+	// replicas. It is started by Start(). Must be set before Start().
+	RecordLeaseStore *RecordLeaseStore
 }
 
 func NewKubeDNS(client clientset.Interface, clusterDomain string, timeout time.Duration, configSync config.Sync) *KubeDNS {
 	kd := &KubeDNS{
-		kubeClient:          client,
-		domain:              clusterDomain,
-		cache:               treecache.NewTreeCache(),
-		cacheLock:           sync.RWMutex{},
-		nodesStore:          kcache.NewStore(kcache.MetaNamespaceKeyFunc),
-		reverseRecordMap:    make(map[string]*skymsg.Service),
-		clusterIPServiceMap: make(map[string]*v1.Service),
-		domainPath:          util.ReverseArray(strings.Split(strings.TrimRight(clusterDomain, "."), ".")),
-		initialSyncTimeout:  timeout,
+		kubeClient:           client,
+		informerFactory:      informers.NewSharedInformerFactory(client, resyncPeriod),
+		events:               newEventEmitter(client),
+		domain:               clusterDomain,
+		cache:                treecache.NewTreeCache(),
+		cacheLock:            sync.RWMutex{},
+		nodesStore:           kcache.NewStore(kcache.MetaNamespaceKeyFunc),
+		ipShards:             newIPShards(),
+		recordCounts:         make(map[string]int),
+		recordOwners:         make(map[string]recordOwner),
+		serviceAliases:       make(map[string][]string),
+		aliasOwners:          make(map[string]string),
+		terminatingEndpoints: make(map[string]map[string]sliceConditions),
+		topology:             newEndpointTopology(),
+		domainPath:           util.ReverseArray(strings.Split(strings.TrimRight(clusterDomain, "."), ".")),
+		initialSyncTimeout:   timeout,
 
 		configLock: sync.RWMutex{},
 		configSync: configSync,
@@ -182,22 +528,155 @@ func (kd *KubeDNS) updateConfig(nextConfig *config.Config) {
 			kd.SkyDNSConfig.Nameservers = nameServers
 		}
 	}
+	if err := features.ApplyConfig(nextConfig.FeatureGates); err != nil {
+		klog.Errorf("Invalid feature gates %v: %v", nextConfig.FeatureGates, err)
+	} else {
+		klog.V(2).Infof("Feature gates: %v", features.String())
+	}
+	kd.setFallthroughZones(nextConfig.FallthroughZones)
+	kd.setPeerClusters(nextConfig.PeerClusters)
+	kd.setNamespaceDomains(nextConfig.NamespaceDomains)
+	kd.setCustomRecords(nextConfig.CustomRecords)
+	kd.setRewriteRules(nextConfig.RewriteRules)
 	kd.config = nextConfig
+	kd.negativeCache().reset()
+	kd.nextGeneration()
 	klog.V(2).Infof("Configuration updated: %+v", *kd.config)
 }
 
+// Config returns the configuration from the dynamic configuration source
+// in effect, nil before the first sync.
+func (kd *KubeDNS) Config() *config.Config {
+	kd.configLock.RLock()
+	defer kd.configLock.RUnlock()
+	return kd.config
+}
+
 func (kd *KubeDNS) Start() {
-	klog.V(2).Infof("Starting endpointsController")
-	go kd.endpointsController.Run(wait.NeverStop)
+	registerGenerationMetric()
+
+	if kd.CacheInvalidation != nil {
+		kd.startCacheInvalidation(wait.NeverStop)
+	}
+
+	if kd.EventWorkers > 0 {
+		kd.queue = newEventQueue(kd.EventCoalescePeriod)
+		go kd.runEventWorkers(kd.EventWorkers, wait.NeverStop)
+	}
+
+	if kd.EndpointsDebounce > 0 {
+		kd.debouncer = newEndpointsDebouncer(kd.EndpointsDebounce)
+	}
+
+	if kd.RecordsSnapshotFile != "" {
+		if err := kd.loadRecordsSnapshot(); err != nil {
+			klog.Errorf("Failed to load the records snapshot: %v", err)
+		}
+	}
 
-	klog.V(2).Infof("Starting serviceController")
-	go kd.serviceController.Run(wait.NeverStop)
+	if kd.WarmStandbyPeer != "" {
+		if err := kd.bootstrapFromPeer(); err != nil {
+			klog.Errorf("Failed to receive the records from %v, waiting for the initial sync: %v", kd.WarmStandbyPeer, err)
+		}
+	}
+
+	kd.startInformers(wait.NeverStop)
+
+	if kd.PodIndex != nil {
+		klog.V(2).Infof("Starting pod index")
+		go kd.PodIndex.Run(wait.NeverStop)
+	}
+
+	if kd.MultiClusterDomain != "" {
+		kd.setServiceImportsStore()
+		klog.V(2).Infof("Starting serviceImportController")
+		go kd.serviceImportController.Run(wait.NeverStop)
+	}
 
 	kd.startConfigMapSync()
 
+	if kd.CustomRecordStore != nil {
+		klog.V(2).Infof("Starting custom record store")
+		go kd.CustomRecordStore.Run(wait.NeverStop, kd.setCustomRecordSet)
+	}
+
+	if kd.ACMEChallengeStore != nil {
+		klog.V(2).Infof("Starting ACME challenge store")
+		go kd.ACMEChallengeStore.Run(wait.NeverStop, kd.setACMEChallenges)
+	}
+
+	if kd.RecordLeaseStore != nil {
+		klog.V(2).Infof("Starting record lease store")
+		go kd.RecordLeaseStore.Run(wait.NeverStop, kd.setSharedRecordLease, kd.removeSharedRecordLease)
+	}
+
 	// Wait synchronously for the initial list operations to be
 	// complete of endpoints and services from APIServer.
 	kd.waitForResourceSyncedOrDie()
+	if kd.CustomRecordStore != nil {
+		kd.customRecordStoreHasSynced()
+	}
+	if kd.ACMEChallengeStore != nil {
+		kcache.WaitForCacheSync(wait.NeverStop, kd.ACMEChallengeStore.HasSynced)
+	}
+	if kd.RecordLeaseStore != nil {
+		kcache.WaitForCacheSync(wait.NeverStop, kd.RecordLeaseStore.HasSynced)
+	}
+	kd.syncPending.Store([]string(nil))
+	if kd.WarmStandby() {
+		kd.leaveWarmStandby()
+	}
+	if kd.RecordsSnapshotFile != "" {
+		kd.dropRecordsSnapshot()
+		if kd.RecordsSnapshotInterval > 0 {
+			go kd.runRecordsSnapshot(wait.NeverStop)
+		}
+	}
+
+	if kd.CanaryInterval > 0 {
+		go kd.runCanary(wait.NeverStop)
+	}
+	if kd.ResyncPeriod > 0 {
+		go kd.runResync(wait.NeverStop)
+	}
+	if kd.JanitorInterval > 0 {
+		go kd.runJanitor(wait.NeverStop)
+	}
+	if kd.CacheMemoryInterval > 0 {
+		go kd.runCacheMemoryAccounting(wait.NeverStop)
+	}
+	if kd.InventoryInterval > 0 {
+		go kd.runInventory(wait.NeverStop)
+	}
+	if kd.ACMEChallengeZone != "" {
+		go kd.runACMEExpiry(wait.NeverStop)
+	}
+	if kd.RecordLeases {
+		go kd.runRecordLeaseExpiry(wait.NeverStop)
+	}
+	if kd.PeerClusters != nil {
+		go kd.PeerClusters.Run(wait.NeverStop)
+	}
+}
+
+// startInformers registers the handlers of the informers of the factory and
+// starts them. Every informer must be created before the factory starts.
+func (kd *KubeDNS) startInformers(stopCh <-chan struct{}) {
+	kd.servicesHandled, kd.endpointsHandled = newHandledKeys(), newHandledKeys()
+	kd.informerFactory.Core().V1().Services().Informer().AddEventHandlerWithResyncPeriod(kd.servicesHandled.wrap(kd.serviceHandlers()), kd.ResyncPeriod)
+	kd.informerFactory.Core().V1().Endpoints().Informer().AddEventHandlerWithResyncPeriod(kd.endpointsHandled.wrap(kd.endpointsHandlers()), kd.ResyncPeriod)
+	if features.Enabled(features.EndpointSlices) &&
+		(kd.DropTerminatingEndpoints || kd.ServingTerminatingEndpoints || kd.TopologyAwareAnswers || kd.MultiClusterDomain != "") {
+		kd.setEndpointSlicesStore()
+	}
+	if kd.NodeRecords {
+		kd.setNodeRecordsStore()
+	}
+	if kd.TenantZones {
+		kd.setNamespacesStore()
+	}
+	klog.V(2).Infof("Starting informers")
+	kd.informerFactory.Start(stopCh)
 }
 
 func (kd *KubeDNS) waitForResourceSyncedOrDie() {
@@ -210,14 +689,9 @@ func (kd *KubeDNS) waitForResourceSyncedOrDie() {
 		case <-timeout:
 			klog.Fatalf("Timeout waiting for initialization")
 		case <-ticker.C:
-			unsyncedResources := []string{}
-			if !kd.endpointsController.HasSynced() {
-				unsyncedResources = append(unsyncedResources, "endpoints")
-			}
-			if !kd.serviceController.HasSynced() {
-				unsyncedResources = append(unsyncedResources, "services")
-			}
+			unsyncedResources := kd.unsyncedResources()
 			if len(unsyncedResources) > 0 {
+				kd.syncPending.Store(unsyncedResources)
 				klog.V(0).Infof("Waiting for %v to be initialized from apiserver...", unsyncedResources)
 				continue
 			}
@@ -227,12 +701,55 @@ func (kd *KubeDNS) waitForResourceSyncedOrDie() {
 	}
 }
 
+// unsyncedResources returns the resources whose initial sync is not
+// complete: the ones not listed yet, and the services and endpoints listed
+// whose records were not generated yet.
+func (kd *KubeDNS) unsyncedResources() []string {
+	unsyncedResources := []string{}
+	if !kd.endpointsController.HasSynced() {
+		unsyncedResources = append(unsyncedResources, "endpoints")
+	} else if kd.endpointsHandled != nil && !kd.endpointsHandled.covers(kd.endpointsStore) {
+		unsyncedResources = append(unsyncedResources, "endpoints records")
+	}
+	if !kd.serviceController.HasSynced() {
+		unsyncedResources = append(unsyncedResources, "services")
+	} else if kd.servicesHandled != nil && !kd.servicesHandled.covers(kd.servicesStore) {
+		unsyncedResources = append(unsyncedResources, "services records")
+	}
+	if kd.endpointSliceController != nil && !kd.endpointSliceController.HasSynced() {
+		unsyncedResources = append(unsyncedResources, "endpointslices")
+	}
+	if kd.PodIndex != nil && !kd.PodIndex.HasSynced() {
+		unsyncedResources = append(unsyncedResources, "pods")
+	}
+	if kd.serviceImportController != nil && !kd.serviceImportController.HasSynced() {
+		unsyncedResources = append(unsyncedResources, "serviceimports")
+	}
+	if kd.namespaceController != nil && !kd.namespaceController.HasSynced() {
+		unsyncedResources = append(unsyncedResources, "namespaces")
+	}
+	if kd.nodeController != nil && !kd.nodeController.HasSynced() {
+		unsyncedResources = append(unsyncedResources, "nodes")
+	}
+	if kd.CustomRecordStore != nil && !kd.CustomRecordStore.HasSynced() {
+		unsyncedResources = append(unsyncedResources, "customrecords")
+	}
+	// The queue must only be checked once every event of the
+	// initial sync is in it.
+	if len(unsyncedResources) == 0 && kd.queue != nil && !kd.queue.hasDrained() {
+		unsyncedResources = append(unsyncedResources, "events")
+	}
+	return unsyncedResources
+}
+
 func (kd *KubeDNS) startConfigMapSync() {
 	initialConfig, err := kd.configSync.Once()
 	if err != nil {
 		klog.Errorf(
 			"Error getting initial ConfigMap: %v, starting with default values", err)
+		kd.configLock.Lock()
 		kd.config = config.NewDefaultConfig()
+		kd.configLock.Unlock()
 	} else {
 		kd.updateConfig(initialConfig)
 	}
@@ -249,47 +766,23 @@ func (kd *KubeDNS) syncConfigMap(syncChan <-chan *config.Config) {
 }
 
 func (kd *KubeDNS) GetCacheAsJSON() (string, error) {
-	kd.cacheLock.RLock()
-	defer kd.cacheLock.RUnlock()
-	json, err := kd.cache.Serialize()
+	json, err := kd.cacheView().Serialize()
 	return json, err
 }
 
+// DumpCache writes the last snapshot of the cache published to w in format.
+func (kd *KubeDNS) DumpCache(w io.Writer, format treecache.Format) error {
+	return treecache.Dump(w, kd.cacheView(), format)
+}
+
 func (kd *KubeDNS) setServicesStore() {
-	// Returns a cache.ListWatch that gets all changes to services.
-	kd.servicesStore, kd.serviceController = kcache.NewInformer(
-		kcache.NewListWatchFromClient(
-			kd.kubeClient.CoreV1().RESTClient(),
-			"services",
-			v1.NamespaceAll,
-			fields.Everything()),
-		&v1.Service{},
-		resyncPeriod,
-		kcache.ResourceEventHandlerFuncs{
-			AddFunc:    kd.newService,
-			DeleteFunc: kd.removeService,
-			UpdateFunc: kd.updateService,
-		},
-	)
+	informer := kd.informerFactory.Core().V1().Services().Informer()
+	kd.servicesStore, kd.serviceController = informer.GetStore(), informer
 }
 
 func (kd *KubeDNS) setEndpointsStore() {
-	// Returns a cache.ListWatch that gets all changes to endpoints.
-	kd.endpointsStore, kd.endpointsController = kcache.NewInformer(
-		kcache.NewListWatchFromClient(
-			kd.kubeClient.CoreV1().RESTClient(),
-			"endpoints",
-			v1.NamespaceAll,
-			fields.Everything()),
-		&v1.Endpoints{},
-		resyncPeriod,
-		kcache.ResourceEventHandlerFuncs{
-			AddFunc:    kd.handleEndpointAdd,
-			UpdateFunc: kd.handleEndpointUpdate,
-			// If Service is named headless need to remove the reverse dns entries.
-			DeleteFunc: kd.handleEndpointDelete,
-		},
-	)
+	informer := kd.informerFactory.Core().V1().Endpoints().Informer()
+	kd.endpointsStore, kd.endpointsController = informer.GetStore(), informer
 }
 
 func assertIsService(obj interface{}) (*v1.Service, bool) {
@@ -305,7 +798,13 @@ func (kd *KubeDNS) newService(obj interface{}) {
 	if service, ok := assertIsService(obj); ok {
 		klog.V(3).Infof("New service: %v", service.Name)
 		klog.V(4).Infof("Service details: %v", service)
+		kd.Guardrails.cancelHeldDelete(service)
+		kd.updateServiceImportsOfDerivedService(service)
 
+		if isExcluded(service) {
+			kd.excludeService(service)
+			return
+		}
 		// ExternalName services are a special kind that return CNAME records
 		if service.Spec.Type == v1.ServiceTypeExternalName {
 			kd.newExternalNameService(service)
@@ -328,24 +827,52 @@ func (kd *KubeDNS) newService(obj interface{}) {
 
 func (kd *KubeDNS) removeService(obj interface{}) {
 	if s, ok := assertIsService(obj); ok {
-		subCachePath := append(kd.domainPath, serviceSubdomain, s.Namespace, s.Name)
-		kd.cacheLock.Lock()
-		defer kd.cacheLock.Unlock()
-
-		success := kd.cache.DeletePath(subCachePath...)
-		klog.V(3).Infof("removeService %v at path %v. Success: %v",
-			s.Name, subCachePath, success)
-
-		// ExternalName services have no IP
-		if util.IsServiceIPSet(s) {
-			for _, ip := range util.GetClusterIPs(s) {
-				delete(kd.reverseRecordMap, ip)
-				delete(kd.clusterIPServiceMap, ip)
-			}
+		kd.updateServiceImportsOfDerivedService(s)
+		kd.cacheLock.RLock()
+		records := kd.getRecordCount(s)
+		kd.cacheLock.RUnlock()
+		if !kd.Guardrails.allowDelete(s, records) {
+			return
 		}
+		kd.deleteService(s)
 	}
 }
 
+// deleteService removes all records for the given service.
+func (kd *KubeDNS) deleteService(s *v1.Service) {
+	kd.deleteServiceUnless(s, nil)
+}
+
+// deleteServiceUnless removes the records of s unless keep, if set, returns
+// true, called with the cacheLock held so that the records it checks do not
+// change until they are removed. It returns whether they were removed.
+func (kd *KubeDNS) deleteServiceUnless(s *v1.Service, keep func() bool) bool {
+	kd.cacheLock.Lock()
+	defer kd.unlockCache()
+	if keep != nil && keep() {
+		return false
+	}
+
+	subCachePath := append(kd.domainPath, serviceSubdomain, s.Namespace, s.Name)
+	// ExternalName services have no IP
+	if util.IsServiceIPSet(s) {
+		for _, ip := range util.GetClusterIPs(s) {
+			kd.ipShards.deleteService(ip, s)
+		}
+	}
+
+	kd.forgetHeadlessRecords(s)
+
+	success := kd.cache.DeletePath(subCachePath...)
+	klog.V(3).Infof("removeService %v at path %v. Success: %v",
+		s.Name, subCachePath, success)
+	kd.deleteRecordSet(auditKindService, auditKindService, s)
+	kd.deleteRecordSet(auditKindEndpoints, auditKindService, s)
+	kd.setRecordCount(s, 0)
+	kd.updateAliases(s, nil)
+	return true
+}
+
 func (kd *KubeDNS) updateService(oldObj, newObj interface{}) {
 	if new, ok := assertIsService(newObj); ok {
 		if old, ok := assertIsService(oldObj); ok {
@@ -353,13 +880,43 @@ func (kd *KubeDNS) updateService(oldObj, newObj interface{}) {
 			// In all other cases, we'll update records in place.
 			if (new.Spec.Type == v1.ServiceTypeExternalName) !=
 				(old.Spec.Type == v1.ServiceTypeExternalName) {
-				kd.removeService(oldObj)
+				// The queries see the records of either type, never
+				// the service without records in between.
+				kd.batchCache(func() {
+					kd.deleteService(old)
+					kd.newService(newObj)
+				})
+				return
 			}
+			kd.removeStaleReverseRecords(old, new)
 			kd.newService(newObj)
 		}
 	}
 }
 
+// removeStaleReverseRecords removes the reverse records of the ClusterIPs of
+// old that new no longer has, e.g. when the IPv6 family is removed from a
+// dual-stack service. The ClusterIPs that are kept are updated in place by
+// newPortalService.
+func (kd *KubeDNS) removeStaleReverseRecords(old, new *v1.Service) {
+	if !util.IsServiceIPSet(old) {
+		return
+	}
+	ips := sets.NewString()
+	if util.IsServiceIPSet(new) {
+		ips.Insert(util.GetClusterIPs(new)...)
+	}
+	for _, ip := range util.GetClusterIPs(old) {
+		if ips.Has(ip) {
+			continue
+		}
+		// The IP may already have been reallocated to another service.
+		if kd.ipShards.deleteService(ip, old) {
+			klog.V(3).Infof("Removed reverse record of %q, no longer a ClusterIP of %s/%s", ip, old.Namespace, old.Name)
+		}
+	}
+}
+
 func (kd *KubeDNS) handleEndpointAdd(obj interface{}) {
 	if e, ok := obj.(*v1.Endpoints); ok {
 		if err := kd.addDNSUsingEndpoints(e); err != nil {
@@ -390,40 +947,32 @@ func (kd *KubeDNS) handleEndpointUpdate(oldObj, newObj interface{}) {
 	if svc != nil && err == nil {
 		if !util.IsServiceIPSet(svc) {
 			for idx := range oldEndpoints.Subsets {
-				for subIdx := range oldEndpoints.Subsets[idx].Addresses {
-					address := &oldEndpoints.Subsets[idx].Addresses[subIdx]
-					endpointIP := address.IP
-					if _, has := getHostname(address); has {
-						oldAddressMap[endpointIP] = true
+				addresses, _ := kd.publishedAddresses(svc, &oldEndpoints.Subsets[idx])
+				for _, address := range addresses {
+					if kd.hasReverseRecord(address.Hostname) {
+						oldAddressMap[address.IP] = true
 					}
 				}
 			}
 
 			for idx := range newEndpoints.Subsets {
-				for subIdx := range newEndpoints.Subsets[idx].Addresses {
-					address := newEndpoints.Subsets[idx].Addresses[subIdx]
-					endpointIP := address.IP
-					if _, ok := oldAddressMap[endpointIP]; ok {
-						address := &newEndpoints.Subsets[idx].Addresses[subIdx]
-						// Entries are both in old and new endpoint. Remove from the `oldAddressMap`
-						// if the address is still named to the service.
-						if _, has := getHostname(address); has {
-							// The service is still named in the Pod
-							delete(oldAddressMap, endpointIP)
-						}
+				addresses, _ := kd.publishedAddresses(svc, &newEndpoints.Subsets[idx])
+				for _, address := range addresses {
+					// Entries are both in old and new endpoint. Remove from the `oldAddressMap`
+					// if the address still has a reverse record.
+					if oldAddressMap[address.IP] && kd.hasReverseRecord(address.Hostname) {
+						delete(oldAddressMap, address.IP)
 					}
 				}
 			}
 
 			// Remove all old PTR records for the endpoints that are not
 			// in new endpoints, or
-			// the addresses that are no longer named.
-			kd.cacheLock.Lock()
+			// the addresses that no longer have one.
 			for k := range oldAddressMap {
 				klog.V(4).Infof("Removing old endpoint IP %q", k)
-				delete(kd.reverseRecordMap, k)
+				kd.ipShards.deleteReverseRecord(k, svc)
 			}
-			kd.cacheLock.Unlock()
 		}
 	}
 
@@ -443,22 +992,47 @@ func (kd *KubeDNS) handleEndpointDelete(obj interface{}) {
 		klog.Errorf("Error from getServiceFromEndpoints(%v): %v", endpoints.Name, err)
 		return
 	}
-	if svc != nil {
-		if !util.IsServiceIPSet(svc) {
-			kd.cacheLock.Lock()
-			defer kd.cacheLock.Unlock()
-			// When endpoints for Named headless services deleted, delete old reverse dns records.
-			for idx := range endpoints.Subsets {
-				for subIdx := range endpoints.Subsets[idx].Addresses {
-					address := &endpoints.Subsets[idx].Addresses[subIdx]
-					endpointIP := address.IP
-					if _, has := getHostname(address); has {
-						delete(kd.reverseRecordMap, endpointIP)
-					}
-				}
+	if svc == nil || util.IsServiceIPSet(svc) {
+		return
+	}
+	records := 0
+	if !isExcluded(svc) && svc.Spec.Type != v1.ServiceTypeExternalName {
+		kd.cacheLock.RLock()
+		records = kd.getRecordCount(svc)
+		kd.cacheLock.RUnlock()
+	}
+	if !kd.Guardrails.allowEndpointsDelete(endpoints, svc, records) {
+		return
+	}
+	kd.deleteEndpointsRecords(endpoints, svc)
+}
+
+// deleteEndpointsRecords removes the records of the deleted endpoints of
+// the headless service svc.
+func (kd *KubeDNS) deleteEndpointsRecords(endpoints *v1.Endpoints, svc *v1.Service) {
+	// When endpoints for headless services deleted, delete old reverse dns records.
+	for idx := range endpoints.Subsets {
+		addresses, _ := kd.publishedAddresses(svc, &endpoints.Subsets[idx])
+		for _, address := range addresses {
+			if kd.hasReverseRecord(address.Hostname) {
+				kd.ipShards.deleteReverseRecord(address.IP, svc)
 			}
 		}
 	}
+	kd.cacheLock.Lock()
+	kd.deleteReverseRecordSet(auditKindEndpoints, endpoints)
+	kd.unlockCache()
+
+	if isExcluded(svc) || svc.Spec.Type == v1.ServiceTypeExternalName {
+		return
+	}
+	// The records of a headless service come from its endpoints
+	// alone, e.g. the user-managed endpoints of a service without
+	// selector: remove them as well, as a restart would.
+	empty := &v1.Endpoints{ObjectMeta: endpoints.ObjectMeta}
+	if err := kd.generateRecordsForHeadlessService(empty, svc); err != nil {
+		klog.Errorf("Could not remove the records of headless service %v: %v", svc.Name, err)
+	}
 }
 
 func (kd *KubeDNS) addDNSUsingEndpoints(e *v1.Endpoints) error {
@@ -470,6 +1044,10 @@ func (kd *KubeDNS) addDNSUsingEndpoints(e *v1.Endpoints) error {
 		// No headless service found corresponding to endpoints object.
 		return nil
 	}
+	if isExcluded(svc) {
+		return nil
+	}
+	kd.Guardrails.cancelHeldEndpointsDelete(svc)
 	return kd.generateRecordsForHeadlessService(e, svc)
 }
 
@@ -501,27 +1079,33 @@ func (kd *KubeDNS) fqdn(service *v1.Service, subpaths ...string) string {
 }
 
 func (kd *KubeDNS) newPortalService(service *v1.Service) {
+	kd.forgetHeadlessRecords(service)
 	subCache := treecache.NewTreeCache()
 	clusterIPs := util.GetClusterIPs(service)
+	auditRecords := kd.newRecordSet()
+	recordCount := 0
 
 	for _, ip := range clusterIPs {
 		recordValue, recordLabel := util.GetSkyMsg(ip, 0)
 		subCache.SetEntry(recordLabel, recordValue, kd.fqdn(service, recordLabel))
+		auditRecords.add(kd.fqdn(service, recordLabel), recordValue)
+		recordCount++
 
 		// Generate SRV Records
 		for i := range service.Spec.Ports {
 			port := &service.Spec.Ports[i]
 
-			if port.Name == "" || port.Protocol == "" {
+			l, ok := kd.srvLabels(service, port.Name, port.Protocol)
+			if !ok {
 				continue
 			}
 
-			srvValue := kd.generateSRVRecordValue(service, int(port.Port))
-
-			l := []string{"_" + strings.ToLower(string(port.Protocol)), "_" + port.Name}
+			srvValue := kd.generateSRVRecordValue(service, port.Name, int(port.Port))
 			klog.V(3).Infof("Added SRV record %+v", srvValue)
 
 			subCache.SetEntry(recordLabel, srvValue, kd.fqdn(service, append(l, recordLabel)...), l...)
+			auditRecords.add(kd.fqdn(service, append(l, recordLabel)...), srvValue)
+			recordCount++
 		}
 	}
 
@@ -529,71 +1113,211 @@ func (kd *KubeDNS) newPortalService(service *v1.Service) {
 	host := getServiceFQDN(kd.domain, service)
 	reverseRecord, _ := util.GetSkyMsg(host, 0)
 
-	kd.cacheLock.Lock()
-	defer kd.cacheLock.Unlock()
-	kd.cache.SetSubCache(service.Name, subCache, subCachePath...)
-
 	for _, ip := range clusterIPs {
-		kd.reverseRecordMap[ip] = reverseRecord
-		kd.clusterIPServiceMap[ip] = service
+		kd.ipShards.setService(ip, service, reverseRecord)
+		auditRecords.addReverse(ip, reverseRecord)
 	}
+
+	kd.cacheLock.Lock()
+	defer kd.unlockCache()
+	kd.cache.SetSubCache(service.Name, subCache, subCachePath...)
+	kd.updateAliases(service, func(alias string) {
+		kd.cache.SetSubCache(alias, subCache, subCachePath...)
+	})
+	kd.updateRecordSet(auditKindService, service, auditRecords)
+	kd.setRecordCount(service, recordCount)
 }
 
 func (kd *KubeDNS) generateRecordsForHeadlessService(e *v1.Endpoints, svc *v1.Service) error {
-	subCache := treecache.NewTreeCache()
 	klog.V(4).Infof("Endpoints Annotations: %v", e.Annotations)
+	records := map[string]headlessRecord{}
 	generatedRecords := map[string]*skymsg.Service{}
-	for idx := range e.Subsets {
-		for subIdx := range e.Subsets[idx].Addresses {
-			address := &e.Subsets[idx].Addresses[subIdx]
+	auditRecords := kd.newRecordSet()
+	addRecord := func(fqdn string, record headlessRecord) {
+		// The addresses listed in several subsets have a single name,
+		// their records are only added once.
+		if _, ok := records[fqdn]; !ok {
+			records[fqdn] = record
+			auditRecords.add(fqdn, record.value)
+		}
+	}
+	subsets, droppedIPs, hostnames := kd.headlessAddresses(e, svc)
+	for idx, addresses := range subsets {
+		for _, address := range addresses {
 			endpointIP := address.IP
-			recordValue, endpointName := util.GetSkyMsg(endpointIP, 0)
-			if hostLabel, exists := getHostname(address); exists {
-				endpointName = hostLabel
+			recordValue, endpointName := kd.endpointRecord(endpointIP)
+			hostname := hostnames[endpointIP]
+			if hostname != "" {
+				endpointName = hostname
 			}
-			subCache.SetEntry(endpointName, recordValue, kd.fqdn(svc, endpointName))
-			for portIdx := range e.Subsets[idx].Ports {
-				endpointPort := &e.Subsets[idx].Ports[portIdx]
-				if endpointPort.Name != "" && endpointPort.Protocol != "" {
-					srvValue := kd.generateSRVRecordValue(svc, int(endpointPort.Port), endpointName)
+			addRecord(kd.fqdn(svc, endpointName), headlessRecord{name: endpointName, value: recordValue})
+			ports := e.Subsets[idx].Ports
+			if kd.LazySRV {
+				// The SRV records are generated when queried, see
+				// lazySRVZone.
+				ports = nil
+			}
+			for portIdx := range ports {
+				endpointPort := &ports[portIdx]
+				if l, ok := kd.srvLabels(svc, endpointPort.Name, endpointPort.Protocol); ok {
+					srvValue := kd.generateSRVRecordValue(svc, endpointPort.Name, int(endpointPort.Port), endpointName)
 					klog.V(3).Infof("Added SRV record %+v", srvValue)
 
-					l := []string{"_" + strings.ToLower(string(endpointPort.Protocol)), "_" + endpointPort.Name}
-					subCache.SetEntry(endpointName, srvValue, kd.fqdn(svc, append(l, endpointName)...), l...)
+					addRecord(kd.fqdn(svc, append(l, endpointName)...), headlessRecord{name: endpointName, path: l, value: srvValue})
 				}
 			}
 
-			// Generate PTR records only for Named Headless service.
-			if _, has := getHostname(address); has {
-				reverseRecord, _ := util.GetSkyMsg(kd.fqdn(svc, endpointName), 0)
+			if kd.hasReverseRecord(hostname) {
+				reverseRecord, _ := util.GetSkyMsg(kd.headlessReverseTarget(svc, hostname, endpointName), 0)
 				generatedRecords[endpointIP] = reverseRecord
+			} else if address.Hostname != "" {
+				// The hostname went to another address.
+				droppedIPs = append(droppedIPs, endpointIP)
 			}
 		}
 	}
-	subCachePath := append(kd.domainPath, serviceSubdomain, svc.Namespace)
-	kd.cacheLock.Lock()
-	defer kd.cacheLock.Unlock()
+	recordCount := len(records)
+	for _, endpointIP := range droppedIPs {
+		kd.ipShards.deleteReverseRecord(endpointIP, svc)
+	}
 	for endpointIP, reverseRecord := range generatedRecords {
 		klog.V(4).Infof("Adding endpointIP %q to reverseRecord %+v", endpointIP, reverseRecord)
-		kd.reverseRecordMap[endpointIP] = reverseRecord
+		kd.ipShards.setReverseRecord(endpointIP, svc, reverseRecord)
+		auditRecords.addReverse(endpointIP, reverseRecord)
 	}
+
+	published := kd.headlessRecordsOf(svc)
+	published.lock.Lock()
+	defer published.lock.Unlock()
+	subCache := published.update(records)
+
+	subCachePath := append(kd.domainPath, serviceSubdomain, svc.Namespace)
+	kd.cacheLock.Lock()
+	defer kd.unlockCache()
 	kd.cache.SetSubCache(svc.Name, subCache, subCachePath...)
+	kd.updateAliases(svc, func(alias string) {
+		kd.cache.SetSubCache(alias, subCache, subCachePath...)
+	})
+	kd.updateRecordSet(auditKindEndpoints, e, auditRecords)
+	kd.setRecordCount(svc, recordCount)
 	return nil
 }
 
-func getHostname(address *v1.EndpointAddress) (string, bool) {
-	if len(address.Hostname) > 0 {
-		return address.Hostname, true
+// headlessAddresses returns the addresses of each subset of e that get
+// records, the addresses that may have had records before, and the
+// hostnames of the addresses, see endpointHostnames.
+func (kd *KubeDNS) headlessAddresses(e *v1.Endpoints, svc *v1.Service) ([][]*v1.EndpointAddress, []string, map[string]string) {
+	var droppedIPs []string
+	subsets := make([][]*v1.EndpointAddress, len(e.Subsets))
+	var named []endpointAddress
+	for idx := range e.Subsets {
+		addresses, unpublished := kd.publishedAddresses(svc, &e.Subsets[idx])
+		if kd.ServingTerminatingEndpoints {
+			droppedIPs = append(droppedIPs, unpublished...)
+		}
+		for _, address := range addresses {
+			if kd.isTerminating(svc, address.IP) {
+				klog.V(4).Infof("Skipping terminating endpoint %q of %s/%s", address.IP, svc.Namespace, svc.Name)
+				droppedIPs = append(droppedIPs, address.IP)
+				continue
+			}
+			subsets[idx] = append(subsets[idx], address)
+			named = append(named, endpointAddress{ip: address.IP, hostname: address.Hostname})
+		}
 	}
-	return "", false
+	return subsets, droppedIPs, endpointHostnames(named)
+}
+
+// HeadlessReverseRecords selects the endpoints of headless services that
+// get PTR records.
+type HeadlessReverseRecords string
+
+const (
+	// HeadlessReverseRecordsNamed only generates PTR records for the
+	// endpoints that have a hostname. This is the default.
+	HeadlessReverseRecordsNamed HeadlessReverseRecords = "named"
+	// HeadlessReverseRecordsService also generates PTR records for the
+	// endpoints without hostname, pointing at the service name.
+	HeadlessReverseRecordsService HeadlessReverseRecords = "service"
+	// HeadlessReverseRecordsEndpoint also generates PTR records for the
+	// endpoints without hostname, pointing at the generated name of their
+	// A record, e.g. 3f6d5b1a.my-svc.my-ns.svc.cluster.local.
+	HeadlessReverseRecordsEndpoint HeadlessReverseRecords = "endpoint"
+)
+
+// ParseHeadlessReverseRecords validates the value of a
+// HeadlessReverseRecords flag.
+func ParseHeadlessReverseRecords(value string) (HeadlessReverseRecords, error) {
+	switch mode := HeadlessReverseRecords(value); mode {
+	case "", HeadlessReverseRecordsNamed:
+		return HeadlessReverseRecordsNamed, nil
+	case HeadlessReverseRecordsService, HeadlessReverseRecordsEndpoint:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid headless reverse records %q, must be one of %q, %q or %q", value,
+		HeadlessReverseRecordsNamed, HeadlessReverseRecordsService, HeadlessReverseRecordsEndpoint)
 }
 
-func (kd *KubeDNS) generateSRVRecordValue(svc *v1.Service, portNumber int, labels ...string) *skymsg.Service {
+// hasReverseRecord returns whether the endpoint address of a headless
+// service with the given hostname, if any, gets a PTR record.
+func (kd *KubeDNS) hasReverseRecord(hostname string) bool {
+	if hostname != "" {
+		return true
+	}
+	return kd.HeadlessReverseRecords == HeadlessReverseRecordsService ||
+		kd.HeadlessReverseRecords == HeadlessReverseRecordsEndpoint
+}
+
+// headlessReverseTarget returns the name the PTR record of an endpoint of
+// a headless service points at. endpointName is the label of its A record.
+func (kd *KubeDNS) headlessReverseTarget(svc *v1.Service, hostname, endpointName string) string {
+	if hostname == "" && kd.HeadlessReverseRecords == HeadlessReverseRecordsService {
+		return kd.fqdn(svc)
+	}
+	return kd.fqdn(svc, endpointName)
+}
+
+// EndpointNaming is how the records of the endpoints of headless services
+// without hostname are named, e.g. the targets of their SRV records.
+type EndpointNaming string
+
+const (
+	// EndpointNamingHash names them with a hash of their record, e.g.
+	// 3f6d5b1a.my-svc.my-ns.svc.cluster.local. This is the default.
+	EndpointNamingHash EndpointNaming = "hash"
+	// EndpointNamingIP names them with their IP, its dots or colons
+	// replaced with dashes, e.g. 10-0-0-1.my-svc.my-ns.svc.cluster.local.
+	EndpointNamingIP EndpointNaming = "ip"
+)
+
+// ParseEndpointNaming validates the value of an EndpointNaming flag.
+func ParseEndpointNaming(value string) (EndpointNaming, error) {
+	switch naming := EndpointNaming(value); naming {
+	case "", EndpointNamingHash:
+		return EndpointNamingHash, nil
+	case EndpointNamingIP:
+		return naming, nil
+	}
+	return "", fmt.Errorf("invalid endpoint naming %q, must be %q or %q", value, EndpointNamingHash, EndpointNamingIP)
+}
+
+// endpointRecord returns the A or AAAA record of an endpoint address of a
+// headless service, and its name unless it has a hostname.
+func (kd *KubeDNS) endpointRecord(ip string) (*skymsg.Service, string) {
+	record, name := util.GetSkyMsg(ip, 0)
+	if kd.EndpointNaming == EndpointNamingIP {
+		name = strings.NewReplacer(".", "-", ":", "-").Replace(ip)
+	}
+	return record, name
+}
+
+func (kd *KubeDNS) generateSRVRecordValue(svc *v1.Service, portName string, portNumber int, labels ...string) *skymsg.Service {
 	host := strings.Join([]string{svc.Name, svc.Namespace, serviceSubdomain, kd.domain}, ".")
 	for _, cNameLabel := range labels {
 		host = cNameLabel + "." + host
 	}
 	recordValue, _ := util.GetSkyMsg(host, portNumber)
+	applySRVAnnotations(svc, portName, recordValue)
 	return recordValue
 }
 
@@ -633,65 +1357,115 @@ func (kd *KubeDNS) newExternalNameService(service *v1.Service) {
 	klog.V(3).Infof("newExternalNameService: storing key %s with value %v as %s under %v",
 		service.Name, recordValue, fqdn, cachePath)
 	kd.cacheLock.Lock()
-	defer kd.cacheLock.Unlock()
+	defer kd.unlockCache()
 	// Store the service name directly as the leaf key
 	kd.cache.SetEntry(service.Name, recordValue, fqdn, cachePath...)
+	kd.setRecordCount(service, 1)
+	kd.updateAliases(service, func(alias string) {
+		aliasValue, _ := util.GetSkyMsg(service.Spec.ExternalName, 0)
+		kd.cache.SetEntry(alias, aliasValue, kd.aliasFQDN(service.Namespace, alias), cachePath...)
+	})
+	if auditRecords := kd.newRecordSet(); auditRecords != nil {
+		auditRecords.add(fqdn, recordValue)
+		kd.updateRecordSet(auditKindService, service, auditRecords)
+	}
 }
 
 // HasSynced returns true if the initial sync of services and endpoints
 // from the API server has completed
 func (kd *KubeDNS) HasSynced() bool {
-	return kd.endpointsController.HasSynced() && kd.serviceController.HasSynced()
+	return kd.endpointsController.HasSynced() && kd.serviceController.HasSynced() &&
+		(kd.queue == nil || kd.queue.hasDrained())
 }
 
 // Records responds with DNS records that match the given name, in a format
 // understood by the skydns server. If "exact" is true, a single record
 // matching the given name is returned, otherwise all records stored under
 // the subtree matching the name are returned.
-func (kd *KubeDNS) Records(name string, exact bool) (retval []skymsg.Service, err error) {
-	klog.V(3).Infof("Query for %q, exact: %v", name, exact)
+// Wildcard queries timing out may return part of their records along with
+// server.ErrPartial, and the records answered from the snapshot loaded at
+// startup are returned along with server.ErrStale.
+func (kd *KubeDNS) Records(name string, exact bool) ([]skymsg.Service, error) {
+	records, err := kd.AppendRecords(nil, name, exact)
+	if err != nil && !server.WithRecords(err) {
+		return nil, err
+	}
+	return records, err
+}
 
-	trimmed := strings.TrimRight(name, ".")
-	segments := strings.Split(trimmed, ".")
-	isFederationQuery := false
-	federationSegments := []string{}
+// AppendRecords appends the records Records returns to dst, so that the
+// skydns server answers the queries from the slices it reuses. It is a
+// server.RecordsAppender.
+func (kd *KubeDNS) AppendRecords(dst []skymsg.Service, name string, exact bool) ([]skymsg.Service, error) {
+	name, from, to := kd.clusterDomainName(name)
+	records, err := kd.records(dst, name, exact)
+	if err != nil && !server.WithRecords(err) || to == "" {
+		return records, err
+	}
+	moveRecords(records[len(dst):], from, to)
+	return records, err
+}
 
-	if !exact && kd.isFederationQuery(segments) {
-		klog.V(3).Infof("Received federation query, trying local service first")
-		// Try querying the non-federation (local) service first. Will try
-		// the federation one later, if this fails.
-		isFederationQuery = true
-		federationSegments = append(federationSegments, segments...)
-		// To try local service, remove federation name from segments.
-		// Federation name is 3rd in the segment (after service name and
-		// namespace).
-		segments = append(segments[:2], segments[3:]...)
+// records appends the records of name in the cluster domain to dst, see
+// Records.
+func (kd *KubeDNS) records(dst []skymsg.Service, name string, exact bool) (retval []skymsg.Service, err error) {
+	if klogV := klog.V(3); klogV.Enabled() {
+		klogV.Infof("Query for %q, exact: %v", name, exact)
 	}
 
-	path := util.ReverseArray(segments)
-	records, err := kd.getRecordsForPath(path, exact)
+	labels := labelBuffers.Get().(*labelBuffer)
+	defer labels.release()
+	segments := labels.split(strings.TrimRight(name, "."))
+	if kd.DisableWildcards && containsString(segments, "*") {
+		return dst, fmt.Errorf("wildcard queries are disabled: %w", server.ErrNotFound)
+	}
+	for _, provider := range kd.zoneProviderChain() {
+		if records, ok, err := provider.Records(segments, exact); ok {
+			if err != nil && !server.WithRecords(err) {
+				return dst, err
+			}
+			return append(dst, records...), err
+		}
+	}
 
-	if err != nil {
-		return nil, err
+	path := kd.untenantedPath(util.ReverseArray(segments))
+	// The pods are not in the cache, their records are not remembered.
+	negatives := kd.negativeCache()
+	if kd.isPodRecord(path) {
+		negatives = nil
+	}
+	found, generation := negatives.contains(name, exact)
+	if found {
+		return dst, fmt.Errorf("%q recently found to have no record: %w", name, server.ErrNotFound)
 	}
+	records, err := kd.getRecordsForPath(dst, path, exact)
 
-	if isFederationQuery {
-		return kd.recordsForFederation(records, path, exact, federationSegments)
-	} else if len(records) > 0 {
-		klog.V(4).Infof("Records for %v: %v", name, records)
-		return records, nil
+	if err != nil && !server.WithRecords(err) {
+		if errors.Is(err, server.ErrNotFound) {
+			negatives.add(generation, name, exact)
+		}
+		return dst, err
 	}
 
-	klog.V(3).Infof("No record found for %v", name)
-	return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
+	// Partial records are returned even if none, the client is told to
+	// retry.
+	if len(records) > len(dst) || err != nil {
+		if klogV := klog.V(4); klogV.Enabled() {
+			klogV.Infof("Records for %v: %v", name, records[len(dst):])
+		}
+		return records, err
+	}
+
+	if klogV := klog.V(3); klogV.Enabled() {
+		klogV.Infof("No record found for %v", name)
+	}
+	negatives.add(generation, name, exact)
+	return dst, server.ErrNotFound
 }
 
 func (kd *KubeDNS) recordsForFederation(records []skymsg.Service, path []string, exact bool, federationSegments []string) (retval []skymsg.Service, err error) {
 	// For federation query, verify that the local service has endpoints.
 	validRecord := false
-	// isHeadlessServiceRecord and serviceWithClusterIPHasEndpoints assume
-	// they have cacheLock.
-	kd.cacheLock.RLock()
 	for _, val := range records {
 		// We know that a headless service has endpoints for sure if a
 		// record was returned for it. The record contains endpoint
@@ -711,7 +1485,6 @@ func (kd *KubeDNS) recordsForFederation(records []skymsg.Service, path []string,
 		validRecord = true
 		break
 	}
-	kd.cacheLock.RUnlock()
 
 	if validRecord {
 		// There is a local service with valid endpoints, return its CNAME.
@@ -732,73 +1505,133 @@ func (kd *KubeDNS) recordsForFederation(records []skymsg.Service, path []string,
 	// records in the local store, attempt to send a federation redirect
 	// (CNAME) response.
 	if !exact {
+		if !kd.federationHealthy(federationSegments[2]) {
+			// Do not redirect to a federation that does not resolve. Answer
+			// with the local service if there is one, even without
+			// endpoints, otherwise fail the query.
+			if len(records) > 0 {
+				klog.V(3).Infof("Federation: %q is unhealthy, returning local service", federationSegments[2])
+				return []skymsg.Service{{Host: dns.Fqdn(strings.Join(util.ReverseArray(path), "."))}}, nil
+			}
+			return nil, fmt.Errorf("federation %q is unhealthy: %w", federationSegments[2], server.ErrBackendUnavailable)
+		}
 		klog.V(3).Infof(
 			"Federation: Did not find a local service. Trying federation redirect (CNAME)")
 		return kd.federationRecords(util.ReverseArray(federationSegments))
 	}
 
-	return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
+	return nil, server.ErrNotFound
+}
+
+// federationHealthy returns whether queries may be redirected to the given
+// federation.
+func (kd *KubeDNS) federationHealthy(federation string) bool {
+	if kd.FederationHealth == nil {
+		return true
+	}
+	kd.configLock.RLock()
+	domain, ok := kd.config.Federations[federation]
+	var nameservers []string
+	if kd.SkyDNSConfig != nil {
+		nameservers = append(nameservers, kd.SkyDNSConfig.Nameservers...)
+	}
+	kd.configLock.RUnlock()
+	if !ok {
+		return false
+	}
+	if len(nameservers) == 0 {
+		nameservers = kd.loadDefaultNameserver()
+	}
+	return kd.FederationHealth.healthy(domain, nameservers)
 }
 
-func (kd *KubeDNS) getRecordsForPath(path []string, exact bool) ([]skymsg.Service, error) {
+// getRecordsForPath appends the records at path to dst.
+func (kd *KubeDNS) getRecordsForPath(dst []skymsg.Service, path []string, exact bool) ([]skymsg.Service, error) {
 	if kd.isPodRecord(path) {
 		ip, err := kd.getPodIP(path)
 		if err == nil {
+			if namespace := path[len(kd.domainPath)+1]; !kd.podVerified(namespace, ip) {
+				return dst, fmt.Errorf("no pod with IP %q in namespace %q: %w", ip, namespace, server.ErrNotFound)
+			}
 			skyMsg, _ := util.GetSkyMsg(ip, 0)
-			return []skymsg.Service{*skyMsg}, nil
+			return append(dst, *skyMsg), nil
 		}
-		return nil, err
+		return dst, err
 	}
+	return kd.getCachedRecordsForPath(dst, path, exact)
+}
 
+// getCachedRecordsForPath appends the records of the cache at path to dst.
+func (kd *KubeDNS) getCachedRecordsForPath(dst []skymsg.Service, path []string, exact bool) ([]skymsg.Service, error) {
+	cache, locked := kd.queryCache()
+	if locked {
+		defer kd.cacheLock.RUnlock()
+	}
 	if exact {
 		key := path[len(path)-1]
 		if key == "" {
-			return []skymsg.Service{}, nil
+			return dst, nil
 		}
-		kd.cacheLock.RLock()
-		defer kd.cacheLock.RUnlock()
-		if record, ok := kd.cache.GetEntry(key, path[:len(path)-1]...); ok {
-			klog.V(3).Infof("Exact match %v for %v received from cache", record, path[:len(path)-1])
-			return []skymsg.Service{*(record.(*skymsg.Service))}, nil
+		klogV := klog.V(3)
+		if record, ok := cache.GetEntry(key, path[:len(path)-1]...); ok {
+			if klogV.Enabled() {
+				klogV.Infof("Exact match %v for %v received from cache", record, path[:len(path)-1])
+			}
+			return append(dst, *(record.(*skymsg.Service))), nil
 		}
 
-		klog.V(3).Infof("Exact match for %v not found in cache", path)
-		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
+		if klogV.Enabled() {
+			klogV.Infof("Exact match for %v not found in cache", path)
+		}
+		if stale := kd.staleRecordsForPath(path, exact); stale != nil {
+			return append(dst, stale...), fmt.Errorf("%v answered from the records loaded before the sync: %w", path, server.ErrStale)
+		}
+		if cache.HasPath(path...) {
+			return dst, fmt.Errorf("%v has no record of its own: %w", path, server.ErrNoData)
+		}
+		return dst, server.ErrNotFound
+	}
+
+	// The records are copied into dst, growing it at most once: the
+	// query path avoids garbage.
+	retval, err := kd.appendCachedValues(cache, dst, path)
+	if err != nil && !server.WithRecords(err) {
+		return dst, err
+	}
+	if len(retval) == len(dst) && err == nil {
+		if stale := kd.staleRecordsForPath(path, exact); stale != nil {
+			retval = append(retval, stale...)
+			err = fmt.Errorf("%v answered from the records loaded before the sync: %w", path, server.ErrStale)
+		} else if !containsString(path, "*") && cache.HasPath(path...) {
+			// E.g. a namespace, or a headless service without endpoints:
+			// the name exists, answered with NODATA rather than NXDOMAIN.
+			return dst, fmt.Errorf("%v has no record: %w", path, server.ErrNoData)
+		}
 	}
-
-	kd.cacheLock.RLock()
-	defer kd.cacheLock.RUnlock()
-	records := kd.cache.GetValuesForPathWithWildcards(path...)
-	klog.V(3).Infof("Found %d records for %v in the cache", len(records), path)
-
-	retval := []skymsg.Service{}
-	for _, val := range records {
-		retval = append(retval, *val)
+	if klogV := klog.V(3); klogV.Enabled() {
+		klogV.Infof("Found %d records for %v in the cache", len(retval)-len(dst), path)
 	}
 
-	klog.V(4).Infof("getRecordsForPath retval=%+v, path=%v", retval, path)
+	if klogV := klog.V(4); klogV.Enabled() {
+		klogV.Infof("getRecordsForPath retval=%+v, path=%v", retval[len(dst):], path)
+	}
 
-	return retval, nil
+	return retval, err
 }
 
 // Returns true if the given record corresponds to a headless service.
-// Important: Assumes that we already have the cacheLock. Callers responsibility to acquire it.
-// This is because the code will panic, if we try to acquire it again if we already have it.
 func (kd *KubeDNS) isHeadlessServiceRecord(msg *skymsg.Service) bool {
 	// If it is not a headless service, then msg.Host will be the cluster IP.
-	// So we can check if msg.host exists in our clusterIPServiceMap.
-	_, ok := kd.clusterIPServiceMap[msg.Host]
-	// It is headless service if no record was found.
-	return !ok
+	// So we can check if msg.host is the cluster IP of a service.
+	// It is headless service if no service was found.
+	return kd.ipShards.service(msg.Host) == nil
 }
 
 // Returns true if the service corresponding to the given message has endpoints.
 // Note: Works only for services with ClusterIP. Will return an error for headless service (service without a clusterIP).
-// Important: Assumes that we already have the cacheLock. Callers responsibility to acquire it.
-// This is because the code will panic, if we try to acquire it again if we already have it.
 func (kd *KubeDNS) serviceWithClusterIPHasEndpoints(msg *skymsg.Service) (bool, error) {
-	svc, ok := kd.clusterIPServiceMap[msg.Host]
-	if !ok {
+	svc := kd.ipShards.service(msg.Host)
+	if svc == nil {
 		// It is a headless service.
 		return false, fmt.Errorf("method not expected to be called for headless service")
 	}
@@ -819,23 +1652,105 @@ func (kd *KubeDNS) serviceWithClusterIPHasEndpoints(msg *skymsg.Service) (bool,
 	return false, fmt.Errorf("unexpected: found non-endpoint object in endpoint store: %v", e)
 }
 
-// ReverseRecord performs a reverse lookup for the given name.
+// ReverseRecord performs a reverse lookup for the given name. If the IP
+// has several reverse records, the first one is returned, see
+// ReverseRecords.
 func (kd *KubeDNS) ReverseRecord(name string) (*skymsg.Service, error) {
+	ip, err := reverseRecordIP(name)
+	if err != nil {
+		return nil, err
+	}
+	return kd.reverseRecord(ip)
+}
+
+// ReverseRecordV6 performs a reverse lookup for the given ip6.arpa. name,
+// which must have the 32 nibbles of the address, in any case. The names of
+// IPv4-mapped addresses have no record: the reverse names of IPv4
+// addresses are in in-addr.arpa.
+func (kd *KubeDNS) ReverseRecordV6(name string) (*skymsg.Service, error) {
+	ip, err := reverseRecordIPv6(name)
+	if err != nil {
+		return nil, err
+	}
+	return kd.reverseRecord(ip)
+}
+
+// ReverseRecords performs a reverse lookup for the given name, returning
+// the reverse records of every service of the IP, e.g. of the services
+// sharing an external IP or of the headless services with overlapping
+// endpoints.
+func (kd *KubeDNS) ReverseRecords(name string) ([]skymsg.Service, error) {
+	ip, err := reverseRecordIP(name)
+	if err != nil {
+		return nil, err
+	}
+	if reverseRecords := kd.ipShards.reverseRecords(ip); len(reverseRecords) > 0 {
+		records := make([]skymsg.Service, len(reverseRecords))
+		for i, reverseRecord := range reverseRecords {
+			records[i] = *reverseRecord
+		}
+		return records, nil
+	}
+	reverseRecord, err := kd.reverseRecord(ip)
+	if err != nil {
+		return nil, err
+	}
+	return []skymsg.Service{*reverseRecord}, nil
+}
+
+// reverseRecordIP returns the IP of the in-addr.arpa. or ip6.arpa. name,
+// in its canonical form.
+func reverseRecordIP(name string) (string, error) {
+	if strings.HasSuffix(strings.ToLower(name), util.ArpaSuffixV6) {
+		return reverseRecordIPv6(name)
+	}
 	klog.V(3).Infof("Query for ReverseRecord %q", name)
 
-	// if portalIP is not a valid IP, the reverseRecordMap lookup will fail
+	// if portalIP is not a valid IP, the reverse record lookup will fail
 	portalIP, err := util.ExtractIP(name)
 	if err != nil {
-		return nil, fmt.Errorf("failed to extract ip for record %q: %w", name, err)
+		return "", fmt.Errorf("failed to extract ip for record %q: %v: %w", name, err, server.ErrInvalid)
 	}
+	return portalIP, nil
+}
+
+// reverseRecordIPv6 returns the IP of the ip6.arpa. name, in its canonical
+// form. IPv4-mapped addresses are not found.
+func reverseRecordIPv6(name string) (string, error) {
+	klog.V(3).Infof("Query for ReverseRecordV6 %q", name)
 
-	kd.cacheLock.RLock()
-	defer kd.cacheLock.RUnlock()
-	if reverseRecord, ok := kd.reverseRecordMap[portalIP]; ok {
+	ip, err := util.ExtractIPv6(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to extract ip for record %q: %v: %w", name, err, server.ErrInvalid)
+	}
+	if ip.To4() != nil {
+		return "", fmt.Errorf("no reverse record for the IPv4-mapped address %q: %w", ip, server.ErrNotFound)
+	}
+	return ip.String(), nil
+}
+
+// reverseRecord returns the first reverse record of ip, which must be in
+// its canonical form.
+func (kd *KubeDNS) reverseRecord(ip string) (*skymsg.Service, error) {
+	if reverseRecord := kd.ipShards.reverseRecord(ip); reverseRecord != nil {
+		return reverseRecord, nil
+	}
+	if reverseRecord, ok := kd.podReverseRecord(ip); ok {
 		return reverseRecord, nil
 	}
 
-	return nil, fmt.Errorf("must be exactly one service record")
+	return nil, fmt.Errorf("no reverse record for %q: %w", ip, server.ErrNotFound)
+}
+
+// reverseRecordKey returns the key of the reverse record of ip in
+// ipShards: its canonical form, so that the IPv6 addresses written
+// uncompressed, in upper case or with an embedded IPv4 address in the API
+// objects are found.
+func reverseRecordKey(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
 }
 
 // e.g {"local", "cluster", "pod", "default", "10-0-0-1"}
@@ -860,7 +1775,36 @@ func (kd *KubeDNS) getPodIP(path []string) (string, error) {
 	if parsed := net.ParseIP(ip); parsed != nil {
 		return ip, nil
 	}
-	return "", fmt.Errorf("Invalid IP Address %v", ip)
+	return "", fmt.Errorf("Invalid IP Address %v: %w", ip, server.ErrInvalid)
+}
+
+// podVerified returns whether the pod record of ip in namespace is to be
+// answered: always, unless PodsVerified is set, in which case a pod with
+// that IP must exist in the namespace.
+func (kd *KubeDNS) podVerified(namespace, ip string) bool {
+	if !kd.PodsVerified {
+		return true
+	}
+	pod, ok := kd.PodIndex.Lookup(net.ParseIP(ip).String())
+	return ok && pod.Namespace == namespace
+}
+
+// podReverseRecord returns the PTR record of the pod owning ip, if
+// PodReverseRecords is set.
+func (kd *KubeDNS) podReverseRecord(ip string) (*skymsg.Service, bool) {
+	if !kd.PodReverseRecords || kd.PodIndex == nil {
+		return nil, false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, false
+	}
+	pod, ok := kd.PodIndex.Lookup(parsed.String())
+	if !ok {
+		return nil, false
+	}
+	record, _ := util.GetSkyMsg(getPodFQDN(kd.domain, pod.Namespace, parsed), 0)
+	return record, true
 }
 
 // isFederationQuery checks if the given query `path` matches the federated service query pattern.
@@ -877,44 +1821,56 @@ func (kd *KubeDNS) getPodIP(path []string) (string, error) {
 //     *.mysvc.myns.myfederation.svc.domain.path as non-federation queries.
 //     We can add support for wildcard queries later, if needed.
 func (kd *KubeDNS) isFederationQuery(path []string) bool {
+	// The cheap checks come first, most queries are not federation queries
+	// and this is on the path of every query. The log arguments are only
+	// built when logged, so that they do not allocate.
+	klogV := klog.V(4)
 	if len(path) != 4+len(kd.domainPath) {
-		klog.V(4).Infof("Not a federation query: len(%q) != 4+len(%q)", path, kd.domainPath)
+		if klogV.Enabled() {
+			klogV.Infof("Not a federation query: len(%q) != 4+len(%q)", path, kd.domainPath)
+		}
 		return false
 	}
+	if path[3] != serviceSubdomain {
+		if klogV.Enabled() {
+			klogV.Infof("Not a federation query: %q != %q (serviceSubdomain)",
+				path[3], serviceSubdomain)
+		}
+		return false
+	}
+	for i, domComp := range kd.domainPath {
+		// kd.domainPath is reversed, so we need to look in the `path` in the reverse order.
+		if domComp != path[len(path)-i-1] {
+			if klogV.Enabled() {
+				klogV.Infof("Not a federation query: kd.domainPath[%d] != path[%d] (%q != %q)",
+					i, len(path)-i-1, domComp, path[len(path)-i-1])
+			}
+			return false
+		}
+	}
 	if errs := validation.IsDNS1035Label(path[0]); len(errs) != 0 {
-		klog.V(4).Infof("Not a federation query: %q is not an RFC 1035 label: %q",
+		klogV.Infof("Not a federation query: %q is not an RFC 1035 label: %q",
 			path[0], errs)
 		return false
 	}
 	if errs := validation.IsDNS1123Label(path[1]); len(errs) != 0 {
-		klog.V(4).Infof("Not a federation query: %q is not an RFC 1123 label: %q",
+		klogV.Infof("Not a federation query: %q is not an RFC 1123 label: %q",
 			path[1], errs)
 		return false
 	}
 	if errs := validation.IsDNS1123Label(path[2]); len(errs) != 0 {
-		klog.V(4).Infof("Not a federation query: %q is not an RFC 1123 label: %q",
+		klogV.Infof("Not a federation query: %q is not an RFC 1123 label: %q",
 			path[2], errs)
 		return false
 	}
-	if path[3] != serviceSubdomain {
-		klog.V(4).Infof("Not a federation query: %q != %q (serviceSubdomain)",
-			path[3], serviceSubdomain)
-		return false
-	}
-	for i, domComp := range kd.domainPath {
-		// kd.domainPath is reversed, so we need to look in the `path` in the reverse order.
-		if domComp != path[len(path)-i-1] {
-			klog.V(4).Infof("Not a federation query: kd.domainPath[%d] != path[%d] (%q != %q)",
-				i, len(path)-i-1, domComp, path[len(path)-i-1])
-			return false
-		}
-	}
 
 	kd.configLock.RLock()
 	defer kd.configLock.RUnlock()
 
 	if _, ok := kd.config.Federations[path[2]]; !ok {
-		klog.V(4).Infof("Not a federation query: label %q not found", path[2])
+		if klogV.Enabled() {
+			klogV.Infof("Not a federation query: label %q not found", path[2])
+		}
 		return false
 	}
 
@@ -932,7 +1888,7 @@ func (kd *KubeDNS) federationRecords(queryPath []string) ([]skymsg.Service, erro
 
 	// Check if the name query matches the federation query pattern.
 	if !kd.isFederationQuery(path) {
-		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
+		return nil, server.ErrNotFound
 	}
 
 	// Now that we have already established that the query is a federation query, remove the local
@@ -943,7 +1899,7 @@ func (kd *KubeDNS) federationRecords(queryPath []string) ([]skymsg.Service, erro
 	// zone) and the region name.
 	zone, region, err := kd.getClusterZoneAndRegion()
 	if err != nil {
-		return nil, fmt.Errorf("failed to obtain the cluster zone and region: %v", err)
+		return nil, fmt.Errorf("failed to obtain the cluster zone and region: %v: %w", err, server.ErrBackendUnavailable)
 	}
 	path = append(path, zone, region)
 
@@ -955,7 +1911,7 @@ func (kd *KubeDNS) federationRecords(queryPath []string) ([]skymsg.Service, erro
 
 	// We accept valid subdomains as well, so just let all the valid subdomains.
 	if len(validation.IsDNS1123Subdomain(domain)) != 0 {
-		return nil, fmt.Errorf("%s is not a valid domain name for federation %s", domain, path[2])
+		return nil, fmt.Errorf("%s is not a valid domain name for federation %s: %w", domain, path[2], server.ErrBackendUnavailable)
 	}
 	name := strings.Join(append(path, domain), ".")
 
@@ -987,18 +1943,14 @@ func (kd *KubeDNS) getClusterZoneAndRegion() (string, string, error) {
 			return "", "", fmt.Errorf("expected node object, got: %T", objs[0])
 		}
 	} else {
-		// An alternative to listing nodes each time is to set a watch, but that is totally
-		// wasteful in case of non-federated independent Kubernetes clusters. So carefully
-		// proceeding here.
-		// TODO(madhusudancs): Move this to external/v1 API.
-		nodeList, err := kd.kubeClient.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
-		if err != nil || len(nodeList.Items) == 0 {
+		nodes, err := kd.listNodes()
+		if err != nil || len(nodes) == 0 {
 			return "", "", fmt.Errorf("failed to retrieve the cluster nodes: %v", err)
 		}
 
 		// Select a node (arbitrarily the first node) that has
 		// `LabelZoneFailureDomain` and `LabelZoneRegion` set.
-		for _, nodeItem := range nodeList.Items {
+		for _, nodeItem := range nodes {
 			_, zfound := nodeItem.Labels[v1.LabelZoneFailureDomain]
 			_, rfound := nodeItem.Labels[v1.LabelZoneRegion]
 			if !zfound || !rfound {
@@ -1029,6 +1981,35 @@ func (kd *KubeDNS) getClusterZoneAndRegion() (string, string, error) {
 	return zone, region, nil
 }
 
+// listNodes returns the nodes of the cluster, from the node informer if
+// NodeRecords started one.
+func (kd *KubeDNS) listNodes() ([]v1.Node, error) {
+	if kd.nodeRecordsStore != nil {
+		var nodes []v1.Node
+		for _, obj := range kd.nodeRecordsStore.List() {
+			if node, ok := obj.(*v1.Node); ok {
+				nodes = append(nodes, *node)
+			}
+		}
+		return nodes, nil
+	}
+	// An alternative to listing nodes each time is to set a watch, but that is totally
+	// wasteful in case of non-federated independent Kubernetes clusters. So carefully
+	// proceeding here.
+	nodeList, err := kd.kubeClient.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return nodeList.Items, nil
+}
+
+// getPodFQDN returns the name of the pod record of ip, its dots or colons
+// replaced with dashes.
+func getPodFQDN(domain, namespace string, ip net.IP) string {
+	dashed := strings.NewReplacer(".", "-", ":", "-").Replace(ip.String())
+	return strings.Join([]string{dashed, namespace, podSubdomain, domain}, ".")
+}
+
 func getServiceFQDN(domain string, service *v1.Service) string {
 	return strings.Join(
 		[]string{service.Name, service.Namespace, serviceSubdomain, domain}, ".")
@@ -17,6 +17,7 @@ limitations under the License.
 package dns
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -31,7 +32,6 @@ import (
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	etcd "go.etcd.io/etcd/client/v2"
 	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
 	skyserver "k8s.io/dns/third_party/forked/skydns/server"
 
@@ -42,6 +42,7 @@ import (
 
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/dns/pkg/dns/config"
+	"k8s.io/dns/pkg/dns/podindex"
 	"k8s.io/dns/pkg/dns/treecache"
 	"k8s.io/dns/pkg/dns/util"
 )
@@ -62,10 +63,15 @@ func newKubeDNS() *KubeDNS {
 		servicesStore:  cache.NewStore(cache.MetaNamespaceKeyFunc),
 		nodesStore:     cache.NewStore(cache.MetaNamespaceKeyFunc),
 
-		cache:               treecache.NewTreeCache(),
-		reverseRecordMap:    make(map[string]*skymsg.Service),
-		clusterIPServiceMap: make(map[string]*v1.Service),
-		cacheLock:           sync.RWMutex{},
+		cache:          treecache.NewTreeCache(),
+		ipShards:       newIPShards(),
+		recordCounts:   make(map[string]int),
+		recordOwners:   make(map[string]recordOwner),
+		serviceAliases: make(map[string][]string),
+		aliasOwners:    make(map[string]string),
+		cacheLock:      sync.RWMutex{},
+
+		terminatingEndpoints: make(map[string]map[string]sliceConditions),
 
 		config:     config.NewDefaultConfig(),
 		configLock: sync.RWMutex{},
@@ -86,6 +92,203 @@ func TestPodDns(t *testing.T) {
 	assert.Equal(t, testPodIP, records[0].Host)
 }
 
+func TestRecordsErrors(t *testing.T) {
+	kd := newKubeDNS()
+
+	_, err := kd.Records("not-an-ip.default.pod."+kd.domain, false)
+	assert.True(t, errors.Is(err, skyserver.ErrInvalid), "got %v", err)
+
+	_, err = kd.Records("nosvc.default.svc."+kd.domain, false)
+	assert.True(t, errors.Is(err, skyserver.ErrNotFound), "got %v", err)
+
+	_, err = kd.Records("nosvc.default.svc."+kd.domain, true)
+	assert.True(t, errors.Is(err, skyserver.ErrNotFound), "got %v", err)
+
+	// The names that exist without records of their own are answered
+	// with NODATA.
+	kd.newService(newService(testNamespace, testService, "1.2.3.5", "http", 80))
+	_, err = kd.Records(testNamespace+".svc."+kd.domain, false)
+	assert.True(t, errors.Is(err, skyserver.ErrNoData), "got %v", err)
+
+	_, err = kd.Records(testService+"."+testNamespace+".svc."+kd.domain, true)
+	assert.True(t, errors.Is(err, skyserver.ErrNoData), "got %v", err)
+
+	_, err = kd.ReverseRecord("4.3.2.1.in-addr.arpa.")
+	assert.True(t, errors.Is(err, skyserver.ErrNotFound), "got %v", err)
+
+	_, err = kd.ReverseRecord("foo.in-addr.arpa.")
+	assert.True(t, errors.Is(err, skyserver.ErrInvalid), "got %v", err)
+}
+
+func TestPodsVerified(t *testing.T) {
+	kd := newKubeDNS()
+	kd.PodsVerified = true
+	kd.PodIndex = podindex.NewPodIndex(fake.NewSimpleClientset(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Status:     v1.PodStatus{Phase: v1.PodRunning, PodIP: "10.0.0.1"},
+	}), 0)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go kd.PodIndex.Run(stopCh)
+	require.True(t, cache.WaitForCacheSync(stopCh, kd.PodIndex.HasSynced))
+
+	records, err := kd.Records("10-0-0-1.default.pod."+kd.domain, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, "10.0.0.1", records[0].Host)
+
+	_, err = kd.Records("10-0-0-1.other.pod."+kd.domain, false)
+	assert.True(t, errors.Is(err, skyserver.ErrNotFound), "got %v", err)
+	_, err = kd.Records("10-0-0-2.default.pod."+kd.domain, false)
+	assert.True(t, errors.Is(err, skyserver.ErrNotFound), "got %v", err)
+}
+
+func TestPodReverseRecords(t *testing.T) {
+	kd := newKubeDNS()
+	kd.PodReverseRecords = true
+	kd.PodIndex = podindex.NewPodIndex(fake.NewSimpleClientset(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Status: v1.PodStatus{Phase: v1.PodRunning, PodIPs: []v1.PodIP{
+			{IP: "10.0.0.1"}, {IP: "2001:db8::1"},
+		}},
+	}), 0)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go kd.PodIndex.Run(stopCh)
+	require.True(t, cache.WaitForCacheSync(stopCh, kd.PodIndex.HasSynced))
+
+	record, err := kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, "10-0-0-1.default.pod."+kd.domain, record.Host)
+	record, err = kd.ReverseRecord("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, "2001-db8--1.default.pod."+kd.domain, record.Host)
+
+	_, err = kd.ReverseRecord("2.0.0.10.in-addr.arpa.")
+	assert.True(t, errors.Is(err, skyserver.ErrNotFound), "got %v", err)
+
+	// Service records take precedence.
+	kd.newService(newService(testNamespace, testService, "10.0.0.1", "", 80))
+	record, err = kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, getServiceFQDN(kd.domain, newService(testNamespace, testService, "", "", 0)), record.Host)
+}
+
+func TestReverseRecordV6(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "10.0.0.1", "http", 80)
+	// Addresses that are not in their canonical form.
+	s.Spec.ClusterIPs = []string{"10.0.0.1", "FD00:0:0:0:0:0:0:A"}
+	kd.newService(s)
+	headless := newHeadlessService()
+	headless.Name = "headless"
+	endpoints := newEndpoints(headless, newSubsetWithOnePortWithHostname("", 80, true, "2001:DB8:0:0::5", "64:ff9b::192.0.2.1"))
+	require.NoError(t, kd.servicesStore.Add(headless))
+	require.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(headless)
+
+	serviceHost := getServiceFQDN(kd.domain, s)
+	reverseName := func(ip string) string {
+		name, err := util.ReverseName(net.ParseIP(ip))
+		require.NoError(t, err)
+		return name
+	}
+	mappedName, err := util.ReverseNameV6(net.ParseIP("10.0.0.1"))
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name string
+		host string
+		err  error
+	}{
+		{reverseName("10.0.0.1"), serviceHost, nil},
+		{reverseName("fd00::a"), serviceHost, nil},
+		{strings.ToUpper(reverseName("fd00::a")), serviceHost, nil},
+		{reverseName("2001:db8::5"), kd.fqdn(headless, "ep-0"), nil},
+		// An IPv4 address embedded in an IPv6 one.
+		{reverseName("64:ff9b::c000:201"), kd.fqdn(headless, "ep-1"), nil},
+		// IPv4 records are not answered for the IPv4-mapped addresses.
+		{mappedName, "", skyserver.ErrNotFound},
+		{reverseName("fd00::b"), "", skyserver.ErrNotFound},
+		// Incomplete and malformed names.
+		{"a.0.0.0.d.f.ip6.arpa.", "", skyserver.ErrInvalid},
+		{strings.Replace(reverseName("fd00::a"), "a.0.", "a0.", 1), "", skyserver.ErrInvalid},
+		{strings.Replace(reverseName("fd00::a"), "a.", "g.", 1), "", skyserver.ErrInvalid},
+	} {
+		record, err := kd.ReverseRecord(tc.name)
+		if tc.err != nil {
+			assert.True(t, errors.Is(err, tc.err), "%s: got %v", tc.name, err)
+			continue
+		}
+		if assert.NoError(t, err, tc.name) {
+			assert.Equal(t, tc.host, record.Host, tc.name)
+		}
+	}
+
+	// The records are removed with the objects, whatever the form of
+	// their addresses.
+	kd.removeService(s)
+	kd.handleEndpointDelete(endpoints)
+	assert.Zero(t, kd.ipShards.len())
+}
+
+func TestDisableWildcards(t *testing.T) {
+	kd := newKubeDNS()
+	kd.DisableWildcards = true
+	s := newService(testNamespace, testService, "1.2.3.4", "", 80)
+	kd.newService(s)
+
+	serviceFQDN := getServiceFQDN(kd.domain, s)
+	for i, query := range getEquivalentQueries(serviceFQDN, s.Namespace) {
+		records, err := kd.Records(query, false)
+		if i == 0 {
+			require.NoError(t, err)
+			assert.Equal(t, 1, len(records))
+			continue
+		}
+		assert.True(t, errors.Is(err, skyserver.ErrNotFound), "%s: got %v", query, err)
+	}
+}
+
+func TestWildcardQueriesFollowUpdates(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "", 80)
+	kd.newService(s)
+	// Another service of the same name, in another namespace, is matched
+	// by the queries with a wildcard for the namespace alone.
+	other := newService("other", testService, "1.2.3.5", "", 80)
+	kd.newService(other)
+
+	serviceFQDN := getServiceFQDN(kd.domain, s)
+	queries := getEquivalentQueries(serviceFQDN, s.Namespace)
+	check := func(testCase string, ips ...string) {
+		for i, query := range queries {
+			records, err := kd.Records(query, false)
+			require.NoError(t, err, "%s: %s", testCase, query)
+			hosts := make([]string, 0, len(records))
+			for _, record := range records {
+				hosts = append(hosts, record.Host)
+			}
+			want := ips
+			if i == 2 || i == 3 {
+				want = append(append([]string(nil), ips...), "1.2.3.5")
+			}
+			assert.ElementsMatch(t, want, hosts, "%s: %s", testCase, query)
+		}
+	}
+	check("added", "1.2.3.4")
+
+	updated := newService(testNamespace, testService, "1.2.3.6", "", 80)
+	kd.updateService(s, updated)
+	check("updated", "1.2.3.6")
+
+	kd.removeService(updated)
+	for _, query := range queries[:2] {
+		_, err := kd.Records(query, false)
+		assert.Error(t, err, "removed: %s", query)
+	}
+}
+
 func TestUnnamedSinglePortService(t *testing.T) {
 	tests := []struct {
 		name            string
@@ -142,6 +345,59 @@ func TestUnnamedSinglePortService(t *testing.T) {
 	}
 }
 
+func TestDualStackReverseRecords(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "", 80)
+	kd.newService(s)
+	assertReverseRecord(t, "single stack", kd, s)
+
+	// Upgrade to dual-stack, both ClusterIPs get a PTR record.
+	dualStack := s.DeepCopy()
+	dualStack.Spec.ClusterIPs = []string{"1.2.3.4", "2001:db8:0:0::8a2e:370:7334"}
+	kd.updateService(s, dualStack)
+	assertReverseRecord(t, "dual stack", kd, dualStack)
+
+	// Downgrade to single stack, the PTR record of the IPv6 ClusterIP goes away.
+	kd.updateService(dualStack, s)
+	assertReverseRecord(t, "downgraded", kd, s)
+	_, err := kd.ReverseRecord("4.3.3.7.e.2.a.8.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.")
+	assert.Error(t, err)
+
+	kd.removeService(s)
+	assertNoReverseRecord(t, "deleted", kd, dualStack)
+}
+
+func TestDualStackServiceIndex(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "", 80)
+	kd.newService(s)
+	const ipv6 = "2001:db8::8a2e:370:7334"
+	assert.Nil(t, kd.ipShards.service(ipv6))
+
+	// Both ClusterIPs map to the service, in any form.
+	dualStack := s.DeepCopy()
+	dualStack.Spec.ClusterIPs = []string{"1.2.3.4", "2001:DB8:0:0:0:8A2E:370:7334"}
+	kd.updateService(s, dualStack)
+	for _, ip := range []string{"1.2.3.4", ipv6, "2001:db8:0:0:0:8a2e:370:7334"} {
+		assert.Same(t, dualStack, kd.ipShards.service(ip), ip)
+		assert.False(t, kd.isHeadlessServiceRecord(&skymsg.Service{Host: ip}), ip)
+	}
+	require.NoError(t, kd.endpointsStore.Add(newEndpoints(dualStack, newSubsetWithOnePort("", 80, "10.0.0.1"))))
+	hasEndpoints, err := kd.serviceWithClusterIPHasEndpoints(&skymsg.Service{Host: ipv6})
+	require.NoError(t, err)
+	assert.True(t, hasEndpoints)
+
+	// Back to single stack, the IPv6 ClusterIP no longer maps to it.
+	kd.updateService(dualStack, s)
+	assert.Same(t, s, kd.ipShards.service("1.2.3.4"))
+	assert.Nil(t, kd.ipShards.service(ipv6))
+
+	kd.updateService(s, dualStack)
+	kd.removeService(dualStack)
+	assert.Nil(t, kd.ipShards.service("1.2.3.4"))
+	assert.Nil(t, kd.ipShards.service(ipv6))
+}
+
 func TestNamedSinglePortService(t *testing.T) {
 	const (
 		portName1 = "http1"
@@ -434,6 +690,90 @@ func TestHeadlessServiceEndpointsUpdate(t *testing.T) {
 	assertNoReverseDNSForHeadlessService(t, kd, endpoints)
 }
 
+func TestHeadlessReverseRecords(t *testing.T) {
+	for _, mode := range []HeadlessReverseRecords{HeadlessReverseRecordsService, HeadlessReverseRecordsEndpoint} {
+		kd := newKubeDNS()
+		kd.HeadlessReverseRecords = mode
+		service := newHeadlessService()
+		assert.NoError(t, kd.servicesStore.Add(service))
+		endpoints := newEndpoints(service, newSubsetWithOnePort("", 80, "10.0.0.1", "10.0.0.2"))
+		assert.NoError(t, kd.endpointsStore.Add(endpoints))
+		kd.newService(service)
+
+		for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+			reverseLookup, err := util.ReverseName(net.ParseIP(ip))
+			require.NoError(t, err)
+			record, err := kd.ReverseRecord(reverseLookup)
+			require.NoError(t, err, string(mode))
+			if mode == HeadlessReverseRecordsService {
+				assert.Equal(t, getServiceFQDN(kd.domain, service), record.Host)
+				continue
+			}
+			// The PTR record points back at the A record of the endpoint.
+			records, err := kd.Records(record.Host, true)
+			require.NoError(t, err, string(mode))
+			require.Equal(t, 1, len(records))
+			assert.Equal(t, ip, records[0].Host)
+		}
+
+		// Removed endpoints lose their PTR record.
+		newEndpoints := newEndpoints(service, newSubsetWithOnePort("", 80, "10.0.0.1"))
+		kd.handleEndpointUpdate(endpoints, newEndpoints)
+		_, err := kd.ReverseRecord("2.0.0.10.in-addr.arpa.")
+		assert.Error(t, err, string(mode))
+		kd.handleEndpointDelete(newEndpoints)
+		assertNoReverseDNSForHeadlessService(t, kd, endpoints)
+	}
+}
+
+func TestSharedEndpointIPReverseRecords(t *testing.T) {
+	kd := newKubeDNS()
+	kd.HeadlessReverseRecords = HeadlessReverseRecordsService
+	var endpoints []*v1.Endpoints
+	for _, name := range []string{"b", "a"} {
+		service := newHeadlessService()
+		service.Name = name
+		require.NoError(t, kd.servicesStore.Add(service))
+		e := newEndpoints(service, newSubsetWithOnePort("", 80, "10.0.0.1"))
+		require.NoError(t, kd.endpointsStore.Add(e))
+		kd.newService(service)
+		endpoints = append(endpoints, e)
+	}
+
+	// The IP has the PTR records of both services, in the order of the
+	// services.
+	records, err := kd.ReverseRecords("1.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "a.default.svc.cluster.local.", records[0].Host)
+	assert.Equal(t, "b.default.svc.cluster.local.", records[1].Host)
+	record, err := kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, "a.default.svc.cluster.local.", record.Host)
+
+	// The endpoints of b are deleted, those of a keep their PTR record.
+	kd.handleEndpointDelete(endpoints[0])
+	records, err = kd.ReverseRecords("1.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "a.default.svc.cluster.local.", records[0].Host)
+
+	kd.handleEndpointDelete(endpoints[1])
+	_, err = kd.ReverseRecords("1.0.0.10.in-addr.arpa.")
+	assert.Error(t, err)
+}
+
+func TestParseHeadlessReverseRecords(t *testing.T) {
+	mode, err := ParseHeadlessReverseRecords("")
+	assert.NoError(t, err)
+	assert.Equal(t, HeadlessReverseRecordsNamed, mode)
+	mode, err = ParseHeadlessReverseRecords("endpoint")
+	assert.NoError(t, err)
+	assert.Equal(t, HeadlessReverseRecordsEndpoint, mode)
+	_, err = ParseHeadlessReverseRecords("pod")
+	assert.Error(t, err)
+}
+
 func TestNamedHeadlessServiceEndpointAdd(t *testing.T) {
 	kd := newKubeDNS()
 
@@ -544,8 +884,9 @@ func TestNamedHeadlessServiceEndpointDelete(t *testing.T) {
 	kd.newService(service)
 	assertDNSForHeadlessService(t, kd, endpoints)
 
+	// The records of a headless service go away with its endpoints.
 	kd.handleEndpointDelete(endpoints)
-	assertDNSForHeadlessService(t, kd, endpoints)
+	assertNoDNSForHeadlessService(t, kd, service)
 	assertNoReverseDNSForHeadlessService(t, kd, endpoints)
 }
 
@@ -579,6 +920,70 @@ func TestHeadlessServiceWithDelayedEndpointsAddition(t *testing.T) {
 	assertNoReverseDNSForHeadlessService(t, kd, endpoints)
 }
 
+// Services without selector get their records from the endpoints managed by
+// the user, whatever the order the objects are seen in, e.g. after a restart.
+func TestSelectorlessHeadlessService(t *testing.T) {
+	service := newHeadlessService()
+	endpoints := newEndpoints(service, newSubsetWithOnePortWithHostname("http", 80, true, "10.0.0.1", "10.0.0.2"))
+
+	// Endpoints seen before the service.
+	kd := newKubeDNS()
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.handleEndpointAdd(endpoints)
+	assertNoDNSForHeadlessService(t, kd, service)
+	assert.NoError(t, kd.servicesStore.Add(service))
+	kd.newService(service)
+	assertDNSForHeadlessService(t, kd, endpoints)
+	assertSRVForHeadlessService(t, kd, service, endpoints)
+	assertReverseDNSForNamedHeadlessService(t, kd, endpoints)
+
+	// Endpoints seen after the service.
+	kd = newKubeDNS()
+	assert.NoError(t, kd.servicesStore.Add(service))
+	kd.newService(service)
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.handleEndpointAdd(endpoints)
+	assertDNSForHeadlessService(t, kd, endpoints)
+	assertReverseDNSForNamedHeadlessService(t, kd, endpoints)
+
+	// Deleting the endpoints removes every record, as if they never
+	// existed, and adding them back restores them.
+	assert.NoError(t, kd.endpointsStore.Delete(endpoints))
+	kd.handleEndpointDelete(endpoints)
+	assertNoDNSForHeadlessService(t, kd, service)
+	assertNoReverseDNSForHeadlessService(t, kd, endpoints)
+	assert.Equal(t, 0, kd.recordCount)
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.handleEndpointAdd(endpoints)
+	assertDNSForHeadlessService(t, kd, endpoints)
+}
+
+func TestSelectorlessClusterIPService(t *testing.T) {
+	kd := newKubeDNS()
+	service := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	assert.NoError(t, kd.servicesStore.Add(service))
+	kd.newService(service)
+	assertDNSForClusterIP(t, "", kd, service, []string{"1.2.3.4"})
+
+	// The ClusterIP is answered whatever the endpoints, which only tell
+	// whether the service has backends.
+	record := skymsg.Service{Host: "1.2.3.4"}
+	ok, err := kd.serviceWithClusterIPHasEndpoints(&record)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	endpoints := newEndpoints(service, newSubsetWithOnePort("http", 8080, "10.0.0.1"))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.handleEndpointAdd(endpoints)
+	assertDNSForClusterIP(t, "", kd, service, []string{"1.2.3.4"})
+	ok, err = kd.serviceWithClusterIPHasEndpoints(&record)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	assert.NoError(t, kd.endpointsStore.Delete(endpoints))
+	kd.handleEndpointDelete(endpoints)
+	assertDNSForClusterIP(t, "", kd, service, []string{"1.2.3.4"})
+}
+
 // Verifies that a single record with host "a" is returned for query "q".
 func verifyRecord(t *testing.T, testCase string, q, a string, kd *KubeDNS) {
 	records, err := kd.Records(q, false)
@@ -776,7 +1181,7 @@ func testInvalidFederationQueries(t *testing.T, kd *KubeDNS) {
 		if err == nil {
 			t.Errorf("expected not found error, got nil")
 		}
-		if etcdErr, ok := err.(etcd.Error); !ok || etcdErr.Code != etcd.ErrorCodeKeyNotFound {
+		if !errors.Is(err, skyserver.ErrNotFound) {
 			t.Errorf("expected not found error, got %v", err)
 		}
 		assert.Equal(t, 0, len(records))
@@ -1011,7 +1416,7 @@ func assertDNSForHeadlessService(t *testing.T, kd *KubeDNS, e *v1.Endpoints) {
 func assertReverseDNSForNamedHeadlessService(t *testing.T, kd *KubeDNS, e *v1.Endpoints) {
 	for _, subset := range e.Subsets {
 		for _, endpointAddress := range subset.Addresses {
-			record := kd.reverseRecordMap[endpointAddress.IP]
+			record := kd.ipShards.reverseRecord(endpointAddress.IP)
 			t.Logf("got reverse host name %s", record.Host)
 			assert.Equal(t, record.Host, getPodsFQDN(kd, e, endpointAddress.Hostname))
 		}
@@ -1021,7 +1426,7 @@ func assertReverseDNSForNamedHeadlessService(t *testing.T, kd *KubeDNS, e *v1.En
 func assertNoReverseDNSForHeadlessService(t *testing.T, kd *KubeDNS, e *v1.Endpoints) {
 	for _, subset := range e.Subsets {
 		for _, endpointAddress := range subset.Addresses {
-			assert.Nil(t, kd.reverseRecordMap[endpointAddress.IP])
+			assert.Nil(t, kd.ipShards.reverseRecord(endpointAddress.IP))
 		}
 	}
 }
@@ -1116,7 +1521,7 @@ func assertDNSForClusterIP(t *testing.T, testCase string, kd *KubeDNS, s *v1.Ser
 
 func assertReverseRecord(t *testing.T, testCase string, kd *KubeDNS, s *v1.Service) {
 	for _, ip := range util.GetClusterIPs(s) {
-		reverseLookup, err := makePTRRecord(ip)
+		reverseLookup, err := util.ReverseName(net.ParseIP(ip))
 		require.NoError(t, err, testCase)
 		reverseRecord, err := kd.ReverseRecord(reverseLookup)
 		require.NoError(t, err, testCase)
@@ -1126,7 +1531,7 @@ func assertReverseRecord(t *testing.T, testCase string, kd *KubeDNS, s *v1.Servi
 
 func assertNoReverseRecord(t *testing.T, testCase string, kd *KubeDNS, s *v1.Service) {
 	for _, ip := range util.GetClusterIPs(s) {
-		reverseLookup, err := makePTRRecord(ip)
+		reverseLookup, err := util.ReverseName(net.ParseIP(ip))
 		require.NoError(t, err, testCase)
 		reverseRecord, err := kd.ReverseRecord(reverseLookup)
 		require.Error(t, err)
@@ -1134,29 +1539,6 @@ func assertNoReverseRecord(t *testing.T, testCase string, kd *KubeDNS, s *v1.Ser
 	}
 }
 
-// 10.47.32.22 -> 22.32.47.10.in-addr.arpa.
-// 4321:0:1:2:3:4:567:89ab -> b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.
-func makePTRRecord(ip string) (string, error) {
-	if net.ParseIP(ip).To4() != nil {
-		segments := util.ReverseArray(strings.Split(ip, "."))
-		return fmt.Sprintf("%s%s", strings.Join(segments, "."), util.ArpaSuffix), nil
-	}
-
-	const ipv6nibbleCount = 32
-
-	if ipv6 := net.ParseIP(ip).To16(); ipv6 != nil {
-		b := make([]string, 0, ipv6nibbleCount)
-		for i := 0; i < len(ipv6); i += 2 {
-			for _, c := range fmt.Sprintf("%04x", int64(ipv6[i])<<8|int64(ipv6[i+1])) {
-				b = append(b, string(c))
-			}
-		}
-		return fmt.Sprintf("%s%s", strings.Join(util.ReverseArray(b), "."), util.ArpaSuffixV6), nil
-	}
-
-	return "", fmt.Errorf("incorrect ip adress: %q", ip)
-}
-
 func getEquivalentQueries(serviceFQDN, namespace string) []string {
 	return []string{
 		serviceFQDN,
@@ -1182,3 +1564,106 @@ func getPodsFQDN(kd *KubeDNS, e *v1.Endpoints, podHostName string) string {
 func getSRVFQDN(kd *KubeDNS, s *v1.Service, portName string) string {
 	return fmt.Sprintf("_%s._tcp.%s.%s.svc.%s", portName, s.Name, s.Namespace, kd.domain)
 }
+
+func newBenchmarkKubeDNS(b *testing.B) *KubeDNS {
+	kd := newKubeDNS()
+	for i := 0; i < 100; i++ {
+		s := newService(testNamespace, fmt.Sprintf("service-%d", i), fmt.Sprintf("10.0.%d.%d", i/250, i%250+1), "http", 80)
+		require.NoError(b, kd.servicesStore.Add(s))
+		kd.newService(s)
+	}
+	s := newHeadlessService()
+	e := newEndpoints(s, newSubsetWithOnePort("http", 80, "10.1.0.1", "10.1.0.2", "10.1.0.3", "10.1.0.4"))
+	require.NoError(b, kd.servicesStore.Add(s))
+	require.NoError(b, kd.endpointsStore.Add(e))
+	kd.newService(s)
+	return kd
+}
+
+func TestAppendRecords(t *testing.T) {
+	kd := newKubeDNS()
+	kd.ExtraDomains = []string{"prod.internal."}
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	require.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+
+	dst := make([]skymsg.Service, 1, 8)
+	dst[0] = skymsg.Service{Host: "first", Key: skymsg.Path("first.svc.cluster.local.")}
+	for _, name := range []string{
+		"testservice.default.svc.cluster.local.",
+		"_http._tcp.testservice.default.svc.prod.internal.",
+		"*.testservice.default.svc.cluster.local.",
+	} {
+		records, err := kd.Records(name, false)
+		require.NoError(t, err, name)
+		appended, err := kd.AppendRecords(dst, name, false)
+		require.NoError(t, err, name)
+		assert.Equal(t, dst[0], appended[0], name)
+		assert.Equal(t, records, appended[1:], name)
+		// The records are appended in place, dst has room for them.
+		assert.Same(t, &dst[0], &appended[0], name)
+	}
+
+	appended, err := kd.AppendRecords(dst, "missing.default.svc.cluster.local.", false)
+	assert.Error(t, err)
+	assert.Equal(t, dst, appended)
+}
+
+func BenchmarkRecords(b *testing.B) {
+	kd := newBenchmarkKubeDNS(b)
+	for _, bm := range []struct {
+		name  string
+		query string
+		exact bool
+	}{
+		{"service", "service-42.default.svc.cluster.local.", false},
+		{"headless", "testservice.default.svc.cluster.local.", false},
+		{"srv", "_http._tcp.service-42.default.svc.cluster.local.", false},
+		{"wildcard", "*.default.svc.cluster.local.", false},
+		{"missing", "missing.default.svc.cluster.local.", false},
+		{"exact", "service-42.default.svc.cluster.local.", true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				kd.Records(bm.query, bm.exact)
+			}
+		})
+		// The skydns server appends the records to the slices it reuses.
+		b.Run(bm.name+"/append", func(b *testing.B) {
+			b.ReportAllocs()
+			var records []skymsg.Service
+			for i := 0; i < b.N; i++ {
+				records, _ = kd.AppendRecords(records[:0], bm.query, bm.exact)
+			}
+		})
+	}
+}
+
+func TestSharedInformers(t *testing.T) {
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node-1",
+			Labels: map[string]string{v1.LabelZoneFailureDomain: "zone-a", v1.LabelZoneRegion: "region-a"},
+		},
+	}
+	kd := NewKubeDNS(fake.NewSimpleClientset(s, node), testDomain, time.Second, config.NewNopSync(config.NewDefaultConfig()))
+	kd.NodeRecords = true
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	kd.startInformers(stopCh)
+	require.True(t, cache.WaitForCacheSync(stopCh, kd.serviceController.HasSynced, kd.endpointsController.HasSynced, kd.nodeController.HasSynced))
+
+	// The stores are the caches of the informers of the factory.
+	assert.Equal(t, kd.informerFactory.Core().V1().Nodes().Informer().GetStore(), kd.nodeRecordsStore)
+	assert.Eventually(t, func() bool {
+		records, err := kd.Records(testService+"."+testNamespace+".svc."+testDomain, false)
+		return err == nil && len(records) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	zone, region, err := kd.getClusterZoneAndRegion()
+	require.NoError(t, err)
+	assert.Equal(t, "zone-a", zone)
+	assert.Equal(t, "region-a", region)
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// clusterDomainName returns name moved from the extra domain or namespace
+// domain it is in, if any, to the cluster domain, along with the suffixes
+// it was moved from and to. Other names are returned unchanged, with empty
+// suffixes.
+func (kd *KubeDNS) clusterDomainName(name string) (string, string, string) {
+	fqdn := dns.Fqdn(name)
+	for _, domain := range kd.ExtraDomains {
+		domain = dns.Fqdn(domain)
+		if dns.IsSubDomain(domain, fqdn) {
+			return fqdn[:len(fqdn)-len(domain)] + dns.Fqdn(kd.domain), dns.Fqdn(kd.domain), domain
+		}
+	}
+
+	kd.configLock.RLock()
+	defer kd.configLock.RUnlock()
+	if len(kd.namespaceDomains) == 0 {
+		return name, "", ""
+	}
+	for off, end := 0, false; !end; off, end = dns.NextLabel(fqdn, off) {
+		domain := strings.ToLower(fqdn[off:])
+		if namespace, ok := kd.namespaceDomains[domain]; ok {
+			namespaceDomain := dns.Fqdn(strings.Join([]string{namespace, serviceSubdomain, kd.domain}, "."))
+			return fqdn[:off] + namespaceDomain, namespaceDomain, domain
+		}
+	}
+	return name, "", ""
+}
+
+// moveRecords moves the records of a name in the from domain, copies of
+// those of the cache, to the to domain: their key and the names they point
+// to in from, e.g. the targets of SRV records, are moved, so that the
+// clients of to stay in it.
+func moveRecords(records []skymsg.Service, from, to string) {
+	for i := range records {
+		record := &records[i]
+		// The skydns server names the records from their key, e.g. the
+		// targets of the SRV records of headless services.
+		if record.Key != "" {
+			if name := skymsg.Domain(record.Key); dns.IsSubDomain(from, name) {
+				record.Key = skymsg.Path(name[:len(name)-len(from)] + to)
+			}
+		}
+		if net.ParseIP(record.Host) != nil {
+			continue
+		}
+		if host := dns.Fqdn(record.Host); dns.IsSubDomain(from, host) {
+			record.Host = host[:len(host)-len(from)] + to
+		}
+	}
+}
+
+// setNamespaceDomains applies the namespace domains of the configuration,
+// under which the services of a namespace are also served. Domains
+// overlapping the cluster domain or another namespace domain are ignored.
+// The caller must hold configLock.
+func (kd *KubeDNS) setNamespaceDomains(namespaceDomains map[string]string) {
+	clusterDomain := dns.Fqdn(strings.ToLower(kd.domain))
+	namespaces := make([]string, 0, len(namespaceDomains))
+	for namespace := range namespaceDomains {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	domains := make(map[string]string, len(namespaceDomains))
+	names := make([]string, 0, len(namespaceDomains))
+	for _, namespace := range namespaces {
+		domain := dns.Fqdn(strings.ToLower(namespaceDomains[namespace]))
+		overlaps := dns.IsSubDomain(clusterDomain, domain) || dns.IsSubDomain(domain, clusterDomain)
+		for _, other := range names {
+			overlaps = overlaps || dns.IsSubDomain(other, domain) || dns.IsSubDomain(domain, other)
+		}
+		if overlaps {
+			klog.Errorf("Ignoring the domain %q of namespace %q: it overlaps the cluster domain or another namespace domain", domain, namespace)
+			continue
+		}
+		domains[domain] = namespace
+		names = append(names, domain)
+	}
+	kd.namespaceDomains = domains
+
+	if kd.SkyDNSConfig != nil && kd.SkyDNSConfig.LocalZones != nil {
+		kd.SkyDNSConfig.LocalZones.Set(names)
+	}
+	if len(names) > 0 {
+		klog.V(2).Infof("Namespace domains: %v", domains)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/dns/pkg/dns/config"
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+func TestClusterDomainName(t *testing.T) {
+	kd := newKubeDNS()
+	name, from, to := kd.clusterDomainName("a.default.svc.prod.internal.")
+	assert.Equal(t, "a.default.svc.prod.internal.", name)
+	assert.Empty(t, from)
+	assert.Empty(t, to)
+
+	kd.ExtraDomains = []string{"prod.internal.", "vanity"}
+	kd.setNamespaceDomains(map[string]string{"team-a": "team-a.corp.example"})
+	for query, expected := range map[string][3]string{
+		"a.default.svc.prod.internal.": {"a.default.svc.cluster.local.", "cluster.local.", "prod.internal."},
+		"A.Default.svc.Prod.Internal":  {"A.Default.svc.cluster.local.", "cluster.local.", "prod.internal."},
+		"prod.internal.":               {"cluster.local.", "cluster.local.", "prod.internal."},
+		"a.default.svc.vanity.":        {"a.default.svc.cluster.local.", "cluster.local.", "vanity."},
+		"a.default.svc.cluster.local.": {"a.default.svc.cluster.local.", "", ""},
+		"notprod.internal.":            {"notprod.internal.", "", ""},
+		"web.Team-A.corp.example.":     {"web.team-a.svc.cluster.local.", "team-a.svc.cluster.local.", "team-a.corp.example."},
+		"web.team-b.corp.example.":     {"web.team-b.corp.example.", "", ""},
+	} {
+		name, from, to := kd.clusterDomainName(query)
+		assert.Equal(t, expected, [3]string{name, from, to}, query)
+	}
+}
+
+func TestSetNamespaceDomains(t *testing.T) {
+	kd := newKubeDNS()
+	kd.SkyDNSConfig = &server.Config{LocalZones: server.NewZones()}
+	kd.setNamespaceDomains(map[string]string{
+		"team-a": "Team-A.corp.example",
+		"team-b": "legacy.team-a.corp.example",
+		"team-c": "team-c.cluster.local",
+		"team-d": "team-d.corp.example.",
+	})
+	assert.Equal(t, map[string]string{
+		"team-a.corp.example.": "team-a",
+		"team-d.corp.example.": "team-d",
+	}, kd.namespaceDomains)
+	assert.True(t, kd.SkyDNSConfig.LocalZones.Contains("web.team-d.corp.example."))
+	assert.False(t, kd.SkyDNSConfig.LocalZones.Contains("web.team-c.cluster.local."))
+
+	kd.setNamespaceDomains(nil)
+	assert.Empty(t, kd.namespaceDomains)
+	assert.False(t, kd.SkyDNSConfig.LocalZones.Contains("web.team-d.corp.example."))
+}
+
+func TestNamespaceDomains(t *testing.T) {
+	kd := newKubeDNS()
+	next := config.NewDefaultConfig()
+	next.NamespaceDomains = map[string]string{testNamespace: "legacy.example"}
+	kd.updateConfig(next)
+
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	require.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+
+	records, err := kd.Records("testservice.legacy.example.", false)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "1.2.3.4", records[0].Host)
+
+	records, err = kd.Records("_http._tcp.testservice.legacy.example.", false)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "testservice.legacy.example.", records[0].Host)
+
+	// The services of other namespaces are not served in the domain.
+	other := newService("other", testService, "1.2.3.5", "http", 80)
+	require.NoError(t, kd.servicesStore.Add(other))
+	kd.newService(other)
+	records, err = kd.Records("testservice.other.svc.legacy.example.", false)
+	assert.Error(t, err, "%v", records)
+
+	// Nor once the domain is removed from the configuration.
+	kd.updateConfig(config.NewDefaultConfig())
+	_, err = kd.Records("testservice.legacy.example.", false)
+	assert.Error(t, err)
+}
+
+func TestExtraDomains(t *testing.T) {
+	kd := newKubeDNS()
+	kd.ExtraDomains = []string{"prod.internal."}
+
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	require.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+
+	records, err := kd.Records("testservice.default.svc.prod.internal.", false)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "1.2.3.4", records[0].Host)
+	assert.True(t, dns.IsSubDomain("testservice.default.svc.prod.internal.", skymsg.Domain(records[0].Key)), records[0].Key)
+
+	// The SRV targets stay in the queried domain.
+	records, err = kd.Records("_http._tcp.testservice.default.svc.prod.internal.", false)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "testservice.default.svc.prod.internal.", records[0].Host)
+
+	// The records of the cluster domain are unchanged.
+	records, err = kd.Records("_http._tcp.testservice.default.svc.cluster.local.", false)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "testservice.default.svc.cluster.local.", records[0].Host)
+
+	_, err = kd.Records("missing.default.svc.prod.internal.", false)
+	assert.Error(t, err)
+}
+
+func TestExtraDomainsHeadlessService(t *testing.T) {
+	kd := newKubeDNS()
+	kd.ExtraDomains = []string{"prod.internal."}
+
+	s := newHeadlessService()
+	e := newEndpoints(s, newSubsetWithOnePortWithHostname("", 80, true, "10.0.0.1"))
+	require.NoError(t, kd.servicesStore.Add(s))
+	require.NoError(t, kd.endpointsStore.Add(e))
+	kd.newService(s)
+
+	records, err := kd.Records("testservice.default.svc.prod.internal.", false)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "10.0.0.1", records[0].Host)
+	// Named after the hostname of the endpoint, in the queried domain.
+	assert.Equal(t, skymsg.Path(e.Subsets[0].Addresses[0].Hostname+".testservice.default.svc.prod.internal."), records[0].Key)
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// eventInterval is the least time between two Events with the same
+	// reason and message about the same object.
+	eventInterval = 10 * time.Minute
+	// eventComponent is the source of the Events.
+	eventComponent = "kube-dns"
+	// maxEventKeys is the number of Events remembered, past which those
+	// older than eventInterval are forgotten.
+	maxEventKeys = 1024
+)
+
+// eventEmitter posts warning Events about the objects kube-dns cannot
+// fully serve. The Events repeated within eventInterval are dropped, since
+// the records of an object are generated again on every update. The
+// Events are posted asynchronously, and failures, e.g. for lack of the
+// permission to create Events, only logged.
+type eventEmitter struct {
+	client clientset.Interface
+
+	lock sync.Mutex
+	// last maps the key of an Event to when it was last posted.
+	last map[string]time.Time
+}
+
+func newEventEmitter(client clientset.Interface) *eventEmitter {
+	return &eventEmitter{client: client, last: make(map[string]time.Time)}
+}
+
+// warn posts a warning Event about obj, of the given kind, unless the same
+// Event was posted within eventInterval.
+func (e *eventEmitter) warn(kind string, obj metav1.Object, reason, messageFmt string, args ...interface{}) {
+	if e == nil || e.client == nil {
+		return
+	}
+	message := fmt.Sprintf(messageFmt, args...)
+	key := fmt.Sprintf("%s/%s/%s", obj.GetUID(), reason, message)
+	now := time.Now()
+	e.lock.Lock()
+	if last, ok := e.last[key]; ok && now.Sub(last) < eventInterval {
+		e.lock.Unlock()
+		return
+	}
+	if len(e.last) >= maxEventKeys {
+		for k, last := range e.last {
+			if now.Sub(last) >= eventInterval {
+				delete(e.last, k)
+			}
+		}
+	}
+	e.last[key] = now
+	e.lock.Unlock()
+
+	timestamp := metav1.NewTime(now)
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", obj.GetName(), now.UnixNano()),
+			Namespace: obj.GetNamespace(),
+		},
+		InvolvedObject: v1.ObjectReference{
+			APIVersion:      "v1",
+			Kind:            kind,
+			Namespace:       obj.GetNamespace(),
+			Name:            obj.GetName(),
+			UID:             obj.GetUID(),
+			ResourceVersion: obj.GetResourceVersion(),
+		},
+		Reason:              reason,
+		Message:             message,
+		Type:                v1.EventTypeWarning,
+		Source:              v1.EventSource{Component: eventComponent},
+		ReportingController: eventComponent,
+		FirstTimestamp:      timestamp,
+		LastTimestamp:       timestamp,
+		Count:               1,
+	}
+	go func() {
+		if _, err := e.client.CoreV1().Events(event.Namespace).Create(context.TODO(), event, metav1.CreateOptions{}); err != nil {
+			klog.V(2).Infof("Failed to post the %v Event about %s %s/%s: %v", reason, kind, obj.GetNamespace(), obj.GetName(), err)
+		}
+	}()
+}
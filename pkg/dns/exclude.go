@@ -0,0 +1,58 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	v1 "k8s.io/api/core/v1"
+	kcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/util"
+)
+
+// ExcludeAnnotation, set to "true" on a service, keeps it and its endpoints
+// out of DNS.
+const ExcludeAnnotation = "dns.kubernetes.io/exclude"
+
+// isExcluded returns whether the service opted out of DNS.
+func isExcluded(service *v1.Service) bool {
+	return service.Annotations[ExcludeAnnotation] == "true"
+}
+
+// excludeService removes the records of a service that opted out of DNS,
+// in case it had some before being annotated.
+func (kd *KubeDNS) excludeService(service *v1.Service) {
+	kd.cacheLock.RLock()
+	records := kd.getRecordCount(service)
+	kd.cacheLock.RUnlock()
+	if records == 0 {
+		return
+	}
+	klog.V(2).Infof("Removing the records of excluded service %s/%s", service.Namespace, service.Name)
+	kd.deleteService(service)
+	if util.IsServiceIPSet(service) || service.Spec.Type == v1.ServiceTypeExternalName {
+		return
+	}
+	// The PTR records of headless services belong to their endpoints.
+	key, err := kcache.MetaNamespaceKeyFunc(service)
+	if err != nil {
+		return
+	}
+	if e, exists, err := kd.endpointsStore.GetByKey(key); err == nil && exists {
+		kd.handleEndpointDelete(e)
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExcludedService(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	kd.newService(s)
+	assertDNSForClusterIP(t, "", kd, s, []string{"1.2.3.4"})
+
+	// Annotating the service removes its records.
+	excluded := *s
+	excluded.Annotations = map[string]string{ExcludeAnnotation: "true"}
+	kd.updateService(s, &excluded)
+	assertNoDNSForClusterIP(t, kd, s)
+	assert.Nil(t, kd.ipShards.reverseRecord("1.2.3.4"))
+	assert.Equal(t, 0, kd.recordCount)
+
+	// Removing the annotation restores them.
+	kd.updateService(&excluded, s)
+	assertDNSForClusterIP(t, "", kd, s, []string{"1.2.3.4"})
+}
+
+func TestExcludedHeadlessService(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	s.Annotations = map[string]string{ExcludeAnnotation: "true"}
+	require.NoError(t, kd.servicesStore.Add(s))
+	e := newEndpoints(s, newSubsetWithOnePortWithHostname("", 80, true, "10.0.0.1", "10.0.0.2"))
+	require.NoError(t, kd.endpointsStore.Add(e))
+	kd.newService(s)
+	kd.handleEndpointAdd(e)
+	assertNoDNSForHeadlessService(t, kd, s)
+	assert.Nil(t, kd.ipShards.reverseRecord("10.0.0.1"))
+
+	// The records created before the annotation was added are removed,
+	// PTR records included.
+	included := *s
+	included.Annotations = nil
+	require.NoError(t, kd.servicesStore.Update(&included))
+	kd.updateService(s, &included)
+	assertDNSForHeadlessService(t, kd, e)
+	assertReverseDNSForNamedHeadlessService(t, kd, e)
+
+	require.NoError(t, kd.servicesStore.Update(s))
+	kd.updateService(&included, s)
+	assertNoDNSForHeadlessService(t, kd, s)
+	assert.Nil(t, kd.ipShards.reverseRecord("10.0.0.1"))
+	assert.Nil(t, kd.ipShards.reverseRecord("10.0.0.2"))
+}
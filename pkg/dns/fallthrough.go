@@ -0,0 +1,82 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/util"
+)
+
+// setFallthroughZones applies the fallthrough zones of the configuration:
+// the custom records in them are served, and the SkyDNS server forwards
+// their other names to the nameservers of the zone. Zones overlapping the
+// cluster domain are ignored.
+func (kd *KubeDNS) setFallthroughZones(zones map[string][]string) {
+	domain := dns.Fqdn(strings.ToLower(kd.domain))
+	forwarded := make(map[string][]string, len(zones))
+	names := make([]string, 0, len(zones))
+	for zone, nameservers := range zones {
+		name := dns.Fqdn(strings.ToLower(zone))
+		if dns.IsSubDomain(domain, name) || dns.IsSubDomain(name, domain) {
+			klog.Errorf("Ignoring the fallthrough zone %q: it overlaps the cluster domain %s", zone, domain)
+			continue
+		}
+		var hostPorts []string
+		for _, nameserver := range nameservers {
+			ip, port, err := util.ValidateNameserverIpAndPort(nameserver)
+			if err != nil {
+				klog.Errorf("Invalid nameserver %q for the fallthrough zone %q: %v", nameserver, zone, err)
+				continue
+			}
+			hostPorts = append(hostPorts, net.JoinHostPort(ip, port))
+		}
+		forwarded[name] = hostPorts
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	kd.cacheLock.Lock()
+	if strings.Join(names, ",") != strings.Join(kd.fallthroughZones, ",") {
+		kd.fallthroughZones = names
+		kd.rebuildCustomRecords()
+	}
+	kd.unlockCache()
+
+	if kd.SkyDNSConfig != nil && kd.SkyDNSConfig.Fallthrough != nil {
+		kd.SkyDNSConfig.Fallthrough.Set(forwarded)
+	}
+	if len(names) > 0 {
+		klog.V(2).Infof("Fallthrough zones: %v", names)
+	}
+}
+
+// inFallthroughZone returns whether the fully qualified name is in one of
+// the fallthrough zones. The caller must hold cacheLock.
+func (kd *KubeDNS) inFallthroughZone(name string) bool {
+	for _, zone := range kd.fallthroughZones {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+	return false
+}
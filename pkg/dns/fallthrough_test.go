@@ -0,0 +1,62 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/dns/third_party/forked/skydns/server"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func TestFallthroughZones(t *testing.T) {
+	kd := newKubeDNS()
+	kd.SkyDNSConfig = &server.Config{Fallthrough: server.NewFallthroughZones()}
+
+	next := config.NewDefaultConfig()
+	next.CustomRecords = "app.corp.example.com. A 10.0.0.10\nother.example.org. A 10.0.0.11"
+	kd.updateConfig(next)
+	assert.Empty(t, recordHosts(t, kd, "app.corp.example.com."), "outside of a fallthrough zone")
+
+	// The custom records of a fallthrough zone are served once it is set.
+	next = config.NewDefaultConfig()
+	next.CustomRecords = "app.corp.example.com. A 10.0.0.10\nother.example.org. A 10.0.0.11"
+	next.FallthroughZones = map[string][]string{
+		"Corp.Example.com":  {"10.0.0.1", "10.0.0.2:5353"},
+		"svc." + testDomain: {},
+	}
+	kd.updateConfig(next)
+	assert.Equal(t, []string{"10.0.0.10"}, recordHosts(t, kd, "app.corp.example.com."))
+	assert.Empty(t, recordHosts(t, kd, "other.example.org."))
+
+	nameservers, ok := kd.SkyDNSConfig.Fallthrough.Match("www.corp.example.com.")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"10.0.0.1:53", "10.0.0.2:5353"}, nameservers)
+	// Zones in the cluster domain are ignored.
+	_, ok = kd.SkyDNSConfig.Fallthrough.Match("a.default.svc." + testDomain)
+	assert.False(t, ok)
+
+	// Removing the zone removes its records.
+	next = config.NewDefaultConfig()
+	next.CustomRecords = "app.corp.example.com. A 10.0.0.10"
+	kd.updateConfig(next)
+	assert.Empty(t, recordHosts(t, kd, "app.corp.example.com."))
+	_, ok = kd.SkyDNSConfig.Fallthrough.Match("www.corp.example.com.")
+	assert.False(t, ok)
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package features defines the kube-dns feature gates. Gates are set with
+// the --feature-gates flag and can be overridden per cluster with the
+// featureGates key of the kube-dns ConfigMap. The gates read at startup
+// take the value of the ConfigMap at startup: changing it afterwards only
+// takes effect once kube-dns restarts.
+package features
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/component-base/featuregate"
+)
+
+const (
+	// EndpointSlices lets kube-dns watch EndpointSlices, for the terminating
+	// endpoints, the topology aware answers and the multi-cluster services.
+	// It is read at startup.
+	EndpointSlices featuregate.Feature = "EndpointSlices"
+
+	// DNSOverTLS enables serving DNS over TLS on --dot-port. It is read
+	// at startup.
+	DNSOverTLS featuregate.Feature = "DNSOverTLS"
+
+	// Autopath expands the names queried by the pods in the domain of their
+	// namespace with the rest of their search path on the server side. It
+	// is read at startup, to index the pods, and at each query.
+	Autopath featuregate.Feature = "Autopath"
+
+	// COWTreeCache serves queries from copy-on-write snapshots of the
+	// record cache instead of locking it. It is read at each query.
+	COWTreeCache featuregate.Feature = "COWTreeCache"
+)
+
+var defaultFeatureGates = map[featuregate.Feature]featuregate.FeatureSpec{
+	EndpointSlices: {Default: true, PreRelease: featuregate.Beta},
+	DNSOverTLS:     {Default: false, PreRelease: featuregate.Alpha},
+	Autopath:       {Default: false, PreRelease: featuregate.Alpha},
+	COWTreeCache:   {Default: true, PreRelease: featuregate.Beta},
+}
+
+// DefaultMutableFeatureGate is the feature gate used by kube-dns. Its flag
+// is registered with AddFlag.
+var DefaultMutableFeatureGate featuregate.MutableFeatureGate = featuregate.NewFeatureGate()
+
+// DefaultFeatureGate is a read-only view of DefaultMutableFeatureGate.
+var DefaultFeatureGate featuregate.FeatureGate = DefaultMutableFeatureGate
+
+func init() {
+	runtime.Must(DefaultMutableFeatureGate.Add(defaultFeatureGates))
+}
+
+// Enabled returns whether the given feature is enabled.
+func Enabled(f featuregate.Feature) bool {
+	return DefaultFeatureGate.Enabled(f)
+}
+
+var (
+	lock sync.Mutex
+	// flagGates holds the state of the gates before the first configuration
+	// was applied, i.e. as set by the command line flags.
+	flagGates map[string]bool
+)
+
+// Parse parses a "Feature1=true,Feature2=false" list of feature gates, as
+// found in the ConfigMap, and checks that every feature is known.
+func Parse(value string) (map[string]bool, error) {
+	gates := make(map[string]bool)
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		arr := strings.SplitN(s, "=", 2)
+		k := strings.TrimSpace(arr[0])
+		if len(arr) != 2 {
+			return nil, fmt.Errorf("missing bool value for feature gate %s", k)
+		}
+		v, err := strconv.ParseBool(strings.TrimSpace(arr[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of feature gate %s=%s: %v", k, arr[1], err)
+		}
+		gates[k] = v
+	}
+	return gates, Validate(gates)
+}
+
+// Validate returns an error if gates contains an unknown feature.
+func Validate(gates map[string]bool) error {
+	for k := range gates {
+		if _, ok := defaultFeatureGates[featuregate.Feature(k)]; !ok {
+			return fmt.Errorf("unrecognized feature gate: %s", k)
+		}
+	}
+	return nil
+}
+
+// ApplyConfig sets the gates from the dynamic configuration on top of the
+// gates set by the command line flags. Gates missing from gates revert to
+// their flag value. Must only be called once the flags have been parsed.
+func ApplyConfig(gates map[string]bool) error {
+	if err := Validate(gates); err != nil {
+		return err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	if flagGates == nil {
+		flagGates = make(map[string]bool)
+		for f := range defaultFeatureGates {
+			flagGates[string(f)] = DefaultFeatureGate.Enabled(f)
+		}
+	}
+	merged := make(map[string]bool)
+	for k, v := range flagGates {
+		merged[k] = v
+	}
+	for k, v := range gates {
+		merged[k] = v
+	}
+	return DefaultMutableFeatureGate.SetFromMap(merged)
+}
+
+// String returns the state of every kube-dns feature gate, for logging.
+func String() string {
+	var pairs []string
+	for f := range defaultFeatureGates {
+		pairs = append(pairs, fmt.Sprintf("%s=%t", f, DefaultFeatureGate.Enabled(f)))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package features
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	gates, err := Parse("EndpointSlices=true, Autopath=false,")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"EndpointSlices": true, "Autopath": false}, gates)
+
+	for _, value := range []string{
+		"EndpointSlices",
+		"EndpointSlices=maybe",
+		"NoSuchFeature=true",
+		"AllAlpha=true",
+	} {
+		_, err := Parse(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	// Flag value.
+	require.NoError(t, DefaultMutableFeatureGate.Set("DNSOverTLS=true"))
+
+	require.NoError(t, ApplyConfig(map[string]bool{"EndpointSlices": false, "DNSOverTLS": false}))
+	assert.False(t, Enabled(EndpointSlices))
+	assert.False(t, Enabled(DNSOverTLS))
+
+	// Gates removed from the config revert to their flag value.
+	require.NoError(t, ApplyConfig(nil))
+	assert.True(t, Enabled(EndpointSlices))
+	assert.True(t, Enabled(DNSOverTLS))
+
+	assert.Error(t, ApplyConfig(map[string]bool{"NoSuchFeature": true}))
+	assert.Equal(t, "Autopath=false,COWTreeCache=true,DNSOverTLS=true,EndpointSlices=true", String())
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+)
+
+// FederationHealthCheck verifies that the apex of a federation zone resolves
+// through the upstream nameservers before kube-dns redirects a query to it,
+// so that clients are not sent to a federation that is not answering.
+// Results are cached for TTL.
+type FederationHealthCheck struct {
+	// TTL for which the result of a check is cached.
+	TTL time.Duration
+	// Timeout of a single query to an upstream nameserver.
+	Timeout time.Duration
+
+	// exchange sends a query to an upstream nameserver. Replaced in tests.
+	exchange func(m *dns.Msg, server string) (*dns.Msg, error)
+
+	lock sync.Mutex
+	// results maps a federation domain to the result of its last check.
+	results map[string]federationHealthResult
+}
+
+type federationHealthResult struct {
+	healthy bool
+	expires time.Time
+}
+
+// NewFederationHealthCheck returns a FederationHealthCheck caching results
+// for ttl and waiting at most timeout for each upstream nameserver.
+func NewFederationHealthCheck(ttl, timeout time.Duration) *FederationHealthCheck {
+	h := &FederationHealthCheck{
+		TTL:     ttl,
+		Timeout: timeout,
+		results: make(map[string]federationHealthResult),
+	}
+	h.exchange = func(m *dns.Msg, server string) (*dns.Msg, error) {
+		c := &dns.Client{Timeout: h.Timeout}
+		r, _, err := c.Exchange(m, server)
+		return r, err
+	}
+	return h
+}
+
+// healthy returns whether the apex of the federation domain resolves
+// through one of the given nameservers. A nil FederationHealthCheck
+// considers every federation healthy.
+func (h *FederationHealthCheck) healthy(domain string, nameservers []string) bool {
+	if h == nil {
+		return true
+	}
+	domain = dns.Fqdn(domain)
+	now := time.Now()
+
+	h.lock.Lock()
+	result, ok := h.results[domain]
+	h.lock.Unlock()
+	if ok && now.Before(result.expires) {
+		return result.healthy
+	}
+
+	err := h.check(domain, nameservers)
+	if err != nil {
+		klog.Warningf("Federation: health check for %q failed: %v", domain, err)
+	}
+	result = federationHealthResult{healthy: err == nil, expires: now.Add(h.TTL)}
+
+	h.lock.Lock()
+	h.results[domain] = result
+	h.lock.Unlock()
+	return result.healthy
+}
+
+// check queries the SOA of domain from each nameserver in turn and returns
+// nil as soon as one of them answers successfully.
+func (h *FederationHealthCheck) check(domain string, nameservers []string) error {
+	if len(nameservers) == 0 {
+		return fmt.Errorf("no upstream nameservers")
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(domain, dns.TypeSOA)
+
+	var lastErr error
+	for _, server := range nameservers {
+		r, err := h.exchange(m, server)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %v", server, err)
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			lastErr = fmt.Errorf("%s: %s", server, dns.RcodeToString[r.Rcode])
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+// fakeFederationUpstream answers SOA queries for the domains in healthy and
+// counts the queries it received.
+type fakeFederationUpstream struct {
+	healthy map[string]bool
+	queries int
+}
+
+func (f *fakeFederationUpstream) exchange(m *dns.Msg, _ string) (*dns.Msg, error) {
+	f.queries++
+	r := new(dns.Msg)
+	r.SetReply(m)
+	if !f.healthy[m.Question[0].Name] {
+		r.Rcode = dns.RcodeNameError
+	}
+	return r, nil
+}
+
+func TestFederationHealthCheckCache(t *testing.T) {
+	upstream := &fakeFederationUpstream{healthy: map[string]bool{"example.com.": true}}
+	h := NewFederationHealthCheck(time.Hour, time.Second)
+	h.exchange = upstream.exchange
+
+	assert.True(t, h.healthy("example.com", []string{"10.0.0.1:53"}))
+	assert.True(t, h.healthy("example.com", []string{"10.0.0.1:53"}))
+	assert.Equal(t, 1, upstream.queries)
+
+	assert.False(t, h.healthy("dead.example.com", []string{"10.0.0.1:53"}))
+	assert.Equal(t, 2, upstream.queries)
+
+	// Expired results are checked again.
+	upstream.queries = 0
+	h = NewFederationHealthCheck(0, time.Second)
+	h.exchange = upstream.exchange
+	assert.True(t, h.healthy("example.com", []string{"10.0.0.1:53"}))
+	assert.True(t, h.healthy("example.com", []string{"10.0.0.1:53"}))
+	assert.Equal(t, 2, upstream.queries)
+
+	assert.False(t, h.healthy("example.com", nil))
+	h.exchange = func(*dns.Msg, string) (*dns.Msg, error) { return nil, errors.New("timeout") }
+	assert.False(t, h.healthy("example.com", []string{"10.0.0.1:53"}))
+}
+
+func TestFederationHealthCheckFallback(t *testing.T) {
+	kd := newKubeDNS()
+	kd.config.Federations = map[string]string{
+		"myfederation": "example.com",
+	}
+	kd.kubeClient = fake.NewSimpleClientset(newNodes())
+	kd.SkyDNSConfig = &server.Config{Nameservers: []string{"10.0.0.1:53"}}
+	upstream := &fakeFederationUpstream{healthy: map[string]bool{"example.com.": true}}
+	kd.FederationHealth = NewFederationHealthCheck(0, time.Second)
+	kd.FederationHealth.exchange = upstream.exchange
+
+	// Healthy federation, redirect.
+	verifyRecord(t, "", "testservice.default.myfederation.svc.cluster.local.",
+		federatedServiceFQDN, kd)
+
+	// Unhealthy federation without a local service fails the query.
+	upstream.healthy = nil
+	_, err := kd.Records("testservice.default.myfederation.svc.cluster.local.", false)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, server.ErrBackendUnavailable))
+
+	// Unhealthy federation with a local service without endpoints answers
+	// with the local service.
+	s := newService(testNamespace, testService, "1.2.3.4", "", 80)
+	assert.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+	verifyRecord(t, "", getFederationServiceFQDN(kd, s, "myfederation"),
+		"testservice.default.svc.cluster.local.", kd)
+}
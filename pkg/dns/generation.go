@@ -0,0 +1,54 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cacheGeneration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "kubedns",
+		Subsystem: "cache",
+		Name:      "generation",
+		Help:      "Generation of the records, incremented whenever the records or the configuration change.",
+	})
+	registerGenerationMetrics sync.Once
+)
+
+// Generation returns the generation of the records, incremented whenever
+// the queries may be answered differently: the snapshot of the cache they
+// read is published or the configuration changes. The answers computed at a
+// generation hold until the next one, e.g. for the replies cached by the
+// server, see server.Generationer.
+func (kd *KubeDNS) Generation() uint64 {
+	return atomic.LoadUint64(&kd.generation)
+}
+
+// nextGeneration increments the generation, once the changes are seen by
+// the queries.
+func (kd *KubeDNS) nextGeneration() {
+	cacheGeneration.Set(float64(atomic.AddUint64(&kd.generation, 1)))
+}
+
+// registerGenerationMetric exports the generation as a metric.
+func registerGenerationMetric() {
+	registerGenerationMetrics.Do(func() { prometheus.MustRegister(cacheGeneration) })
+}
@@ -0,0 +1,285 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	kcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/util"
+)
+
+// Guardrails protects the record cache against suspicious changes, such as
+// an API server outage returning empty lists and deleting every record.
+// A zero value for any limit disables that check.
+type Guardrails struct {
+	// MinRecords is the minimum number of records expected to be served.
+	// kube-dns reports not ready while fewer records are present.
+	MinRecords int
+	// MaxRecords is the maximum number of records expected to be served.
+	// kube-dns reports not ready while more records are present.
+	MaxRecords int
+	// MaxDeletes is the maximum number of records that may be deleted
+	// within Window. Service and headless endpoints deletions beyond that
+	// are held back until they are released with Override().
+	MaxDeletes int
+	// Window over which deleted records are counted against MaxDeletes.
+	Window time.Duration
+
+	lock sync.Mutex
+	// deletions holds the time and record count of recent deletions.
+	deletions []guardrailDeletion
+	// held contains the deletions that were refused, keyed by
+	// namespace/name.
+	held map[string]heldDeletion
+}
+
+// heldDeletion is a deletion refused by the guardrails: that of a service,
+// or of the records of the endpoints of a headless service if endpoints is
+// set.
+type heldDeletion struct {
+	service   *v1.Service
+	endpoints *v1.Endpoints
+}
+
+type guardrailDeletion struct {
+	time    time.Time
+	records int
+}
+
+// GuardrailsStatus is a snapshot of the guardrails state.
+type GuardrailsStatus struct {
+	Records        int      `json:"records"`
+	MinRecords     int      `json:"minRecords"`
+	MaxRecords     int      `json:"maxRecords"`
+	MaxDeletes     int      `json:"maxDeletes"`
+	RecentDeletes  int      `json:"recentDeletes"`
+	HeldDeletions  []string `json:"heldDeletions"`
+	Ready          bool     `json:"ready"`
+	NotReadyReason string   `json:"notReadyReason,omitempty"`
+}
+
+// NewGuardrails returns guardrails with the given limits.
+func NewGuardrails(minRecords, maxRecords, maxDeletes int, window time.Duration) *Guardrails {
+	return &Guardrails{
+		MinRecords: minRecords,
+		MaxRecords: maxRecords,
+		MaxDeletes: maxDeletes,
+		Window:     window,
+		held:       make(map[string]heldDeletion),
+	}
+}
+
+// checkRecordCount returns an error if the number of records is outside of
+// the expected bounds.
+func (g *Guardrails) checkRecordCount(records int) error {
+	if g == nil {
+		return nil
+	}
+	if g.MinRecords > 0 && records < g.MinRecords {
+		return fmt.Errorf("serving %d records, expected at least %d", records, g.MinRecords)
+	}
+	if g.MaxRecords > 0 && records > g.MaxRecords {
+		return fmt.Errorf("serving %d records, expected at most %d", records, g.MaxRecords)
+	}
+	return nil
+}
+
+// allowDelete returns whether deleting the given service and its records
+// stays within the deletion budget. Refused deletions are held until they
+// are released.
+func (g *Guardrails) allowDelete(service *v1.Service, records int) bool {
+	return g.allow(heldDeletion{service: service}, records)
+}
+
+// allowEndpointsDelete returns whether removing the records of the deleted
+// endpoints of the headless service stays within the deletion budget, like
+// allowDelete. A held deletion of the service itself is kept, as it
+// removes those records as well.
+func (g *Guardrails) allowEndpointsDelete(endpoints *v1.Endpoints, service *v1.Service, records int) bool {
+	return g.allow(heldDeletion{service: service, endpoints: endpoints}, records)
+}
+
+func (g *Guardrails) allow(deletion heldDeletion, records int) bool {
+	if g == nil || g.MaxDeletes <= 0 {
+		return true
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	now := time.Now()
+	recent := g.recentDeletesLocked(now)
+	key, _ := kcache.MetaNamespaceKeyFunc(deletion.service)
+	if recent+records > g.MaxDeletes {
+		what := "service"
+		if deletion.endpoints != nil {
+			what = "endpoints of headless service"
+		}
+		klog.Warningf("Guardrails: holding deletion of %s %q (%d records): %d records already deleted in the last %v (max %d)",
+			what, key, records, recent, g.Window, g.MaxDeletes)
+		if held, ok := g.held[key]; !ok || held.endpoints != nil {
+			g.held[key] = deletion
+		}
+		return false
+	}
+	delete(g.held, key)
+	g.deletions = append(g.deletions, guardrailDeletion{time: now, records: records})
+	return true
+}
+
+// cancelHeldDelete forgets a held deletion of the service, e.g. because the
+// service was seen again.
+func (g *Guardrails) cancelHeldDelete(service *v1.Service) {
+	g.cancel(service, false)
+}
+
+// cancelHeldEndpointsDelete forgets a held deletion of the records of the
+// endpoints of the headless service, e.g. because its endpoints were seen
+// again.
+func (g *Guardrails) cancelHeldEndpointsDelete(service *v1.Service) {
+	g.cancel(service, true)
+}
+
+func (g *Guardrails) cancel(service *v1.Service, endpoints bool) {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	key, _ := kcache.MetaNamespaceKeyFunc(service)
+	if held, ok := g.held[key]; ok && (held.endpoints != nil) == endpoints {
+		delete(g.held, key)
+	}
+}
+
+// release returns the held deletions and resets the deletion budget.
+func (g *Guardrails) release() []heldDeletion {
+	if g == nil {
+		return nil
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	var deletions []heldDeletion
+	for _, deletion := range g.held {
+		deletions = append(deletions, deletion)
+	}
+	g.held = make(map[string]heldDeletion)
+	g.deletions = nil
+	return deletions
+}
+
+func (g *Guardrails) recentDeletesLocked(now time.Time) int {
+	cutoff := now.Add(-g.Window)
+	i := 0
+	for i < len(g.deletions) && g.deletions[i].time.Before(cutoff) {
+		i++
+	}
+	g.deletions = g.deletions[i:]
+	total := 0
+	for _, d := range g.deletions {
+		total += d.records
+	}
+	return total
+}
+
+func (g *Guardrails) status(records int) GuardrailsStatus {
+	status := GuardrailsStatus{Records: records, Ready: true, HeldDeletions: []string{}}
+	if g == nil {
+		return status
+	}
+	g.lock.Lock()
+	status.MinRecords = g.MinRecords
+	status.MaxRecords = g.MaxRecords
+	status.MaxDeletes = g.MaxDeletes
+	status.RecentDeletes = g.recentDeletesLocked(time.Now())
+	for key := range g.held {
+		status.HeldDeletions = append(status.HeldDeletions, key)
+	}
+	g.lock.Unlock()
+	sort.Strings(status.HeldDeletions)
+
+	if err := g.checkRecordCount(records); err != nil {
+		status.Ready = false
+		status.NotReadyReason = err.Error()
+	} else if len(status.HeldDeletions) > 0 {
+		status.Ready = false
+		status.NotReadyReason = fmt.Sprintf("%d deletions held back", len(status.HeldDeletions))
+	}
+	return status
+}
+
+// GuardrailsStatus returns the current state of the record guardrails.
+func (kd *KubeDNS) GuardrailsStatus() GuardrailsStatus {
+	kd.cacheLock.RLock()
+	records := kd.recordCount
+	kd.cacheLock.RUnlock()
+	return kd.Guardrails.status(records)
+}
+
+// OverrideGuardrails applies every held deletion and resets the deletion
+// budget. It returns the number of deletions applied.
+func (kd *KubeDNS) OverrideGuardrails() int {
+	held := kd.Guardrails.release()
+	for _, deletion := range held {
+		service := deletion.service
+		if deletion.endpoints == nil {
+			klog.V(0).Infof("Guardrails override: applying held deletion of service %s/%s", service.Namespace, service.Name)
+			kd.deleteService(service)
+			continue
+		}
+		// The service may have been deleted or changed since.
+		svc, err := kd.getServiceFromEndpoints(deletion.endpoints)
+		if err != nil || svc == nil || util.IsServiceIPSet(svc) {
+			continue
+		}
+		klog.V(0).Infof("Guardrails override: applying held deletion of the endpoints of headless service %s/%s", service.Namespace, service.Name)
+		kd.deleteEndpointsRecords(deletion.endpoints, svc)
+	}
+	return len(held)
+}
+
+// setRecordCount updates the number of records generated for a service.
+// Must be called with the cacheLock held.
+func (kd *KubeDNS) setRecordCount(service *v1.Service, count int) {
+	key, err := kcache.MetaNamespaceKeyFunc(service)
+	if err != nil {
+		return
+	}
+	kd.recordCount += count - kd.recordCounts[key]
+	kd.setRecordOwner(key, service, count)
+	if count == 0 {
+		delete(kd.recordCounts, key)
+		return
+	}
+	kd.recordCounts[key] = count
+}
+
+// getRecordCount returns the number of records generated for a service.
+// Must be called with the cacheLock held.
+func (kd *KubeDNS) getRecordCount(service *v1.Service) int {
+	key, err := kcache.MetaNamespaceKeyFunc(service)
+	if err != nil {
+		return 0
+	}
+	return kd.recordCounts[key]
+}
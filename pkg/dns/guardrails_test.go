@@ -0,0 +1,143 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestGuardrailsRecordCount(t *testing.T) {
+	kd := newKubeDNS()
+	kd.Guardrails = NewGuardrails(2, 4, 0, time.Minute)
+
+	status := kd.GuardrailsStatus()
+	assert.False(t, status.Ready)
+	assert.Equal(t, 0, status.Records)
+	assert.Contains(t, status.NotReadyReason, "at least 2")
+
+	// A and SRV record.
+	s1 := newService(testNamespace, "svc1", "1.2.3.4", "http", 80)
+	kd.newService(s1)
+	status = kd.GuardrailsStatus()
+	assert.True(t, status.Ready)
+	assert.Equal(t, 2, status.Records)
+
+	s2 := newService(testNamespace, "svc2", "1.2.3.5", "http", 80)
+	s3 := newService(testNamespace, "svc3", "1.2.3.6", "", 80)
+	kd.newService(s2)
+	kd.newService(s3)
+	status = kd.GuardrailsStatus()
+	assert.False(t, status.Ready)
+	assert.Equal(t, 5, status.Records)
+	assert.Contains(t, status.NotReadyReason, "at most 4")
+
+	kd.removeService(s3)
+	status = kd.GuardrailsStatus()
+	assert.True(t, status.Ready)
+	assert.Equal(t, 4, status.Records)
+}
+
+func TestGuardrailsHoldDeletions(t *testing.T) {
+	kd := newKubeDNS()
+	kd.Guardrails = NewGuardrails(0, 0, 4, time.Minute)
+
+	var services []*v1.Service
+	for i := 0; i < 4; i++ {
+		s := newService(testNamespace, fmt.Sprintf("svc%d", i), fmt.Sprintf("1.2.3.%d", i+1), "http", 80)
+		kd.newService(s)
+		services = append(services, s)
+	}
+	assert.Equal(t, 8, kd.GuardrailsStatus().Records)
+
+	// The first two deletions fit the budget of 4 records.
+	kd.removeService(services[0])
+	kd.removeService(services[1])
+	assertNoDNSForClusterIP(t, kd, services[0])
+	assertNoDNSForClusterIP(t, kd, services[1])
+
+	// The next ones are held back.
+	kd.removeService(services[2])
+	kd.removeService(services[3])
+	assertDNSForClusterIP(t, "held", kd, services[2], []string{services[2].Spec.ClusterIP})
+	assertDNSForClusterIP(t, "held", kd, services[3], []string{services[3].Spec.ClusterIP})
+	status := kd.GuardrailsStatus()
+	assert.False(t, status.Ready)
+	assert.Equal(t, 4, status.RecentDeletes)
+	assert.Equal(t, []string{"default/svc2", "default/svc3"}, status.HeldDeletions)
+
+	// Seeing a service again cancels its held deletion.
+	kd.newService(services[3])
+	assert.Equal(t, []string{"default/svc2"}, kd.GuardrailsStatus().HeldDeletions)
+
+	assert.Equal(t, 1, kd.OverrideGuardrails())
+	assertNoDNSForClusterIP(t, kd, services[2])
+	assertDNSForClusterIP(t, "held", kd, services[3], []string{services[3].Spec.ClusterIP})
+	status = kd.GuardrailsStatus()
+	assert.True(t, status.Ready)
+	assert.Equal(t, 2, status.Records)
+	assert.Equal(t, 0, status.RecentDeletes)
+}
+
+func TestGuardrailsHoldEndpointsDeletions(t *testing.T) {
+	kd := newKubeDNS()
+	kd.Guardrails = NewGuardrails(0, 0, 1, time.Minute)
+
+	service := newHeadlessService()
+	endpoints := newEndpoints(service, newSubsetWithOnePort("", 0, "10.0.0.1", "10.0.0.2"))
+	assert.NoError(t, kd.servicesStore.Add(service))
+	assert.NoError(t, kd.endpointsStore.Add(endpoints))
+	kd.newService(service)
+	assertDNSForHeadlessService(t, kd, endpoints)
+
+	// Removing the records of the endpoints is held back like a service
+	// deletion.
+	kd.handleEndpointDelete(endpoints)
+	assertDNSForHeadlessService(t, kd, endpoints)
+	assert.Equal(t, []string{"default/" + testService}, kd.GuardrailsStatus().HeldDeletions)
+
+	// Updating the service does not cancel it, seeing the endpoints again
+	// does.
+	kd.newService(service)
+	assert.Equal(t, []string{"default/" + testService}, kd.GuardrailsStatus().HeldDeletions)
+	kd.handleEndpointAdd(endpoints)
+	assert.Empty(t, kd.GuardrailsStatus().HeldDeletions)
+
+	kd.handleEndpointDelete(endpoints)
+	assertDNSForHeadlessService(t, kd, endpoints)
+	assert.Equal(t, 1, kd.OverrideGuardrails())
+	assertNoDNSForHeadlessService(t, kd, service)
+	status := kd.GuardrailsStatus()
+	assert.True(t, status.Ready)
+	assert.Equal(t, 0, status.Records)
+}
+
+func TestGuardrailsDisabled(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	kd.newService(s)
+	status := kd.GuardrailsStatus()
+	assert.True(t, status.Ready)
+	assert.Equal(t, 2, status.Records)
+	kd.removeService(s)
+	assertNoDNSForClusterIP(t, kd, s)
+	assert.Equal(t, 0, kd.OverrideGuardrails())
+}
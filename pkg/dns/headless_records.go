@@ -0,0 +1,140 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/dns/pkg/dns/treecache"
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// headlessRecord is a record of the subcache of a headless service.
+type headlessRecord struct {
+	// name is the key of the record, under path in the subcache.
+	name  string
+	path  []string
+	value *skymsg.Service
+}
+
+// headlessRecords are the records of a headless service as last published.
+// The next update of its endpoints is diffed against them, so that only the
+// records of the addresses that changed are written to the subcache, e.g. a
+// single record when one pod of a large service is replaced.
+type headlessRecords struct {
+	// lock serializes the updates of the service, e.g. by a service and
+	// an endpoints event.
+	lock sync.Mutex
+	// subCache holds records, by FQDN. It is copied on write once
+	// published, so it is updated while the queries read it.
+	subCache treecache.TreeCache
+	records  map[string]headlessRecord
+}
+
+// endpointAddress is an address of an endpoint of a headless service, and
+// its hostname, if any.
+type endpointAddress struct {
+	ip       string
+	hostname string
+}
+
+// endpointHostnames returns the hostname of the records of each address, by
+// IP, empty for the name generated from the IP. The same address may be
+// listed several times, e.g. in several subsets or slices with different
+// ports during a rollout, with or without hostname: it takes the first of
+// its hostnames in sorted order. A hostname listed for several addresses,
+// e.g. while a pod is replaced, goes to the first of them in sorted order,
+// the others get generated names. The records thus have a single name per
+// address, which does not depend on the order of the subsets.
+func endpointHostnames(addresses []endpointAddress) map[string]string {
+	hostnames := make(map[string]string, len(addresses))
+	for _, address := range addresses {
+		hostname, ok := hostnames[address.ip]
+		if !ok || address.hostname != "" && (hostname == "" || address.hostname < hostname) {
+			hostnames[address.ip] = address.hostname
+		}
+	}
+	owners := make(map[string]string)
+	for ip, hostname := range hostnames {
+		if owner, ok := owners[hostname]; hostname != "" && (!ok || ip < owner) {
+			owners[hostname] = ip
+		}
+	}
+	for ip, hostname := range hostnames {
+		if hostname != "" && owners[hostname] != ip {
+			hostnames[ip] = ""
+		}
+	}
+	return hostnames
+}
+
+// headlessRecordsOf returns the published records of the headless service,
+// which the caller must lock.
+func (kd *KubeDNS) headlessRecordsOf(service *v1.Service) *headlessRecords {
+	key := service.Namespace + "/" + service.Name
+	kd.headlessRecordsLock.Lock()
+	defer kd.headlessRecordsLock.Unlock()
+	if kd.headlessRecords == nil {
+		kd.headlessRecords = make(map[string]*headlessRecords)
+	}
+	records, ok := kd.headlessRecords[key]
+	if !ok {
+		records = &headlessRecords{}
+		kd.headlessRecords[key] = records
+	}
+	return records
+}
+
+// forgetHeadlessRecords drops the published records of the service, once
+// it is deleted or no longer headless.
+func (kd *KubeDNS) forgetHeadlessRecords(service *v1.Service) {
+	kd.headlessRecordsLock.Lock()
+	defer kd.headlessRecordsLock.Unlock()
+	delete(kd.headlessRecords, service.Namespace+"/"+service.Name)
+}
+
+// update writes the records that differ from the published ones to the
+// subcache, and returns it.
+func (h *headlessRecords) update(records map[string]headlessRecord) treecache.TreeCache {
+	if h.subCache == nil {
+		h.subCache = treecache.NewTreeCache()
+	}
+	for fqdn, record := range h.records {
+		if _, ok := records[fqdn]; !ok {
+			h.subCache.DeletePath(append(record.path[:len(record.path):len(record.path)], record.name)...)
+		}
+	}
+	for fqdn, record := range records {
+		if published, ok := h.records[fqdn]; ok && sameRecord(published.value, record.value) {
+			// The published value, whose Key is set, is kept.
+			records[fqdn] = published
+			continue
+		}
+		h.subCache.SetEntry(record.name, record.value, fqdn, record.path...)
+	}
+	h.records = records
+	return h.subCache
+}
+
+// sameRecord returns whether the records are equal, but for their Key,
+// which is set when they are written to a cache.
+func sameRecord(a, b *skymsg.Service) bool {
+	c := *a
+	c.Key = b.Key
+	return c == *b
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/dns/pkg/dns/util"
+)
+
+func TestHeadlessRecordsDiff(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	e := newEndpoints(s, newSubsetWithOnePort("http", 80, "10.0.0.1", "10.0.0.2", "10.0.0.3"))
+	require.NoError(t, kd.servicesStore.Add(s))
+	require.NoError(t, kd.endpointsStore.Add(e))
+	kd.newService(s)
+
+	label := func(ip string) string {
+		_, label := util.GetSkyMsg(ip, 0)
+		return label
+	}
+	published := kd.headlessRecordsOf(s)
+	kept := published.records[kd.fqdn(s, label("10.0.0.1"))].value
+	require.NotNil(t, kept)
+
+	// One pod is replaced: only its records are written.
+	updated := e.DeepCopy()
+	updated.Subsets = []v1.EndpointSubset{newSubsetWithOnePort("http", 80, "10.0.0.1", "10.0.0.2", "10.0.0.4")}
+	require.NoError(t, kd.endpointsStore.Update(updated))
+	kd.handleEndpointUpdate(e, updated)
+	assertDNSForHeadlessService(t, kd, updated)
+	assertSRVForHeadlessService(t, kd, s, updated)
+	assert.Same(t, kept, published.records[kd.fqdn(s, label("10.0.0.1"))].value)
+	assert.NotContains(t, published.records, kd.fqdn(s, label("10.0.0.3")))
+	assert.Contains(t, published.records, kd.fqdn(s, "_tcp", "_http", label("10.0.0.4")))
+	_, err := kd.Records(kd.fqdn(s, label("10.0.0.3")), true)
+	assert.Error(t, err)
+
+	// A change of the port rewrites the SRV records.
+	ported := updated.DeepCopy()
+	ported.Subsets = []v1.EndpointSubset{newSubsetWithOnePort("http", 8080, "10.0.0.1", "10.0.0.2", "10.0.0.4")}
+	require.NoError(t, kd.endpointsStore.Update(ported))
+	kd.handleEndpointUpdate(updated, ported)
+	assertSRVForHeadlessService(t, kd, s, ported)
+	assert.Same(t, kept, published.records[kd.fqdn(s, label("10.0.0.1"))].value)
+
+	// The published records are dropped with the service.
+	kd.removeService(s)
+	kd.headlessRecordsLock.Lock()
+	assert.Empty(t, kd.headlessRecords)
+	kd.headlessRecordsLock.Unlock()
+}
+
+func TestEndpointHostnames(t *testing.T) {
+	for _, testCase := range []struct {
+		name      string
+		addresses []endpointAddress
+		want      map[string]string
+	}{
+		{
+			name:      "listed once",
+			addresses: []endpointAddress{{"10.0.0.1", "web-0"}, {"10.0.0.2", ""}},
+			want:      map[string]string{"10.0.0.1": "web-0", "10.0.0.2": ""},
+		},
+		{
+			name:      "listed with and without hostname",
+			addresses: []endpointAddress{{"10.0.0.1", ""}, {"10.0.0.1", "web-1"}, {"10.0.0.1", "web-0"}},
+			want:      map[string]string{"10.0.0.1": "web-0"},
+		},
+		{
+			name:      "hostname of several addresses",
+			addresses: []endpointAddress{{"10.0.0.2", "web-0"}, {"10.0.0.1", "web-0"}},
+			want:      map[string]string{"10.0.0.1": "web-0", "10.0.0.2": ""},
+		},
+	} {
+		assert.Equal(t, testCase.want, endpointHostnames(testCase.addresses), testCase.name)
+		reversed := make([]endpointAddress, 0, len(testCase.addresses))
+		for i := len(testCase.addresses) - 1; i >= 0; i-- {
+			reversed = append(reversed, testCase.addresses[i])
+		}
+		assert.Equal(t, testCase.want, endpointHostnames(reversed), "%s, reversed", testCase.name)
+	}
+}
+
+func TestHeadlessServiceDuplicateAddresses(t *testing.T) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	// The pods are listed in two subsets, as during a rollout adding a
+	// port, and one of them has a hostname in one of the subsets only.
+	rolledOut := newSubsetWithTwoPorts("http", 80, "metrics", 9090, "10.0.0.1", "10.0.0.2")
+	rolling := newSubsetWithOnePort("http", 80, "10.0.0.1", "10.0.0.2")
+	rolling.Addresses[0].Hostname = "web-0"
+	e := newEndpoints(s, rolledOut, rolling)
+	require.NoError(t, kd.servicesStore.Add(s))
+	require.NoError(t, kd.endpointsStore.Add(e))
+	kd.newService(s)
+
+	records, err := kd.Records(getEndpointsFQDN(kd, e), false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.2"}, hosts(records))
+
+	_, label := util.GetSkyMsg("10.0.0.2", 0)
+	for _, port := range []string{"http", "metrics"} {
+		records, err = kd.Records(getSRVFQDN(kd, s, port), false)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{kd.fqdn(s, "web-0"), kd.fqdn(s, label)}, hosts(records), port)
+	}
+	reverse, err := kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, kd.fqdn(s, "web-0"), reverse.Host)
+	assert.Equal(t, 6, kd.recordCounts[testNamespace+"/"+testService])
+
+	// The records do not depend on the order of the subsets.
+	published := kd.headlessRecordsOf(s).records
+	reordered := newEndpoints(s, rolling, rolledOut)
+	require.NoError(t, kd.endpointsStore.Update(reordered))
+	kd.handleEndpointUpdate(e, reordered)
+	assert.Equal(t, published, kd.headlessRecordsOf(s).records)
+}
+
+func TestEndpointNamingIP(t *testing.T) {
+	kd := newKubeDNS()
+	kd.EndpointNaming = EndpointNamingIP
+	kd.HeadlessReverseRecords = HeadlessReverseRecordsEndpoint
+	s := newHeadlessService()
+	subset := newSubsetWithOnePort("http", 80, "10.0.0.1", "fd00::2", "10.0.0.3")
+	subset.Addresses[2].Hostname = "web-0"
+	e := newEndpoints(s, subset)
+	require.NoError(t, kd.servicesStore.Add(s))
+	require.NoError(t, kd.endpointsStore.Add(e))
+	kd.newService(s)
+
+	records, err := kd.Records(getSRVFQDN(kd, s, "http"), false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{kd.fqdn(s, "10-0-0-1"), kd.fqdn(s, "fd00--2"), kd.fqdn(s, "web-0")}, hosts(records))
+	records, err = kd.Records(kd.fqdn(s, "fd00--2"), false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"fd00::2"}, hosts(records))
+	reverse, err := kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	assert.Equal(t, kd.fqdn(s, "10-0-0-1"), reverse.Host)
+
+	// The names do not change with the ports.
+	updated := newEndpoints(s, newSubsetWithTwoPorts("http", 8080, "metrics", 9090, "10.0.0.1"))
+	require.NoError(t, kd.endpointsStore.Update(updated))
+	kd.handleEndpointUpdate(e, updated)
+	records, err = kd.Records(getSRVFQDN(kd, s, "metrics"), false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{kd.fqdn(s, "10-0-0-1")}, hosts(records))
+}
+
+func BenchmarkHeadlessEndpointsUpdate(b *testing.B) {
+	kd := newKubeDNS()
+	s := newHeadlessService()
+	var ips []string
+	for i := 0; i < 1000; i++ {
+		ips = append(ips, fmt.Sprintf("10.1.%d.%d", i/250, i%250+1))
+	}
+	e := newEndpoints(s, newSubsetWithOnePort("http", 80, ips...))
+	require.NoError(b, kd.servicesStore.Add(s))
+	require.NoError(b, kd.endpointsStore.Add(e))
+	kd.newService(s)
+
+	// Every update replaces one pod.
+	replaced := e.DeepCopy()
+	replaced.Subsets[0].Addresses[0].IP = "10.2.0.1"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		old, new := e, replaced
+		if i%2 == 1 {
+			old, new = replaced, e
+		}
+		kd.handleEndpointUpdate(old, new)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/util"
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+var (
+	inventoryRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kubedns",
+		Subsystem: "inventory",
+		Name:      "records",
+		Help:      "Number of records served, by type: A, AAAA, SRV, CNAME, TXT or PTR.",
+	}, []string{"type"})
+	inventoryServices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kubedns",
+		Subsystem: "inventory",
+		Name:      "services",
+		Help:      "Number of services in the services store, by type: ClusterIP, headless or ExternalName.",
+	}, []string{"type"})
+	inventoryNamespaceRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kubedns",
+		Subsystem: "inventory",
+		Name:      "namespace_records",
+		Help:      "Number of records generated for the services of each namespace.",
+	}, []string{"namespace"})
+	registerInventoryMetrics sync.Once
+)
+
+// The record types of the inventory.
+var inventoryRecordTypes = []string{"A", "AAAA", "SRV", "CNAME", "TXT", "PTR"}
+
+// The service types of the inventory.
+const (
+	inventoryClusterIP    = "ClusterIP"
+	inventoryHeadless     = "headless"
+	inventoryExternalName = "ExternalName"
+)
+
+// Inventory counts the records served and the services they are generated
+// from.
+type Inventory struct {
+	// Records maps the record types, e.g. AAAA, to the number of records
+	// of that type. The pod records, generated when queried, are not
+	// counted.
+	Records map[string]int
+	// Services maps the service types, ClusterIP, headless or
+	// ExternalName, to the number of services of that type. The NodePort
+	// and LoadBalancer services are ClusterIP services.
+	Services map[string]int
+	// Namespaces maps the namespaces to the number of records generated
+	// for their services.
+	Namespaces map[string]int
+}
+
+// recordType returns the type of the record answered for value in the
+// forward zones, like RecordEvent.RR.
+func recordType(value *skymsg.Service) string {
+	if value.Text != "" {
+		return "TXT"
+	}
+	if value.Port != 0 {
+		return "SRV"
+	}
+	switch ip := net.ParseIP(value.Host); {
+	case ip == nil:
+		return "CNAME"
+	case ip.To4() != nil:
+		return "A"
+	default:
+		return "AAAA"
+	}
+}
+
+// TakeInventory counts the records served and the services. It walks every
+// record, but does not block the queries.
+func (kd *KubeDNS) TakeInventory() Inventory {
+	inventory := Inventory{
+		Records:    make(map[string]int),
+		Services:   make(map[string]int),
+		Namespaces: make(map[string]int),
+	}
+	kd.RangeRecords(func(_ string, records []*skymsg.Service) bool {
+		for _, record := range records {
+			inventory.Records[recordType(record)]++
+		}
+		return true
+	})
+	inventory.Records["PTR"] = kd.ipShards.len()
+
+	for _, obj := range kd.servicesStore.List() {
+		service, ok := obj.(*v1.Service)
+		if !ok {
+			continue
+		}
+		switch {
+		case service.Spec.Type == v1.ServiceTypeExternalName:
+			inventory.Services[inventoryExternalName]++
+		case util.IsServiceIPSet(service):
+			inventory.Services[inventoryClusterIP]++
+		default:
+			inventory.Services[inventoryHeadless]++
+		}
+	}
+
+	kd.cacheLock.RLock()
+	for key, count := range kd.recordCounts {
+		if namespace, _, err := kcache.SplitMetaNamespaceKey(key); err == nil {
+			inventory.Namespaces[namespace] += count
+		}
+	}
+	kd.cacheLock.RUnlock()
+	return inventory
+}
+
+// runInventory periodically exports the inventory until stopCh is closed.
+func (kd *KubeDNS) runInventory(stopCh <-chan struct{}) {
+	registerInventoryMetrics.Do(func() {
+		prometheus.MustRegister(inventoryRecords, inventoryServices, inventoryNamespaceRecords)
+	})
+	klog.V(0).Infof("Exporting the inventory of the records every %v", kd.InventoryInterval)
+	namespaces := sets.NewString()
+	wait.Until(func() { namespaces = kd.exportInventory(namespaces) }, kd.InventoryInterval, stopCh)
+}
+
+// exportInventory sets the inventory metrics, removing those of the
+// namespaces last exported that no longer have records. It returns the
+// namespaces exported.
+func (kd *KubeDNS) exportInventory(last sets.String) sets.String {
+	start := time.Now()
+	inventory := kd.TakeInventory()
+	for _, t := range inventoryRecordTypes {
+		inventoryRecords.WithLabelValues(t).Set(float64(inventory.Records[t]))
+	}
+	for _, t := range []string{inventoryClusterIP, inventoryHeadless, inventoryExternalName} {
+		inventoryServices.WithLabelValues(t).Set(float64(inventory.Services[t]))
+	}
+	namespaces := sets.NewString()
+	for namespace, count := range inventory.Namespaces {
+		inventoryNamespaceRecords.WithLabelValues(namespace).Set(float64(count))
+		namespaces.Insert(namespace)
+	}
+	for _, namespace := range last.Difference(namespaces).List() {
+		inventoryNamespaceRecords.DeleteLabelValues(namespace)
+	}
+	klog.V(4).Infof("Took the inventory of the records in %v: %+v", time.Since(start), inventory)
+	return namespaces
+}
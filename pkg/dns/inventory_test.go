@@ -0,0 +1,58 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestTakeInventory(t *testing.T) {
+	kd := newKubeDNS()
+	dualStack := newService(testNamespace, "web", "10.0.0.1", "http", 80)
+	dualStack.Spec.ClusterIPs = []string{"10.0.0.1", "2001:db8::1"}
+	headless := newHeadlessService()
+	external := newService("other", "db", "", "", 0)
+	external.Spec.Type = v1.ServiceTypeExternalName
+	external.Spec.ExternalName = "db.example.com"
+	for _, service := range []*v1.Service{dualStack, headless, external} {
+		require.NoError(t, kd.servicesStore.Add(service))
+	}
+	require.NoError(t, kd.endpointsStore.Add(newEndpoints(headless, newSubsetWithOnePort("", 80, "10.0.1.1", "10.0.1.2"))))
+	for _, service := range []*v1.Service{dualStack, headless, external} {
+		kd.newService(service)
+	}
+
+	inventory := kd.TakeInventory()
+	assert.Equal(t, map[string]int{inventoryClusterIP: 1, inventoryHeadless: 1, inventoryExternalName: 1}, inventory.Services)
+	// The A and AAAA records of web and the A records of the endpoints of
+	// the headless service, the SRV records of web, one per ClusterIP, the
+	// CNAME record of db and the PTR records of the ClusterIPs.
+	assert.Equal(t, map[string]int{"A": 3, "AAAA": 1, "SRV": 2, "CNAME": 1, "PTR": 2}, inventory.Records)
+	assert.Equal(t, kd.recordCounts["default/web"]+kd.recordCounts["default/"+testService], inventory.Namespaces[testNamespace])
+	assert.Equal(t, 1, inventory.Namespaces["other"])
+
+	// The namespaces without records are no longer exported.
+	namespaces := kd.exportInventory(sets.NewString())
+	assert.Equal(t, []string{"default", "other"}, namespaces.List())
+	kd.removeService(external)
+	assert.Equal(t, []string{"default"}, kd.exportInventory(namespaces).List())
+}
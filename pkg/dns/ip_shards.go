@@ -0,0 +1,279 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sort"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/dns/pkg/dns/treecache"
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// ipShardCount is the number of shards of ipShards.
+const ipShardCount = 64
+
+// ipShards holds the reverse records of the cluster and endpoint IPs and the
+// services of the cluster IPs. They are hash-sharded by IP, each shard with
+// its own lock instead of cacheLock: updating the records of many IPs, e.g.
+// of the endpoints of a large headless service, only ever locks one shard at
+// a time, and the PTR queries do not wait for the other updates of the
+// cache.
+//
+// The records of the names, in cache, are not sharded: with the
+// COWTreeCache feature gate, on by default, the queries read the snapshots
+// of the cache published, see cacheView, without cacheLock, so that the
+// update of a namespace never stalls the queries for the others, and only
+// the writers wait for each other.
+type ipShards [ipShardCount]ipShard
+
+type ipShard struct {
+	lock sync.RWMutex
+	// reverseRecords maps the canonical form of the IPs, see
+	// reverseRecordKey, to their PTR records, one per service owning the
+	// IP, e.g. services sharing an external IP or headless services with
+	// overlapping endpoints. They are sorted by owner.
+	reverseRecords map[string][]ownedReverseRecord
+	// services maps the cluster IPs to their service, every IP of
+	// Spec.ClusterIPs so that the IPs of both families of dual-stack
+	// services are found. Headless services are not part of it.
+	services map[string]*v1.Service
+}
+
+// ownedReverseRecord is the PTR record of an IP for one of its services.
+type ownedReverseRecord struct {
+	// owner is the namespace/name key of the service.
+	owner  string
+	record *skymsg.Service
+}
+
+// reverseRecordOwner returns the key of service among the owners of the
+// reverse records.
+func reverseRecordOwner(service *v1.Service) string {
+	return service.Namespace + "/" + service.Name
+}
+
+func newIPShards() *ipShards {
+	shards := &ipShards{}
+	for i := range shards {
+		shards[i].reverseRecords = make(map[string][]ownedReverseRecord)
+		shards[i].services = make(map[string]*v1.Service)
+	}
+	return shards
+}
+
+// shard returns the shard of the IP with the given canonical form.
+func (shards *ipShards) shard(key string) *ipShard {
+	// FNV-1a.
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return &shards[hash%ipShardCount]
+}
+
+// reverseRecord returns the first reverse record of ip, nil if there is
+// none.
+func (shards *ipShards) reverseRecord(ip string) *skymsg.Service {
+	key := reverseRecordKey(ip)
+	shard := shards.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	if records := shard.reverseRecords[key]; len(records) > 0 {
+		return records[0].record
+	}
+	return nil
+}
+
+// reverseRecords returns the reverse records of ip, in the order of their
+// owners.
+func (shards *ipShards) reverseRecords(ip string) []*skymsg.Service {
+	key := reverseRecordKey(ip)
+	shard := shards.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	owned := shard.reverseRecords[key]
+	if len(owned) == 0 {
+		return nil
+	}
+	records := make([]*skymsg.Service, len(owned))
+	for i := range owned {
+		records[i] = owned[i].record
+	}
+	return records
+}
+
+// setReverseRecord sets the reverse record of the endpoint ip for owner,
+// keeping those of its other services.
+func (shards *ipShards) setReverseRecord(ip string, owner *v1.Service, record *skymsg.Service) {
+	key := reverseRecordKey(ip)
+	shard := shards.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	shard.setReverseRecord(key, reverseRecordOwner(owner), record)
+}
+
+// deleteReverseRecord removes the reverse record of the endpoint ip for
+// owner, keeping those of its other services.
+func (shards *ipShards) deleteReverseRecord(ip string, owner *v1.Service) {
+	key := reverseRecordKey(ip)
+	shard := shards.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	shard.deleteReverseRecord(key, reverseRecordOwner(owner))
+}
+
+// setReverseRecord sets the reverse record of owner for the IP key. The
+// shard must be locked.
+func (shard *ipShard) setReverseRecord(key, owner string, record *skymsg.Service) {
+	records := shard.reverseRecords[key]
+	i := sort.Search(len(records), func(i int) bool { return records[i].owner >= owner })
+	if i < len(records) && records[i].owner == owner {
+		records[i].record = record
+		return
+	}
+	records = append(records, ownedReverseRecord{})
+	copy(records[i+1:], records[i:])
+	records[i] = ownedReverseRecord{owner: owner, record: record}
+	shard.reverseRecords[key] = records
+}
+
+// deleteReverseRecord removes the reverse record of owner for the IP key.
+// The shard must be locked.
+func (shard *ipShard) deleteReverseRecord(key, owner string) {
+	records := shard.reverseRecords[key]
+	i := sort.Search(len(records), func(i int) bool { return records[i].owner >= owner })
+	if i == len(records) || records[i].owner != owner {
+		return
+	}
+	if len(records) == 1 {
+		delete(shard.reverseRecords, key)
+		return
+	}
+	shard.reverseRecords[key] = append(records[:i], records[i+1:]...)
+}
+
+// service returns the service of the cluster ip, nil if there is none.
+func (shards *ipShards) service(ip string) *v1.Service {
+	key := reverseRecordKey(ip)
+	shard := shards.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	return shard.services[key]
+}
+
+// setService sets the service of the cluster ip and its reverse record.
+func (shards *ipShards) setService(ip string, service *v1.Service, record *skymsg.Service) {
+	key := reverseRecordKey(ip)
+	shard := shards.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	shard.services[key] = service
+	shard.setReverseRecord(key, reverseRecordOwner(service), record)
+}
+
+// deleteService removes the reverse record of owner for the cluster ip,
+// and the service of the ip if it is still owner, and not reallocated to
+// another service. It returns whether the ip was still owner's.
+func (shards *ipShards) deleteService(ip string, owner *v1.Service) bool {
+	key := reverseRecordKey(ip)
+	shard := shards.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	shard.deleteReverseRecord(key, reverseRecordOwner(owner))
+	service, ok := shard.services[key]
+	if !ok || service.Namespace != owner.Namespace || service.Name != owner.Name {
+		return false
+	}
+	delete(shard.services, key)
+	return true
+}
+
+// deleteOrphans removes the reverse records whose owner exists returns
+// false for, and the cluster IPs of that owner. exists is called with the
+// shard locked, so that the records set meanwhile, once their service is
+// in the store, are kept. It returns the number of records removed.
+func (shards *ipShards) deleteOrphans(exists func(owner string) bool) int {
+	removed := 0
+	for i := range shards {
+		shard := &shards[i]
+		shard.lock.Lock()
+		for key, records := range shard.reverseRecords {
+			var orphans []string
+			for _, owned := range records {
+				if !exists(owned.owner) {
+					orphans = append(orphans, owned.owner)
+				}
+			}
+			for _, owner := range orphans {
+				shard.deleteReverseRecord(key, owner)
+				if service, ok := shard.services[key]; ok && reverseRecordOwner(service) == owner {
+					delete(shard.services, key)
+				}
+				removed++
+			}
+		}
+		shard.lock.Unlock()
+	}
+	return removed
+}
+
+// len returns the number of reverse records.
+func (shards *ipShards) len() int {
+	n := 0
+	for i := range shards {
+		shard := &shards[i]
+		shard.lock.RLock()
+		for _, records := range shard.reverseRecords {
+			n += len(records)
+		}
+		shard.lock.RUnlock()
+	}
+	return n
+}
+
+// ipShardEntryOverhead estimates the bytes the maps of a shard spend per
+// entry besides the bytes of its key and record, see treecache.EstimateSize.
+const ipShardEntryOverhead = 16 + 16 + 8
+
+// ipShardRecordOverhead is the bytes of an ownedReverseRecord besides those
+// of its owner and record.
+const ipShardRecordOverhead = 16 + 8
+
+// estimateSize returns an estimate of the bytes of memory held by the
+// reverse records and the cluster IPs. The services are not counted, the
+// informer holds them.
+func (shards *ipShards) estimateSize() int64 {
+	var size int64
+	for i := range shards {
+		shard := &shards[i]
+		shard.lock.RLock()
+		for key, records := range shard.reverseRecords {
+			size += int64(len(key)) + ipShardEntryOverhead
+			for _, owned := range records {
+				size += int64(len(owned.owner)) + ipShardRecordOverhead + treecache.ServiceSize(owned.record)
+			}
+		}
+		for key := range shard.services {
+			size += int64(len(key)) + ipShardEntryOverhead
+		}
+		shard.lock.RUnlock()
+	}
+	return size
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/dns/pkg/dns/util"
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+func TestIPShards(t *testing.T) {
+	shards := newIPShards()
+	a := newService(testNamespace, "a", "2001:db8::1", "", 0)
+	b := newService(testNamespace, "b", "2001:db8::1", "", 0)
+	record, _ := util.GetSkyMsg("a.default.svc.cluster.local.", 0)
+
+	// The IPs are found in any form.
+	shards.setService("2001:DB8:0:0:0:0:0:1", a, record)
+	assert.Same(t, a, shards.service("2001:db8::1"))
+	assert.Same(t, record, shards.reverseRecord("2001:0db8::0001"))
+
+	// The IP was reallocated to b, it is not removed as a's.
+	recordB, _ := util.GetSkyMsg("b.default.svc.cluster.local.", 0)
+	shards.setService("2001:db8::1", b, recordB)
+	assert.False(t, shards.deleteService("2001:db8::1", a))
+	assert.Same(t, b, shards.service("2001:db8::1"))
+	assert.Equal(t, []*skymsg.Service{recordB}, shards.reverseRecords("2001:db8::1"))
+	assert.True(t, shards.deleteService("2001:db8::1", b))
+	assert.Nil(t, shards.service("2001:db8::1"))
+	assert.Nil(t, shards.reverseRecord("2001:db8::1"))
+
+	shards.setReverseRecord("10.0.0.1", a, record)
+	assert.Equal(t, 1, shards.len())
+	assert.Nil(t, shards.service("10.0.0.1"), "endpoints have no service")
+	shards.deleteReverseRecord("10.0.0.1", a)
+	assert.Zero(t, shards.len())
+}
+
+func TestIPShardsReverseRecordsPerOwner(t *testing.T) {
+	shards := newIPShards()
+	a := newService(testNamespace, "a", "None", "", 0)
+	b := newService(testNamespace, "b", "None", "", 0)
+	recordA, _ := util.GetSkyMsg("a.default.svc.cluster.local.", 0)
+	recordB, _ := util.GetSkyMsg("b.default.svc.cluster.local.", 0)
+
+	// The records are in the order of their owners, whatever the order
+	// they are set in.
+	shards.setReverseRecord("10.0.0.1", b, recordB)
+	shards.setReverseRecord("10.0.0.1", a, recordA)
+	assert.Equal(t, []*skymsg.Service{recordA, recordB}, shards.reverseRecords("10.0.0.1"))
+	assert.Same(t, recordA, shards.reverseRecord("10.0.0.1"))
+	assert.Equal(t, 2, shards.len())
+
+	// Setting the record of an owner again replaces it.
+	shards.setReverseRecord("10.0.0.1", b, recordA)
+	assert.Equal(t, []*skymsg.Service{recordA, recordA}, shards.reverseRecords("10.0.0.1"))
+
+	shards.deleteReverseRecord("10.0.0.1", a)
+	assert.Equal(t, []*skymsg.Service{recordA}, shards.reverseRecords("10.0.0.1"))
+	shards.deleteReverseRecord("10.0.0.1", a)
+	assert.Equal(t, 1, shards.len(), "b's record is kept")
+	shards.deleteReverseRecord("10.0.0.1", b)
+	assert.Nil(t, shards.reverseRecords("10.0.0.1"))
+	assert.Zero(t, shards.len())
+}
+
+func TestReverseRecordsDoNotWaitForWriters(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "10.0.0.1", "", 0)
+	require.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+
+	kd.cacheLock.Lock()
+	defer kd.unlockCache()
+	done := make(chan error)
+	go func() {
+		_, err := kd.ReverseRecord("1.0.0.10.in-addr.arpa.")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Error("ReverseRecord waited for cacheLock")
+	}
+}
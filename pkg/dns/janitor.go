@@ -0,0 +1,192 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+var (
+	orphanedRecordsPurged = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "kubedns",
+		Subsystem: "janitor",
+		Name:      "orphaned_records_purged_total",
+		Help:      "Number of records purged because the service owning them no longer exists.",
+	})
+	cacheDiscrepancies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kubedns",
+		Subsystem: "janitor",
+		Name:      "discrepancies_total",
+		Help:      "Number of names and reverse records found in the cache without the service they were generated from, and removed, by kind.",
+	}, []string{"kind"})
+	registerJanitorMetrics sync.Once
+)
+
+// recordOwner is the service whose records are in the cache, and when they
+// were last written.
+type recordOwner struct {
+	service *v1.Service
+	updated time.Time
+}
+
+// setRecordOwner records that the records of service were just written, or
+// removed if count is 0. Must be called with the cacheLock held.
+func (kd *KubeDNS) setRecordOwner(key string, service *v1.Service, count int) {
+	if count == 0 {
+		delete(kd.recordOwners, key)
+		return
+	}
+	kd.recordOwners[key] = recordOwner{service: service, updated: time.Now()}
+}
+
+func registerJanitorMetric() {
+	registerJanitorMetrics.Do(func() { prometheus.MustRegister(orphanedRecordsPurged, cacheDiscrepancies) })
+}
+
+// runJanitor periodically purges the orphaned records, then sweeps the
+// cache for those purgeOrphans does not know of, until stopCh is closed.
+func (kd *KubeDNS) runJanitor(stopCh <-chan struct{}) {
+	registerJanitorMetric()
+	klog.V(0).Infof("Purging orphaned records every %v", kd.JanitorInterval)
+	wait.Until(func() {
+		kd.purgeOrphans(time.Now().Add(-kd.JanitorInterval))
+		kd.sweepCache()
+	}, kd.JanitorInterval, stopCh)
+}
+
+// purgeOrphans removes the records of the services that no longer exist in
+// the services store, e.g. because their delete event was missed. Records
+// written after notBefore are left alone, as the store may not reflect them
+// yet. Deletions go through the guardrails like any other. It returns the
+// number of records purged.
+func (kd *KubeDNS) purgeOrphans(notBefore time.Time) int {
+	type orphan struct {
+		key     string
+		uid     types.UID
+		service *v1.Service
+	}
+	var orphans []orphan
+	kd.cacheLock.RLock()
+	for key, owner := range kd.recordOwners {
+		if owner.updated.After(notBefore) {
+			continue
+		}
+		if _, exists, err := kd.servicesStore.GetByKey(key); err == nil && !exists {
+			orphans = append(orphans, orphan{key: key, uid: owner.service.UID, service: owner.service})
+		}
+	}
+	kd.cacheLock.RUnlock()
+
+	purged := 0
+	for _, o := range orphans {
+		records := 0
+		purge := kd.deleteServiceUnless(o.service, func() bool {
+			// Checked again with the cacheLock held: the service was
+			// deleted, written again or created again in the meantime.
+			owner, ok := kd.recordOwners[o.key]
+			if !ok || owner.service.UID != o.uid || owner.updated.After(notBefore) || kd.serviceExists(o.key) {
+				return true
+			}
+			records = kd.recordCounts[o.key]
+			return !kd.Guardrails.allowDelete(o.service, records)
+		})
+		if purge {
+			klog.Warningf("Purged %d orphaned records of service %s, which no longer exists", records, o.key)
+			purged += records
+		}
+	}
+	orphanedRecordsPurged.Add(float64(purged))
+	return purged
+}
+
+// sweepCache compares the cache itself against the services store, rather
+// than the owners of the records purgeOrphans goes through: it removes the
+// names of the svc subdomain and the reverse records of the services that
+// neither exist nor own records, e.g. left behind by a path that did not
+// account for them. The services owning records are left to purgeOrphans
+// and its guardrails, the aliases and the canary record have no service of
+// their own. It returns the number of names and reverse records removed.
+func (kd *KubeDNS) sweepCache() int {
+	suffix := "." + serviceSubdomain + "." + dns.Fqdn(kd.domain)
+	keys := sets.NewString()
+	kd.RangeRecords(func(fqdn string, _ []*skymsg.Service) bool {
+		if !strings.HasSuffix(fqdn, suffix) {
+			return true
+		}
+		// e.g. [_http _tcp web default] for _http._tcp.web.default.svc.
+		labels := strings.Split(strings.TrimSuffix(fqdn, suffix), ".")
+		if len(labels) >= 2 {
+			keys.Insert(labels[len(labels)-1] + "/" + labels[len(labels)-2])
+		}
+		return true
+	})
+
+	canaryKey := canaryNamespace + "/" + CanaryName
+	owned := sets.NewString(canaryKey)
+	kd.cacheLock.RLock()
+	for key := range kd.recordOwners {
+		owned.Insert(key)
+	}
+	kd.cacheLock.RUnlock()
+
+	removed := 0
+	for _, key := range keys.List() {
+		if owned.Has(key) || kd.serviceExists(key) {
+			continue
+		}
+		namespace, name, err := kcache.SplitMetaNamespaceKey(key)
+		if err != nil {
+			continue
+		}
+		kd.cacheLock.Lock()
+		// Checked again with the cacheLock held: the services added since
+		// write their records after this.
+		_, tracked := kd.recordOwners[key]
+		_, alias := kd.aliasOwners[key]
+		if tracked || alias || kd.serviceExists(key) {
+			kd.cacheLock.Unlock()
+			continue
+		}
+		klog.Warningf("Removing the records of %s, which is not a service", key)
+		kd.cache.DeletePath(append(kd.domainPath, serviceSubdomain, namespace, name)...)
+		kd.unlockCache()
+		cacheDiscrepancies.WithLabelValues("name").Inc()
+		removed++
+	}
+
+	reverse := kd.ipShards.deleteOrphans(func(owner string) bool {
+		return owned.Has(owner) || kd.serviceExists(owner)
+	})
+	if reverse > 0 {
+		klog.Warningf("Removed %d reverse records of services that no longer exist", reverse)
+		cacheDiscrepancies.WithLabelValues("reverse").Add(float64(reverse))
+	}
+	return removed + reverse
+}
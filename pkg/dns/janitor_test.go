@@ -0,0 +1,135 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	kcache "k8s.io/client-go/tools/cache"
+
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+func TestPurgeOrphans(t *testing.T) {
+	kd := newKubeDNS()
+	kept := newService(testNamespace, "kept", "1.2.3.4", "http", 80)
+	orphaned := newService(testNamespace, "orphaned", "1.2.3.5", "http", 80)
+	require.NoError(t, kd.servicesStore.Add(kept))
+	kd.newService(kept)
+	// The delete event of the orphaned service was missed.
+	kd.newService(orphaned)
+	assertDNSForClusterIP(t, "", kd, orphaned, []string{"1.2.3.5"})
+
+	// Records written recently are left alone.
+	assert.Equal(t, 0, kd.purgeOrphans(time.Now().Add(-time.Minute)))
+	assertDNSForClusterIP(t, "", kd, orphaned, []string{"1.2.3.5"})
+
+	assert.Equal(t, 2, kd.purgeOrphans(time.Now()))
+	assertNoDNSForClusterIP(t, kd, orphaned)
+	assert.Nil(t, kd.ipShards.reverseRecord("1.2.3.5"))
+	assertDNSForClusterIP(t, "", kd, kept, []string{"1.2.3.4"})
+	assert.Equal(t, 2, kd.recordCount)
+
+	assert.Equal(t, 0, kd.purgeOrphans(time.Now()))
+}
+
+// lateStore is a store missing its objects on the first lookup, as if they
+// were added right after.
+type lateStore struct {
+	kcache.Store
+	looked bool
+}
+
+func (s *lateStore) GetByKey(key string) (interface{}, bool, error) {
+	if !s.looked {
+		s.looked = true
+		return nil, false, nil
+	}
+	return s.Store.GetByKey(key)
+}
+
+func TestPurgeOrphansRecreated(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, "recreated", "1.2.3.5", "http", 80)
+	kd.newService(s)
+	// The service is added to the store once found orphaned, its records
+	// are kept.
+	store := &lateStore{Store: kd.servicesStore}
+	require.NoError(t, store.Add(s))
+	kd.servicesStore = store
+	assert.Equal(t, 0, kd.purgeOrphans(time.Now()))
+	assert.True(t, store.looked)
+	assertDNSForClusterIP(t, "", kd, s, []string{"1.2.3.5"})
+}
+
+func TestPurgeOrphansGuardrails(t *testing.T) {
+	kd := newKubeDNS()
+	kd.Guardrails = NewGuardrails(0, 0, 1, time.Minute)
+	orphaned := newService(testNamespace, "orphaned", "1.2.3.5", "http", 80)
+	kd.newService(orphaned)
+
+	// Purging the two records exceeds the deletion budget.
+	assert.Equal(t, 0, kd.purgeOrphans(time.Now()))
+	assertDNSForClusterIP(t, "", kd, orphaned, []string{"1.2.3.5"})
+	assert.Equal(t, []string{"default/orphaned"}, kd.GuardrailsStatus().HeldDeletions)
+}
+
+func TestSweepCache(t *testing.T) {
+	kd := newKubeDNS()
+	kept := newService(testNamespace, "kept", "1.2.3.4", "http", 80)
+	require.NoError(t, kd.servicesStore.Add(kept))
+	kd.newService(kept)
+	tracked := newService(testNamespace, "tracked", "1.2.3.6", "http", 80)
+	kd.newService(tracked)
+	// The records of the untracked service were left behind without their
+	// owner.
+	untracked := newService(testNamespace, "untracked", "1.2.3.5", "http", 80)
+	kd.newService(untracked)
+	kd.cacheLock.Lock()
+	delete(kd.recordOwners, "default/untracked")
+	kd.unlockCache()
+	// A headless service sharing an endpoint IP with one that is gone.
+	headless := newHeadlessService()
+	kd.HeadlessReverseRecords = HeadlessReverseRecordsService
+	require.NoError(t, kd.servicesStore.Add(headless))
+	require.NoError(t, kd.endpointsStore.Add(newEndpoints(headless, newSubsetWithOnePort("", 80, "10.0.0.1"))))
+	kd.newService(headless)
+	gone := newHeadlessService()
+	gone.Name = "gone"
+	kd.ipShards.setReverseRecord("10.0.0.1", gone, &skymsg.Service{Host: "gone.default.svc.cluster.local."})
+
+	// The name and reverse record of the untracked service, and the
+	// reverse record of the gone one.
+	assert.Equal(t, 3, kd.sweepCache())
+	assertNoDNSForClusterIP(t, kd, untracked)
+	assert.Nil(t, kd.ipShards.reverseRecord("1.2.3.5"))
+	assert.Nil(t, kd.ipShards.service("1.2.3.5"))
+	records, err := kd.ReverseRecords("1.0.0.10.in-addr.arpa.")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, getServiceFQDN(kd.domain, headless), records[0].Host)
+
+	// The tracked service is left to purgeOrphans.
+	assertDNSForClusterIP(t, "", kd, tracked, []string{"1.2.3.6"})
+	assert.NotNil(t, kd.ipShards.reverseRecord("1.2.3.6"))
+	assertDNSForClusterIP(t, "", kd, kept, []string{"1.2.3.4"})
+
+	assert.Equal(t, 0, kd.sweepCache())
+}
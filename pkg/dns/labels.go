@@ -0,0 +1,56 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"strings"
+	"sync"
+)
+
+// labelBuffers holds the slices the queried names are split into, so that
+// the queries do not allocate them.
+var labelBuffers = sync.Pool{New: func() interface{} { return new(labelBuffer) }}
+
+type labelBuffer struct {
+	labels []string
+}
+
+// split returns the labels of name, as strings.Split does, in the buffer.
+// They are only valid until the buffer is released.
+func (buf *labelBuffer) split(name string) []string {
+	labels := buf.labels[:0]
+	for {
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		labels = append(labels, name[:i])
+		name = name[i+1:]
+	}
+	buf.labels = append(labels, name)
+	return buf.labels
+}
+
+// release clears the labels, which refer to the queried name, and returns
+// the buffer to the pool.
+func (buf *labelBuffer) release() {
+	for i := range buf.labels {
+		buf.labels[i] = ""
+	}
+	buf.labels = buf.labels[:0]
+	labelBuffers.Put(buf)
+}
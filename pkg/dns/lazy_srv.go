@@ -0,0 +1,131 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	"k8s.io/dns/pkg/dns/util"
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+// lazySRVZone answers the SRV names of the headless services,
+// [<endpoint>.]_<port>._<protocol>.<service>.<namespace>.svc.<domain>,
+// from the service and its endpoints in the stores, with LazySRV. Their
+// records are not in the cache, which only keeps the records of the
+// endpoints themselves: the SRV records of every named port of every
+// endpoint are generated at each query instead.
+func (kd *KubeDNS) lazySRVZone(segments []string, exact bool) ([]skymsg.Service, bool, error) {
+	// The wildcard queries are answered from the cache, where the SRV
+	// names are not.
+	if !kd.LazySRV || len(segments) < 2 || !strings.HasPrefix(segments[0], "_") && !strings.HasPrefix(segments[1], "_") ||
+		containsString(segments, "*") {
+		return nil, false, nil
+	}
+	path := kd.untenantedPath(util.ReverseArray(append([]string{}, segments...)))
+	d := len(kd.domainPath)
+	if !hasPathPrefix(path, kd.domainPath) || len(path) != d+5 && len(path) != d+6 || path[d] != serviceSubdomain {
+		return nil, false, nil
+	}
+	namespace, name, protocol, port := path[d+1], path[d+2], path[d+3], path[d+4]
+	if !strings.HasPrefix(protocol, "_") || !strings.HasPrefix(port, "_") {
+		return nil, false, nil
+	}
+	endpoint := ""
+	if len(path) == d+6 {
+		endpoint = path[d+5]
+	}
+	svc := kd.lazySRVService(namespace, name)
+	if svc == nil {
+		return nil, false, nil
+	}
+	if exact && endpoint == "" {
+		return nil, true, server.ErrNotFound
+	}
+	obj, exists, err := kd.endpointsStore.GetByKey(svc.Namespace + "/" + svc.Name)
+	if err != nil || !exists {
+		return nil, true, server.ErrNotFound
+	}
+	e, ok := obj.(*v1.Endpoints)
+	if !ok {
+		return nil, true, server.ErrNotFound
+	}
+
+	var records []skymsg.Service
+	seen := map[string]bool{}
+	subsets, _, hostnames := kd.headlessAddresses(e, svc)
+	for idx, addresses := range subsets {
+		for portIdx := range e.Subsets[idx].Ports {
+			endpointPort := &e.Subsets[idx].Ports[portIdx]
+			if port != "_"+endpointPort.Name {
+				continue
+			}
+			l, ok := kd.srvLabels(nil, endpointPort.Name, endpointPort.Protocol)
+			if !ok || protocol != l[0] {
+				continue
+			}
+			for _, address := range addresses {
+				_, endpointName := kd.endpointRecord(address.IP)
+				if hostname := hostnames[address.IP]; hostname != "" {
+					endpointName = hostname
+				}
+				if endpoint != "" && endpoint != endpointName {
+					continue
+				}
+				fqdn := kd.fqdn(svc, append(l, endpointName)...)
+				if seen[fqdn] {
+					continue
+				}
+				seen[fqdn] = true
+				record := kd.generateSRVRecordValue(svc, endpointPort.Name, int(endpointPort.Port), endpointName)
+				record.Key = skymsg.Path(fqdn)
+				records = append(records, *record)
+			}
+		}
+	}
+	if len(records) == 0 {
+		return nil, true, server.ErrNotFound
+	}
+	return records, true, nil
+}
+
+// lazySRVService returns the headless service named name in namespace,
+// directly or by one of its aliases, nil if there is none.
+func (kd *KubeDNS) lazySRVService(namespace, name string) *v1.Service {
+	key := namespace + "/" + name
+	obj, exists, err := kd.servicesStore.GetByKey(key)
+	if err == nil && !exists {
+		kd.cacheLock.RLock()
+		owner, ok := kd.aliasOwners[key]
+		kd.cacheLock.RUnlock()
+		if !ok {
+			return nil
+		}
+		obj, exists, err = kd.servicesStore.GetByKey(owner)
+	}
+	if err != nil || !exists {
+		return nil
+	}
+	svc, ok := obj.(*v1.Service)
+	if !ok || util.IsServiceIPSet(svc) || svc.Spec.Type == v1.ServiceTypeExternalName || isExcluded(svc) {
+		return nil
+	}
+	return svc
+}
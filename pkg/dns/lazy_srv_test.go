@@ -0,0 +1,87 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+)
+
+// srvAnswers returns the records of name as sorted key=host:port strings,
+// nil if there are none.
+func srvAnswers(kd *KubeDNS, name string, exact bool) []string {
+	records, err := kd.Records(name, exact)
+	if err != nil {
+		return nil
+	}
+	var answers []string
+	for _, record := range records {
+		answers = append(answers, fmt.Sprintf("%s=%s:%d", record.Key, record.Host, record.Port))
+	}
+	sort.Strings(answers)
+	return answers
+}
+
+func TestLazySRV(t *testing.T) {
+	s := newHeadlessService()
+	s.Annotations = map[string]string{AliasesAnnotation: "db"}
+	subset := newSubsetWithTwoPorts("http", 80, "dns", 53, "10.0.0.1", "10.0.0.2")
+	subset.Ports[1].Protocol = v1.ProtocolUDP
+	subset.Addresses[0].Hostname = "primary"
+	e := newEndpoints(s, subset, newSubsetWithOnePort("http", 80, "10.0.0.3"))
+
+	newKD := func(lazy bool) *KubeDNS {
+		kd := newKubeDNS()
+		kd.LazySRV = lazy
+		require.NoError(t, kd.servicesStore.Add(s))
+		require.NoError(t, kd.endpointsStore.Add(e))
+		kd.newService(s)
+		return kd
+	}
+	eager, lazy := newKD(false), newKD(true)
+	// Only the A records of the endpoints are in the cache.
+	assert.Equal(t, 3, lazy.recordCount)
+	assert.Less(t, lazy.recordCount, eager.recordCount)
+
+	for _, query := range []struct {
+		name  string
+		exact bool
+	}{
+		{name: "_http._tcp." + testService + ".default.svc.cluster.local."},
+		{name: "_dns._udp." + testService + ".default.svc.cluster.local."},
+		{name: "primary._http._tcp." + testService + ".default.svc.cluster.local.", exact: true},
+		{name: "_http._tcp.db.default.svc.cluster.local."},
+		{name: "_dns._tcp." + testService + ".default.svc.cluster.local."},
+		{name: "_https._tcp." + testService + ".default.svc.cluster.local."},
+	} {
+		assert.Equal(t, srvAnswers(eager, query.name, query.exact), srvAnswers(lazy, query.name, query.exact), query.name)
+	}
+	assert.Len(t, srvAnswers(lazy, "_http._tcp."+testService+".default.svc.cluster.local.", false), 3)
+
+	// The records of the endpoints are still in the cache.
+	records, err := lazy.Records(testService+".default.svc.cluster.local.", false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, hosts(records))
+	records, err = lazy.Records("primary._http._tcp."+testService+".default.svc.cluster.local.", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"primary." + testService + ".default.svc.cluster.local."}, hosts(records))
+}
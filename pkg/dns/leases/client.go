@@ -0,0 +1,208 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package leases is a client of the record leases of kube-dns: controllers
+// publish custom records for as long as they hold a lease on them, renewed
+// by heartbeats, instead of abusing ExternalName services as a record API.
+// The records of a lease are withdrawn when it expires, e.g. once its
+// holder is gone. The holder of a lease is the identity the client
+// authenticates with: the common name of its certificate, or the user of
+// its bearer token.
+package leases
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Path is the path of the record leases on the kube-dns admin listener.
+const Path = "/admin/records/leases"
+
+var (
+	// ErrNotFound means there is no lease with the given ID, e.g. it
+	// expired or kube-dns restarted.
+	ErrNotFound = errors.New("lease not found")
+	// ErrConflict means the lease is held by another holder.
+	ErrConflict = errors.New("lease held by another holder")
+)
+
+// Lease publishes custom records until it expires.
+type Lease struct {
+	// ID of the lease, chosen by its holder.
+	ID string `json:"id"`
+	// Holder of the lease, only it can renew or withdraw the lease. It is
+	// the identity of the client that acquired it.
+	Holder string `json:"holder"`
+	// Records in zone file or hosts file format, see the customRecords of
+	// the kube-dns configuration. Relative names are relative to the
+	// cluster domain.
+	Records string `json:"records"`
+	// Expires is when the records are withdrawn unless the lease is
+	// renewed.
+	Expires time.Time `json:"expires"`
+}
+
+// Client publishes records through the admin listener of kube-dns.
+type Client struct {
+	// URL of the admin listener, e.g. http://kube-dns.kube-system:8081.
+	URL string
+	// HTTPClient sends the requests, e.g. with the client certificate
+	// required by the listener.
+	HTTPClient *http.Client
+	// Token, if set, is the bearer token authenticating the holder, e.g.
+	// the token of a ServiceAccount.
+	Token string
+}
+
+// NewClient returns a Client of the admin listener at url.
+func NewClient(url string) *Client {
+	return &Client{URL: strings.TrimSuffix(url, "/"), HTTPClient: http.DefaultClient}
+}
+
+// Publish acquires the lease id for holder, or updates it if holder already
+// holds it, publishing records for ttl. The holder, if not empty, must be
+// the identity the client authenticates as.
+func (c *Client) Publish(ctx context.Context, id, holder, records string, ttl time.Duration) (Lease, error) {
+	if records == "" {
+		return Lease{}, fmt.Errorf("no records to publish")
+	}
+	return c.post(ctx, url.Values{"id": {id}, "holder": {holder}, "records": {records}, "ttl": {ttl.String()}})
+}
+
+// Renew extends the lease id of holder by ttl from now, without changing
+// its records.
+func (c *Client) Renew(ctx context.Context, id, holder string, ttl time.Duration) (Lease, error) {
+	return c.post(ctx, url.Values{"id": {id}, "holder": {holder}, "ttl": {ttl.String()}})
+}
+
+// Withdraw releases the lease id of holder, withdrawing its records.
+func (c *Client) Withdraw(ctx context.Context, id, holder string) error {
+	_, err := c.do(ctx, http.MethodDelete, url.Values{"id": {id}, "holder": {holder}})
+	return err
+}
+
+// List returns the leases.
+func (c *Client) List(ctx context.Context) ([]Lease, error) {
+	body, err := c.do(ctx, http.MethodGet, nil)
+	if err != nil {
+		return nil, err
+	}
+	var leases []Lease
+	if err := json.Unmarshal(body, &leases); err != nil {
+		return nil, fmt.Errorf("invalid leases: %w", err)
+	}
+	return leases, nil
+}
+
+// Keep publishes records under the lease id for holder and renews it every
+// third of ttl until ctx is done, then withdraws it. A lease found missing
+// on renewal, e.g. after a restart of kube-dns, is published again. It only
+// returns an error if the records cannot be published in the first place.
+func (c *Client) Keep(ctx context.Context, id, holder, records string, ttl time.Duration) error {
+	if _, err := c.Publish(ctx, id, holder, records, ttl); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			withdrawCtx, cancel := context.WithTimeout(context.Background(), ttl/3)
+			defer cancel()
+			if err := c.Withdraw(withdrawCtx, id, holder); err != nil && !errors.Is(err, ErrNotFound) {
+				klog.Warningf("Failed to withdraw the record lease %q: %v", id, err)
+			}
+			return nil
+		case <-ticker.C:
+		}
+		_, err := c.Renew(ctx, id, holder, ttl)
+		if errors.Is(err, ErrNotFound) {
+			klog.V(2).Infof("Record lease %q is gone, publishing it again", id)
+			_, err = c.Publish(ctx, id, holder, records, ttl)
+		}
+		if err != nil && ctx.Err() == nil {
+			klog.Warningf("Failed to renew the record lease %q: %v", id, err)
+		}
+	}
+}
+
+func (c *Client) post(ctx context.Context, values url.Values) (Lease, error) {
+	body, err := c.do(ctx, http.MethodPost, values)
+	if err != nil {
+		return Lease{}, err
+	}
+	var lease Lease
+	if err := json.Unmarshal(body, &lease); err != nil {
+		return Lease{}, fmt.Errorf("invalid lease: %w", err)
+	}
+	return lease, nil
+}
+
+// do sends a request with values as its form, in the body of a POST and in
+// the query otherwise, and returns the body of the response. The status
+// codes of a missing and of a conflicting lease map to ErrNotFound and
+// ErrConflict.
+func (c *Client) do(ctx context.Context, method string, values url.Values) ([]byte, error) {
+	target := c.URL + Path
+	var body io.Reader
+	if method == http.MethodPost {
+		body = strings.NewReader(values.Encode())
+	} else if len(values) > 0 {
+		target += "?" + values.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return data, nil
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%s: %w", strings.TrimSpace(string(data)), ErrNotFound)
+	case http.StatusConflict:
+		return nil, fmt.Errorf("%s: %w", strings.TrimSpace(string(data)), ErrConflict)
+	default:
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+}
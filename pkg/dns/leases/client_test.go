@@ -0,0 +1,178 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leases
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer holds the leases like kube-dns, without expiring them.
+type fakeServer struct {
+	lock     sync.Mutex
+	leases   map[string]Lease
+	renewals int
+	// authorization is the Authorization header of the last request.
+	authorization string
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.authorization = req.Header.Get("Authorization")
+	id, holder := req.FormValue("id"), req.FormValue("holder")
+	lease, ok := f.leases[id]
+	if ok && lease.Holder != holder {
+		http.Error(w, "held", http.StatusConflict)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		var list []Lease
+		for _, lease := range f.leases {
+			list = append(list, lease)
+		}
+		writeJSON(w, list)
+	case http.MethodPost:
+		records := req.FormValue("records")
+		if records == "" {
+			if !ok {
+				http.Error(w, "no lease", http.StatusNotFound)
+				return
+			}
+			f.renewals++
+		} else {
+			lease = Lease{ID: id, Holder: holder, Records: records}
+		}
+		ttl, err := time.ParseDuration(req.FormValue("ttl"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		lease.Expires = time.Now().Add(ttl)
+		f.leases[id] = lease
+		writeJSON(w, lease)
+	case http.MethodDelete:
+		if !ok {
+			http.Error(w, "no lease", http.StatusNotFound)
+			return
+		}
+		delete(f.leases, id)
+		writeJSON(w, struct{}{})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeServer) lease(id string) (Lease, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	lease, ok := f.leases[id]
+	return lease, ok
+}
+
+func newFakeServer(t *testing.T) (*fakeServer, *Client) {
+	f := &fakeServer{leases: make(map[string]Lease)}
+	mux := http.NewServeMux()
+	mux.Handle(Path, f)
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return f, NewClient(s.URL + "/")
+}
+
+func TestClient(t *testing.T) {
+	_, c := newFakeServer(t)
+	ctx := context.Background()
+
+	lease, err := c.Publish(ctx, "registry", "controller-a", "registry A 10.0.0.10", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "registry A 10.0.0.10", lease.Records)
+
+	renewed, err := c.Renew(ctx, "registry", "controller-a", time.Hour)
+	require.NoError(t, err)
+	assert.True(t, renewed.Expires.After(lease.Expires))
+
+	_, err = c.Renew(ctx, "missing", "controller-a", time.Minute)
+	assert.True(t, errors.Is(err, ErrNotFound), "%v", err)
+	_, err = c.Publish(ctx, "registry", "controller-b", "registry A 10.0.0.11", time.Minute)
+	assert.True(t, errors.Is(err, ErrConflict), "%v", err)
+	_, err = c.Publish(ctx, "registry", "controller-a", "", time.Minute)
+	assert.Error(t, err)
+
+	list, err := c.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	require.NoError(t, c.Withdraw(ctx, "registry", "controller-a"))
+	assert.True(t, errors.Is(c.Withdraw(ctx, "registry", "controller-a"), ErrNotFound))
+}
+
+func TestClientToken(t *testing.T) {
+	f, c := newFakeServer(t)
+	_, err := c.List(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, f.authorization)
+
+	c.Token = "token"
+	_, err = c.List(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer token", f.authorization)
+}
+
+func TestClientKeep(t *testing.T) {
+	f, c := newFakeServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Keep(ctx, "registry", "controller-a", "registry A 10.0.0.10", 30*time.Millisecond) }()
+
+	require.Eventually(t, func() bool {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		return f.renewals >= 2
+	}, 5*time.Second, 5*time.Millisecond)
+
+	// A lease lost, e.g. on a restart of kube-dns, is published again.
+	f.lock.Lock()
+	delete(f.leases, "registry")
+	f.lock.Unlock()
+	require.Eventually(t, func() bool {
+		_, ok := f.lease("registry")
+		return ok
+	}, 5*time.Second, 5*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+	_, ok := f.lease("registry")
+	assert.False(t, ok, "the lease is withdrawn")
+
+	// Records that cannot be published fail right away.
+	_, err := c.Publish(context.Background(), "other", "controller-b", "other A 10.0.0.11", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, errors.Is(c.Keep(context.Background(), "other", "controller-a", "other A 10.0.0.12", time.Minute), ErrConflict))
+}
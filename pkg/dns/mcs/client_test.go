@@ -0,0 +1,63 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mcs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/rest"
+)
+
+func TestListServiceImports(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/apis/multicluster.x-k8s.io/v1alpha1/serviceimports", req.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"apiVersion": "multicluster.x-k8s.io/v1alpha1",
+			"kind": "ServiceImportList",
+			"metadata": {"resourceVersion": "42"},
+			"items": [{
+				"metadata": {"name": "db", "namespace": "default"},
+				"spec": {"type": "ClusterSetIP", "ips": ["10.42.0.1"], "ports": [{"name": "sql", "protocol": "TCP", "port": 5432}]},
+				"status": {"clusters": [{"cluster": "east"}, {"cluster": "west"}]}
+			}]
+		}`))
+	}))
+	defer srv.Close()
+
+	client, err := NewForConfig(&rest.Config{Host: srv.URL})
+	require.NoError(t, err)
+	list := &ServiceImportList{}
+	require.NoError(t, client.Get().Resource("serviceimports").Do(context.Background()).Into(list))
+	assert.Equal(t, "42", list.ResourceVersion)
+	require.Len(t, list.Items, 1)
+	serviceImport := list.Items[0]
+	assert.Equal(t, "default", serviceImport.Namespace)
+	assert.Equal(t, ClusterSetIP, serviceImport.Spec.Type)
+	assert.Equal(t, []string{"10.42.0.1"}, serviceImport.Spec.IPs)
+	assert.Equal(t, []ServicePort{{Name: "sql", Protocol: "TCP", Port: 5432}}, serviceImport.Spec.Ports)
+	assert.Equal(t, []ClusterStatus{{Cluster: "east"}, {Cluster: "west"}}, serviceImport.Status.Clusters)
+
+	copied := serviceImport.DeepCopy()
+	copied.Spec.IPs[0] = "10.42.0.2"
+	assert.Equal(t, "10.42.0.1", serviceImport.Spec.IPs[0])
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mcs holds the subset of the Multi-Cluster Services API
+// (multicluster.x-k8s.io, KEP-1645) kube-dns reads to serve the clusterset
+// domain, and a client for it. ServiceExports are not needed: the
+// ServiceImports reflect the services exported by every cluster.
+package mcs
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupVersion of the ServiceImports.
+var GroupVersion = schema.GroupVersion{Group: "multicluster.x-k8s.io", Version: "v1alpha1"}
+
+const (
+	// LabelServiceName is set on the EndpointSlices of an imported
+	// service to the name of the ServiceImport.
+	LabelServiceName = "multicluster.kubernetes.io/service-name"
+	// LabelSourceCluster is set on the EndpointSlices of an imported
+	// service to the id of the cluster the endpoints run in.
+	LabelSourceCluster = "multicluster.kubernetes.io/source-cluster"
+	// DerivedServiceAnnotation is set by some implementations on a
+	// ServiceImport to the name of the Service, in the same namespace,
+	// holding its ClusterSetIP.
+	DerivedServiceAnnotation = "multicluster.kubernetes.io/derived-service"
+)
+
+// ServiceImportType is the type of a ServiceImport.
+type ServiceImportType string
+
+const (
+	// ClusterSetIP services are reached through their ClusterSetIPs.
+	ClusterSetIP ServiceImportType = "ClusterSetIP"
+	// Headless services are reached through their endpoints.
+	Headless ServiceImportType = "Headless"
+)
+
+// ServiceImport describes a service imported from the clusters of the
+// clusterset.
+type ServiceImport struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ServiceImportSpec   `json:"spec,omitempty"`
+	Status ServiceImportStatus `json:"status,omitempty"`
+}
+
+// ServiceImportSpec is the spec of a ServiceImport.
+type ServiceImportSpec struct {
+	Ports []ServicePort     `json:"ports"`
+	IPs   []string          `json:"ips,omitempty"`
+	Type  ServiceImportType `json:"type"`
+}
+
+// ServicePort is a port of an imported service.
+type ServicePort struct {
+	Name     string      `json:"name,omitempty"`
+	Protocol v1.Protocol `json:"protocol,omitempty"`
+	Port     int32       `json:"port"`
+}
+
+// ServiceImportStatus is the status of a ServiceImport.
+type ServiceImportStatus struct {
+	Clusters []ClusterStatus `json:"clusters,omitempty"`
+}
+
+// ClusterStatus names a cluster exporting the service.
+type ClusterStatus struct {
+	Cluster string `json:"cluster"`
+}
+
+// ServiceImportList is a list of ServiceImports.
+type ServiceImportList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []ServiceImport `json:"items"`
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *ServiceImport) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+// DeepCopy returns a deep copy of the ServiceImport.
+func (in *ServiceImport) DeepCopy() *ServiceImport {
+	if in == nil {
+		return nil
+	}
+	out := &ServiceImport{TypeMeta: in.TypeMeta}
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec.Type = in.Spec.Type
+	out.Spec.Ports = append([]ServicePort(nil), in.Spec.Ports...)
+	out.Spec.IPs = append([]string(nil), in.Spec.IPs...)
+	out.Status.Clusters = append([]ClusterStatus(nil), in.Status.Clusters...)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *ServiceImportList) DeepCopyObject() runtime.Object {
+	if in == nil {
+		return nil
+	}
+	out := &ServiceImportList{TypeMeta: in.TypeMeta}
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]ServiceImport, len(in.Items))
+		for i := range in.Items {
+			out.Items[i] = *in.Items[i].DeepCopy()
+		}
+	}
+	return out
+}
@@ -0,0 +1,331 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mirror sends a sample of the queries served and their replies to
+// an analytics sink, for offline analysis. Mirroring is rate capped and
+// never blocks the serving of queries: records are dropped rather than
+// queued when the sink falls behind.
+package mirror
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/pflag"
+	"k8s.io/klog/v2"
+)
+
+// queueLength is the number of records waiting for the sink before new
+// ones are dropped.
+const queueLength = 1024
+
+var (
+	recordsSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "kubedns",
+		Subsystem: "mirror",
+		Name:      "records_sent_total",
+		Help:      "Number of query records sent to the mirror sink.",
+	})
+	recordsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kubedns",
+		Subsystem: "mirror",
+		Name:      "records_dropped_total",
+		Help:      "Number of sampled query records not sent to the mirror sink, by reason.",
+	}, []string{"reason"})
+	registerMetrics sync.Once
+)
+
+// ClientScrub is what is kept of the address of the clients.
+type ClientScrub string
+
+const (
+	// ClientKeep keeps the address of the client.
+	ClientKeep ClientScrub = "keep"
+	// ClientTruncate keeps the /24 of IPv4 clients and the /48 of IPv6
+	// clients.
+	ClientTruncate ClientScrub = "truncate"
+	// ClientDrop keeps nothing of the client.
+	ClientDrop ClientScrub = "drop"
+)
+
+// NameScrub is what is kept of the names queried.
+type NameScrub string
+
+const (
+	// NameKeep keeps the name queried.
+	NameKeep NameScrub = "keep"
+	// NameHash replaces the name queried with its hash, so that the
+	// queries for a name can still be counted, e.g. those for the names of
+	// the pods, which hold their IP. The answers, which hold the name, are
+	// left out.
+	NameHash NameScrub = "hash"
+)
+
+// Config configures a Mirror.
+type Config struct {
+	// Sink is where records are sent, e.g. udp://analytics:9999.
+	Sink string
+	// Rate is the sampling rate: one query out of Rate is mirrored.
+	Rate int
+	// MaxPerSecond caps the number of records sent per second.
+	MaxPerSecond int
+	// Client is what is kept of the address of the clients.
+	Client ClientScrub
+	// Name is what is kept of the names queried.
+	Name NameScrub
+	// DropAnswers leaves the data of the answers out of the records, only
+	// their number is kept.
+	DropAnswers bool
+}
+
+// DefaultConfig returns the default Config, without a sink.
+func DefaultConfig() Config {
+	return Config{Rate: 100, MaxPerSecond: 100, Client: ClientTruncate, Name: NameHash}
+}
+
+// AddFlags adds the flags setting c to fs.
+func (c *Config) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.Sink, "mirror-sink", c.Sink,
+		"if set, e.g. udp://analytics:9999, mirror a sample of the queries and their replies to this sink,"+
+			" one JSON document per datagram, for offline analytics.")
+	fs.IntVar(&c.Rate, "mirror-rate", c.Rate, "mirror one query out of this many.")
+	fs.IntVar(&c.MaxPerSecond, "mirror-max-per-second", c.MaxPerSecond,
+		"maximum number of queries mirrored per second, the others are dropped.")
+	fs.StringVar((*string)(&c.Client), "mirror-client", string(c.Client),
+		"what is mirrored of the address of the clients: \"keep\", \"truncate\" to its /24 or /48, or \"drop\".")
+	fs.StringVar((*string)(&c.Name), "mirror-name", string(c.Name),
+		"what is mirrored of the names queried: \"keep\", or \"hash\" to their SHA-256, leaving the answers out.")
+	fs.BoolVar(&c.DropAnswers, "mirror-drop-answers", c.DropAnswers,
+		"if true, only mirror the number of answers, not their data.")
+}
+
+// Record is a mirrored query and its reply, sent as one JSON document. Name
+// is the name queried, or its hash with NameHash.
+type Record struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client,omitempty"`
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	// Rcode is empty if no reply was written.
+	Rcode   string   `json:"rcode,omitempty"`
+	Answers int      `json:"answers"`
+	Answer  []string `json:"answer,omitempty"`
+}
+
+// Sink receives the records.
+type Sink interface {
+	Send(data []byte) error
+	Close() error
+}
+
+// NewSink returns the sink at the given URL. Only UDP sinks, e.g.
+// udp://host:port, are supported: each record is sent in a datagram, for a
+// relay to forward to the analytics pipeline.
+func NewSink(sink string) (Sink, error) {
+	u, err := url.Parse(sink)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror sink %q: %w", sink, err)
+	}
+	switch u.Scheme {
+	case "udp":
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach mirror sink %q: %w", sink, err)
+		}
+		return &udpSink{conn}, nil
+	}
+	return nil, fmt.Errorf("unsupported mirror sink %q, must be udp://host:port", sink)
+}
+
+type udpSink struct {
+	conn net.Conn
+}
+
+func (s *udpSink) Send(data []byte) error {
+	_, err := s.conn.Write(data)
+	return err
+}
+
+func (s *udpSink) Close() error {
+	return s.conn.Close()
+}
+
+// Validate returns an error if config is invalid, without reaching the sink.
+func (config Config) Validate() error {
+	if u, err := url.Parse(config.Sink); err != nil || u.Scheme != "udp" || u.Host == "" {
+		return fmt.Errorf("invalid mirror sink %q, must be udp://host:port", config.Sink)
+	}
+	switch config.Client {
+	case ClientKeep, ClientTruncate, ClientDrop:
+	default:
+		return fmt.Errorf("invalid client scrubbing %q, must be %s, %s or %s", config.Client, ClientKeep, ClientTruncate, ClientDrop)
+	}
+	switch config.Name {
+	case NameKeep, NameHash:
+	default:
+		return fmt.Errorf("invalid name scrubbing %q, must be %s or %s", config.Name, NameKeep, NameHash)
+	}
+	if config.MaxPerSecond <= 0 {
+		return fmt.Errorf("the mirror needs a positive rate cap, got %d", config.MaxPerSecond)
+	}
+	return nil
+}
+
+// Mirror samples the queries served and sends them to a Sink.
+type Mirror struct {
+	config Config
+	sink   Sink
+	queue  chan Record
+	now    func() time.Time
+
+	seen uint64 // accessed atomically
+
+	lock sync.Mutex
+	// second is the start of the current second, sent the number of
+	// records sent during it.
+	second time.Time
+	sent   int
+}
+
+// NewMirror returns a Mirror sending to sink. Run must be called for the
+// records to be sent.
+func NewMirror(config Config, sink Sink) *Mirror {
+	if config.Rate < 1 {
+		config.Rate = 1
+	}
+	return &Mirror{
+		config: config,
+		sink:   sink,
+		queue:  make(chan Record, queueLength),
+		now:    time.Now,
+	}
+}
+
+// Run sends the records to the sink until stopCh is closed.
+func (m *Mirror) Run(stopCh <-chan struct{}) {
+	registerMetrics.Do(func() { prometheus.MustRegister(recordsSent, recordsDropped) })
+	klog.V(0).Infof("Mirroring one query out of %d, at most %d per second, to %s",
+		m.config.Rate, m.config.MaxPerSecond, m.config.Sink)
+	defer m.sink.Close()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case record := <-m.queue:
+			data, err := json.Marshal(record)
+			if err == nil {
+				err = m.sink.Send(data)
+			}
+			if err != nil {
+				klog.V(2).Infof("Failed to mirror a query: %v", err)
+				recordsDropped.WithLabelValues("error").Inc()
+				continue
+			}
+			recordsSent.Inc()
+		}
+	}
+}
+
+// Observe samples a query and its reply. It is a server.QueryObserver.
+func (m *Mirror) Observe(remote net.Addr, req, resp *dns.Msg) {
+	if atomic.AddUint64(&m.seen, 1)%uint64(m.config.Rate) != 0 || req == nil || len(req.Question) == 0 {
+		return
+	}
+	if !m.allow() {
+		recordsDropped.WithLabelValues("rate").Inc()
+		return
+	}
+	select {
+	case m.queue <- m.record(remote, req, resp):
+	default:
+		recordsDropped.WithLabelValues("queue").Inc()
+	}
+}
+
+// allow returns whether a record may be sent within the rate cap.
+func (m *Mirror) allow() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if now := m.now(); now.Sub(m.second) >= time.Second {
+		m.second, m.sent = now, 0
+	}
+	if m.sent >= m.config.MaxPerSecond {
+		return false
+	}
+	m.sent++
+	return true
+}
+
+func (m *Mirror) record(remote net.Addr, req, resp *dns.Msg) Record {
+	q := req.Question[0]
+	record := Record{
+		Time:   m.now().UTC(),
+		Client: scrubClient(remote, m.config.Client),
+		Name:   scrubName(q.Name, m.config.Name),
+		Type:   dns.TypeToString[q.Qtype],
+	}
+	if resp != nil {
+		record.Rcode = dns.RcodeToString[resp.Rcode]
+		record.Answers = len(resp.Answer)
+		if !m.config.DropAnswers && m.config.Name != NameHash {
+			for _, rr := range resp.Answer {
+				record.Answer = append(record.Answer, rr.String())
+			}
+		}
+	}
+	return record
+}
+
+// scrubClient returns what is kept of the IP of remote.
+func scrubClient(remote net.Addr, scrub ClientScrub) string {
+	var ip net.IP
+	switch addr := remote.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	}
+	if ip == nil || scrub == ClientDrop {
+		return ""
+	}
+	if scrub == ClientTruncate {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	}
+	return ip.String()
+}
+
+// scrubName returns what is kept of the name queried: the hex SHA-256 of
+// its canonical form with NameHash.
+func scrubName(name string, scrub NameScrub) string {
+	if scrub != NameHash {
+		return name
+	}
+	sum := sha256.Sum256([]byte(strings.ToLower(dns.Fqdn(name))))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mirror
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSink struct {
+	sent chan []byte
+}
+
+func (s *fakeSink) Send(data []byte) error {
+	s.sent <- data
+	return nil
+}
+
+func (s *fakeSink) Close() error { return nil }
+
+func query(name string) (*dns.Msg, *dns.Msg) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	rr, _ := dns.NewRR(name + " 30 IN A 10.0.0.1")
+	resp.Answer = []dns.RR{rr}
+	return req, resp
+}
+
+func TestMirror(t *testing.T) {
+	config := DefaultConfig()
+	config.Name = NameKeep
+	config.Rate = 2
+	config.MaxPerSecond = 2
+	m := NewMirror(config, nil)
+	now := time.Unix(1000, 0)
+	m.now = func() time.Time { return now }
+	client := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 4242}
+
+	// One query out of two is sampled, and at most two per second.
+	for i := 0; i < 8; i++ {
+		req, resp := query("a.default.svc.cluster.local.")
+		m.Observe(client, req, resp)
+	}
+	require.Len(t, m.queue, 2)
+	now = now.Add(time.Second)
+	req, resp := query("b.default.svc.cluster.local.")
+	m.Observe(client, req, resp)
+	m.Observe(client, req, resp)
+	require.Len(t, m.queue, 3)
+
+	record := <-m.queue
+	assert.Equal(t, "10.1.2.0", record.Client)
+	assert.Equal(t, "a.default.svc.cluster.local.", record.Name)
+	assert.Equal(t, "A", record.Type)
+	assert.Equal(t, "NOERROR", record.Rcode)
+	assert.Equal(t, 1, record.Answers)
+	assert.Len(t, record.Answer, 1)
+}
+
+func TestScrub(t *testing.T) {
+	config := DefaultConfig()
+	config.Rate = 1
+	config.Client = ClientDrop
+	config.DropAnswers = true
+	m := NewMirror(config, nil)
+	req, resp := query("a.default.svc.cluster.local.")
+	record := m.record(&net.UDPAddr{IP: net.ParseIP("10.1.2.3")}, req, resp)
+	assert.Empty(t, record.Client)
+	assert.Equal(t, 1, record.Answers)
+	assert.Empty(t, record.Answer)
+
+	// The names are hashed by default, and the answers holding them left
+	// out.
+	m = NewMirror(DefaultConfig(), nil)
+	record = m.record(&net.UDPAddr{IP: net.ParseIP("10.1.2.3")}, req, resp)
+	assert.Equal(t, scrubName("A.Default.svc.cluster.local.", NameHash), record.Name)
+	assert.Len(t, record.Name, 64)
+	assert.NotContains(t, record.Name, "default")
+	assert.Equal(t, 1, record.Answers)
+	assert.Empty(t, record.Answer)
+	assert.Equal(t, "a.default.svc.cluster.local.", scrubName("a.default.svc.cluster.local.", NameKeep))
+
+	assert.Equal(t, "fd00:1:2::", scrubClient(&net.TCPAddr{IP: net.ParseIP("fd00:1:2:3::4")}, ClientTruncate))
+	assert.Equal(t, "fd00:1:2:3::4", scrubClient(&net.TCPAddr{IP: net.ParseIP("fd00:1:2:3::4")}, ClientKeep))
+}
+
+func TestRun(t *testing.T) {
+	sink := &fakeSink{sent: make(chan []byte, 1)}
+	config := DefaultConfig()
+	config.Rate = 1
+	config.Name = NameKeep
+	m := NewMirror(config, sink)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go m.Run(stopCh)
+
+	req, resp := query("a.default.svc.cluster.local.")
+	m.Observe(&net.UDPAddr{IP: net.ParseIP("10.1.2.3")}, req, resp)
+	var record Record
+	select {
+	case data := <-sink.sent:
+		require.NoError(t, json.Unmarshal(data, &record))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no record sent")
+	}
+	assert.Equal(t, "a.default.svc.cluster.local.", record.Name)
+}
+
+func TestValidate(t *testing.T) {
+	config := DefaultConfig()
+	config.Sink = "udp://127.0.0.1:9999"
+	assert.NoError(t, config.Validate())
+
+	for _, sink := range []string{"", "kafka://analytics:9092", "udp://"} {
+		config.Sink = sink
+		assert.Error(t, config.Validate(), sink)
+	}
+	config.Sink = "udp://127.0.0.1:9999"
+	config.Client = "hash"
+	assert.Error(t, config.Validate())
+	config.Client = ClientKeep
+	config.Name = "drop"
+	assert.Error(t, config.Validate())
+	config.Name = NameKeep
+	config.MaxPerSecond = 0
+	assert.Error(t, config.Validate())
+}
+
+func TestUDPSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	sink, err := NewSink("udp://" + conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer sink.Close()
+
+	require.NoError(t, sink.Send([]byte(`{"name":"a."}`)))
+	buf := make([]byte, 512)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, `{"name":"a."}`, string(buf[:n]))
+}
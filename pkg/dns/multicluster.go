@@ -0,0 +1,274 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	kcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/mcs"
+	"k8s.io/dns/pkg/dns/treecache"
+	"k8s.io/dns/pkg/dns/util"
+)
+
+const (
+	// multiClusterSliceIndex indexes the EndpointSlices of imported
+	// services by the namespace/name of their ServiceImport.
+	multiClusterSliceIndex = "multiClusterService"
+	// derivedServiceIndex indexes the ServiceImports by the
+	// namespace/name of their derived service.
+	derivedServiceIndex = "derivedService"
+)
+
+func multiClusterSliceKeys(obj interface{}) ([]string, error) {
+	slice, ok := obj.(*discovery.EndpointSlice)
+	if !ok {
+		return nil, nil
+	}
+	name, ok := slice.Labels[mcs.LabelServiceName]
+	if !ok {
+		return nil, nil
+	}
+	return []string{slice.Namespace + "/" + name}, nil
+}
+
+func derivedServiceKeys(obj interface{}) ([]string, error) {
+	serviceImport, ok := obj.(*mcs.ServiceImport)
+	if !ok {
+		return nil, nil
+	}
+	name, ok := serviceImport.Annotations[mcs.DerivedServiceAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	return []string{serviceImport.Namespace + "/" + name}, nil
+}
+
+// setServiceImportsStore watches the ServiceImports, serving the services
+// of the clusterset under MultiClusterDomain.
+func (kd *KubeDNS) setServiceImportsStore() {
+	kd.multiClusterPath = util.ReverseArray(strings.Split(strings.TrimRight(kd.MultiClusterDomain, "."), "."))
+	kd.serviceImportsStore, kd.serviceImportController = kcache.NewIndexerInformer(
+		kcache.NewListWatchFromClient(
+			kd.MultiClusterClient,
+			"serviceimports",
+			v1.NamespaceAll,
+			fields.Everything()),
+		&mcs.ServiceImport{},
+		kd.ResyncPeriod,
+		kcache.ResourceEventHandlerFuncs{
+			AddFunc:    kd.handleServiceImportAdd,
+			UpdateFunc: kd.handleServiceImportUpdate,
+			DeleteFunc: kd.handleServiceImportDelete,
+		},
+		kcache.Indexers{derivedServiceIndex: derivedServiceKeys},
+	)
+}
+
+func (kd *KubeDNS) handleServiceImportAdd(obj interface{}) {
+	if serviceImport, ok := obj.(*mcs.ServiceImport); ok {
+		kd.generateRecordsForServiceImport(serviceImport)
+	}
+}
+
+func (kd *KubeDNS) handleServiceImportUpdate(_, newObj interface{}) {
+	kd.handleServiceImportAdd(newObj)
+}
+
+func (kd *KubeDNS) handleServiceImportDelete(obj interface{}) {
+	if tombstone, ok := obj.(kcache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if serviceImport, ok := obj.(*mcs.ServiceImport); ok {
+		path := append(kd.multiClusterPath, serviceSubdomain, serviceImport.Namespace, serviceImport.Name)
+		kd.cacheLock.Lock()
+		defer kd.unlockCache()
+		kd.cache.DeletePath(path...)
+		klog.V(3).Infof("Removed the records of ServiceImport %s/%s", serviceImport.Namespace, serviceImport.Name)
+	}
+}
+
+// updateServiceImport regenerates the records of the ServiceImport with the
+// given namespace/name, if there is one, e.g. when its endpoints or derived
+// service change.
+func (kd *KubeDNS) updateServiceImport(key string) {
+	if kd.serviceImportsStore == nil {
+		return
+	}
+	obj, exists, err := kd.serviceImportsStore.GetByKey(key)
+	if err != nil || !exists {
+		return
+	}
+	kd.handleServiceImportAdd(obj)
+}
+
+// updateServiceImportOfSlice regenerates the records of the ServiceImport
+// the slice holds endpoints of, if any.
+func (kd *KubeDNS) updateServiceImportOfSlice(slice *discovery.EndpointSlice) {
+	keys, _ := multiClusterSliceKeys(slice)
+	for _, key := range keys {
+		kd.updateServiceImport(key)
+	}
+}
+
+// updateServiceImportsOfDerivedService regenerates the records of the
+// ServiceImports whose ClusterSetIPs are those of the given service.
+func (kd *KubeDNS) updateServiceImportsOfDerivedService(service *v1.Service) {
+	if kd.serviceImportsStore == nil {
+		return
+	}
+	imports, err := kd.serviceImportsStore.ByIndex(derivedServiceIndex, service.Namespace+"/"+service.Name)
+	if err != nil {
+		return
+	}
+	for _, obj := range imports {
+		kd.handleServiceImportAdd(obj)
+	}
+}
+
+// multiClusterFQDN returns the fqdn of an imported service in the
+// clusterset domain. subpaths are path elements rooted at the service.
+func (kd *KubeDNS) multiClusterFQDN(serviceImport *mcs.ServiceImport, subpaths ...string) string {
+	domainLabels := append(append(kd.multiClusterPath, serviceSubdomain, serviceImport.Namespace, serviceImport.Name), subpaths...)
+	return dns.Fqdn(strings.Join(util.ReverseArray(domainLabels), "."))
+}
+
+// clusterSetIPs returns the ClusterSetIPs of an import, from its spec or,
+// if it has none, from its derived service.
+func (kd *KubeDNS) clusterSetIPs(serviceImport *mcs.ServiceImport) []string {
+	if len(serviceImport.Spec.IPs) > 0 {
+		return serviceImport.Spec.IPs
+	}
+	name, ok := serviceImport.Annotations[mcs.DerivedServiceAnnotation]
+	if !ok {
+		return nil
+	}
+	obj, exists, err := kd.servicesStore.GetByKey(serviceImport.Namespace + "/" + name)
+	if err != nil || !exists {
+		return nil
+	}
+	if service, ok := obj.(*v1.Service); ok && util.IsServiceIPSet(service) {
+		return util.GetClusterIPs(service)
+	}
+	return nil
+}
+
+// generateRecordsForServiceImport generates the records of an imported
+// service, per KEP-1645: the ClusterSetIPs of ClusterSetIP services, and
+// the ready endpoints of headless services in every cluster, the named
+// ones also as <hostname>.<cluster id>.<service>.
+func (kd *KubeDNS) generateRecordsForServiceImport(serviceImport *mcs.ServiceImport) {
+	subCache := treecache.NewTreeCache()
+
+	if serviceImport.Spec.Type == mcs.Headless {
+		kd.addMultiClusterEndpoints(subCache, serviceImport)
+	} else {
+		for _, ip := range kd.clusterSetIPs(serviceImport) {
+			recordValue, recordLabel := util.GetSkyMsg(ip, 0)
+			subCache.SetEntry(recordLabel, recordValue, kd.multiClusterFQDN(serviceImport, recordLabel))
+			for _, port := range serviceImport.Spec.Ports {
+				l, ok := kd.srvLabels(nil, port.Name, port.Protocol)
+				if !ok {
+					continue
+				}
+				srvValue, _ := util.GetSkyMsg(kd.multiClusterFQDN(serviceImport), int(port.Port))
+				subCache.SetEntry(recordLabel, srvValue, kd.multiClusterFQDN(serviceImport, append(l, recordLabel)...), l...)
+			}
+		}
+	}
+
+	path := append(kd.multiClusterPath, serviceSubdomain, serviceImport.Namespace)
+	kd.cacheLock.Lock()
+	defer kd.unlockCache()
+	kd.cache.SetSubCache(serviceImport.Name, subCache, path...)
+	klog.V(3).Infof("Updated the records of ServiceImport %s/%s", serviceImport.Namespace, serviceImport.Name)
+}
+
+// addMultiClusterEndpoints adds the records of the endpoints of a headless
+// imported service to subCache.
+func (kd *KubeDNS) addMultiClusterEndpoints(subCache treecache.TreeCache, serviceImport *mcs.ServiceImport) {
+	if kd.endpointSlicesStore == nil {
+		return
+	}
+	slices, err := kd.endpointSlicesStore.ByIndex(multiClusterSliceIndex, serviceImport.Namespace+"/"+serviceImport.Name)
+	if err != nil {
+		klog.Errorf("Failed to list the EndpointSlices of ServiceImport %s/%s: %v", serviceImport.Namespace, serviceImport.Name, err)
+		return
+	}
+	// An address may be listed in several slices of its cluster, e.g.
+	// during a rollout: its hostname is picked first, so that its SRV
+	// records have a single target whatever the order of the slices.
+	addresses := map[string][]endpointAddress{}
+	for _, obj := range slices {
+		slice, ok := obj.(*discovery.EndpointSlice)
+		if !ok {
+			continue
+		}
+		cluster := slice.Labels[mcs.LabelSourceCluster]
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Hostname == nil || cluster == "" || endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			for _, ip := range endpoint.Addresses {
+				addresses[cluster] = append(addresses[cluster], endpointAddress{ip: ip, hostname: *endpoint.Hostname})
+			}
+		}
+	}
+	hostnames := make(map[string]map[string]string, len(addresses))
+	for cluster, clusterAddresses := range addresses {
+		hostnames[cluster] = endpointHostnames(clusterAddresses)
+	}
+	for _, obj := range slices {
+		slice, ok := obj.(*discovery.EndpointSlice)
+		if !ok {
+			continue
+		}
+		cluster := slice.Labels[mcs.LabelSourceCluster]
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			for _, ip := range endpoint.Addresses {
+				recordValue, recordLabel := kd.endpointRecord(ip)
+				subCache.SetEntry(recordLabel, recordValue, kd.multiClusterFQDN(serviceImport, recordLabel))
+				target := kd.multiClusterFQDN(serviceImport, recordLabel)
+				if hostname := hostnames[cluster][ip]; hostname != "" {
+					hostValue, _ := util.GetSkyMsg(ip, 0)
+					target = kd.multiClusterFQDN(serviceImport, cluster, hostname)
+					subCache.SetEntry(hostname, hostValue, target, cluster)
+				}
+				for _, port := range slice.Ports {
+					if port.Name == nil || port.Protocol == nil || port.Port == nil {
+						continue
+					}
+					l, ok := kd.srvLabels(nil, *port.Name, *port.Protocol)
+					if !ok {
+						continue
+					}
+					srvValue, _ := util.GetSkyMsg(target, int(*port.Port))
+					subCache.SetEntry(recordLabel, srvValue, kd.multiClusterFQDN(serviceImport, append(l, recordLabel)...), l...)
+				}
+			}
+		}
+	}
+}
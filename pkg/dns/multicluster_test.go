@@ -0,0 +1,168 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"k8s.io/dns/pkg/dns/mcs"
+)
+
+const testMultiClusterDomain = "clusterset.local."
+
+// newMultiClusterKubeDNS returns a KubeDNS serving the clusterset domain,
+// with the stores its informers would fill.
+func newMultiClusterKubeDNS() *KubeDNS {
+	kd := newKubeDNS()
+	kd.MultiClusterDomain = testMultiClusterDomain
+	kd.multiClusterPath = []string{"local", "clusterset"}
+	kd.serviceImportsStore = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{derivedServiceIndex: derivedServiceKeys})
+	kd.endpointSlicesStore = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{multiClusterSliceIndex: multiClusterSliceKeys})
+	return kd
+}
+
+func newServiceImport(importType mcs.ServiceImportType, ips ...string) *mcs.ServiceImport {
+	return &mcs.ServiceImport{
+		ObjectMeta: metav1.ObjectMeta{Name: testService, Namespace: testNamespace},
+		Spec: mcs.ServiceImportSpec{
+			Type:  importType,
+			IPs:   ips,
+			Ports: []mcs.ServicePort{{Name: "http", Protocol: v1.ProtocolTCP, Port: 80}},
+		},
+	}
+}
+
+func newMultiClusterSlice(name, cluster string, endpoints ...discovery.Endpoint) *discovery.EndpointSlice {
+	portName, protocol, port := "http", v1.ProtocolTCP, int32(8080)
+	return &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace, Labels: map[string]string{
+			mcs.LabelServiceName:   testService,
+			mcs.LabelSourceCluster: cluster,
+		}},
+		Endpoints: endpoints,
+		Ports:     []discovery.EndpointPort{{Name: &portName, Protocol: &protocol, Port: &port}},
+	}
+}
+
+func recordHosts(t *testing.T, kd *KubeDNS, name string) []string {
+	records, err := kd.Records(name, false)
+	if err != nil {
+		return nil
+	}
+	var hosts []string
+	for _, record := range records {
+		hosts = append(hosts, record.Host)
+	}
+	return hosts
+}
+
+func TestClusterSetIPServiceImport(t *testing.T) {
+	kd := newMultiClusterKubeDNS()
+	serviceImport := newServiceImport(mcs.ClusterSetIP, "10.42.0.1")
+	require.NoError(t, kd.serviceImportsStore.Add(serviceImport))
+	kd.handleServiceImportAdd(serviceImport)
+
+	name := testService + "." + testNamespace + ".svc." + testMultiClusterDomain
+	assert.Equal(t, []string{"10.42.0.1"}, recordHosts(t, kd, name))
+	assert.Equal(t, []string{name}, recordHosts(t, kd, "_http._tcp."+name))
+	// The cluster domain is not affected.
+	assert.Empty(t, recordHosts(t, kd, testService+"."+testNamespace+".svc."+testDomain))
+
+	require.NoError(t, kd.serviceImportsStore.Delete(serviceImport))
+	kd.handleServiceImportDelete(serviceImport)
+	assert.Empty(t, recordHosts(t, kd, name))
+}
+
+func TestDerivedServiceImport(t *testing.T) {
+	kd := newMultiClusterKubeDNS()
+	serviceImport := newServiceImport(mcs.ClusterSetIP)
+	serviceImport.Annotations = map[string]string{mcs.DerivedServiceAnnotation: "derived-abc"}
+	require.NoError(t, kd.serviceImportsStore.Add(serviceImport))
+	kd.handleServiceImportAdd(serviceImport)
+	name := testService + "." + testNamespace + ".svc." + testMultiClusterDomain
+	assert.Empty(t, recordHosts(t, kd, name))
+
+	// The ClusterSetIP is that of the derived service, once it has one.
+	derived := newService(testNamespace, "derived-abc", "10.42.0.2", "http", 80)
+	require.NoError(t, kd.servicesStore.Add(derived))
+	kd.newService(derived)
+	assert.Equal(t, []string{"10.42.0.2"}, recordHosts(t, kd, name))
+
+	require.NoError(t, kd.servicesStore.Delete(derived))
+	kd.removeService(derived)
+	assert.Empty(t, recordHosts(t, kd, name))
+}
+
+func TestHeadlessServiceImport(t *testing.T) {
+	kd := newMultiClusterKubeDNS()
+	serviceImport := newServiceImport(mcs.Headless)
+	require.NoError(t, kd.serviceImportsStore.Add(serviceImport))
+	kd.handleServiceImportAdd(serviceImport)
+
+	hostname, notReady := "db-0", false
+	east := newMultiClusterSlice("east-1", "east",
+		discovery.Endpoint{Addresses: []string{"10.1.0.1"}, Hostname: &hostname},
+		discovery.Endpoint{Addresses: []string{"10.1.0.2"}, Conditions: discovery.EndpointConditions{Ready: &notReady}})
+	west := newMultiClusterSlice("west-1", "west", discovery.Endpoint{Addresses: []string{"10.2.0.1"}})
+	// Slices of services of the cluster are ignored.
+	local := newMultiClusterSlice("local", "")
+	local.Labels = map[string]string{discovery.LabelServiceName: testService}
+	local.Endpoints = []discovery.Endpoint{{Addresses: []string{"10.0.0.1"}}}
+	for _, slice := range []*discovery.EndpointSlice{east, west, local} {
+		require.NoError(t, kd.endpointSlicesStore.Add(slice))
+		kd.handleEndpointSliceAdd(slice)
+	}
+
+	name := testService + "." + testNamespace + ".svc." + testMultiClusterDomain
+	assert.ElementsMatch(t, []string{"10.1.0.1", "10.2.0.1"}, recordHosts(t, kd, name))
+	assert.Equal(t, []string{"10.1.0.1"}, recordHosts(t, kd, "db-0.east."+name))
+	targets := recordHosts(t, kd, "_http._tcp."+name)
+	assert.Len(t, targets, 2)
+	assert.Contains(t, targets, "db-0.east."+name)
+
+	require.NoError(t, kd.endpointSlicesStore.Delete(east))
+	kd.handleEndpointSliceDelete(east)
+	assert.Equal(t, []string{"10.2.0.1"}, recordHosts(t, kd, name))
+	assert.Empty(t, recordHosts(t, kd, "db-0.east."+name))
+}
+
+func TestHeadlessServiceImportDuplicateAddresses(t *testing.T) {
+	kd := newMultiClusterKubeDNS()
+	serviceImport := newServiceImport(mcs.Headless)
+	require.NoError(t, kd.serviceImportsStore.Add(serviceImport))
+	kd.handleServiceImportAdd(serviceImport)
+
+	// The address is listed by two slices of the cluster, named in one.
+	hostname := "db-0"
+	named := newMultiClusterSlice("east-1", "east", discovery.Endpoint{Addresses: []string{"10.1.0.1"}, Hostname: &hostname})
+	unnamed := newMultiClusterSlice("east-2", "east", discovery.Endpoint{Addresses: []string{"10.1.0.1"}})
+	for _, slice := range []*discovery.EndpointSlice{unnamed, named} {
+		require.NoError(t, kd.endpointSlicesStore.Add(slice))
+		kd.handleEndpointSliceAdd(slice)
+	}
+
+	name := testService + "." + testNamespace + ".svc." + testMultiClusterDomain
+	assert.Equal(t, []string{"10.1.0.1"}, recordHosts(t, kd, name))
+	assert.Equal(t, []string{"db-0.east." + name}, recordHosts(t, kd, "_http._tcp."+name))
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultNegativeCacheSize is the number of names the negative cache
+// remembers at most if NegativeCacheSize is not positive.
+const DefaultNegativeCacheSize = 10000
+
+var (
+	negativeCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "kubedns",
+		Subsystem: "negative_cache",
+		Name:      "hits_total",
+		Help:      "Queries answered NXDOMAIN from the names recently found to have no record.",
+	})
+	registerNegativeCacheMetrics sync.Once
+)
+
+// negativeKey is a name remembered by the negative cache.
+type negativeKey struct {
+	name  string
+	exact bool
+}
+
+// negativeCache remembers the names recently found to have no record in
+// the cache, so that the search path expansions of the names outside of
+// the cluster, e.g. example.com.my-ns.svc.cluster.local with ndots:5, do
+// not walk the cache again and again. It is reset whenever a snapshot of
+// the cache is published: a name is never answered NXDOMAIN from it once
+// it has a record. A nil negativeCache remembers nothing.
+type negativeCache struct {
+	ttl  time.Duration
+	size int
+
+	lock sync.Mutex
+	// generation is incremented by reset, the names found to have no
+	// record in a previous generation are not added.
+	generation uint64
+	expiry     map[negativeKey]time.Time
+}
+
+// negativeCache returns the negative cache of kd, nil if NegativeCacheTTL
+// is not positive.
+func (kd *KubeDNS) negativeCache() *negativeCache {
+	kd.negativesOnce.Do(func() {
+		if kd.NegativeCacheTTL <= 0 {
+			return
+		}
+		size := kd.NegativeCacheSize
+		if size <= 0 {
+			size = DefaultNegativeCacheSize
+		}
+		registerNegativeCacheMetrics.Do(func() { prometheus.MustRegister(negativeCacheHits) })
+		kd.negatives = &negativeCache{ttl: kd.NegativeCacheTTL, size: size}
+	})
+	return kd.negatives
+}
+
+// contains returns whether name was recently found to have no record, and
+// the generation to add it in otherwise.
+func (c *negativeCache) contains(name string, exact bool) (bool, uint64) {
+	if c == nil {
+		return false, 0
+	}
+	key := negativeKey{name, exact}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	expiry, ok := c.expiry[key]
+	if !ok {
+		return false, c.generation
+	}
+	if time.Now().After(expiry) {
+		delete(c.expiry, key)
+		return false, c.generation
+	}
+	negativeCacheHits.Inc()
+	return true, c.generation
+}
+
+// add remembers that name has no record, unless the cache was reset since
+// generation was returned by contains. The expired names are dropped when
+// the cache is full, every name if none expired.
+func (c *negativeCache) add(generation uint64, name string, exact bool) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if generation != c.generation {
+		return
+	}
+	now := time.Now()
+	if len(c.expiry) >= c.size {
+		for key, expiry := range c.expiry {
+			if now.After(expiry) {
+				delete(c.expiry, key)
+			}
+		}
+		if len(c.expiry) >= c.size {
+			c.expiry = nil
+		}
+	}
+	if c.expiry == nil {
+		c.expiry = make(map[negativeKey]time.Time)
+	}
+	c.expiry[negativeKey{name, exact}] = now.Add(c.ttl)
+}
+
+// reset forgets every name.
+func (c *negativeCache) reset() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	c.expiry = nil
+}
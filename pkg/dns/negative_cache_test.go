@@ -0,0 +1,88 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+func TestNegativeCache(t *testing.T) {
+	kd := newKubeDNS()
+	kd.NegativeCacheTTL = time.Minute
+	const name = "web.default.svc.cluster.local."
+
+	_, err := kd.Records(name, false)
+	assert.True(t, errors.Is(err, server.ErrNotFound), "got %v", err)
+	found, _ := kd.negativeCache().contains(name, false)
+	assert.True(t, found)
+	found, _ = kd.negativeCache().contains(name, true)
+	assert.False(t, found)
+	_, err = kd.Records(name, false)
+	assert.True(t, errors.Is(err, server.ErrNotFound), "got %v", err)
+
+	// The name is forgotten once it has a record.
+	kd.newService(newService(testNamespace, "web", "10.0.0.1", "", 80))
+	records, err := kd.Records(name, false)
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+
+	// The pods are not in the cache.
+	_, err = kd.Records("not-an-ip.default.pod.cluster.local.", false)
+	assert.True(t, errors.Is(err, server.ErrInvalid), "got %v", err)
+	found, _ = kd.negativeCache().contains("not-an-ip.default.pod.cluster.local.", false)
+	assert.False(t, found)
+}
+
+func TestNegativeCacheGenerations(t *testing.T) {
+	c := &negativeCache{ttl: time.Minute, size: 2}
+
+	_, generation := c.contains("a", true)
+	c.reset()
+	c.add(generation, "a", true)
+	found, generation := c.contains("a", true)
+	assert.False(t, found, "added after a reset")
+
+	c.add(generation, "a", true)
+	c.add(generation, "b", true)
+	found, _ = c.contains("a", true)
+	assert.True(t, found)
+
+	// The cache is full and nothing expired.
+	c.add(generation, "c", true)
+	found, _ = c.contains("a", true)
+	assert.False(t, found)
+	found, _ = c.contains("c", true)
+	assert.True(t, found)
+
+	c.ttl = -time.Minute
+	c.add(generation, "d", true)
+	found, _ = c.contains("d", true)
+	assert.False(t, found, "expired")
+
+	assert.NotPanics(t, func() {
+		var none *negativeCache
+		none.add(0, "a", true)
+		none.reset()
+	})
+}
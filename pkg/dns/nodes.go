@@ -0,0 +1,158 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"net"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	kcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/util"
+)
+
+// nodeSubdomain is the subdomain of the cluster domain serving the
+// addresses of the nodes, with NodeRecords.
+const nodeSubdomain = "node"
+
+// setNodeRecordsStore watches the nodes, serving their addresses under
+// node.<domain>.
+func (kd *KubeDNS) setNodeRecordsStore() {
+	informer := kd.informerFactory.Core().V1().Nodes().Informer()
+	informer.AddEventHandlerWithResyncPeriod(kcache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) { kd.updateNodeRecords(nil, nodeOf(obj)) },
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// Nodes update their status often, their addresses rarely.
+			oldNode, newNode := nodeOf(oldObj), nodeOf(newObj)
+			if oldNode != nil && newNode != nil && equalStrings(nodeAddresses(oldNode), nodeAddresses(newNode)) {
+				return
+			}
+			kd.updateNodeRecords(oldNode, newNode)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(kcache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			kd.updateNodeRecords(nodeOf(obj), nil)
+		},
+	}, kd.ResyncPeriod)
+	kd.nodeRecordsStore, kd.nodeController = informer.GetStore(), informer
+}
+
+// nodeOf returns obj if it is a node, nil otherwise.
+func nodeOf(obj interface{}) *v1.Node {
+	node, _ := obj.(*v1.Node)
+	return node
+}
+
+// nodeAddresses returns the internal IPs of a node, which its records
+// point at.
+func nodeAddresses(node *v1.Node) []string {
+	var addresses []string
+	for _, address := range node.Status.Addresses {
+		if address.Type == v1.NodeInternalIP && net.ParseIP(address.Address) != nil {
+			addresses = append(addresses, address.Address)
+		}
+	}
+	return addresses
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// updateNodeRecords replaces the records of oldNode, if any, with those of
+// newNode, if any, e.g. my-node.node.cluster.local. Only the entries of the
+// node are written, as the names of nodes may be subdomains of each other:
+// the name of a deleted node is removed with the names above it that no
+// other node is named at or under.
+func (kd *KubeDNS) updateNodeRecords(oldNode, newNode *v1.Node) {
+	kd.cacheLock.Lock()
+	defer kd.unlockCache()
+	if oldNode != nil {
+		path := kd.nodePath(oldNode.Name)
+		for _, address := range nodeAddresses(oldNode) {
+			key := util.HashServiceRecord(util.NewServiceRecord(address, 0))
+			kd.cache.DeletePath(append(path[:len(path):len(path)], key)...)
+		}
+		if newNode == nil {
+			kd.deleteNodeName(oldNode.Name)
+		}
+	}
+	if newNode != nil {
+		path, fqdn := kd.nodePath(newNode.Name), kd.nodeFQDN(newNode.Name)
+		for _, address := range nodeAddresses(newNode) {
+			record := util.NewServiceRecord(address, 0)
+			kd.cache.SetEntry(util.HashServiceRecord(record), record, fqdn, path...)
+		}
+	}
+	klog.V(3).Infof("Updated the records of node %q", nodeName(oldNode, newNode))
+}
+
+// deleteNodeName removes the name of a deleted node, along with the
+// highest name above it that no node of the store is named at or under.
+func (kd *KubeDNS) deleteNodeName(name string) {
+	labels := strings.Split(strings.ToLower(name), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		suffix := strings.Join(labels[i:], ".")
+		if !kd.hasNodesUnder(suffix) {
+			kd.cache.DeletePath(kd.nodePath(suffix)...)
+			return
+		}
+	}
+}
+
+// hasNodesUnder returns whether a node of the store is named name or under
+// it. name is lower case.
+func (kd *KubeDNS) hasNodesUnder(name string) bool {
+	for _, key := range kd.nodeRecordsStore.ListKeys() {
+		key = strings.ToLower(key)
+		if key == name || strings.HasSuffix(key, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodePath returns the path of the records of a node in the cache.
+func (kd *KubeDNS) nodePath(name string) []string {
+	labels := strings.Split(strings.ToLower(name), ".")
+	path := append(append([]string{}, kd.domainPath...), nodeSubdomain)
+	return append(path, util.ReverseArray(labels)...)
+}
+
+func nodeName(oldNode, newNode *v1.Node) string {
+	if newNode != nil {
+		return newNode.Name
+	}
+	return oldNode.Name
+}
+
+// nodeFQDN returns the name of the records of a node.
+func (kd *KubeDNS) nodeFQDN(name string) string {
+	return strings.ToLower(name) + "." + nodeSubdomain + "." + strings.TrimSuffix(kd.domain, ".") + "."
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newNode(name string, addresses ...v1.NodeAddress) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status:     v1.NodeStatus{Addresses: addresses},
+	}
+}
+
+func TestNodeRecords(t *testing.T) {
+	kd := newKubeDNS()
+	kd.NodeRecords = true
+	kd.nodeRecordsStore = cache.NewStore(cache.MetaNamespaceKeyFunc)
+
+	set := func(node *v1.Node) {
+		old, _, _ := kd.nodeRecordsStore.Get(node)
+		require.NoError(t, kd.nodeRecordsStore.Update(node))
+		if old != nil {
+			kd.updateNodeRecords(old.(*v1.Node), node)
+		} else {
+			kd.updateNodeRecords(nil, node)
+		}
+	}
+	remove := func(node *v1.Node) {
+		require.NoError(t, kd.nodeRecordsStore.Delete(node))
+		kd.updateNodeRecords(node, nil)
+	}
+
+	node1 := newNode("node-1",
+		v1.NodeAddress{Type: v1.NodeInternalIP, Address: "10.0.0.1"},
+		v1.NodeAddress{Type: v1.NodeInternalIP, Address: "fd00::1"},
+		v1.NodeAddress{Type: v1.NodeExternalIP, Address: "203.0.113.1"},
+		v1.NodeAddress{Type: v1.NodeHostName, Address: "node-1"})
+	node2 := newNode("ip-10-0-0-2.ec2.internal", v1.NodeAddress{Type: v1.NodeInternalIP, Address: "10.0.0.2"})
+	node3 := newNode("ec2.internal", v1.NodeAddress{Type: v1.NodeInternalIP, Address: "10.0.0.3"})
+	for _, node := range []*v1.Node{node1, node2, node3} {
+		set(node)
+	}
+
+	assert.ElementsMatch(t, []string{"10.0.0.1", "fd00::1"}, recordHosts(t, kd, "node-1.node.cluster.local."))
+	assert.Equal(t, []string{"10.0.0.2"}, recordHosts(t, kd, "ip-10-0-0-2.ec2.internal.node.cluster.local."))
+	assert.Equal(t, []string{"10.0.0.3"}, recordHosts(t, kd, "ec2.internal.node.cluster.local."))
+	assert.Empty(t, recordHosts(t, kd, "node-2.node.cluster.local."))
+
+	// Changing the addresses of a node replaces its records only.
+	set(newNode("ec2.internal", v1.NodeAddress{Type: v1.NodeInternalIP, Address: "10.0.0.4"}))
+	assert.Equal(t, []string{"10.0.0.4"}, recordHosts(t, kd, "ec2.internal.node.cluster.local."))
+	assert.Equal(t, []string{"10.0.0.2"}, recordHosts(t, kd, "ip-10-0-0-2.ec2.internal.node.cluster.local."))
+
+	// Deleting a node keeps the nodes under its name.
+	remove(newNode("ec2.internal", v1.NodeAddress{Type: v1.NodeInternalIP, Address: "10.0.0.4"}))
+	assert.Empty(t, recordHosts(t, kd, "ec2.internal.node.cluster.local."))
+	assert.Equal(t, []string{"10.0.0.2"}, recordHosts(t, kd, "ip-10-0-0-2.ec2.internal.node.cluster.local."))
+	assert.True(t, kd.cache.HasPath(kd.nodePath("ec2.internal")...))
+
+	// Deleting the last node under a name removes it.
+	remove(node2)
+	assert.False(t, kd.cache.HasPath(kd.nodePath("internal")...))
+	assert.ElementsMatch(t, []string{"10.0.0.1", "fd00::1"}, recordHosts(t, kd, "node-1.node.cluster.local."))
+}
+
+func TestNodeRecordsCustomRecords(t *testing.T) {
+	kd := newKubeDNS()
+	kd.NodeRecords = true
+	kd.setCustomRecords("10.1.0.1 node-1.node\n10.1.0.2 registry")
+	assert.Empty(t, recordHosts(t, kd, "node-1.node.cluster.local."))
+	assert.Equal(t, []string{"10.1.0.2"}, recordHosts(t, kd, "registry.cluster.local."))
+}
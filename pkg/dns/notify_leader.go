@@ -0,0 +1,86 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+// NotifyLeader elects, among the replicas, the one notifying the
+// secondaries of the changes of the cluster domain, so that they are
+// notified once: the replicas compete for a coordination.k8s.io Lease, and
+// its holder notifies.
+type NotifyLeader struct {
+	lock   *resourcelock.LeaseLock
+	leader int32
+}
+
+// NewNotifyLeader returns a NotifyLeader competing for the Lease name of
+// namespace as identity, typically the name of the pod.
+func NewNotifyLeader(client clientset.Interface, namespace, name, identity string) *NotifyLeader {
+	return &NotifyLeader{lock: &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}}
+}
+
+// Run competes for the Lease until stopCh is closed, standing again when
+// the Lease is lost.
+func (l *NotifyLeader) Run(stopCh <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	wait.Until(func() {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            l.lock,
+			LeaseDuration:   15 * time.Second,
+			RenewDeadline:   10 * time.Second,
+			RetryPeriod:     2 * time.Second,
+			ReleaseOnCancel: true,
+			Name:            l.lock.LeaseMeta.Name,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(context.Context) {
+					klog.V(0).Infof("Notifying the secondaries as %s", l.lock.Identity())
+					atomic.StoreInt32(&l.leader, 1)
+				},
+				OnStoppedLeading: func() {
+					klog.V(0).Infof("Not notifying the secondaries anymore as %s", l.lock.Identity())
+					atomic.StoreInt32(&l.leader, 0)
+				},
+			},
+		})
+	}, time.Second, stopCh)
+}
+
+// IsLeader returns whether this replica holds the Lease, and notifies the
+// secondaries.
+func (l *NotifyLeader) IsLeader() bool {
+	return atomic.LoadInt32(&l.leader) == 1
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNotifyLeader(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	stopA := make(chan struct{})
+	stopB := make(chan struct{})
+	defer close(stopB)
+
+	a := NewNotifyLeader(client, "kube-system", "kube-dns-notify", "kube-dns-a")
+	go a.Run(stopA)
+	require.NoError(t, wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return a.IsLeader(), nil
+	}))
+
+	// The other replicas do not notify while a holds the Lease.
+	b := NewNotifyLeader(client, "kube-system", "kube-dns-notify", "kube-dns-b")
+	go b.Run(stopB)
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, b.IsLeader())
+
+	// They take over once a releases it.
+	close(stopA)
+	require.NoError(t, wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		return b.IsLeader() && !a.IsLeader(), nil
+	}))
+}
@@ -0,0 +1,339 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/lru"
+
+	"k8s.io/dns/pkg/dns/config"
+	"k8s.io/dns/pkg/dns/util"
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+	"k8s.io/dns/third_party/forked/skydns/server"
+	"k8s.io/dns/third_party/forked/skydns/singleflight"
+)
+
+// peerClusterSubdomain is the subdomain of the cluster domain under which
+// the services of the peer clusters are resolved.
+const peerClusterSubdomain = "remote"
+
+// maxPeerAnswers is how many answers of the peer clusters are cached, the
+// least recently used ones being evicted beyond.
+var maxPeerAnswers = 4096
+
+// PeerClusters resolves the services of peer clusters,
+// <service>.<namespace>.<peer>.remote.<cluster domain>, by forwarding the
+// query for <service>.<namespace>.svc.<peer domain> to the kube-dns of the
+// peer. It supersedes the federation CNAME redirects, which need the
+// federation domain to be resolvable by the clients. Answers are cached for
+// at most TTL, and the nameservers of a peer whose health check, run every
+// TTL by Run, fails are skipped until the next check.
+type PeerClusters struct {
+	// TTL for which answers are cached, and period of the health checks.
+	TTL time.Duration
+	// Timeout of a single query to a nameserver of a peer.
+	Timeout time.Duration
+
+	// exchange sends a query to a nameserver. Replaced in tests.
+	exchange func(m *dns.Msg, server string) (*dns.Msg, error)
+
+	// answers maps a queried name to its cached peerAnswer.
+	answers *lru.Cache
+	// inflight resolves a name once for the concurrent queries.
+	inflight singleflight.Group
+
+	lock sync.Mutex
+	// peers maps a peer name to its domain and nameservers.
+	peers map[string]peerCluster
+	// generation counts the changes of the peers.
+	generation int
+	// unhealthy holds the nameservers of the peers whose last check or
+	// query failed.
+	unhealthy map[string]bool
+}
+
+type peerCluster struct {
+	domain      string
+	nameservers []string
+}
+
+type peerAnswer struct {
+	records []skymsg.Service
+	err     error
+	expires time.Time
+}
+
+// NewPeerClusters returns a PeerClusters caching answers for at most ttl
+// and waiting at most timeout for each nameserver.
+func NewPeerClusters(ttl, timeout time.Duration) *PeerClusters {
+	p := &PeerClusters{
+		TTL:       ttl,
+		Timeout:   timeout,
+		answers:   lru.New(maxPeerAnswers),
+		peers:     make(map[string]peerCluster),
+		unhealthy: make(map[string]bool),
+	}
+	p.exchange = func(m *dns.Msg, server string) (*dns.Msg, error) {
+		c := &dns.Client{Timeout: p.Timeout}
+		r, _, err := c.Exchange(m, server)
+		return r, err
+	}
+	return p
+}
+
+// set replaces the peers, dropping the cached answers and health checks.
+func (p *PeerClusters) set(peers map[string]peerCluster) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.peers = peers
+	p.generation++
+	p.answers.Clear()
+	p.unhealthy = make(map[string]bool)
+}
+
+// Run checks the health of the nameservers of the peers every TTL until
+// stopCh is closed.
+func (p *PeerClusters) Run(stopCh <-chan struct{}) {
+	wait.Until(p.checkHealth, p.TTL, stopCh)
+}
+
+// records returns the addresses of the service of a peer cluster, or the
+// target of its CNAME if the peer answers with one only.
+func (p *PeerClusters) records(peer, namespace, service string) ([]skymsg.Service, error) {
+	p.lock.Lock()
+	cluster, ok := p.peers[peer]
+	p.lock.Unlock()
+	if !ok {
+		return nil, server.ErrNotFound
+	}
+	name := dns.Fqdn(strings.Join([]string{service, namespace, serviceSubdomain, cluster.domain}, "."))
+
+	if cached, ok := p.answers.Get(name); ok {
+		if answer := cached.(peerAnswer); time.Now().Before(answer.expires) {
+			return answer.records, answer.err
+		}
+	}
+	// The concurrent queries for name wait for the same answer.
+	answer, _ := p.inflight.Do(name, func() (interface{}, error) {
+		return p.resolveAnswer(peer, name, cluster.nameservers), nil
+	})
+	return answer.(peerAnswer).records, answer.(peerAnswer).err
+}
+
+// resolveAnswer resolves name from the healthy nameservers of peer, and
+// caches the answer unless they are unavailable.
+func (p *PeerClusters) resolveAnswer(peer, name string, nameservers []string) peerAnswer {
+	var healthy []string
+	p.lock.Lock()
+	for _, nameserver := range nameservers {
+		if !p.unhealthy[nameserver] {
+			healthy = append(healthy, nameserver)
+		}
+	}
+	p.lock.Unlock()
+	if len(healthy) == 0 {
+		return peerAnswer{err: fmt.Errorf("peer cluster %q is unhealthy: %w", peer, server.ErrBackendUnavailable)}
+	}
+
+	now := time.Now()
+	records, ttl, err := p.resolve(name, healthy)
+	answer := peerAnswer{records: records, err: err, expires: now.Add(ttl)}
+	if errors.Is(err, server.ErrBackendUnavailable) {
+		// Do not cache the failure, the next query retries.
+		return answer
+	}
+	p.answers.Add(name, answer)
+	return answer
+}
+
+// resolve queries the addresses of name from each nameserver in turn until
+// one of them answers, and returns them with the TTL to cache them for.
+func (p *PeerClusters) resolve(name string, nameservers []string) ([]skymsg.Service, time.Duration, error) {
+	var lastErr error
+	for _, nameserver := range nameservers {
+		records, ttl, err := p.resolveFrom(name, nameserver)
+		if err == nil || errors.Is(err, server.ErrNotFound) {
+			return records, ttl, err
+		}
+		klog.Warningf("Peer clusters: query for %q to %s failed: %v", name, nameserver, err)
+		p.lock.Lock()
+		p.unhealthy[nameserver] = true
+		p.lock.Unlock()
+		lastErr = err
+	}
+	return nil, 0, fmt.Errorf("%v: %w", lastErr, server.ErrBackendUnavailable)
+}
+
+// resolveFrom queries the A and AAAA records of name from nameserver.
+func (p *PeerClusters) resolveFrom(name, nameserver string) ([]skymsg.Service, time.Duration, error) {
+	ttl := p.TTL
+	var records []skymsg.Service
+	var target string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		r, err := p.exchange(m, nameserver)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch r.Rcode {
+		case dns.RcodeSuccess:
+		case dns.RcodeNameError:
+			return nil, negativeTTL(r, ttl), fmt.Errorf("%q: %w", name, server.ErrNotFound)
+		default:
+			return nil, 0, fmt.Errorf("%s", dns.RcodeToString[r.Rcode])
+		}
+		for _, rr := range r.Answer {
+			if d := time.Duration(rr.Header().Ttl) * time.Second; d < ttl {
+				ttl = d
+			}
+			switch rr := rr.(type) {
+			case *dns.A:
+				records = append(records, skymsg.Service{Host: rr.A.String()})
+			case *dns.AAAA:
+				records = append(records, skymsg.Service{Host: rr.AAAA.String()})
+			case *dns.CNAME:
+				if strings.EqualFold(rr.Hdr.Name, name) {
+					target = rr.Target
+				}
+			}
+		}
+	}
+	if len(records) == 0 {
+		if target == "" {
+			return nil, ttl, fmt.Errorf("%q has no addresses: %w", name, server.ErrNotFound)
+		}
+		records = []skymsg.Service{{Host: target}}
+	}
+	for i := range records {
+		records[i].Ttl = uint32(ttl / time.Second)
+	}
+	return records, ttl, nil
+}
+
+// negativeTTL returns the TTL of the SOA of a negative reply r, bounded by
+// ttl.
+func negativeTTL(r *dns.Msg, ttl time.Duration) time.Duration {
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if d := time.Duration(soa.Minttl) * time.Second; d < ttl {
+				return d
+			}
+		}
+	}
+	return ttl
+}
+
+// checkHealth checks whether the SOA of the domain of each peer resolves
+// through each of its nameservers, the others being skipped until the next
+// check.
+func (p *PeerClusters) checkHealth() {
+	p.lock.Lock()
+	peers, generation := p.peers, p.generation
+	p.lock.Unlock()
+
+	unhealthy := make(map[string]bool)
+	for _, cluster := range peers {
+		for _, nameserver := range cluster.nameservers {
+			m := new(dns.Msg)
+			m.SetQuestion(dns.Fqdn(cluster.domain), dns.TypeSOA)
+			r, err := p.exchange(m, nameserver)
+			if err == nil && r.Rcode != dns.RcodeSuccess {
+				err = fmt.Errorf("%s", dns.RcodeToString[r.Rcode])
+			}
+			if err != nil {
+				klog.Warningf("Peer clusters: health check of %s for %q failed: %v", nameserver, cluster.domain, err)
+				unhealthy[nameserver] = true
+			}
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	// The results are outdated if the peers changed during the checks.
+	if p.generation == generation {
+		p.unhealthy = unhealthy
+	}
+}
+
+// setPeerClusters applies the peer clusters of the configuration. The
+// domain of a peer defaults to the cluster domain.
+func (kd *KubeDNS) setPeerClusters(peers map[string]config.PeerCluster) {
+	if kd.PeerClusters == nil {
+		return
+	}
+	clusters := make(map[string]peerCluster, len(peers))
+	names := make([]string, 0, len(peers))
+	for name, peer := range peers {
+		domain := peer.Domain
+		if domain == "" {
+			domain = kd.domain
+		}
+		cluster := peerCluster{domain: strings.ToLower(strings.TrimSuffix(domain, "."))}
+		for _, nameserver := range peer.Nameservers {
+			ip, port, err := util.ValidateNameserverIpAndPort(nameserver)
+			if err != nil {
+				klog.Errorf("Invalid nameserver %q for the peer cluster %q: %v", nameserver, name, err)
+				continue
+			}
+			cluster.nameservers = append(cluster.nameservers, net.JoinHostPort(ip, port))
+		}
+		clusters[strings.ToLower(name)] = cluster
+		names = append(names, name)
+	}
+	kd.PeerClusters.set(clusters)
+	if len(names) > 0 {
+		sort.Strings(names)
+		klog.V(2).Infof("Peer clusters: %v", names)
+	}
+}
+
+// isPeerClusterQuery returns whether the query segments are
+// <service>.<namespace>.<peer>.remote.<cluster domain>.
+func (kd *KubeDNS) isPeerClusterQuery(segments []string) bool {
+	if kd.PeerClusters == nil || len(segments) != len(kd.domainPath)+4 {
+		return false
+	}
+	for i, label := range kd.domainPath {
+		// kd.domainPath is reversed, so we need to look in the segments in
+		// the reverse order.
+		if !strings.EqualFold(segments[len(segments)-1-i], label) {
+			return false
+		}
+	}
+	return strings.EqualFold(segments[3], peerClusterSubdomain)
+}
+
+// peerClusterRecords returns the records of the service of a peer cluster
+// for the query segments, as matched by isPeerClusterQuery.
+func (kd *KubeDNS) peerClusterRecords(segments []string) ([]skymsg.Service, error) {
+	service, namespace, peer := strings.ToLower(segments[0]), strings.ToLower(segments[1]), strings.ToLower(segments[2])
+	if service == "*" || namespace == "*" {
+		return nil, fmt.Errorf("wildcard queries are not forwarded to peer clusters: %w", server.ErrNotFound)
+	}
+	return kd.PeerClusters.records(peer, namespace, service)
+}
@@ -0,0 +1,247 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/dns/pkg/dns/config"
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+// fakePeerCluster answers for the services in addresses, the SOA of its
+// domain if it is up, and counts the address queries it received.
+type fakePeerCluster struct {
+	down      map[string]bool
+	addresses map[string][]string
+	cnames    map[string]string
+	queries   int
+}
+
+func (f *fakePeerCluster) exchange(m *dns.Msg, nameserver string) (*dns.Msg, error) {
+	if f.down[nameserver] {
+		return nil, errors.New("timeout")
+	}
+	r := new(dns.Msg)
+	r.SetReply(m)
+	q := m.Question[0]
+	if q.Qtype == dns.TypeSOA {
+		return r, nil
+	}
+	f.queries++
+	if target, ok := f.cnames[q.Name]; ok {
+		r.Answer = append(r.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: target,
+		})
+		return r, nil
+	}
+	addresses, ok := f.addresses[q.Name]
+	if !ok {
+		r.Rcode = dns.RcodeNameError
+		return r, nil
+	}
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip.To4() != nil && q.Qtype == dns.TypeA {
+			r.Answer = append(r.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+				A:   ip,
+			})
+		}
+		if ip.To4() == nil && q.Qtype == dns.TypeAAAA {
+			r.Answer = append(r.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 10},
+				AAAA: ip,
+			})
+		}
+	}
+	return r, nil
+}
+
+func newPeerClustersKubeDNS(peer *fakePeerCluster) *KubeDNS {
+	kd := newKubeDNS()
+	kd.PeerClusters = NewPeerClusters(time.Hour, time.Second)
+	kd.PeerClusters.exchange = peer.exchange
+	kd.setPeerClusters(map[string]config.PeerCluster{
+		"cluster-b": {Nameservers: []string{"10.1.0.10", "10.1.0.11:53"}},
+		"cluster-c": {Domain: "c.local.", Nameservers: []string{"10.2.0.10"}},
+	})
+	return kd
+}
+
+func TestPeerClusters(t *testing.T) {
+	peer := &fakePeerCluster{
+		addresses: map[string][]string{
+			"web.default.svc.cluster.local.": {"10.1.1.1", "fd00::1"},
+			"web.default.svc.c.local.":       {"10.2.1.1"},
+		},
+		cnames: map[string]string{
+			"ext.default.svc.cluster.local.": "www.example.com.",
+		},
+	}
+	kd := newPeerClustersKubeDNS(peer)
+
+	records, err := kd.Records("web.default.cluster-b.remote.cluster.local.", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.1.1.1", "fd00::1"}, hosts(records))
+	assert.EqualValues(t, 10, records[0].Ttl)
+	assert.Equal(t, 2, peer.queries)
+
+	// Cached.
+	_, err = kd.Records("Web.Default.Cluster-B.remote.cluster.local.", false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, peer.queries)
+
+	// The domain of the peer is used.
+	records, err = kd.Records("web.default.cluster-c.remote.cluster.local.", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.2.1.1"}, hosts(records))
+
+	// CNAME to the target of the peer.
+	records, err = kd.Records("ext.default.cluster-b.remote.cluster.local.", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"www.example.com."}, hosts(records))
+
+	for _, name := range []string{
+		"missing.default.cluster-b.remote.cluster.local.",
+		"web.default.cluster-d.remote.cluster.local.",
+		"*.default.cluster-b.remote.cluster.local.",
+	} {
+		_, err = kd.Records(name, false)
+		assert.True(t, errors.Is(err, server.ErrNotFound), "%s: %v", name, err)
+	}
+
+	// Not forwarded once the peer is removed from the configuration.
+	kd.setPeerClusters(nil)
+	_, err = kd.Records("web.default.cluster-b.remote.cluster.local.", false)
+	assert.True(t, errors.Is(err, server.ErrNotFound), "%v", err)
+}
+
+func TestPeerClustersHealth(t *testing.T) {
+	peer := &fakePeerCluster{
+		down:      map[string]bool{"10.1.0.10:53": true},
+		addresses: map[string][]string{"web.default.svc.cluster.local.": {"10.1.1.1"}},
+	}
+	kd := newPeerClustersKubeDNS(peer)
+	kd.PeerClusters.checkHealth()
+	assert.Equal(t, map[string]bool{"10.1.0.10:53": true}, kd.PeerClusters.unhealthy)
+
+	// The unhealthy nameserver is skipped.
+	records, err := kd.Records("web.default.cluster-b.remote.cluster.local.", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.1.1.1"}, hosts(records))
+
+	// Failures are not cached.
+	peer.down["10.2.0.10:53"] = true
+	_, err = kd.Records("web.default.cluster-c.remote.cluster.local.", false)
+	assert.True(t, errors.Is(err, server.ErrBackendUnavailable), "%v", err)
+	_, err = kd.Records("web.default.cluster-c.remote.cluster.local.", false)
+	assert.True(t, errors.Is(err, server.ErrBackendUnavailable), "%v", err)
+	delete(peer.down, "10.2.0.10:53")
+	kd.PeerClusters.checkHealth()
+	_, err = kd.Records("web.default.cluster-c.remote.cluster.local.", false)
+	assert.True(t, errors.Is(err, server.ErrNotFound), "%v", err)
+}
+
+func TestPeerClustersCacheSize(t *testing.T) {
+	defer func(size int) { maxPeerAnswers = size }(maxPeerAnswers)
+	maxPeerAnswers = 2
+	peer := &fakePeerCluster{addresses: map[string][]string{"web.default.svc.cluster.local.": {"10.1.1.1"}}}
+	kd := newPeerClustersKubeDNS(peer)
+
+	_, err := kd.Records("web.default.cluster-b.remote.cluster.local.", false)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := kd.Records(fmt.Sprintf("missing-%d.default.cluster-b.remote.cluster.local.", i), false)
+		assert.True(t, errors.Is(err, server.ErrNotFound), "%v", err)
+	}
+	assert.Equal(t, 2, kd.PeerClusters.answers.Len())
+
+	// The least recently used answer was evicted.
+	queries := peer.queries
+	_, err = kd.Records("web.default.cluster-b.remote.cluster.local.", false)
+	require.NoError(t, err)
+	assert.Equal(t, queries+2, peer.queries)
+}
+
+func TestPeerClustersConcurrentQueries(t *testing.T) {
+	peer := &fakePeerCluster{addresses: map[string][]string{"web.default.svc.cluster.local.": {"10.1.1.1"}}}
+	kd := newPeerClustersKubeDNS(peer)
+	var lock sync.Mutex
+	release := make(chan struct{})
+	kd.PeerClusters.exchange = func(m *dns.Msg, nameserver string) (*dns.Msg, error) {
+		<-release
+		lock.Lock()
+		defer lock.Unlock()
+		return peer.exchange(m, nameserver)
+	}
+
+	const queries = 10
+	var wg sync.WaitGroup
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			records, err := kd.Records("web.default.cluster-b.remote.cluster.local.", false)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"10.1.1.1"}, hosts(records))
+		}()
+	}
+	// Let the queries wait for the first one.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	// The A and AAAA queries of the first one only.
+	assert.Equal(t, 2, peer.queries)
+}
+
+func TestIsPeerClusterQuery(t *testing.T) {
+	kd := newKubeDNS()
+	assert.False(t, kd.isPeerClusterQuery([]string{"web", "default", "cluster-b", "remote", "cluster", "local"}))
+
+	kd.PeerClusters = NewPeerClusters(time.Hour, time.Second)
+	for name, expected := range map[string]bool{
+		"web.default.cluster-b.remote.cluster.local":     true,
+		"web.default.cluster-b.REMOTE.cluster.local":     true,
+		"web.default.cluster-b.svc.cluster.local":        false,
+		"web.default.cluster-b.remote.example.local":     false,
+		"x.web.default.cluster-b.remote.cluster.local":   false,
+		"web.default.cluster-b.remote.cluster.local.com": false,
+	} {
+		assert.Equal(t, expected, kd.isPeerClusterQuery(strings.Split(name, ".")), name)
+	}
+}
+
+func hosts(records []skymsg.Service) []string {
+	var hosts []string
+	for _, record := range records {
+		hosts = append(hosts, record.Host)
+	}
+	return hosts
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package podindex maintains an index from pod IPs to pod identities, so
+// that the namespace and pod of a DNS client can be found from its source
+// address.
+package podindex
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	clientset "k8s.io/client-go/kubernetes"
+	kcache "k8s.io/client-go/tools/cache"
+)
+
+const podIPIndex = "podIP"
+
+// Pod identifies the pod owning an IP.
+type Pod struct {
+	Namespace string
+	Name      string
+	// Node is the name of the node the pod is scheduled on.
+	Node string
+}
+
+// PodIndex is an informer-backed index from pod IPs to pods. Only the
+// fields needed for the index are kept in memory, and host network pods
+// are ignored as they share the IP of their node.
+type PodIndex struct {
+	indexer    kcache.Indexer
+	controller kcache.Controller
+}
+
+// NewPodIndex returns a PodIndex watching the pods of every namespace. Run
+// must be called to start populating it.
+func NewPodIndex(client clientset.Interface, resyncPeriod time.Duration) *PodIndex {
+	p := &PodIndex{}
+	p.indexer, p.controller = kcache.NewTransformingIndexerInformer(
+		&kcache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return client.CoreV1().Pods(v1.NamespaceAll).List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return client.CoreV1().Pods(v1.NamespaceAll).Watch(context.TODO(), options)
+			},
+		},
+		&v1.Pod{},
+		resyncPeriod,
+		kcache.ResourceEventHandlerFuncs{},
+		kcache.Indexers{podIPIndex: indexPodIPs},
+		stripPod,
+	)
+	return p
+}
+
+// Run populates the index until stopCh is closed.
+func (p *PodIndex) Run(stopCh <-chan struct{}) {
+	p.controller.Run(stopCh)
+}
+
+// HasSynced returns true once the initial list of pods has been indexed.
+func (p *PodIndex) HasSynced() bool {
+	return p.controller.HasSynced()
+}
+
+// Lookup returns the running pod that owns ip.
+func (p *PodIndex) Lookup(ip string) (Pod, bool) {
+	objs, err := p.indexer.ByIndex(podIPIndex, ip)
+	if err != nil {
+		return Pod{}, false
+	}
+	for _, obj := range objs {
+		// IPs of pods that have completed can be reused by new pods.
+		if pod := obj.(*v1.Pod); !isTerminated(pod) {
+			return Pod{Namespace: pod.Namespace, Name: pod.Name, Node: pod.Spec.NodeName}, true
+		}
+	}
+	return Pod{}, false
+}
+
+// Len returns the number of pods in the index.
+func (p *PodIndex) Len() int {
+	return len(p.indexer.ListKeys())
+}
+
+func isTerminated(pod *v1.Pod) bool {
+	return pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed
+}
+
+func indexPodIPs(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return nil, fmt.Errorf("expected pod, got %T", obj)
+	}
+	if pod.Spec.HostNetwork || isTerminated(pod) {
+		return nil, nil
+	}
+	ips := make([]string, 0, len(pod.Status.PodIPs))
+	for _, podIP := range pod.Status.PodIPs {
+		ips = append(ips, podIP.IP)
+	}
+	if len(ips) == 0 && pod.Status.PodIP != "" {
+		ips = append(ips, pod.Status.PodIP)
+	}
+	return ips, nil
+}
+
+// stripPod drops every field of the pod that the index does not need.
+func stripPod(obj interface{}) (interface{}, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		// Tombstones are stored as is.
+		return obj, nil
+	}
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pod.Name,
+			Namespace:       pod.Namespace,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+		},
+		Spec: v1.PodSpec{
+			HostNetwork: pod.Spec.HostNetwork,
+			NodeName:    pod.Spec.NodeName,
+		},
+		Status: v1.PodStatus{
+			Phase:  pod.Status.Phase,
+			PodIP:  pod.Status.PodIP,
+			PodIPs: pod.Status.PodIPs,
+		},
+	}, nil
+}
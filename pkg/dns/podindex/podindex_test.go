@@ -0,0 +1,99 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podindex
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newPod(namespace, name string, phase v1.PodPhase, ips ...string) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "c", Image: "image"}}},
+		Status:     v1.PodStatus{Phase: phase},
+	}
+	for _, ip := range ips {
+		pod.Status.PodIPs = append(pod.Status.PodIPs, v1.PodIP{IP: ip})
+	}
+	if len(ips) > 0 {
+		pod.Status.PodIP = ips[0]
+	}
+	return pod
+}
+
+func TestPodIndex(t *testing.T) {
+	hostNetwork := newPod("kube-system", "proxy", v1.PodRunning, "192.168.0.1")
+	hostNetwork.Spec.HostNetwork = true
+	scheduled := newPod("ns1", "a", v1.PodRunning, "10.0.0.1", "fd00::1")
+	scheduled.Spec.NodeName = "node1"
+	client := fake.NewSimpleClientset(
+		scheduled,
+		newPod("ns2", "b", v1.PodSucceeded, "10.0.0.2"),
+		hostNetwork,
+	)
+	p := NewPodIndex(client, 0)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go p.Run(stopCh)
+	require.True(t, waitFor(p.HasSynced))
+
+	pod, ok := p.Lookup("10.0.0.1")
+	assert.True(t, ok)
+	assert.Equal(t, Pod{Namespace: "ns1", Name: "a", Node: "node1"}, pod)
+	pod, ok = p.Lookup("fd00::1")
+	assert.True(t, ok)
+	assert.Equal(t, Pod{Namespace: "ns1", Name: "a", Node: "node1"}, pod)
+	_, ok = p.Lookup("10.0.0.2")
+	assert.False(t, ok, "completed pods are not indexed")
+	_, ok = p.Lookup("192.168.0.1")
+	assert.False(t, ok, "host network pods are not indexed")
+	assert.Equal(t, 3, p.Len())
+
+	// The IP of the completed pod is reused.
+	_, err := client.CoreV1().Pods("ns3").Create(context.TODO(), newPod("ns3", "c", v1.PodRunning, "10.0.0.2"), metav1.CreateOptions{})
+	require.NoError(t, err)
+	require.True(t, waitFor(func() bool { _, ok := p.Lookup("10.0.0.2"); return ok }))
+	pod, _ = p.Lookup("10.0.0.2")
+	assert.Equal(t, Pod{Namespace: "ns3", Name: "c"}, pod)
+
+	require.NoError(t, client.CoreV1().Pods("ns1").Delete(context.TODO(), "a", metav1.DeleteOptions{}))
+	require.True(t, waitFor(func() bool { _, ok := p.Lookup("10.0.0.1"); return !ok }))
+}
+
+func TestStripPod(t *testing.T) {
+	obj, err := stripPod(newPod("ns1", "a", v1.PodRunning, "10.0.0.1"))
+	require.NoError(t, err)
+	pod := obj.(*v1.Pod)
+	assert.Empty(t, pod.Spec.Containers)
+	assert.Equal(t, "10.0.0.1", pod.Status.PodIP)
+	assert.Equal(t, "a", pod.Name)
+}
+
+func waitFor(condition func() bool) bool {
+	return wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return condition(), nil
+	}) == nil
+}
@@ -0,0 +1,319 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kcache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+// maxEventRetries is the number of times the handling of an event is
+// retried, with backoff, before it is dropped.
+const maxEventRetries = 5
+
+// eventQueue serializes the handling of the service and endpoints events of
+// each service, keyed by its namespace/name. Events of the same service that
+// are queued together are coalesced: the handlers are called once, with the
+// objects last applied and the current ones in the stores. With a coalesce
+// period, the events are held for that long before they are handled, so
+// that a burst of endpoints updates, e.g. during a rolling update, results
+// in a single rebuild of the records of the service.
+type eventQueue struct {
+	queue workqueue.RateLimitingInterface
+	// coalescePeriod is how long the events are held once the initial
+	// sync was handled.
+	coalescePeriod time.Duration
+
+	lock sync.Mutex
+	// appliedServices and appliedEndpoints are the objects that the
+	// handlers were last called with, by namespace/name.
+	appliedServices  map[string]*v1.Service
+	appliedEndpoints map[string]*v1.Endpoints
+	// unhandled is the number of events queued and not handled yet, by
+	// namespace/name. It is counted as the events are queued, rather than
+	// as the workers take them, so that an event taken from the queue but
+	// not handled yet is still seen by hasDrained.
+	unhandled map[string]int
+
+	// drained is set once the queue was empty after the initial sync.
+	drained int32
+}
+
+func newEventQueue(coalescePeriod time.Duration) *eventQueue {
+	registerQueueMetrics()
+	return &eventQueue{
+		queue:            workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "kubedns"),
+		coalescePeriod:   coalescePeriod,
+		appliedServices:  make(map[string]*v1.Service),
+		appliedEndpoints: make(map[string]*v1.Endpoints),
+		unhandled:        make(map[string]int),
+	}
+}
+
+// enqueue queues the key of the service of obj, a service or its endpoints.
+func (q *eventQueue) enqueue(obj interface{}) {
+	key, err := kcache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		klog.Errorf("Failed to get the key of %T: %v", obj, err)
+		return
+	}
+	q.lock.Lock()
+	q.unhandled[key]++
+	q.lock.Unlock()
+	// The events of the initial sync are not held, so that they are
+	// handled as soon as possible.
+	if q.coalescePeriod > 0 && atomic.LoadInt32(&q.drained) == 1 {
+		q.queue.AddAfter(key, q.coalescePeriod)
+		return
+	}
+	q.queue.Add(key)
+}
+
+// taken returns the number of events of key queued before a worker took
+// key from the queue, which handling key handles: the handlers read the
+// objects from the stores, which the informers updated before queuing the
+// events.
+func (q *eventQueue) taken(key string) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.unhandled[key]
+}
+
+// handled records that n events of key were handled.
+func (q *eventQueue) handled(key string, n int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.unhandled[key] -= n; q.unhandled[key] <= 0 {
+		delete(q.unhandled, key)
+	}
+}
+
+// hasDrained returns whether the events of the initial sync were handled.
+// It keeps returning true once they were, even as new events come in.
+func (q *eventQueue) hasDrained() bool {
+	if atomic.LoadInt32(&q.drained) == 1 {
+		return true
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.unhandled) > 0 {
+		return false
+	}
+	atomic.StoreInt32(&q.drained, 1)
+	return true
+}
+
+// serviceHandlers returns the handlers of the services informer, which
+// either queue the events or handle them inline if there is no queue.
+func (kd *KubeDNS) serviceHandlers() kcache.ResourceEventHandlerFuncs {
+	return kcache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if kd.queue != nil {
+				kd.queue.enqueue(obj)
+				return
+			}
+			kd.newService(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if kd.queue != nil {
+				kd.queue.enqueue(newObj)
+				return
+			}
+			kd.updateService(oldObj, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if kd.queue != nil {
+				kd.queue.enqueue(obj)
+				return
+			}
+			kd.removeService(obj)
+		},
+	}
+}
+
+// endpointsHandlers returns the handlers of the endpoints informer, like
+// serviceHandlers. The updates go through the debouncer, if any.
+func (kd *KubeDNS) endpointsHandlers() kcache.ResourceEventHandlerFuncs {
+	handlers := kcache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if kd.queue != nil {
+				kd.queue.enqueue(obj)
+				return
+			}
+			kd.handleEndpointAdd(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if kd.queue != nil {
+				kd.queue.enqueue(newObj)
+				return
+			}
+			kd.handleEndpointUpdate(oldObj, newObj)
+		},
+		// If Service is named headless need to remove the reverse dns entries.
+		DeleteFunc: func(obj interface{}) {
+			if kd.queue != nil {
+				kd.queue.enqueue(obj)
+				return
+			}
+			kd.handleEndpointDelete(obj)
+		},
+	}
+	if kd.debouncer != nil {
+		return kd.debouncer.handlers(handlers)
+	}
+	return handlers
+}
+
+// runEventWorkers handles the queued events with the given number of
+// workers until stopCh is closed.
+func (kd *KubeDNS) runEventWorkers(workers int, stopCh <-chan struct{}) {
+	klog.V(0).Infof("Handling service and endpoints events with %d workers", workers)
+	for i := 0; i < workers; i++ {
+		go wait.Until(func() {
+			for kd.processNextEvent() {
+			}
+		}, 0, stopCh)
+	}
+	<-stopCh
+	kd.queue.queue.ShutDown()
+}
+
+// processNextEvent handles the next queued event. It returns false once the
+// queue is shut down.
+func (kd *KubeDNS) processNextEvent() bool {
+	q := kd.queue
+	item, quit := q.queue.Get()
+	if quit {
+		return false
+	}
+	kd.processEvent(item)
+	return true
+}
+
+// processEvent handles item, taken from the queue.
+func (kd *KubeDNS) processEvent(item interface{}) {
+	q := kd.queue
+	defer q.queue.Done(item)
+
+	key := item.(string)
+	n := q.taken(key)
+	if err := kd.handleEvent(key); err != nil {
+		if q.queue.NumRequeues(item) < maxEventRetries {
+			klog.Warningf("Failed to handle the events of %q, retrying: %v", key, err)
+			q.queue.AddRateLimited(item)
+			return
+		}
+		klog.Errorf("Dropping the events of %q after %d retries: %v", key, maxEventRetries, err)
+	}
+	q.handled(key, n)
+	q.queue.Forget(item)
+}
+
+// handleEvent calls the service and endpoints handlers of the service with
+// key with the objects last applied and the ones in the stores, if they
+// changed. Panics are returned as errors, so that the event is retried and
+// the worker survives.
+func (kd *KubeDNS) handleEvent(key string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	if err := kd.syncService(key); err != nil {
+		return err
+	}
+	return kd.syncEndpoints(key)
+}
+
+// syncService applies the service with key in the store.
+func (kd *KubeDNS) syncService(key string) error {
+	q := kd.queue
+	obj, exists, err := kd.servicesStore.GetByKey(key)
+	if err != nil {
+		return err
+	}
+	q.lock.Lock()
+	old := q.appliedServices[key]
+	q.lock.Unlock()
+	var current *v1.Service
+	switch {
+	case exists:
+		current = obj.(*v1.Service)
+		switch {
+		case old == current:
+			// Only the endpoints changed.
+		case old != nil:
+			kd.updateService(old, current)
+		default:
+			kd.newService(current)
+		}
+	case old != nil:
+		kd.removeService(old)
+	}
+	q.lock.Lock()
+	if current != nil {
+		q.appliedServices[key] = current
+	} else {
+		delete(q.appliedServices, key)
+	}
+	q.lock.Unlock()
+	return nil
+}
+
+// syncEndpoints applies the endpoints with key in the store.
+func (kd *KubeDNS) syncEndpoints(key string) error {
+	q := kd.queue
+	obj, exists, err := kd.endpointsStore.GetByKey(key)
+	if err != nil {
+		return err
+	}
+	q.lock.Lock()
+	old := q.appliedEndpoints[key]
+	q.lock.Unlock()
+	var current *v1.Endpoints
+	switch {
+	case exists:
+		current = obj.(*v1.Endpoints)
+		switch {
+		case old == current:
+			// Only the service changed.
+		case old != nil:
+			kd.handleEndpointUpdate(old, current)
+		default:
+			kd.handleEndpointAdd(current)
+		}
+	case old != nil:
+		kd.handleEndpointDelete(old)
+	}
+	q.lock.Lock()
+	if current != nil {
+		q.appliedEndpoints[key] = current
+	} else {
+		delete(q.appliedEndpoints, key)
+	}
+	q.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// The metrics of the event queue. There is a single queue, so its name is
+// not a label.
+var (
+	queueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "kubedns",
+		Subsystem: "event_queue",
+		Name:      "depth",
+		Help:      "Number of services whose events are waiting to be handled.",
+	})
+	queueAdds = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "kubedns",
+		Subsystem: "event_queue",
+		Name:      "adds_total",
+		Help:      "Number of services queued, not counting the events coalesced with queued ones.",
+	})
+	queueLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "kubedns",
+		Subsystem: "event_queue",
+		Name:      "queue_duration_seconds",
+		Help:      "How long the events of a service wait before they are handled, including the coalesce period.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 9),
+	})
+	queueWorkDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "kubedns",
+		Subsystem: "event_queue",
+		Name:      "work_duration_seconds",
+		Help:      "How long handling the events of a service takes.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 9),
+	})
+	queueUnfinishedWork = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "kubedns",
+		Subsystem: "event_queue",
+		Name:      "unfinished_work_seconds",
+		Help:      "Seconds spent handling the events being handled, to detect stuck workers.",
+	})
+	queueLongestRunning = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "kubedns",
+		Subsystem: "event_queue",
+		Name:      "longest_running_processor_seconds",
+		Help:      "Seconds spent by the longest running handling of events.",
+	})
+	queueRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "kubedns",
+		Subsystem: "event_queue",
+		Name:      "retries_total",
+		Help:      "Number of times the events of a service were retried after a failure.",
+	})
+	registerQueueMetricsOnce sync.Once
+)
+
+// registerQueueMetrics registers the metrics of the event queue, and sets
+// them as the metrics of the workqueues.
+func registerQueueMetrics() {
+	registerQueueMetricsOnce.Do(func() {
+		prometheus.MustRegister(queueDepth, queueAdds, queueLatency, queueWorkDuration,
+			queueUnfinishedWork, queueLongestRunning, queueRetries)
+		workqueue.SetProvider(queueMetricsProvider{})
+	})
+}
+
+// queueMetricsProvider is the workqueue.MetricsProvider of the event queue.
+type queueMetricsProvider struct{}
+
+func (queueMetricsProvider) NewDepthMetric(string) workqueue.GaugeMetric { return queueDepth }
+
+func (queueMetricsProvider) NewAddsMetric(string) workqueue.CounterMetric { return queueAdds }
+
+func (queueMetricsProvider) NewLatencyMetric(string) workqueue.HistogramMetric { return queueLatency }
+
+func (queueMetricsProvider) NewWorkDurationMetric(string) workqueue.HistogramMetric {
+	return queueWorkDuration
+}
+
+func (queueMetricsProvider) NewUnfinishedWorkSecondsMetric(string) workqueue.SettableGaugeMetric {
+	return queueUnfinishedWork
+}
+
+func (queueMetricsProvider) NewLongestRunningProcessorSecondsMetric(string) workqueue.SettableGaugeMetric {
+	return queueLongestRunning
+}
+
+func (queueMetricsProvider) NewRetriesMetric(string) workqueue.CounterMetric { return queueRetries }
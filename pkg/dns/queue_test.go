@@ -0,0 +1,162 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+)
+
+// processEvents handles the queued events until the queue is empty.
+func processEvents(kd *KubeDNS) {
+	for kd.queue.queue.Len() > 0 {
+		kd.processNextEvent()
+	}
+}
+
+func TestEventQueueServices(t *testing.T) {
+	kd := newKubeDNS()
+	kd.queue = newEventQueue(0)
+	defer kd.queue.queue.ShutDown()
+	handlers := kd.serviceHandlers()
+
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	require.NoError(t, kd.servicesStore.Add(s))
+	handlers.OnAdd(s)
+	assertNoDNSForClusterIP(t, kd, s)
+	assert.False(t, kd.queue.hasDrained())
+	processEvents(kd)
+	assertDNSForClusterIP(t, "", kd, s, []string{"1.2.3.4"})
+	assert.True(t, kd.queue.hasDrained())
+
+	// Updates queued together are coalesced into the last one.
+	updated := newService(testNamespace, testService, "1.2.3.5", "http", 80)
+	handlers.OnUpdate(s, s)
+	require.NoError(t, kd.servicesStore.Update(updated))
+	handlers.OnUpdate(s, updated)
+	assert.Equal(t, 1, kd.queue.queue.Len())
+	processEvents(kd)
+	assertDNSForClusterIP(t, "", kd, updated, []string{"1.2.3.5"})
+	assert.Nil(t, kd.ipShards.reverseRecord("1.2.3.4"))
+
+	require.NoError(t, kd.servicesStore.Delete(updated))
+	handlers.OnDelete(updated)
+	processEvents(kd)
+	assertNoDNSForClusterIP(t, kd, updated)
+	assert.Empty(t, kd.queue.appliedServices)
+}
+
+func TestEventQueueDrainedWhileHandling(t *testing.T) {
+	kd := newKubeDNS()
+	kd.queue = newEventQueue(0)
+	defer kd.queue.queue.ShutDown()
+
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	require.NoError(t, kd.servicesStore.Add(s))
+	kd.serviceHandlers().OnAdd(s)
+
+	// A worker took the event from the queue, and did not handle it yet.
+	item, quit := kd.queue.queue.Get()
+	require.False(t, quit)
+	assert.Zero(t, kd.queue.queue.Len())
+	assert.False(t, kd.queue.hasDrained())
+
+	// The events queued before it is handled are handled with it.
+	kd.serviceHandlers().OnUpdate(s, s)
+	kd.processEvent(item)
+	assertDNSForClusterIP(t, "", kd, s, []string{"1.2.3.4"})
+	assert.True(t, kd.queue.hasDrained())
+	processEvents(kd)
+	assert.Empty(t, kd.queue.unhandled)
+}
+
+func TestEventQueueEndpoints(t *testing.T) {
+	kd := newKubeDNS()
+	kd.queue = newEventQueue(0)
+	defer kd.queue.queue.ShutDown()
+
+	s := newHeadlessService()
+	require.NoError(t, kd.servicesStore.Add(s))
+	kd.serviceHandlers().OnAdd(s)
+	e := newEndpoints(s, newSubsetWithOnePortWithHostname("", 80, true, "10.0.0.1", "10.0.0.2"))
+	require.NoError(t, kd.endpointsStore.Add(e))
+	kd.endpointsHandlers().OnAdd(e)
+	processEvents(kd)
+	assertDNSForHeadlessService(t, kd, e)
+	assertReverseDNSForNamedHeadlessService(t, kd, e)
+
+	require.NoError(t, kd.endpointsStore.Delete(e))
+	kd.endpointsHandlers().OnDelete(e)
+	processEvents(kd)
+	assertNoReverseDNSForHeadlessService(t, kd, e)
+}
+
+func TestEventQueuePanic(t *testing.T) {
+	kd := newKubeDNS()
+	kd.queue = newEventQueue(0)
+	defer kd.queue.queue.ShutDown()
+
+	// An object of the wrong type in the store makes the handler panic.
+	require.NoError(t, kd.servicesStore.Add(&v1.Endpoints{ObjectMeta: newService(testNamespace, testService, "", "", 0).ObjectMeta}))
+	key := testNamespace + "/" + testService
+	err := kd.handleEvent(key)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "panic")
+
+	// The event is retried with backoff rather than dropped.
+	kd.queue.queue.Add(key)
+	assert.True(t, kd.processNextEvent())
+	assert.Equal(t, 1, kd.queue.queue.NumRequeues(key))
+}
+
+func TestEventQueueCoalescing(t *testing.T) {
+	kd := newKubeDNS()
+	kd.queue = newEventQueue(time.Hour)
+	defer kd.queue.queue.ShutDown()
+
+	// The service and endpoints events of a service share its key.
+	s := newHeadlessService()
+	require.NoError(t, kd.servicesStore.Add(s))
+	kd.serviceHandlers().OnAdd(s)
+	e := newEndpoints(s, newSubsetWithOnePortWithHostname("", 80, true, "10.0.0.1"))
+	require.NoError(t, kd.endpointsStore.Add(e))
+	kd.endpointsHandlers().OnAdd(e)
+	assert.Equal(t, 1, kd.queue.queue.Len())
+	// The events of the initial sync are not held.
+	processEvents(kd)
+	assertDNSForHeadlessService(t, kd, e)
+	assert.True(t, kd.queue.hasDrained())
+
+	// A burst of endpoints updates is held for the coalesce period.
+	for _, ip := range []string{"10.0.0.2", "10.0.0.3"} {
+		updated := newEndpoints(s, newSubsetWithOnePortWithHostname("", 80, true, ip))
+		require.NoError(t, kd.endpointsStore.Update(updated))
+		kd.endpointsHandlers().OnUpdate(e, updated)
+		e = updated
+	}
+	assert.Equal(t, 0, kd.queue.queue.Len())
+	assertDNSForHeadlessService(t, kd, kd.queue.appliedEndpoints[testNamespace+"/"+s.Name])
+
+	// Once it elapses, the last endpoints are applied at once.
+	require.NoError(t, kd.handleEvent(testNamespace+"/"+s.Name))
+	assertDNSForHeadlessService(t, kd, e)
+	assert.Same(t, e, kd.queue.appliedEndpoints[testNamespace+"/"+s.Name])
+}
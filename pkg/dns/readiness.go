@@ -0,0 +1,95 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"sync"
+	"sync/atomic"
+
+	kcache "k8s.io/client-go/tools/cache"
+)
+
+// InitialSyncPending returns the resources that Start still waits for:
+// the ones not listed from the apiserver yet, and the ones listed whose
+// records were not generated yet. It returns nil once Start returned, the
+// records of every service and endpoints known at startup being served.
+func (kd *KubeDNS) InitialSyncPending() []string {
+	if pending, ok := kd.syncPending.Load().([]string); ok {
+		return pending
+	}
+	return []string{"informers"}
+}
+
+// handledKeys holds the keys of the objects whose events were handled, so
+// that the initial sync completes once the records of every object listed
+// were generated, not only once the objects are in the store.
+type handledKeys struct {
+	keys sync.Map
+	// done is set once every object of the store was handled, the keys no
+	// longer being recorded.
+	done int32
+}
+
+func newHandledKeys() *handledKeys {
+	return &handledKeys{}
+}
+
+// wrap returns handlers recording the key of the objects once h handled
+// their events.
+func (h *handledKeys) wrap(handlers kcache.ResourceEventHandler) kcache.ResourceEventHandlerFuncs {
+	record := func(obj interface{}) {
+		if atomic.LoadInt32(&h.done) == 1 {
+			return
+		}
+		if key, err := kcache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+			h.keys.Store(key, struct{}{})
+		}
+	}
+	return kcache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			handlers.OnAdd(obj)
+			record(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			handlers.OnUpdate(oldObj, newObj)
+			record(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			handlers.OnDelete(obj)
+			record(obj)
+		},
+	}
+}
+
+// covers returns whether the events of every object in store were handled.
+// Once they were, it keeps returning true.
+func (h *handledKeys) covers(store kcache.Store) bool {
+	if atomic.LoadInt32(&h.done) == 1 {
+		return true
+	}
+	for _, key := range store.ListKeys() {
+		if _, ok := h.keys.Load(key); !ok {
+			return false
+		}
+	}
+	atomic.StoreInt32(&h.done, 1)
+	h.keys.Range(func(key, _ interface{}) bool {
+		h.keys.Delete(key)
+		return true
+	})
+	return true
+}
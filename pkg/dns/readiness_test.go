@@ -0,0 +1,62 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func TestHandledKeys(t *testing.T) {
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	assert.True(t, newHandledKeys().covers(store))
+
+	handled := newHandledKeys()
+	handlers := handled.wrap(cache.ResourceEventHandlerFuncs{})
+	a := newService(testNamespace, "a", "10.0.0.1", "http", 80)
+	b := newService(testNamespace, "b", "10.0.0.2", "http", 80)
+	require.NoError(t, store.Add(a))
+	require.NoError(t, store.Add(b))
+	handlers.OnAdd(a)
+	assert.False(t, handled.covers(store))
+	handlers.OnAdd(b)
+	assert.True(t, handled.covers(store))
+
+	// Once covered, the keys are no longer recorded.
+	require.NoError(t, store.Add(newService(testNamespace, "c", "10.0.0.3", "http", 80)))
+	assert.True(t, handled.covers(store))
+}
+
+func TestInitialSyncPending(t *testing.T) {
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	kd := NewKubeDNS(fake.NewSimpleClientset(s), testDomain, 10*time.Second, config.NewNopSync(config.NewDefaultConfig()))
+	assert.Equal(t, []string{"informers"}, kd.InitialSyncPending())
+
+	// Start returns once the records of the services listed are served.
+	kd.Start()
+	assert.Nil(t, kd.InitialSyncPending())
+	records, err := kd.Records(testService+"."+testNamespace+".svc."+testDomain, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.2.3.4"}, hosts(records))
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	clientset "k8s.io/client-go/kubernetes"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	kcache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+
+	"k8s.io/dns/pkg/dns/leases"
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+const (
+	// RecordLeaseLabel selects the Leases holding record leases.
+	RecordLeaseLabel = "dns.kubernetes.io/record-lease"
+	// RecordLeaseRecordsAnnotation holds the records of a record lease.
+	RecordLeaseRecordsAnnotation = "dns.kubernetes.io/records"
+	// recordLeaseObjectPrefix prefixes the names of the Leases holding
+	// record leases, so that they do not clash with the other Leases of
+	// the namespace.
+	recordLeaseObjectPrefix = "kube-dns-record-lease-"
+)
+
+// RecordLeaseStore shares the record leases between the replicas: they are
+// held by coordination.k8s.io Leases labeled with RecordLeaseLabel, which
+// every replica watches and serves. The holder identity of a Lease is the
+// holder of the record lease, and its renew time and duration when it
+// expires.
+type RecordLeaseStore struct {
+	client    clientset.Interface
+	namespace string
+
+	lock       sync.Mutex
+	controller kcache.Controller
+}
+
+// NewRecordLeaseStore returns a RecordLeaseStore holding the record leases
+// in the Leases of namespace.
+func NewRecordLeaseStore(client clientset.Interface, namespace string) *RecordLeaseStore {
+	return &RecordLeaseStore{client: client, namespace: namespace}
+}
+
+func (s *RecordLeaseStore) leases() coordinationclient.LeaseInterface {
+	return s.client.CoordinationV1().Leases(s.namespace)
+}
+
+// Run calls set with the record leases and their changes, and remove with
+// the ID of those deleted, until stopCh is closed.
+func (s *RecordLeaseStore) Run(stopCh <-chan struct{}, set func(leases.Lease), remove func(id string)) {
+	update := func(obj interface{}) {
+		if lease, ok := recordLeaseOf(obj); ok {
+			set(lease)
+		}
+	}
+	_, controller := kcache.NewInformer(&kcache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = RecordLeaseLabel
+			return s.leases().List(context.TODO(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = RecordLeaseLabel
+			return s.leases().Watch(context.TODO(), options)
+		},
+	}, &coordinationv1.Lease{}, 0, kcache.ResourceEventHandlerFuncs{
+		AddFunc:    update,
+		UpdateFunc: func(oldObj, newObj interface{}) { update(newObj) },
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(kcache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if lease, ok := recordLeaseOf(obj); ok {
+				remove(lease.ID)
+			}
+		},
+	})
+	s.lock.Lock()
+	s.controller = controller
+	s.lock.Unlock()
+	controller.Run(stopCh)
+}
+
+// HasSynced returns true once Run handled the initial record leases.
+func (s *RecordLeaseStore) HasSynced() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.controller != nil && s.controller.HasSynced()
+}
+
+// set acquires, updates or renews the record lease id for holder, like
+// KubeDNS.SetRecordLease. An expired lease may be acquired by another
+// holder.
+func (s *RecordLeaseStore) set(id, holder, records string, ttl time.Duration) (leases.Lease, error) {
+	var lease leases.Lease
+	err := s.retry(func() error {
+		now := time.Now()
+		obj, err := s.leases().Get(context.TODO(), recordLeaseObjectPrefix+id, metav1.GetOptions{})
+		next, create := records, apierrors.IsNotFound(err)
+		switch {
+		case create:
+			if records == "" {
+				return fmt.Errorf("no lease %q to renew: %w", id, leases.ErrNotFound)
+			}
+			obj = &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{
+				Name:      recordLeaseObjectPrefix + id,
+				Namespace: s.namespace,
+				Labels:    map[string]string{RecordLeaseLabel: "true"},
+			}}
+		case err != nil:
+			return err
+		default:
+			current, ok := recordLeaseOf(obj)
+			if !ok {
+				return fmt.Errorf("lease %q is not a record lease: %w", id, leases.ErrConflict)
+			}
+			expired := !now.Before(current.Expires)
+			if current.Holder != holder && !expired {
+				return fmt.Errorf("lease %q is held by %q: %w", id, current.Holder, leases.ErrConflict)
+			}
+			if records == "" {
+				if expired {
+					return fmt.Errorf("no lease %q to renew: %w", id, leases.ErrNotFound)
+				}
+				next = current.Records
+			}
+		}
+
+		if obj.Annotations == nil {
+			obj.Annotations = make(map[string]string)
+		}
+		obj.Annotations[RecordLeaseRecordsAnnotation] = next
+		seconds := int32((ttl + time.Second - 1) / time.Second)
+		renewTime := metav1.NewMicroTime(now)
+		if obj.Spec.HolderIdentity == nil || *obj.Spec.HolderIdentity != holder {
+			obj.Spec.AcquireTime = &renewTime
+		}
+		obj.Spec.HolderIdentity = &holder
+		obj.Spec.LeaseDurationSeconds = &seconds
+		obj.Spec.RenewTime = &renewTime
+		if create {
+			obj, err = s.leases().Create(context.TODO(), obj, metav1.CreateOptions{})
+		} else {
+			obj, err = s.leases().Update(context.TODO(), obj, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			return err
+		}
+		lease, _ = recordLeaseOf(obj)
+		return nil
+	})
+	return lease, err
+}
+
+// remove releases the record lease id of holder, or, if holder is empty,
+// the one expired at now.
+func (s *RecordLeaseStore) remove(id, holder string, now time.Time) error {
+	return s.retry(func() error {
+		obj, err := s.leases().Get(context.TODO(), recordLeaseObjectPrefix+id, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("no lease %q: %w", id, leases.ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		current, ok := recordLeaseOf(obj)
+		switch {
+		case !ok:
+			return fmt.Errorf("lease %q is not a record lease: %w", id, leases.ErrConflict)
+		case holder == "" && now.Before(current.Expires):
+			return fmt.Errorf("lease %q was renewed: %w", id, leases.ErrConflict)
+		case holder != "" && current.Holder != holder:
+			return fmt.Errorf("lease %q is held by %q: %w", id, current.Holder, leases.ErrConflict)
+		}
+		// The lease must not have been renewed since.
+		return s.leases().Delete(context.TODO(), obj.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &obj.UID, ResourceVersion: &obj.ResourceVersion},
+		})
+	})
+}
+
+// retry calls fn until it succeeds, or fails otherwise than on the
+// concurrent writes of the other replicas.
+func (s *RecordLeaseStore) retry(fn func() error) error {
+	err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, fn)
+	if err != nil && !errors.Is(err, leases.ErrNotFound) && !errors.Is(err, leases.ErrConflict) {
+		return fmt.Errorf("%v: %w", err, server.ErrBackendUnavailable)
+	}
+	return err
+}
+
+// recordLeaseOf returns the record lease held by obj, and whether it is a
+// Lease holding one.
+func recordLeaseOf(obj interface{}) (leases.Lease, bool) {
+	lease, ok := obj.(*coordinationv1.Lease)
+	if !ok || lease.Labels[RecordLeaseLabel] == "" || !strings.HasPrefix(lease.Name, recordLeaseObjectPrefix) {
+		return leases.Lease{}, false
+	}
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return leases.Lease{}, false
+	}
+	return leases.Lease{
+		ID:      strings.TrimPrefix(lease.Name, recordLeaseObjectPrefix),
+		Holder:  *spec.HolderIdentity,
+		Records: lease.Annotations[RecordLeaseRecordsAnnotation],
+		Expires: spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second),
+	}, true
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/config"
+	"k8s.io/dns/pkg/dns/leases"
+)
+
+const (
+	// recordLeaseSetPrefix prefixes the keys of the record sets of the
+	// leases.
+	recordLeaseSetPrefix = "lease/"
+	// maxRecordLeaseTTL caps how long a lease lasts without a renewal.
+	maxRecordLeaseTTL = time.Hour
+	// recordLeaseExpiryPeriod is how often the expired leases are removed.
+	recordLeaseExpiryPeriod = 10 * time.Second
+)
+
+// isRecordLeaseSet returns whether key is the key of the record set of a
+// lease.
+func isRecordLeaseSet(key string) bool {
+	return strings.HasPrefix(key, recordLeaseSetPrefix)
+}
+
+// SetRecordLease publishes the custom records of the lease id, held by
+// holder, for ttl. The lease is acquired if there is none, its records are
+// replaced if holder already holds it, and leases.ErrConflict is returned
+// if another holder does. If records is empty, the lease is only renewed,
+// leases.ErrNotFound is returned if there is none. The lease is published
+// by every replica sharing the RecordLeaseStore.
+func (kd *KubeDNS) SetRecordLease(id, holder, records string, ttl time.Duration) (leases.Lease, error) {
+	if !kd.RecordLeases {
+		return leases.Lease{}, fmt.Errorf("record leases are disabled")
+	}
+	if errs := validation.IsDNS1123Subdomain(recordLeaseObjectPrefix + id); len(errs) > 0 || id == "" {
+		return leases.Lease{}, fmt.Errorf("invalid lease ID %q: %s", id, strings.Join(errs, ", "))
+	}
+	if holder == "" {
+		return leases.Lease{}, fmt.Errorf("lease %q has no holder", id)
+	}
+	if ttl <= 0 || ttl > maxRecordLeaseTTL {
+		return leases.Lease{}, fmt.Errorf("lease TTL must be positive and at most %v, got %v", maxRecordLeaseTTL, ttl)
+	}
+	if records != "" {
+		if err := kd.checkRecordLease(records); err != nil {
+			return leases.Lease{}, fmt.Errorf("invalid records for the lease %q: %w", id, err)
+		}
+	}
+	if kd.RecordLeaseStore != nil {
+		lease, err := kd.RecordLeaseStore.set(id, holder, records, ttl)
+		if err != nil {
+			return leases.Lease{}, err
+		}
+		kd.setSharedRecordLease(lease)
+		return lease, nil
+	}
+
+	kd.recordLeasesLock.Lock()
+	defer kd.recordLeasesLock.Unlock()
+	lease, ok := kd.recordLeases[id]
+	if ok && lease.Holder != holder {
+		return leases.Lease{}, fmt.Errorf("lease %q is held by %q: %w", id, lease.Holder, leases.ErrConflict)
+	}
+	if !ok && records == "" {
+		return leases.Lease{}, fmt.Errorf("no lease %q to renew: %w", id, leases.ErrNotFound)
+	}
+	lease.ID = id
+	lease.Holder = holder
+	lease.Expires = time.Now().Add(ttl)
+	if records != "" && records != lease.Records {
+		lease.Records = records
+		kd.setCustomRecordSet(recordLeaseSetPrefix+id, records)
+	}
+	if kd.recordLeases == nil {
+		kd.recordLeases = make(map[string]leases.Lease)
+	}
+	kd.recordLeases[id] = lease
+	return lease, nil
+}
+
+// checkRecordLease returns an error if records cannot be parsed or if one of
+// them cannot be served.
+func (kd *KubeDNS) checkRecordLease(records string) error {
+	rrs, err := config.ParseCustomRecords(records, dns.Fqdn(strings.ToLower(kd.domain)))
+	if err != nil {
+		return err
+	}
+	if len(rrs) == 0 {
+		return fmt.Errorf("no records")
+	}
+	kd.cacheLock.RLock()
+	defer kd.cacheLock.RUnlock()
+	for _, rr := range rrs {
+		if err := kd.checkCustomRecordName(rr.Header().Name); err != nil {
+			return fmt.Errorf("%q: %v", rr.String(), err)
+		}
+	}
+	return nil
+}
+
+// DeleteRecordLease releases the lease id held by holder, withdrawing its
+// records.
+func (kd *KubeDNS) DeleteRecordLease(id, holder string) error {
+	if holder == "" {
+		return fmt.Errorf("lease %q has no holder", id)
+	}
+	if kd.RecordLeaseStore != nil {
+		if err := kd.RecordLeaseStore.remove(id, holder, time.Now()); err != nil {
+			return err
+		}
+		kd.removeSharedRecordLease(id)
+		return nil
+	}
+	kd.recordLeasesLock.Lock()
+	defer kd.recordLeasesLock.Unlock()
+	lease, ok := kd.recordLeases[id]
+	if !ok {
+		return fmt.Errorf("no lease %q: %w", id, leases.ErrNotFound)
+	}
+	if lease.Holder != holder {
+		return fmt.Errorf("lease %q is held by %q: %w", id, lease.Holder, leases.ErrConflict)
+	}
+	delete(kd.recordLeases, id)
+	kd.setCustomRecordSet(recordLeaseSetPrefix+id, "")
+	return nil
+}
+
+// ListRecordLeases returns the leases, by ID.
+func (kd *KubeDNS) ListRecordLeases() []leases.Lease {
+	kd.recordLeasesLock.Lock()
+	defer kd.recordLeasesLock.Unlock()
+	list := make([]leases.Lease, 0, len(kd.recordLeases))
+	for _, lease := range kd.recordLeases {
+		list = append(list, lease)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// runRecordLeaseExpiry removes the expired leases until stopCh is closed.
+func (kd *KubeDNS) runRecordLeaseExpiry(stopCh <-chan struct{}) {
+	wait.Until(func() { kd.expireRecordLeases(time.Now()) }, recordLeaseExpiryPeriod, stopCh)
+}
+
+// expireRecordLeases removes the leases expired at now, withdrawing their
+// records, from the RecordLeaseStore too.
+func (kd *KubeDNS) expireRecordLeases(now time.Time) {
+	for _, id := range kd.expireLocalRecordLeases(now) {
+		if kd.RecordLeaseStore == nil {
+			continue
+		}
+		// Another replica may have removed or renewed it already.
+		if err := kd.RecordLeaseStore.remove(id, "", now); err != nil && !errors.Is(err, leases.ErrNotFound) && !errors.Is(err, leases.ErrConflict) {
+			klog.Errorf("Failed to remove the expired record lease %q: %v", id, err)
+		}
+	}
+}
+
+// expireLocalRecordLeases removes the leases expired at now, withdrawing
+// their records, and returns their IDs.
+func (kd *KubeDNS) expireLocalRecordLeases(now time.Time) []string {
+	kd.recordLeasesLock.Lock()
+	defer kd.recordLeasesLock.Unlock()
+	var expired []string
+	for id, lease := range kd.recordLeases {
+		if now.Before(lease.Expires) {
+			continue
+		}
+		klog.V(2).Infof("Record lease %q of %q expired", id, lease.Holder)
+		delete(kd.recordLeases, id)
+		kd.setCustomRecordSet(recordLeaseSetPrefix+id, "")
+		expired = append(expired, id)
+	}
+	return expired
+}
+
+// setSharedRecordLease publishes the records of a lease of the
+// RecordLeaseStore, unless it expired or its records cannot be served.
+func (kd *KubeDNS) setSharedRecordLease(lease leases.Lease) {
+	if !time.Now().Before(lease.Expires) {
+		kd.removeSharedRecordLease(lease.ID)
+		return
+	}
+	if err := kd.checkRecordLease(lease.Records); err != nil {
+		klog.Errorf("Ignoring the record lease %q of %q: %v", lease.ID, lease.Holder, err)
+		kd.removeSharedRecordLease(lease.ID)
+		return
+	}
+	kd.recordLeasesLock.Lock()
+	defer kd.recordLeasesLock.Unlock()
+	if current, ok := kd.recordLeases[lease.ID]; !ok || current.Records != lease.Records {
+		kd.setCustomRecordSet(recordLeaseSetPrefix+lease.ID, lease.Records)
+	}
+	if kd.recordLeases == nil {
+		kd.recordLeases = make(map[string]leases.Lease)
+	}
+	kd.recordLeases[lease.ID] = lease
+}
+
+// removeSharedRecordLease withdraws the records of the lease id removed
+// from the RecordLeaseStore.
+func (kd *KubeDNS) removeSharedRecordLease(id string) {
+	kd.recordLeasesLock.Lock()
+	defer kd.recordLeasesLock.Unlock()
+	if _, ok := kd.recordLeases[id]; !ok {
+		return
+	}
+	delete(kd.recordLeases, id)
+	kd.setCustomRecordSet(recordLeaseSetPrefix+id, "")
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	kcache "k8s.io/client-go/tools/cache"
+
+	"k8s.io/dns/pkg/dns/leases"
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+func TestRecordLeases(t *testing.T) {
+	kd := newKubeDNS()
+	_, err := kd.SetRecordLease("registry", "controller-a", "registry A 10.0.0.10", time.Minute)
+	assert.Error(t, err, "leases are disabled")
+
+	kd.RecordLeases = true
+	lease, err := kd.SetRecordLease("registry", "controller-a", "registry A 10.0.0.10", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "controller-a", lease.Holder)
+	assert.Equal(t, []string{"10.0.0.10"}, hosts(lookupRecords(t, kd, "registry."+testDomain)))
+
+	// Another holder cannot take over the lease.
+	_, err = kd.SetRecordLease("registry", "controller-b", "registry A 10.0.0.11", time.Minute)
+	assert.True(t, errors.Is(err, leases.ErrConflict), "%v", err)
+	assert.True(t, errors.Is(kd.DeleteRecordLease("registry", "controller-b"), leases.ErrConflict))
+
+	// The holder updates the records, and renews the lease.
+	_, err = kd.SetRecordLease("registry", "controller-a", "registry A 10.0.0.11", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.11"}, hosts(lookupRecords(t, kd, "registry."+testDomain)))
+	renewed, err := kd.SetRecordLease("registry", "controller-a", "", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "registry A 10.0.0.11", renewed.Records)
+	assert.True(t, renewed.Expires.After(lease.Expires))
+
+	_, err = kd.SetRecordLease("missing", "controller-a", "", time.Minute)
+	assert.True(t, errors.Is(err, leases.ErrNotFound), "%v", err)
+	for _, invalid := range []struct {
+		id, holder, records string
+		ttl                 time.Duration
+	}{
+		{"Not_An_ID", "controller-a", "ntp A 10.0.0.12", time.Minute},
+		{"ntp", "", "ntp A 10.0.0.12", time.Minute},
+		{"ntp", "controller-a", "ntp A 10.0.0.12", 2 * time.Hour},
+		{"ntp", "controller-a", "ntp MX 10 mail.example.com.", time.Minute},
+		{"ntp", "controller-a", "ntp.default.svc A 10.0.0.12", time.Minute},
+		{"ntp", "controller-a", "ntp.example.com. A 10.0.0.12", time.Minute},
+	} {
+		_, err = kd.SetRecordLease(invalid.id, invalid.holder, invalid.records, invalid.ttl)
+		assert.Error(t, err, "%+v", invalid)
+	}
+
+	_, err = kd.SetRecordLease("ntp", "controller-b", "ntp A 10.0.0.12", time.Minute)
+	require.NoError(t, err)
+	assert.Len(t, kd.ListRecordLeases(), 2)
+
+	// Leases expire unless renewed.
+	kd.expireRecordLeases(time.Now().Add(2 * time.Minute))
+	assert.Equal(t, "registry", kd.ListRecordLeases()[0].ID)
+	_, err = kd.Records("ntp."+testDomain, false)
+	assert.Error(t, err)
+
+	require.NoError(t, kd.DeleteRecordLease("registry", "controller-a"))
+	assert.Empty(t, kd.ListRecordLeases())
+	_, err = kd.Records("registry."+testDomain, false)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(kd.DeleteRecordLease("registry", "controller-a"), leases.ErrNotFound))
+}
+
+func TestRecordLeasesShared(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	replicas := make([]*KubeDNS, 2)
+	for i := range replicas {
+		kd := newKubeDNS()
+		kd.RecordLeases = true
+		kd.RecordLeaseStore = NewRecordLeaseStore(client, "kube-system")
+		go kd.RecordLeaseStore.Run(stopCh, kd.setSharedRecordLease, kd.removeSharedRecordLease)
+		require.True(t, kcache.WaitForCacheSync(stopCh, kd.RecordLeaseStore.HasSynced))
+		replicas[i] = kd
+	}
+	served := func(kd *KubeDNS, name string) []string {
+		records, err := kd.Records(name, false)
+		if err != nil {
+			return nil
+		}
+		return hosts(records)
+	}
+
+	// A lease acquired through a replica is served by the others.
+	_, err := replicas[0].SetRecordLease("registry", "controller-a", "registry A 10.0.0.10", time.Minute)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return len(served(replicas[1], "registry."+testDomain)) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	lease, err := client.CoordinationV1().Leases("kube-system").Get(context.TODO(), recordLeaseObjectPrefix+"registry", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "controller-a", *lease.Spec.HolderIdentity)
+
+	// And held across the replicas.
+	_, err = replicas[1].SetRecordLease("registry", "controller-b", "registry A 10.0.0.11", time.Minute)
+	assert.True(t, errors.Is(err, leases.ErrConflict), "%v", err)
+	assert.True(t, errors.Is(replicas[1].DeleteRecordLease("registry", "controller-b"), leases.ErrConflict))
+	renewed, err := replicas[1].SetRecordLease("registry", "controller-a", "", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "registry A 10.0.0.10", renewed.Records)
+
+	// The Leases of others are not taken over.
+	_, err = client.CoordinationV1().Leases("kube-system").Create(context.TODO(), &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: recordLeaseObjectPrefix + "ntp"},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	_, err = replicas[0].SetRecordLease("ntp", "controller-a", "ntp A 10.0.0.12", time.Minute)
+	assert.True(t, errors.Is(err, leases.ErrConflict), "%v", err)
+
+	// The release through a replica withdraws the records of the others.
+	require.NoError(t, replicas[1].DeleteRecordLease("registry", "controller-a"))
+	assert.Eventually(t, func() bool {
+		return len(served(replicas[0], "registry."+testDomain)) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// So does the expiry.
+	_, err = replicas[0].SetRecordLease("registry", "controller-a", "registry A 10.0.0.10", time.Minute)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return len(served(replicas[1], "registry."+testDomain)) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	replicas[0].expireRecordLeases(time.Now().Add(2 * time.Minute))
+	assert.Eventually(t, func() bool {
+		return len(served(replicas[1], "registry."+testDomain)) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, replicas[1].ListRecordLeases())
+}
+
+func lookupRecords(t *testing.T, kd *KubeDNS, name string) []skymsg.Service {
+	t.Helper()
+	records, err := kd.Records(name, false)
+	require.NoError(t, err)
+	return records
+}
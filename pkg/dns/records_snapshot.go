@@ -0,0 +1,159 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/treecache"
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// staleRecordTTL is the TTL of the records answered from the snapshot
+// loaded at startup, so that the clients ask again once the records are
+// synced.
+const staleRecordTTL = 5
+
+var (
+	staleAnswers = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "kubedns",
+		Subsystem: "records_snapshot",
+		Name:      "stale_answers_total",
+		Help:      "Queries answered from the records snapshot loaded at startup, before the records were synced.",
+	})
+	recordsSnapshotSaves = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kubedns",
+		Subsystem: "records_snapshot",
+		Name:      "saves_total",
+		Help:      "Records snapshots written to disk, by result: success or error.",
+	}, []string{"result"})
+	registerRecordsSnapshotMetrics sync.Once
+)
+
+// staleCache holds the records loaded from the snapshot, nil once the
+// records are synced.
+type staleCache struct {
+	cache treecache.TreeCache
+}
+
+// loadRecordsSnapshot loads the records saved in RecordsSnapshotFile, to
+// be answered while the records are synced, unless the file is missing or
+// older than RecordsSnapshotMaxAge.
+func (kd *KubeDNS) loadRecordsSnapshot() error {
+	registerRecordsSnapshotMetrics.Do(func() { prometheus.MustRegister(staleAnswers, recordsSnapshotSaves) })
+	info, err := os.Stat(kd.RecordsSnapshotFile)
+	if os.IsNotExist(err) {
+		klog.V(0).Infof("No records snapshot in %v", kd.RecordsSnapshotFile)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if age := time.Since(info.ModTime()); kd.RecordsSnapshotMaxAge > 0 && age > kd.RecordsSnapshotMaxAge {
+		klog.V(0).Infof("Ignoring the records snapshot in %v, saved %v ago", kd.RecordsSnapshotFile, age.Round(time.Second))
+		return nil
+	}
+	data, err := os.ReadFile(kd.RecordsSnapshotFile)
+	if err != nil {
+		return err
+	}
+	cache, err := treecache.Deserialize(data)
+	if err != nil {
+		return fmt.Errorf("invalid records snapshot %v: %w", kd.RecordsSnapshotFile, err)
+	}
+	kd.staleCache.Store(staleCache{cache: cache})
+	klog.V(0).Infof("Answering from the records snapshot saved in %v at %v until the records are synced",
+		kd.RecordsSnapshotFile, info.ModTime().Format(time.RFC3339))
+	return nil
+}
+
+// dropRecordsSnapshot stops answering from the snapshot loaded at startup.
+func (kd *KubeDNS) dropRecordsSnapshot() {
+	kd.staleCache.Store(staleCache{})
+}
+
+// staleRecordsForPath returns the records at path in the snapshot loaded at
+// startup, with a short TTL, if the records are not synced yet.
+func (kd *KubeDNS) staleRecordsForPath(path []string, exact bool) []skymsg.Service {
+	stale, ok := kd.staleCache.Load().(staleCache)
+	if !ok || stale.cache == nil {
+		return nil
+	}
+	var records []skymsg.Service
+	if exact {
+		if record, ok := stale.cache.GetEntry(path[len(path)-1], path[:len(path)-1]...); ok {
+			records = []skymsg.Service{*(record.(*skymsg.Service))}
+		}
+	} else {
+		records = stale.cache.AppendValuesForPathWithWildcards(nil, path...)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	for i := range records {
+		if records[i].Ttl == 0 || records[i].Ttl > staleRecordTTL {
+			records[i].Ttl = staleRecordTTL
+		}
+	}
+	staleAnswers.Inc()
+	return records
+}
+
+// runRecordsSnapshot saves the records to RecordsSnapshotFile every
+// RecordsSnapshotInterval until stopCh is closed.
+func (kd *KubeDNS) runRecordsSnapshot(stopCh <-chan struct{}) {
+	registerRecordsSnapshotMetrics.Do(func() { prometheus.MustRegister(staleAnswers, recordsSnapshotSaves) })
+	klog.V(0).Infof("Saving the records to %v every %v", kd.RecordsSnapshotFile, kd.RecordsSnapshotInterval)
+	wait.Until(func() {
+		if err := kd.saveRecordsSnapshot(); err != nil {
+			klog.Errorf("Failed to save the records snapshot: %v", err)
+			recordsSnapshotSaves.WithLabelValues("error").Inc()
+			return
+		}
+		recordsSnapshotSaves.WithLabelValues("success").Inc()
+	}, kd.RecordsSnapshotInterval, stopCh)
+}
+
+// saveRecordsSnapshot writes the records to RecordsSnapshotFile, replacing
+// it atomically.
+func (kd *KubeDNS) saveRecordsSnapshot() error {
+	serialized, err := kd.cacheView().Serialize()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(kd.RecordsSnapshotFile), filepath.Base(kd.RecordsSnapshotFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(serialized); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), kd.RecordsSnapshotFile)
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+func TestRecordsSnapshot(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "records.json")
+	name := testService + "." + testNamespace + ".svc." + testDomain
+
+	kd := newKubeDNS()
+	kd.RecordsSnapshotFile = file
+	kd.newService(newService(testNamespace, testService, "1.2.3.4", "http", 80))
+	require.NoError(t, kd.saveRecordsSnapshot())
+
+	restarted := newKubeDNS()
+	restarted.RecordsSnapshotFile = file
+	_, err := restarted.Records(name, false)
+	assert.ErrorIs(t, err, server.ErrNotFound, "nothing is loaded yet")
+
+	// The records are answered from the snapshot until they are synced.
+	require.NoError(t, restarted.loadRecordsSnapshot())
+	records, err := restarted.Records(name, false)
+	assert.ErrorIs(t, err, server.ErrStale)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "1.2.3.4", records[0].Host)
+		assert.Equal(t, uint32(staleRecordTTL), records[0].Ttl)
+	}
+	srv, err := restarted.Records("_http._tcp."+name, false)
+	assert.ErrorIs(t, err, server.ErrStale)
+	if assert.Len(t, srv, 1) {
+		assert.Equal(t, 80, srv[0].Port)
+	}
+	_, err = restarted.Records("other."+testNamespace+".svc."+testDomain, false)
+	assert.ErrorIs(t, err, server.ErrNotFound)
+
+	// The synced records take precedence.
+	restarted.newService(newService(testNamespace, testService, "1.2.3.5", "http", 80))
+	records, err = restarted.Records(name, false)
+	require.NoError(t, err)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "1.2.3.5", records[0].Host)
+	}
+
+	restarted.dropRecordsSnapshot()
+	restarted.removeService(newService(testNamespace, testService, "1.2.3.5", "http", 80))
+	_, err = restarted.Records(name, false)
+	assert.ErrorIs(t, err, server.ErrNotFound, "the snapshot is dropped once synced")
+
+	// Old snapshots are ignored.
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(file, old, old))
+	restarted = newKubeDNS()
+	restarted.RecordsSnapshotFile = file
+	restarted.RecordsSnapshotMaxAge = time.Hour
+	require.NoError(t, restarted.loadRecordsSnapshot())
+	_, err = restarted.Records(name, false)
+	assert.ErrorIs(t, err, server.ErrNotFound)
+
+	// A missing snapshot is not an error.
+	restarted.RecordsSnapshotFile = filepath.Join(t.TempDir(), "missing.json")
+	assert.NoError(t, restarted.loadRecordsSnapshot())
+}
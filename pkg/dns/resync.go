@@ -0,0 +1,91 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/util"
+)
+
+// runResync reconciles the records against the stores every ResyncPeriod
+// until stopCh is closed. The informers replay their stores to the handlers
+// at the same period, which rewrites the records of the objects that still
+// exist.
+func (kd *KubeDNS) runResync(stopCh <-chan struct{}) {
+	registerJanitorMetric()
+	klog.V(0).Infof("Reconciling the records against the stores every %v", kd.ResyncPeriod)
+	wait.Until(func() {
+		if n := kd.reconcileRecords(time.Now().Add(-kd.ResyncPeriod)); n > 0 {
+			klog.V(0).Infof("Resync removed %d records whose objects no longer exist", n)
+		}
+	}, kd.ResyncPeriod, stopCh)
+}
+
+// reconcileRecords removes the records of the objects that vanished from
+// the stores without their delete event reaching the handlers, e.g. while a
+// watch was broken: the records of the services that no longer exist, see
+// purgeOrphans, and the endpoint records of the headless services whose
+// endpoints no longer exist. Records written after notBefore are left
+// alone. It returns the number of records removed.
+func (kd *KubeDNS) reconcileRecords(notBefore time.Time) int {
+	removed := kd.purgeOrphans(notBefore)
+
+	var keys []string
+	kd.cacheLock.RLock()
+	for key, owner := range kd.recordOwners {
+		if owner.updated.After(notBefore) {
+			continue
+		}
+		if _, exists, err := kd.endpointsStore.GetByKey(key); err == nil && !exists {
+			keys = append(keys, key)
+		}
+	}
+	kd.cacheLock.RUnlock()
+
+	for _, key := range keys {
+		obj, exists, err := kd.servicesStore.GetByKey(key)
+		if err != nil || !exists {
+			continue
+		}
+		service, ok := obj.(*v1.Service)
+		if !ok || util.IsServiceIPSet(service) || service.Spec.Type == v1.ServiceTypeExternalName || isExcluded(service) {
+			continue
+		}
+		kd.cacheLock.RLock()
+		owner, ok := kd.recordOwners[key]
+		records := kd.recordCounts[key]
+		kd.cacheLock.RUnlock()
+		// The records were written again in the meantime.
+		if !ok || owner.updated.After(notBefore) {
+			continue
+		}
+		klog.Warningf("Removing %d records of headless service %s, whose endpoints no longer exist", records, key)
+		empty := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: service.Name, Namespace: service.Namespace}}
+		if err := kd.generateRecordsForHeadlessService(empty, service); err != nil {
+			klog.Errorf("Could not remove the records of headless service %s: %v", key, err)
+			continue
+		}
+		removed += records
+	}
+	return removed
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcileRecords(t *testing.T) {
+	kd := newKubeDNS()
+	orphaned := newService(testNamespace, "orphaned", "1.2.3.5", "http", 80)
+	kd.newService(orphaned)
+	s := newHeadlessService()
+	e := newEndpoints(s, newSubsetWithOnePort("", 80, "10.0.0.1", "10.0.0.2"))
+	require.NoError(t, kd.servicesStore.Add(s))
+	require.NoError(t, kd.endpointsStore.Add(e))
+	kd.newService(s)
+	kd.handleEndpointAdd(e)
+	assertDNSForHeadlessService(t, kd, e)
+
+	// The delete events of the service and of the endpoints were missed.
+	require.NoError(t, kd.endpointsStore.Delete(e))
+	assert.Equal(t, 0, kd.reconcileRecords(time.Now().Add(-time.Minute)))
+	assertDNSForHeadlessService(t, kd, e)
+
+	assert.Equal(t, 4, kd.reconcileRecords(time.Now()))
+	assertNoDNSForClusterIP(t, kd, orphaned)
+	assertNoDNSForHeadlessService(t, kd, s)
+	assert.Equal(t, 0, kd.recordCount)
+
+	assert.Equal(t, 0, kd.reconcileRecords(time.Now()))
+}
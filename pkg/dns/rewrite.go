@@ -0,0 +1,46 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"k8s.io/dns/third_party/forked/skydns/server"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+// setRewriteRules applies the rewrite rules of the configuration to the
+// SkyDNS server. Invalid rules are ignored.
+func (kd *KubeDNS) setRewriteRules(rules []config.RewriteRule) {
+	if kd.SkyDNSConfig == nil || kd.SkyDNSConfig.Rewrites == nil {
+		return
+	}
+	compiled := make([]server.RewriteRule, 0, len(rules))
+	for _, rule := range rules {
+		name, err := rule.Compile()
+		if err != nil {
+			klog.Errorf("Ignoring the rewrite rule %q: %v", rule.Name, err)
+			continue
+		}
+		compiled = append(compiled, server.RewriteRule{Name: name, Replacement: dns.Fqdn(rule.Replacement)})
+	}
+	kd.SkyDNSConfig.Rewrites.Set(compiled)
+	if len(compiled) > 0 {
+		klog.V(2).Infof("Rewrite rules: %+v", rules)
+	}
+}
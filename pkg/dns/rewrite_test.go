@@ -0,0 +1,52 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/dns/third_party/forked/skydns/server"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func TestRewriteRules(t *testing.T) {
+	kd := newKubeDNS()
+	kd.SkyDNSConfig = &server.Config{Rewrites: server.NewRewrites()}
+
+	next := config.NewDefaultConfig()
+	next.RewriteRules = []config.RewriteRule{
+		{Name: `db\.legacy\.local`, Replacement: "postgres.default.svc." + testDomain},
+		{Name: `(.*)\.legacy\.local`, Replacement: "${1}.default.svc." + testDomain},
+	}
+	kd.updateConfig(next)
+
+	name, ok := kd.SkyDNSConfig.Rewrites.Rewrite("db.legacy.local.")
+	assert.True(t, ok)
+	assert.Equal(t, "postgres.default.svc."+testDomain, name)
+	name, ok = kd.SkyDNSConfig.Rewrites.Rewrite("web.legacy.local.")
+	assert.True(t, ok)
+	assert.Equal(t, "web.default.svc."+testDomain, name)
+	_, ok = kd.SkyDNSConfig.Rewrites.Rewrite("web.default.svc." + testDomain)
+	assert.False(t, ok)
+
+	// Removing the rules stops the rewrites.
+	kd.updateConfig(config.NewDefaultConfig())
+	_, ok = kd.SkyDNSConfig.Rewrites.Rewrite("db.legacy.local.")
+	assert.False(t, ok)
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sampler finds the heaviest hitters among the queries served: the
+// most queried names, wildcard patterns and the clients causing the most
+// NXDOMAIN answers, so that the workload behind a load spike can be found.
+package sampler
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Sampler samples one query out of Rate and keeps the top K keys of each
+// kind in the sample over fixed windows of time, using the Space-Saving
+// algorithm so that memory is bounded by K whatever the query mix.
+type Sampler struct {
+	rate   uint64
+	k      int
+	window time.Duration
+	// resolve, if set, names the workload owning a client IP.
+	resolve func(ip string) (string, bool)
+	now     func() time.Time
+
+	seen uint64 // accessed atomically
+
+	mu       sync.Mutex
+	current  *window
+	previous *window
+}
+
+// NewSampler returns a Sampler keeping the top k keys of one query out of
+// rate, over windows of the given duration. resolve, if not nil, turns the
+// IP of a client into the name of its workload, e.g. namespace/pod.
+func NewSampler(rate, k int, window time.Duration, resolve func(ip string) (string, bool)) *Sampler {
+	if rate < 1 {
+		rate = 1
+	}
+	s := &Sampler{
+		rate:    uint64(rate),
+		k:       k,
+		window:  window,
+		resolve: resolve,
+		now:     time.Now,
+	}
+	s.current = s.newWindow(s.now())
+	return s
+}
+
+// Entry is a key along with its count in the sample. The actual count lies
+// between Count-Error and Count.
+type Entry struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error,omitempty"`
+}
+
+// WindowReport holds the top keys of a window.
+type WindowReport struct {
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	SampleRate uint64    `json:"sampleRate"`
+	Sampled    uint64    `json:"sampled"`
+	// Names are the most queried names.
+	Names []Entry `json:"names"`
+	// Wildcards are the most queried names containing a wildcard label.
+	Wildcards []Entry `json:"wildcards"`
+	// NXDomainSources are the clients that got the most NXDOMAIN answers.
+	NXDomainSources []Entry `json:"nxdomainSources"`
+}
+
+// Report holds the top keys of the current window, and of the previous
+// one if it was complete.
+type Report struct {
+	Current  WindowReport  `json:"current"`
+	Previous *WindowReport `json:"previous,omitempty"`
+}
+
+// Observe accounts for a query and its reply. It is a server.QueryObserver.
+func (s *Sampler) Observe(remote net.Addr, req, resp *dns.Msg) {
+	if atomic.AddUint64(&s.seen, 1)%s.rate != 0 || len(req.Question) == 0 {
+		return
+	}
+	name := strings.ToLower(req.Question[0].Name)
+	var source string
+	if resp != nil && resp.Rcode == dns.RcodeNameError {
+		source = s.source(remote)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate()
+	w := s.current
+	w.sampled++
+	w.names.add(name)
+	if isWildcard(name) {
+		w.wildcards.add(name)
+	}
+	if source != "" {
+		w.nxdomainSources.add(source)
+	}
+}
+
+// Report returns the top keys of the current and previous windows.
+func (s *Sampler) Report() Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate()
+	report := Report{Current: s.current.report(s.rate, s.now())}
+	if s.previous != nil {
+		previous := s.previous.report(s.rate, s.current.start)
+		report.Previous = &previous
+	}
+	return report
+}
+
+// rotate starts a new window if the current one is over. Must be called
+// with mu held.
+func (s *Sampler) rotate() {
+	now := s.now()
+	if now.Sub(s.current.start) < s.window {
+		return
+	}
+	start := s.current.start.Add(s.window)
+	if now.Sub(start) < s.window {
+		s.previous = s.current
+	} else {
+		// Nothing was sampled for a whole window.
+		s.previous = nil
+		start = now
+	}
+	s.current = s.newWindow(start)
+}
+
+func (s *Sampler) source(remote net.Addr) string {
+	var ip net.IP
+	switch addr := remote.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		return "unknown"
+	}
+	if s.resolve != nil {
+		if workload, ok := s.resolve(ip.String()); ok {
+			return workload
+		}
+	}
+	return ip.String()
+}
+
+func isWildcard(name string) bool {
+	for _, label := range dns.SplitDomainName(name) {
+		if label == "*" || label == "any" {
+			return true
+		}
+	}
+	return false
+}
+
+type window struct {
+	start           time.Time
+	sampled         uint64
+	names           *topK
+	wildcards       *topK
+	nxdomainSources *topK
+}
+
+func (s *Sampler) newWindow(start time.Time) *window {
+	return &window{
+		start:           start,
+		names:           newTopK(s.k),
+		wildcards:       newTopK(s.k),
+		nxdomainSources: newTopK(s.k),
+	}
+}
+
+func (w *window) report(rate uint64, end time.Time) WindowReport {
+	return WindowReport{
+		Start:           w.start,
+		End:             end,
+		SampleRate:      rate,
+		Sampled:         w.sampled,
+		Names:           w.names.list(),
+		Wildcards:       w.wildcards.list(),
+		NXDomainSources: w.nxdomainSources.list(),
+	}
+}
+
+// topK implements the Space-Saving algorithm: once k keys are tracked, a new
+// key replaces the least counted one and inherits its count as error.
+type topK struct {
+	k       int
+	entries map[string]*Entry
+}
+
+func newTopK(k int) *topK {
+	return &topK{k: k, entries: make(map[string]*Entry, k)}
+}
+
+func (t *topK) add(key string) {
+	if e, ok := t.entries[key]; ok {
+		e.Count++
+		return
+	}
+	if len(t.entries) < t.k {
+		t.entries[key] = &Entry{Key: key, Count: 1}
+		return
+	}
+	var min *Entry
+	for _, e := range t.entries {
+		if min == nil || e.Count < min.Count {
+			min = e
+		}
+	}
+	if min == nil {
+		return
+	}
+	delete(t.entries, min.Key)
+	t.entries[key] = &Entry{Key: key, Count: min.Count + 1, Error: min.Count}
+}
+
+// list returns the entries by decreasing count.
+func (t *topK) list() []Entry {
+	entries := make([]Entry, 0, len(t.entries))
+	for _, e := range t.entries {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
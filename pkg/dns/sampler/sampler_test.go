@@ -0,0 +1,107 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sampler
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func observe(s *Sampler, remote net.Addr, name string, rcode int) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetRcode(req, rcode)
+	s.Observe(remote, req, resp)
+}
+
+func TestSampler(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewSampler(1, 3, time.Minute, func(ip string) (string, bool) {
+		if ip == "10.0.0.1" {
+			return "default/client", true
+		}
+		return "", false
+	})
+	s.now = func() time.Time { return now }
+	s.current = s.newWindow(now)
+
+	pod := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	node := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1234}
+	for i := 0; i < 5; i++ {
+		observe(s, pod, "hot.default.svc.cluster.local.", dns.RcodeSuccess)
+	}
+	for i := 0; i < 3; i++ {
+		observe(s, pod, "missing.default.svc.cluster.local.", dns.RcodeNameError)
+	}
+	observe(s, node, "*.default.svc.cluster.local.", dns.RcodeNameError)
+	// Evicts the least counted name, the wildcard one.
+	observe(s, node, "cold.default.svc.cluster.local.", dns.RcodeSuccess)
+
+	report := s.Report()
+	assert.Nil(t, report.Previous)
+	assert.Equal(t, uint64(10), report.Current.Sampled)
+	assert.Equal(t, []Entry{
+		{Key: "hot.default.svc.cluster.local.", Count: 5},
+		{Key: "missing.default.svc.cluster.local.", Count: 3},
+		{Key: "cold.default.svc.cluster.local.", Count: 2, Error: 1},
+	}, report.Current.Names)
+	assert.Equal(t, []Entry{{Key: "*.default.svc.cluster.local.", Count: 1}}, report.Current.Wildcards)
+	assert.Equal(t, []Entry{
+		{Key: "default/client", Count: 3},
+		{Key: "192.168.0.1", Count: 1},
+	}, report.Current.NXDomainSources)
+
+	// The window is over, it becomes the previous one.
+	now = now.Add(90 * time.Second)
+	observe(s, pod, "hot.default.svc.cluster.local.", dns.RcodeSuccess)
+	report = s.Report()
+	require.NotNil(t, report.Previous)
+	assert.Equal(t, uint64(10), report.Previous.Sampled)
+	assert.Equal(t, uint64(1), report.Current.Sampled)
+	assert.Equal(t, report.Previous.End, report.Current.Start)
+
+	// Nothing happened for a whole window.
+	now = now.Add(5 * time.Minute)
+	report = s.Report()
+	assert.Nil(t, report.Previous)
+	assert.Equal(t, uint64(0), report.Current.Sampled)
+}
+
+func TestSamplerRate(t *testing.T) {
+	s := NewSampler(10, 5, time.Minute, nil)
+	for i := 0; i < 100; i++ {
+		observe(s, &net.UDPAddr{}, "a.default.svc.cluster.local.", dns.RcodeSuccess)
+	}
+	report := s.Report()
+	assert.Equal(t, uint64(10), report.Current.Sampled)
+	assert.Equal(t, uint64(10), report.Current.SampleRate)
+}
+
+func TestTopK(t *testing.T) {
+	top := newTopK(2)
+	for _, key := range []string{"a", "a", "a", "b", "c"} {
+		top.add(key)
+	}
+	// c replaced b and inherited its count as error.
+	assert.Equal(t, []Entry{{Key: "a", Count: 3}, {Key: "c", Count: 2, Error: 1}}, top.list())
+}
@@ -0,0 +1,249 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package searchpath detects the queries that are expansions of external
+// names with the search path of the pods, e.g. api.example.com.default.svc.cluster.local.
+// for api.example.com, which pods with the default ndots of 5 send before
+// the name itself. They are counted by namespace, so that the workloads
+// multiplying the load of the cluster DNS can be fixed, e.g. with a lower
+// ndots or fully qualified names.
+package searchpath
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+)
+
+// maxOffenders bounds the workloads whose expansions are tracked over a
+// window, and topOffenders is how many are logged.
+const (
+	maxOffenders = 1000
+	topOffenders = 10
+)
+
+var (
+	queries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kubedns",
+		Subsystem: "search_path",
+		Name:      "queries_total",
+		Help:      "Number of queries of the pods, by namespace.",
+	}, []string{"namespace"})
+	expansions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kubedns",
+		Subsystem: "search_path",
+		Name:      "expansions_total",
+		Help:      "Number of queries of the pods that are search path expansions of external names, by namespace.",
+	}, []string{"namespace"})
+	amplification = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kubedns",
+		Subsystem: "search_path",
+		Name:      "amplification_factor",
+		Help: "Queries sent by the pods per name they looked up over the last window, by namespace:" +
+			" 1 if no query is a search path expansion.",
+	}, []string{"namespace"})
+	registerMetrics sync.Once
+)
+
+// Detector classifies the queries of the pods. Its Observe method is a
+// server.QueryObserver.
+type Detector struct {
+	// domain is the cluster domain, fully qualified.
+	domain string
+	window time.Duration
+	// resolve names the pod of a client IP, as namespace/name.
+	resolve      func(ip string) (string, bool)
+	logOffenders bool
+
+	mu         sync.Mutex
+	namespaces map[string]*counts
+	offenders  map[string]*offender
+}
+
+// counts are the queries of a namespace over a window.
+type counts struct {
+	queries    uint64
+	expansions uint64
+}
+
+// offender is a pod that sent expansions over a window.
+type offender struct {
+	pod        string
+	expansions uint64
+	// example is one of its expansions.
+	example string
+}
+
+// NewDetector returns a Detector for the cluster domain, computing the
+// amplification factors over windows of the given duration. resolve names
+// the pod of a client IP as namespace/name; the queries of the clients it
+// does not know are ignored. If logOffenders is true, the pods that sent
+// the most expansions are logged at the end of every window.
+func NewDetector(domain string, window time.Duration, resolve func(ip string) (string, bool), logOffenders bool) *Detector {
+	return &Detector{
+		domain:       strings.ToLower(dns.Fqdn(domain)),
+		window:       window,
+		resolve:      resolve,
+		logOffenders: logOffenders,
+		namespaces:   make(map[string]*counts),
+		offenders:    make(map[string]*offender),
+	}
+}
+
+// IsExpansion returns whether name, which got an NXDOMAIN answer, is an
+// external name expanded with the search path of a pod in namespace, i.e.
+// <name>.<namespace>.svc.<domain>, <name>.svc.<domain> or <name>.<domain>
+// for a name of several labels that is not a name of the cluster itself.
+// As <service>.<namespace>.svc.<domain> is a name of the cluster, external
+// names of two labels are not recognized in <name>.svc.<domain>.
+func IsExpansion(name, namespace, domain string) bool {
+	for i, suffix := range []string{namespace + ".svc." + domain, "svc." + domain, domain} {
+		if !strings.HasSuffix(name, "."+suffix) {
+			continue
+		}
+		external := strings.TrimSuffix(name, "."+suffix)
+		if strings.HasPrefix(external, "_") {
+			// A service port.
+			return false
+		}
+		labels := strings.Count(external, ".") + 1
+		if labels < 2 || (i == 1 && labels < 3) {
+			// A service, or another name of the cluster.
+			return false
+		}
+		top := external[strings.LastIndex(external, ".")+1:]
+		return top != "svc" && top != "pod"
+	}
+	return false
+}
+
+// Observe accounts for a query and its reply.
+func (d *Detector) Observe(remote net.Addr, req, resp *dns.Msg) {
+	if len(req.Question) == 0 {
+		return
+	}
+	var ip net.IP
+	switch addr := remote.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		return
+	}
+	pod, ok := d.resolve(ip.String())
+	if !ok {
+		return
+	}
+	namespace := pod
+	if i := strings.Index(pod, "/"); i >= 0 {
+		namespace = pod[:i]
+	}
+	name := strings.ToLower(req.Question[0].Name)
+	expansion := resp != nil && resp.Rcode == dns.RcodeNameError && IsExpansion(name, namespace, d.domain)
+
+	queries.WithLabelValues(namespace).Inc()
+	if expansion {
+		expansions.WithLabelValues(namespace).Inc()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.namespaces[namespace]
+	if !ok {
+		c = &counts{}
+		d.namespaces[namespace] = c
+	}
+	c.queries++
+	if !expansion {
+		return
+	}
+	c.expansions++
+	if !d.logOffenders {
+		return
+	}
+	if o, ok := d.offenders[pod]; ok {
+		o.expansions++
+	} else if len(d.offenders) < maxOffenders {
+		d.offenders[pod] = &offender{pod: pod, expansions: 1, example: name}
+	}
+}
+
+// Run registers the metrics and updates the amplification factors at the
+// end of every window, until stopCh is closed.
+func (d *Detector) Run(stopCh <-chan struct{}) {
+	registerMetrics.Do(func() { prometheus.MustRegister(queries, expansions, amplification) })
+	klog.V(0).Infof("Detecting search path expansions over windows of %v", d.window)
+	ticker := time.NewTicker(d.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			d.flush()
+		}
+	}
+}
+
+// flush sets the amplification factors of the window that ended, and logs
+// its worst offenders.
+func (d *Detector) flush() {
+	d.mu.Lock()
+	namespaces, offenders := d.namespaces, d.offenders
+	d.namespaces = make(map[string]*counts)
+	d.offenders = make(map[string]*offender)
+	d.mu.Unlock()
+
+	amplification.Reset()
+	for namespace, c := range namespaces {
+		amplification.WithLabelValues(namespace).Set(c.factor())
+	}
+
+	sorted := make([]*offender, 0, len(offenders))
+	for _, o := range offenders {
+		sorted = append(sorted, o)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].expansions != sorted[j].expansions {
+			return sorted[i].expansions > sorted[j].expansions
+		}
+		return sorted[i].pod < sorted[j].pod
+	})
+	if len(sorted) > topOffenders {
+		sorted = sorted[:topOffenders]
+	}
+	for _, o := range sorted {
+		klog.Warningf("Pod %s sent %d search path expansions of external names in %v, e.g. %q:"+
+			" lower the ndots of its dnsConfig or query fully qualified names", o.pod, o.expansions, d.window, o.example)
+	}
+}
+
+// factor returns the queries sent per name looked up.
+func (c *counts) factor() float64 {
+	lookups := c.queries - c.expansions
+	if lookups == 0 {
+		// Only expansions, whose names were looked up in another window.
+		return float64(c.queries)
+	}
+	return float64(c.queries) / float64(lookups)
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package searchpath
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func value(t *testing.T, metric prometheus.Metric) float64 {
+	m := &dto.Metric{}
+	require.NoError(t, metric.Write(m))
+	if m.Counter != nil {
+		return m.Counter.GetValue()
+	}
+	return m.Gauge.GetValue()
+}
+
+func observe(d *Detector, remote net.Addr, name string, rcode int) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetRcode(req, rcode)
+	d.Observe(remote, req, resp)
+}
+
+func TestIsExpansion(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		expansion bool
+	}{
+		{"api.example.com.team-a.svc.cluster.local.", true},
+		{"api.example.com.svc.cluster.local.", true},
+		{"api.example.com.cluster.local.", true},
+		{"redis.team-a.svc.cluster.local.", false},
+		{"redis.svc.cluster.local.", false},
+		{"_http._tcp.web.team-a.svc.cluster.local.", false},
+		{"redis.team-b.svc.cluster.local.", false},
+		{"example.com.team-a.svc.cluster.local.", true},
+		{"example.com.cluster.local.", true},
+		{"10-0-0-1.team-a.pod.cluster.local.", false},
+		{"api.example.com.", false},
+	} {
+		assert.Equal(t, tc.expansion, IsExpansion(tc.name, "team-a", "cluster.local."), tc.name)
+	}
+}
+
+func TestDetector(t *testing.T) {
+	d := NewDetector("cluster.local", time.Minute, func(ip string) (string, bool) {
+		switch ip {
+		case "10.0.0.1":
+			return "team-a/client", true
+		case "10.0.0.2":
+			return "team-b/client", true
+		}
+		return "", false
+	}, true)
+
+	teamA := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	teamB := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1234}
+	node := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1234}
+	// The search path of api.example.com with ndots:5, then the name.
+	for _, name := range []string{
+		"api.example.com.team-a.svc.cluster.local.",
+		"api.example.com.svc.cluster.local.",
+		"api.example.com.cluster.local.",
+	} {
+		observe(d, teamA, name, dns.RcodeNameError)
+		observe(d, node, name, dns.RcodeNameError)
+	}
+	observe(d, teamA, "api.example.com.", dns.RcodeSuccess)
+	observe(d, teamB, "redis.team-b.svc.cluster.local.", dns.RcodeSuccess)
+	observe(d, teamB, "missing.team-b.svc.cluster.local.", dns.RcodeNameError)
+
+	assert.Equal(t, float64(3), value(t, expansions.WithLabelValues("team-a")))
+	assert.Equal(t, float64(4), value(t, queries.WithLabelValues("team-a")))
+	assert.Equal(t, float64(0), value(t, expansions.WithLabelValues("team-b")))
+	if assert.Contains(t, d.offenders, "team-a/client") {
+		assert.Equal(t, uint64(3), d.offenders["team-a/client"].expansions)
+		assert.Equal(t, "api.example.com.team-a.svc.cluster.local.", d.offenders["team-a/client"].example)
+	}
+
+	d.flush()
+	assert.Equal(t, float64(4), value(t, amplification.WithLabelValues("team-a")))
+	assert.Equal(t, float64(1), value(t, amplification.WithLabelValues("team-b")))
+	assert.Empty(t, d.offenders)
+
+	// The namespaces without queries in the last window are dropped.
+	observe(d, teamB, "redis.team-b.svc.cluster.local.", dns.RcodeSuccess)
+	d.flush()
+	ch := make(chan prometheus.Metric, 10)
+	amplification.Collect(ch)
+	assert.Len(t, ch, 1)
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+const (
+	// SRVPriorityAnnotation sets the priority of the SRV records of the
+	// ports of a service, from 0 to 65535. The priority of a single port is
+	// set by suffixing the annotation with its name, e.g.
+	// dns.kubernetes.io/srv-priority.http, which takes precedence.
+	SRVPriorityAnnotation = "dns.kubernetes.io/srv-priority"
+	// SRVWeightAnnotation sets the weight of the SRV records of the ports of
+	// a service, from 1 to 65535, like SRVPriorityAnnotation. Weights are
+	// relative to those of the records with the same priority.
+	SRVWeightAnnotation = "dns.kubernetes.io/srv-weight"
+)
+
+// applySRVAnnotations sets the priority and weight of the SRV record of the
+// named port of svc from its annotations. Invalid values are ignored.
+func applySRVAnnotations(svc *v1.Service, portName string, record *skymsg.Service) {
+	if priority, ok := srvAnnotation(svc, SRVPriorityAnnotation, portName, 0); ok {
+		record.Priority = priority
+	}
+	if weight, ok := srvAnnotation(svc, SRVWeightAnnotation, portName, 1); ok {
+		record.Weight = weight
+	}
+}
+
+// srvAnnotation returns the value of the annotation for the named port of
+// svc, falling back to the value for the whole service.
+func srvAnnotation(svc *v1.Service, annotation, portName string, min int) (int, bool) {
+	for _, key := range []string{annotation + "." + portName, annotation} {
+		value, ok := svc.Annotations[key]
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < min || n > 65535 {
+			klog.Warningf("Ignoring invalid annotation %s=%q on service %s/%s, must be between %d and 65535",
+				key, value, svc.Namespace, svc.Name, min)
+			continue
+		}
+		return n, true
+	}
+	return 0, false
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+// UnknownProtocolPolicy selects the SRV records of the ports whose protocol
+// is not TCP, UDP or SCTP, which have no standard SRV protocol label.
+type UnknownProtocolPolicy string
+
+const (
+	// UnknownProtocolSkip publishes no SRV records for the port.
+	UnknownProtocolSkip UnknownProtocolPolicy = "skip"
+	// UnknownProtocolLowercase publishes them under the protocol in lower
+	// case, e.g. _quic, as kube-dns always did.
+	UnknownProtocolLowercase UnknownProtocolPolicy = "lowercase"
+	// UnknownProtocolTCP publishes them under _tcp.
+	UnknownProtocolTCP UnknownProtocolPolicy = "tcp"
+)
+
+// Reasons of the Events about the ports without SRV records.
+const (
+	eventReasonInvalidSRVPortName = "InvalidSRVPortName"
+	eventReasonUnknownSRVProtocol = "UnknownSRVProtocol"
+)
+
+var (
+	srvPortsSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kubedns",
+		Subsystem: "srv",
+		Name:      "ports_skipped_total",
+		Help:      "Named ports whose SRV records were not generated, by reason: invalid_name or unknown_protocol.",
+	}, []string{"reason"})
+	registerSRVPortMetrics sync.Once
+)
+
+// ParseUnknownProtocolPolicy parses the --unknown-port-protocols flag.
+func ParseUnknownProtocolPolicy(value string) (UnknownProtocolPolicy, error) {
+	switch policy := UnknownProtocolPolicy(value); policy {
+	case UnknownProtocolSkip, UnknownProtocolLowercase, UnknownProtocolTCP:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid unknown port protocol policy %q, must be %v, %v or %v",
+		value, UnknownProtocolSkip, UnknownProtocolLowercase, UnknownProtocolTCP)
+}
+
+// srvLabels returns the labels, _<protocol> and _<name>, under which the SRV
+// records of a named port of svc are published, or false if they are not:
+// the port is unnamed or has no protocol, its name is not a DNS label, or
+// its protocol is unknown and skipped by UnknownProtocols. The Service is
+// warned about with an Event, if svc is set, for the named ports skipped.
+func (kd *KubeDNS) srvLabels(svc *v1.Service, name string, protocol v1.Protocol) ([]string, bool) {
+	if name == "" || protocol == "" {
+		return nil, false
+	}
+	registerSRVPortMetrics.Do(func() { prometheus.MustRegister(srvPortsSkipped) })
+	if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+		srvPortsSkipped.WithLabelValues("invalid_name").Inc()
+		kd.warnSRVPort(svc, eventReasonInvalidSRVPortName,
+			"Port %q has no SRV records: its name is not a DNS label: %s", name, strings.Join(errs, ", "))
+		return nil, false
+	}
+	label := strings.ToLower(string(protocol))
+	switch protocol {
+	case v1.ProtocolTCP, v1.ProtocolUDP, v1.ProtocolSCTP:
+	default:
+		switch kd.UnknownProtocols {
+		case UnknownProtocolLowercase:
+			if len(validation.IsDNS1123Label(label)) == 0 {
+				break
+			}
+			fallthrough
+		case UnknownProtocolSkip, "":
+			srvPortsSkipped.WithLabelValues("unknown_protocol").Inc()
+			kd.warnSRVPort(svc, eventReasonUnknownSRVProtocol,
+				"Port %q has no SRV records: its protocol %q is not TCP, UDP or SCTP", name, protocol)
+			return nil, false
+		case UnknownProtocolTCP:
+			label = "tcp"
+		}
+	}
+	return []string{"_" + label, "_" + name}, true
+}
+
+// warnSRVPort logs and posts an Event about a port of svc without SRV
+// records.
+func (kd *KubeDNS) warnSRVPort(svc *v1.Service, reason, messageFmt string, args ...interface{}) {
+	if svc == nil {
+		klog.V(2).Infof(messageFmt, args...)
+		return
+	}
+	klog.V(2).Infof("Service %s/%s: "+messageFmt, append([]interface{}{svc.Namespace, svc.Name}, args...)...)
+	kd.events.warn("Service", svc, reason, messageFmt, args...)
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+func TestSRVPorts(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	kd := newKubeDNS()
+	kd.events = newEventEmitter(client)
+
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	s.UID = "uid-1"
+	s.Spec.Ports = append(s.Spec.Ports,
+		v1.ServicePort{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP},
+		v1.ServicePort{Name: "diameter", Port: 3868, Protocol: v1.ProtocolSCTP},
+		v1.ServicePort{Name: "quic", Port: 443, Protocol: "QUIC"},
+		v1.ServicePort{Name: "Bad_Name", Port: 8080, Protocol: v1.ProtocolTCP},
+	)
+	kd.newService(s)
+
+	name := testService + "." + testNamespace + ".svc." + testDomain
+	for _, srv := range []string{"_http._tcp.", "_dns._udp.", "_diameter._sctp."} {
+		records, err := kd.Records(srv+name, false)
+		require.NoError(t, err, srv)
+		assert.Len(t, records, 1, srv)
+	}
+	for _, srv := range []string{"_quic._quic.", "_quic._tcp.", "_Bad_Name._tcp."} {
+		_, err := kd.Records(srv+name, false)
+		assert.ErrorIs(t, err, server.ErrNotFound, srv)
+	}
+
+	// The Service is warned about each port skipped, once.
+	kd.newService(s)
+	var events *v1.EventList
+	require.Eventually(t, func() bool {
+		var err error
+		events, err = client.CoreV1().Events(testNamespace).List(context.TODO(), metav1.ListOptions{})
+		return err == nil && len(events.Items) >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	events, err := client.CoreV1().Events(testNamespace).List(context.TODO(), metav1.ListOptions{})
+	require.NoError(t, err)
+	reasons := map[string]int{}
+	for _, event := range events.Items {
+		assert.Equal(t, "Service", event.InvolvedObject.Kind)
+		assert.Equal(t, s.UID, event.InvolvedObject.UID)
+		assert.Equal(t, v1.EventTypeWarning, event.Type)
+		reasons[event.Reason]++
+	}
+	assert.Equal(t, map[string]int{eventReasonInvalidSRVPortName: 1, eventReasonUnknownSRVProtocol: 1}, reasons)
+
+	// Unknown protocols can be published as they are or under _tcp.
+	for policy, srv := range map[UnknownProtocolPolicy]string{
+		UnknownProtocolLowercase: "_quic._quic.",
+		UnknownProtocolTCP:       "_quic._tcp.",
+	} {
+		kd.UnknownProtocols = policy
+		kd.newService(s)
+		records, err := kd.Records(srv+name, false)
+		require.NoError(t, err, policy)
+		assert.Len(t, records, 1, policy)
+	}
+}
+
+func TestParseUnknownProtocolPolicy(t *testing.T) {
+	for _, value := range []string{"skip", "lowercase", "tcp"} {
+		policy, err := ParseUnknownProtocolPolicy(value)
+		assert.NoError(t, err)
+		assert.Equal(t, UnknownProtocolPolicy(value), policy)
+	}
+	_, err := ParseUnknownProtocolPolicy("udp")
+	assert.Error(t, err)
+}
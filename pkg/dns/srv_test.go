@@ -0,0 +1,65 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestSRVAnnotations(t *testing.T) {
+	kd := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	s.Spec.Ports = append(s.Spec.Ports, v1.ServicePort{Port: 443, Name: "https", Protocol: "TCP"})
+	s.Annotations = map[string]string{
+		SRVPriorityAnnotation:            "5",
+		SRVWeightAnnotation:              "30",
+		SRVWeightAnnotation + ".https":   "70",
+		SRVPriorityAnnotation + ".https": "invalid",
+	}
+	kd.newService(s)
+
+	records, err := kd.Records(getSRVFQDN(kd, s, "http"), false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, 5, records[0].Priority)
+	assert.Equal(t, 30, records[0].Weight)
+
+	// The invalid per port priority falls back to the service one.
+	records, err = kd.Records(getSRVFQDN(kd, s, "https"), false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, 5, records[0].Priority)
+	assert.Equal(t, 70, records[0].Weight)
+
+	// Headless services get the same values on the SRV records of their endpoints.
+	h := newHeadlessService()
+	h.Annotations = map[string]string{SRVPriorityAnnotation + ".http": "0"}
+	e := newEndpoints(h, newSubsetWithOnePort("http", 80, "10.0.0.1", "10.0.0.2"))
+	require.NoError(t, kd.endpointsStore.Add(e))
+	kd.newService(h)
+	records, err = kd.Records(getSRVFQDN(kd, h, "http"), false)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(records))
+	for _, record := range records {
+		assert.Equal(t, 0, record.Priority)
+		assert.Equal(t, 10, record.Weight)
+	}
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"net"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/util"
+)
+
+// TenantLabel is the namespace label naming the tenant the namespace
+// belongs to. With TenantZones, the services of the namespace are also
+// served in the zone of the tenant, e.g. my-svc.my-ns.svc.team-a.cluster.local.
+const TenantLabel = "dns.kubernetes.io/tenant"
+
+// setNamespacesStore watches the namespaces, to map them to their tenant.
+func (kd *KubeDNS) setNamespacesStore() {
+	informer := kd.informerFactory.Core().V1().Namespaces().Informer()
+	kd.namespacesStore, kd.namespaceController = informer.GetStore(), informer
+}
+
+// namespaceTenant returns the tenant of a namespace, "" if it belongs to
+// none or its tenant label is not a valid zone name.
+func (kd *KubeDNS) namespaceTenant(namespace string) string {
+	if kd.namespacesStore == nil {
+		return ""
+	}
+	obj, exists, err := kd.namespacesStore.GetByKey(namespace)
+	if err != nil || !exists {
+		return ""
+	}
+	ns, ok := obj.(*v1.Namespace)
+	if !ok {
+		return ""
+	}
+	tenant := ns.Labels[TenantLabel]
+	if !isTenantName(tenant) {
+		if tenant != "" {
+			klog.V(4).Infof("Ignoring invalid tenant %q of namespace %q", tenant, namespace)
+		}
+		return ""
+	}
+	return tenant
+}
+
+// isTenantName returns whether tenant can name a zone: a DNS label that
+// does not collide with the subdomains of the cluster domain.
+func isTenantName(tenant string) bool {
+	return tenant != serviceSubdomain && tenant != podSubdomain &&
+		len(validation.IsDNS1123Label(tenant)) == 0
+}
+
+// untenantedPath maps a path in the zone of a tenant, e.g.
+// {"local", "cluster", "team-a", "svc", "my-ns", "my-svc"}, to the path of
+// the records in the cluster domain, {"local", "cluster", "svc", "my-ns",
+// "my-svc"}, if the namespace belongs to the tenant. Other paths are
+// returned as is.
+func (kd *KubeDNS) untenantedPath(path []string) []string {
+	if !kd.TenantZones || !hasPathPrefix(path, kd.domainPath) {
+		return path
+	}
+	d := len(kd.domainPath)
+	if len(path) < d+3 || path[d+1] != serviceSubdomain {
+		return path
+	}
+	if tenant := path[d]; tenant == "*" || kd.namespaceTenant(path[d+2]) != tenant {
+		return path
+	}
+	untenanted := make([]string, 0, len(path)-1)
+	untenanted = append(untenanted, path[:d]...)
+	return append(untenanted, path[d+1:]...)
+}
+
+// Authorize returns whether the client at remote may resolve name, under
+// the tenantAccess configuration: the services of a tenant listed there
+// may only be resolved by the pods of the tenant and of the tenants it
+// allows, in the tenant zone and the cluster domain alike. Queries with a
+// wildcard namespace, which could span tenants, are refused to every client
+// once access is restricted. The reverse names are authorized as the names
+// they point to. The clients in TrustedForwarders, e.g. the node-local-dns
+// caches, are trusted to forward the queries of any pod. It is a
+// server.QueryAuthorizer.
+func (kd *KubeDNS) Authorize(remote net.Addr, name string) bool {
+	kd.configLock.RLock()
+	var access map[string][]string
+	if kd.config != nil {
+		access = kd.config.TenantAccess
+	}
+	kd.configLock.RUnlock()
+	if len(access) == 0 || kd.trustedForwarder(remote) {
+		return true
+	}
+	return kd.authorize(remote, name, access)
+}
+
+// authorize returns whether the client at remote may resolve name under
+// access.
+func (kd *KubeDNS) authorize(remote net.Addr, name string, access map[string][]string) bool {
+	if lower := strings.ToLower(name); strings.HasSuffix(lower, util.ArpaSuffix) || strings.HasSuffix(lower, util.ArpaSuffixV6) {
+		return kd.authorizeReverse(remote, name, access)
+	}
+
+	path := kd.untenantedPath(util.ReverseArray(strings.Split(strings.TrimRight(strings.ToLower(name), "."), ".")))
+	d := len(kd.domainPath)
+	if !hasPathPrefix(path, kd.domainPath) || len(path) < d+2 || path[d] != serviceSubdomain {
+		return true
+	}
+	if path[d+1] == "*" {
+		return false
+	}
+	tenant := kd.namespaceTenant(path[d+1])
+	allowed, restricted := access[tenant]
+	if tenant == "" || !restricted {
+		return true
+	}
+
+	client := kd.clientTenant(remote)
+	if client == "" {
+		klog.V(4).Infof("Refusing %q of tenant %q to %v, not in a tenant", name, tenant, remote)
+		return false
+	}
+	if client == tenant {
+		return true
+	}
+	for _, other := range allowed {
+		if other == "*" || other == client {
+			return true
+		}
+	}
+	klog.V(4).Infof("Refusing %q of tenant %q to %v of tenant %q", name, tenant, remote, client)
+	return false
+}
+
+// authorizeReverse returns whether the client at remote may resolve the
+// reverse name, i.e. every name its PTR records point to: the reverse
+// names of the services of a tenant would disclose them otherwise.
+func (kd *KubeDNS) authorizeReverse(remote net.Addr, name string, access map[string][]string) bool {
+	records, err := kd.ReverseRecords(name)
+	if err != nil {
+		return true
+	}
+	for _, record := range records {
+		if !kd.authorize(remote, record.Host, access) {
+			return false
+		}
+	}
+	return true
+}
+
+// trustedForwarder returns whether remote is in TrustedForwarders.
+func (kd *KubeDNS) trustedForwarder(remote net.Addr) bool {
+	ip := remoteIP(remote)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range kd.TrustedForwarders {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientTenant returns the tenant of the pod at remote, "" if it is not a
+// pod or its namespace belongs to no tenant.
+func (kd *KubeDNS) clientTenant(remote net.Addr) string {
+	if kd.PodIndex == nil {
+		return ""
+	}
+	ip := remoteIP(remote)
+	if ip == nil {
+		return ""
+	}
+	pod, ok := kd.PodIndex.Lookup(ip.String())
+	if !ok {
+		return ""
+	}
+	return kd.namespaceTenant(pod.Namespace)
+}
+
+// remoteIP returns the IP of remote, nil if it is neither a UDP nor a TCP
+// address.
+func remoteIP(remote net.Addr) net.IP {
+	switch addr := remote.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// hasPathPrefix returns whether path starts with the labels of prefix.
+func hasPathPrefix(path, prefix []string) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	for i, label := range prefix {
+		if path[i] != label {
+			return false
+		}
+	}
+	return true
+}
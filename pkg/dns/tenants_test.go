@@ -0,0 +1,140 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"k8s.io/dns/pkg/dns/podindex"
+)
+
+// newTenantKubeDNS returns a KubeDNS with tenant zones, where the namespace
+// ns-a belongs to team-a, ns-b to team-b, ns-c to team-c and default to
+// none. Each namespace runs a client pod, e.g. 10.0.0.1 in ns-a.
+func newTenantKubeDNS(t *testing.T) *KubeDNS {
+	kd := newKubeDNS()
+	kd.TenantZones = true
+	kd.namespacesStore = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	var pods []runtime.Object
+	for i, ns := range []struct{ name, tenant string }{
+		{"ns-a", "team-a"},
+		{"ns-b", "team-b"},
+		{"ns-c", "team-c"},
+		{"default", ""},
+		{"ns-svc", "svc"},
+	} {
+		namespace := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns.name}}
+		if ns.tenant != "" {
+			namespace.Labels = map[string]string{TenantLabel: ns.tenant}
+		}
+		require.NoError(t, kd.namespacesStore.Add(namespace))
+		pods = append(pods, &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "client", Namespace: ns.name},
+			Status:     v1.PodStatus{Phase: v1.PodRunning, PodIP: net.IPv4(10, 0, 0, byte(i+1)).String()},
+		})
+	}
+	kd.PodIndex = podindex.NewPodIndex(fake.NewSimpleClientset(pods...), 0)
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	go kd.PodIndex.Run(stopCh)
+	require.True(t, cache.WaitForCacheSync(stopCh, kd.PodIndex.HasSynced))
+	return kd
+}
+
+func TestTenantZones(t *testing.T) {
+	kd := newTenantKubeDNS(t)
+	for _, ns := range []string{"ns-a", "default", "ns-svc"} {
+		s := newService(ns, testService, "1.2.3.4", "http", 80)
+		require.NoError(t, kd.servicesStore.Add(s))
+		kd.newService(s)
+	}
+
+	assert.Equal(t, []string{"1.2.3.4"}, recordHosts(t, kd, "testservice.ns-a.svc.team-a.cluster.local."))
+	assert.Equal(t, []string{"1.2.3.4"}, recordHosts(t, kd, "testservice.ns-a.svc.cluster.local."))
+	assert.Equal(t, []string{"testservice.ns-a.svc.cluster.local."},
+		recordHosts(t, kd, "_http._tcp.testservice.ns-a.svc.team-a.cluster.local."))
+	// Only in the zone of their own tenant.
+	assert.Empty(t, recordHosts(t, kd, "testservice.ns-a.svc.team-b.cluster.local."))
+	assert.Empty(t, recordHosts(t, kd, "testservice.default.svc.team-a.cluster.local."))
+	// Tenants cannot shadow the subdomains of the cluster domain.
+	assert.Empty(t, recordHosts(t, kd, "testservice.ns-svc.svc.svc.cluster.local."))
+}
+
+func TestAuthorize(t *testing.T) {
+	kd := newTenantKubeDNS(t)
+	client := func(i byte) net.Addr { return &net.UDPAddr{IP: net.IPv4(10, 0, 0, i), Port: 4242} }
+	a, b, c, none := client(1), client(2), client(3), client(4)
+	node := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 4242}
+	for i, ns := range []string{"ns-a", "ns-b"} {
+		s := newService(ns, testService, net.IPv4(1, 2, 3, byte(i+4)).String(), "http", 80)
+		require.NoError(t, kd.servicesStore.Add(s))
+		kd.newService(s)
+	}
+
+	// Everything is allowed until access is restricted.
+	assert.True(t, kd.Authorize(c, "testservice.ns-a.svc.cluster.local."))
+	kd.config.TenantAccess = map[string][]string{"team-a": {"team-b"}, "team-b": {"*"}}
+
+	for _, tc := range []struct {
+		remote  net.Addr
+		name    string
+		allowed bool
+	}{
+		{a, "testservice.ns-a.svc.cluster.local.", true},
+		{a, "testservice.ns-a.svc.team-a.cluster.local.", true},
+		{b, "testservice.ns-a.svc.team-a.cluster.local.", true},
+		{b, "_http._tcp.testservice.ns-a.svc.cluster.local.", true},
+		{c, "testservice.ns-a.svc.cluster.local.", false},
+		{c, "testservice.ns-a.svc.team-a.cluster.local.", false},
+		{none, "testservice.ns-a.svc.cluster.local.", false},
+		{node, "testservice.ns-a.svc.cluster.local.", false},
+		// team-b allows every tenant, but not the clients in no tenant.
+		{c, "testservice.ns-b.svc.cluster.local.", true},
+		{none, "testservice.ns-b.svc.cluster.local.", false},
+		// team-c and the namespaces in no tenant are not restricted.
+		{a, "testservice.ns-c.svc.cluster.local.", true},
+		{node, "testservice.default.svc.cluster.local.", true},
+		{node, "1-2-3-4.ns-a.pod.cluster.local.", true},
+		// Wildcard namespaces could span tenants.
+		{a, "testservice.*.svc.cluster.local.", false},
+		// Reverse names are authorized as the services they point to.
+		{a, "4.3.2.1.in-addr.arpa.", true},
+		{c, "4.3.2.1.in-addr.arpa.", false},
+		{c, "5.3.2.1.in-addr.arpa.", true},
+		{c, "9.3.2.1.in-addr.arpa.", true},
+	} {
+		assert.Equal(t, tc.allowed, kd.Authorize(tc.remote, tc.name), "%v resolving %q", tc.remote, tc.name)
+	}
+
+	// The node-local-dns caches forward the queries of every pod once
+	// trusted.
+	_, nodes, err := net.ParseCIDR("192.168.0.0/24")
+	require.NoError(t, err)
+	kd.TrustedForwarders = []*net.IPNet{nodes}
+	assert.True(t, kd.Authorize(node, "testservice.ns-a.svc.cluster.local."))
+	assert.True(t, kd.Authorize(node, "4.3.2.1.in-addr.arpa."))
+	assert.False(t, kd.Authorize(c, "testservice.ns-a.svc.cluster.local."))
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	kcache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// setEndpointSlicesStore watches EndpointSlices to learn which endpoint
+// addresses are terminating or still serving, where the endpoints run, and the endpoints of
+// the services imported from the clusterset.
+func (kd *KubeDNS) setEndpointSlicesStore() {
+	informer := kd.informerFactory.Discovery().V1().EndpointSlices().Informer()
+	if err := informer.AddIndexers(kcache.Indexers{multiClusterSliceIndex: multiClusterSliceKeys}); err != nil {
+		klog.Errorf("Failed to index the endpoint slices: %v", err)
+	}
+	informer.AddEventHandlerWithResyncPeriod(kcache.ResourceEventHandlerFuncs{
+		AddFunc:    kd.handleEndpointSliceAdd,
+		UpdateFunc: kd.handleEndpointSliceUpdate,
+		DeleteFunc: kd.handleEndpointSliceDelete,
+	}, kd.ResyncPeriod)
+	kd.endpointSlicesStore, kd.endpointSliceController = informer.GetIndexer(), informer
+}
+
+func (kd *KubeDNS) handleEndpointSliceAdd(obj interface{}) {
+	if slice, ok := obj.(*discovery.EndpointSlice); ok {
+		if kd.TopologyAwareAnswers {
+			kd.topology.setSlice(slice.Namespace+"/"+slice.Name, slice)
+		}
+		if kd.DropTerminatingEndpoints || kd.ServingTerminatingEndpoints {
+			kd.setTerminatingEndpoints(slice, endpointSliceConditions(slice))
+		}
+		kd.updateServiceImportOfSlice(slice)
+	}
+}
+
+func (kd *KubeDNS) handleEndpointSliceUpdate(_, newObj interface{}) {
+	kd.handleEndpointSliceAdd(newObj)
+}
+
+func (kd *KubeDNS) handleEndpointSliceDelete(obj interface{}) {
+	if tombstone, ok := obj.(kcache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if slice, ok := obj.(*discovery.EndpointSlice); ok {
+		if kd.TopologyAwareAnswers {
+			kd.topology.setSlice(slice.Namespace+"/"+slice.Name, nil)
+		}
+		if kd.DropTerminatingEndpoints || kd.ServingTerminatingEndpoints {
+			kd.setTerminatingEndpoints(slice, sliceConditions{})
+		}
+		kd.updateServiceImportOfSlice(slice)
+	}
+}
+
+// sliceConditions are the addresses of the endpoints of a slice that are
+// terminating, and those of them that are still serving.
+type sliceConditions struct {
+	terminating sets.String
+	serving     sets.String
+}
+
+func (c sliceConditions) equal(other sliceConditions) bool {
+	return c.terminating.Equal(other.terminating) && c.serving.Equal(other.serving)
+}
+
+// endpointSliceConditions returns the addresses of the endpoints of the
+// slice that are terminating, and those that are still serving.
+func endpointSliceConditions(slice *discovery.EndpointSlice) sliceConditions {
+	conditions := sliceConditions{terminating: sets.NewString(), serving: sets.NewString()}
+	for _, endpoint := range slice.Endpoints {
+		if endpoint.Conditions.Terminating != nil && *endpoint.Conditions.Terminating {
+			conditions.terminating.Insert(endpoint.Addresses...)
+			if endpoint.Conditions.Serving != nil && *endpoint.Conditions.Serving {
+				conditions.serving.Insert(endpoint.Addresses...)
+			}
+		}
+	}
+	return conditions
+}
+
+// setTerminatingEndpoints records the terminating addresses of a slice and
+// regenerates the records of its service if they changed.
+func (kd *KubeDNS) setTerminatingEndpoints(slice *discovery.EndpointSlice, conditions sliceConditions) {
+	serviceName, ok := slice.Labels[discovery.LabelServiceName]
+	if !ok {
+		return
+	}
+	serviceKey := slice.Namespace + "/" + serviceName
+
+	kd.terminatingLock.Lock()
+	slices := kd.terminatingEndpoints[serviceKey]
+	if slices[slice.Name].equal(conditions) {
+		kd.terminatingLock.Unlock()
+		return
+	}
+	if conditions.terminating.Len() == 0 {
+		delete(slices, slice.Name)
+		if len(slices) == 0 {
+			delete(kd.terminatingEndpoints, serviceKey)
+		}
+	} else {
+		if slices == nil {
+			slices = make(map[string]sliceConditions)
+			kd.terminatingEndpoints[serviceKey] = slices
+		}
+		slices[slice.Name] = conditions
+	}
+	kd.terminatingLock.Unlock()
+
+	obj, exists, err := kd.endpointsStore.GetByKey(serviceKey)
+	if err != nil || !exists {
+		return
+	}
+	klog.V(3).Infof("Terminating endpoints of %q changed to %v, serving %v",
+		serviceKey, conditions.terminating.List(), conditions.serving.List())
+	kd.handleEndpointAdd(obj)
+}
+
+// isTerminating returns whether the address of an endpoint of the service is
+// known to be terminating, and is to be dropped.
+func (kd *KubeDNS) isTerminating(service *v1.Service, address string) bool {
+	if !kd.DropTerminatingEndpoints || service.Spec.PublishNotReadyAddresses {
+		return false
+	}
+	kd.terminatingLock.RLock()
+	defer kd.terminatingLock.RUnlock()
+	for _, conditions := range kd.terminatingEndpoints[service.Namespace+"/"+service.Name] {
+		if conditions.terminating.Has(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// isServingTerminating returns whether the address of an endpoint of the
+// service is known to be terminating but still serving, and is to be
+// published even though it is not ready.
+func (kd *KubeDNS) isServingTerminating(service *v1.Service, address string) bool {
+	if !kd.ServingTerminatingEndpoints {
+		return false
+	}
+	kd.terminatingLock.RLock()
+	defer kd.terminatingLock.RUnlock()
+	for _, conditions := range kd.terminatingEndpoints[service.Namespace+"/"+service.Name] {
+		if conditions.serving.Has(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// publishedAddresses returns the addresses of subset that get records: the
+// ready ones, and the not ready ones if the service publishes them or they
+// are terminating but still serving. The other not ready addresses are
+// returned as unpublished.
+func (kd *KubeDNS) publishedAddresses(service *v1.Service, subset *v1.EndpointSubset) (published []*v1.EndpointAddress, unpublished []string) {
+	for i := range subset.Addresses {
+		published = append(published, &subset.Addresses[i])
+	}
+	for i := range subset.NotReadyAddresses {
+		address := &subset.NotReadyAddresses[i]
+		if service.Spec.PublishNotReadyAddresses || kd.isServingTerminating(service, address.IP) {
+			published = append(published, address)
+		} else {
+			unpublished = append(unpublished, address.IP)
+		}
+	}
+	return published, unpublished
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newEndpointSlice(serviceName string, terminating map[string]bool) *discovery.EndpointSlice {
+	slice := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      serviceName + "-abcde",
+			Namespace: testNamespace,
+			Labels:    map[string]string{discovery.LabelServiceName: serviceName},
+		},
+		AddressType: discovery.AddressTypeIPv4,
+	}
+	for ip, isTerminating := range terminating {
+		isTerminating := isTerminating
+		slice.Endpoints = append(slice.Endpoints, discovery.Endpoint{
+			Addresses:  []string{ip},
+			Conditions: discovery.EndpointConditions{Terminating: &isTerminating},
+		})
+	}
+	return slice
+}
+
+func TestDropTerminatingEndpoints(t *testing.T) {
+	kd := newKubeDNS()
+	kd.DropTerminatingEndpoints = true
+
+	s := newHeadlessService()
+	require.NoError(t, kd.servicesStore.Add(s))
+	e := newEndpoints(s, newSubsetWithOnePortWithHostname("", 80, true, "10.0.0.1", "10.0.0.2"))
+	require.NoError(t, kd.endpointsStore.Add(e))
+	kd.handleEndpointAdd(e)
+	assertDNSForHeadlessService(t, kd, e)
+
+	// 10.0.0.2 starts terminating, it is dropped along with its PTR record.
+	slice := newEndpointSlice(s.Name, map[string]bool{"10.0.0.1": false, "10.0.0.2": true})
+	kd.handleEndpointSliceAdd(slice)
+	records, err := kd.Records(getServiceFQDN(kd.domain, s), false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, "10.0.0.1", records[0].Host)
+	assert.Nil(t, kd.ipShards.reverseRecord("10.0.0.2"))
+	assert.NotNil(t, kd.ipShards.reverseRecord("10.0.0.1"))
+
+	// Deleting the slice restores the endpoint.
+	kd.handleEndpointSliceDelete(cache.DeletedFinalStateUnknown{Key: "default/" + slice.Name, Obj: slice})
+	assertDNSForHeadlessService(t, kd, e)
+	assertReverseDNSForNamedHeadlessService(t, kd, e)
+}
+
+func TestTerminatingEndpointsDisabled(t *testing.T) {
+	kd := newKubeDNS()
+
+	s := newHeadlessService()
+	require.NoError(t, kd.servicesStore.Add(s))
+	e := newEndpoints(s, newSubsetWithOnePort("", 80, "10.0.0.1", "10.0.0.2"))
+	require.NoError(t, kd.endpointsStore.Add(e))
+	kd.handleEndpointSliceAdd(newEndpointSlice(s.Name, map[string]bool{"10.0.0.2": true}))
+	kd.handleEndpointAdd(e)
+	assertDNSForHeadlessService(t, kd, e)
+}
+
+func TestPublishNotReadyAddresses(t *testing.T) {
+	kd := newKubeDNS()
+	kd.DropTerminatingEndpoints = true
+
+	s := newHeadlessService()
+	s.Spec.PublishNotReadyAddresses = true
+	require.NoError(t, kd.servicesStore.Add(s))
+	subset := newSubsetWithOnePortWithHostname("", 80, true, "10.0.0.1")
+	subset.NotReadyAddresses = []v1.EndpointAddress{{IP: "10.0.0.2", Hostname: "ep-1"}}
+	e := newEndpoints(s, subset)
+	require.NoError(t, kd.endpointsStore.Add(e))
+	kd.handleEndpointAdd(e)
+	// Terminating endpoints are kept as well.
+	kd.handleEndpointSliceAdd(newEndpointSlice(s.Name, map[string]bool{"10.0.0.2": true}))
+
+	assert.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.2"}, recordHosts(t, kd, getServiceFQDN(kd.domain, s)))
+	assert.NotNil(t, kd.ipShards.reverseRecord("10.0.0.2"))
+
+	kd.handleEndpointDelete(e)
+	assert.Nil(t, kd.ipShards.reverseRecord("10.0.0.2"))
+}
+
+func TestServingTerminatingEndpoints(t *testing.T) {
+	kd := newKubeDNS()
+	kd.ServingTerminatingEndpoints = true
+
+	s := newHeadlessService()
+	require.NoError(t, kd.servicesStore.Add(s))
+	subset := newSubsetWithOnePortWithHostname("", 80, true, "10.0.0.1")
+	subset.NotReadyAddresses = []v1.EndpointAddress{{IP: "10.0.0.2", Hostname: "ep-1"}, {IP: "10.0.0.3", Hostname: "ep-2"}}
+	e := newEndpoints(s, subset)
+	require.NoError(t, kd.endpointsStore.Add(e))
+	kd.handleEndpointAdd(e)
+	assert.Equal(t, []string{"10.0.0.1"}, recordHosts(t, kd, getServiceFQDN(kd.domain, s)))
+
+	// 10.0.0.2 is terminating but still serving, 10.0.0.3 is not ready.
+	terminating, serving, notServing := true, true, false
+	slice := newEndpointSlice(s.Name, nil)
+	slice.Endpoints = []discovery.Endpoint{
+		{Addresses: []string{"10.0.0.2"}, Conditions: discovery.EndpointConditions{Terminating: &terminating, Serving: &serving}},
+		{Addresses: []string{"10.0.0.3"}, Conditions: discovery.EndpointConditions{Serving: &notServing}},
+	}
+	kd.handleEndpointSliceAdd(slice)
+	assert.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.2"}, recordHosts(t, kd, getServiceFQDN(kd.domain, s)))
+	assert.NotNil(t, kd.ipShards.reverseRecord("10.0.0.2"))
+
+	// Once it stops serving, it is dropped along with its PTR record.
+	slice.Endpoints[0].Conditions.Serving = &notServing
+	kd.handleEndpointSliceUpdate(nil, slice)
+	assert.Equal(t, []string{"10.0.0.1"}, recordHosts(t, kd, getServiceFQDN(kd.domain, s)))
+	assert.Nil(t, kd.ipShards.reverseRecord("10.0.0.2"))
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/miekg/dns"
+	discovery "k8s.io/api/discovery/v1"
+)
+
+// endpointLocation is where an endpoint address runs, as reported by its
+// EndpointSlice.
+type endpointLocation struct {
+	// slice is the namespace/name of the slice reporting the address.
+	slice    string
+	node     string
+	zone     string
+	forZones []string
+}
+
+// endpointTopology maps endpoint addresses to their location. The zone of
+// a node is learned from the endpoints running on it, so the zone of a node
+// running no endpoint is unknown.
+type endpointTopology struct {
+	lock sync.RWMutex
+	// slices maps a slice namespace/name to the addresses it reports.
+	slices    map[string][]string
+	addresses map[string]endpointLocation
+	nodeZones map[string]string
+}
+
+func newEndpointTopology() *endpointTopology {
+	return &endpointTopology{
+		slices:    make(map[string][]string),
+		addresses: make(map[string]endpointLocation),
+		nodeZones: make(map[string]string),
+	}
+}
+
+// setSlice records the location of the endpoints of slice, nil to forget
+// the slice with the given key.
+func (t *endpointTopology) setSlice(key string, slice *discovery.EndpointSlice) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, address := range t.slices[key] {
+		if t.addresses[address].slice == key {
+			delete(t.addresses, address)
+		}
+	}
+	delete(t.slices, key)
+	if slice == nil {
+		return
+	}
+
+	var addresses []string
+	for _, endpoint := range slice.Endpoints {
+		location := endpointLocation{slice: key}
+		if endpoint.NodeName != nil {
+			location.node = *endpoint.NodeName
+		}
+		if endpoint.Zone != nil {
+			location.zone = *endpoint.Zone
+		}
+		if location.node != "" && location.zone != "" {
+			t.nodeZones[location.node] = location.zone
+		}
+		if endpoint.Hints != nil {
+			for _, forZone := range endpoint.Hints.ForZones {
+				location.forZones = append(location.forZones, forZone.Name)
+			}
+		}
+		for _, address := range endpoint.Addresses {
+			t.addresses[address] = location
+			addresses = append(addresses, address)
+		}
+	}
+	if len(addresses) > 0 {
+		t.slices[key] = addresses
+	}
+}
+
+// sort keeps the records hinted for zone, if every endpoint in answer has
+// hints and some are for zone, then orders the endpoints on node first and
+// those in zone next. Records that are not endpoints, e.g. ClusterIPs, are
+// kept in place relative to each other, after the preferred endpoints.
+func (t *endpointTopology) sort(node string, answer []dns.RR) []dns.RR {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	zone := t.nodeZones[node]
+
+	locations := make([]endpointLocation, len(answer))
+	known := make([]bool, len(answer))
+	hinted, allHinted := false, true
+	for i, rr := range answer {
+		locations[i], known[i] = t.addresses[recordAddress(rr)]
+		if !known[i] {
+			continue
+		}
+		if len(locations[i].forZones) == 0 {
+			allHinted = false
+		}
+		for _, forZone := range locations[i].forZones {
+			if zone != "" && forZone == zone {
+				hinted = true
+			}
+		}
+	}
+
+	if hinted && allHinted {
+		filtered := make([]dns.RR, 0, len(answer))
+		filteredLocations := make([]endpointLocation, 0, len(answer))
+		filteredKnown := make([]bool, 0, len(answer))
+		for i, rr := range answer {
+			if known[i] && !containsString(locations[i].forZones, zone) {
+				continue
+			}
+			filtered = append(filtered, rr)
+			filteredLocations = append(filteredLocations, locations[i])
+			filteredKnown = append(filteredKnown, known[i])
+		}
+		answer, locations, known = filtered, filteredLocations, filteredKnown
+	}
+
+	rank := func(i int) int {
+		switch {
+		case !known[i]:
+			return 2
+		case node != "" && locations[i].node == node:
+			return 0
+		case zone != "" && locations[i].zone == zone:
+			return 1
+		default:
+			return 2
+		}
+	}
+	ranks := make([]int, len(answer))
+	for i := range answer {
+		ranks[i] = rank(i)
+	}
+	sort.Stable(byRank{answer, ranks})
+	return answer
+}
+
+type byRank struct {
+	rrs   []dns.RR
+	ranks []int
+}
+
+func (b byRank) Len() int           { return len(b.rrs) }
+func (b byRank) Less(i, j int) bool { return b.ranks[i] < b.ranks[j] }
+func (b byRank) Swap(i, j int) {
+	b.rrs[i], b.rrs[j] = b.rrs[j], b.rrs[i]
+	b.ranks[i], b.ranks[j] = b.ranks[j], b.ranks[i]
+}
+
+func recordAddress(rr dns.RR) string {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A.String()
+	case *dns.AAAA:
+		return rr.AAAA.String()
+	}
+	return ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SortAnswers filters and orders the address records answered to a client
+// by topology when TopologyAwareAnswers is set: the endpoints hinted for the
+// zone of the client are kept when the EndpointSlices carry hints, and the
+// endpoints on the node of the client, then in its zone, come first. The
+// client is found through the PodIndex, by its address or the single address
+// of the EDNS Client Subnet of its query, e.g. set by a node-local cache;
+// answers to clients that are not pods are left as is. The answers depend on
+// the client once its address is looked up, even if it is not a pod, not
+// when the subnet is wider than an address. It is a server.AnswerSorter.
+func (kd *KubeDNS) SortAnswers(remote net.Addr, answer []dns.RR) ([]dns.RR, bool) {
+	if !kd.TopologyAwareAnswers || kd.PodIndex == nil {
+		return answer, false
+	}
+	var ip net.IP
+	switch addr := remote.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.IPNet:
+		if ones, bits := addr.Mask.Size(); ones != bits {
+			return answer, false
+		}
+		ip = addr.IP
+	default:
+		return answer, false
+	}
+	pod, ok := kd.PodIndex.Lookup(ip.String())
+	if !ok || pod.Node == "" {
+		return answer, true
+	}
+	return kd.topology.sort(pod.Node, answer), true
+}
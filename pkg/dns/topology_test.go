@@ -0,0 +1,151 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"k8s.io/dns/pkg/dns/podindex"
+)
+
+// topologyEndpoint returns an endpoint on node in zone, hinted for forZones.
+func topologyEndpoint(ip, node, zone string, forZones ...string) discovery.Endpoint {
+	endpoint := discovery.Endpoint{
+		Addresses: []string{ip},
+		NodeName:  &node,
+		Zone:      &zone,
+	}
+	if len(forZones) > 0 {
+		endpoint.Hints = &discovery.EndpointHints{}
+		for _, forZone := range forZones {
+			endpoint.Hints.ForZones = append(endpoint.Hints.ForZones, discovery.ForZone{Name: forZone})
+		}
+	}
+	return endpoint
+}
+
+func addressRecords(ips ...string) []dns.RR {
+	var rrs []dns.RR
+	for _, ip := range ips {
+		rrs = append(rrs, &dns.A{Hdr: dns.RR_Header{Name: "a.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP(ip)})
+	}
+	return rrs
+}
+
+func recordAddresses(rrs []dns.RR) []string {
+	var ips []string
+	for _, rr := range rrs {
+		ips = append(ips, recordAddress(rr))
+	}
+	return ips
+}
+
+func TestEndpointTopologySort(t *testing.T) {
+	topology := newEndpointTopology()
+	topology.setSlice("default/a", &discovery.EndpointSlice{Endpoints: []discovery.Endpoint{
+		topologyEndpoint("10.0.0.1", "node1", "zone-a"),
+		topologyEndpoint("10.0.0.2", "node2", "zone-a"),
+		topologyEndpoint("10.0.0.3", "node3", "zone-b"),
+	}})
+	topology.setSlice("default/b", &discovery.EndpointSlice{Endpoints: []discovery.Endpoint{
+		topologyEndpoint("10.0.1.1", "node1", "zone-a", "zone-a"),
+		topologyEndpoint("10.0.1.2", "node3", "zone-b", "zone-b"),
+		topologyEndpoint("10.0.1.3", "node4", "zone-b", "zone-a"),
+	}})
+
+	// Without hints, the endpoints are ordered by proximity.
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.1", "10.0.0.3"},
+		recordAddresses(topology.sort("node2", addressRecords("10.0.0.3", "10.0.0.2", "10.0.0.1"))))
+	assert.Equal(t, []string{"10.0.0.3", "10.0.0.1", "10.0.0.2"},
+		recordAddresses(topology.sort("node4", addressRecords("10.0.0.1", "10.0.0.2", "10.0.0.3"))))
+	// Addresses that are not endpoints come last.
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "1.2.3.4"},
+		recordAddresses(topology.sort("node1", addressRecords("1.2.3.4", "10.0.0.2", "10.0.0.1"))))
+
+	// With hints, only the endpoints hinted for the zone of the client are kept.
+	assert.Equal(t, []string{"10.0.1.1", "10.0.1.3"},
+		recordAddresses(topology.sort("node2", addressRecords("10.0.1.1", "10.0.1.2", "10.0.1.3"))))
+	// Hints are ignored unless every endpoint has some.
+	assert.Equal(t, []string{"10.0.1.1", "10.0.0.2", "10.0.1.2"},
+		recordAddresses(topology.sort("node1", addressRecords("10.0.1.2", "10.0.0.2", "10.0.1.1"))))
+
+	// Deleting a slice forgets its endpoints.
+	topology.setSlice("default/a", nil)
+	assert.Equal(t, []string{"10.0.0.3", "10.0.0.1"},
+		recordAddresses(topology.sort("node1", addressRecords("10.0.0.3", "10.0.0.1"))))
+}
+
+func TestSortAnswers(t *testing.T) {
+	kd := newKubeDNS()
+	kd.topology = newEndpointTopology()
+	kd.TopologyAwareAnswers = true
+	kd.PodIndex = podindex.NewPodIndex(fake.NewSimpleClientset(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "client", Namespace: "default"},
+		Spec:       v1.PodSpec{NodeName: "node2"},
+		Status:     v1.PodStatus{Phase: v1.PodRunning, PodIP: "10.0.2.1"},
+	}), 0)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go kd.PodIndex.Run(stopCh)
+	require.True(t, cache.WaitForCacheSync(stopCh, kd.PodIndex.HasSynced))
+
+	slice := newEndpointSlice(testService, nil)
+	slice.Endpoints = []discovery.Endpoint{
+		topologyEndpoint("10.0.0.1", "node1", "zone-a"),
+		topologyEndpoint("10.0.0.2", "node2", "zone-a"),
+	}
+	kd.handleEndpointSliceAdd(slice)
+
+	sortAnswers := func(remote net.Addr) ([]string, bool) {
+		answer, byClient := kd.SortAnswers(remote, addressRecords("10.0.0.1", "10.0.0.2"))
+		return recordAddresses(answer), byClient
+	}
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.2.1"), Port: 53}
+	addresses, byClient := sortAnswers(client)
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.1"}, addresses)
+	assert.True(t, byClient)
+	// Forwarded by a node-local cache, with the address of the client.
+	subnet := &net.IPNet{IP: net.ParseIP("10.0.2.1").To4(), Mask: net.CIDRMask(32, 32)}
+	addresses, byClient = sortAnswers(subnet)
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.1"}, addresses)
+	assert.True(t, byClient)
+	// The wider subnets are not sorted for, the answer does not depend on
+	// them.
+	subnet.Mask = net.CIDRMask(24, 32)
+	addresses, byClient = sortAnswers(subnet)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, addresses)
+	assert.False(t, byClient)
+	// Clients that are not pods get the answer as is.
+	other := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 53}
+	addresses, byClient = sortAnswers(other)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, addresses)
+	assert.True(t, byClient)
+
+	kd.handleEndpointSliceDelete(slice)
+	addresses, _ = sortAnswers(client)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, addresses)
+}
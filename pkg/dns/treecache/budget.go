@@ -0,0 +1,48 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package treecache
+
+import "time"
+
+// budgetCheckInterval is the number of positions a wildcard expands to
+// between two readings of the clock.
+const budgetCheckInterval = 64
+
+// walkBudget bounds the time the wildcards of a query are expanded for, so
+// that a query matching most of the names, e.g. *.*.svc.cluster.local,
+// does not hold the server for long.
+type walkBudget struct {
+	// deadline past which the wildcards are no longer expanded, none if
+	// zero.
+	deadline time.Time
+	steps    int
+	exceeded bool
+}
+
+// spend counts n positions found through a wildcard, and returns whether
+// the budget is exceeded.
+func (b *walkBudget) spend(n int) bool {
+	if b.exceeded || b.deadline.IsZero() {
+		return b.exceeded
+	}
+	before := b.steps
+	b.steps += n
+	if b.steps/budgetCheckInterval != before/budgetCheckInterval && time.Now().After(b.deadline) {
+		b.exceeded = true
+	}
+	return b.exceeded
+}
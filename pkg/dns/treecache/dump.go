@@ -0,0 +1,127 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package treecache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// Format is a format a cache can be dumped in.
+type Format string
+
+const (
+	// FormatTree is the tree of the cache, as serialized by Serialize.
+	FormatTree Format = "tree"
+	// FormatZone is an RFC 1035 zone file, one resource record per line.
+	FormatZone Format = "zone"
+	// FormatJSON is a JSON list of the resource records.
+	FormatJSON Format = "json"
+)
+
+// ErrUnknownFormat is returned by Dump for a format it does not know.
+var ErrUnknownFormat = errors.New("unknown format")
+
+// Record is a resource record of a cache dumped in FormatJSON.
+type Record struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	// Data is the rdata in presentation format, e.g. the priority, weight,
+	// port and target of an SRV record.
+	Data string `json:"data"`
+}
+
+// ResourceRecords returns the resource records the entries of cache are
+// answered as, in the order of Range: an A or AAAA record for an entry whose
+// host is an IP, an SRV record for an entry with a port and a CNAME record
+// otherwise, plus a TXT or MX record for the entries with a text or marked
+// as mail.
+func ResourceRecords(cache TreeCache) []dns.RR {
+	var records []dns.RR
+	cache.Range(func(fqdn string, services []*skymsg.Service) bool {
+		for _, service := range services {
+			records = append(records, resourceRecords(fqdn, service)...)
+		}
+		return true
+	})
+	return records
+}
+
+func resourceRecords(fqdn string, service *skymsg.Service) []dns.RR {
+	var records []dns.RR
+	if service.Mail {
+		records = append(records, service.NewMX(fqdn))
+	} else if ip := net.ParseIP(service.Host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			records = append(records, service.NewA(fqdn, ip4))
+		} else {
+			records = append(records, service.NewAAAA(fqdn, ip))
+		}
+	} else if service.Port > 0 {
+		records = append(records, service.NewSRV(fqdn, uint16(service.Weight)))
+	} else if service.Host != "" {
+		records = append(records, service.NewCNAME(fqdn, dns.Fqdn(service.Host)))
+	}
+	if service.Text != "" {
+		records = append(records, service.NewTXT(fqdn))
+	}
+	return records
+}
+
+// Dump writes cache to w in format.
+func Dump(w io.Writer, cache TreeCache, format Format) error {
+	switch format {
+	case FormatTree:
+		serialized, err := cache.Serialize()
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, serialized)
+		return err
+	case FormatZone:
+		for _, rr := range ResourceRecords(cache) {
+			if _, err := fmt.Fprintln(w, rr.String()); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatJSON:
+		records := []Record{}
+		for _, rr := range ResourceRecords(cache) {
+			header := rr.Header()
+			records = append(records, Record{
+				Name: header.Name,
+				Type: dns.TypeToString[header.Rrtype],
+				TTL:  header.Ttl,
+				Data: strings.TrimPrefix(rr.String(), header.String()),
+			})
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "\t")
+		return encoder.Encode(records)
+	}
+	return fmt.Errorf("%w %q, must be %s, %s or %s", ErrUnknownFormat, format, FormatTree, FormatZone, FormatJSON)
+}
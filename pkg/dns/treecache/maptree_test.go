@@ -0,0 +1,306 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package treecache
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// treeCache is a TreeCache of nested maps, a node per label. It was the
+// implementation of NewTreeCache until the radix tree, which the tests and
+// benchmarks compare it to. It is kept as simple as possible rather than
+// fast.
+type treeCache struct {
+	ChildNodes map[string]*treeCache
+	Entries    map[string]interface{}
+}
+
+func newMapTreeCache() *treeCache {
+	return &treeCache{
+		ChildNodes: make(map[string]*treeCache),
+		Entries:    make(map[string]interface{}),
+	}
+}
+
+func (cache *treeCache) Serialize() (string, error) {
+	prettyJSON, err := json.MarshalIndent(cache, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	return string(prettyJSON), nil
+}
+
+func (cache *treeCache) Snapshot() TreeCache {
+	snapshot := newMapTreeCache()
+	for key, value := range cache.Entries {
+		snapshot.Entries[key] = value
+	}
+	for key, node := range cache.ChildNodes {
+		snapshot.ChildNodes[key] = node.Snapshot().(*treeCache)
+	}
+	return snapshot
+}
+
+func (cache *treeCache) SetEntry(key string, val *skymsg.Service, fqdn string, path ...string) {
+	// TODO: Consolidate setEntry and setSubCache into a single method with a
+	// type switch.
+	// TODO: Instead of passing the fqdn as an argument, we can reconstruct
+	// it from the path, provided callers always pass the full path to the
+	// object. This is currently *not* the case, since callers first create
+	// a new, empty node, populate it, then parent it under the right path.
+	// So we don't know the full key till the final parenting operation.
+	node := cache.ensureChildNode(path...)
+
+	// This key is used to construct the "target" for SRV record lookups.
+	// For normal service/endpoint lookups, this will result in a key like:
+	// /skydns/local/cluster/svc/svcNS/svcName/record-hash
+	// but for headless services that govern pods requesting a specific
+	// hostname (as used by petset), this will end up being:
+	// /skydns/local/cluster/svc/svcNS/svcName/pod-hostname
+	val.Key = skymsg.Path(fqdn)
+	node.Entries[key] = val
+}
+
+func (cache *treeCache) getSubCache(path ...string) *treeCache {
+	childCache := cache
+	for _, subpath := range path {
+		childCache = childCache.ChildNodes[subpath]
+		if childCache == nil {
+			return nil
+		}
+	}
+	return childCache
+}
+
+func (cache *treeCache) SetSubCache(key string, subCache TreeCache, path ...string) {
+	node := cache.ensureChildNode(path...)
+	node.ChildNodes[key] = subCache.(*treeCache)
+}
+
+func (cache *treeCache) GetEntry(key string, path ...string) (interface{}, bool) {
+	childNode := cache.getSubCache(path...)
+	if childNode == nil {
+		return nil, false
+	}
+	val, ok := childNode.Entries[key]
+	return val, ok
+}
+
+// exploreBuffer holds the results of explore.
+type exploreBuffer struct {
+	nodes   []*treeCache
+	entries []*skymsg.Service
+	// partial is set if the deadline of explore passed before the
+	// wildcards were expanded.
+	partial bool
+}
+
+// explore returns the entries path, which may include wildcards, ends on,
+// and the nodes whose entries it matches. Past deadline, unless zero, the
+// wildcards are no longer expanded.
+func (cache *treeCache) explore(path []string, deadline time.Time) *exploreBuffer {
+	budget := walkBudget{deadline: deadline}
+	var entries []*skymsg.Service
+	nodesToExplore := []*treeCache{cache}
+	var nextNodesToExplore []*treeCache
+	for idx, subpath := range path {
+		nextNodesToExplore = nextNodesToExplore[:0]
+		if idx == len(path)-1 {
+			// if path ends on an entry, instead of a child node, add the entry
+			for _, node := range nodesToExplore {
+				if subpath == "*" {
+					nextNodesToExplore = append(nextNodesToExplore, node)
+				} else {
+					if val, ok := node.Entries[subpath]; ok {
+						entries = append(entries, val.(*skymsg.Service))
+					} else {
+						childNode := node.ChildNodes[subpath]
+						if childNode != nil {
+							nextNodesToExplore = append(nextNodesToExplore, childNode)
+						}
+					}
+				}
+			}
+			nodesToExplore, nextNodesToExplore = nextNodesToExplore, nodesToExplore
+			break
+		}
+
+		if subpath == "*" {
+			for _, node := range nodesToExplore {
+				for subkey, subnode := range node.ChildNodes {
+					if !strings.HasPrefix(subkey, "_") && !budget.spend(1) {
+						nextNodesToExplore = append(nextNodesToExplore, subnode)
+					}
+				}
+			}
+		} else {
+			for _, node := range nodesToExplore {
+				childNode := node.ChildNodes[subpath]
+				if childNode != nil {
+					nextNodesToExplore = append(nextNodesToExplore, childNode)
+				}
+			}
+		}
+		nodesToExplore, nextNodesToExplore = nextNodesToExplore, nodesToExplore
+	}
+	return &exploreBuffer{nodes: nodesToExplore, entries: entries, partial: budget.exceeded}
+}
+
+// count returns the number of values explored.
+func (buf *exploreBuffer) count() int {
+	count := len(buf.entries)
+	for _, node := range buf.nodes {
+		count += len(node.Entries)
+	}
+	return count
+}
+
+func (cache *treeCache) GetValuesForPathWithWildcards(path ...string) []*skymsg.Service {
+	buf := cache.explore(path, time.Time{})
+
+	retval := make([]*skymsg.Service, 0, buf.count())
+	retval = append(retval, buf.entries...)
+	for _, node := range buf.nodes {
+		for _, val := range node.Entries {
+			retval = append(retval, val.(*skymsg.Service))
+		}
+	}
+	return retval
+}
+
+func (cache *treeCache) AppendValuesForPathWithWildcards(dst []skymsg.Service, path ...string) []skymsg.Service {
+	dst, _ = cache.AppendValuesForPathWithDeadline(dst, time.Time{}, path...)
+	return dst
+}
+
+func (cache *treeCache) AppendValuesForPathWithDeadline(dst []skymsg.Service, deadline time.Time, path ...string) ([]skymsg.Service, bool) {
+	buf := cache.explore(path, deadline)
+
+	if n := len(dst) + buf.count(); n > cap(dst) {
+		grown := make([]skymsg.Service, len(dst), n)
+		copy(grown, dst)
+		dst = grown
+	}
+	for _, val := range buf.entries {
+		dst = append(dst, *val)
+	}
+	for _, node := range buf.nodes {
+		for _, val := range node.Entries {
+			dst = append(dst, *val.(*skymsg.Service))
+		}
+	}
+	return dst, buf.partial
+}
+
+func (cache *treeCache) DeletePath(path ...string) bool {
+	if len(path) == 0 {
+		return false
+	}
+	if parentNode := cache.getSubCache(path[:len(path)-1]...); parentNode != nil {
+		name := path[len(path)-1]
+		if _, ok := parentNode.ChildNodes[name]; ok {
+			delete(parentNode.ChildNodes, name)
+			return true
+		}
+		// ExternalName services are stored with their name as the leaf key
+		if _, ok := parentNode.Entries[name]; ok {
+			delete(parentNode.Entries, name)
+			return true
+		}
+	}
+	return false
+}
+
+func (cache *treeCache) HasPath(path ...string) bool {
+	if len(path) == 0 {
+		return true
+	}
+	parentNode := cache.getSubCache(path[:len(path)-1]...)
+	if parentNode == nil {
+		return false
+	}
+	name := path[len(path)-1]
+	_, node := parentNode.ChildNodes[name]
+	_, entry := parentNode.Entries[name]
+	return node || entry
+}
+
+func (cache *treeCache) ensureChildNode(path ...string) *treeCache {
+	childNode := cache
+	for _, subpath := range path {
+		newNode, ok := childNode.ChildNodes[subpath]
+		if !ok {
+			newNode = newMapTreeCache()
+			childNode.ChildNodes[subpath] = newNode
+		}
+		childNode = newNode
+	}
+	return childNode
+}
+
+func (cache *treeCache) Range(fn func(fqdn string, services []*skymsg.Service) bool) {
+	cache.walk(nil, fn)
+}
+
+func (cache *treeCache) walk(path []string, fn func(fqdn string, services []*skymsg.Service) bool) bool {
+	if len(cache.Entries) > 0 {
+		keys := make([]string, 0, len(cache.Entries))
+		for key := range cache.Entries {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		services := make([]*skymsg.Service, 0, len(keys))
+		for _, key := range keys {
+			services = append(services, cache.Entries[key].(*skymsg.Service))
+		}
+		if !fn(pathName(path), services) {
+			return false
+		}
+	}
+	labels := make([]string, 0, len(cache.ChildNodes))
+	for label := range cache.ChildNodes {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		if !cache.ChildNodes[label].walk(append(path[:len(path):len(path)], label), fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// mapTx writes to a copy of the nested maps, which Commit then makes the
+// cache.
+type mapTx struct {
+	*treeCache
+	base *treeCache
+}
+
+func (cache *treeCache) Begin() Transaction {
+	return &mapTx{treeCache: cache.Snapshot().(*treeCache), base: cache}
+}
+
+func (tx *mapTx) Commit() TreeCache {
+	*tx.base = *tx.treeCache
+	return tx.base
+}
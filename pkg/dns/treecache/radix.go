@@ -0,0 +1,627 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package treecache
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// maxSortedChildren is the number of edges, or entries, a node keeps in a
+// sorted slice. Past it they move to a map, like the larger node kinds of
+// an adaptive radix tree: most nodes have a handful of children, a few,
+// such as the namespaces and services, have thousands.
+const maxSortedChildren = 16
+
+// radixTree is a TreeCache storing the paths, reversed FQDNs, in a radix
+// tree of labels. A chain of nodes without entries, nor other children, is
+// collapsed into a single edge, e.g. local.cluster.svc.<namespace> for a
+// namespace alone in the cluster, and split when the paths diverge.
+// Nothing is merged back on deletion, the empty nodes remain.
+//
+// Subtrees may be shared: SetSubCache inserts the same subtree under the
+// names of a service and of its aliases. The labels are thus held by the
+// edges, not by the nodes they lead to.
+//
+// The tree is copy-on-write. A node is only modified by the tree that owns
+// it, the one that created it since its last Snapshot; the others, shared
+// with snapshots or grafted subtrees, are copied first along with the path
+// to them. Snapshots thus never change, and can be read without locks
+// while the tree is written.
+type radixTree struct {
+	root  *radixNode
+	owner *radixOwner
+}
+
+// radixOwner identifies the nodes a tree may modify in place.
+type radixOwner struct {
+	// A field, so that each owner has a distinct address.
+	_ byte
+}
+
+type radixNode struct {
+	owner *radixOwner
+	// edges are sorted by their first label, nil once edgeMap holds them.
+	edges   []radixEdge
+	edgeMap map[string]radixEdge
+	// entries are sorted by key, nil once entryMap holds them.
+	entries  []radixEntry
+	entryMap map[string]interface{}
+	// wildcard holds the *radixWildcardIndex of the node, built by the
+	// first wildcard query and dropped by the writes below the node.
+	wildcard atomic.Value
+}
+
+type radixEdge struct {
+	// labels from the node to child, at least one.
+	labels []string
+	child  *radixNode
+}
+
+type radixEntry struct {
+	key   string
+	value interface{}
+}
+
+// NewTreeCache returns an empty TreeCache.
+func NewTreeCache() TreeCache {
+	owner := &radixOwner{}
+	return &radixTree{root: &radixNode{owner: owner}, owner: owner}
+}
+
+// newNode returns an empty node of the tree.
+func (tree *radixTree) newNode() *radixNode {
+	return &radixNode{owner: tree.owner}
+}
+
+// writable returns node if the tree owns it, otherwise a copy of it that
+// the tree owns.
+func (tree *radixTree) writable(node *radixNode) *radixNode {
+	if node.owner == tree.owner {
+		return node
+	}
+	c := &radixNode{owner: tree.owner}
+	if node.edgeMap != nil {
+		c.edgeMap = make(map[string]radixEdge, len(node.edgeMap))
+		for label, e := range node.edgeMap {
+			c.edgeMap[label] = e
+		}
+	} else {
+		c.edges = append([]radixEdge(nil), node.edges...)
+	}
+	if node.entryMap != nil {
+		c.entryMap = make(map[string]interface{}, len(node.entryMap))
+		for key, value := range node.entryMap {
+			c.entryMap[key] = value
+		}
+	} else {
+		c.entries = append([]radixEntry(nil), node.entries...)
+	}
+	return c
+}
+
+// Snapshot returns a copy of the tree, in constant time: the nodes are
+// shared, and copied by the first write of either tree.
+func (tree *radixTree) Snapshot() TreeCache {
+	tree.owner = &radixOwner{}
+	return &radixTree{root: tree.root, owner: &radixOwner{}}
+}
+
+func (node *radixNode) edge(label string) (radixEdge, bool) {
+	if node.edgeMap != nil {
+		e, ok := node.edgeMap[label]
+		return e, ok
+	}
+	for _, e := range node.edges {
+		if e.labels[0] >= label {
+			return e, e.labels[0] == label
+		}
+	}
+	return radixEdge{}, false
+}
+
+// putEdge adds e, replacing the edge with the same first label.
+func (node *radixNode) putEdge(e radixEdge) {
+	label := e.labels[0]
+	if node.edgeMap != nil {
+		node.edgeMap[label] = e
+		return
+	}
+	i := 0
+	for i < len(node.edges) && node.edges[i].labels[0] < label {
+		i++
+	}
+	if i < len(node.edges) && node.edges[i].labels[0] == label {
+		node.edges[i] = e
+		return
+	}
+	if len(node.edges) == maxSortedChildren {
+		node.edgeMap = make(map[string]radixEdge, 2*maxSortedChildren)
+		for _, e := range node.edges {
+			node.edgeMap[e.labels[0]] = e
+		}
+		node.edgeMap[label] = e
+		node.edges = nil
+		return
+	}
+	node.edges = append(node.edges, radixEdge{})
+	copy(node.edges[i+1:], node.edges[i:])
+	node.edges[i] = e
+}
+
+func (node *radixNode) deleteEdge(label string) bool {
+	if node.edgeMap != nil {
+		_, ok := node.edgeMap[label]
+		delete(node.edgeMap, label)
+		return ok
+	}
+	for i, e := range node.edges {
+		if e.labels[0] == label {
+			copy(node.edges[i:], node.edges[i+1:])
+			node.edges[len(node.edges)-1] = radixEdge{}
+			node.edges = node.edges[:len(node.edges)-1]
+			return true
+		}
+	}
+	return false
+}
+
+func (node *radixNode) entry(key string) (interface{}, bool) {
+	if node.entryMap != nil {
+		value, ok := node.entryMap[key]
+		return value, ok
+	}
+	for _, e := range node.entries {
+		if e.key >= key {
+			return e.value, e.key == key
+		}
+	}
+	return nil, false
+}
+
+// putEntry sets the entry with the given key.
+func (node *radixNode) putEntry(key string, value interface{}) {
+	if node.entryMap != nil {
+		node.entryMap[key] = value
+		return
+	}
+	i := 0
+	for i < len(node.entries) && node.entries[i].key < key {
+		i++
+	}
+	if i < len(node.entries) && node.entries[i].key == key {
+		node.entries[i].value = value
+		return
+	}
+	if len(node.entries) == maxSortedChildren {
+		node.entryMap = make(map[string]interface{}, 2*maxSortedChildren)
+		for _, e := range node.entries {
+			node.entryMap[e.key] = e.value
+		}
+		node.entryMap[key] = value
+		node.entries = nil
+		return
+	}
+	node.entries = append(node.entries, radixEntry{})
+	copy(node.entries[i+1:], node.entries[i:])
+	node.entries[i] = radixEntry{key: key, value: value}
+}
+
+func (node *radixNode) deleteEntry(key string) bool {
+	if node.entryMap != nil {
+		_, ok := node.entryMap[key]
+		delete(node.entryMap, key)
+		return ok
+	}
+	for i, e := range node.entries {
+		if e.key == key {
+			copy(node.entries[i:], node.entries[i+1:])
+			node.entries[len(node.entries)-1] = radixEntry{}
+			node.entries = node.entries[:len(node.entries)-1]
+			return true
+		}
+	}
+	return false
+}
+
+func (node *radixNode) entryCount() int {
+	if node.entryMap != nil {
+		return len(node.entryMap)
+	}
+	return len(node.entries)
+}
+
+// appendEntries appends the values of the entries to dst.
+func (node *radixNode) appendEntries(dst []*skymsg.Service) []*skymsg.Service {
+	if node.entryMap != nil {
+		for _, value := range node.entryMap {
+			dst = append(dst, value.(*skymsg.Service))
+		}
+		return dst
+	}
+	for _, e := range node.entries {
+		dst = append(dst, e.value.(*skymsg.Service))
+	}
+	return dst
+}
+
+// commonPrefix returns the number of leading labels a and b have in common.
+func commonPrefix(a, b []string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// ensureChildNode returns the node at path, writable, creating it and
+// splitting the edge the path leaves if needed.
+func (tree *radixTree) ensureChildNode(path ...string) *radixNode {
+	tree.root = tree.writable(tree.root)
+	node := tree.root
+	for len(path) > 0 {
+		node.dropWildcardIndex()
+		e, ok := node.edge(path[0])
+		if !ok {
+			// The labels are copied, callers reuse the arrays of their
+			// paths.
+			child := tree.newNode()
+			node.putEdge(radixEdge{labels: append([]string(nil), path...), child: child})
+			return child
+		}
+		n := commonPrefix(e.labels, path)
+		if n < len(e.labels) {
+			mid := tree.newNode()
+			mid.putEdge(radixEdge{labels: e.labels[n:], child: e.child})
+			e = radixEdge{labels: e.labels[:n:n], child: mid}
+			node.putEdge(e)
+		} else if child := tree.writable(e.child); child != e.child {
+			e.child = child
+			node.putEdge(e)
+		}
+		node, path = e.child, path[n:]
+	}
+	node.dropWildcardIndex()
+	return node
+}
+
+// getSubCache returns the node at path, nil if there is none.
+func (node *radixNode) getSubCache(path ...string) *radixNode {
+	for len(path) > 0 {
+		e, ok := node.edge(path[0])
+		if !ok || commonPrefix(e.labels, path) != len(e.labels) {
+			return nil
+		}
+		node, path = e.child, path[len(e.labels):]
+	}
+	return node
+}
+
+func (tree *radixTree) SetEntry(key string, val *skymsg.Service, fqdn string, path ...string) {
+	// See TreeCache.SetEntry for the Key.
+	val.Key = skymsg.Path(fqdn)
+	tree.ensureChildNode(path...).putEntry(key, val)
+}
+
+// SetSubCache inserts the root of subCache. Both trees share its nodes from
+// then on, and copy them to write them.
+func (tree *radixTree) SetSubCache(key string, subCache TreeCache, path ...string) {
+	sub := subCache.(*radixTree)
+	sub.owner = &radixOwner{}
+	tree.ensureChildNode(path...).putEdge(radixEdge{labels: []string{key}, child: sub.root})
+}
+
+func (tree *radixTree) GetEntry(key string, path ...string) (interface{}, bool) {
+	childNode := tree.root.getSubCache(path...)
+	if childNode == nil {
+		return nil, false
+	}
+	return childNode.entry(key)
+}
+
+func (tree *radixTree) DeletePath(path ...string) bool {
+	if len(path) == 0 || !tree.root.hasPath(path) {
+		return false
+	}
+	parentPath, name := path[:len(path)-1], path[len(path)-1]
+	tree.root = tree.writable(tree.root)
+	node := tree.root
+	for len(parentPath) > 0 {
+		node.dropWildcardIndex()
+		e, _ := node.edge(parentPath[0])
+		n := commonPrefix(e.labels, parentPath)
+		if n < len(e.labels) {
+			// The parent is within the edge, its only child is the next
+			// label of the edge. Deleting it cuts the edge there.
+			node.putEdge(radixEdge{labels: e.labels[:n:n], child: tree.newNode()})
+			return true
+		}
+		if child := tree.writable(e.child); child != e.child {
+			e.child = child
+			node.putEdge(e)
+		}
+		node, parentPath = e.child, parentPath[n:]
+	}
+	node.dropWildcardIndex()
+	// ExternalName services are stored with their name as the leaf key.
+	return node.deleteEdge(name) || node.deleteEntry(name)
+}
+
+func (tree *radixTree) HasPath(path ...string) bool {
+	return tree.root.hasPath(path)
+}
+
+// hasPath returns whether there is a child node or an entry at path.
+func (node *radixNode) hasPath(path []string) bool {
+	for len(path) > 0 {
+		e, ok := node.edge(path[0])
+		if !ok {
+			return len(path) == 1 && node.hasEntry(path[0])
+		}
+		n := commonPrefix(e.labels, path)
+		if n < len(e.labels) {
+			// The path ends within the edge, or leaves it.
+			return n == len(path)
+		}
+		node, path = e.child, path[n:]
+	}
+	return true
+}
+
+func (node *radixNode) hasEntry(key string) bool {
+	_, ok := node.entry(key)
+	return ok
+}
+
+// radixCursor is a position in the tree: the labels left on the way to
+// node, none if at node.
+type radixCursor struct {
+	node *radixNode
+	rest []string
+	// ahead is set if the cursor already matched the label of the step,
+	// found through a wildcard index along with the wildcard before it.
+	ahead bool
+}
+
+// radixExploreBuffers holds the scratch slices of explore, so that queries
+// do not allocate them.
+var radixExploreBuffers = sync.Pool{New: func() interface{} { return new(radixExploreBuffer) }}
+
+type radixExploreBuffer struct {
+	cursors, nextCursors []radixCursor
+	entries              []*skymsg.Service
+	// used is the number of cursors explore used in either slice.
+	used int
+	// partial is set if the deadline of explore passed before the
+	// wildcards were expanded.
+	partial bool
+}
+
+// release drops the references of the buffer, the nodes and entries may be
+// deleted from the cache meanwhile, and returns it to the pool. Only the
+// cursors used are cleared, the others already are.
+func (buf *radixExploreBuffer) release() {
+	clearCursors(buf.cursors, buf.used)
+	clearCursors(buf.nextCursors, buf.used)
+	for i := range buf.entries {
+		buf.entries[i] = nil
+	}
+	buf.cursors, buf.nextCursors, buf.entries, buf.used, buf.partial = buf.cursors[:0], buf.nextCursors[:0], buf.entries[:0], 0, false
+	radixExploreBuffers.Put(buf)
+}
+
+// clearCursors clears the first n cursors of the array of cursors.
+func clearCursors(cursors []radixCursor, n int) {
+	cursors = cursors[:cap(cursors)]
+	if len(cursors) > n {
+		cursors = cursors[:n]
+	}
+	for i := range cursors {
+		cursors[i] = radixCursor{}
+	}
+}
+
+// explore returns the entries path, which may include wildcards, ends on,
+// and the positions whose entries it matches, in a buffer to be released.
+// A wildcard matches every label but those of the SRV records, prefixed
+// with "_", and a trailing one the entries of the node. A wildcard
+// followed by a label is looked up in the wildcard index of the node, in
+// a single step, rather than walking all its children.
+//
+// Past deadline, unless zero, the wildcards are no longer expanded: the
+// positions found so far are followed to the end of path, and the buffer
+// is marked partial.
+func (node *radixNode) explore(path []string, deadline time.Time) *radixExploreBuffer {
+	buf := radixExploreBuffers.Get().(*radixExploreBuffer)
+	budget := walkBudget{deadline: deadline}
+	entries := buf.entries
+	cursors := append(buf.cursors, radixCursor{node: node})
+	next := buf.nextCursors
+	buf.used = 1
+	for idx, label := range path {
+		last := idx == len(path)-1
+		if last && label == "*" {
+			break
+		}
+		next = next[:0]
+		for _, c := range cursors {
+			if c.ahead {
+				next = append(next, radixCursor{node: c.node, rest: c.rest})
+				continue
+			}
+			if len(c.rest) > 0 {
+				if c.rest[0] == label || label == "*" && !strings.HasPrefix(c.rest[0], "_") && !budget.spend(1) {
+					next = append(next, radixCursor{node: c.node, rest: c.rest[1:]})
+				}
+				continue
+			}
+			if label == "*" && budget.exceeded {
+				continue
+			}
+			if label == "*" && path[idx+1] != "*" {
+				index := c.node.wildcardIndex()
+				if idx+1 == len(path)-1 {
+					next = append(next, index.last[path[idx+1]]...)
+					entries = append(entries, index.entries[path[idx+1]]...)
+					budget.spend(len(index.last[path[idx+1]]) + len(index.entries[path[idx+1]]))
+				} else {
+					next = append(next, index.positions[path[idx+1]]...)
+					budget.spend(len(index.positions[path[idx+1]]))
+				}
+				continue
+			}
+			if label == "*" {
+				if c.node.edgeMap != nil {
+					for first, e := range c.node.edgeMap {
+						if !strings.HasPrefix(first, "_") {
+							if budget.spend(1) {
+								break
+							}
+							next = append(next, radixCursor{node: e.child, rest: e.labels[1:]})
+						}
+					}
+				} else {
+					for _, e := range c.node.edges {
+						if !strings.HasPrefix(e.labels[0], "_") {
+							if budget.spend(1) {
+								break
+							}
+							next = append(next, radixCursor{node: e.child, rest: e.labels[1:]})
+						}
+					}
+				}
+				continue
+			}
+			if last {
+				// if path ends on an entry, instead of a child node, add
+				// the entry
+				if value, ok := c.node.entry(label); ok {
+					entries = append(entries, value.(*skymsg.Service))
+					continue
+				}
+			}
+			if e, ok := c.node.edge(label); ok {
+				next = append(next, radixCursor{node: e.child, rest: e.labels[1:]})
+			}
+		}
+		if len(next) > buf.used {
+			buf.used = len(next)
+		}
+		cursors, next = next, cursors
+	}
+	buf.cursors, buf.nextCursors, buf.entries, buf.partial = cursors, next, entries, budget.exceeded
+	return buf
+}
+
+// count returns the number of values explored.
+func (buf *radixExploreBuffer) count() int {
+	count := len(buf.entries)
+	for _, c := range buf.cursors {
+		if len(c.rest) == 0 {
+			count += c.node.entryCount()
+		}
+	}
+	return count
+}
+
+func (tree *radixTree) GetValuesForPathWithWildcards(path ...string) []*skymsg.Service {
+	buf := tree.root.explore(path, time.Time{})
+	defer buf.release()
+
+	retval := make([]*skymsg.Service, 0, buf.count())
+	retval = append(retval, buf.entries...)
+	for _, c := range buf.cursors {
+		if len(c.rest) == 0 {
+			retval = c.node.appendEntries(retval)
+		}
+	}
+	return retval
+}
+
+func (tree *radixTree) AppendValuesForPathWithWildcards(dst []skymsg.Service, path ...string) []skymsg.Service {
+	dst, _ = tree.AppendValuesForPathWithDeadline(dst, time.Time{}, path...)
+	return dst
+}
+
+func (tree *radixTree) AppendValuesForPathWithDeadline(dst []skymsg.Service, deadline time.Time, path ...string) ([]skymsg.Service, bool) {
+	buf := tree.root.explore(path, deadline)
+	defer buf.release()
+
+	if n := len(dst) + buf.count(); n > cap(dst) {
+		grown := make([]skymsg.Service, len(dst), n)
+		copy(grown, dst)
+		dst = grown
+	}
+	for _, val := range buf.entries {
+		dst = append(dst, *val)
+	}
+	for _, c := range buf.cursors {
+		if len(c.rest) > 0 {
+			continue
+		}
+		if c.node.entryMap != nil {
+			for _, value := range c.node.entryMap {
+				dst = append(dst, *value.(*skymsg.Service))
+			}
+		} else {
+			for _, e := range c.node.entries {
+				dst = append(dst, *e.value.(*skymsg.Service))
+			}
+		}
+	}
+	return dst, buf.partial
+}
+
+// Serialize dumps the cache in the format of the nested maps, a node per
+// label.
+func (tree *radixTree) Serialize() (string, error) {
+	prettyJSON, err := json.MarshalIndent(tree.root.serialized(), "", "\t")
+	if err != nil {
+		return "", err
+	}
+	return string(prettyJSON), nil
+}
+
+func (node *radixNode) serialized() *serializedNode {
+	serialized := newSerializedNode()
+	if node.entryMap != nil {
+		for key, value := range node.entryMap {
+			serialized.Entries[key] = value.(*skymsg.Service)
+		}
+	}
+	for _, e := range node.entries {
+		serialized.Entries[e.key] = e.value.(*skymsg.Service)
+	}
+	addEdge := func(e radixEdge) {
+		parent := serialized.ensureChildNode(e.labels[:len(e.labels)-1]...)
+		parent.ChildNodes[e.labels[len(e.labels)-1]] = e.child.serialized()
+	}
+	if node.edgeMap != nil {
+		for _, e := range node.edgeMap {
+			addEdge(e)
+		}
+	}
+	for _, e := range node.edges {
+		addEdge(e)
+	}
+	return serialized
+}
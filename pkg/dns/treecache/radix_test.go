@@ -0,0 +1,403 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package treecache
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// hostsOf returns the sorted hosts of values.
+func hostsOf(values []*msg.Service) []string {
+	hosts := make([]string, 0, len(values))
+	for _, value := range values {
+		hosts = append(hosts, value.Host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// TestRadixTreeCacheMatchesMaps applies the same random operations to the
+// radix tree and to the nested maps, and checks that they answer the same.
+func TestRadixTreeCacheMatchesMaps(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	// The labels of the second level are more than maxSortedChildren, so
+	// that nodes move their children to maps.
+	labels := [][]string{{"a", "b"}, {}, {"c", "_tcp", "d"}, {"e", "f"}}
+	for i := 0; i < 2*maxSortedChildren; i++ {
+		labels[1] = append(labels[1], "n"+strconv.Itoa(i))
+	}
+	randomPath := func(wildcards bool) []string {
+		path := make([]string, rnd.Intn(len(labels)+1))
+		for i := range path {
+			path[i] = labels[i][rnd.Intn(len(labels[i]))]
+			if wildcards && rnd.Intn(4) == 0 {
+				path[i] = "*"
+			}
+		}
+		return path
+	}
+	randomKey := func() string {
+		return []string{"k1", "k2", "e", "f", "c"}[rnd.Intn(5)]
+	}
+
+	radix, maps := NewTreeCache(), TreeCache(newMapTreeCache())
+	host := 0
+	newServices := func() (*msg.Service, *msg.Service) {
+		host++
+		return &msg.Service{Host: strconv.Itoa(host)}, &msg.Service{Host: strconv.Itoa(host)}
+	}
+	for i := 0; i < 5000; i++ {
+		switch op := rnd.Intn(10); {
+		case op < 5:
+			key, path := randomKey(), randomPath(false)
+			radixValue, mapValue := newServices()
+			radix.SetEntry(key, radixValue, key, path...)
+			maps.SetEntry(key, mapValue, key, path...)
+		case op < 7:
+			// The same subtree is inserted under two keys, as for the
+			// aliases of a service.
+			radixSub, mapSub := NewTreeCache(), TreeCache(newMapTreeCache())
+			for j := rnd.Intn(4); j >= 0; j-- {
+				key, path := randomKey(), randomPath(false)
+				radixValue, mapValue := newServices()
+				radixSub.SetEntry(key, radixValue, key, path...)
+				mapSub.SetEntry(key, mapValue, key, path...)
+			}
+			// The nested maps share the subtree, where the radix tree
+			// copies it on write: they are given a copy for each key.
+			path := randomPath(false)
+			for _, key := range []string{randomKey(), randomKey()} {
+				radix.SetSubCache(key, radixSub, path...)
+				maps.SetSubCache(key, mapSub.Snapshot(), path...)
+			}
+		default:
+			path := randomPath(false)
+			if got, want := radix.DeletePath(path...), maps.DeletePath(path...); got != want {
+				t.Fatalf("step %d: DeletePath(%v) = %v, want %v", i, path, got, want)
+			}
+		}
+
+		for j := 0; j < 10; j++ {
+			key, path := randomKey(), randomPath(false)
+			got, gotOK := radix.GetEntry(key, path...)
+			want, wantOK := maps.GetEntry(key, path...)
+			if gotOK != wantOK || gotOK && got.(*msg.Service).Host != want.(*msg.Service).Host {
+				t.Fatalf("step %d: GetEntry(%q, %v) = %v, %v, want %v, %v", i, key, path, got, gotOK, want, wantOK)
+			}
+			path = randomPath(true)
+			if got, want := hostsOf(radix.GetValuesForPathWithWildcards(path...)), hostsOf(maps.GetValuesForPathWithWildcards(path...)); !reflect.DeepEqual(got, want) {
+				t.Fatalf("step %d: GetValuesForPathWithWildcards(%v) = %v, want %v", i, path, got, want)
+			}
+		}
+	}
+
+	got, err := radix.Serialize()
+	if err != nil {
+		t.Fatalf("Serialize() = %v", err)
+	}
+	want, err := maps.Serialize()
+	if err != nil {
+		t.Fatalf("Serialize() = %v", err)
+	}
+	if got != want {
+		t.Errorf("Serialize() = %s, want %s", got, want)
+	}
+	if got, want := rangeOf(radix), rangeOf(maps); !reflect.DeepEqual(got, want) {
+		t.Errorf("Range() = %v, want %v", got, want)
+	}
+}
+
+func TestRadixTreeCacheSharedSubCache(t *testing.T) {
+	tc := NewTreeCache()
+	sub := NewTreeCache()
+	sub.SetEntry("1", &msg.Service{Host: "10.0.0.1"}, "1.web.default.svc.cluster.local.")
+	tc.SetSubCache("web", sub, "local", "cluster", "svc", "default")
+	tc.SetSubCache("www", sub, "local", "cluster", "svc", "default")
+
+	// Splitting the edges of the tree leaves the shared subtree alone, and
+	// the writes to a subtree once inserted are not seen by the tree.
+	tc.SetEntry("1", &msg.Service{Host: "10.0.0.2"}, "1.db.kube-system.svc.cluster.local.", "local", "cluster", "svc", "kube-system", "db")
+	sub.SetEntry("2", &msg.Service{Host: "10.0.0.3"}, "2.web.default.svc.cluster.local.")
+	tc.SetEntry("3", &msg.Service{Host: "10.0.0.4"}, "3.web.default.svc.cluster.local.", "local", "cluster", "svc", "default", "web")
+	for name, want := range map[string][]string{"web": {"10.0.0.1", "10.0.0.4"}, "www": {"10.0.0.1"}} {
+		values := tc.GetValuesForPathWithWildcards("local", "cluster", "svc", "default", name)
+		if got := hostsOf(values); !reflect.DeepEqual(got, want) {
+			t.Errorf("values of %s = %v, want %v", name, got, want)
+		}
+	}
+	if got := hostsOf(sub.GetValuesForPathWithWildcards()); !reflect.DeepEqual(got, []string{"10.0.0.1", "10.0.0.3"}) {
+		t.Errorf("values of the subtree = %v", got)
+	}
+	// The wildcard matches the namespace within the edge to db as well.
+	for name, want := range map[string][]string{"www": {"10.0.0.1"}, "db": {"10.0.0.2"}} {
+		values := tc.GetValuesForPathWithWildcards("local", "cluster", "svc", "*", name)
+		if got := hostsOf(values); !reflect.DeepEqual(got, want) {
+			t.Errorf("values of %s in every namespace = %v, want %v", name, got, want)
+		}
+	}
+
+	if !tc.DeletePath("local", "cluster", "svc", "default", "www") {
+		t.Fatal("should delete www")
+	}
+	if _, ok := tc.GetEntry("1", "local", "cluster", "svc", "default", "web"); !ok {
+		t.Error("should not affect web")
+	}
+}
+
+func TestRadixTreeCacheSnapshot(t *testing.T) {
+	tc := NewTreeCache()
+	tc.SetEntry("1", &msg.Service{Host: "10.0.0.1"}, "1.web.default.svc.cluster.local.", "local", "cluster", "svc", "default", "web")
+	snapshot := tc.Snapshot()
+	tc.SetEntry("2", &msg.Service{Host: "10.0.0.2"}, "2.web.default.svc.cluster.local.", "local", "cluster", "svc", "default", "web")
+	tc.SetEntry("1", &msg.Service{Host: "10.0.0.3"}, "1.db.default.svc.cluster.local.", "local", "cluster", "svc", "default", "db")
+	tc.DeletePath("local", "cluster", "svc", "default", "web", "1")
+
+	path := []string{"local", "cluster", "svc", "default", "*"}
+	if got := hostsOf(snapshot.GetValuesForPathWithWildcards(append(path[:4:4], "web")...)); !reflect.DeepEqual(got, []string{"10.0.0.1"}) {
+		t.Errorf("values of web in the snapshot = %v", got)
+	}
+	if _, ok := snapshot.GetEntry("1", "local", "cluster", "svc", "default", "db"); ok {
+		t.Error("db should not be in the snapshot")
+	}
+	if got := hostsOf(tc.GetValuesForPathWithWildcards(append(path[:4:4], "web")...)); !reflect.DeepEqual(got, []string{"10.0.0.2"}) {
+		t.Errorf("values of web = %v", got)
+	}
+
+	// Readers of the snapshots run along the writes to the tree.
+	var published atomic.Value
+	published.Store(tc.Snapshot())
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				published.Load().(TreeCache).AppendValuesForPathWithWildcards(nil, "local", "cluster", "svc", "*", "web")
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		tc.SetEntry(strconv.Itoa(i), &msg.Service{Host: "10.0.1.1"}, "web.default.svc.cluster.local.", "local", "cluster", "svc", "default", "web")
+		tc.DeletePath("local", "cluster", "svc", "default", "web", strconv.Itoa(i-10))
+		published.Store(tc.Snapshot())
+	}
+	wg.Wait()
+}
+
+func TestRadixTreeCacheWildcardIndex(t *testing.T) {
+	tc := NewTreeCache()
+	sub := NewTreeCache()
+	sub.SetEntry("1", &msg.Service{Host: "10.0.0.1"}, "web.default.svc.cluster.local.")
+	sub.SetEntry("1", &msg.Service{Host: "web.default.svc.cluster.local.", Port: 80}, "1._http._tcp.web.default.svc.cluster.local.", "_tcp", "_http")
+	tc.SetSubCache("web", sub, "local", "cluster", "svc", "default")
+
+	// The queries a service answers, as getEquivalentQueries of the
+	// package dns lists them.
+	queries := [][]string{
+		{"local", "cluster", "svc", "default", "web"},
+		{"local", "cluster", "*", "default", "web"},
+		{"local", "cluster", "svc", "*", "web"},
+		{"local", "cluster", "*", "*", "web"},
+		{"local", "cluster", "svc", "default", "web", "*"},
+	}
+	check := func(cache TreeCache, want []string) {
+		t.Helper()
+		for _, path := range queries {
+			if got := hostsOf(cache.GetValuesForPathWithWildcards(path...)); !reflect.DeepEqual(got, want) {
+				t.Errorf("values of %v = %v, want %v", path, got, want)
+			}
+		}
+	}
+	check(tc, []string{"10.0.0.1"})
+
+	// The indexes built by the queries are dropped by the writes below
+	// them, the snapshots keep theirs.
+	snapshot := tc.Snapshot()
+	tc.SetEntry("2", &msg.Service{Host: "10.0.0.2"}, "web.default.svc.cluster.local.", "local", "cluster", "svc", "default", "web")
+	check(tc, []string{"10.0.0.1", "10.0.0.2"})
+	check(snapshot, []string{"10.0.0.1"})
+	tc.SetEntry("1", &msg.Service{Host: "10.0.1.1"}, "web.team-a.svc.cluster.local.", "local", "cluster", "svc", "team-a", "web")
+	if got := hostsOf(tc.GetValuesForPathWithWildcards("local", "cluster", "svc", "*", "web")); !reflect.DeepEqual(got, []string{"10.0.0.1", "10.0.0.2", "10.0.1.1"}) {
+		t.Errorf("values of web in every namespace = %v", got)
+	}
+	if !tc.DeletePath("local", "cluster", "svc", "default", "web") {
+		t.Fatal("should delete web")
+	}
+	if got := hostsOf(tc.GetValuesForPathWithWildcards("local", "cluster", "svc", "*", "web")); !reflect.DeepEqual(got, []string{"10.0.1.1"}) {
+		t.Errorf("values of web in every namespace = %v", got)
+	}
+	check(snapshot, []string{"10.0.0.1"})
+
+	// The wildcard does not match the SRV labels, the label after it does.
+	for _, testCase := range []struct {
+		path []string
+		want []string
+	}{
+		{[]string{"local", "cluster", "svc", "default", "web", "*", "_http"}, nil},
+		{[]string{"local", "cluster", "*", "default", "web", "_tcp", "_http"}, []string{"web.default.svc.cluster.local."}},
+		{[]string{"local", "cluster", "svc", "*", "web", "_tcp", "_http"}, []string{"web.default.svc.cluster.local."}},
+	} {
+		got := hostsOf(snapshot.GetValuesForPathWithWildcards(testCase.path...))
+		if len(got) != len(testCase.want) || len(got) > 0 && !reflect.DeepEqual(got, testCase.want) {
+			t.Errorf("values of %v = %v, want %v", testCase.path, got, testCase.want)
+		}
+	}
+}
+
+func TestTreeCacheDeadline(t *testing.T) {
+	const services = 1000
+	for _, impl := range []struct {
+		name     string
+		newCache func() TreeCache
+	}{
+		{"radix", NewTreeCache},
+		{"maps", func() TreeCache { return newMapTreeCache() }},
+	} {
+		tc := newLargeTreeCache(impl.newCache, services, 10)
+		path := []string{"local", "cluster", "svc", "*", "*", "*"}
+
+		values, partial := tc.AppendValuesForPathWithDeadline(nil, time.Time{}, path...)
+		if partial || len(values) != services {
+			t.Errorf("%s: expected %d values without deadline, got %d, partial %v", impl.name, services, len(values), partial)
+		}
+		values, partial = tc.AppendValuesForPathWithDeadline(nil, time.Now().Add(time.Hour), path...)
+		if partial || len(values) != services {
+			t.Errorf("%s: expected %d values before the deadline, got %d, partial %v", impl.name, services, len(values), partial)
+		}
+		// Past the deadline, the values of the names found until the
+		// clock is read are returned.
+		values, partial = tc.AppendValuesForPathWithDeadline(nil, time.Now().Add(-time.Second), path...)
+		if !partial || len(values) == 0 || len(values) >= services {
+			t.Errorf("%s: expected part of the values past the deadline, got %d, partial %v", impl.name, len(values), partial)
+		}
+		// The names without wildcards are found whatever the deadline.
+		values, partial = tc.AppendValuesForPathWithDeadline(nil, time.Now().Add(-time.Second), "local", "cluster", "svc", "ns-2", "svc-42")
+		if partial || len(values) != 1 {
+			t.Errorf("%s: expected the value of svc-42 past the deadline, got %v, partial %v", impl.name, values, partial)
+		}
+	}
+}
+
+// newLargeTreeCache returns a cache of the given implementation with the
+// records of services, each in the namespace of its index modulo
+// namespaces, with a cluster IP and an SRV record.
+func newLargeTreeCache(newCache func() TreeCache, services, namespaces int) TreeCache {
+	tc := newCache()
+	for i := 0; i < services; i++ {
+		name, namespace := fmt.Sprintf("svc-%d", i), fmt.Sprintf("ns-%d", i%namespaces)
+		fqdn := name + "." + namespace + ".svc.cluster.local."
+		sub := newCache()
+		sub.SetEntry("1234", &msg.Service{Host: fmt.Sprintf("10.%d.%d.%d", i>>16&255, i>>8&255, i&255)}, fqdn)
+		sub.SetEntry("1234", &msg.Service{Host: fqdn, Port: 80}, "1234._http._tcp."+fqdn, "_tcp", "_http")
+		tc.SetSubCache(name, sub, "local", "cluster", "svc", namespace)
+	}
+	return tc
+}
+
+func BenchmarkTreeCacheLarge(b *testing.B) {
+	const services, namespaces = 10000, 100
+	for _, impl := range []struct {
+		name     string
+		newCache func() TreeCache
+	}{
+		{"radix", NewTreeCache},
+		{"maps", func() TreeCache { return newMapTreeCache() }},
+	} {
+		b.Run(impl.name+"/build", func(b *testing.B) {
+			b.ReportAllocs()
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			tc := newLargeTreeCache(impl.newCache, services, namespaces)
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			runtime.KeepAlive(tc)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				newLargeTreeCache(impl.newCache, services, namespaces)
+			}
+			// The heap the cache holds, once built.
+			b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/services, "heap-B/service")
+		})
+
+		tc := newLargeTreeCache(impl.newCache, services, namespaces)
+		for _, bm := range []struct {
+			name string
+			path []string
+		}{
+			{"service", []string{"local", "cluster", "svc", "ns-42", "svc-4242"}},
+			{"entry", []string{"local", "cluster", "svc", "ns-42", "svc-4242", "1234"}},
+			{"srv", []string{"local", "cluster", "svc", "ns-42", "svc-4242", "_tcp", "_http"}},
+			{"wildcard", []string{"local", "cluster", "svc", "*", "svc-4242"}},
+			{"missing", []string{"local", "cluster", "svc", "ns-42", "svc-missing"}},
+		} {
+			b.Run(impl.name+"/"+bm.name, func(b *testing.B) {
+				b.ReportAllocs()
+				var values []msg.Service
+				for i := 0; i < b.N; i++ {
+					values = tc.AppendValuesForPathWithWildcards(values[:0], bm.path...)
+				}
+			})
+		}
+	}
+}
+
+func TestEstimateSize(t *testing.T) {
+	tc := NewTreeCache()
+	empty := EstimateSize(tc)
+	if empty <= 0 {
+		t.Fatalf("expected the size of an empty cache to be positive, got %d", empty)
+	}
+
+	svc := &msg.Service{Host: "10.0.0.1"}
+	tc.SetEntry("key1", svc, "key1.web.default.svc.cluster.local.", "local", "cluster", "svc", "default", "web")
+	one := EstimateSize(tc)
+	if one <= empty+ServiceSize(svc) {
+		t.Errorf("expected an entry to add more than its record, %d, got %d", ServiceSize(svc), one-empty)
+	}
+
+	// A subtree under several names is counted once.
+	sub := NewTreeCache()
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("%d", i)
+		sub.SetEntry(key, &msg.Service{Host: "10.0.1.1"}, key+".headless.default.svc.cluster.local.")
+	}
+	tc.SetSubCache("headless", sub, "local", "cluster", "svc", "default")
+	withSub := EstimateSize(tc)
+	tc.SetSubCache("alias", sub, "local", "cluster", "svc", "default")
+	withAlias := EstimateSize(tc)
+	if withAlias-withSub >= (withSub-one)/10 {
+		t.Errorf("expected an alias to cost little, got %d for a subtree of %d", withAlias-withSub, withSub-one)
+	}
+
+	// Snapshots share the nodes of the cache.
+	snapshot := tc.Snapshot()
+	if EstimateSize(snapshot) != withAlias {
+		t.Errorf("expected the snapshot to have the size of the cache, %d, got %d", withAlias, EstimateSize(snapshot))
+	}
+}
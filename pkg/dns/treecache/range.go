@@ -0,0 +1,74 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package treecache
+
+import (
+	"sort"
+	"strings"
+
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// pathName returns the name of the node at path, e.g.
+// web.default.svc.cluster.local. for local, cluster, svc, default, web.
+func pathName(path []string) string {
+	labels := make([]string, len(path))
+	for i, label := range path {
+		labels[len(path)-1-i] = label
+	}
+	return strings.Join(labels, ".") + "."
+}
+
+func (tree *radixTree) Range(fn func(fqdn string, services []*skymsg.Service) bool) {
+	tree.root.walk(nil, fn)
+}
+
+// walk calls fn for node, at path, and the nodes below it, and returns
+// false once fn does.
+func (node *radixNode) walk(path []string, fn func(fqdn string, services []*skymsg.Service) bool) bool {
+	if node.entryCount() > 0 {
+		entries := node.entries
+		if node.entryMap != nil {
+			entries = make([]radixEntry, 0, len(node.entryMap))
+			for key, value := range node.entryMap {
+				entries = append(entries, radixEntry{key: key, value: value})
+			}
+			sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+		}
+		services := make([]*skymsg.Service, 0, len(entries))
+		for _, e := range entries {
+			services = append(services, e.value.(*skymsg.Service))
+		}
+		if !fn(pathName(path), services) {
+			return false
+		}
+	}
+	edges := node.edges
+	if node.edgeMap != nil {
+		edges = make([]radixEdge, 0, len(node.edgeMap))
+		for _, e := range node.edgeMap {
+			edges = append(edges, e)
+		}
+		sort.Slice(edges, func(i, j int) bool { return edges[i].labels[0] < edges[j].labels[0] })
+	}
+	for _, e := range edges {
+		if !e.child.walk(append(path[:len(path):len(path)], e.labels...), fn) {
+			return false
+		}
+	}
+	return true
+}
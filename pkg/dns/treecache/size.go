@@ -0,0 +1,101 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package treecache
+
+import (
+	"unsafe"
+
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// mapEntryOverhead estimates the bytes a map spends per entry besides its
+// key and value: the tophash, overflow pointers and the unused slots of
+// its buckets.
+const mapEntryOverhead = 16
+
+var (
+	stringSize   = int64(unsafe.Sizeof(""))
+	ifaceSize    = int64(unsafe.Sizeof(interface{}(nil)))
+	serviceSize  = int64(unsafe.Sizeof(skymsg.Service{}))
+	nodeSize     = int64(unsafe.Sizeof(radixNode{}))
+	edgeSize     = int64(unsafe.Sizeof(radixEdge{}))
+	entrySize    = int64(unsafe.Sizeof(radixEntry{}))
+	mapEntrySize = stringSize + ifaceSize + mapEntryOverhead
+)
+
+// EstimateSize returns an estimate of the bytes of memory held by cache:
+// its nodes, labels, keys and records. The nodes shared by several paths,
+// e.g. the records of a service and of its aliases, are counted once. The
+// nodes that cache shares with its snapshots are counted as well, as it
+// keeps them alive.
+func EstimateSize(cache TreeCache) int64 {
+	switch cache := cache.(type) {
+	case *radixTree:
+		return cache.root.estimateSize(make(map[*radixNode]struct{}))
+	}
+	return 0
+}
+
+// ServiceSize returns an estimate of the bytes of memory held by a record.
+func ServiceSize(svc *skymsg.Service) int64 {
+	return serviceSize + int64(len(svc.Host)+len(svc.Text)+len(svc.Group)+len(svc.Key))
+}
+
+// valueSize returns the size of the value of an entry.
+func valueSize(value interface{}) int64 {
+	if svc, ok := value.(*skymsg.Service); ok && svc != nil {
+		return ServiceSize(svc)
+	}
+	return 0
+}
+
+func (node *radixNode) estimateSize(seen map[*radixNode]struct{}) int64 {
+	if _, ok := seen[node]; ok {
+		return 0
+	}
+	seen[node] = struct{}{}
+	size := nodeSize
+	visit := func(e radixEdge) {
+		size += int64(cap(e.labels)) * stringSize
+		for _, label := range e.labels {
+			size += int64(len(label))
+		}
+		size += e.child.estimateSize(seen)
+	}
+	if node.edgeMap != nil {
+		for label, e := range node.edgeMap {
+			size += int64(len(label)) + stringSize + edgeSize + mapEntryOverhead
+			visit(e)
+		}
+	} else {
+		size += int64(cap(node.edges)) * edgeSize
+		for _, e := range node.edges {
+			visit(e)
+		}
+	}
+	if node.entryMap != nil {
+		for key, value := range node.entryMap {
+			size += int64(len(key)) + mapEntrySize + valueSize(value)
+		}
+	} else {
+		size += int64(cap(node.entries)) * entrySize
+		for _, e := range node.entries {
+			size += int64(len(e.key)) + valueSize(e.value)
+		}
+	}
+	return size
+}
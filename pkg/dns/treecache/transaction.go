@@ -0,0 +1,51 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package treecache
+
+// Transaction is a set of writes to a TreeCache, begun by its Begin, that
+// Commit applies at once. It reads as the cache with its writes applied,
+// while the cache itself is left unchanged until Commit.
+type Transaction interface {
+	TreeCache
+
+	// Commit applies the writes of the transaction to the cache it was
+	// begun on, and returns the cache. The transaction must not be used
+	// after.
+	Commit() TreeCache
+}
+
+// radixTx writes to a copy of the tree, sharing its nodes like a Snapshot
+// and copying them on write, which Commit then makes the tree.
+type radixTx struct {
+	*radixTree
+	base *radixTree
+}
+
+// Begin returns a transaction on the tree, in constant time. The tree must
+// not be written until the transaction is committed or dropped; dropping it
+// leaves the tree unchanged.
+func (tree *radixTree) Begin() Transaction {
+	return &radixTx{radixTree: &radixTree{root: tree.root, owner: &radixOwner{}}, base: tree}
+}
+
+func (tx *radixTx) Commit() TreeCache {
+	// The tree owns the nodes the transaction wrote from then on, and
+	// copies those it owned before, possibly still shared with tx, to
+	// write them.
+	tx.base.root, tx.base.owner = tx.root, tx.owner
+	return tx.base
+}
@@ -19,6 +19,7 @@ package treecache
 import (
 	"encoding/json"
 	"strings"
+	"time"
 
 	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
 )
@@ -30,6 +31,16 @@ type TreeCache interface {
 	// Get a list of values including wildcards labels (e.g. "*").
 	GetValuesForPathWithWildcards(path ...string) []*skymsg.Service
 
+	// AppendValuesForPathWithWildcards appends copies of the values
+	// GetValuesForPathWithWildcards returns to dst, growing it at most
+	// once, and returns the extended slice.
+	AppendValuesForPathWithWildcards(dst []skymsg.Service, path ...string) []skymsg.Service
+
+	// AppendValuesForPathWithDeadline is AppendValuesForPathWithWildcards
+	// giving up on expanding the wildcards once deadline passes. It then
+	// appends the values of the names found so far, and returns true.
+	AppendValuesForPathWithDeadline(dst []skymsg.Service, deadline time.Time, path ...string) ([]skymsg.Service, bool)
+
 	// SetEntry creates the entire path if it doesn't already exist in
 	// the cache, then sets the given service record under the given
 	// key. The path this entry would have occupied in an etcd datastore
@@ -43,171 +54,97 @@ type TreeCache interface {
 	// SetSubCache inserts the given subtree under the given
 	// path:key. Usually the key is the name of a Kubernetes Service,
 	// and the path maps to the cluster subdomains matching the Service.
+	// The writes to either of them after that may not be seen by the
+	// other.
 	SetSubCache(key string, subCache TreeCache, path ...string)
 
 	// DeletePath removes all entries associated with a given path.
 	DeletePath(path ...string) bool
 
+	// HasPath returns whether there is a node or an entry at path, i.e.
+	// whether its name exists, with or without records. The labels of
+	// path are not wildcards.
+	HasPath(path ...string) bool
+
 	// Serialize dumps a JSON representation of the cache.
 	Serialize() (string, error)
-}
-
-type treeCache struct {
-	ChildNodes map[string]*treeCache
-	Entries    map[string]interface{}
-}
-
-func NewTreeCache() TreeCache {
-	return &treeCache{
-		ChildNodes: make(map[string]*treeCache),
-		Entries:    make(map[string]interface{}),
-	}
-}
-
-func (cache *treeCache) Serialize() (string, error) {
-	prettyJSON, err := json.MarshalIndent(cache, "", "\t")
-	if err != nil {
-		return "", err
-	}
-	return string(prettyJSON), nil
-}
-
-func (cache *treeCache) SetEntry(key string, val *skymsg.Service, fqdn string, path ...string) {
-	// TODO: Consolidate setEntry and setSubCache into a single method with a
-	// type switch.
-	// TODO: Instead of passing the fqdn as an argument, we can reconstruct
-	// it from the path, provided callers always pass the full path to the
-	// object. This is currently *not* the case, since callers first create
-	// a new, empty node, populate it, then parent it under the right path.
-	// So we don't know the full key till the final parenting operation.
-	node := cache.ensureChildNode(path...)
-
-	// This key is used to construct the "target" for SRV record lookups.
-	// For normal service/endpoint lookups, this will result in a key like:
-	// /skydns/local/cluster/svc/svcNS/svcName/record-hash
-	// but for headless services that govern pods requesting a specific
-	// hostname (as used by petset), this will end up being:
-	// /skydns/local/cluster/svc/svcNS/svcName/pod-hostname
-	val.Key = skymsg.Path(fqdn)
-	node.Entries[key] = val
-}
 
-func (cache *treeCache) getSubCache(path ...string) *treeCache {
-	childCache := cache
-	for _, subpath := range path {
-		childCache = childCache.ChildNodes[subpath]
-		if childCache == nil {
-			return nil
-		}
-	}
-	return childCache
+	// Snapshot returns a copy of the cache, which the later writes to the
+	// cache do not change. The copy can thus be read while the cache is
+	// written, but not written itself meanwhile.
+	Snapshot() TreeCache
+
+	// Begin returns a transaction on the cache, whose writes are applied
+	// at once by its Commit, e.g. to replace all the records of a service
+	// without a snapshot ever holding part of them. The cache must not be
+	// written until then.
+	Begin() Transaction
+
+	// Range calls fn with the name of each node holding entries, e.g.
+	// web.default.svc.cluster.local., and their values sorted by key,
+	// until fn returns false. The nodes are visited depth first, their
+	// children in the order of their labels. The cache must not be written
+	// meanwhile: Range is meant for the snapshots, which never change, so
+	// that the callers see a consistent cache without holding its lock.
+	// The values must not be modified.
+	Range(fn func(fqdn string, services []*skymsg.Service) bool)
 }
 
-func (cache *treeCache) SetSubCache(key string, subCache TreeCache, path ...string) {
-	node := cache.ensureChildNode(path...)
-	node.ChildNodes[key] = subCache.(*treeCache)
+// serializedNode is a node of a cache serialized by Serialize.
+type serializedNode struct {
+	ChildNodes map[string]*serializedNode
+	Entries    map[string]*skymsg.Service
 }
 
-func (cache *treeCache) GetEntry(key string, path ...string) (interface{}, bool) {
-	childNode := cache.getSubCache(path...)
-	if childNode == nil {
-		return nil, false
+// Deserialize returns a new TreeCache holding the entries of a cache
+// serialized by Serialize. The fqdn of each entry is rebuilt from its path.
+func Deserialize(data []byte) (TreeCache, error) {
+	var root serializedNode
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, err
 	}
-	val, ok := childNode.Entries[key]
-	return val, ok
+	cache := NewTreeCache()
+	root.setEntries(cache, nil)
+	return cache, nil
 }
 
-func (cache *treeCache) GetValuesForPathWithWildcards(path ...string) []*skymsg.Service {
-	retval := []*skymsg.Service{}
-	nodesToExplore := []*treeCache{cache}
-	for idx, subpath := range path {
-		nextNodesToExplore := []*treeCache{}
-		if idx == len(path)-1 {
-			// if path ends on an entry, instead of a child node, add the entry
-			for _, node := range nodesToExplore {
-				if subpath == "*" {
-					nextNodesToExplore = append(nextNodesToExplore, node)
-				} else {
-					if val, ok := node.Entries[subpath]; ok {
-						retval = append(retval, val.(*skymsg.Service))
-					} else {
-						childNode := node.ChildNodes[subpath]
-						if childNode != nil {
-							nextNodesToExplore = append(nextNodesToExplore, childNode)
-						}
-					}
-				}
-			}
-			nodesToExplore = nextNodesToExplore
-			break
+func (node *serializedNode) setEntries(cache TreeCache, path []string) {
+	for key, val := range node.Entries {
+		if val == nil {
+			continue
 		}
-
-		if subpath == "*" {
-			for _, node := range nodesToExplore {
-				for subkey, subnode := range node.ChildNodes {
-					if !strings.HasPrefix(subkey, "_") {
-						nextNodesToExplore = append(nextNodesToExplore, subnode)
-					}
-				}
-			}
-		} else {
-			for _, node := range nodesToExplore {
-				childNode := node.ChildNodes[subpath]
-				if childNode != nil {
-					nextNodesToExplore = append(nextNodesToExplore, childNode)
-				}
-			}
+		labels := []string{key}
+		for i := len(path) - 1; i >= 0; i-- {
+			labels = append(labels, path[i])
 		}
-		nodesToExplore = nextNodesToExplore
+		cache.SetEntry(key, val, strings.Join(labels, ".")+".", path...)
 	}
-
-	for _, node := range nodesToExplore {
-		for _, val := range node.Entries {
-			retval = append(retval, val.(*skymsg.Service))
+	for label, child := range node.ChildNodes {
+		if child != nil {
+			child.setEntries(cache, append(path[:len(path):len(path)], label))
 		}
 	}
-	return retval
 }
 
-func (cache *treeCache) DeletePath(path ...string) bool {
-	if len(path) == 0 {
-		return false
-	}
-	if parentNode := cache.getSubCache(path[:len(path)-1]...); parentNode != nil {
-		name := path[len(path)-1]
-		if _, ok := parentNode.ChildNodes[name]; ok {
-			delete(parentNode.ChildNodes, name)
-			return true
-		}
-		// ExternalName services are stored with their name as the leaf key
-		if _, ok := parentNode.Entries[name]; ok {
-			delete(parentNode.Entries, name)
-			return true
-		}
-	}
-	return false
-}
-
-func (cache *treeCache) appendValues(recursive bool, ref [][]interface{}) {
-	for _, value := range cache.Entries {
-		ref[0] = append(ref[0], value)
-	}
-	if recursive {
-		for _, node := range cache.ChildNodes {
-			node.appendValues(recursive, ref)
-		}
+// newSerializedNode returns an empty node, serialized with empty maps rather
+// than null.
+func newSerializedNode() *serializedNode {
+	return &serializedNode{
+		ChildNodes: make(map[string]*serializedNode),
+		Entries:    make(map[string]*skymsg.Service),
 	}
 }
 
-func (cache *treeCache) ensureChildNode(path ...string) *treeCache {
-	childNode := cache
-	for _, subpath := range path {
-		newNode, ok := childNode.ChildNodes[subpath]
+// ensureChildNode returns the node at path below node, creating the nodes
+// missing.
+func (node *serializedNode) ensureChildNode(path ...string) *serializedNode {
+	for _, label := range path {
+		child, ok := node.ChildNodes[label]
 		if !ok {
-			newNode = NewTreeCache().(*treeCache)
-			childNode.ChildNodes[subpath] = newNode
+			child = newSerializedNode()
+			node.ChildNodes[label] = child
 		}
-		childNode = newNode
+		node = child
 	}
-	return childNode
+	return node
 }
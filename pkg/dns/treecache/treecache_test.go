@@ -17,6 +17,10 @@ limitations under the License.
 package treecache
 
 import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
 
 	"k8s.io/dns/third_party/forked/skydns/msg"
@@ -82,6 +86,11 @@ func TestTreeCache(t *testing.T) {
 			t.Fatalf("Expected %v services for path %v, got %v",
 				testCase.count, testCase.path, len(services))
 		}
+		values := tc.AppendValuesForPathWithWildcards([]msg.Service{{Host: "first"}}, testCase.path...)
+		if len(values) != testCase.count+1 || values[0].Host != "first" {
+			t.Fatalf("Expected %v values appended for path %v, got %v",
+				testCase.count, testCase.path, values)
+		}
 	}
 
 	// Delete some paths
@@ -130,6 +139,23 @@ func TestTreeCacheSetSubCache(t *testing.T) {
 	}
 }
 
+func TestTreeCacheHasPath(t *testing.T) {
+	for _, tc := range []TreeCache{NewTreeCache(), newMapTreeCache()} {
+		tc.SetEntry("key1", &msg.Service{}, "key1.p3.p2.p1.", "p1", "p2", "p3")
+		tc.SetEntry("leaf", &msg.Service{}, "leaf.p1.", "p1")
+		for _, path := range [][]string{{"p1"}, {"p1", "p2"}, {"p1", "p2", "p3"}, {"p1", "leaf"}} {
+			if !tc.HasPath(path...) {
+				t.Errorf("%T: expected %v to exist", tc, path)
+			}
+		}
+		for _, path := range [][]string{{"p2"}, {"p1", "p3"}, {"p1", "p2", "p3", "key1", "p4"}, {"p1", "leaf", "p2"}} {
+			if tc.HasPath(path...) {
+				t.Errorf("%T: expected %v not to exist", tc, path)
+			}
+		}
+	}
+}
+
 func TestTreeCacheSerialize(t *testing.T) {
 	tc := NewTreeCache()
 	tc.SetEntry("key1", &msg.Service{}, "key1.p2.p1.", "p1", "p2")
@@ -159,3 +185,240 @@ func TestTreeCacheSerialize(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, actual)
 	}
 }
+
+func TestTreeCacheDeserialize(t *testing.T) {
+	tc := NewTreeCache()
+	tc.SetEntry("key1", &msg.Service{Host: "10.0.0.1", Ttl: 30}, "key1.web.default.svc.cluster.local.",
+		"local", "cluster", "svc", "default", "web")
+	branch := NewTreeCache()
+	branch.SetEntry("key2", &msg.Service{Host: "10.0.0.2", Port: 80}, "key2._http._tcp.db.default.svc.cluster.local.",
+		"_tcp", "_http")
+	tc.SetSubCache("db", branch, "local", "cluster", "svc", "default")
+
+	serialized, err := tc.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deserialized, err := Deserialize([]byte(serialized))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := deserialized.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != serialized {
+		t.Errorf("expected %q, got %q", serialized, again)
+	}
+
+	for _, testCase := range []struct {
+		key  string
+		path []string
+		host string
+		etcd string
+	}{
+		{"key1", []string{"local", "cluster", "svc", "default", "web"}, "10.0.0.1", "/skydns/local/cluster/svc/default/web/key1"},
+		{"key2", []string{"local", "cluster", "svc", "default", "db", "_tcp", "_http"}, "10.0.0.2", "/skydns/local/cluster/svc/default/db/_tcp/_http/key2"},
+	} {
+		entry, ok := deserialized.GetEntry(testCase.key, testCase.path...)
+		if !ok {
+			t.Fatalf("entry %v %v should exist", testCase.path, testCase.key)
+		}
+		if svc := entry.(*msg.Service); svc.Host != testCase.host || svc.Key != testCase.etcd {
+			t.Errorf("expected host %v and key %v, got %+v", testCase.host, testCase.etcd, svc)
+		}
+	}
+
+	if _, err := Deserialize([]byte("not json")); err == nil {
+		t.Errorf("expected an error for invalid JSON")
+	}
+}
+
+// rangeOf returns the names Range calls its function with, each followed by
+// the hosts of its values, in order.
+func rangeOf(tc TreeCache) []string {
+	var names []string
+	tc.Range(func(fqdn string, services []*msg.Service) bool {
+		hosts := make([]string, 0, len(services))
+		for _, svc := range services {
+			hosts = append(hosts, svc.Host)
+		}
+		names = append(names, fqdn+"="+strings.Join(hosts, ","))
+		return true
+	})
+	return names
+}
+
+func TestTreeCacheRange(t *testing.T) {
+	for _, impl := range []struct {
+		name     string
+		newCache func() TreeCache
+	}{
+		{"radix", NewTreeCache},
+		{"maps", func() TreeCache { return newMapTreeCache() }},
+	} {
+		tc := impl.newCache()
+		tc.SetEntry("k2", &msg.Service{Host: "1"}, "k2.web.default.svc.cluster.local.", "local", "cluster", "svc", "default", "web")
+		tc.SetEntry("k1", &msg.Service{Host: "2"}, "k1.web.default.svc.cluster.local.", "local", "cluster", "svc", "default", "web")
+		tc.SetEntry("k3", &msg.Service{Host: "3"}, "k3.db.default.svc.cluster.local.", "local", "cluster", "svc", "default", "db")
+		sub := impl.newCache()
+		sub.SetEntry("k4", &msg.Service{Host: "4"}, "k4._http._tcp.api.default.svc.cluster.local.", "_tcp", "_http")
+		tc.SetSubCache("api", sub, "local", "cluster", "svc", "default")
+		tc.SetEntry("k5", &msg.Service{Host: "5"}, "k5.1-2-3-4.default.pod.cluster.local.", "local", "cluster", "pod", "default", "1-2-3-4")
+
+		snapshot := tc.Snapshot()
+		tc.DeletePath("local", "cluster", "svc", "default", "db")
+
+		// The values are sorted by key.
+		want := []string{
+			"1-2-3-4.default.pod.cluster.local.=5",
+			"_http._tcp.api.default.svc.cluster.local.=4",
+			"db.default.svc.cluster.local.=3",
+			"web.default.svc.cluster.local.=2,1",
+		}
+		if got := rangeOf(snapshot); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Range() = %v, want %v", impl.name, got, want)
+		}
+		want = append(want[:2], want[3:]...)
+		if got := rangeOf(tc); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Range() after DeletePath = %v, want %v", impl.name, got, want)
+		}
+
+		calls := 0
+		snapshot.Range(func(string, []*msg.Service) bool {
+			calls++
+			return false
+		})
+		if calls != 1 {
+			t.Errorf("%s: Range() called fn %d times after it returned false", impl.name, calls)
+		}
+	}
+}
+
+func TestTreeCacheTransaction(t *testing.T) {
+	for _, impl := range []struct {
+		name     string
+		newCache func() TreeCache
+	}{
+		{"radix", NewTreeCache},
+		{"maps", func() TreeCache { return newMapTreeCache() }},
+	} {
+		tc := impl.newCache()
+		tc.SetEntry("web", &msg.Service{Host: "10.0.0.1"}, "web.default.svc.cluster.local.", "local", "cluster", "svc", "default")
+		tc.SetEntry("db", &msg.Service{Host: "10.0.0.2"}, "db.default.svc.cluster.local.", "local", "cluster", "svc", "default")
+		before := rangeOf(tc)
+		snapshot := tc.Snapshot()
+
+		// The service becomes an ExternalName one.
+		tx := tc.Begin()
+		tx.DeletePath("local", "cluster", "svc", "default", "web")
+		tx.SetEntry("web", &msg.Service{Host: "example.com"}, "web.default.svc.cluster.local.", "local", "cluster", "svc", "default")
+		want := []string{"default.svc.cluster.local.=10.0.0.2,example.com"}
+		if got := rangeOf(tx); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Range() of the transaction = %v, want %v", impl.name, got, want)
+		}
+		if got := rangeOf(tc); !reflect.DeepEqual(got, before) {
+			t.Errorf("%s: Range() before Commit = %v, want %v", impl.name, got, before)
+		}
+
+		if committed := tx.Commit(); committed != tc {
+			t.Errorf("%s: Commit() = %v, want the cache", impl.name, committed)
+		}
+		if got := rangeOf(tc); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Range() after Commit = %v, want %v", impl.name, got, want)
+		}
+		if got := rangeOf(snapshot); !reflect.DeepEqual(got, before) {
+			t.Errorf("%s: Range() of the snapshot = %v, want %v", impl.name, got, before)
+		}
+
+		// A transaction dropped leaves the cache unchanged, and the writes
+		// after Commit do not change the snapshots.
+		snapshot = tc.Snapshot()
+		tc.Begin().DeletePath("local")
+		tc.SetEntry("api", &msg.Service{Host: "10.0.0.3"}, "api.default.svc.cluster.local.", "local", "cluster", "svc", "default")
+		if got := rangeOf(snapshot); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Range() of the snapshot after writes = %v, want %v", impl.name, got, want)
+		}
+		want = []string{"default.svc.cluster.local.=10.0.0.3,10.0.0.2,example.com"}
+		if got := rangeOf(tc); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Range() after a dropped transaction = %v, want %v", impl.name, got, want)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	tc := NewTreeCache()
+	tc.SetEntry("a", &msg.Service{Host: "10.0.0.1", Ttl: 30}, "a.web.default.svc.cluster.local.", "local", "cluster", "svc", "default", "web")
+	tc.SetEntry("b", &msg.Service{Host: "fd00::1", Ttl: 30}, "b.web.default.svc.cluster.local.", "local", "cluster", "svc", "default", "web")
+	tc.SetEntry("c", &msg.Service{Host: "web.default.svc.cluster.local.", Port: 80, Priority: 10, Weight: 100, Ttl: 30},
+		"c._http._tcp.web.default.svc.cluster.local.", "local", "cluster", "svc", "default", "web", "_tcp", "_http")
+	tc.SetEntry("d", &msg.Service{Host: "example.com", Ttl: 5}, "d.ext.default.svc.cluster.local.", "local", "cluster", "svc", "default", "ext")
+	tc.SetEntry("e", &msg.Service{Text: "v=1", Ttl: 60}, "e.txt.cluster.local.", "local", "cluster", "txt")
+
+	var zone strings.Builder
+	if err := Dump(&zone, tc, FormatZone); err != nil {
+		t.Fatalf("Dump(FormatZone) = %v", err)
+	}
+	want := "ext.default.svc.cluster.local.\t5\tIN\tCNAME\texample.com.\n" +
+		"web.default.svc.cluster.local.\t30\tIN\tA\t10.0.0.1\n" +
+		"web.default.svc.cluster.local.\t30\tIN\tAAAA\tfd00::1\n" +
+		"_http._tcp.web.default.svc.cluster.local.\t30\tIN\tSRV\t10 100 80 web.default.svc.cluster.local.\n" +
+		"txt.cluster.local.\t60\tIN\tTXT\t\"v=1\"\n"
+	if zone.String() != want {
+		t.Errorf("Dump(FormatZone) = %q, want %q", zone.String(), want)
+	}
+
+	var records strings.Builder
+	if err := Dump(&records, tc, FormatJSON); err != nil {
+		t.Fatalf("Dump(FormatJSON) = %v", err)
+	}
+	var got []Record
+	if err := json.Unmarshal([]byte(records.String()), &got); err != nil {
+		t.Fatalf("Dump(FormatJSON) = %q: %v", records.String(), err)
+	}
+	if len(got) != 5 {
+		t.Fatalf("Dump(FormatJSON) = %+v, want 5 records", got)
+	}
+	if want := (Record{Name: "_http._tcp.web.default.svc.cluster.local.", Type: "SRV", TTL: 30,
+		Data: "10 100 80 web.default.svc.cluster.local."}); got[3] != want {
+		t.Errorf("Dump(FormatJSON)[3] = %+v, want %+v", got[3], want)
+	}
+
+	if err := Dump(&records, tc, "xml"); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("Dump(xml) = %v, want ErrUnknownFormat", err)
+	}
+}
+
+func BenchmarkTreeCacheGetValues(b *testing.B) {
+	tc := NewTreeCache()
+	for _, ns := range []string{"default", "kube-system", "team-a"} {
+		for _, svc := range []string{"web", "db", "cache"} {
+			for _, key := range []string{"1", "2", "3"} {
+				tc.SetEntry(key, &msg.Service{Host: "10.0.0.1"}, key+"."+svc+"."+ns+".svc.cluster.local.",
+					"local", "cluster", "svc", ns, svc)
+			}
+		}
+	}
+	for _, bm := range []struct {
+		name string
+		path []string
+	}{
+		{"service", []string{"local", "cluster", "svc", "default", "web"}},
+		{"entry", []string{"local", "cluster", "svc", "default", "web", "1"}},
+		{"wildcard", []string{"local", "cluster", "svc", "*", "web"}},
+	} {
+		b.Run(bm.name+"/pointers", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				tc.GetValuesForPathWithWildcards(bm.path...)
+			}
+		})
+		b.Run(bm.name+"/values", func(b *testing.B) {
+			b.ReportAllocs()
+			var values []msg.Service
+			for i := 0; i < b.N; i++ {
+				values = tc.AppendValuesForPathWithWildcards(values[:0], bm.path...)
+			}
+		})
+	}
+}
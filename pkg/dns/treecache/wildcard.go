@@ -0,0 +1,113 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package treecache
+
+import (
+	"strings"
+
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// radixWildcardIndex aggregates the grandchildren of a node, so that a
+// wildcard followed by a label, e.g. the namespace in
+// <service>.*.svc.<domain>, is answered by a lookup rather than by walking
+// the children of the node.
+type radixWildcardIndex struct {
+	// positions the label leads to past the wildcard, with ahead set.
+	positions map[string][]radixCursor
+	// last holds the positions of a label ending the path: an entry of a
+	// child hides the node with the same label.
+	last map[string][]radixCursor
+	// entries the label ends on past the wildcard.
+	entries map[string][]*skymsg.Service
+}
+
+// noWildcardIndex is stored in place of the index of a node once dropped.
+var noWildcardIndex *radixWildcardIndex
+
+// wildcardIndex returns the index of the node, building it if the node has
+// none yet. The nodes of the snapshots are read concurrently: their index
+// may be built by several queries at once, which store the same one.
+func (node *radixNode) wildcardIndex() *radixWildcardIndex {
+	if index, _ := node.wildcard.Load().(*radixWildcardIndex); index != nil {
+		return index
+	}
+	index := &radixWildcardIndex{
+		positions: map[string][]radixCursor{},
+		last:      map[string][]radixCursor{},
+		entries:   map[string][]*skymsg.Service{},
+	}
+	add := func(e radixEdge) {
+		if strings.HasPrefix(e.labels[0], "_") {
+			return
+		}
+		if len(e.labels) > 1 {
+			index.add(e.labels[1], radixCursor{node: e.child, rest: e.labels[2:], ahead: true}, true)
+			return
+		}
+		child := e.child
+		child.forEachEdge(func(f radixEdge) {
+			index.add(f.labels[0], radixCursor{node: f.child, rest: f.labels[1:], ahead: true}, !child.hasEntry(f.labels[0]))
+		})
+		e.child.forEachEntry(func(key string, value interface{}) {
+			index.entries[key] = append(index.entries[key], value.(*skymsg.Service))
+		})
+	}
+	node.forEachEdge(add)
+	node.wildcard.Store(index)
+	return index
+}
+
+// add adds the position of label, if last to those of the paths it ends.
+func (index *radixWildcardIndex) add(label string, c radixCursor, last bool) {
+	index.positions[label] = append(index.positions[label], c)
+	if last {
+		index.last[label] = append(index.last[label], c)
+	}
+}
+
+// dropWildcardIndex drops the index of the node, about to be written or to
+// have a child or grandchild written.
+func (node *radixNode) dropWildcardIndex() {
+	if index, _ := node.wildcard.Load().(*radixWildcardIndex); index != nil {
+		node.wildcard.Store(noWildcardIndex)
+	}
+}
+
+func (node *radixNode) forEachEdge(f func(radixEdge)) {
+	if node.edgeMap != nil {
+		for _, e := range node.edgeMap {
+			f(e)
+		}
+		return
+	}
+	for _, e := range node.edges {
+		f(e)
+	}
+}
+
+func (node *radixNode) forEachEntry(f func(key string, value interface{})) {
+	if node.entryMap != nil {
+		for key, value := range node.entryMap {
+			f(key, value)
+		}
+		return
+	}
+	for _, e := range node.entries {
+		f(e.key, e.value)
+	}
+}
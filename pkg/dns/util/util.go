@@ -45,25 +45,40 @@ const (
 // into an IP address
 // Returns "", error if the reverseName is not a valid PTR lookup name
 func ExtractIP(reverseName string) (string, error) {
-	if strings.HasSuffix(reverseName, ArpaSuffix) {
-		ip, err := extractIPv4(strings.TrimSuffix(reverseName, ArpaSuffix))
+	lower := strings.ToLower(reverseName)
+	if strings.HasSuffix(lower, ArpaSuffix) {
+		ip, err := extractIPv4(strings.TrimSuffix(lower, ArpaSuffix))
 		if err != nil {
 			return "", fmt.Errorf("incorrect PTR IPv4 %q: %w", reverseName, err)
 		}
 		return ip, nil
 	}
 
-	if strings.HasSuffix(reverseName, ArpaSuffixV6) {
-		ip, err := extractIPv6(strings.TrimSuffix(reverseName, ArpaSuffixV6))
+	if strings.HasSuffix(lower, ArpaSuffixV6) {
+		ip, err := ExtractIPv6(reverseName)
 		if err != nil {
-			return "", fmt.Errorf("incorrect PTR IPv6 %q: %w", reverseName, err)
+			return "", err
 		}
-		return ip, nil
+		return ip.String(), nil
 	}
 
 	return "", fmt.Errorf("incorrect PTR: %q", reverseName)
 }
 
+// ExtractIPv6 turns an IPv6 PTR reverse record lookup name into an IPv6
+// address. The name must have the 32 nibbles of the address, in any case.
+func ExtractIPv6(reverseName string) (net.IP, error) {
+	lower := strings.ToLower(reverseName)
+	if !strings.HasSuffix(lower, ArpaSuffixV6) {
+		return nil, fmt.Errorf("incorrect PTR IPv6 %q: missing the %s suffix", reverseName, ArpaSuffixV6)
+	}
+	ip, err := extractIPv6(strings.TrimSuffix(lower, ArpaSuffixV6))
+	if err != nil {
+		return nil, fmt.Errorf("incorrect PTR IPv6 %q: %w", reverseName, err)
+	}
+	return ip, nil
+}
+
 // extractIPv4 turns a standard PTR reverse record lookup name
 // into an IP address
 func extractIPv4(reverseName string) (string, error) {
@@ -77,18 +92,26 @@ func extractIPv4(reverseName string) (string, error) {
 	return ip.String(), nil
 }
 
+// ipv6NibbleCount is the number of nibbles in an IPv6 PTR record as
+// defined in RFC 3596.
+const ipv6NibbleCount = 32
+
 // extractIPv6 turns a IPv6 PTR reverse record lookup name
 // into an IPv6 address according to RFC3596
 // b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.
 // is reversed to 4321:0:1:2:3:4:567:89ab
-func extractIPv6(reverseName string) (string, error) {
+func extractIPv6(reverseName string) (net.IP, error) {
 	segments := ReverseArray(strings.Split(reverseName, "."))
 
-	// IPv6nibbleCount is the expected number of nibbles in IPv6 PTR record as defined in rfc3596
-	const ipv6nibbleCount = 32
-
-	if len(segments) != ipv6nibbleCount {
-		return "", fmt.Errorf("incorrect number of segments in IPv6 PTR: %v", len(segments))
+	if len(segments) != ipv6NibbleCount {
+		return nil, fmt.Errorf("incorrect number of segments in IPv6 PTR: %v", len(segments))
+	}
+	// Each label is a single nibble, net.ParseIP would otherwise accept
+	// groups made of labels of other lengths.
+	for _, segment := range segments {
+		if len(segment) != 1 {
+			return nil, fmt.Errorf("invalid nibble %q in IPv6 PTR", segment)
+		}
 	}
 
 	var slice6 []string
@@ -98,9 +121,37 @@ func extractIPv6(reverseName string) (string, error) {
 
 	ip := net.ParseIP(strings.Join(slice6, ":")).To16()
 	if ip == nil {
-		return "", fmt.Errorf("failed to parse IPv6 segments: %v", slice6)
+		return nil, fmt.Errorf("failed to parse IPv6 segments: %v", slice6)
 	}
-	return ip.String(), nil
+	return ip, nil
+}
+
+// ReverseName returns the PTR reverse record lookup name of ip: in
+// in-addr.arpa. for IPv4 addresses, in ip6.arpa. for IPv6 addresses.
+// 10.47.32.22 is turned into 22.32.47.10.in-addr.arpa.
+func ReverseName(ip net.IP) (string, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d%s", ip4[3], ip4[2], ip4[1], ip4[0], ArpaSuffix), nil
+	}
+	return ReverseNameV6(ip)
+}
+
+// ReverseNameV6 returns the ip6.arpa. PTR reverse record lookup name of
+// ip, with its 32 nibbles in lower case. IPv4 addresses are turned into
+// the name of their IPv4-mapped IPv6 address.
+// 4321:0:1:2:3:4:567:89ab is turned into
+// b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.
+func ReverseNameV6(ip net.IP) (string, error) {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return "", fmt.Errorf("invalid IP address: %v", ip)
+	}
+	const hexDigits = "0123456789abcdef"
+	b := make([]byte, 0, 2*ipv6NibbleCount+len(ArpaSuffixV6)-1)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		b = append(b, hexDigits[ip16[i]&0xf], '.', hexDigits[ip16[i]>>4], '.')
+	}
+	return string(b) + strings.TrimPrefix(ArpaSuffixV6, "."), nil
 }
 
 // ReverseArray reverses an array.
@@ -17,6 +17,8 @@ limitations under the License.
 package util
 
 import (
+	"net"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -111,6 +113,28 @@ func TestExtractIP(t *testing.T) {
 			wantErr:  true,
 			errMsg:   "incorrect PTR IPv6 \"z.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.\": failed to parse IPv6 segments: [4321 0000 0001 0002 0003 0004 0567 89az]",
 		},
+		{
+			testName: "upper case IPv6 ptr",
+			ptr:      "B.A.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.IP6.ARPA.",
+			wantIP:   "4321:0:1:2:3:4:567:89ab",
+		},
+		{
+			testName: "upper case IPv4 ptr",
+			ptr:      "255.2.0.192.IN-ADDR.ARPA.",
+			wantIP:   "192.0.2.255",
+		},
+		{
+			testName: "IPv6 ptr with an empty label",
+			ptr:      "b.a..8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.",
+			wantErr:  true,
+			errMsg:   "incorrect PTR IPv6 \"b.a..8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.\": invalid nibble \"\" in IPv6 PTR",
+		},
+		{
+			testName: "IPv6 ptr with a label of two nibbles",
+			ptr:      "ba.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.0.ip6.arpa.",
+			wantErr:  true,
+			errMsg:   "incorrect PTR IPv6 \"ba.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.0.ip6.arpa.\": invalid nibble \"ba\" in IPv6 PTR",
+		},
 		{
 			testName: "custom text",
 			ptr:      "custom text",
@@ -164,3 +188,45 @@ func TestGetClusterIPs(t *testing.T) {
 		assert.ElementsMatch(t, tc.wantIPs, GetClusterIPs(tc.service))
 	}
 }
+
+func TestReverseName(t *testing.T) {
+	for _, tc := range []struct {
+		ip   string
+		name string
+		// want is the address extracted back from name.
+		want string
+	}{
+		{"192.0.2.255", "255.2.0.192.in-addr.arpa.", "192.0.2.255"},
+		{"4321:0:1:2:3:4:567:89ab", "b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.", "4321:0:1:2:3:4:567:89ab"},
+		// Compressed and uncompressed addresses have the same name.
+		{"fd00::a", "a.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", "fd00::a"},
+		{"FD00:0000:0000:0000:0000:0000:0000:000A", "a.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", "fd00::a"},
+		{"::", "0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.", "::"},
+		{"::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.", "::1"},
+		// An IPv4 address embedded in an IPv6 address, e.g. by NAT64.
+		{"64:ff9b::192.0.2.1", "1.0.2.0.0.0.0.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.b.9.f.f.4.6.0.0.ip6.arpa.", "64:ff9b::c000:201"},
+	} {
+		name, err := ReverseName(net.ParseIP(tc.ip))
+		assert.NoError(t, err, tc.ip)
+		assert.Equal(t, tc.name, name, tc.ip)
+		ip, err := ExtractIP(name)
+		assert.NoError(t, err, tc.ip)
+		assert.Equal(t, tc.want, ip, tc.ip)
+		ip, err = ExtractIP(strings.ToUpper(name))
+		assert.NoError(t, err, tc.ip)
+		assert.Equal(t, tc.want, ip, tc.ip)
+	}
+
+	// The IPv6 name of an IPv4 address is that of its IPv4-mapped address.
+	name, err := ReverseNameV6(net.ParseIP("192.0.2.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0.2.0.0.0.0.c.f.f.f.f.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.", name)
+	ip, err := ExtractIPv6(name)
+	assert.NoError(t, err)
+	assert.True(t, ip.Equal(net.ParseIP("::ffff:192.0.2.1")))
+
+	_, err = ReverseName(nil)
+	assert.Error(t, err)
+	_, err = ExtractIPv6("255.2.0.192.in-addr.arpa.")
+	assert.Error(t, err)
+}
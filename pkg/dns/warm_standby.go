@@ -0,0 +1,212 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/treecache"
+)
+
+const (
+	// warmStandbyMethod streams the records of a synced replica, serialized
+	// like the records snapshot, in chunks of warmStandbyChunkSize bytes,
+	// each a google.protobuf.BytesValue. It takes a google.protobuf.Empty.
+	warmStandbyMethod    = "/kubedns.WarmStandby/Records"
+	warmStandbyChunkSize = 1 << 20
+	// warmStandbyAttempts is how many times the peers are asked for their
+	// records: the replica answering may not be synced itself, the next
+	// connection may reach another one.
+	warmStandbyAttempts = 3
+)
+
+// warmStandbyMaxSize is the largest size of the serialized records received
+// from a peer: the transfer is aborted beyond.
+var warmStandbyMaxSize = 256 << 20
+
+var (
+	warmStandbyTransfers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kubedns",
+		Subsystem: "warm_standby",
+		Name:      "transfers_total",
+		Help:      "Transfers of the records between replicas, by direction: sent or received, and result: success or error.",
+	}, []string{"direction", "result"})
+	registerWarmStandbyMetrics sync.Once
+)
+
+func registerWarmStandbyMetric() {
+	registerWarmStandbyMetrics.Do(func() { prometheus.MustRegister(warmStandbyTransfers) })
+}
+
+// warmStandbyServer is the HandlerType of warmStandbyService, implemented by
+// the KubeDNS serving its records.
+type warmStandbyServer interface {
+	sendRecords(stream grpc.ServerStream) error
+}
+
+var warmStandbyService = grpc.ServiceDesc{
+	ServiceName: "kubedns.WarmStandby",
+	HandlerType: (*warmStandbyServer)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Records",
+		ServerStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			if err := stream.RecvMsg(new(emptypb.Empty)); err != nil {
+				return err
+			}
+			return srv.(warmStandbyServer).sendRecords(stream)
+		},
+	}},
+}
+
+// RegisterWarmStandby registers the service streaming the records of kd,
+// once synced, to the replicas starting with WarmStandbyPeer, on s.
+func (kd *KubeDNS) RegisterWarmStandby(s *grpc.Server) {
+	registerWarmStandbyMetric()
+	s.RegisterService(&warmStandbyService, kd)
+}
+
+// sendRecords streams the records served to a starting replica. The
+// replicas not synced yet refuse, their records being partial.
+func (kd *KubeDNS) sendRecords(stream grpc.ServerStream) error {
+	if pending := kd.InitialSyncPending(); len(pending) > 0 {
+		warmStandbyTransfers.WithLabelValues("sent", "error").Inc()
+		return status.Errorf(codes.Unavailable, "initial sync: waiting for %s", strings.Join(pending, ", "))
+	}
+	serialized, err := kd.cacheView().Serialize()
+	if err != nil {
+		warmStandbyTransfers.WithLabelValues("sent", "error").Inc()
+		return status.Errorf(codes.Internal, "failed to serialize the records: %v", err)
+	}
+	for len(serialized) > 0 {
+		n := warmStandbyChunkSize
+		if n > len(serialized) {
+			n = len(serialized)
+		}
+		if err := stream.SendMsg(wrapperspb.Bytes([]byte(serialized[:n]))); err != nil {
+			warmStandbyTransfers.WithLabelValues("sent", "error").Inc()
+			return err
+		}
+		serialized = serialized[n:]
+	}
+	klog.V(2).Infof("Sent the records to a starting replica")
+	warmStandbyTransfers.WithLabelValues("sent", "success").Inc()
+	return nil
+}
+
+// bootstrapFromPeer answers from the records of a synced replica, received
+// from WarmStandbyPeer, until the records are synced: like the records
+// snapshot, they are answered for the names missing from the records, with
+// a short TTL. The replica is then ready, see WarmStandby, rather than
+// unavailable for as long as the initial sync takes.
+func (kd *KubeDNS) bootstrapFromPeer() error {
+	registerWarmStandbyMetric()
+	if kd.WarmStandbyTLS == nil {
+		return fmt.Errorf("no TLS configuration to receive the records from %v", kd.WarmStandbyPeer)
+	}
+	registerRecordsSnapshotMetrics.Do(func() { prometheus.MustRegister(staleAnswers, recordsSnapshotSaves) })
+	ctx, cancel := context.WithTimeout(context.Background(), kd.WarmStandbyTimeout)
+	defer cancel()
+	var lastErr error
+	for attempt := 0; attempt < warmStandbyAttempts; attempt++ {
+		cache, err := receiveRecords(ctx, kd.WarmStandbyPeer, kd.WarmStandbyTLS)
+		if err == nil {
+			kd.staleCache.Store(staleCache{cache: cache})
+			atomic.StoreInt32(&kd.warmStandby, 1)
+			warmStandbyTransfers.WithLabelValues("received", "success").Inc()
+			klog.V(0).Infof("Answering from the records of a peer received from %v until the records are synced", kd.WarmStandbyPeer)
+			return nil
+		}
+		warmStandbyTransfers.WithLabelValues("received", "error").Inc()
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+		klog.Warningf("Failed to receive the records from %v: %v", kd.WarmStandbyPeer, err)
+	}
+	return lastErr
+}
+
+// receiveRecords receives the records of the replica at target over TLS,
+// at most warmStandbyMaxSize bytes.
+func receiveRecords(ctx context.Context, target string, tlsConfig *tls.Config) (treecache.TreeCache, error) {
+	conn, err := grpc.DialContext(ctx, target, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stream, err := conn.NewStream(ctx, &warmStandbyService.Streams[0], warmStandbyMethod)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(new(emptypb.Empty)); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	var serialized bytes.Buffer
+	for {
+		chunk := new(wrapperspb.BytesValue)
+		err := stream.RecvMsg(chunk)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if serialized.Len()+len(chunk.Value) > warmStandbyMaxSize {
+			return nil, fmt.Errorf("the records exceed %d bytes", warmStandbyMaxSize)
+		}
+		serialized.Write(chunk.Value)
+	}
+	cache, err := treecache.Deserialize(serialized.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("invalid records: %w", err)
+	}
+	return cache, nil
+}
+
+// WarmStandby returns whether the records of a peer are answered while
+// the records are synced, see WarmStandbyPeer.
+func (kd *KubeDNS) WarmStandby() bool {
+	return atomic.LoadInt32(&kd.warmStandby) == 1
+}
+
+// leaveWarmStandby stops answering from the records of the peer once the
+// records are synced.
+func (kd *KubeDNS) leaveWarmStandby() {
+	kd.dropRecordsSnapshot()
+	atomic.StoreInt32(&kd.warmStandby, 0)
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+// newPeerCert returns a certificate for 127.0.0.1 signed by parent, itself
+// if nil, and its key.
+func newPeerCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (tls.Certificate, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "kube-dns"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert, key
+}
+
+// newWarmStandbyTLS returns the TLS configurations of a replica serving its
+// records and of one receiving them, authenticated by the same CA.
+func newWarmStandbyTLS(t *testing.T) (server, client *tls.Config) {
+	_, ca, caKey := newPeerCert(t, nil, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	serverCert, _, _ := newPeerCert(t, ca, caKey)
+	clientCert, _, _ := newPeerCert(t, ca, caKey)
+	server = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	client = &tls.Config{Certificates: []tls.Certificate{clientCert}, RootCAs: pool}
+	return server, client
+}
+
+// serveWarmStandby serves the records of kd over TLS with tlsConfig on a
+// loopback port, and returns its address.
+func serveWarmStandby(t *testing.T, kd *KubeDNS, tlsConfig *tls.Config) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+	kd.RegisterWarmStandby(s)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return lis.Addr().String()
+}
+
+func TestWarmStandby(t *testing.T) {
+	peer := newKubeDNS()
+	s := newService(testNamespace, testService, "1.2.3.4", "", 0)
+	peer.newService(s)
+	serverTLS, clientTLS := newWarmStandbyTLS(t)
+	addr := serveWarmStandby(t, peer, serverTLS)
+
+	kd := newKubeDNS()
+	kd.WarmStandbyPeer = addr
+	kd.WarmStandbyTimeout = 10 * time.Second
+
+	// The records are not received without TLS.
+	assert.Error(t, kd.bootstrapFromPeer())
+	kd.WarmStandbyTLS = clientTLS
+
+	// The peer is not synced, its records are partial.
+	_, err := receiveRecords(context.Background(), addr, clientTLS)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Error(t, kd.bootstrapFromPeer())
+	assert.False(t, kd.WarmStandby())
+
+	peer.syncPending.Store([]string(nil))
+	require.NoError(t, kd.bootstrapFromPeer())
+	assert.True(t, kd.WarmStandby())
+	name := getServiceFQDN(kd.domain, s)
+	records, err := kd.Records(name, false)
+	assert.ErrorIs(t, err, server.ErrStale)
+	require.Len(t, records, 1)
+	assert.Equal(t, "1.2.3.4", records[0].Host)
+	assert.Equal(t, uint32(staleRecordTTL), records[0].Ttl)
+
+	// Once synced, the records of the peer are no longer answered.
+	kd.leaveWarmStandby()
+	assert.False(t, kd.WarmStandby())
+	_, err = kd.Records(name, false)
+	assert.Error(t, err)
+}
+
+func TestWarmStandbyRefused(t *testing.T) {
+	peer := newKubeDNS()
+	peer.newService(newService(testNamespace, testService, "1.2.3.4", "", 0))
+	peer.syncPending.Store([]string(nil))
+	serverTLS, clientTLS := newWarmStandbyTLS(t)
+	addr := serveWarmStandby(t, peer, serverTLS)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The clients without a certificate of the CA are refused.
+	_, err := receiveRecords(ctx, addr, &tls.Config{RootCAs: clientTLS.RootCAs})
+	assert.Error(t, err)
+	otherCert, _, _ := newPeerCert(t, nil, nil)
+	_, err = receiveRecords(ctx, addr, &tls.Config{RootCAs: clientTLS.RootCAs, Certificates: []tls.Certificate{otherCert}})
+	assert.Error(t, err)
+
+	// The records larger than warmStandbyMaxSize are refused.
+	defer func(size int) { warmStandbyMaxSize = size }(warmStandbyMaxSize)
+	warmStandbyMaxSize = 16
+	_, err = receiveRecords(ctx, addr, clientTLS)
+	assert.ErrorContains(t, err, "exceed")
+	warmStandbyMaxSize = 1 << 20
+	_, err = receiveRecords(ctx, addr, clientTLS)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+	"k8s.io/klog/v2"
+)
+
+// recordWatchBuffer is the number of events a watcher may lag behind, on
+// top of the records it is sent when it starts watching.
+const recordWatchBuffer = 1024
+
+// RecordEvent is the change of a record generated for a service or its
+// endpoints, as streamed by WatchRecords.
+type RecordEvent struct {
+	// Op is AuditOpAdd, AuditOpUpdate or AuditOpDelete.
+	Op string `json:"op"`
+	// Name is the fully qualified DNS name of the record.
+	Name string `json:"name"`
+	// Record is the value served after the change. For deletes it is the
+	// value that was served before the change.
+	Record skymsg.Service `json:"record"`
+	// Previous holds the value served before an update.
+	Previous *skymsg.Service `json:"previous,omitempty"`
+
+	// The Kubernetes object that caused the change.
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace"`
+	ObjectName string `json:"objectName"`
+}
+
+// RR returns the record as answered for Name: a PTR record for reverse
+// names, an SRV record for the records with a port, an A or AAAA record
+// for the addresses and a CNAME record otherwise.
+func (e RecordEvent) RR() dns.RR {
+	name := dns.Fqdn(e.Name)
+	record := e.Record
+	if isReverseName(name) {
+		return record.NewPTR(name, record.Ttl)
+	}
+	if record.Port != 0 {
+		return record.NewSRV(name, uint16(record.Weight))
+	}
+	switch ip := net.ParseIP(record.Host); {
+	case ip == nil:
+		return record.NewCNAME(name, dns.Fqdn(record.Host))
+	case ip.To4() != nil:
+		return record.NewA(name, ip)
+	default:
+		return record.NewAAAA(name, ip)
+	}
+}
+
+// RecordWatch streams the changes of the records generated for services
+// and endpoints to watchers. Like the AuditLog, it keeps the last set of
+// records generated for each owning object, so that watchers are first
+// sent the records served when they start watching. A RecordWatch is safe
+// for concurrent use.
+type RecordWatch struct {
+	lock sync.Mutex
+	// records maps an owner key (kind/namespace/name) to the records it
+	// last generated, keyed by fqdn.
+	records  map[string]recordSet
+	watchers map[chan RecordEvent]struct{}
+}
+
+// NewRecordWatch returns a RecordWatch without watchers.
+func NewRecordWatch() *RecordWatch {
+	return &RecordWatch{
+		records:  make(map[string]recordSet),
+		watchers: make(map[chan RecordEvent]struct{}),
+	}
+}
+
+// Watch returns a channel receiving an add event for each record served,
+// then the changes of the records until stopCh is closed. The channel is
+// closed then, or as soon as the watcher lags too far behind, in which
+// case it has to watch again.
+func (w *RecordWatch) Watch(stopCh <-chan struct{}) <-chan RecordEvent {
+	w.lock.Lock()
+	keys := make([]string, 0, len(w.records))
+	count := 0
+	for key, records := range w.records {
+		keys = append(keys, key)
+		count += len(records)
+	}
+	sort.Strings(keys)
+	events := make(chan RecordEvent, count+recordWatchBuffer)
+	for _, key := range keys {
+		kind, namespace, name := splitOwnerKey(key)
+		for _, fqdn := range sortedNames(w.records[key]) {
+			events <- RecordEvent{Op: AuditOpAdd, Name: fqdn, Record: w.records[key][fqdn],
+				Kind: kind, Namespace: namespace, ObjectName: name}
+		}
+	}
+	w.watchers[events] = struct{}{}
+	w.lock.Unlock()
+
+	go func() {
+		<-stopCh
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		w.remove(events)
+	}()
+	return events
+}
+
+// remove closes the channel of a watcher, unless it was already. It must
+// be called with the lock held.
+func (w *RecordWatch) remove(events chan RecordEvent) {
+	if _, ok := w.watchers[events]; ok {
+		delete(w.watchers, events)
+		close(events)
+	}
+}
+
+// update replaces the records generated by the given object and sends the
+// differences with the previously generated records to the watchers.
+func (w *RecordWatch) update(kind string, obj metav1.Object, records recordSet) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.apply(auditOwnerKey(kind, obj), kind, obj, records)
+}
+
+// delete removes every record owned by the ownerKind object with the same
+// namespace and name as obj. obj is the object whose change caused the
+// removal.
+func (w *RecordWatch) delete(ownerKind string, kind string, obj metav1.Object) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.apply(auditOwnerKey(ownerKind, obj), kind, obj, nil)
+}
+
+// deleteReverse removes the PTR records generated by the given object,
+// leaving its forward records in place.
+func (w *RecordWatch) deleteReverse(kind string, obj metav1.Object) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	key := auditOwnerKey(kind, obj)
+	remaining := recordSet{}
+	for name, record := range w.records[key] {
+		if !isReverseName(name) {
+			remaining[name] = record
+		}
+	}
+	w.apply(key, kind, obj, remaining)
+}
+
+// apply must be called with the lock held.
+func (w *RecordWatch) apply(key string, kind string, obj metav1.Object, records recordSet) {
+	previous := w.records[key]
+	diffRecords(previous, records, func(op, name string, record skymsg.Service, old *skymsg.Service) {
+		event := RecordEvent{Op: op, Name: name, Record: record, Previous: old,
+			Kind: kind, Namespace: obj.GetNamespace(), ObjectName: obj.GetName()}
+		for events := range w.watchers {
+			select {
+			case events <- event:
+			default:
+				klog.Warningf("Record watcher lagging behind, closing its watch")
+				w.remove(events)
+			}
+		}
+	})
+	if len(records) == 0 {
+		delete(w.records, key)
+		return
+	}
+	w.records[key] = records
+}
+
+// splitOwnerKey returns the kind, namespace and name of an owner key.
+func splitOwnerKey(key string) (string, string, string) {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) != 3 {
+		return key, "", ""
+	}
+	return parts[0], parts[1], parts[2]
+}
+
+// WatchRecords returns a channel receiving the records generated for the
+// services and their endpoints, then their changes until stopCh is closed,
+// see RecordWatch.Watch. It fails unless RecordWatch is set.
+func (kd *KubeDNS) WatchRecords(stopCh <-chan struct{}) (<-chan RecordEvent, error) {
+	if kd.RecordWatch == nil {
+		return nil, fmt.Errorf("record watch is disabled")
+	}
+	return kd.RecordWatch.Watch(stopCh), nil
+}
+
+// newRecordSet returns a recordSet to collect the records generated for an
+// object into, or nil if neither the AuditLog nor the RecordWatch is set.
+func (kd *KubeDNS) newRecordSet() recordSet {
+	if kd.AuditLog == nil && kd.RecordWatch == nil {
+		return nil
+	}
+	return recordSet{}
+}
+
+// updateRecordSet passes the records generated by obj to the AuditLog and
+// the RecordWatch.
+func (kd *KubeDNS) updateRecordSet(kind string, obj metav1.Object, records recordSet) {
+	kd.AuditLog.update(kind, obj, records)
+	kd.RecordWatch.update(kind, obj, records)
+}
+
+// deleteRecordSet removes the records owned by the ownerKind object with
+// the namespace and name of obj from the AuditLog and the RecordWatch.
+func (kd *KubeDNS) deleteRecordSet(ownerKind string, kind string, obj metav1.Object) {
+	kd.AuditLog.delete(ownerKind, kind, obj)
+	kd.RecordWatch.delete(ownerKind, kind, obj)
+}
+
+// deleteReverseRecordSet removes the PTR records generated by obj from the
+// AuditLog and the RecordWatch.
+func (kd *KubeDNS) deleteReverseRecordSet(kind string, obj metav1.Object) {
+	kd.AuditLog.deleteReverse(kind, obj)
+	kd.RecordWatch.deleteReverse(kind, obj)
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/dns/pkg/dns/util"
+)
+
+// receiveRecordEvents returns the events queued in events.
+func receiveRecordEvents(events <-chan RecordEvent) []RecordEvent {
+	var received []RecordEvent
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return received
+			}
+			received = append(received, event)
+		default:
+			return received
+		}
+	}
+}
+
+func TestWatchRecords(t *testing.T) {
+	kd := newKubeDNS()
+	_, err := kd.WatchRecords(nil)
+	assert.Error(t, err, "record watch disabled")
+
+	kd.RecordWatch = NewRecordWatch()
+	s := newService(testNamespace, testService, "1.2.3.4", "http", 80)
+	kd.newService(s)
+
+	// The watcher is first sent the records served.
+	stopCh := make(chan struct{})
+	events, err := kd.WatchRecords(stopCh)
+	require.NoError(t, err)
+	received := receiveRecordEvents(events)
+	require.Len(t, received, 3)
+	types := map[uint16]string{}
+	for _, event := range received {
+		assert.Equal(t, AuditOpAdd, event.Op)
+		assert.Equal(t, auditKindService, event.Kind)
+		assert.Equal(t, testNamespace, event.Namespace)
+		assert.Equal(t, testService, event.ObjectName)
+		rr := event.RR()
+		assert.Equal(t, dns.Fqdn(event.Name), rr.Header().Name)
+		types[rr.Header().Rrtype] = event.Name
+	}
+	require.Len(t, types, 3)
+	// The names of the A and SRV records have the label of their value.
+	assert.True(t, dns.IsSubDomain("testservice.default.svc.cluster.local.", types[dns.TypeA]), types[dns.TypeA])
+	assert.True(t, dns.IsSubDomain("_http._tcp.testservice.default.svc.cluster.local.", types[dns.TypeSRV]), types[dns.TypeSRV])
+	assert.Equal(t, "4.3.2.1.in-addr.arpa.", types[dns.TypePTR])
+
+	// Then the changes.
+	s.Spec.Ports[0].Port = 8080
+	kd.updateService(s, s)
+	received = receiveRecordEvents(events)
+	require.Len(t, received, 1)
+	assert.Equal(t, AuditOpUpdate, received[0].Op)
+	assert.Equal(t, 8080, received[0].Record.Port)
+	assert.Equal(t, 80, received[0].Previous.Port)
+	assert.Equal(t, uint16(8080), received[0].RR().(*dns.SRV).Port)
+
+	kd.removeService(s)
+	received = receiveRecordEvents(events)
+	require.Len(t, received, 3)
+	for _, event := range received {
+		assert.Equal(t, AuditOpDelete, event.Op)
+	}
+
+	close(stopCh)
+	_, ok := <-events
+	assert.False(t, ok, "the channel is closed once stopped")
+}
+
+func TestWatchRecordsLagging(t *testing.T) {
+	w := NewRecordWatch()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	events := w.Watch(stopCh)
+
+	obj := &metav1.ObjectMeta{Namespace: testNamespace, Name: testService}
+	records := recordSet{}
+	for i := 0; i <= recordWatchBuffer; i++ {
+		records[fmt.Sprintf("a%d.%s", i, testDomain)] = *util.NewServiceRecord("10.0.0.1", 0)
+	}
+	w.update(auditKindService, obj, records)
+
+	// The watcher that could not keep up is closed.
+	received := receiveRecordEvents(events)
+	assert.Len(t, received, recordWatchBuffer)
+	_, ok := <-events
+	assert.False(t, ok)
+
+	// Watching again starts from the records served.
+	events = w.Watch(stopCh)
+	assert.Len(t, receiveRecordEvents(events), recordWatchBuffer+1)
+}
+
+func TestRecordEventRR(t *testing.T) {
+	for _, tc := range []struct {
+		event RecordEvent
+		rr    string
+	}{
+		{RecordEvent{Name: "a.default.svc.cluster.local.", Record: *util.NewServiceRecord("10.0.0.1", 0)},
+			"a.default.svc.cluster.local.\t30\tIN\tA\t10.0.0.1"},
+		{RecordEvent{Name: "a.default.svc.cluster.local.", Record: *util.NewServiceRecord("fd00::1", 0)},
+			"a.default.svc.cluster.local.\t30\tIN\tAAAA\tfd00::1"},
+		{RecordEvent{Name: "ext.default.svc.cluster.local.", Record: *util.NewServiceRecord("example.com", 0)},
+			"ext.default.svc.cluster.local.\t30\tIN\tCNAME\texample.com."},
+		{RecordEvent{Name: "1.0.0.10.in-addr.arpa.", Record: *util.NewServiceRecord("a.default.svc.cluster.local.", 0)},
+			"1.0.0.10.in-addr.arpa.\t30\tIN\tPTR\ta.default.svc.cluster.local."},
+	} {
+		assert.Equal(t, tc.rr, tc.event.RR().String())
+	}
+}
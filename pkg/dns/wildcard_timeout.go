@@ -0,0 +1,91 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/treecache"
+	"k8s.io/dns/pkg/dns/util"
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+// WildcardTimeoutAction selects the answer to the wildcard queries given
+// up on past WildcardQueryTimeout.
+type WildcardTimeoutAction string
+
+const (
+	// WildcardTimeoutTruncate answers the records found so far, with the
+	// TC bit set.
+	WildcardTimeoutTruncate WildcardTimeoutAction = "truncate"
+	// WildcardTimeoutServfail answers SERVFAIL.
+	WildcardTimeoutServfail WildcardTimeoutAction = "servfail"
+)
+
+var (
+	wildcardQueriesTimedOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kubedns",
+		Subsystem: "wildcard",
+		Name:      "queries_timed_out_total",
+		Help:      "Wildcard queries given up on past their timeout, by action: truncate or servfail.",
+	}, []string{"action"})
+	registerWildcardMetrics sync.Once
+)
+
+// ParseWildcardTimeoutAction parses the --wildcard-query-timeout-action
+// flag.
+func ParseWildcardTimeoutAction(value string) (WildcardTimeoutAction, error) {
+	switch action := WildcardTimeoutAction(value); action {
+	case WildcardTimeoutTruncate, WildcardTimeoutServfail:
+		return action, nil
+	}
+	return "", fmt.Errorf("invalid wildcard query timeout action %q, must be %v or %v",
+		value, WildcardTimeoutTruncate, WildcardTimeoutServfail)
+}
+
+// appendCachedValues appends the values of the cache at path to dst. The
+// wildcards of path are expanded for WildcardQueryTimeout at most, past
+// which the records found so far are returned with server.ErrPartial, or
+// none with server.ErrBackendUnavailable, as WildcardTimeoutAction says.
+func (kd *KubeDNS) appendCachedValues(cache treecache.TreeCache, dst []skymsg.Service, path []string) ([]skymsg.Service, error) {
+	if kd.WildcardQueryTimeout <= 0 || !containsString(path, "*") {
+		return cache.AppendValuesForPathWithWildcards(dst, path...), nil
+	}
+	records, partial := cache.AppendValuesForPathWithDeadline(dst, time.Now().Add(kd.WildcardQueryTimeout), path...)
+	if !partial {
+		return records, nil
+	}
+	action := kd.WildcardTimeoutAction
+	if action == "" {
+		action = WildcardTimeoutTruncate
+	}
+	registerWildcardMetrics.Do(func() { prometheus.MustRegister(wildcardQueriesTimedOut) })
+	wildcardQueriesTimedOut.WithLabelValues(string(action)).Inc()
+	name := strings.Join(util.ReverseArray(append([]string(nil), path...)), ".")
+	klog.V(2).Infof("Wildcard query %q timed out after %v, answering with %v", name, kd.WildcardQueryTimeout, action)
+	if action == WildcardTimeoutServfail {
+		return dst, fmt.Errorf("wildcard query %q timed out: %w", name, server.ErrBackendUnavailable)
+	}
+	return records, fmt.Errorf("wildcard query %q timed out: %w", name, server.ErrPartial)
+}
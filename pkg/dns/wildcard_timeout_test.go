@@ -0,0 +1,70 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+func TestParseWildcardTimeoutAction(t *testing.T) {
+	for _, value := range []string{"truncate", "servfail"} {
+		action, err := ParseWildcardTimeoutAction(value)
+		assert.NoError(t, err)
+		assert.Equal(t, WildcardTimeoutAction(value), action)
+	}
+	_, err := ParseWildcardTimeoutAction("refuse")
+	assert.Error(t, err)
+}
+
+func TestWildcardQueryTimeout(t *testing.T) {
+	const services = 200
+	kd := newKubeDNS()
+	for i := 0; i < services; i++ {
+		kd.newService(newService(testNamespace, fmt.Sprintf("service-%d", i), fmt.Sprintf("10.0.%d.%d", i/250, i%250+1), "", 80))
+	}
+	const query = "*.*.*.svc.cluster.local."
+
+	records, err := kd.Records(query, false)
+	require.NoError(t, err)
+	assert.Len(t, records, services)
+
+	// The queries time out at once, the clock is read once the wildcards
+	// expanded to a few names.
+	kd.WildcardQueryTimeout = time.Nanosecond
+	records, err = kd.Records(query, false)
+	assert.True(t, errors.Is(err, server.ErrPartial), "got %v", err)
+	assert.NotEmpty(t, records)
+	assert.Less(t, len(records), services)
+
+	// The names without wildcards are answered in full.
+	records, err = kd.Records("service-42.default.svc.cluster.local.", false)
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+
+	kd.WildcardTimeoutAction = WildcardTimeoutServfail
+	records, err = kd.Records(query, false)
+	assert.True(t, errors.Is(err, server.ErrBackendUnavailable), "got %v", err)
+	assert.Empty(t, records)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"errors"
+
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/util"
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+// ZoneProvider answers the queries for a part of the names served by
+// KubeDNS, such as the services of the peer clusters or of the federations,
+// ahead of the services and pods of the cluster. Records asks each provider
+// of the chain in turn, the first one that handles a name answers it.
+type ZoneProvider interface {
+	// Records returns the records of the query segments, the labels of the
+	// queried name in order, and whether the provider handles the name. The
+	// segments must not be modified. An exact query asks for the record of
+	// the name itself rather than of all the names under it.
+	Records(segments []string, exact bool) (records []skymsg.Service, handled bool, err error)
+}
+
+// ZoneProviderFunc is a ZoneProvider calling a function.
+type ZoneProviderFunc func(segments []string, exact bool) ([]skymsg.Service, bool, error)
+
+// Records calls f.
+func (f ZoneProviderFunc) Records(segments []string, exact bool) ([]skymsg.Service, bool, error) {
+	return f(segments, exact)
+}
+
+// zoneProviderChain returns the built-in providers followed by
+// ZoneProviders. The built-in providers check their configuration on each
+// query, so that the chain does not change once built.
+func (kd *KubeDNS) zoneProviderChain() []ZoneProvider {
+	kd.zoneProvidersOnce.Do(func() {
+		kd.zoneProviders = append([]ZoneProvider{
+			ZoneProviderFunc(kd.peerClusterZone),
+			ZoneProviderFunc(kd.federationZone),
+			ZoneProviderFunc(kd.multiClusterZone),
+			ZoneProviderFunc(kd.lazySRVZone),
+		}, kd.ZoneProviders...)
+	})
+	return kd.zoneProviders
+}
+
+// peerClusterZone answers <service>.<namespace>.<peer>.remote.<domain>
+// with the services of the peer clusters.
+func (kd *KubeDNS) peerClusterZone(segments []string, exact bool) ([]skymsg.Service, bool, error) {
+	if !kd.isPeerClusterQuery(segments) {
+		return nil, false, nil
+	}
+	records, err := kd.peerClusterRecords(segments)
+	return records, true, err
+}
+
+// federationZone answers <service>.<namespace>.<federation>.svc.<domain>
+// with the local service if it has endpoints, and otherwise with a CNAME
+// redirect to the federation.
+func (kd *KubeDNS) federationZone(segments []string, exact bool) ([]skymsg.Service, bool, error) {
+	if exact || !kd.isFederationQuery(segments) {
+		return nil, false, nil
+	}
+	klog.V(3).Infof("Received federation query, trying local service first")
+	// Try querying the non-federation (local) service first. Will try the
+	// federation one later, if this fails. To try the local service, remove
+	// the federation name from the segments, 3rd after the service name and
+	// namespace.
+	federationSegments := append([]string{}, segments...)
+	local := make([]string, 0, len(segments)-1)
+	local = append(append(local, segments[:2]...), segments[3:]...)
+
+	path := kd.untenantedPath(util.ReverseArray(local))
+	records, err := kd.getRecordsForPath(nil, path, exact)
+	if err != nil && !errors.Is(err, server.ErrNoData) && !server.WithRecords(err) {
+		return nil, true, err
+	}
+	records, err = kd.recordsForFederation(records, path, exact, federationSegments)
+	return records, true, err
+}
+
+// multiClusterZone answers the names of MultiClusterDomain from the cache,
+// where the services of the clusterset are. The subdomains of the cluster
+// domain, such as pod, have no meaning there.
+func (kd *KubeDNS) multiClusterZone(segments []string, exact bool) ([]skymsg.Service, bool, error) {
+	if len(kd.multiClusterPath) == 0 || len(segments) < len(kd.multiClusterPath) {
+		return nil, false, nil
+	}
+	for i, label := range kd.multiClusterPath {
+		// kd.multiClusterPath is reversed, so we need to look in the
+		// segments in the reverse order.
+		if segments[len(segments)-1-i] != label {
+			return nil, false, nil
+		}
+	}
+	path := util.ReverseArray(append([]string{}, segments...))
+	records, err := kd.getCachedRecordsForPath(nil, path, exact)
+	if err == nil && len(records) == 0 {
+		err = server.ErrNotFound
+	}
+	return records, true, err
+}
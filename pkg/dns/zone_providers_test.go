@@ -0,0 +1,89 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+
+	skymsg "k8s.io/dns/third_party/forked/skydns/msg"
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+func TestZoneProviders(t *testing.T) {
+	kd := newKubeDNS()
+	kd.kubeClient = fake.NewSimpleClientset(newNodes())
+	kd.config.Federations = map[string]string{"myfederation": "example.com"}
+	var queried []string
+	kd.ZoneProviders = []ZoneProvider{
+		ZoneProviderFunc(func(segments []string, exact bool) ([]skymsg.Service, bool, error) {
+			queried = append(queried, strings.Join(segments, "."))
+			if len(segments) < 3 || segments[len(segments)-3] != "ext" {
+				return nil, false, nil
+			}
+			if segments[0] == "missing" {
+				return nil, true, server.ErrNotFound
+			}
+			return []skymsg.Service{{Host: "10.0.0.1"}}, true, nil
+		}),
+	}
+	s := newExternalNameService()
+	require.NoError(t, kd.servicesStore.Add(s))
+	kd.newService(s)
+
+	records, err := kd.Records("foo.ext.cluster.local.", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1"}, hosts(records))
+
+	_, err = kd.Records("missing.ext.cluster.local.", false)
+	assert.True(t, errors.Is(err, server.ErrNotFound), "got %v", err)
+
+	// The names the provider does not handle are the services and pods of
+	// the cluster.
+	records, err = kd.Records(testService+"."+testNamespace+".svc.cluster.local.", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{testExternalName}, hosts(records))
+
+	// The federations are answered by the built-in providers, ahead of
+	// ZoneProviders.
+	queried = nil
+	records, err = kd.Records("mysvc.myns.myfederation.svc.cluster.local.", false)
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+	assert.Empty(t, queried)
+}
+
+func TestMultiClusterZone(t *testing.T) {
+	kd := newKubeDNS()
+	kd.multiClusterPath = []string{"local", "clusterset"}
+	kd.cacheLock.Lock()
+	kd.cache.SetEntry("1", &skymsg.Service{Host: "10.0.0.2"}, "", "local", "clusterset", "pod", "ns", "name")
+	kd.unlockCache()
+
+	// The clusterset has no pod subdomain, its names are in the cache.
+	records, err := kd.Records("name.ns.pod.clusterset.local.", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2"}, hosts(records))
+
+	_, err = kd.Records("other.ns.svc.clusterset.local.", false)
+	assert.True(t, errors.Is(err, server.ErrNotFound), "got %v", err)
+}
@@ -25,7 +25,10 @@ import (
 	"os/exec"
 	"strings"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/dns/pkg/configcheck"
 	"k8s.io/dns/pkg/dns/config"
+	"k8s.io/dns/pkg/httpaccess"
 	"k8s.io/klog/v2"
 )
 
@@ -106,6 +109,12 @@ func (n *Nanny) Configure(args []string, config *config.Config, kubednsServer st
 		}
 	}
 
+	// kubedns answers the fallthrough zones, forwarding the names it does
+	// not know itself, and the namespace domains.
+	for _, zone := range config.KubeDNSZones() {
+		n.args = append(n.args, "--server", fmt.Sprintf("/%v/%v", zone, munge(kubednsServer)))
+	}
+
 	for _, server := range config.UpstreamNameservers {
 		// dnsmasq port separator is '#' for some reason.
 		server = munge(server)
@@ -168,6 +177,16 @@ func (n *Nanny) Start() error {
 	return nil
 }
 
+// Test checks the arguments of dnsmasq with its --test option, without
+// starting it.
+func (n *Nanny) Test() error {
+	out, err := exec.Command(n.Exec, append(n.args, "--test")...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
 // Kill the running Nanny.
 func (n *Nanny) Kill() error {
 	klog.V(0).Infof("Killing dnsmasq")
@@ -193,6 +212,31 @@ type RunNannyOpts struct {
 	DnsmasqArgs []string
 	// Restart the daemon on ConfigMap changes.
 	RestartOnChange bool
+	// Address to serve the metrics of the nanny on, disabled if empty.
+	MetricsAddress string
+	// Restricts the access to the metrics endpoint.
+	MetricsAccess httpaccess.Config
+}
+
+// ValidateNanny checks the configuration and the dnsmasq arguments built from
+// it, for --validateOnly.
+func ValidateNanny(sync config.Sync, opts RunNannyOpts, kubednsServer string, report *configcheck.Report) {
+	currentConfig, err := sync.Once()
+	report.Check("configuration", err)
+	if err != nil {
+		return
+	}
+
+	_, err = httpaccess.New(opts.MetricsAccess)
+	report.Check("access to the metrics endpoint", err)
+
+	if _, err := exec.LookPath(opts.DnsmasqExec); err != nil {
+		report.Skip("dnsmasq arguments", fmt.Sprintf("%s is not available: %v", opts.DnsmasqExec, err))
+		return
+	}
+	nanny := &Nanny{Exec: opts.DnsmasqExec}
+	nanny.Configure(opts.DnsmasqArgs, currentConfig, kubednsServer)
+	report.Check(fmt.Sprintf("dnsmasq arguments %v", nanny.args), nanny.Test())
 }
 
 // RunNanny runs the nanny and handles configuration updates.
@@ -205,11 +249,21 @@ func RunNanny(sync config.Sync, opts RunNannyOpts, kubednsServer string) {
 		currentConfig = config.NewDefaultConfig()
 	}
 
+	registry := prometheus.NewRegistry()
+	metrics := newNannyMetrics(registry)
+	if opts.MetricsAddress != "" {
+		if err := serveNannyMetrics(opts.MetricsAddress, opts.MetricsAccess, registry); err != nil {
+			klog.Fatalf("Could not serve the nanny metrics: %v", err)
+		}
+	}
+
 	nanny := &Nanny{Exec: opts.DnsmasqExec}
 	nanny.Configure(opts.DnsmasqArgs, currentConfig, kubednsServer)
+	metrics.configRewrites.Inc()
 	if err := nanny.Start(); err != nil {
 		klog.Fatalf("Could not start dnsmasq with initial configuration: %v", err)
 	}
+	metrics.applied(nanny.cmd.Process.Pid)
 
 	configChan := sync.Periodic()
 
@@ -223,9 +277,16 @@ func RunNanny(sync config.Sync, opts RunNannyOpts, kubednsServer string) {
 			if opts.RestartOnChange {
 				klog.V(0).Infof("Restarting dnsmasq with new configuration")
 				nanny.Kill()
+				metrics.stopped()
 				nanny = &Nanny{Exec: opts.DnsmasqExec}
 				nanny.Configure(opts.DnsmasqArgs, currentConfig, kubednsServer)
-				nanny.Start()
+				metrics.configRewrites.Inc()
+				metrics.restarts.Inc()
+				if err := nanny.Start(); err != nil {
+					klog.Errorf("Could not restart dnsmasq with new configuration: %v", err)
+				} else {
+					metrics.applied(nanny.cmd.Process.Pid)
+				}
 			} else {
 				klog.V(2).Infof("Not restarting dnsmasq (--restartDnsmasq=false)")
 			}
@@ -0,0 +1,144 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dnsmasq
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/procfs"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/httpaccess"
+)
+
+const (
+	nannyNamespace = "dnsmasq"
+	nannySubsystem = "nanny"
+)
+
+// nannyMetrics are the metrics of the nanny itself, as opposed to the
+// statistics of dnsmasq exported by the sidecar.
+type nannyMetrics struct {
+	configRewrites prometheus.Counter
+	restarts       prometheus.Counter
+
+	lock sync.Mutex
+	// lastApply is when dnsmasq was last started with a new configuration.
+	lastApply time.Time
+	// pid is the process ID of the running dnsmasq, 0 if none.
+	pid int
+}
+
+func newNannyMetrics(registry prometheus.Registerer) *nannyMetrics {
+	m := &nannyMetrics{
+		configRewrites: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: nannyNamespace,
+			Subsystem: nannySubsystem,
+			Name:      "config_rewrites_total",
+			Help:      "Number of times the dnsmasq arguments were rewritten from the configuration",
+		}),
+		restarts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: nannyNamespace,
+			Subsystem: nannySubsystem,
+			Name:      "dnsmasq_restarts_total",
+			Help:      "Number of times dnsmasq was restarted on a configuration change",
+		}),
+	}
+	registry.MustRegister(m.configRewrites, m.restarts,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: nannyNamespace,
+			Subsystem: nannySubsystem,
+			Name:      "seconds_since_last_config_apply",
+			Help:      "Seconds since dnsmasq was last started successfully with a new configuration",
+		}, m.sinceLastApply),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: nannyNamespace,
+			Subsystem: nannySubsystem,
+			Name:      "dnsmasq_resident_memory_bytes",
+			Help:      "Resident set size of the dnsmasq process, 0 if it is not running",
+		}, m.residentMemory))
+	return m
+}
+
+// applied records that dnsmasq was started with a new configuration as pid.
+func (m *nannyMetrics) applied(pid int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lastApply = time.Now()
+	m.pid = pid
+}
+
+// stopped records that dnsmasq is no longer running.
+func (m *nannyMetrics) stopped() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.pid = 0
+}
+
+func (m *nannyMetrics) sinceLastApply() float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.lastApply.IsZero() {
+		return 0
+	}
+	return time.Since(m.lastApply).Seconds()
+}
+
+func (m *nannyMetrics) residentMemory() float64 {
+	m.lock.Lock()
+	pid := m.pid
+	m.lock.Unlock()
+	if pid == 0 {
+		return 0
+	}
+	proc, err := procfs.NewProc(pid)
+	if err != nil {
+		klog.V(2).Infof("Failed to find dnsmasq process %d: %v", pid, err)
+		return 0
+	}
+	stat, err := proc.Stat()
+	if err != nil {
+		klog.V(2).Infof("Failed to read the stats of dnsmasq process %d: %v", pid, err)
+		return 0
+	}
+	return float64(stat.ResidentMemory())
+}
+
+// serveNannyMetrics serves the metrics gathered by registry on addr.
+func serveNannyMetrics(addr string, access httpaccess.Config, registry prometheus.Gatherer) error {
+	admin, err := httpaccess.New(access)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	go func() {
+		if err := admin.Serve(ln, mux); err != nil {
+			klog.Errorf("Error serving the nanny metrics: %v", err)
+		}
+	}()
+	return nil
+}
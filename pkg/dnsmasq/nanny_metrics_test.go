@@ -0,0 +1,72 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dnsmasq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func gatherNannyMetrics(registry *prometheus.Registry) map[string]float64 {
+	families, err := registry.Gather()
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	values := make(map[string]float64)
+	for _, family := range families {
+		metric := family.GetMetric()[0]
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			values[family.GetName()] = metric.GetCounter().GetValue()
+		case dto.MetricType_GAUGE:
+			values[family.GetName()] = metric.GetGauge().GetValue()
+		}
+	}
+	return values
+}
+
+func TestNannyMetrics(t *testing.T) {
+	gomega.RegisterTestingT(t)
+
+	registry := prometheus.NewRegistry()
+	metrics := newNannyMetrics(registry)
+	values := gatherNannyMetrics(registry)
+	gomega.Expect(values["dnsmasq_nanny_seconds_since_last_config_apply"]).To(gomega.BeZero())
+	gomega.Expect(values["dnsmasq_nanny_dnsmasq_resident_memory_bytes"]).To(gomega.BeZero())
+
+	nanny := &Nanny{Exec: "../../test/fixtures/mock-dnsmasq.sh"}
+	nanny.Configure([]string{"--runForever"}, &config.Config{}, "127.0.0.1:10053")
+	metrics.configRewrites.Inc()
+	gomega.Expect(nanny.Start()).To(gomega.Succeed())
+	metrics.applied(nanny.cmd.Process.Pid)
+	time.Sleep(50 * time.Millisecond)
+
+	values = gatherNannyMetrics(registry)
+	gomega.Expect(values["dnsmasq_nanny_config_rewrites_total"]).To(gomega.Equal(1.0))
+	gomega.Expect(values["dnsmasq_nanny_dnsmasq_restarts_total"]).To(gomega.BeZero())
+	gomega.Expect(values["dnsmasq_nanny_seconds_since_last_config_apply"]).To(gomega.BeNumerically(">", 0))
+	gomega.Expect(values["dnsmasq_nanny_dnsmasq_resident_memory_bytes"]).To(gomega.BeNumerically(">", 0))
+
+	gomega.Expect(nanny.Kill()).To(gomega.Succeed())
+	metrics.stopped()
+	values = gatherNannyMetrics(registry)
+	gomega.Expect(values["dnsmasq_nanny_dnsmasq_resident_memory_bytes"]).To(gomega.BeZero())
+}
@@ -17,10 +17,13 @@ limitations under the License.
 package dnsmasq
 
 import (
+	"bytes"
+	"errors"
 	"sort"
 	"testing"
 	"time"
 
+	"k8s.io/dns/pkg/configcheck"
 	"k8s.io/dns/pkg/dns/config"
 
 	"github.com/onsi/gomega"
@@ -63,6 +66,24 @@ func TestNannyConfig(t *testing.T) {
 		sort bool
 	}{
 		{c: &config.Config{}, e: []string{"--abc"}},
+		{
+			c: &config.Config{
+				FallthroughZones: map[string][]string{
+					"corp.example.com": {"10.0.0.1"},
+					"eu.example.com":   {},
+				},
+				NamespaceDomains: map[string]string{"team-a": "team-a.legacy.example"},
+			},
+			e: []string{
+				"--abc",
+				"--server",
+				"/corp.example.com/127.0.0.1#10053",
+				"--server",
+				"/eu.example.com/127.0.0.1#10053",
+				"--server",
+				"/team-a.legacy.example/127.0.0.1#10053",
+			},
+		},
 		{
 			c: &config.Config{
 				StubDomains: map[string][]string{
@@ -164,3 +185,28 @@ func TestNannyLifecycle(t *testing.T) {
 	gomega.Expect(nanny.Kill()).To(gomega.Succeed())
 	gomega.Expect(nanny.Kill()).NotTo(gomega.Succeed())
 }
+
+func TestValidateNanny(t *testing.T) {
+	gomega.RegisterTestingT(t)
+
+	validate := func(sync config.Sync, args ...string) (string, bool) {
+		var out bytes.Buffer
+		report := configcheck.NewReport(&out)
+		opts := RunNannyOpts{DnsmasqExec: "../../test/fixtures/mock-dnsmasq.sh", DnsmasqArgs: args}
+		ValidateNanny(sync, opts, "127.0.0.1:10053", report)
+		return out.String(), report.Failed()
+	}
+
+	upstreams := &config.Config{UpstreamNameservers: []string{"1.2.3.4"}}
+	out, failed := validate(config.NewMockSync(upstreams, nil), "--exitWithSuccess")
+	gomega.Expect(failed).To(gomega.BeFalse(), out)
+	gomega.Expect(out).To(gomega.ContainSubstring("--server 1.2.3.4"))
+
+	out, failed = validate(config.NewMockSync(upstreams, nil), "--exitWithError")
+	gomega.Expect(failed).To(gomega.BeTrue(), out)
+	gomega.Expect(out).To(gomega.ContainSubstring("exitWithError"))
+
+	out, failed = validate(config.NewMockSync(nil, errors.New("invalid stub domain")), "--exitWithSuccess")
+	gomega.Expect(failed).To(gomega.BeTrue(), out)
+	gomega.Expect(out).To(gomega.ContainSubstring("FAIL  configuration: invalid stub domain"))
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package effectiveconfig reports the configuration a process runs with:
+// the flags, the dynamic configuration from the kube-dns ConfigMap and the
+// defaults, each field attributed to where its value came from.
+package effectiveconfig
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+// Path is the path of the endpoint serving the effective configuration.
+const Path = "/config/effective"
+
+// Source is where the value of a field came from.
+type Source string
+
+const (
+	// Default is the value of a field that was not set.
+	Default Source = "default"
+	// Flag is the value of a field set on the command line.
+	Flag Source = "flag"
+	// ConfigMap is the value of a field set in the kube-dns ConfigMap,
+	// or in the directory it is mounted at.
+	ConfigMap Source = "configmap"
+)
+
+// Field is the value of a field in effect and its source.
+type Field struct {
+	Value  interface{} `json:"value"`
+	Source Source      `json:"source"`
+}
+
+// Config is the effective configuration, by field name: the names of the
+// flags and the keys of the ConfigMap.
+type Config map[string]Field
+
+// AddFlags adds the flags of fs, with the values they were parsed to.
+func (c Config) AddFlags(fs *pflag.FlagSet) {
+	fs.VisitAll(func(f *pflag.Flag) {
+		source := Default
+		if f.Changed {
+			source = Flag
+		}
+		c[f.Name] = Field{Value: f.Value.String(), Source: source}
+	})
+}
+
+// AddGoFlags adds the flags of fs, with the values they were parsed to.
+func (c Config) AddGoFlags(fs *flag.FlagSet) {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	fs.VisitAll(func(f *flag.Flag) {
+		source := Default
+		if set[f.Name] {
+			source = Flag
+		}
+		c[f.Name] = Field{Value: f.Value.String(), Source: source}
+	})
+}
+
+// AddConfig adds the fields of the dynamic configuration, by ConfigMap key.
+// The fields set are attributed to source and override the flags of the
+// same name, e.g. federations; the others are defaults, unless a flag of
+// the same name was already added.
+func (c Config) AddConfig(dnsConfig *config.Config, source Source) {
+	if dnsConfig == nil {
+		dnsConfig = &config.Config{}
+	}
+	v := reflect.ValueOf(*dnsConfig)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.Anonymous || name == "" || name == "-" {
+			continue
+		}
+		value := v.Field(i)
+		if isSet(value) {
+			c[name] = Field{Value: value.Interface(), Source: source}
+		} else if _, ok := c[name]; !ok {
+			c[name] = Field{Value: value.Interface(), Source: Default}
+		}
+	}
+}
+
+// isSet returns whether value is set, empty maps and slices being unset.
+func isSet(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Map, reflect.Slice:
+		return value.Len() > 0
+	}
+	return !value.IsZero()
+}
+
+// Handler serves the configuration returned by effective as JSON.
+func Handler(effective func() Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(effective()); err != nil {
+			klog.Errorf("Failed to write the effective configuration: %v", err)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package effectiveconfig
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/dns/pkg/dns/config"
+)
+
+func TestAddFlags(t *testing.T) {
+	fs := pflag.NewFlagSet("kube-dns", pflag.ContinueOnError)
+	fs.String("domain", "cluster.local.", "")
+	fs.Int("dns-port", 53, "")
+	fs.StringToString("federations", nil, "")
+	require.NoError(t, fs.Parse([]string{"--dns-port=10053", "--federations=fed=fed.example.com"}))
+
+	effective := Config{}
+	effective.AddFlags(fs)
+	effective.AddConfig(&config.Config{
+		StubDomains:         map[string][]string{"acme.local": {"1.2.3.4"}},
+		UpstreamNameservers: []string{},
+	}, Flag)
+	assert.Equal(t, Field{Value: "cluster.local.", Source: Default}, effective["domain"])
+	assert.Equal(t, Field{Value: "10053", Source: Flag}, effective["dns-port"])
+	// The ConfigMap does not set the federations of the flag.
+	assert.Equal(t, Flag, effective["federations"].Source)
+	assert.Equal(t, Field{Value: map[string][]string{"acme.local": {"1.2.3.4"}}, Source: Flag}, effective["stubDomains"])
+	assert.Equal(t, Default, effective["upstreamNameservers"].Source)
+	assert.NotContains(t, effective, "TypeMeta")
+	assert.NotContains(t, effective, "kind")
+}
+
+func TestAddGoFlags(t *testing.T) {
+	fs := flag.NewFlagSet("node-cache", flag.ContinueOnError)
+	fs.String("localip", "", "")
+	fs.String("corefile", "/etc/Corefile", "")
+	require.NoError(t, fs.Parse([]string{"-localip=169.254.20.10"}))
+
+	effective := Config{}
+	effective.AddGoFlags(fs)
+	effective.AddConfig(&config.Config{Federations: map[string]string{"fed": "fed.example.com"}}, ConfigMap)
+	assert.Equal(t, Field{Value: "169.254.20.10", Source: Flag}, effective["localip"])
+	assert.Equal(t, Field{Value: "/etc/Corefile", Source: Default}, effective["corefile"])
+	assert.Equal(t, Field{Value: map[string]string{"fed": "fed.example.com"}, Source: ConfigMap}, effective["federations"])
+}
+
+func TestHandler(t *testing.T) {
+	effective := Config{}
+	effective.AddConfig(nil, ConfigMap)
+	w := httptest.NewRecorder()
+	Handler(func() Config { return effective }).ServeHTTP(w, httptest.NewRequest("GET", Path, nil))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var got map[string]struct {
+		Value  interface{}
+		Source Source
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Equal(t, Default, got["stubDomains"].Source)
+	assert.Len(t, got, len(effective))
+}
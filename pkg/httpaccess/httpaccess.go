@@ -0,0 +1,257 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package httpaccess restricts who can reach the HTTP listeners: by source
+// IP, and optionally by client certificate or bearer token.
+package httpaccess
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/reuseport"
+	"github.com/spf13/pflag"
+)
+
+// Config restricts the access to an HTTP listener. The zero value allows
+// every client over plain HTTP, to read only: the requests changing the
+// state of the server, to the AdminPath endpoints with a method other than
+// GET or HEAD, are refused unless AllowedCIDRs or ClientCAFile are set.
+type Config struct {
+	// AllowedCIDRs, if not empty, are the only source networks allowed.
+	// They must include the node addresses for the kubelet probes to pass.
+	AllowedCIDRs []string
+	// CertFile and KeyFile, if set, serve over TLS.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, if set, requires client certificates signed by one of
+	// its CAs. Requires CertFile and KeyFile.
+	ClientCAFile string
+	// ReusePort sets SO_REUSEPORT on the listeners of ListenAndServe, so
+	// that a replacement process can bind them before this one exits.
+	ReusePort bool
+}
+
+// AdminPath is the prefix of the paths of the admin endpoints.
+const AdminPath = "/admin/"
+
+// Guard enforces a Config.
+type Guard struct {
+	nets      []*net.IPNet
+	tlsConfig *tls.Config
+	reusePort bool
+}
+
+// New returns a Guard enforcing config, or an error if it is invalid or its
+// files cannot be loaded.
+func New(config Config) (*Guard, error) {
+	g := &Guard{reusePort: config.ReusePort}
+	for _, cidr := range config.AllowedCIDRs {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed CIDR %q: %w", cidr, err)
+		}
+		g.nets = append(g.nets, ipNet)
+	}
+
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, fmt.Errorf("both a TLS certificate and key are needed")
+	}
+	if config.ClientCAFile != "" && config.CertFile == "" {
+		return nil, fmt.Errorf("a client CA requires a TLS certificate and key")
+	}
+	if config.CertFile == "" {
+		return g, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the TLS certificate: %w", err)
+	}
+	g.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.ClientCAFile != "" {
+		pem, err := os.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in the client CA %q", config.ClientCAFile)
+		}
+		g.tlsConfig.ClientCAs = pool
+		g.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return g, nil
+}
+
+// Allowed returns whether a client with the given address, as found in
+// http.Request.RemoteAddr, may be served.
+func (g *Guard) Allowed(remoteAddr string) bool {
+	if len(g.nets) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range g.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Restricted returns whether the clients are restricted, by source network
+// or by client certificate.
+func (g *Guard) Restricted() bool {
+	return len(g.nets) > 0 || (g.tlsConfig != nil && g.tlsConfig.ClientCAs != nil)
+}
+
+// Handler returns h, rejecting the requests of clients that are not allowed
+// with 403 Forbidden, as well as the requests changing the state of the
+// server if the clients are not restricted.
+func (g *Guard) Handler(h http.Handler) http.Handler {
+	restricted := g.Restricted()
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !g.Allowed(req.RemoteAddr) || (!restricted && mutating(req)) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// Restrict returns h, refusing its requests with 403 Forbidden if the
+// clients are not restricted, for the endpoints disclosing what any client
+// of the port is not to read, e.g. the records of the cluster. It is to be
+// served through Handler.
+func (g *Guard) Restrict(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !g.Restricted() {
+			http.Error(w, "forbidden: the clients are not restricted", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// mutating returns whether req may change the state of the server: a
+// request to an admin endpoint with a method other than GET or HEAD.
+func mutating(req *http.Request) bool {
+	if !strings.HasPrefix(req.URL.Path, AdminPath) {
+		return false
+	}
+	return req.Method != http.MethodGet && req.Method != http.MethodHead
+}
+
+// Serve serves h on ln, over TLS if configured, to the allowed clients.
+func (g *Guard) Serve(ln net.Listener, h http.Handler) error {
+	srv := &http.Server{Handler: g.Handler(h), TLSConfig: g.tlsConfig}
+	if g.tlsConfig != nil {
+		// The certificates are in TLSConfig already.
+		return srv.ServeTLS(ln, "", "")
+	}
+	return srv.Serve(ln)
+}
+
+// ListenAndServe listens on the TCP address addr and serves h, like
+// http.ListenAndServe. h is http.DefaultServeMux if nil.
+func (g *Guard) ListenAndServe(addr string, h http.Handler) error {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	ln, err := g.Listen(addr)
+	if err != nil {
+		return err
+	}
+	return g.Serve(ln, h)
+}
+
+// Listen listens on the TCP address addr, with SO_REUSEPORT if configured.
+func (g *Guard) Listen(addr string) (net.Listener, error) {
+	if g.reusePort {
+		return reuseport.Listen("tcp", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// TLSConfig returns the TLS configuration of the listeners, nil if they
+// serve in plain text.
+func (g *Guard) TLSConfig() *tls.Config {
+	return g.tlsConfig
+}
+
+// PeerTLSConfig returns the TLS configuration to connect to the other
+// servers enforcing the same Config: the client presents the certificate
+// of the listeners and verifies the server against the client CA. It is
+// nil without a client CA.
+func (g *Guard) PeerTLSConfig() *tls.Config {
+	if g.tlsConfig == nil || g.tlsConfig.ClientCAs == nil {
+		return nil
+	}
+	return &tls.Config{
+		Certificates: g.tlsConfig.Certificates,
+		RootCAs:      g.tlsConfig.ClientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+const (
+	allowedCIDRsUsage = "comma-separated CIDRs of the clients allowed on the healthz, metrics" +
+		" and admin HTTP endpoints. Include the node addresses for the kubelet probes. Empty allows every client to read," +
+		" but refuses the requests changing the state of the server, dumping the cache in another format than its" +
+		" tree and reading the effective configuration unless --admin-client-ca-file is set."
+	certFileUsage     = "if set, serve the healthz, metrics and admin HTTP endpoints over TLS with this certificate."
+	keyFileUsage      = "key of the certificate given with --admin-tls-cert-file."
+	clientCAFileUsage = "if set, require the clients of the healthz, metrics and admin HTTP endpoints" +
+		" to present a certificate signed by one of the CAs in this file. Requires --admin-tls-cert-file."
+)
+
+// AddFlags adds the flags setting c to fs.
+func (c *Config) AddFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(&c.AllowedCIDRs, "admin-allowed-cidrs", c.AllowedCIDRs, allowedCIDRsUsage)
+	fs.StringVar(&c.CertFile, "admin-tls-cert-file", c.CertFile, certFileUsage)
+	fs.StringVar(&c.KeyFile, "admin-tls-key-file", c.KeyFile, keyFileUsage)
+	fs.StringVar(&c.ClientCAFile, "admin-client-ca-file", c.ClientCAFile, clientCAFileUsage)
+}
+
+// AddGoFlags adds the flags setting c to fs, for the binaries using the
+// standard flag package.
+func (c *Config) AddGoFlags(fs *flag.FlagSet) {
+	fs.Func("admin-allowed-cidrs", allowedCIDRsUsage, func(value string) error {
+		c.AllowedCIDRs = strings.Split(value, ",")
+		return nil
+	})
+	fs.StringVar(&c.CertFile, "admin-tls-cert-file", c.CertFile, certFileUsage)
+	fs.StringVar(&c.KeyFile, "admin-tls-key-file", c.KeyFile, keyFileUsage)
+	fs.StringVar(&c.ClientCAFile, "admin-client-ca-file", c.ClientCAFile, clientCAFileUsage)
+}
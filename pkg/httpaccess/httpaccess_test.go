@@ -0,0 +1,253 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httpaccess
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowed(t *testing.T) {
+	g, err := New(Config{AllowedCIDRs: []string{"10.0.0.0/8", " fd00::/8"}})
+	require.NoError(t, err)
+	assert.True(t, g.Allowed("10.1.2.3:4242"))
+	assert.True(t, g.Allowed("[fd00::1]:4242"))
+	assert.False(t, g.Allowed("192.168.0.1:4242"))
+	assert.False(t, g.Allowed("garbage"))
+
+	g, err = New(Config{})
+	require.NoError(t, err)
+	assert.True(t, g.Allowed("192.168.0.1:4242"))
+}
+
+func TestHandler(t *testing.T) {
+	g, err := New(Config{AllowedCIDRs: []string{"10.0.0.0/8"}})
+	require.NoError(t, err)
+	h := g.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	req.RemoteAddr = "10.0.0.1:4242"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req.RemoteAddr = "192.168.0.1:4242"
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestHandlerDefaultConfig(t *testing.T) {
+	g, err := New(Config{})
+	require.NoError(t, err)
+	assert.False(t, g.Restricted())
+	h := g.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	for _, tc := range []struct {
+		method, path string
+		expected     int
+	}{
+		{http.MethodGet, "/admin/forwarders", http.StatusOK},
+		{http.MethodPost, "/readiness", http.StatusOK},
+		// The admin endpoints are read only without restriction.
+		{http.MethodPost, "/admin/forwarders", http.StatusForbidden},
+		{http.MethodDelete, "/admin/acme-challenges", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.RemoteAddr = "192.168.0.1:4242"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, tc.expected, w.Code, "%s %s", tc.method, tc.path)
+	}
+
+	g, err = New(Config{AllowedCIDRs: []string{"10.0.0.0/8"}})
+	require.NoError(t, err)
+	assert.True(t, g.Restricted())
+	h = g.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	req := httptest.NewRequest(http.MethodPost, "/admin/forwarders", nil)
+	req.RemoteAddr = "10.0.0.1:4242"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRestrict(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	for _, tc := range []struct {
+		config   Config
+		expected int
+	}{
+		{Config{}, http.StatusForbidden},
+		{Config{AllowedCIDRs: []string{"10.0.0.0/8"}}, http.StatusOK},
+	} {
+		g, err := New(tc.config)
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodGet, "/config/effective", nil)
+		req.RemoteAddr = "10.0.0.1:4242"
+		w := httptest.NewRecorder()
+		g.Handler(g.Restrict(h)).ServeHTTP(w, req)
+		assert.Equal(t, tc.expected, w.Code, "%+v", tc.config)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, config := range []Config{
+		{AllowedCIDRs: []string{"10.0.0.0"}},
+		{CertFile: "cert.pem"},
+		{ClientCAFile: "ca.pem"},
+		{CertFile: "missing.pem", KeyFile: "missing.pem"},
+	} {
+		_, err := New(config)
+		assert.Error(t, err, "%+v", config)
+	}
+}
+
+// writeCert writes a certificate for name signed by parent, itself if nil,
+// and its key under dir, and returns them along with the file names.
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return cert, key, certFile, keyFile
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := writeCert(t, dir, "ca", nil, nil)
+	_, _, serverCert, serverKey := writeCert(t, dir, "server", ca, caKey)
+	_, _, clientCert, clientKey := writeCert(t, dir, "client", ca, caKey)
+
+	g, err := New(Config{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: caFile})
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go g.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	url := "https://" + ln.Addr().String() + "/admin"
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	_, err = anonymous.Get(url)
+	assert.Error(t, err, "clients without a certificate are rejected")
+
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{cert},
+	}}}
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestPeerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := writeCert(t, dir, "ca", nil, nil)
+	_, _, peerCert, peerKey := writeCert(t, dir, "peer", ca, caKey)
+
+	g, err := New(Config{CertFile: peerCert, KeyFile: peerKey})
+	require.NoError(t, err)
+	assert.Nil(t, g.PeerTLSConfig(), "no peer configuration without a client CA")
+
+	g, err = New(Config{CertFile: peerCert, KeyFile: peerKey, ClientCAFile: caFile})
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go g.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: g.PeerTLSConfig()}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestReusePort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	g, err := New(Config{ReusePort: true})
+	require.NoError(t, err)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- g.ListenAndServe(addr, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+		}()
+	}
+
+	var resp *http.Response
+	for i := 0; i < 100; i++ {
+		if resp, err = http.Get("http://" + addr + "/healthz"); err == nil {
+			resp.Body.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	select {
+	case err := <-errs:
+		t.Fatalf("both listeners should bind the address: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
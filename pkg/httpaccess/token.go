@@ -0,0 +1,183 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httpaccess
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	authenticationclient "k8s.io/client-go/kubernetes/typed/authentication/v1"
+	"k8s.io/klog/v2"
+)
+
+// maxTokenReviews bounds the reviews cached by a TokenReviewer.
+const maxTokenReviews = 1024
+
+// ErrUnauthenticated is returned for the tokens the API server rejects.
+var ErrUnauthenticated = errors.New("invalid bearer token")
+
+// TokenReviewer authenticates the bearer tokens of HTTP requests with the
+// TokenReview API, e.g. the tokens of users querying from off the cluster.
+// The reviews are cached, so that the API server is not called for every
+// request.
+type TokenReviewer struct {
+	client authenticationclient.TokenReviewInterface
+	// audiences, if not empty, are the audiences the tokens must be
+	// issued for.
+	audiences []string
+	// groups, if not empty, are the groups allowed, one of which the
+	// users must be in.
+	groups []string
+	ttl    time.Duration
+	now    func() time.Time
+
+	lock    sync.Mutex
+	reviews map[[sha256.Size]byte]tokenReview
+}
+
+// tokenReview is the cached review of a token.
+type tokenReview struct {
+	user    *authenticationv1.UserInfo
+	expires time.Time
+}
+
+// NewTokenReviewer returns a TokenReviewer creating TokenReviews with
+// client, and caching them for ttl.
+func NewTokenReviewer(client authenticationclient.TokenReviewInterface, audiences, groups []string, ttl time.Duration) *TokenReviewer {
+	return &TokenReviewer{
+		client:    client,
+		audiences: audiences,
+		groups:    groups,
+		ttl:       ttl,
+		now:       time.Now,
+		reviews:   make(map[[sha256.Size]byte]tokenReview),
+	}
+}
+
+// Authenticate returns the user token was issued to, or ErrUnauthenticated
+// if it is not valid.
+func (r *TokenReviewer) Authenticate(ctx context.Context, token string) (*authenticationv1.UserInfo, error) {
+	// Only the hashes of the tokens are kept.
+	key := sha256.Sum256([]byte(token))
+	now := r.now()
+	r.lock.Lock()
+	review, ok := r.reviews[key]
+	r.lock.Unlock()
+	if !ok || now.After(review.expires) {
+		tr, err := r.client.Create(ctx, &authenticationv1.TokenReview{
+			Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: r.audiences},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to review the token: %w", err)
+		}
+		// Rejected tokens are cached as well, not to call the API server
+		// for every request of a client retrying with a bad token.
+		review = tokenReview{expires: now.Add(r.ttl)}
+		if tr.Status.Authenticated {
+			review.user = &tr.Status.User
+		}
+		r.cache(key, review)
+	}
+	if review.user == nil {
+		return nil, ErrUnauthenticated
+	}
+	return review.user, nil
+}
+
+// cache adds a review to the cache, dropping the expired ones when it is
+// full.
+func (r *TokenReviewer) cache(key [sha256.Size]byte, review tokenReview) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.reviews) >= maxTokenReviews {
+		now := r.now()
+		for k, cached := range r.reviews {
+			if now.After(cached.expires) {
+				delete(r.reviews, k)
+			}
+		}
+		if len(r.reviews) >= maxTokenReviews {
+			r.reviews = make(map[[sha256.Size]byte]tokenReview)
+		}
+	}
+	r.reviews[key] = review
+}
+
+// inGroups returns whether user is in one of the allowed groups.
+func (r *TokenReviewer) inGroups(user *authenticationv1.UserInfo) bool {
+	if len(r.groups) == 0 {
+		return true
+	}
+	for _, group := range user.Groups {
+		for _, allowed := range r.groups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Handler returns h, rejecting the requests without a valid bearer token
+// with 401 Unauthorized, and those of the users that are not in the
+// allowed groups with 403 Forbidden.
+func (r *TokenReviewer) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token := BearerToken(req)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kube-dns"`)
+			http.Error(w, "bearer token required", http.StatusUnauthorized)
+			return
+		}
+		user, err := r.Authenticate(req.Context(), token)
+		switch {
+		case errors.Is(err, ErrUnauthenticated):
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kube-dns", error="invalid_token"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case err != nil:
+			klog.Errorf("Failed to authenticate a request from %s: %v", req.RemoteAddr, err)
+			http.Error(w, "authentication unavailable", http.StatusServiceUnavailable)
+			return
+		case !r.inGroups(user):
+			klog.V(2).Infof("Rejected a request of %q from %s: not in the allowed groups", user.Username, req.RemoteAddr)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		klog.V(4).Infof("Serving %s %s to %q from %s", req.Method, req.URL.Path, user.Username, req.RemoteAddr)
+		h.ServeHTTP(w, req)
+	})
+}
+
+// BearerToken returns the bearer token of the Authorization header of req,
+// empty if there is none.
+func BearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	if token == auth {
+		return ""
+	}
+	return token
+}
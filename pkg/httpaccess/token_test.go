@@ -0,0 +1,115 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httpaccess
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newFakeTokenReviewer returns a TokenReviewer of a fake API server that
+// authenticates the tokens in users, and counts its reviews.
+func newFakeTokenReviewer(users map[string]authenticationv1.UserInfo, reviews *int, groups ...string) *TokenReviewer {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		*reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "unavailable" {
+			return true, nil, fmt.Errorf("connection refused")
+		}
+		user, ok := users[review.Spec.Token]
+		review.Status = authenticationv1.TokenReviewStatus{Authenticated: ok, User: user}
+		return true, review, nil
+	})
+	return NewTokenReviewer(client.AuthenticationV1().TokenReviews(), nil, groups, time.Minute)
+}
+
+func TestTokenReviewerAuthenticate(t *testing.T) {
+	reviews := 0
+	r := newFakeTokenReviewer(map[string]authenticationv1.UserInfo{"good": {Username: "alice"}}, &reviews)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	user, err := r.Authenticate(context.Background(), "good")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", user.Username)
+	_, err = r.Authenticate(context.Background(), "bad")
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+	_, err = r.Authenticate(context.Background(), "unavailable")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrUnauthenticated)
+	assert.Equal(t, 3, reviews)
+
+	// The reviews, but for the failed ones, are cached until they expire.
+	_, err = r.Authenticate(context.Background(), "good")
+	require.NoError(t, err)
+	_, err = r.Authenticate(context.Background(), "bad")
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+	assert.Equal(t, 3, reviews)
+	_, err = r.Authenticate(context.Background(), "unavailable")
+	assert.Error(t, err)
+	assert.Equal(t, 4, reviews)
+
+	now = now.Add(2 * time.Minute)
+	_, err = r.Authenticate(context.Background(), "good")
+	require.NoError(t, err)
+	assert.Equal(t, 5, reviews)
+}
+
+func TestTokenReviewerHandler(t *testing.T) {
+	reviews := 0
+	r := newFakeTokenReviewer(map[string]authenticationv1.UserInfo{
+		"sre":       {Username: "alice", Groups: []string{"system:authenticated", "sre"}},
+		"developer": {Username: "bob", Groups: []string{"system:authenticated"}},
+	}, &reviews, "sre")
+	h := r.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	for _, tc := range []struct {
+		authorization string
+		code          int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Basic c3JlOnNyZQ==", http.StatusUnauthorized},
+		{"Bearer ", http.StatusUnauthorized},
+		{"Bearer bad", http.StatusUnauthorized},
+		{"Bearer unavailable", http.StatusServiceUnavailable},
+		{"Bearer developer", http.StatusForbidden},
+		{"Bearer sre", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, tc.code, w.Code, "Authorization: %q", tc.authorization)
+		if tc.code == http.StatusUnauthorized {
+			assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Bearer")
+		}
+	}
+}
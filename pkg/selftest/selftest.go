@@ -0,0 +1,258 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package selftest runs a battery of lookups against a kube-dns server
+// backed by a fake clientset holding fixture objects, for the self-test
+// subcommands of kube-dns and node-cache.
+package selftest
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"k8s.io/dns/pkg/configcheck"
+	kdns "k8s.io/dns/pkg/dns"
+	"k8s.io/dns/pkg/dns/config"
+	"k8s.io/dns/third_party/forked/skydns/server"
+)
+
+const (
+	// Namespace is the namespace of the fixture objects.
+	Namespace = "default"
+	// Federation is the name of the federation of the fixture
+	// configuration, and FederationDomain its domain.
+	Federation       = "selftest-fed"
+	FederationDomain = "fed.example.com"
+
+	serviceIPv4  = "10.0.0.10"
+	serviceIPv6  = "fd00::10"
+	endpointIP   = "10.1.0.5"
+	headlessIP   = "10.1.0.6"
+	remoteIP     = "192.0.2.1"
+	nodeZone     = "zone-a"
+	nodeRegion   = "region-1"
+	syncTimeout  = 10 * time.Second
+	queryTimeout = 2 * time.Second
+)
+
+// Objects returns the fixture objects: a dual-stack service "web" with a
+// named port and endpoints, a headless service "db" with a hostname, and a
+// node with the zone and region labels used by federation queries.
+func Objects() []runtime.Object {
+	dualStack := v1.IPFamilyPolicyPreferDualStack
+	return []runtime.Object{
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: Namespace},
+			Spec: v1.ServiceSpec{
+				Type:           v1.ServiceTypeClusterIP,
+				ClusterIP:      serviceIPv4,
+				ClusterIPs:     []string{serviceIPv4, serviceIPv6},
+				IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+				IPFamilyPolicy: &dualStack,
+				Ports:          []v1.ServicePort{{Name: "http", Protocol: v1.ProtocolTCP, Port: 80}},
+			},
+		},
+		&v1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: Namespace},
+			Subsets: []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{IP: endpointIP}},
+				Ports:     []v1.EndpointPort{{Name: "http", Protocol: v1.ProtocolTCP, Port: 8080}},
+			}},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: Namespace},
+			Spec: v1.ServiceSpec{
+				Type:      v1.ServiceTypeClusterIP,
+				ClusterIP: v1.ClusterIPNone,
+				Ports:     []v1.ServicePort{{Name: "sql", Protocol: v1.ProtocolTCP, Port: 5432}},
+			},
+		},
+		&v1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: Namespace},
+			Subsets: []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{IP: headlessIP, Hostname: "db-0"}},
+				Ports:     []v1.EndpointPort{{Name: "sql", Protocol: v1.ProtocolTCP, Port: 5432}},
+			}},
+		},
+		&v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "node-0",
+				Labels: map[string]string{
+					v1.LabelZoneFailureDomain: nodeZone,
+					v1.LabelZoneRegion:        nodeRegion,
+				},
+			},
+		},
+	}
+}
+
+// Lookup is a query of the battery, which passes if one of the records of
+// the answer contains Want.
+type Lookup struct {
+	What  string
+	Name  string
+	Qtype uint16
+	Want  string
+}
+
+// Lookups returns the battery of lookups for the fixture objects in domain.
+func Lookups(domain string) []Lookup {
+	domain = dns.Fqdn(domain)
+	web := "web." + Namespace + ".svc." + domain
+	federated := Namespace + "." + Federation + ".svc." + domain
+	return []Lookup{
+		{"A", web, dns.TypeA, serviceIPv4},
+		{"AAAA", web, dns.TypeAAAA, serviceIPv6},
+		{"SRV", "_http._tcp." + web, dns.TypeSRV, "80"},
+		{"A headless", "db-0.db." + Namespace + ".svc." + domain, dns.TypeA, headlessIP},
+		{"PTR", "10.0.0.10.in-addr.arpa.", dns.TypePTR, web},
+		{"federation local", "web." + federated, dns.TypeA, web},
+		{"federation remote", "missing." + federated, dns.TypeA,
+			"missing." + Namespace + "." + Federation + ".svc." + nodeZone + "." + nodeRegion + "." + FederationDomain + "."},
+		{"wildcard", "web.*.svc." + domain, dns.TypeA, serviceIPv4},
+	}
+}
+
+// Server is a kube-dns server answering from the fixture objects.
+type Server struct {
+	// Addr is the loopback address the server listens on, over both UDP
+	// and TCP.
+	Addr string
+
+	servers []*dns.Server
+}
+
+// StartKubeDNS starts a kube-dns server for domain on a loopback address,
+// backed by a fake clientset holding the fixture objects. Stop must be
+// called to stop it.
+func StartKubeDNS(domain string) (*Server, error) {
+	client := fake.NewSimpleClientset(Objects()...)
+	configSync := config.NewNopSync(&config.Config{Federations: map[string]string{Federation: FederationDomain}})
+	kd := kdns.NewKubeDNS(client, domain, syncTimeout, configSync)
+	kd.Start()
+
+	s := &Server{}
+	// The names the federation queries are redirected to are answered by
+	// an upstream standing for the other clusters of the federation.
+	remote, err := s.serve(dns.HandlerFunc(answerRemote))
+	if err != nil {
+		return nil, err
+	}
+	cfg := &server.Config{Domain: dns.Fqdn(domain), DnsAddr: "127.0.0.1:0", Nameservers: []string{remote}}
+	if err := server.SetDefaults(cfg); err != nil {
+		s.Stop()
+		return nil, err
+	}
+	if s.Addr, err = s.serve(server.New(server.NewBackendMux(kd), cfg)); err != nil {
+		s.Stop()
+		return nil, err
+	}
+	return s, nil
+}
+
+// serve serves handler on a loopback address over both UDP and TCP, and
+// returns the address.
+func (s *Server) serve(handler dns.Handler) (string, error) {
+	listener, conn, err := listenLoopback()
+	if err != nil {
+		return "", err
+	}
+	for _, srv := range []*dns.Server{
+		{Listener: listener, Handler: handler},
+		{PacketConn: conn, Handler: handler},
+	} {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+		s.servers = append(s.servers, srv)
+	}
+	return listener.Addr().String(), nil
+}
+
+// Stop stops the server.
+func (s *Server) Stop() {
+	for _, srv := range s.servers {
+		srv.Shutdown()
+	}
+}
+
+// answerRemote answers every A query with remoteIP.
+func answerRemote(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	if len(req.Question) == 1 && req.Question[0].Qtype == dns.TypeA {
+		q := req.Question[0]
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30},
+			A:   net.ParseIP(remoteIP),
+		})
+	}
+	w.WriteMsg(m)
+}
+
+// listenLoopback listens on a loopback port free for both TCP and UDP.
+func listenLoopback() (net.Listener, net.PacketConn, error) {
+	var err error
+	for i := 0; i < 10; i++ {
+		var listener net.Listener
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, nil, err
+		}
+		var conn net.PacketConn
+		conn, err = net.ListenPacket("udp", listener.Addr().String())
+		if err == nil {
+			return listener, conn, nil
+		}
+		listener.Close()
+	}
+	return nil, nil, fmt.Errorf("failed to find a free loopback port: %w", err)
+}
+
+// Run sends each lookup to addr over UDP and records its result in report.
+func Run(addr string, lookups []Lookup, report *configcheck.Report) {
+	client := &dns.Client{Net: "udp", Timeout: queryTimeout}
+	for _, lookup := range lookups {
+		report.Check(fmt.Sprintf("%s %s", lookup.What, strings.TrimSuffix(lookup.Name, ".")), exchange(client, addr, lookup))
+	}
+}
+
+func exchange(client *dns.Client, addr string, lookup Lookup) error {
+	req := new(dns.Msg)
+	req.SetQuestion(lookup.Name, lookup.Qtype)
+	resp, _, err := client.Exchange(req, addr)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("got %s, want %q in the answer", dns.RcodeToString[resp.Rcode], lookup.Want)
+	}
+	for _, rr := range resp.Answer {
+		if strings.Contains(rr.String(), lookup.Want) {
+			return nil
+		}
+	}
+	return fmt.Errorf("got %d record(s) without %q in the answer: %v", len(resp.Answer), lookup.Want, resp.Answer)
+}
@@ -0,0 +1,39 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package selftest
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/dns/pkg/configcheck"
+)
+
+func TestKubeDNS(t *testing.T) {
+	s, err := StartKubeDNS("cluster.local.")
+	require.NoError(t, err)
+	defer s.Stop()
+
+	var out bytes.Buffer
+	report := configcheck.NewReport(&out)
+	Run(s.Addr, Lookups("cluster.local."), report)
+	assert.False(t, report.Failed(), out.String())
+	assert.Contains(t, out.String(), "OK    wildcard web.*.svc.cluster.local\n")
+}
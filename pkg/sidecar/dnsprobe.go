@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -66,6 +67,9 @@ type dnsProbe struct {
 	lastError          error
 	latencyHistogram   prometheus.Histogram
 	errorCount         prometheus.Counter
+	// extendedErrorCount counts the failures by the Extended DNS Error
+	// (RFC 8914) explaining them, if the server sent one.
+	extendedErrorCount *prometheus.CounterVec
 	// loopDelay to use. If set to nil, dnsProbe will use
 	// defaultLoopDelayer.
 	delayer loopDelayer
@@ -106,6 +110,14 @@ func (p *dnsProbe) registerMetrics(options *Options) {
 		Help:      "Count of errors in name resolution of " + p.Label,
 	})
 	prometheus.MustRegister(p.errorCount)
+
+	p.extendedErrorCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: options.PrometheusNamespace,
+		Subsystem: dnsProbeSubsystem,
+		Name:      p.Label + "_extended_errors",
+		Help:      "Count of failed name resolutions of " + p.Label + " by the extended DNS error of the reply",
+	}, []string{"code"})
+	prometheus.MustRegister(p.extendedErrorCount)
 }
 
 func (p *dnsProbe) loop() {
@@ -120,7 +132,10 @@ func (p *dnsProbe) loop() {
 		klog.V(4).Infof("Got response, err=%v after %v", err, latency)
 
 		if err == nil && len(msg.Answer) == 0 {
-			err = fmt.Errorf("no RRs for domain %q", p.Name)
+			err = fmt.Errorf("no RRs for domain %q (%s)", p.Name, p.describeFailure(msg))
+		}
+		if err == nil && p.Expected != "" {
+			err = p.validate(msg)
 		}
 
 		p.update(err, latency)
@@ -146,6 +161,40 @@ func (p *dnsProbe) update(err error, latency time.Duration) {
 	}
 }
 
+// validate checks that a PTR record of the answer points at the expected
+// name.
+func (p *dnsProbe) validate(msg *dns.Msg) error {
+	var names []string
+	for _, rr := range msg.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			if strings.EqualFold(ptr.Ptr, p.Expected) {
+				return nil
+			}
+			names = append(names, ptr.Ptr)
+		}
+	}
+	return fmt.Errorf("%q points at %v, expected %q", p.Name, names, p.Expected)
+}
+
+// describeFailure returns the rcode of a reply without answer and the
+// Extended DNS Errors explaining it, counting them.
+func (p *dnsProbe) describeFailure(msg *dns.Msg) string {
+	description := "rcode " + dns.RcodeToString[msg.Rcode]
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ede, ok := o.(*dns.EDNS0_EDE); ok {
+				code := dns.ExtendedErrorCodeToString[ede.InfoCode]
+				if code == "" {
+					code = fmt.Sprint(ede.InfoCode)
+				}
+				p.extendedErrorCount.WithLabelValues(code).Inc()
+				description += ", " + ede.String()
+			}
+		}
+	}
+	return description
+}
+
 func (p *dnsProbe) msg() (msg *dns.Msg) {
 	msg = new(dns.Msg)
 	msg.Id = dns.Id()
@@ -156,6 +205,8 @@ func (p *dnsProbe) msg() (msg *dns.Msg) {
 		Qtype:  p.Type,
 		Qclass: dns.ClassINET,
 	}
+	// Advertise EDNS0 for the server to explain failures.
+	msg.SetEdns0(dns.DefaultMsgSize, false)
 	return
 }
 
@@ -19,10 +19,12 @@ package sidecar
 import (
 	"fmt"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
+	dto "github.com/prometheus/client_model/go"
 
 	"k8s.io/dns/pkg/test"
 )
@@ -65,7 +67,77 @@ func TestProbeFail(t *testing.T) {
 	testProbe(t, "fail", true, nil)
 }
 
-func testProbe(t *testing.T, name string, hasError bool, callback test.ServerCallback) {
+func TestProbeExtendedError(t *testing.T) {
+	probe := testProbe(t, "ede", true, servfailResponseCallback)
+	probe.lock.Lock()
+	defer probe.lock.Unlock()
+	if err := probe.lastError.Error(); !strings.Contains(err, "rcode SERVFAIL") || !strings.Contains(err, "No Reachable Authority") {
+		t.Errorf("expected the error to explain the SERVFAIL, got %q", err)
+	}
+	metric := &dto.Metric{}
+	if err := probe.extendedErrorCount.WithLabelValues("No Reachable Authority").Write(metric); err != nil {
+		t.Fatal(err)
+	}
+	// The probe may have run again since.
+	if count := metric.GetCounter().GetValue(); count < 1 {
+		t.Errorf("expected an extended error to be counted, got %v", count)
+	}
+}
+
+func TestProbeExpected(t *testing.T) {
+	for _, tc := range []struct {
+		label    string
+		expected string
+		hasError bool
+	}{
+		{"ptr_ok", "kubernetes.default.svc.cluster.local.", false},
+		{"ptr_mismatch", "kube-dns.kube-system.svc.cluster.local.", true},
+	} {
+		server := &test.Server{}
+		addr, port := server.Init(t)
+		go server.Run(ptrResponseCallback)
+
+		delayer := &mockLoopDelayer{sleepDone: make(chan struct{})}
+		options := makeOptions(tc.label, addr, port)
+		options.Probes[0].Name = "1.0.96.10.in-addr.arpa."
+		options.Probes[0].Type = dns.TypePTR
+		options.Probes[0].Expected = tc.expected
+		probe := &dnsProbe{DNSProbeOption: options.Probes[0], delayer: delayer}
+		probe.Start(options)
+		<-delayer.sleepDone
+
+		probe.lock.Lock()
+		if hasError := probe.lastError != nil; hasError != tc.hasError {
+			t.Errorf("%s: expected error %v, got %v", tc.label, tc.hasError, probe.lastError)
+		}
+		probe.lock.Unlock()
+	}
+}
+
+func TestReverseProbeOptions(t *testing.T) {
+	env := map[string]string{
+		"KUBERNETES_SERVICE_HOST": "10.96.0.1",
+		"KUBE_DNS_SERVICE_HOST":   "fd00::a",
+	}
+	options := ReverseProbeOptions("127.0.0.1:53", "cluster.local", time.Second, func(key string) string { return env[key] })
+	if len(options) != 2 {
+		t.Fatalf("expected 2 probes, got %+v", options)
+	}
+	if options[0].Name != "1.0.96.10.in-addr.arpa." || options[0].Expected != "kubernetes.default.svc.cluster.local." ||
+		options[0].Type != dns.TypePTR || options[0].Label != "kubernetes_ptr" {
+		t.Errorf("unexpected kubernetes probe %+v", options[0])
+	}
+	if !strings.HasSuffix(options[1].Name, ".ip6.arpa.") || options[1].Expected != "kube-dns.kube-system.svc.cluster.local." {
+		t.Errorf("unexpected kube-dns probe %+v", options[1])
+	}
+
+	delete(env, "KUBE_DNS_SERVICE_HOST")
+	if options := ReverseProbeOptions("127.0.0.1:53", "cluster.local.", time.Second, func(key string) string { return env[key] }); len(options) != 1 {
+		t.Errorf("expected the probe of kube-dns to be skipped, got %+v", options)
+	}
+}
+
+func testProbe(t *testing.T, name string, hasError bool, callback test.ServerCallback) *dnsProbe {
 	server := &test.Server{}
 	addr, port := server.Init(t)
 
@@ -99,6 +171,7 @@ func testProbe(t *testing.T, name string, hasError bool, callback test.ServerCal
 			t.Errorf("should have no error: %v", probe.lastError)
 		}
 	}
+	return probe
 }
 
 func okResponseCallback(server *test.Server, remoteAddr net.Addr, msg *dns.Msg) {
@@ -117,6 +190,37 @@ func nxResponseCallback(server *test.Server, remoteAddr net.Addr, msg *dns.Msg)
 	}
 }
 
+func ptrResponseCallback(server *test.Server, remoteAddr net.Addr, msg *dns.Msg) {
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	reply.Answer = []dns.RR{&dns.PTR{
+		Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 30},
+		Ptr: "kubernetes.default.svc.cluster.local.",
+	}}
+	bytes, err := reply.Pack()
+	if err != nil {
+		server.T.Fatalf("msg.Pack(): %v", err)
+	}
+	if _, err := server.Conn.WriteTo(bytes, remoteAddr); err != nil {
+		server.T.Fatalf("error sending response: %v", err)
+	}
+}
+
+func servfailResponseCallback(server *test.Server, remoteAddr net.Addr, msg *dns.Msg) {
+	reply := new(dns.Msg)
+	reply.SetRcode(msg, dns.RcodeServerFailure)
+	reply.SetEdns0(dns.DefaultMsgSize, false)
+	opt := reply.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNoReachableAuthority, ExtraText: "timeout"})
+	bytes, err := reply.Pack()
+	if err != nil {
+		server.T.Fatalf("msg.Pack(): %v", err)
+	}
+	if _, err := server.Conn.WriteTo(bytes, remoteAddr); err != nil {
+		server.T.Fatalf("error sending response: %v", err)
+	}
+}
+
 func makeResponsePacket(t *testing.T, id uint16, responses int) []byte {
 	answer, err := dns.NewRR("test.local. 100 IN A 1.2.3.4")
 	if err != nil {
@@ -24,6 +24,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"k8s.io/dns/pkg/dnsmasq"
+	"k8s.io/dns/pkg/httpaccess"
 	"k8s.io/klog/v2"
 )
 
@@ -97,8 +98,12 @@ func InitializeMetrics(options *Options) {
 		fmt.Fprintf(w, "ok (%v)\n", time.Now())
 	})
 
+	admin, err := httpaccess.New(options.Admin)
+	if err != nil {
+		klog.Fatalf("Invalid access configuration of the metrics server: %v", err)
+	}
 	go func() {
-		err := http.ListenAndServe(
+		err := admin.ListenAndServe(
 			fmt.Sprintf("%s:%d", options.PrometheusAddr, options.PrometheusPort), nil)
 		if err != nil {
 			klog.Fatalf("Error starting metrics server: %v", err)
@@ -16,7 +16,15 @@ limitations under the License.
 
 package sidecar
 
-import "time"
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+
+	"k8s.io/dns/pkg/httpaccess"
+)
 
 // DNSProbeOption for periodic DNS health check and latency probes.
 type DNSProbeOption struct {
@@ -30,6 +38,9 @@ type DNSProbeOption struct {
 	Interval time.Duration
 	// Type of Record to query for.
 	Type uint16
+	// Expected, if set, is the name a PTR record of the answer must point
+	// at for the probe to succeed.
+	Expected string
 }
 
 // Options for the daemon
@@ -40,10 +51,19 @@ type Options struct {
 
 	Probes []DNSProbeOption
 
+	// ReverseProbeServer, if set, is the DNS server the reverse lookups
+	// of the well-known services are probed on, see ReverseProbeOptions.
+	ReverseProbeServer   string
+	ReverseProbeInterval time.Duration
+	ClusterDomain        string
+
 	PrometheusAddr      string
 	PrometheusPort      int
 	PrometheusPath      string
 	PrometheusNamespace string
+
+	// Admin restricts the access to the metrics and healthcheck endpoints.
+	Admin httpaccess.Config
 }
 
 // NewOptions creates a new options struct with default values.
@@ -53,9 +73,42 @@ func NewOptions() *Options {
 		DnsMasqPort:           53,
 		DnsMasqPollIntervalMs: 5000,
 
+		ReverseProbeInterval: 5 * time.Second,
+		ClusterDomain:        "cluster.local.",
+
 		PrometheusAddr:      "0.0.0.0",
 		PrometheusPort:      10054,
 		PrometheusPath:      "/metrics",
 		PrometheusNamespace: "kubedns",
 	}
 }
+
+// ReverseProbeOptions returns the probes of the reverse lookups of the
+// ClusterIPs of the kubernetes and kube-dns services, which must point at
+// their names in domain. The ClusterIPs are read from the environment of
+// the sidecar, running in the namespace of kube-dns; the services missing
+// from it are skipped.
+func ReverseProbeOptions(server, domain string, interval time.Duration, getenv func(string) string) []DNSProbeOption {
+	domain = strings.Trim(domain, ".")
+	var options []DNSProbeOption
+	for _, service := range []struct{ label, env, name string }{
+		{"kubernetes_ptr", "KUBERNETES_SERVICE_HOST", "kubernetes.default.svc." + domain + "."},
+		{"kubedns_ptr", "KUBE_DNS_SERVICE_HOST", "kube-dns.kube-system.svc." + domain + "."},
+	} {
+		ip := getenv(service.env)
+		reverse, err := dns.ReverseAddr(ip)
+		if err != nil {
+			klog.Warningf("Not probing the reverse lookup of %s: invalid %s %q", service.name, service.env, ip)
+			continue
+		}
+		options = append(options, DNSProbeOption{
+			Label:    service.label,
+			Server:   server,
+			Name:     reverse,
+			Interval: interval,
+			Type:     dns.TypePTR,
+			Expected: service.name,
+		})
+	}
+	return options
+}
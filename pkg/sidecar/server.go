@@ -18,6 +18,7 @@ package sidecar
 
 import (
 	"math"
+	"os"
 	"time"
 
 	"k8s.io/dns/pkg/dnsmasq"
@@ -45,7 +46,12 @@ func (s *server) Run(options *Options) {
 	s.options = options
 	klog.Infof("Starting server (options %+v)", *s.options)
 
-	for _, probeOption := range options.Probes {
+	probes := options.Probes
+	if options.ReverseProbeServer != "" {
+		probes = append(probes, ReverseProbeOptions(options.ReverseProbeServer, options.ClusterDomain,
+			options.ReverseProbeInterval, os.Getenv)...)
+	}
+	for _, probeOption := range probes {
 		probe := &dnsProbe{DNSProbeOption: probeOption}
 		s.probes = append(s.probes, probe)
 		probe.Start(options)
@@ -0,0 +1,124 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tlscert serves a TLS certificate loaded from files or from a
+// Kubernetes Secret, reloading it so that renewed certificates are served
+// without a restart.
+package tlscert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// Source holds the certificate last loaded.
+type Source struct {
+	// name describes where the certificate is loaded from.
+	name string
+	load func() (certPEM, keyPEM []byte, err error)
+	// cert holds the *tls.Certificate last loaded.
+	cert atomic.Value
+	// certPEM is the certificate last loaded, to log its changes.
+	certPEM []byte
+}
+
+// NewFileSource returns a Source loading the certificate and key in the
+// PEM files certFile and keyFile, or an error if they cannot be loaded.
+func NewFileSource(certFile, keyFile string) (*Source, error) {
+	return newSource(fmt.Sprintf("%s and %s", certFile, keyFile), func() ([]byte, []byte, error) {
+		certPEM, err := os.ReadFile(certFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyPEM, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return certPEM, keyPEM, nil
+	})
+}
+
+// NewSecretSource returns a Source loading the certificate and key of the
+// kubernetes.io/tls Secret namespace/name, or an error if it cannot be
+// loaded.
+func NewSecretSource(client kubernetes.Interface, namespace, name string) (*Source, error) {
+	return newSource(fmt.Sprintf("Secret %s/%s", namespace, name), func() ([]byte, []byte, error) {
+		secret, err := client.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		certPEM, keyPEM := secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey]
+		if len(certPEM) == 0 || len(keyPEM) == 0 {
+			return nil, nil, fmt.Errorf("the Secret has no %s or %s", v1.TLSCertKey, v1.TLSPrivateKeyKey)
+		}
+		return certPEM, keyPEM, nil
+	})
+}
+
+func newSource(name string, load func() ([]byte, []byte, error)) (*Source, error) {
+	s := &Source{name: name, load: load}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload loads the certificate again. The previous one is kept on error.
+func (s *Source) Reload() error {
+	certPEM, keyPEM, err := s.load()
+	if err != nil {
+		return fmt.Errorf("failed to load the TLS certificate from %s: %w", s.name, err)
+	}
+	if bytes.Equal(certPEM, s.certPEM) {
+		return nil
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid TLS certificate in %s: %w", s.name, err)
+	}
+	if s.certPEM != nil {
+		klog.V(0).Infof("Serving the renewed TLS certificate of %s", s.name)
+	}
+	s.cert.Store(&cert)
+	s.certPEM = certPEM
+	return nil
+}
+
+// Run reloads the certificate every period until stopCh is closed.
+func (s *Source) Run(period time.Duration, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := s.Reload(); err != nil {
+			klog.Errorf("%v, still serving the previous one", err)
+		}
+	}, period, stopCh)
+}
+
+// GetCertificate returns the certificate last loaded, for
+// tls.Config.GetCertificate.
+func (s *Source) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert.Load().(*tls.Certificate), nil
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tlscert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newCertificate returns a self-signed certificate for host and its key,
+// PEM encoded.
+func newCertificate(t *testing.T, host string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func servedHost(t *testing.T, s *Source) string {
+	cert, err := s.GetCertificate(nil)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestFileSource(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	write := func(certPEM, keyPEM []byte) {
+		require.NoError(t, os.WriteFile(certFile, certPEM, 0600))
+		require.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+	}
+
+	_, err := NewFileSource(certFile, keyFile)
+	assert.Error(t, err, "missing files")
+
+	write(newCertificate(t, "old.kube-dns"))
+	s, err := NewFileSource(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "old.kube-dns", servedHost(t, s))
+
+	write(newCertificate(t, "new.kube-dns"))
+	require.NoError(t, s.Reload())
+	assert.Equal(t, "new.kube-dns", servedHost(t, s))
+
+	// A certificate not matching its key is not served.
+	certPEM, _ := newCertificate(t, "bad.kube-dns")
+	_, keyPEM := newCertificate(t, "bad.kube-dns")
+	write(certPEM, keyPEM)
+	assert.Error(t, s.Reload())
+	assert.Equal(t, "new.kube-dns", servedHost(t, s))
+}
+
+func TestSecretSource(t *testing.T) {
+	certPEM, keyPEM := newCertificate(t, "kube-dns.kube-system.svc")
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "kube-dns-tls"},
+		Type:       v1.SecretTypeTLS,
+		Data:       map[string][]byte{v1.TLSCertKey: certPEM, v1.TLSPrivateKeyKey: keyPEM},
+	}
+	client := fake.NewSimpleClientset(secret)
+
+	_, err := NewSecretSource(client, "kube-system", "missing")
+	assert.Error(t, err)
+
+	s, err := NewSecretSource(client, "kube-system", "kube-dns-tls")
+	require.NoError(t, err)
+	assert.Equal(t, "kube-dns.kube-system.svc", servedHost(t, s))
+
+	// The previous certificate is kept while the Secret is gone.
+	require.NoError(t, client.CoreV1().Secrets("kube-system").Delete(context.Background(), "kube-dns-tls", metav1.DeleteOptions{}))
+	assert.Error(t, s.Reload())
+	assert.Equal(t, "kube-dns.kube-system.svc", servedHost(t, s))
+}
@@ -22,6 +22,7 @@ import (
 type elem struct {
 	expiration time.Time // time added + TTL, after this the elem is invalid
 	msg        *dns.Msg
+	generation uint64 // generation of the backend the msg was computed at, 0 for any
 }
 
 // Cache is a cache that holds on the a number of RRs or DNS messages. The cache
@@ -51,6 +52,28 @@ func (c *Cache) Remove(s string) {
 	c.Unlock()
 }
 
+// RemoveFunc removes the messages whose question remove returns true for, and
+// returns how many were removed.
+func (c *Cache) RemoveFunc(remove func(q dns.Question) bool) int {
+	c.Lock()
+	defer c.Unlock()
+	removed := 0
+	for k, e := range c.m {
+		if len(e.msg.Question) > 0 && remove(e.msg.Question[0]) {
+			delete(c.m, k)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Flush removes every member of the cache.
+func (c *Cache) Flush() {
+	c.Lock()
+	c.m = make(map[string]*elem)
+	c.Unlock()
+}
+
 // EvictRandom removes a random member a the cache.
 // Must be called under a write lock.
 func (c *Cache) EvictRandom() {
@@ -71,13 +94,20 @@ func (c *Cache) EvictRandom() {
 // InsertMessage inserts a message in the Cache. We will cache it for ttl seconds, which
 // should be a small (60...300) integer.
 func (c *Cache) InsertMessage(s string, msg *dns.Msg) {
+	c.InsertMessageGeneration(s, msg, 0)
+}
+
+// InsertMessageGeneration inserts a message computed at the given generation
+// of the backend, only hit at that generation, see HitGeneration. A message
+// inserted at generation 0 is hit at any generation.
+func (c *Cache) InsertMessageGeneration(s string, msg *dns.Msg, generation uint64) {
 	if c.capacity <= 0 {
 		return
 	}
 
 	c.Lock()
 	if _, ok := c.m[s]; !ok {
-		c.m[s] = &elem{time.Now().UTC().Add(c.ttl), msg.Copy()}
+		c.m[s] = &elem{time.Now().UTC().Add(c.ttl), msg.Copy(), generation}
 
 	}
 	c.EvictRandom()
@@ -97,7 +127,7 @@ func (c *Cache) InsertSignature(s string, sig *dns.RRSIG) {
 			m = 0
 		}
 		t := time.Unix(int64(sig.Expiration)-(m*(1<<31)), 0).UTC()
-		c.m[s] = &elem{t, &dns.Msg{Answer: []dns.RR{dns.Copy(sig)}}}
+		c.m[s] = &elem{t, &dns.Msg{Answer: []dns.RR{dns.Copy(sig)}}, 0}
 	}
 	c.EvictRandom()
 	c.Unlock()
@@ -106,17 +136,23 @@ func (c *Cache) InsertSignature(s string, sig *dns.RRSIG) {
 // Search returns a dns.Msg, the expiration time and a boolean indicating if we found something
 // in the cache.
 func (c *Cache) Search(s string) (*dns.Msg, time.Time, bool) {
+	m, exp, _, hit := c.search(s)
+	return m, exp, hit
+}
+
+// search is Search, also returning the generation the message was inserted at.
+func (c *Cache) search(s string) (*dns.Msg, time.Time, uint64, bool) {
 	if c.capacity <= 0 {
-		return nil, time.Time{}, false
+		return nil, time.Time{}, 0, false
 	}
 	c.RLock()
 	if e, ok := c.m[s]; ok {
 		e1 := e.msg.Copy()
 		c.RUnlock()
-		return e1, e.expiration, true
+		return e1, e.expiration, e.generation, true
 	}
 	c.RUnlock()
-	return nil, time.Time{}, false
+	return nil, time.Time{}, 0, false
 }
 
 // Key creates a hash key from a question section. It creates a different key
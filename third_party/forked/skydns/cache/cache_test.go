@@ -83,3 +83,48 @@ func TestExpireMessage(t *testing.T) {
 		t.Fatalf("bad Qtype, expected %s, got %s:", tc.m.Question[0].Name, m1.Question[0].Name)
 	}
 }
+
+func TestRemoveFunc(t *testing.T) {
+	c := New(10, testTTL)
+	for _, m := range []*dns.Msg{newMsg("miek.nl.", dns.TypeA), newMsg("miek.nl.", dns.TypeAAAA), newMsg("miek2.nl.", dns.TypeA)} {
+		c.InsertMessage(Key(m.Question[0], false, false), m)
+	}
+
+	removed := c.RemoveFunc(func(q dns.Question) bool { return q.Name == "miek.nl." })
+	if removed != 2 {
+		t.Fatalf("expected 2 messages removed, got %d", removed)
+	}
+	if m := c.Hit(dns.Question{Name: "miek.nl.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, false, false, 1); m != nil {
+		t.Fatalf("expected miek.nl. to be removed, got %s", m)
+	}
+	if m := c.Hit(dns.Question{Name: "miek2.nl.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, false, false, 1); m == nil {
+		t.Fatalf("expected miek2.nl. to be kept")
+	}
+
+	c.Flush()
+	if m := c.Hit(dns.Question{Name: "miek2.nl.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, false, false, 1); m != nil {
+		t.Fatalf("expected the cache to be flushed, got %s", m)
+	}
+}
+
+func TestHitGeneration(t *testing.T) {
+	c := New(10, testTTL)
+	m := newMsg("miek.nl.", dns.TypeA)
+	c.InsertMessageGeneration(Key(m.Question[0], false, false), m, 1)
+	if m1 := c.HitGeneration(m.Question[0], false, false, 1, 1); m1 == nil {
+		t.Fatalf("expected a hit at the generation of the message")
+	}
+	if m1 := c.HitGeneration(m.Question[0], false, false, 1, 2); m1 != nil {
+		t.Fatalf("expected no hit at the next generation, got %s", m1)
+	}
+	// The stale message was removed.
+	if m1 := c.HitGeneration(m.Question[0], false, false, 1, 1); m1 != nil {
+		t.Fatalf("expected the stale message to be removed, got %s", m1)
+	}
+
+	// The messages inserted at generation 0 are hit at any generation.
+	c.InsertMessage(Key(m.Question[0], false, false), m)
+	if m1 := c.HitGeneration(m.Question[0], false, false, 1, 3); m1 == nil {
+		t.Fatalf("expected a hit of the message inserted at generation 0")
+	}
+}
@@ -13,8 +13,19 @@ import (
 // Hit returns a dns message from the cache. If the message's TTL is expired nil
 // is returned and the message is removed from the cache.
 func (c *Cache) Hit(question dns.Question, dnssec, tcp bool, msgid uint16) *dns.Msg {
+	return c.HitGeneration(question, dnssec, tcp, msgid, 0)
+}
+
+// HitGeneration is Hit at the given generation of the backend: the messages
+// inserted at another generation, but 0, are stale, and removed as well.
+func (c *Cache) HitGeneration(question dns.Question, dnssec, tcp bool, msgid uint16, generation uint64) *dns.Msg {
 	key := Key(question, dnssec, tcp)
-	m1, exp, hit := c.Search(key)
+	m1, exp, inserted, hit := c.search(key)
+	if hit && inserted != 0 && inserted != generation {
+		// Stale! /o\
+		c.Remove(key)
+		return nil
+	}
 	if hit {
 		// Cache hit! \o/
 		if time.Since(exp) < 0 {
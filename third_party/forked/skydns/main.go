@@ -83,6 +83,9 @@ func init() {
 	flag.StringVar(&password, "password", env("ETCD_PASSWORD", ""), "Password used to support etcd basic auth")
 	flag.DurationVar(&config.ReadTimeout, "rtimeout", 2*time.Second, "read timeout")
 	flag.BoolVar(&config.RoundRobin, "round-robin", true, "round robin A/AAAA replies")
+	flag.IntVar(&config.MaxAnswers, "max-answers", 0, "maximum number of A/AAAA/SRV records answered over UDP, 0 for no limit")
+	flag.StringVar((*string)(&config.AnswerOrder), "answer-order", "", "order of A/AAAA replies: none, random or round-robin, overrides -round-robin")
+	flag.BoolVar(&config.RaceUpstreams, "race-upstreams", false, "race forwarded queries to the two fastest nameservers")
 	flag.BoolVar(&config.NSRotate, "ns-rotate", true, "round robin selection of nameservers from among those listed")
 	flag.BoolVar(&stub, "stubzones", false, "support stub zones")
 	flag.BoolVar(&config.Verbose, "verbose", false, "log queries")
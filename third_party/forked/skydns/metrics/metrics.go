@@ -22,11 +22,18 @@ var (
 	Namespace = envOrDefault("PROMETHEUS_NAMESPACE", "skydns")
 	Subsystem = envOrDefault("PROMETHEUS_SUBSYSTEM", "skydns")
 
+	// ListenAndServe serves the metrics on Port. It can be replaced, before
+	// Metrics is called, to restrict the access to them.
+	ListenAndServe = http.ListenAndServe
+
 	requestCount    *prometheus.CounterVec
 	requestDuration *prometheus.HistogramVec
 	responseSize    *prometheus.HistogramVec
+	compressionSize *prometheus.HistogramVec
 	errorCount      *prometheus.CounterVec
 	cacheMiss       *prometheus.CounterVec
+	upstreamRaces   *prometheus.CounterVec
+	upstreamWins    *prometheus.CounterVec
 )
 
 type (
@@ -80,6 +87,14 @@ func defineMetrics() {
 		},
 	}, []string{"system"})
 
+	compressionSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: Subsystem,
+		Name:      "dns_response_compression_size_bytes",
+		Help:      "Size of the returned response in bytes, with and without name compression.",
+		Buckets:   []float64{0, 128, 256, 512, 1024, 1500, 2048, 4096, 8192, 16384, 32768, 65536},
+	}, []string{"system", "compression"})
+
 	errorCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: Namespace,
 		Subsystem: Subsystem,
@@ -93,6 +108,20 @@ func defineMetrics() {
 		Name:      "dns_cachemiss_count_total",
 		Help:      "Counter of DNS requests that result in a cache miss.",
 	}, []string{"cache"})
+
+	upstreamRaces = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: Subsystem,
+		Name:      "dns_upstream_races_total",
+		Help:      "Counter of forwarded queries raced to each upstream.",
+	}, []string{"upstream"})
+
+	upstreamWins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: Subsystem,
+		Name:      "dns_upstream_race_wins_total",
+		Help:      "Counter of raced queries whose answer came from each upstream first.",
+	}, []string{"upstream"})
 }
 
 // Metrics registers the DNS metrics to Prometheus, and starts the internal metrics
@@ -114,12 +143,15 @@ func Metrics() error {
 	prometheus.MustRegister(requestCount)
 	prometheus.MustRegister(requestDuration)
 	prometheus.MustRegister(responseSize)
+	prometheus.MustRegister(compressionSize)
 	prometheus.MustRegister(errorCount)
 	prometheus.MustRegister(cacheMiss)
+	prometheus.MustRegister(upstreamRaces)
+	prometheus.MustRegister(upstreamWins)
 
 	http.Handle(Path, promhttp.Handler())
 	go func() {
-		fmt.Errorf("%s", http.ListenAndServe(":"+Port, nil))
+		fmt.Errorf("%s", ListenAndServe(":"+Port, nil))
 	}()
 	return nil
 }
@@ -129,12 +161,49 @@ func ReportDuration(resp *dns.Msg, start time.Time, sys System) {
 		return
 	}
 
-	rlen := float64(0)
+	rlen := 0
 	if resp != nil {
-		rlen = float64(resp.Len())
+		compressed, uncompressed := compressionSizes(resp)
+		rlen = uncompressed
+		if resp.Compress {
+			rlen = compressed
+		}
+		reportCompression(compressed, uncompressed, sys)
 	}
 	requestDuration.WithLabelValues(string(sys)).Observe(float64(time.Since(start)) / float64(time.Second))
-	responseSize.WithLabelValues(string(sys)).Observe(rlen)
+	responseSize.WithLabelValues(string(sys)).Observe(float64(rlen))
+}
+
+// ReportCompression records the size of the response both with and without
+// name compression, whichever was used to send it.
+func ReportCompression(resp *dns.Msg, sys System) {
+	if compressionSize == nil || resp == nil {
+		return
+	}
+	compressed, uncompressed := compressionSizes(resp)
+	reportCompression(compressed, uncompressed, sys)
+}
+
+// compressionSizes returns the size of resp with and without name
+// compression, packing it once each way.
+func compressionSizes(resp *dns.Msg) (compressed, uncompressed int) {
+	// Len depends on Compress, use a copy as resp may be shared with the
+	// response cache.
+	other := *resp
+	other.Compress = !resp.Compress
+	compressed, uncompressed = resp.Len(), other.Len()
+	if !resp.Compress {
+		compressed, uncompressed = uncompressed, compressed
+	}
+	return compressed, uncompressed
+}
+
+func reportCompression(compressed, uncompressed int, sys System) {
+	if compressionSize == nil {
+		return
+	}
+	compressionSize.WithLabelValues(string(sys), "compressed").Observe(float64(compressed))
+	compressionSize.WithLabelValues(string(sys), "uncompressed").Observe(float64(uncompressed))
 }
 
 func ReportRequestCount(req *dns.Msg, sys System) {
@@ -178,6 +247,18 @@ func ReportCacheMiss(ca CacheType) {
 	cacheMiss.WithLabelValues(string(ca)).Inc()
 }
 
+// ReportRace records that a query was raced to upstream, and whether its
+// answer was used.
+func ReportRace(upstream string, won bool) {
+	if upstreamRaces == nil || upstreamWins == nil {
+		return
+	}
+	upstreamRaces.WithLabelValues(upstream).Inc()
+	if won {
+		upstreamWins.WithLabelValues(upstream).Inc()
+	}
+}
+
 func envOrDefault(env, def string) string {
 	e := os.Getenv(env)
 	if e != "" {
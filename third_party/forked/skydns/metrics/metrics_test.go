@@ -0,0 +1,69 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package metrics
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// histogramSum returns the sum of the samples observed by h.
+func histogramSum(t *testing.T, h prometheus.Observer) float64 {
+	m := &dto.Metric{}
+	if err := h.(prometheus.Metric).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleSum()
+}
+
+func TestReportCompression(t *testing.T) {
+	defineMetrics()
+	resp := new(dns.Msg)
+	resp.SetQuestion("web.default.svc.cluster.local.", dns.TypeA)
+	for i := 1; i <= 4; i++ {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "web.default.svc.cluster.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30},
+			A:   net.IPv4(10, 0, 0, byte(i)),
+		})
+	}
+	resp.Compress = true
+	compressed := resp.Len()
+	resp.Compress = false
+	uncompressed := resp.Len()
+	if compressed >= uncompressed {
+		t.Fatalf("expected the compressed reply to be smaller, got %d and %d bytes", compressed, uncompressed)
+	}
+
+	// The sizes are the same whichever way the reply was sent, and the size
+	// of the reply is the one it was sent with.
+	for _, compress := range []bool{true, false} {
+		defineMetrics()
+		resp.Compress = compress
+		ReportDuration(resp, time.Now(), Rec)
+		gotCompressed := histogramSum(t, compressionSize.WithLabelValues(string(Rec), "compressed"))
+		gotUncompressed := histogramSum(t, compressionSize.WithLabelValues(string(Rec), "uncompressed"))
+		if gotCompressed != float64(compressed) || gotUncompressed != float64(uncompressed) {
+			t.Errorf("compress %v: expected %d and %d bytes, got %v and %v", compress, compressed, uncompressed, gotCompressed, gotUncompressed)
+		}
+		if ratio, expected := gotCompressed/gotUncompressed, float64(compressed)/float64(uncompressed); ratio != expected {
+			t.Errorf("compress %v: expected a compression ratio of %v, got %v", compress, expected, ratio)
+		}
+		sent := uncompressed
+		if compress {
+			sent = compressed
+		}
+		if got := histogramSum(t, responseSize.WithLabelValues(string(Rec))); got != float64(sent) {
+			t.Errorf("compress %v: expected a response size of %d bytes, got %v", compress, sent, got)
+		}
+		if resp.Compress != compress {
+			t.Errorf("compress %v: the reply was changed", compress)
+		}
+	}
+}
@@ -137,7 +137,7 @@ func Domain(s string) string {
 // is not empty), we don't consider it a group.
 // If a group is found, only services with *that* group (or no group) will be returned.
 func Group(sx []Service) []Service {
-	if len(sx) == 0 {
+	if len(sx) == 0 || !anyGroup(sx) {
 		return sx
 	}
 
@@ -181,6 +181,17 @@ func Group(sx []Service) []Service {
 	return ret
 }
 
+// anyGroup returns whether a service of sx has a group, most have none and
+// Group then returns sx as is.
+func anyGroup(sx []Service) bool {
+	for i := range sx {
+		if sx[i].Group != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // Split255 splits a string into 255 byte chunks.
 func split255(s string) []string {
 	if len(s) < 255 {
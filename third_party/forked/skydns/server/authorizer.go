@@ -0,0 +1,25 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// QueryAuthorizer returns whether a client may resolve a name of the served
+// domains, e.g. to keep tenants from resolving each other's services.
+type QueryAuthorizer func(remote net.Addr, name string) bool
+
+// authorized returns whether the client may resolve name. Names outside of
+// the served domains are always authorized. The check is made before the
+// cache is consulted, as the cached replies are shared by every client.
+func (s *server) authorized(w dns.ResponseWriter, name string) bool {
+	if s.config.Authorizer == nil || !s.inDomain(name) {
+		return true
+	}
+	return s.config.Authorizer(w.RemoteAddr(), name)
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryAuthorizer(t *testing.T) {
+	config := &Config{
+		Domain:      "cluster.local.",
+		Nameservers: []string{"127.0.0.1:53"},
+		NoRec:       true,
+		RCache:      10,
+		Authorizer: func(remote net.Addr, name string) bool {
+			return name != "b.default.svc.cluster.local."
+		},
+	}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(StaticBackend{
+		"a.default.svc.cluster.local.": {{Host: "10.0.0.1"}},
+		"b.default.svc.cluster.local.": {{Host: "10.0.0.2"}},
+	}, config)
+
+	// The second queries are answered from the cache, which must not
+	// bypass the authorizer.
+	for i := 0; i < 2; i++ {
+		for name, rcode := range map[string]int{
+			"a.default.svc.cluster.local.": dns.RcodeSuccess,
+			"b.default.svc.cluster.local.": dns.RcodeRefused,
+		} {
+			req := new(dns.Msg)
+			req.SetQuestion(name, dns.TypeA)
+			w := &recordingWriter{}
+			s.ServeDNS(w, req)
+			if w.msg == nil || w.msg.Rcode != rcode {
+				t.Errorf("expected rcode %d for %q, got %v", rcode, name, w.msg)
+			}
+		}
+	}
+}
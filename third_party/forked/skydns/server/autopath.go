@@ -0,0 +1,126 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SearchPath returns the search domains of the client at remote, most
+// specific first and fully qualified, e.g. the namespace, service and
+// cluster domains of a pod, or nil if its queries are not to be expanded.
+type SearchPath func(remote net.Addr) []string
+
+// autopathHandler returns h, resolving the names queried in the first
+// search domain of the client, see Config.SearchPath, in its other search
+// domains and as is in turn, as the resolver of the client would after an
+// NXDOMAIN answer, which saves its round trips. The first name found is
+// answered behind a CNAME from the name queried. The replies depend on the
+// client, only those of the names tried are cached.
+func (s *server) autopathHandler(h dns.Handler) dns.Handler {
+	if s.config.SearchPath == nil {
+		return h
+	}
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if !autopathQuery(req) {
+			h.ServeDNS(w, req)
+			return
+		}
+		search := s.config.SearchPath(w.RemoteAddr())
+		name := strings.ToLower(req.Question[0].Name)
+		if len(search) == 0 || !strings.HasSuffix(name, "."+search[0]) {
+			h.ServeDNS(w, req)
+			return
+		}
+		first := &autopathWriter{ResponseWriter: w}
+		h.ServeDNS(first, req)
+		if first.msg == nil || first.msg.Rcode != dns.RcodeNameError {
+			first.flush()
+			return
+		}
+
+		base := strings.TrimSuffix(name, "."+search[0])
+		targets := make([]string, 0, len(search))
+		for _, domain := range search[1:] {
+			targets = append(targets, base+"."+domain)
+		}
+		for _, target := range append(targets, base+".") {
+			next := req.Copy()
+			next.Question[0].Name = target
+			aw := &autopathWriter{ResponseWriter: w}
+			h.ServeDNS(aw, next)
+			if aw.msg == nil || aw.msg.Rcode != dns.RcodeSuccess {
+				continue
+			}
+			if s.config.Verbose {
+				logf("autopath: answering %q with %q for %q", name, target, w.RemoteAddr())
+			}
+			if err := w.WriteMsg(autopathReply(req, aw.msg, target, s.config.Ttl)); err != nil {
+				logf("failure to return reply %q", err)
+			}
+			return
+		}
+		first.flush()
+	})
+}
+
+// autopathQuery returns whether req may be expanded: an Internet query
+// for records other than the zone transfers, whose reply is not to be
+// signed, as the CNAME added would not be.
+func autopathQuery(req *dns.Msg) bool {
+	if len(req.Question) != 1 {
+		return false
+	}
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET || q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		return false
+	}
+	o := req.IsEdns0()
+	return o == nil || !o.Do()
+}
+
+// autopathReply returns the reply to req from the reply m to the query for
+// target: the answers of m behind a CNAME from the name queried to target,
+// with the TTL of the shortest answer, ttl if there is none.
+func autopathReply(req, m *dns.Msg, target string, ttl uint32) *dns.Msg {
+	m = m.Copy()
+	m.Id = req.Id
+	m.Question = req.Question
+	for _, rr := range m.Answer {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+		Target: target,
+	}
+	m.Answer = append([]dns.RR{cname}, m.Answer...)
+	return m
+}
+
+// autopathWriter keeps the reply written through it, until flushed.
+type autopathWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *autopathWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// flush writes the reply kept, if any.
+func (w *autopathWriter) flush() {
+	if w.msg == nil {
+		return
+	}
+	if err := w.ResponseWriter.WriteMsg(w.msg); err != nil {
+		logf("failure to return reply %q", err)
+	}
+}
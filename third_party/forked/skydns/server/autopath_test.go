@@ -0,0 +1,92 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAutopath(t *testing.T) {
+	search := []string{"default.svc.cluster.local.", "svc.cluster.local.", "cluster.local."}
+	config := &Config{
+		Domain:      "cluster.local.",
+		Nameservers: []string{"127.0.0.1:53"},
+		NoRec:       true,
+		RCache:      10,
+		SearchPath: func(remote net.Addr) []string {
+			if remote.(*net.UDPAddr).Port != 4242 {
+				return nil
+			}
+			return search
+		},
+	}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(StaticBackend{
+		"a.default.svc.cluster.local.": {{Host: "10.0.0.1"}},
+		"b.other.svc.cluster.local.":   {{Host: "10.0.0.2"}},
+	}, config)
+	h := s.handler()
+
+	for _, tc := range []struct {
+		name   string
+		rcode  int
+		cname  string
+		answer string
+	}{
+		{"a.default.svc.cluster.local.", dns.RcodeSuccess, "", "10.0.0.1"},
+		{"b.other.default.svc.cluster.local.", dns.RcodeSuccess, "b.other.svc.cluster.local.", "10.0.0.2"},
+		{"B.Other.default.svc.cluster.local.", dns.RcodeSuccess, "b.other.svc.cluster.local.", "10.0.0.2"},
+		{"c.default.svc.cluster.local.", dns.RcodeNameError, "", ""},
+		// Only the names in the first search domain are expanded.
+		{"b.other.cluster.local.", dns.RcodeNameError, "", ""},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, dns.TypeA)
+		w := &recordingWriter{}
+		h.ServeDNS(w, req)
+		if w.msg == nil || w.msg.Rcode != tc.rcode {
+			t.Errorf("expected rcode %d for %q, got %v", tc.rcode, tc.name, w.msg)
+			continue
+		}
+		if w.msg.Id != req.Id || w.msg.Question[0].Name != tc.name {
+			t.Errorf("expected the reply to the query for %q, got %v", tc.name, w.msg)
+		}
+		answer := w.msg.Answer
+		if tc.cname != "" {
+			if len(answer) == 0 || answer[0].(*dns.CNAME).Target != tc.cname || answer[0].Header().Name != tc.name {
+				t.Errorf("expected a CNAME from %q to %q, got %v", tc.name, tc.cname, answer)
+				continue
+			}
+			answer = answer[1:]
+		}
+		if tc.answer != "" && (len(answer) != 1 || answer[0].(*dns.A).A.String() != tc.answer) {
+			t.Errorf("expected %s for %q, got %v", tc.answer, tc.name, answer)
+		}
+	}
+
+	// The replies depend on the client, the cache must not answer
+	// another one.
+	req := new(dns.Msg)
+	req.SetQuestion("b.other.default.svc.cluster.local.", dns.TypeA)
+	w := &otherClientWriter{}
+	h.ServeDNS(w, req)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN for a client without search path, got %v", w.msg)
+	}
+}
+
+// otherClientWriter is a recordingWriter of another client.
+type otherClientWriter struct {
+	recordingWriter
+}
+
+func (w *otherClientWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 4343}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+	"k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// transferMessageSize bounds the uncompressed size of the records of each
+// message of a zone transfer, well below the 64K of a TCP message.
+const transferMessageSize = 32 * 1024
+
+// serveTransfer answers the AXFR or IXFR query req (RFC 5936 and RFC 1995):
+// the SOA record of the zone, every record of the zone from a consistent view
+// of the backend and the SOA record again, over as many messages as needed.
+// The IXFR queries are answered with the changes since the serial of the
+// client instead, if the domain is journaled and they are all kept, or with
+// the SOA record only over UDP, for the client to retry over TCP. The
+// transfers are only allowed from the TransferCIDRs, at the apex of a served
+// domain.
+func (s *server) serveTransfer(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	zone := dns.CanonicalName(q.Name)
+	if (q.Qtype == dns.TypeAXFR && !isTCP(w)) || !s.transferAllowed(w, req) {
+		s.transferError(w, req, dns.RcodeRefused, dns.ExtendedErrorCodeProhibited, "zone transfer not allowed")
+		return
+	}
+	if zone != s.zoneOf(zone) {
+		s.transferError(w, req, dns.RcodeNotAuth, dns.ExtendedErrorCodeNotAuthoritative, "not a zone apex")
+		return
+	}
+	var clientSerial uint32
+	if q.Qtype == dns.TypeIXFR {
+		soa, ok := ixfrSOA(req)
+		if !ok {
+			s.transferError(w, req, dns.RcodeFormatError, dns.ExtendedErrorCodeOther, "IXFR query without a SOA record")
+			return
+		}
+		clientSerial = soa.Serial
+	}
+
+	var records []dns.RR
+	if s.journal != nil && zone == s.config.Domain {
+		records = s.journaledTransfer(zone, q.Qtype == dns.TypeIXFR, clientSerial)
+	} else {
+		var err error
+		if records, err = s.zoneTransfer(zone); errors.Is(err, ErrNotFound) {
+			s.transferError(w, req, dns.RcodeNotAuth, dns.ExtendedErrorCodeNotAuthoritative, "zone transfers not supported")
+			return
+		} else if err != nil {
+			logf("failed to transfer %s: %s", zone, err)
+			s.transferError(w, req, dns.RcodeServerFailure, dns.ExtendedErrorCodeOther, "")
+			return
+		}
+	}
+	if !isTCP(w) {
+		records = records[:1]
+	}
+
+	ch := make(chan *dns.Envelope, len(records)/16+1)
+	go func() {
+		defer close(ch)
+		var rrs []dns.RR
+		size := 0
+		for _, rr := range records {
+			if len(rrs) > 0 && size+dns.Len(rr) > transferMessageSize {
+				ch <- &dns.Envelope{RR: rrs}
+				rrs, size = nil, 0
+			}
+			rrs = append(rrs, rr)
+			size += dns.Len(rr)
+		}
+		ch <- &dns.Envelope{RR: rrs}
+	}()
+	tr := new(dns.Transfer)
+	if err := tr.Out(w, req, ch); err != nil {
+		logf("failed to transfer %s to %s: %s", zone, w.RemoteAddr(), err)
+		// Let the producer return.
+		for range ch {
+		}
+		return
+	}
+	if s.config.Verbose {
+		logf("transferred %s to %s: %d records", zone, w.RemoteAddr(), len(records))
+	}
+}
+
+// zoneTransfer returns the records of zone, between its SOA records.
+func (s *server) zoneTransfer(zone string) ([]dns.RR, error) {
+	soa := s.newSOA(zone)
+	records := []dns.RR{soa}
+	err := RangeZone(s.backend, zone, func(name string, services []msg.Service) bool {
+		for _, service := range services {
+			if rr := s.transferRR(name, service); rr != nil {
+				records = append(records, rr)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(records, soa), nil
+}
+
+// journaledTransfer returns the records of the journaled zone: its changes
+// since clientSerial for IXFR if they are all kept, every record otherwise.
+func (s *server) journaledTransfer(zone string, ixfr bool, clientSerial uint32) []dns.RR {
+	serial, current, changes, ok := s.journal.since(clientSerial)
+	soa := s.soaWithSerial(zone, serial)
+	if ixfr && ok {
+		if len(changes) == 0 {
+			// The client is up to date.
+			return []dns.RR{soa}
+		}
+		records := []dns.RR{soa}
+		for _, change := range changes {
+			records = append(records, s.soaWithSerial(zone, change.serial))
+			records = append(records, change.deleted...)
+			records = append(records, s.soaWithSerial(zone, change.serial+1))
+			records = append(records, change.added...)
+		}
+		return append(records, soa)
+	}
+	records := make([]dns.RR, 0, len(current)+2)
+	records = append(records, soa)
+	records = append(records, current...)
+	return append(records, soa)
+}
+
+// ixfrSOA returns the SOA record of the client in the authority section of
+// the IXFR query req.
+func ixfrSOA(req *dns.Msg) (*dns.SOA, bool) {
+	for _, rr := range req.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa, true
+		}
+	}
+	return nil, false
+}
+
+// transferAllowed returns whether the client of w may transfer the zones,
+// with req signed with one of the TransferKeys if set.
+func (s *server) transferAllowed(w dns.ResponseWriter, req *dns.Msg) bool {
+	if len(s.config.TransferKeys) > 0 && !signedWith(w, req, s.config.TransferKeys) {
+		return false
+	}
+	var ip net.IP
+	switch addr := w.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return false
+	}
+	for _, ipNet := range s.config.transferNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// transferError answers req with rcode and the extended error code, if
+// the client supports them.
+func (s *server) transferError(w dns.ResponseWriter, req *dns.Msg, rcode int, code uint16, text string) {
+	m := new(dns.Msg)
+	m.SetRcode(req, rcode)
+	setExtendedError(m, req, code, text)
+	if err := w.WriteMsg(m); err != nil {
+		logf("failure to return reply %q", err)
+	}
+}
+
+// transferRR returns the record of service as answered for name: a TXT
+// record for the texts, an SRV record for the records with a port, an A or
+// AAAA record for the addresses and a CNAME record otherwise.
+func (s *server) transferRR(name string, service msg.Service) dns.RR {
+	if service.Ttl == 0 {
+		service.Ttl = s.config.Ttl
+	}
+	if service.Text != "" {
+		return service.NewTXT(name)
+	}
+	if service.Port != 0 {
+		return service.NewSRV(name, uint16(service.Weight))
+	}
+	switch ip := net.ParseIP(service.Host); {
+	case service.Host == "":
+		return nil
+	case ip == nil:
+		return service.NewCNAME(name, dns.Fqdn(service.Host))
+	case ip.To4() != nil:
+		return service.NewA(name, ip.To4())
+	default:
+		return service.NewAAAA(name, ip)
+	}
+}
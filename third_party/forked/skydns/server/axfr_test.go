@@ -0,0 +1,116 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// serveTCP serves the queries over TCP with s until the test ends, and
+// returns its address.
+func serveTCP(t *testing.T, s *server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Listener: ln, Handler: s.handler(), TsigSecret: s.config.TsigSecret}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return ln.Addr().String()
+}
+
+func TestAXFR(t *testing.T) {
+	backend := StaticBackend{
+		"web.default.svc.cluster.local.":             {{Host: "10.0.0.1", Ttl: 30}, {Host: "fd00::1", Ttl: 30}},
+		"_http._tcp.web.default.svc.cluster.local.":  {{Host: "web.default.svc.cluster.local.", Port: 80, Ttl: 30}},
+		"external.default.svc.cluster.local.":        {{Host: "example.com", Ttl: 30}},
+		"_acme-challenge.web.default.cluster.local.": {{Text: "token", Ttl: 30}},
+		"web.default.svc.prod.internal.":             {{Host: "10.0.0.1", Ttl: 30}},
+	}
+	for i := 0; i < 2000; i++ {
+		backend[fmt.Sprintf("pod-%d.headless.default.svc.cluster.local.", i)] = []msg.Service{{Host: "10.1.0.1", Ttl: 30}}
+	}
+	config := &Config{Domain: "cluster.local.", NoRec: true, TransferCIDRs: []string{"127.0.0.0/8"}}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTCP(t, New(backend, config))
+
+	m := new(dns.Msg)
+	m.SetAxfr("cluster.local.")
+	envelopes, err := new(dns.Transfer).In(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []dns.RR
+	messages := 0
+	for e := range envelopes {
+		if e.Error != nil {
+			t.Fatal(e.Error)
+		}
+		records = append(records, e.RR...)
+		messages++
+	}
+	if messages < 2 {
+		t.Errorf("expected the transfer to span several messages, got %d", messages)
+	}
+	if len(records) != 2+2+1+1+1+2000 {
+		t.Fatalf("expected 2007 records, got %d", len(records))
+	}
+	if records[0].Header().Rrtype != dns.TypeSOA || records[len(records)-1].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("expected the transfer to start and end with the SOA, got %v and %v", records[0], records[len(records)-1])
+	}
+	types := map[uint16]int{}
+	for _, rr := range records[1 : len(records)-1] {
+		if !dns.IsSubDomain("cluster.local.", rr.Header().Name) {
+			t.Errorf("unexpected record outside of the zone: %v", rr)
+		}
+		types[rr.Header().Rrtype]++
+	}
+	if types[dns.TypeA] != 2001 || types[dns.TypeAAAA] != 1 || types[dns.TypeSRV] != 1 || types[dns.TypeCNAME] != 1 || types[dns.TypeTXT] != 1 {
+		t.Errorf("unexpected record types %v", types)
+	}
+
+	for _, tc := range []struct {
+		zone  string
+		rcode int
+	}{
+		{"svc.cluster.local.", dns.RcodeNotAuth},
+		{"example.com.", dns.RcodeNotAuth},
+	} {
+		m := new(dns.Msg)
+		m.SetAxfr(tc.zone)
+		resp, _, err := (&dns.Client{Net: "tcp"}).Exchange(m, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Rcode != tc.rcode {
+			t.Errorf("%s: expected %s, got %s", tc.zone, dns.RcodeToString[tc.rcode], dns.RcodeToString[resp.Rcode])
+		}
+	}
+}
+
+func TestAXFRNotAllowed(t *testing.T) {
+	config := &Config{Domain: "cluster.local.", NoRec: true, TransferCIDRs: []string{"192.0.2.0/24"}}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTCP(t, New(StaticBackend{"web.default.svc.cluster.local.": {{Host: "10.0.0.1"}}}, config))
+
+	m := new(dns.Msg)
+	m.SetAxfr("cluster.local.")
+	resp, _, err := (&dns.Client{Net: "tcp"}).Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeRefused || len(resp.Answer) != 0 {
+		t.Errorf("expected REFUSED, got %v", resp)
+	}
+}
@@ -4,7 +4,46 @@
 
 package server
 
-import "k8s.io/dns/third_party/forked/skydns/msg"
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/miekg/dns"
+	"k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// Errors returned by a Backend, possibly wrapped, select the response code
+// of the answer. Other errors are answered with NODATA, or SERVFAIL for SRV
+// queries.
+var (
+	// ErrNotFound means the name does not exist, answered with NXDOMAIN.
+	ErrNotFound = errors.New("name not found")
+	// ErrNoData means the name exists but has no records, answered with
+	// NODATA.
+	ErrNoData = errors.New("no records for name")
+	// ErrBackendUnavailable means the backend cannot answer at the moment,
+	// answered with SERVFAIL.
+	ErrBackendUnavailable = errors.New("backend unavailable")
+	// ErrInvalid means the name is malformed for the backend, e.g. a pod
+	// name that is not an IP, so it cannot exist. Answered with NXDOMAIN.
+	ErrInvalid = errors.New("invalid name")
+	// ErrPartial means the records returned along with it are only part
+	// of those of the name, e.g. a wildcard query was given up on. They
+	// are answered with the TC bit set.
+	ErrPartial = errors.New("partial records")
+	// ErrStale means the records returned along with it are from a stale
+	// copy of the backend, e.g. one loaded before it synced. They are
+	// answered with a Stale Answer extended error (RFC 8914), and not
+	// cached.
+	ErrStale = errors.New("stale records")
+)
+
+// WithRecords returns true if the records returned along with err are to be
+// answered, err being ErrPartial or ErrStale.
+func WithRecords(err error) bool {
+	return errors.Is(err, ErrPartial) || errors.Is(err, ErrStale)
+}
 
 type Backend interface {
 	HasSynced() bool
@@ -12,13 +51,100 @@ type Backend interface {
 	ReverseRecord(name string) (*msg.Service, error)
 }
 
+// RecordsAppender is implemented by the Backends able to append the records
+// of a name to dst rather than allocate them, so that the server reuses
+// the same slices from query to query. The records appended are copies, the
+// server may modify them.
+type RecordsAppender interface {
+	AppendRecords(dst []msg.Service, name string, exact bool) ([]msg.Service, error)
+}
+
+// ReverseRecordsBackend is implemented by the Backends able to have several
+// reverse records for a name, e.g. for an IP shared by several services.
+// The server answers all of them rather than the one of ReverseRecord.
+type ReverseRecordsBackend interface {
+	ReverseRecords(name string) ([]msg.Service, error)
+}
+
+// ReverseRecords returns the reverse records of name, from
+// backend.ReverseRecord if backend is not a ReverseRecordsBackend.
+func ReverseRecords(backend Backend, name string) ([]msg.Service, error) {
+	if reverse, ok := backend.(ReverseRecordsBackend); ok {
+		return reverse.ReverseRecords(name)
+	}
+	record, err := backend.ReverseRecord(name)
+	if err != nil {
+		return nil, err
+	}
+	return []msg.Service{*record}, nil
+}
+
+// ZoneTransferer is implemented by the Backends able to list every record of
+// a zone, for the zone transfers (AXFR).
+type ZoneTransferer interface {
+	// RangeZone calls fn with each name of zone holding records, and its
+	// records, until fn returns false. The records are those of a
+	// consistent view of the backend, and must not be modified. It returns
+	// ErrNotFound if the backend does not serve zone.
+	RangeZone(zone string, fn func(name string, records []msg.Service) bool) error
+}
+
+// RangeZone calls fn with the names of zone and their records from backend,
+// see ZoneTransferer. It returns ErrNotFound if backend is not a
+// ZoneTransferer.
+func RangeZone(backend Backend, zone string, fn func(name string, records []msg.Service) bool) error {
+	if transferer, ok := backend.(ZoneTransferer); ok {
+		return transferer.RangeZone(zone, fn)
+	}
+	return ErrNotFound
+}
+
+// Generationer is implemented by the Backends counting the changes to their
+// records: the generation is incremented whenever the records may change, so
+// that the replies cached at a previous generation are not answered anymore,
+// rather than until they expire.
+type Generationer interface {
+	Generation() uint64
+}
+
+// generation returns the generation of backend, 0 if it is not a
+// Generationer.
+func generation(backend Backend) uint64 {
+	if g, ok := backend.(Generationer); ok {
+		return g.Generation()
+	}
+	return 0
+}
+
+// AppendRecords appends the records of name to dst, from backend.Records if
+// backend is not a RecordsAppender. On error, dst is returned as it was,
+// but for ErrPartial and ErrStale.
+func AppendRecords(backend Backend, dst []msg.Service, name string, exact bool) ([]msg.Service, error) {
+	if appender, ok := backend.(RecordsAppender); ok {
+		records, err := appender.AppendRecords(dst, name, exact)
+		if err != nil && !WithRecords(err) {
+			return dst, err
+		}
+		return records, err
+	}
+	records, err := backend.Records(name, exact)
+	if err != nil && !WithRecords(err) {
+		return dst, err
+	}
+	return append(dst, records...), err
+}
+
 // FirstBackend exposes the Backend interface over multiple Backends, returning
 // the first Backend that answers the provided record request. If no Backend answers
 // a record request, the last error seen will be returned.
 type FirstBackend []Backend
 
-// FirstBackend implements Backend
-var _ Backend = FirstBackend{}
+// FirstBackend implements Backend, RecordsAppender and ReverseRecordsBackend
+var (
+	_ Backend               = FirstBackend{}
+	_ RecordsAppender       = FirstBackend{}
+	_ ReverseRecordsBackend = FirstBackend{}
+)
 
 func (g FirstBackend) Records(name string, exact bool) (records []msg.Service, err error) {
 	var lastError error
@@ -33,6 +159,20 @@ func (g FirstBackend) Records(name string, exact bool) (records []msg.Service, e
 	return nil, lastError
 }
 
+func (g FirstBackend) AppendRecords(dst []msg.Service, name string, exact bool) ([]msg.Service, error) {
+	var lastError error
+	for _, backend := range g {
+		records, err := AppendRecords(backend, dst, name, exact)
+		if (err == nil || WithRecords(err)) && len(records) > len(dst) {
+			return records, err
+		}
+		if err != nil {
+			lastError = err
+		}
+	}
+	return dst, lastError
+}
+
 func (g FirstBackend) ReverseRecord(name string) (record *msg.Service, err error) {
 	var lastError error
 	for _, backend := range g {
@@ -46,7 +186,214 @@ func (g FirstBackend) ReverseRecord(name string) (record *msg.Service, err error
 	return nil, lastError
 }
 
+func (g FirstBackend) ReverseRecords(name string) (records []msg.Service, err error) {
+	var lastError error
+	for _, backend := range g {
+		if records, err = ReverseRecords(backend, name); err == nil && len(records) > 0 {
+			return records, nil
+		}
+		if err != nil {
+			lastError = err
+		}
+	}
+	return nil, lastError
+}
+
 func (g FirstBackend) HasSynced() bool {
 	// Stub implementation only to satisfy interface.
 	return true
 }
+
+// BackendMux exposes the Backend interface over multiple Backends, each
+// authoritative for a zone. A name is answered by the Backend registered for
+// the longest zone containing it, or by the default Backend if there is none.
+type BackendMux struct {
+	def Backend
+
+	lock  sync.RWMutex
+	zones map[string]Backend
+}
+
+// BackendMux implements Backend, RecordsAppender, ReverseRecordsBackend,
+// ZoneTransferer and Generationer
+var (
+	_ Backend               = &BackendMux{}
+	_ RecordsAppender       = &BackendMux{}
+	_ ReverseRecordsBackend = &BackendMux{}
+	_ ZoneTransferer        = &BackendMux{}
+	_ Generationer          = &BackendMux{}
+)
+
+// NewBackendMux returns a BackendMux falling back to def, which may be nil,
+// for names outside of every registered zone.
+func NewBackendMux(def Backend) *BackendMux {
+	return &BackendMux{def: def, zones: make(map[string]Backend)}
+}
+
+// Handle registers the Backend for zone, replacing any previous one.
+func (m *BackendMux) Handle(zone string, backend Backend) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.zones[dns.CanonicalName(zone)] = backend
+}
+
+// HandleRemove deregisters the Backend for zone.
+func (m *BackendMux) HandleRemove(zone string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.zones, dns.CanonicalName(zone))
+}
+
+// Match returns the Backend answering for name, or nil if there is none.
+func (m *BackendMux) Match(name string) Backend {
+	name = dns.CanonicalName(name)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if backend, ok := m.zones[name[off:]]; ok {
+			return backend
+		}
+	}
+	if backend, ok := m.zones["."]; ok {
+		return backend
+	}
+	return m.def
+}
+
+func (m *BackendMux) Records(name string, exact bool) ([]msg.Service, error) {
+	backend := m.Match(name)
+	if backend == nil {
+		return nil, ErrNotFound
+	}
+	return backend.Records(name, exact)
+}
+
+func (m *BackendMux) AppendRecords(dst []msg.Service, name string, exact bool) ([]msg.Service, error) {
+	backend := m.Match(name)
+	if backend == nil {
+		return dst, ErrNotFound
+	}
+	return AppendRecords(backend, dst, name, exact)
+}
+
+func (m *BackendMux) ReverseRecord(name string) (*msg.Service, error) {
+	backend := m.Match(name)
+	if backend == nil {
+		return nil, ErrNotFound
+	}
+	return backend.ReverseRecord(name)
+}
+
+func (m *BackendMux) ReverseRecords(name string) ([]msg.Service, error) {
+	backend := m.Match(name)
+	if backend == nil {
+		return nil, ErrNotFound
+	}
+	return ReverseRecords(backend, name)
+}
+
+func (m *BackendMux) RangeZone(zone string, fn func(name string, records []msg.Service) bool) error {
+	backend := m.Match(zone)
+	if backend == nil {
+		return ErrNotFound
+	}
+	return RangeZone(backend, zone, fn)
+}
+
+// Generation returns the sum of the generations of the Backends, which
+// changes whenever one of them does.
+func (m *BackendMux) Generation() uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var sum uint64
+	if m.def != nil {
+		sum = generation(m.def)
+	}
+	for _, backend := range m.zones {
+		sum += generation(backend)
+	}
+	return sum
+}
+
+// HasSynced returns true once every Backend has synced.
+func (m *BackendMux) HasSynced() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.def != nil && !m.def.HasSynced() {
+		return false
+	}
+	for _, backend := range m.zones {
+		if !backend.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// StaticBackend is a Backend serving a fixed set of records, keyed by fully
+// qualified name. Non exact queries also return the records of the names
+// below the queried name.
+type StaticBackend map[string][]msg.Service
+
+// StaticBackend implements Backend, ReverseRecordsBackend and ZoneTransferer
+var (
+	_ Backend               = StaticBackend{}
+	_ ReverseRecordsBackend = StaticBackend{}
+	_ ZoneTransferer        = StaticBackend{}
+)
+
+func (b StaticBackend) Records(name string, exact bool) ([]msg.Service, error) {
+	name = dns.CanonicalName(name)
+	var records []msg.Service
+	for key, services := range b {
+		key = dns.CanonicalName(key)
+		if key == name || (!exact && dns.IsSubDomain(name, key)) {
+			records = append(records, services...)
+		}
+	}
+	if len(records) == 0 {
+		return nil, ErrNotFound
+	}
+	return records, nil
+}
+
+func (b StaticBackend) ReverseRecord(name string) (*msg.Service, error) {
+	name = dns.CanonicalName(name)
+	for key, services := range b {
+		if dns.CanonicalName(key) == name && len(services) > 0 {
+			return &services[0], nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (b StaticBackend) ReverseRecords(name string) ([]msg.Service, error) {
+	name = dns.CanonicalName(name)
+	for key, services := range b {
+		if dns.CanonicalName(key) == name && len(services) > 0 {
+			return services, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (b StaticBackend) RangeZone(zone string, fn func(name string, records []msg.Service) bool) error {
+	zone = dns.CanonicalName(zone)
+	names := make([]string, 0, len(b))
+	for key := range b {
+		if dns.IsSubDomain(zone, dns.CanonicalName(key)) {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !fn(dns.CanonicalName(name), b[name]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (b StaticBackend) HasSynced() bool {
+	return true
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+	"k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+func TestBackendMux(t *testing.T) {
+	def := StaticBackend{"svc.cluster.local.": {{Host: "10.0.0.1"}}}
+	zone := StaticBackend{
+		"a.example.com.": {{Host: "10.0.0.2"}},
+		"b.example.com.": {{Host: "10.0.0.3"}},
+	}
+	sub := StaticBackend{"x.sub.example.com.": {{Host: "10.0.0.4"}}}
+	reverse := StaticBackend{"4.0.0.10.in-addr.arpa.": {{Host: "x.sub.example.com."}}}
+
+	mux := NewBackendMux(def)
+	mux.Handle("example.com", zone)
+	mux.Handle("sub.example.com.", sub)
+	mux.Handle("in-addr.arpa.", reverse)
+
+	for _, tc := range []struct {
+		name     string
+		exact    bool
+		expected []string
+	}{
+		{"svc.cluster.local.", true, []string{"10.0.0.1"}},
+		{"A.Example.com.", true, []string{"10.0.0.2"}},
+		{"example.com.", false, []string{"10.0.0.2", "10.0.0.3"}},
+		{"x.sub.example.com.", false, []string{"10.0.0.4"}},
+		// Longest zone wins, sub.example.com does not contain a.example.com.
+		{"a.sub.example.com.", false, nil},
+		{"c.example.com.", true, nil},
+	} {
+		records, err := mux.Records(tc.name, tc.exact)
+		if tc.expected == nil {
+			if !isEtcdNameError(err, nil) {
+				t.Errorf("%s: expected name error, got %v, %v", tc.name, records, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !sameHosts(records, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, records)
+		}
+	}
+
+	record, err := mux.ReverseRecord("4.0.0.10.in-addr.arpa.")
+	if err != nil || record.Host != "x.sub.example.com." {
+		t.Errorf("unexpected reverse record %v, %v", record, err)
+	}
+
+	mux.HandleRemove("example.com.")
+	if _, err := mux.Records("a.example.com.", true); !isEtcdNameError(err, nil) {
+		t.Errorf("expected name error after removing the zone, got %v", err)
+	}
+	if !mux.HasSynced() {
+		t.Error("expected mux to be synced")
+	}
+}
+
+func TestAppendRecords(t *testing.T) {
+	mux := NewBackendMux(StaticBackend{"svc.cluster.local.": {{Host: "10.0.0.1"}}})
+	mux.Handle("example.com.", FirstBackend{
+		StaticBackend{"a.example.com.": {{Host: "10.0.0.2"}}},
+		StaticBackend{"b.example.com.": {{Host: "10.0.0.3"}}},
+	})
+
+	dst := []msg.Service{{Host: "first"}}
+	for _, tc := range []struct {
+		name     string
+		expected []string
+	}{
+		{"svc.cluster.local.", []string{"first", "10.0.0.1"}},
+		{"a.example.com.", []string{"first", "10.0.0.2"}},
+		{"b.example.com.", []string{"first", "10.0.0.3"}},
+		{"c.example.com.", nil},
+	} {
+		records, err := AppendRecords(mux, dst, tc.name, true)
+		if tc.expected == nil {
+			if err == nil || len(records) != len(dst) {
+				t.Errorf("%s: expected an error and dst, got %v, %v", tc.name, records, err)
+			}
+			continue
+		}
+		if err != nil || !sameHosts(records, tc.expected) || records[0].Host != "first" {
+			t.Errorf("%s: expected %v, got %v, %v", tc.name, tc.expected, records, err)
+		}
+	}
+
+	// The buffers of the server are cleared once released.
+	buf := &recordsBuffer{services: []msg.Service{{Host: "10.0.0.1"}}}
+	services := buf.services
+	buf.release()
+	if services[0].Host != "" || len(buf.services) != 0 {
+		t.Errorf("expected a cleared buffer, got %v", services)
+	}
+}
+
+func TestPartialRecords(t *testing.T) {
+	config := &Config{Domain: "cluster.local.", Nameservers: []string{"127.0.0.1:53"}, NoRec: true, RCache: 100}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(partialBackend{}, config)
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeSRV} {
+		req := new(dns.Msg)
+		req.SetQuestion("*.*.svc.cluster.local.", qtype)
+		w := &recordingWriter{}
+		s.ServeDNS(w, req)
+		if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess || !w.msg.Truncated || len(w.msg.Answer) != 1 {
+			t.Fatalf("expected the partial records with TC set, got %v", w.msg)
+		}
+		// The next query is answered by the backend again.
+		if m := s.rcache.Hit(req.Question[0], false, false, req.Id); m != nil {
+			t.Errorf("expected the partial reply not to be cached, got %v", m)
+		}
+	}
+}
+
+type partialBackend struct{ StaticBackend }
+
+func (partialBackend) Records(name string, exact bool) ([]msg.Service, error) {
+	return []msg.Service{{Host: "10.0.0.1", Port: 80, Key: msg.Path("a.default.svc.cluster.local.")}},
+		fmt.Errorf("wildcard query timed out: %w", ErrPartial)
+}
+
+func sameHosts(records []msg.Service, hosts []string) bool {
+	if len(records) != len(hosts) {
+		return false
+	}
+	seen := map[string]bool{}
+	for _, record := range records {
+		seen[record.Host] = true
+	}
+	for _, host := range hosts {
+		if !seen[host] {
+			return false
+		}
+	}
+	return true
+}
+
+// generationBackend is a StaticBackend mapped to a name at a generation.
+type generationBackend struct {
+	StaticBackend
+	generation uint64
+}
+
+func (b *generationBackend) Generation() uint64 { return b.generation }
+
+func TestGenerationInvalidatesCache(t *testing.T) {
+	config := &Config{Domain: "cluster.local.", Nameservers: []string{"127.0.0.1:53"}, NoRec: true, RCache: 100, RCacheTtl: 60}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	backend := &generationBackend{StaticBackend: StaticBackend{"web.default.svc.cluster.local.": {{Host: "10.0.0.1"}}}, generation: 1}
+	mux := NewBackendMux(backend)
+	mux.Handle("example.com.", StaticBackend{})
+	s := New(mux, config)
+
+	query := func() string {
+		req := new(dns.Msg)
+		req.SetQuestion("web.default.svc.cluster.local.", dns.TypeA)
+		w := &recordingWriter{}
+		s.ServeDNS(w, req)
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Fatalf("expected a single answer, got %v", w.msg)
+		}
+		return w.msg.Answer[0].(*dns.A).A.String()
+	}
+	if got := query(); got != "10.0.0.1" {
+		t.Fatalf("expected 10.0.0.1, got %s", got)
+	}
+	// The reply is cached until the generation changes.
+	backend.StaticBackend["web.default.svc.cluster.local."] = []msg.Service{{Host: "10.0.0.2"}}
+	if got := query(); got != "10.0.0.1" {
+		t.Errorf("expected the cached 10.0.0.1, got %s", got)
+	}
+	backend.generation++
+	if got := mux.Generation(); got != 2 {
+		t.Errorf("expected the generation of the mux to be 2, got %d", got)
+	}
+	if got := query(); got != "10.0.0.2" {
+		t.Errorf("expected 10.0.0.2 at the next generation, got %s", got)
+	}
+}
+
+func TestPTRAnswersEveryReverseRecord(t *testing.T) {
+	config := &Config{Domain: "cluster.local.", Nameservers: []string{"127.0.0.1:53"}, NoRec: true}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	backend := StaticBackend{"1.0.0.10.in-addr.arpa.": {
+		{Host: "a.default.svc.cluster.local.", Ttl: 30},
+		{Host: "b.default.svc.cluster.local.", Ttl: 30},
+	}}
+	mux := NewBackendMux(nil)
+	mux.Handle("in-addr.arpa.", backend)
+	s := New(mux, config)
+
+	req := new(dns.Msg)
+	req.SetQuestion("1.0.0.10.in-addr.arpa.", dns.TypePTR)
+	w := &recordingWriter{}
+	s.ServeDNS(w, req)
+	if w.msg == nil || len(w.msg.Answer) != 2 {
+		t.Fatalf("expected 2 answers, got %v", w.msg)
+	}
+	for i, want := range []string{"a.default.svc.cluster.local.", "b.default.svc.cluster.local."} {
+		if got := w.msg.Answer[i].(*dns.PTR).Ptr; got != want {
+			t.Errorf("expected the answer %d to be %s, got %s", i, want, got)
+		}
+	}
+
+	// A Backend with a single reverse record per name is answered through
+	// ReverseRecord.
+	records, err := ReverseRecords(FirstBackend{singleReverseBackend{backend}}, "1.0.0.10.in-addr.arpa.")
+	if err != nil || len(records) != 1 || records[0].Host != "a.default.svc.cluster.local." {
+		t.Errorf("expected the first reverse record alone, got %v, %v", records, err)
+	}
+}
+
+// singleReverseBackend hides the ReverseRecords of a Backend.
+type singleReverseBackend struct {
+	Backend
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import "github.com/miekg/dns"
+
+// cnameGlue resolves the targets of the CNAME records that are outside of
+// the served domains through the nameservers, and returns their address
+// records for the additional section, sparing the client the lookup.
+// Targets that do not resolve are skipped.
+func (s *server) cnameGlue(records []dns.RR, bufsize uint16, dnssec bool) (extra []dns.RR) {
+	if s.config.NoRec {
+		return nil
+	}
+	for _, rr := range records {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok || s.inDomain(cname.Target) {
+			continue
+		}
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			m, err := s.Lookup(cname.Target, qtype, bufsize, dnssec)
+			if err != nil {
+				if s.config.Verbose {
+					logf("failure to resolve CNAME target %q: %s", cname.Target, err)
+				}
+				continue
+			}
+			for _, answer := range m.Answer {
+				if t := answer.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA || t == dns.TypeCNAME {
+					extra = append(extra, answer)
+				}
+			}
+		}
+	}
+	return extra
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startUDPUpstream starts a UDP nameserver answering A queries for
+// www.example.com. with 192.0.2.1 and AAAA queries with 2001:db8::1, and
+// returns its address.
+func startUDPUpstream(t *testing.T) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			hdr := dns.RR_Header{Name: req.Question[0].Name, Rrtype: req.Question[0].Qtype, Class: dns.ClassINET, Ttl: 30}
+			switch {
+			case req.Question[0].Name != "www.example.com.":
+				m.Rcode = dns.RcodeNameError
+			case req.Question[0].Qtype == dns.TypeA:
+				m.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.ParseIP("192.0.2.1")}}
+			case req.Question[0].Qtype == dns.TypeAAAA:
+				m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")}}
+			}
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	return conn.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func TestChaseCNAME(t *testing.T) {
+	addr, stop := startUDPUpstream(t)
+	defer stop()
+
+	backend := StaticBackend{
+		"ext.default.svc.cluster.local.":     {{Host: "www.example.com"}},
+		"missing.default.svc.cluster.local.": {{Host: "missing.example.com"}},
+		"local.default.svc.cluster.local.":   {{Host: "a.default.svc.cluster.local"}},
+	}
+	for _, chase := range []bool{false, true} {
+		config := &Config{Domain: "cluster.local.", Nameservers: []string{addr}, ChaseCNAME: chase}
+		if err := SetDefaults(config); err != nil {
+			t.Fatal(err)
+		}
+		s := New(backend, config)
+
+		for name, glue := range map[string]int{
+			"ext.default.svc.cluster.local.":     2,
+			"missing.default.svc.cluster.local.": 0,
+			"local.default.svc.cluster.local.":   0,
+		} {
+			req := new(dns.Msg)
+			req.SetQuestion(name, dns.TypeCNAME)
+			w := &recordingWriter{}
+			s.ServeDNS(w, req)
+			if w.msg == nil || len(w.msg.Answer) != 1 {
+				t.Fatalf("expected a CNAME for %q, got %v", name, w.msg)
+			}
+			if !chase {
+				glue = 0
+			}
+			if len(w.msg.Extra) != glue {
+				t.Errorf("chase %v: expected %d additional records for %q, got %v", chase, glue, name, w.msg.Extra)
+			}
+		}
+	}
+}
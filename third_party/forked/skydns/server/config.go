@@ -6,6 +6,7 @@ package server
 
 import (
 	"crypto"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"os"
@@ -28,29 +29,128 @@ type Config struct {
 	DnsAddr string `json:"dns_addr,omitempty"`
 	// bind to port(s) activated by systemd. If set to true, this overrides DnsAddr.
 	Systemd bool `json:"systemd,omitempty"`
+	// Set SO_REUSEPORT on the sockets bound to DnsAddr, so that a replacement
+	// process can bind them before this one exits.
+	ReusePort bool `json:"reuse_port,omitempty"`
+	// Do not serve DNS over UDP.
+	NoUDP bool `json:"no_udp,omitempty"`
+	// Do not serve DNS over TCP.
+	NoTCP bool `json:"no_tcp,omitempty"`
+	// The ip:port SkyDNS serves DNS over TLS (RFC 7858) on, with
+	// TLSConfig, see NewDoTConfig. Disabled if empty.
+	DoTAddr   string      `json:"dot_addr,omitempty"`
+	TLSConfig *tls.Config `json:"-"`
+	// Do not compress names in responses, for clients that mishandle
+	// compression pointers.
+	NoCompress bool `json:"no_compress,omitempty"`
 	// The domain SkyDNS is authoritative for, defaults to skydns.local.
 	Domain string `json:"domain,omitempty"`
+	// Other domains whose names are answered from the backend rather than
+	// forwarded, e.g. clusterset.local.
+	ExtraDomains []string `json:"extra_domains,omitempty"`
+	// LocalZones, if set, holds more domains answered from the backend,
+	// which can change while serving.
+	LocalZones *Zones `json:"-"`
 	// Domain pointing to a key where service info is stored when being queried
 	// for local.dns.skydns.local.
 	Local string `json:"local,omitempty"`
 	// The hostmaster responsible for this domain, defaults to hostmaster.<Domain>.
 	Hostmaster string `json:"hostmaster,omitempty"`
 	DNSSEC     string `json:"dnssec,omitempty"`
+	// Deny names and types with NSEC white lies (RFC 4470) rather than
+	// NSEC3 ones when signing.
+	NSEC bool `json:"nsec,omitempty"`
+	// Maximum number of A, AAAA or SRV records answered over UDP for the
+	// names of the served domains, 0 for no limit. The limited replies are
+	// truncated (TC), replies over TCP are complete.
+	MaxAnswers int `json:"max_answers,omitempty"`
 	// Round robin A/AAAA replies. Default is true.
 	RoundRobin bool `json:"round_robin,omitempty"`
+	// Order of the A/AAAA records in replies: none, random or round-robin.
+	// Overrides RoundRobin if set.
+	AnswerOrder AnswerOrder `json:"answer_order,omitempty"`
 	// Round robin selection of nameservers from among those listed, rather than have all forwarded requests try the first listed server first every time.
 	NSRotate bool `json:"ns_rotate,omitempty"`
+	// Race forwarded queries to the two historically fastest nameservers and
+	// answer with the first valid reply, rather than trying them in turn.
+	RaceUpstreams bool `json:"race_upstreams,omitempty"`
 	// List of ip:port, separated by commas of recursive nameservers to forward queries to.
 	Nameservers []string `json:"nameservers,omitempty"`
+	// CIDRs, e.g. the service and pod CIDRs, whose reverse names SkyDNS is
+	// authoritative for. PTR queries for addresses within them that have no
+	// record get NXDOMAIN instead of being forwarded.
+	ReverseCIDRs []string `json:"reverse_cidrs,omitempty"`
+	// CIDRs of the clients allowed to transfer the domains with AXFR over
+	// TCP, or IXFR. The transfers are refused if empty.
+	TransferCIDRs []string `json:"transfer_cidrs,omitempty"`
+	// Secrets, base64, of the TSIG keys (RFC 8945) by name. The signed
+	// queries are verified, and their replies signed with the same key.
+	TsigSecret map[string]string `json:"tsig_secret,omitempty"`
+	// Names of the TSIG keys the transfers must be signed with, if any. The
+	// NOTIFY messages are signed with the first one.
+	TransferKeys []string `json:"transfer_keys,omitempty"`
+	// Name of the TSIG key signing the queries forwarded to Nameservers, if
+	// any. The queries are then not pipelined over UpstreamConns, whose
+	// replies could not be verified.
+	ForwardKey string `json:"forward_key,omitempty"`
+	// What is done with the EDNS Client Subnet options of the queries
+	// forwarded to the nameservers. Defaults to SubnetPass.
+	SubnetForward SubnetPolicy `json:"subnet_forward,omitempty"`
+	// Source prefixes of the client subnets forwarded with SubnetReplace.
+	// Default to 24 and 56 (RFC 7871, section 11.1).
+	SubnetPrefixV4 int `json:"subnet_prefix_v4,omitempty"`
+	SubnetPrefixV6 int `json:"subnet_prefix_v6,omitempty"`
+	// Number of changes to the records of the domain kept for the
+	// incremental zone transfers (IXFR). 0 answers IXFR with the whole
+	// domain.
+	IXFRJournal int `json:"ixfr_journal,omitempty"`
+	// Addresses, host:port, of the secondaries notified (NOTIFY) when the
+	// records of the domain change.
+	Notify []string `json:"notify,omitempty"`
+	// If set, whether this replica is the one notifying the secondaries, so
+	// that they are notified once when several replicas serve the domain.
+	NotifyLeader func() bool `json:"-"`
+	// How often the records of the domain are compared to the last ones
+	// when IXFRJournal or Notify are set, the serial of the domain then
+	// being the time of their last change. The journal is kept by each
+	// replica: the secondaries must transfer from a single one. Defaults
+	// to 1s.
+	JournalInterval time.Duration `json:"journal_interval,omitempty"`
+	// Maximum number of persistent TCP connections per nameserver that
+	// queries forwarded over TCP, or TLS with UpstreamTLS, are pipelined on.
+	// 0 dials a connection per query.
+	UpstreamConns int `json:"upstream_conns,omitempty"`
+	// Number of queries in flight on a pooled connection before another
+	// connection is opened, at most 1024. Defaults to 16.
+	UpstreamPipeline int `json:"upstream_pipeline,omitempty"`
+	// Pooled connections idle for longer are closed. Defaults to 30s.
+	UpstreamIdleTimeout time.Duration `json:"upstream_idle_timeout,omitempty"`
+	// If set, the queries are forwarded to the nameservers over TLS (DNS
+	// over TLS, RFC 7858) with this configuration, whatever the transport
+	// they were received over. The stub domains are still queried over UDP
+	// and TCP.
+	UpstreamTLS *tls.Config `json:"-"`
 	// Never provide a recursive service.
 	NoRec       bool          `json:"no_rec,omitempty"`
 	ReadTimeout time.Duration `json:"read_timeout,omitempty"`
+	// Resolve the out-of-domain targets of the CNAME records answered to
+	// CNAME queries, e.g. of ExternalName services, through the nameservers
+	// and add their addresses to the additional section.
+	ChaseCNAME bool `json:"chase_cname,omitempty"`
 	// Default priority on SRV records when none is given. Defaults to 10.
 	Priority uint16 `json:"priority"`
 	// Default TTL, in seconds, when none is given in etcd. Defaults to 3600.
 	Ttl uint32 `json:"ttl,omitempty"`
 	// Minimum TTL, in seconds, for NXDOMAIN responses. Defaults to 300.
 	MinTtl uint32 `json:"min_ttl,omitempty"`
+	// Serial of the SOA records. Defaults to the start of the current hour,
+	// in Unix time.
+	SOASerial uint32 `json:"soa_serial,omitempty"`
+	// Refresh, retry and expire intervals of the SOA records, in seconds.
+	// Default to 28800, 7200 and 604800.
+	SOARefresh uint32 `json:"soa_refresh,omitempty"`
+	SOARetry   uint32 `json:"soa_retry,omitempty"`
+	SOAExpire  uint32 `json:"soa_expire,omitempty"`
 	// SCache, capacity of the signature cache in signatures stored.
 	SCache int `json:"scache,omitempty"`
 	// RCache, capacity of response cache in resource records stored.
@@ -69,12 +169,34 @@ type Config struct {
 
 	Verbose bool `json:"-"`
 
+	// Observer, if set, is called with every query served and its reply.
+	Observer QueryObserver `json:"-"`
+	// Overrides, if set, forwards zones to other nameservers for a while.
+	Overrides *ForwardOverrides `json:"-"`
+	// Fallthrough, if set, holds zones answered from the backend, whose
+	// unknown names are forwarded.
+	Fallthrough *FallthroughZones `json:"-"`
+	// Rewrites, if set, rewrites the names of the queries and answers.
+	Rewrites *Rewrites `json:"-"`
+	// Sorter, if set, filters and orders the address records answered.
+	Sorter AnswerSorter `json:"-"`
+	// Authorizer, if set, refuses the queries for names of the served
+	// domains that a client may not resolve.
+	Authorizer QueryAuthorizer `json:"-"`
+	// SearchPath, if set, expands the names queried in the first search
+	// domain of a client with its other search domains (autopath).
+	SearchPath SearchPath `json:"-"`
+
 	Version bool
 
 	// some predefined string "constants"
 	localDomain string // "local.dns." + config.Domain
 	dnsDomain   string // "ns.dns". + config.Domain
 
+	// ReverseCIDRs and TransferCIDRs, parsed.
+	reverseNets  []*net.IPNet
+	transferNets []*net.IPNet
+
 	// Stub zones support. Pointer to a map that we refresh when we see
 	// an update. Map contains domainname -> nameserver:port
 	stub *map[string][]string
@@ -87,6 +209,63 @@ func SetDefaults(config *Config) error {
 	if config.DnsAddr == "" {
 		config.DnsAddr = "127.0.0.1:53"
 	}
+	if config.UpstreamPipeline <= 0 {
+		config.UpstreamPipeline = 16
+	}
+	if config.UpstreamPipeline > maxConnInflight {
+		return fmt.Errorf("at most %d queries may be pipelined on an upstream connection", maxConnInflight)
+	}
+	if config.UpstreamIdleTimeout == 0 {
+		config.UpstreamIdleTimeout = 30 * time.Second
+	}
+	if config.JournalInterval == 0 {
+		config.JournalInterval = time.Second
+	}
+	if config.NoUDP && config.NoTCP {
+		return fmt.Errorf("cannot disable both the UDP and the TCP listener")
+	}
+	if config.DoTAddr != "" && config.TLSConfig == nil {
+		return fmt.Errorf("DNS over TLS requires a TLS configuration")
+	}
+	if config.AnswerOrder != "" {
+		if _, err := ParseAnswerOrder(string(config.AnswerOrder)); err != nil {
+			return err
+		}
+	}
+	if config.SubnetForward == "" {
+		config.SubnetForward = SubnetPass
+	}
+	if _, err := ParseSubnetPolicy(string(config.SubnetForward)); err != nil {
+		return err
+	}
+	if config.SubnetPrefixV4 == 0 {
+		config.SubnetPrefixV4 = 24
+	}
+	if config.SubnetPrefixV6 == 0 {
+		config.SubnetPrefixV6 = 56
+	}
+	if config.SubnetPrefixV4 < 0 || config.SubnetPrefixV4 > 32 || config.SubnetPrefixV6 < 0 || config.SubnetPrefixV6 > 128 {
+		return fmt.Errorf("invalid client subnet prefixes /%d and /%d", config.SubnetPrefixV4, config.SubnetPrefixV6)
+	}
+	config.reverseNets = nil
+	for _, cidr := range config.ReverseCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid reverse CIDR %q: %v", cidr, err)
+		}
+		config.reverseNets = append(config.reverseNets, ipNet)
+	}
+	config.transferNets = nil
+	for _, cidr := range config.TransferCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid transfer CIDR %q: %v", cidr, err)
+		}
+		config.transferNets = append(config.transferNets, ipNet)
+	}
+	if err := setTsigDefaults(config); err != nil {
+		return err
+	}
 	if config.Domain == "" {
 		config.Domain = "skydns.local."
 	}
@@ -102,6 +281,15 @@ func SetDefaults(config *Config) error {
 	if config.Ttl == 0 {
 		config.Ttl = 3600
 	}
+	if config.SOARefresh == 0 {
+		config.SOARefresh = 28800
+	}
+	if config.SOARetry == 0 {
+		config.SOARetry = 7200
+	}
+	if config.SOAExpire == 0 {
+		config.SOAExpire = 604800
+	}
 	if config.Priority == 0 {
 		config.Priority = 10
 	}
@@ -130,6 +318,9 @@ func SetDefaults(config *Config) error {
 		}
 	}
 	config.Domain = dns.Fqdn(strings.ToLower(config.Domain))
+	for i, domain := range config.ExtraDomains {
+		config.ExtraDomains[i] = dns.Fqdn(strings.ToLower(domain))
+	}
 	if config.DNSSEC != "" {
 		// For some reason the + are replaces by spaces in etcd. Re-replace them
 		keyfile := strings.Replace(config.DNSSEC, " ", "+", -1)
@@ -137,14 +328,20 @@ func SetDefaults(config *Config) error {
 		if err != nil {
 			return err
 		}
-		if k.Header().Name != dns.Fqdn(config.Domain) {
-			return fmt.Errorf("ownername of DNSKEY must match SkyDNS domain")
-		}
-		k.Header().Ttl = config.Ttl
 		config.PubKey = k
-		config.KeyTag = k.KeyTag()
 		config.PrivKey = p
 	}
+	// The key may also be set directly, e.g. loaded from a Secret.
+	if config.PubKey != nil {
+		if config.PubKey.Header().Name != dns.Fqdn(config.Domain) {
+			return fmt.Errorf("ownername of DNSKEY must match SkyDNS domain")
+		}
+		if config.PrivKey == nil {
+			return fmt.Errorf("unsupported DNSKEY algorithm %d", config.PubKey.Algorithm)
+		}
+		config.PubKey.Header().Ttl = config.Ttl
+		config.KeyTag = config.PubKey.KeyTag()
+	}
 	config.localDomain = appendDomain("local.dns", config.Domain)
 	config.dnsDomain = appendDomain("ns.dns", config.Domain)
 	stubmap := make(map[string][]string)
@@ -5,9 +5,12 @@
 package server
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
+	"fmt"
 	"os"
 	"time"
 
@@ -25,30 +28,43 @@ var (
 // ParseKeyFile read a DNSSEC keyfile as generated by dnssec-keygen or other
 // utilities. It add ".key" for the public key and ".private" for the private key.
 func ParseKeyFile(file string) (*dns.DNSKEY, crypto.Signer, error) {
-	f, e := os.Open(file + ".key")
+	public, e := os.ReadFile(file + ".key")
 	if e != nil {
 		return nil, nil, e
 	}
-	k, e := dns.ReadRR(f, file+".key")
+	private, e := os.ReadFile(file + ".private")
 	if e != nil {
 		return nil, nil, e
 	}
-	f, e = os.Open(file + ".private")
+	return ParseKey(public, private, file)
+}
+
+// ParseKey parses a DNSSEC key pair in the format of dnssec-keygen, e.g. as
+// stored in a Kubernetes Secret. file names the pair in the errors.
+func ParseKey(public, private []byte, file string) (*dns.DNSKEY, crypto.Signer, error) {
+	k, e := dns.ReadRR(bytes.NewReader(public), file+".key")
 	if e != nil {
 		return nil, nil, e
 	}
-	p, e := k.(*dns.DNSKEY).ReadPrivateKey(f, file+".private")
+	key, ok := k.(*dns.DNSKEY)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s.key holds no DNSKEY", file)
+	}
+	p, e := key.ReadPrivateKey(bytes.NewReader(private), file+".private")
 	if e != nil {
 		return nil, nil, e
 	}
 
 	if v, ok := p.(*rsa.PrivateKey); ok {
-		return k.(*dns.DNSKEY), v, nil
+		return key, v, nil
 	}
 	if v, ok := p.(*ecdsa.PrivateKey); ok {
-		return k.(*dns.DNSKEY), v, nil
+		return key, v, nil
+	}
+	if v, ok := p.(ed25519.PrivateKey); ok {
+		return key, v, nil
 	}
-	return k.(*dns.DNSKEY), nil, nil
+	return key, nil, nil
 }
 
 // Sign signs a message m, it takes care of negative or nodata responses as
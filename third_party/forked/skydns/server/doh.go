@@ -0,0 +1,100 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/coredns/coredns/plugin/pkg/doh"
+	"github.com/miekg/dns"
+)
+
+// DoHHandler returns the handler of the DNS over HTTPS (RFC 8484) queries
+// sent to doh.Path. They are answered as the queries over TCP, without
+// truncation.
+func (s *server) DoHHandler() http.Handler {
+	h := s.handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != doh.Path {
+			http.NotFound(w, req)
+			return
+		}
+		m, err := doh.RequestToMsg(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(m.Question) != 1 {
+			http.Error(w, "expected a single question", http.StatusBadRequest)
+			return
+		}
+
+		dw := &dohWriter{remote: tcpAddr(req.RemoteAddr)}
+		dw.local, _ = req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		h.ServeDNS(dw, m)
+		if dw.msg == nil {
+			http.Error(w, "no reply", http.StatusInternalServerError)
+			return
+		}
+		buf, err := dw.msg.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", doh.MimeType)
+		w.Header().Set("Content-Length", fmt.Sprint(len(buf)))
+		w.Write(buf)
+	})
+}
+
+// tcpAddr returns the address of an HTTP client as a TCP one, so that its
+// queries are not truncated.
+func tcpAddr(remoteAddr string) *net.TCPAddr {
+	addr, err := net.ResolveTCPAddr("tcp", remoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+// dohWriter keeps the reply to a DNS over HTTPS or gRPC query.
+type dohWriter struct {
+	local  net.Addr
+	remote *net.TCPAddr
+	msg    *dns.Msg
+}
+
+func (w *dohWriter) LocalAddr() net.Addr {
+	if w.local == nil {
+		return &net.TCPAddr{}
+	}
+	return w.local
+}
+
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohWriter) Write(buf []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(buf), nil
+}
+
+func (w *dohWriter) Close() error        { return nil }
+func (w *dohWriter) TsigTimersOnly(bool) {}
+func (w *dohWriter) Hijack()             {}
+
+// TsigStatus fails, the TSIG records of the queries not being verified over
+// HTTPS or gRPC.
+func (w *dohWriter) TsigStatus() error { return dns.ErrSecret }
@@ -0,0 +1,58 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/doh"
+	"github.com/miekg/dns"
+)
+
+func TestDoHHandler(t *testing.T) {
+	config := &Config{Domain: "cluster.local."}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	h := New(StaticBackend{"a.default.svc.cluster.local.": {{Host: "10.0.0.1"}}}, config).DoHHandler()
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		m := new(dns.Msg)
+		m.SetQuestion("a.default.svc.cluster.local.", dns.TypeA)
+		req, err := doh.NewRequest(method, "kube-dns", m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "192.0.2.1:4242"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", method, w.Code, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != doh.MimeType {
+			t.Errorf("%s: expected content type %q, got %q", method, doh.MimeType, ct)
+		}
+		resp, err := doh.ResponseToMsg(w.Result())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+			t.Errorf("%s: unexpected answer %v", method, resp.Answer)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, doh.Path+"?dns=garbage", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid query, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/other", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for another path, got %d", w.Code)
+	}
+}
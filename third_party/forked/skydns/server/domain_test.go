@@ -0,0 +1,45 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestExtraDomains(t *testing.T) {
+	config := &Config{
+		Domain:       "cluster.local.",
+		ExtraDomains: []string{"ClusterSet.local"},
+		Nameservers:  []string{"127.0.0.1:53"},
+		NoRec:        true,
+	}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(StaticBackend{"a.default.svc.clusterset.local.": {{Host: "10.0.0.1"}}}, config)
+
+	for name, want := range map[string]bool{
+		"cluster.local.":                  true,
+		"a.default.svc.cluster.local.":    true,
+		"clusterset.local.":               true,
+		"a.default.svc.clusterset.local.": true,
+		"notclusterset.local.":            false,
+		"example.com.":                    false,
+	} {
+		if got := s.inDomain(name); got != want {
+			t.Errorf("inDomain(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.default.svc.clusterset.local.", dns.TypeA)
+	w := &recordingWriter{}
+	s.ServeDNS(w, req)
+	if w.msg == nil || len(w.msg.Answer) != 1 {
+		t.Fatalf("expected 1 record from the backend, got %v", w.msg)
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+)
+
+// DoTALPN is the ALPN protocol of DNS over TLS, RFC 7858.
+const DoTALPN = "dot"
+
+// NewDoTConfig returns the TLS configuration of a DNS over TLS listener
+// serving the certificate getCertificate returns, which may change, e.g.
+// when it is renewed. The clients negotiating ALPN are offered DoTALPN,
+// and may resume their sessions with the session tickets of the listener,
+// sparing a full handshake when they reconnect.
+func NewDoTConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{DoTALPN},
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// selfSignedCertificate returns a certificate for host, and a pool trusting
+// it.
+func selfSignedCertificate(t *testing.T, host string) (*tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestDoT(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	cert, pool := selfSignedCertificate(t, "kube-dns.kube-system.svc")
+	config := &Config{Domain: "cluster.local.", DnsAddr: "127.0.0.1:0", NoUDP: true, NoRec: true, DoTAddr: addr,
+		TLSConfig: NewDoTConfig(func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert, nil })}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(StaticBackend{"a.default.svc.cluster.local.": {{Host: "10.0.0.1"}}}, config)
+	go s.Run()
+
+	c := &dns.Client{Net: "tcp-tls", Timeout: time.Second, TLSConfig: &tls.Config{
+		RootCAs:            pool,
+		ServerName:         "kube-dns.kube-system.svc",
+		NextProtos:         []string{DoTALPN},
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}}
+	query := func() tls.ConnectionState {
+		var conn *dns.Conn
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if conn, err = c.Dial(addr); err == nil || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		req := new(dns.Msg)
+		req.SetQuestion("a.default.svc.cluster.local.", dns.TypeA)
+		resp, _, err := c.ExchangeWithConn(req, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+			t.Errorf("expected 10.0.0.1, got %v", resp.Answer)
+		}
+		return conn.Conn.(*tls.Conn).ConnectionState()
+	}
+
+	state := query()
+	if state.NegotiatedProtocol != DoTALPN {
+		t.Errorf("expected the %q ALPN protocol, got %q", DoTALPN, state.NegotiatedProtocol)
+	}
+	// The client resumes its session when reconnecting.
+	if state := query(); !state.DidResume {
+		t.Errorf("expected the session to be resumed")
+	}
+}
+
+func TestDoTRequiresTLSConfig(t *testing.T) {
+	config := &Config{Domain: "cluster.local.", DoTAddr: "127.0.0.1:853"}
+	if err := SetDefaults(config); err == nil {
+		t.Errorf("expected an error without a TLS configuration")
+	}
+}
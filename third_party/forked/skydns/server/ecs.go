@@ -0,0 +1,191 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// SubnetPolicy is what is done with the EDNS Client Subnet options (ECS,
+// RFC 7871) of the queries forwarded to the nameservers.
+type SubnetPolicy string
+
+const (
+	// SubnetPass forwards the ECS options as they are.
+	SubnetPass SubnetPolicy = "pass"
+	// SubnetStrip removes the ECS options, so that the nameservers do not
+	// learn the subnets of the clients.
+	SubnetStrip SubnetPolicy = "strip"
+	// SubnetReplace truncates the ECS options to SubnetPrefixV4 or
+	// SubnetPrefixV6, and adds one with the truncated address of the client
+	// to the EDNS queries without.
+	SubnetReplace SubnetPolicy = "replace"
+)
+
+// ParseSubnetPolicy returns the SubnetPolicy named s.
+func ParseSubnetPolicy(s string) (SubnetPolicy, error) {
+	switch policy := SubnetPolicy(s); policy {
+	case SubnetPass, SubnetStrip, SubnetReplace:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid client subnet policy %q, must be %s, %s or %s", s, SubnetPass, SubnetStrip, SubnetReplace)
+}
+
+// clientSubnet returns the ECS option of m, nil if it has none.
+func clientSubnet(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// subnetNet returns the subnet of the ECS option e, nil if e is nil or asks
+// for answers that are not specific to its subnet, with a 0 source prefix.
+func subnetNet(e *dns.EDNS0_SUBNET) *net.IPNet {
+	if e == nil || e.SourceNetmask == 0 {
+		return nil
+	}
+	bits := 8 * net.IPv6len
+	ip := e.Address
+	if e.Family == 1 {
+		bits = 8 * net.IPv4len
+		ip = ip.To4()
+	}
+	if ip == nil || int(e.SourceNetmask) > bits {
+		return nil
+	}
+	mask := net.CIDRMask(int(e.SourceNetmask), bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// removeSubnet removes the ECS options of m and returns the largest of
+// their scope prefixes.
+func removeSubnet(m *dns.Msg) uint8 {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return 0
+	}
+	var scope uint8
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			if e.SourceScope > scope {
+				scope = e.SourceScope
+			}
+			continue
+		}
+		options = append(options, o)
+	}
+	opt.Option = options
+	return scope
+}
+
+// subnetScoped returns whether the reply r is only valid for the subnet of
+// the query, with a non-zero scope prefix. Such replies are not cached.
+func subnetScoped(r *dns.Msg) bool {
+	e := clientSubnet(r)
+	return e != nil && e.SourceScope > 0
+}
+
+// forwardSubnet applies the SubnetForward policy to m, the copy of a query
+// of the client of w to forward.
+func (s *server) forwardSubnet(w dns.ResponseWriter, m *dns.Msg) {
+	switch s.config.SubnetForward {
+	case SubnetStrip:
+		removeSubnet(m)
+	case SubnetReplace:
+		opt := m.IsEdns0()
+		if opt == nil {
+			return
+		}
+		var ip net.IP
+		prefix := -1
+		if e := clientSubnet(m); e != nil {
+			ip, prefix = e.Address, int(e.SourceNetmask)
+		} else {
+			switch addr := w.RemoteAddr().(type) {
+			case *net.UDPAddr:
+				ip = addr.IP
+			case *net.TCPAddr:
+				ip = addr.IP
+			}
+		}
+		removeSubnet(m)
+		if ip == nil {
+			return
+		}
+		e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 2}
+		bits, max := 8*net.IPv6len, s.config.SubnetPrefixV6
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			e.Family, bits, max = 1, 8*net.IPv4len, s.config.SubnetPrefixV4
+		}
+		// The subnets of the clients are narrowed, never widened.
+		if prefix < 0 || prefix > max {
+			prefix = max
+		}
+		e.SourceNetmask = uint8(prefix)
+		e.Address = ip.Mask(net.CIDRMask(prefix, bits))
+		opt.Option = append(opt.Option, e)
+	}
+}
+
+// subnetHandler answers the queries with an ECS option with an ECS option
+// echoing it (RFC 7871, section 7.2.1). Its scope prefix is the one of the
+// reply, 0 unless the reply is specific to the subnet. The replies to the
+// queries without are answered without, though SubnetReplace added one to
+// the query forwarded.
+func (s *server) subnetHandler(h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		e := clientSubnet(req)
+		if (e == nil && (s.config.SubnetForward != SubnetReplace || req.IsEdns0() == nil)) ||
+			len(req.Question) == 0 || req.Question[0].Qtype == dns.TypeAXFR || req.Question[0].Qtype == dns.TypeIXFR {
+			h.ServeDNS(w, req)
+			return
+		}
+		h.ServeDNS(&subnetWriter{ResponseWriter: w, subnet: e}, req)
+	})
+}
+
+// subnetWriter sets the ECS option of the replies written through it to
+// subnet, the ECS option of the query, with the scope prefix of the reply,
+// or removes it if subnet is nil.
+type subnetWriter struct {
+	dns.ResponseWriter
+	subnet *dns.EDNS0_SUBNET
+}
+
+func (w *subnetWriter) WriteMsg(m *dns.Msg) error {
+	// The reply may be cached, it is not changed.
+	m = m.Copy()
+	scope := removeSubnet(m)
+	if w.subnet == nil {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	opt := replyOPT(m)
+	e := *w.subnet
+	e.SourceScope = scope
+	opt.Option = append(opt.Option, &e)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// setSubnetScope marks the reply m as specific to the subnet of the ECS
+// option e of the query, with a scope prefix of its source prefix.
+func setSubnetScope(m *dns.Msg, e *dns.EDNS0_SUBNET) {
+	removeSubnet(m)
+	opt := replyOPT(m)
+	scoped := *e
+	scoped.SourceScope = e.SourceNetmask
+	opt.Option = append(opt.Option, &scoped)
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// subnetQuery returns an A query for name with the ECS option of subnet, if
+// set.
+func subnetQuery(t *testing.T, name, subnet string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	m.SetEdns0(1232, false)
+	if subnet == "" {
+		return m
+	}
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ones, bits := ipNet.Mask.Size()
+	e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: ipNet.IP}
+	if bits == 8*net.IPv6len {
+		e.Family = 2
+	}
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, e)
+	return m
+}
+
+func TestForwardSubnet(t *testing.T) {
+	received := make(chan *dns.EDNS0_SUBNET, 10)
+	upstream := serveUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		e := clientSubnet(req)
+		received <- e
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30},
+			A:   net.IPv4(10, 0, 0, 1),
+		}}
+		m.SetEdns0(1232, false)
+		if e != nil {
+			// The answer is specific to the subnet.
+			scoped := *e
+			scoped.SourceScope = e.SourceNetmask
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &scoped)
+		}
+		w.WriteMsg(m)
+	}), nil)
+
+	for _, tc := range []struct {
+		policy   SubnetPolicy
+		subnet   string
+		expected string
+	}{
+		{SubnetPass, "192.0.2.42/32", "192.0.2.42/32"},
+		{SubnetPass, "", ""},
+		{SubnetStrip, "192.0.2.42/32", ""},
+		{SubnetReplace, "192.0.2.42/32", "192.0.2.0/24"},
+		{SubnetReplace, "192.0.2.0/20", "192.0.0.0/20"},
+		{SubnetReplace, "2001:db8::42/128", "2001:db8::/56"},
+		// Without an ECS option, the one of the client of the query.
+		{SubnetReplace, "", "127.0.0.0/24"},
+	} {
+		config := &Config{Domain: "cluster.local.", Nameservers: []string{upstream}, SubnetForward: tc.policy, RCache: 10, RCacheTtl: 60}
+		if err := SetDefaults(config); err != nil {
+			t.Fatal(err)
+		}
+		h := New(StaticBackend{}, config).handler()
+
+		for i := 0; i < 2; i++ {
+			w := &recordingWriter{}
+			h.ServeDNS(w, subnetQuery(t, "www.example.com.", tc.subnet))
+			select {
+			case e := <-received:
+				got := ""
+				if n := subnetNet(e); n != nil {
+					got = n.String()
+				}
+				if got != tc.expected {
+					t.Errorf("%s %q: expected %q forwarded, got %q", tc.policy, tc.subnet, tc.expected, got)
+				}
+			default:
+				// Only the replies that are not scoped are cached.
+				if i == 0 || tc.expected != "" {
+					t.Errorf("%s %q: expected query %d to be forwarded", tc.policy, tc.subnet, i)
+				}
+			}
+
+			// The ECS option of the query is echoed.
+			e := clientSubnet(w.msg)
+			if tc.subnet == "" {
+				if e != nil {
+					t.Errorf("%s: expected no ECS option in the reply, got %v", tc.policy, e)
+				}
+				continue
+			}
+			if n := subnetNet(e); n == nil || n.String() != subnetNet(clientSubnet(subnetQuery(t, ".", tc.subnet))).String() {
+				t.Errorf("%s %q: expected the ECS option of the query in the reply, got %v", tc.policy, tc.subnet, e)
+			}
+			if scoped := tc.expected != ""; scoped != (e.SourceScope > 0) {
+				t.Errorf("%s %q: expected a scoped reply: %v, got scope %d", tc.policy, tc.subnet, scoped, e.SourceScope)
+			}
+		}
+	}
+}
+
+func TestSortAnswersSubnet(t *testing.T) {
+	var remote net.Addr
+	config := &Config{
+		Domain: "cluster.local.",
+		NoRec:  true,
+		// The answer depends on the clients of the single address
+		// subnets only.
+		Sorter: func(r net.Addr, answer []dns.RR) ([]dns.RR, bool) {
+			remote = r
+			n, ok := r.(*net.IPNet)
+			if !ok {
+				return answer, true
+			}
+			ones, bits := n.Mask.Size()
+			return answer, ones == bits
+		},
+	}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	h := New(StaticBackend{"web.default.svc.cluster.local.": {{Host: "10.0.0.1"}, {Host: "10.0.0.2"}}}, config).handler()
+
+	w := &recordingWriter{}
+	h.ServeDNS(w, subnetQuery(t, "web.default.svc.cluster.local.", "10.1.2.3/32"))
+	if n, ok := remote.(*net.IPNet); !ok || n.String() != "10.1.2.3/32" {
+		t.Errorf("expected the client subnet to be sorted for, got %v", remote)
+	}
+	if e := clientSubnet(w.msg); e == nil || e.SourceScope != 32 {
+		t.Errorf("expected the reply scoped to the client subnet, got %v", e)
+	}
+
+	// The answer does not depend on the wider subnets.
+	w = &recordingWriter{}
+	h.ServeDNS(w, subnetQuery(t, "web.default.svc.cluster.local.", "10.1.2.0/24"))
+	if n, ok := remote.(*net.IPNet); !ok || n.String() != "10.1.2.0/24" {
+		t.Errorf("expected the client subnet to be sorted for, got %v", remote)
+	}
+	if e := clientSubnet(w.msg); e == nil || e.SourceScope != 0 {
+		t.Errorf("expected the reply not scoped to the client subnet, got %v", e)
+	}
+
+	// Answered from the cache, for another client.
+	w = &recordingWriter{}
+	h.ServeDNS(w, subnetQuery(t, "web.default.svc.cluster.local.", ""))
+	if _, ok := remote.(*net.UDPAddr); !ok {
+		t.Errorf("expected the client address to be sorted for, got %v", remote)
+	}
+	if e := clientSubnet(w.msg); e != nil {
+		t.Errorf("expected no ECS option in the reply, got %v", e)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import "github.com/miekg/dns"
+
+// setExtendedError attaches an Extended DNS Error (RFC 8914) to the reply m,
+// telling the client why its query failed, or was answered as it was, beyond
+// the rcode. It is only attached when the request advertised EDNS0, as the
+// RFC requires. The text is read by any client: it must not tell more than
+// code does.
+func setExtendedError(m, req *dns.Msg, code uint16, text string) {
+	if m == nil || req.IsEdns0() == nil {
+		return
+	}
+	opt := replyOPT(m)
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+// replyOPT returns the OPT record of the reply m, adding one if it has none.
+func replyOPT(m *dns.Msg) *dns.OPT {
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.SetUDPSize(dns.DefaultMsgSize)
+		m.Extra = append(m.Extra, opt)
+	}
+	return opt
+}
+
+// backendFailure returns the SERVFAIL reply to req when the backend cannot
+// answer. The error err of the backend, which may name its internals, is
+// logged rather than answered.
+func (s *server) backendFailure(req *dns.Msg, err error) *dns.Msg {
+	logf("backend failed to answer %q: %s", req.Question[0].Name, err)
+	m := s.ServerFailure(req)
+	setExtendedError(m, req, dns.ExtendedErrorCodeOther, "backend unavailable")
+	return m
+}
+
+// upstreamFailure returns the SERVFAIL reply to req when none of the
+// nameservers it was forwarded to answered. Why is logged by the caller
+// rather than answered.
+func (s *server) upstreamFailure(req *dns.Msg) *dns.Msg {
+	m := s.ServerFailure(req)
+	setExtendedError(m, req, dns.ExtendedErrorCodeNoReachableAuthority, "no nameserver answered")
+	return m
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"k8s.io/dns/third_party/forked/skydns/cache"
+	"k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// extendedError returns the Extended DNS Error of m, nil if there is none.
+func extendedError(m *dns.Msg) *dns.EDNS0_EDE {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ede, ok := o.(*dns.EDNS0_EDE); ok {
+				return ede
+			}
+		}
+	}
+	return nil
+}
+
+func TestExtendedErrors(t *testing.T) {
+	// Nothing listens on the nameserver, so forwarding fails at once.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameserver := conn.LocalAddr().String()
+	conn.Close()
+
+	config := &Config{
+		Domain:      "cluster.local.",
+		Nameservers: []string{nameserver},
+		Ndots:       1,
+	}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(StaticBackend{}, config)
+
+	for _, tc := range []struct {
+		name  string
+		qtype uint16
+		rcode int
+		code  uint16
+	}{
+		{"a.default.svc.cluster.local.", dns.TypeANY, dns.RcodeRefused, dns.ExtendedErrorCodeNotSupported},
+		{"example.com.", dns.TypeA, dns.RcodeServerFailure, dns.ExtendedErrorCodeNoReachableAuthority},
+	} {
+		t.Run(fmt.Sprintf("%s/%d", tc.name, tc.qtype), func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tc.name, tc.qtype)
+			w := &recordingWriter{}
+			s.ServeDNS(w, req)
+			if w.msg == nil || w.msg.Rcode != tc.rcode {
+				t.Fatalf("expected rcode %d, got %v", tc.rcode, w.msg)
+			}
+			if ede := extendedError(w.msg); ede != nil {
+				t.Errorf("expected no extended error without EDNS0, got %v", ede)
+			}
+
+			req.SetEdns0(4096, false)
+			w = &recordingWriter{}
+			s.ServeDNS(w, req)
+			if w.msg == nil || w.msg.Rcode != tc.rcode {
+				t.Fatalf("expected rcode %d, got %v", tc.rcode, w.msg)
+			}
+			if ede := extendedError(w.msg); ede == nil || ede.InfoCode != tc.code {
+				t.Errorf("expected extended error %d, got %v", tc.code, ede)
+			}
+		})
+	}
+}
+
+func TestExtendedErrorBackendFailure(t *testing.T) {
+	config := &Config{Domain: "cluster.local.", Nameservers: []string{"127.0.0.1:53"}, NoRec: true}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(failingBackend{}, config)
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.default.svc.cluster.local.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	w := &recordingWriter{}
+	s.ServeDNS(w, req)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("expected SERVFAIL, got %v", w.msg)
+	}
+	// The error of the backend is not told to the client.
+	if ede := extendedError(w.msg); ede == nil || ede.InfoCode != dns.ExtendedErrorCodeOther || ede.ExtraText != "backend unavailable" {
+		t.Errorf("expected a backend failure without the error of the backend, got %v", ede)
+	}
+}
+
+func TestExtendedErrorStaleAnswer(t *testing.T) {
+	config := &Config{Domain: "cluster.local.", Nameservers: []string{"127.0.0.1:53"}, NoRec: true, RCache: 10}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(staleBackend{StaticBackend{
+		"a.default.svc.cluster.local.": {{Host: "10.0.0.1", Ttl: 5}},
+	}}, config)
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.default.svc.cluster.local.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	w := &recordingWriter{}
+	s.ServeDNS(w, req)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 1 {
+		t.Fatalf("expected the stale record, got %v", w.msg)
+	}
+	if ede := extendedError(w.msg); ede == nil || ede.InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		t.Errorf("expected a stale answer extended error, got %v", ede)
+	}
+	if _, _, ok := s.rcache.Search(cache.Key(req.Question[0], false, false)); ok {
+		t.Errorf("stale reply cached")
+	}
+}
+
+type staleBackend struct{ StaticBackend }
+
+func (b staleBackend) Records(name string, exact bool) ([]msg.Service, error) {
+	records, err := b.StaticBackend.Records(name, exact)
+	if err != nil {
+		return nil, err
+	}
+	return records, fmt.Errorf("from the snapshot: %w", ErrStale)
+}
+
+type failingBackend struct{ StaticBackend }
+
+func (failingBackend) Records(name string, exact bool) ([]msg.Service, error) {
+	return nil, fmt.Errorf("federation down: %w", ErrBackendUnavailable)
+}
+
+func TestBackendErrorRcodes(t *testing.T) {
+	config := &Config{Domain: "cluster.local.", Nameservers: []string{"127.0.0.1:53"}, NoRec: true}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		backend Backend
+		rcode   int
+	}{
+		{failingBackend{}, dns.RcodeServerFailure},
+		{noDataBackend{}, dns.RcodeSuccess},
+	} {
+		s := New(tc.backend, config)
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeTXT, dns.TypeCNAME, dns.TypeMX, dns.TypeSRV} {
+			req := new(dns.Msg)
+			req.SetQuestion("default.svc.cluster.local.", qtype)
+			w := &recordingWriter{}
+			s.ServeDNS(w, req)
+			if w.msg == nil || w.msg.Rcode != tc.rcode {
+				t.Errorf("%T: expected rcode %d for type %d, got %v", tc.backend, tc.rcode, qtype, w.msg)
+				continue
+			}
+			if tc.rcode == dns.RcodeSuccess && (len(w.msg.Answer) != 0 || len(w.msg.Ns) != 1) {
+				t.Errorf("%T: expected NODATA for type %d, got %v", tc.backend, qtype, w.msg)
+			}
+		}
+	}
+}
+
+type noDataBackend struct{ StaticBackend }
+
+func (noDataBackend) Records(name string, exact bool) ([]msg.Service, error) {
+	return nil, fmt.Errorf("namespace: %w", ErrNoData)
+}
@@ -15,7 +15,7 @@ func newExchangeMsg(name string, typ, bufsize uint16, dnssec bool) *dns.Msg {
 }
 
 // exchangeWithRetry sends message m to server, but retries on ServerFailure.
-func exchangeWithRetry(c *dns.Client, m *dns.Msg, server string) (*dns.Msg, error) {
+func exchangeWithRetry(c exchanger, m *dns.Msg, server string) (*dns.Msg, error) {
 	r, _, err := c.Exchange(m, server)
 	if err == nil && r.Rcode == dns.RcodeServerFailure {
 		// redo the query
@@ -24,6 +24,30 @@ func exchangeWithRetry(c *dns.Client, m *dns.Msg, server string) (*dns.Msg, erro
 	return r, err
 }
 
+// tcpExchanger returns the exchanger used to forward queries over TCP: the
+// connection pool when upstream connections are pooled, the TCP client otherwise.
+func (s *server) tcpExchanger() exchanger {
+	if s.tcpPool != nil {
+		return s.tcpPool
+	}
+	return s.dnsTCPclient
+}
+
+// forwardExchanger returns the exchanger used to forward queries to the
+// nameservers: over TLS when UpstreamTLS is set, pooled as over TCP, else
+// over TCP if tcp, over UDP otherwise.
+func (s *server) forwardExchanger(tcp bool) exchanger {
+	switch {
+	case s.tlsPool != nil:
+		return s.tlsPool
+	case s.dnsTLSclient != nil:
+		return s.dnsTLSclient
+	case tcp:
+		return s.tcpExchanger()
+	}
+	return s.dnsUDPclient
+}
+
 func (s *server) randomNameserverID(id uint16) int {
 	nsid := 0
 	if s.config.NSRotate {
@@ -0,0 +1,75 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// FallthroughZones holds the zones answered from the backend, whose names
+// the backend does not know are forwarded to the nameservers of the zone,
+// like the CoreDNS fallthrough. It lets part of a zone served elsewhere be
+// moved into the cluster. It is safe for concurrent use.
+type FallthroughZones struct {
+	mu    sync.RWMutex
+	zones map[string][]string
+}
+
+// NewFallthroughZones returns an empty set of fallthrough zones.
+func NewFallthroughZones() *FallthroughZones {
+	return &FallthroughZones{zones: make(map[string][]string)}
+}
+
+// Set replaces the fallthrough zones with zones, mapping a zone to the
+// nameservers, given as ip:port, of the names the backend does not know.
+// Those of a zone without nameservers are forwarded to the default ones.
+func (f *FallthroughZones) Set(zones map[string][]string) {
+	normalized := make(map[string][]string, len(zones))
+	for zone, nameservers := range zones {
+		normalized[dns.Fqdn(strings.ToLower(zone))] = nameservers
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.zones = normalized
+}
+
+// Match returns the nameservers of the longest fallthrough zone containing
+// name, which must be lower case and fully qualified.
+func (f *FallthroughZones) Match(name string) ([]string, bool) {
+	if f == nil {
+		return nil, false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if len(f.zones) == 0 {
+		return nil, false
+	}
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if nameservers, ok := f.zones[name[off:]]; ok {
+			return nameservers, true
+		}
+	}
+	return nil, false
+}
+
+// fallthroughForward forwards req to the nameservers of its fallthrough
+// zone, if the backend does not know its name, i.e. m is a NXDOMAIN reply,
+// and returns whether it did.
+func (s *server) fallthroughForward(w dns.ResponseWriter, req, m *dns.Msg) (*dns.Msg, bool) {
+	if m.Rcode != dns.RcodeNameError || s.config.Fallthrough == nil {
+		return nil, false
+	}
+	nameservers, ok := s.config.Fallthrough.Match(strings.ToLower(req.Question[0].Name))
+	if !ok {
+		return nil, false
+	}
+	if len(nameservers) == 0 {
+		return s.ServeDNSForward(w, req), true
+	}
+	return s.ServeDNSStubForward(w, req, nameservers), true
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFallthroughZonesMatch(t *testing.T) {
+	f := NewFallthroughZones()
+	f.Set(map[string][]string{
+		"Corp.Example.com":     {"10.0.0.1:53"},
+		"eu.corp.example.com.": nil,
+	})
+
+	for _, tc := range []struct {
+		name string
+		ok   bool
+		ns   int
+	}{
+		{"corp.example.com.", true, 1},
+		{"www.corp.example.com.", true, 1},
+		{"www.eu.corp.example.com.", true, 0},
+		{"example.com.", false, 0},
+		{"notcorp.example.com.", false, 0},
+	} {
+		ns, ok := f.Match(tc.name)
+		if ok != tc.ok || len(ns) != tc.ns {
+			t.Errorf("%s: expected %v with %d nameservers, got %v with %v", tc.name, tc.ok, tc.ns, ok, ns)
+		}
+	}
+
+	f.Set(nil)
+	if _, ok := f.Match("www.corp.example.com."); ok {
+		t.Errorf("expected no fallthrough zone left")
+	}
+	var nilZones *FallthroughZones
+	if _, ok := nilZones.Match("example.com."); ok {
+		t.Errorf("expected no fallthrough zone")
+	}
+}
+
+func TestFallthrough(t *testing.T) {
+	addr, stop := startUDPUpstream(t)
+	defer stop()
+
+	for _, nameservers := range [][]string{{addr}, nil} {
+		config := &Config{
+			Domain:      "cluster.local.",
+			Nameservers: []string{addr},
+			Fallthrough: NewFallthroughZones(),
+		}
+		config.Fallthrough.Set(map[string][]string{"example.com": nameservers})
+		if err := SetDefaults(config); err != nil {
+			t.Fatal(err)
+		}
+		s := New(StaticBackend{"app.example.com.": {{Host: "10.0.0.1"}}}, config)
+
+		for _, tc := range []struct {
+			name   string
+			rcode  int
+			answer string
+		}{
+			// Known to the backend.
+			{"app.example.com.", dns.RcodeSuccess, "10.0.0.1"},
+			// Unknown to the backend, answered by the upstream.
+			{"www.example.com.", dns.RcodeSuccess, "192.0.2.1"},
+			{"missing.example.com.", dns.RcodeNameError, ""},
+		} {
+			// The second round is answered from the cache.
+			for i := 0; i < 2; i++ {
+				req := new(dns.Msg)
+				req.SetQuestion(tc.name, dns.TypeA)
+				w := &recordingWriter{}
+				s.ServeDNS(w, req)
+				if w.msg == nil || w.msg.Rcode != tc.rcode {
+					t.Fatalf("%s: expected rcode %d, got %v", tc.name, tc.rcode, w.msg)
+				}
+				if tc.answer == "" {
+					continue
+				}
+				if len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != tc.answer {
+					t.Errorf("%s: expected %s, got %v", tc.name, tc.answer, w.msg.Answer)
+				}
+			}
+		}
+	}
+}
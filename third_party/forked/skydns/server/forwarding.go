@@ -6,6 +6,10 @@ package server
 
 import (
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -36,17 +40,29 @@ func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 		r   *dns.Msg
 		err error
 	)
+	fwd := s.forwardMsg(w, req, s.config.ForwardKey)
+
+	if s.config.RaceUpstreams && len(s.config.Nameservers) > 1 {
+		if r, err = s.raceExchange(s.forwardExchanger(isTCP(w)), fwd, s.config.Nameservers); err == nil {
+			stripTsig(r)
+			r.Compress = !s.config.NoCompress
+			r.Id = req.Id
+			w.WriteMsg(r)
+			return r
+		}
+		logf("failure to forward request %q", err)
+		m := s.upstreamFailure(req)
+		w.WriteMsg(m)
+		return m
+	}
 
 	nsid := s.randomNameserverID(req.Id)
 	try := 0
 Redo:
-	if isTCP(w) {
-		r, err = exchangeWithRetry(s.dnsTCPclient, req, s.config.Nameservers[nsid])
-	} else {
-		r, err = exchangeWithRetry(s.dnsUDPclient, req, s.config.Nameservers[nsid])
-	}
+	r, err = exchangeWithRetry(s.forwardExchanger(isTCP(w)), fwd, s.config.Nameservers[nsid])
 	if err == nil {
-		r.Compress = true
+		stripTsig(r)
+		r.Compress = !s.config.NoCompress
 		r.Id = req.Id
 		w.WriteMsg(r)
 		return r
@@ -60,20 +76,47 @@ Redo:
 	}
 
 	logf("failure to forward request %q", err)
-	m := s.ServerFailure(req)
+	m := s.upstreamFailure(req)
+	w.WriteMsg(m)
+	return m
+}
+
+// forwardMsg returns the query req of the client of w to forward: without
+// its TSIG record, which only authenticates it to this server, with the
+// SubnetForward policy applied and signed with key if set.
+func (s *server) forwardMsg(w dns.ResponseWriter, req *dns.Msg, key string) *dns.Msg {
+	t := req.IsTsig()
+	if t == nil && key == "" && (s.config.SubnetForward == "" || s.config.SubnetForward == SubnetPass) {
+		return req
+	}
+	m := req.Copy()
+	if t != nil {
+		m.Extra = m.Extra[:len(m.Extra)-1]
+	}
+	s.forwardSubnet(w, m)
+	if key != "" {
+		m.SetTsig(key, tsigAlgorithm, tsigFudge, time.Now().Unix())
+	}
 	return m
 }
 
 // ServeDNSReverse is the handler for DNS requests for the reverse zone. If nothing is found
-// locally the request is forwarded to the forwarder for resolution.
+// locally the request is forwarded to the forwarder for resolution, unless the name
+// falls within one of the configured reverse CIDRs.
 func (s *server) ServeDNSReverse(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 	m := new(dns.Msg)
 	m.SetReply(req)
-	m.Compress = true
+	m.Compress = !s.config.NoCompress
 	m.Authoritative = false // Set to false, because I don't know what to do wrt DNSSEC.
 	m.RecursionAvailable = true
 	var err error
-	if m.Answer, err = s.PTRRecords(req.Question[0]); err == nil {
+	if m.Answer, err = s.PTRRecords(req.Question[0]); isServerFailure(err) {
+		m = s.backendFailure(req, err)
+		if err := w.WriteMsg(m); err != nil {
+			logf("failure to return reply %q", err)
+		}
+		return m
+	} else if err == nil {
 		// TODO(miek): Reverse DNSSEC. We should sign this, but requires a key....and more
 		// Probably not worth the hassle?
 		if err := w.WriteMsg(m); err != nil {
@@ -81,10 +124,94 @@ func (s *server) ServeDNSReverse(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 		}
 		return m
 	}
-	// Always forward if not found locally.
+	// Names within our reverse CIDRs are ours, there is no point forwarding them.
+	if leaf, ok := s.isReverseAuthoritative(req.Question[0].Name); ok {
+		if leaf {
+			m = s.NameError(req)
+		} else {
+			// An empty non-terminal, e.g. the /24 of a service CIDR.
+			m.Answer = nil
+			m.Ns = []dns.RR{s.negativeSOA(req.Question[0].Name)}
+		}
+		if err := w.WriteMsg(m); err != nil {
+			logf("failure to return reply %q", err)
+		}
+		return m
+	}
+	// Forward if not found locally.
 	return s.ServeDNSForward(w, req)
 }
 
+// isReverseAuthoritative returns whether the reverse name lies within one of the
+// reverse CIDRs, and if so whether it is the name of a single address rather than
+// of a range.
+func (s *server) isReverseAuthoritative(name string) (leaf, ok bool) {
+	if len(s.config.reverseNets) == 0 {
+		return false, false
+	}
+	prefix, ok := reverseNamePrefix(name)
+	if !ok {
+		return false, false
+	}
+	ones, bits := prefix.Mask.Size()
+	for _, ipNet := range s.config.reverseNets {
+		netOnes, netBits := ipNet.Mask.Size()
+		if bits == netBits && ones >= netOnes && ipNet.Contains(prefix.IP) {
+			return ones == bits, true
+		}
+	}
+	return false, false
+}
+
+// reverseNamePrefix returns the range of addresses covered by a (possibly partial)
+// in-addr.arpa. or ip6.arpa. name, e.g. 10.0.96.10.in-addr.arpa. is 10.96.0.10/32
+// and 96.10.in-addr.arpa. is 10.96.0.0/16.
+func reverseNamePrefix(name string) (*net.IPNet, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	var (
+		labels    []string
+		ip        net.IP
+		labelBits int
+	)
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels = dns.SplitDomainName(strings.TrimSuffix(name, ".in-addr.arpa."))
+		if len(labels) > net.IPv4len {
+			return nil, false
+		}
+		ip = make(net.IP, net.IPv4len)
+		labelBits = 8
+		for i, label := range labels {
+			b, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil, false
+			}
+			ip[len(labels)-1-i] = byte(b)
+		}
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels = dns.SplitDomainName(strings.TrimSuffix(name, ".ip6.arpa."))
+		if len(labels) > 2*net.IPv6len {
+			return nil, false
+		}
+		ip = make(net.IP, net.IPv6len)
+		labelBits = 4
+		for i, label := range labels {
+			n, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil, false
+			}
+			nibble := len(labels) - 1 - i
+			ip[nibble/2] |= byte(n) << (4 * uint(1-nibble%2))
+		}
+	default:
+		return nil, false
+	}
+	if len(labels) == 0 {
+		return nil, false
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(labels)*labelBits, len(ip)*8)}, true
+}
+
 // Lookup looks up name,type using the recursive nameserver defines
 // in the server's config. If none defined it returns an error.
 func (s *server) Lookup(n string, t, bufsize uint16, dnssec bool) (*dns.Msg, error) {
@@ -99,7 +226,7 @@ func (s *server) Lookup(n string, t, bufsize uint16, dnssec bool) (*dns.Msg, err
 	nsid := s.randomNameserverID(m.Id)
 	try := 0
 Redo:
-	r, err := exchangeWithRetry(s.dnsUDPclient, m, s.config.Nameservers[nsid])
+	r, err := exchangeWithRetry(s.forwardExchanger(false), m, s.config.Nameservers[nsid])
 	if err == nil {
 		if r.Rcode != dns.RcodeSuccess {
 			return nil, fmt.Errorf("rcode %d is not equal to success", r.Rcode)
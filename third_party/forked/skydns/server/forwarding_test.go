@@ -0,0 +1,155 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// recordingWriter is a dns.ResponseWriter keeping the last message written.
+type recordingWriter struct {
+	msg *dns.Msg
+}
+
+func (w *recordingWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (w *recordingWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}
+}
+func (w *recordingWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *recordingWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *recordingWriter) Close() error                { return nil }
+func (w *recordingWriter) TsigStatus() error           { return nil }
+func (w *recordingWriter) TsigTimersOnly(bool)         {}
+func (w *recordingWriter) Hijack()                     {}
+
+func TestReverseNamePrefix(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		expected string
+	}{
+		{"10.0.96.10.in-addr.arpa.", "10.96.0.10/32"},
+		{"96.10.in-addr.arpa.", "10.96.0.0/16"},
+		{"10.IN-ADDR.ARPA", "10.0.0.0/8"},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", "fd00::1/128"},
+		{"0.d.f.ip6.arpa.", "fd00::/12"},
+		{"in-addr.arpa.", ""},
+		{"256.in-addr.arpa.", ""},
+		{"1.1.1.1.1.in-addr.arpa.", ""},
+		{"10.d.f.ip6.arpa.", ""},
+		{"example.com.", ""},
+	} {
+		prefix, ok := reverseNamePrefix(tc.name)
+		if tc.expected == "" {
+			if ok {
+				t.Errorf("%s: expected no prefix, got %v", tc.name, prefix)
+			}
+			continue
+		}
+		if !ok || prefix.String() != tc.expected {
+			t.Errorf("%s: expected %s, got %v", tc.name, tc.expected, prefix)
+		}
+	}
+}
+
+func TestServeDNSReverseAuthoritative(t *testing.T) {
+	config := &Config{
+		Domain:       "cluster.local.",
+		Nameservers:  []string{"127.0.0.1:53"},
+		NoRec:        true,
+		ReverseCIDRs: []string{"10.96.0.0/12", "fd00::/64"},
+	}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(StaticBackend{"10.0.96.10.in-addr.arpa.": {{Host: "kube-dns.kube-system.svc.cluster.local."}}}, config)
+
+	for _, tc := range []struct {
+		name  string
+		rcode int
+		ptr   bool
+	}{
+		{"10.0.96.10.in-addr.arpa.", dns.RcodeSuccess, true},
+		// Within the service CIDR, without a record.
+		{"11.0.96.10.in-addr.arpa.", dns.RcodeNameError, false},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dns.RcodeNameError, false},
+		// An empty non-terminal of the service CIDR.
+		{"0.96.10.in-addr.arpa.", dns.RcodeSuccess, false},
+		// Covers more than the service CIDR, or outside of it, forwarded.
+		{"10.in-addr.arpa.", dns.RcodeServerFailure, false},
+		{"1.0.0.192.in-addr.arpa.", dns.RcodeServerFailure, false},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, dns.TypePTR)
+		w := &recordingWriter{}
+		s.ServeDNSReverse(w, req)
+		if w.msg == nil {
+			t.Errorf("%s: no reply", tc.name)
+			continue
+		}
+		if w.msg.Rcode != tc.rcode {
+			t.Errorf("%s: expected rcode %s, got %s", tc.name, dns.RcodeToString[tc.rcode], dns.RcodeToString[w.msg.Rcode])
+		}
+		if tc.ptr != (len(w.msg.Answer) == 1) {
+			t.Errorf("%s: unexpected answer %v", tc.name, w.msg.Answer)
+		}
+		if tc.rcode != dns.RcodeServerFailure && !tc.ptr && len(w.msg.Ns) != 1 {
+			t.Errorf("%s: expected a SOA in the authority section, got %v", tc.name, w.msg.Ns)
+		}
+	}
+}
+
+func TestServeDNSReverseOnlyPTR(t *testing.T) {
+	addr, stop := startUDPUpstream(t)
+	defer stop()
+
+	const v6Name = "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa."
+	config := &Config{Domain: "cluster.local.", Nameservers: []string{addr}}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(StaticBackend{
+		v6Name:                     {{Host: "a.default.svc.cluster.local."}},
+		"10.0.96.10.in-addr.arpa.": {{Host: "b.default.svc.cluster.local."}},
+	}, config)
+
+	for _, tc := range []struct {
+		name  string
+		qtype uint16
+		ptr   bool
+	}{
+		{v6Name, dns.TypePTR, true},
+		{strings.ToUpper(v6Name), dns.TypePTR, true},
+		{"10.0.96.10.in-addr.arpa.", dns.TypePTR, true},
+		// Other types are not answered with the PTR record.
+		{v6Name, dns.TypeAAAA, false},
+		{v6Name, dns.TypeTXT, false},
+		{"10.0.96.10.in-addr.arpa.", dns.TypeA, false},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, tc.qtype)
+		w := &recordingWriter{}
+		s.ServeDNS(w, req)
+		if w.msg == nil {
+			t.Errorf("%s %s: no reply", tc.name, dns.TypeToString[tc.qtype])
+			continue
+		}
+		ptr := len(w.msg.Answer) == 1 && w.msg.Answer[0].Header().Rrtype == dns.TypePTR
+		if ptr != tc.ptr {
+			t.Errorf("%s %s: unexpected answer %v", tc.name, dns.TypeToString[tc.qtype], w.msg.Answer)
+		}
+	}
+}
+
+func TestSetDefaultsReverseCIDRs(t *testing.T) {
+	if err := SetDefaults(&Config{Nameservers: []string{"127.0.0.1:53"}, ReverseCIDRs: []string{"10.96.0.0"}}); err == nil {
+		t.Fatal("expected an error for an invalid reverse CIDR")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// The service of the CoreDNS grpc plugin, answering the packed DNS messages
+// of a DnsPacket. A DnsPacket holds its message in field 1 as bytes, like
+// wrapperspb.BytesValue, so the latter is used rather than generated code.
+const (
+	GRPCServiceName = "coredns.dns.DnsService"
+	GRPCQueryMethod = "/" + GRPCServiceName + "/Query"
+)
+
+type grpcDNSServer interface {
+	query(ctx context.Context, packet *wrapperspb.BytesValue) (*wrapperspb.BytesValue, error)
+}
+
+var grpcDNSService = grpc.ServiceDesc{
+	ServiceName: GRPCServiceName,
+	HandlerType: (*grpcDNSServer)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Query",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			packet := new(wrapperspb.BytesValue)
+			if err := dec(packet); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return srv.(grpcDNSServer).query(ctx, packet)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: GRPCQueryMethod}
+			return interceptor(ctx, packet, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.(grpcDNSServer).query(ctx, req.(*wrapperspb.BytesValue))
+			})
+		},
+	}},
+}
+
+// RegisterGRPC registers on g the service of the CoreDNS grpc plugin, so
+// that proxies such as Envoy can forward queries over their gRPC channels.
+// They are answered as the queries over TCP, without truncation.
+func (s *server) RegisterGRPC(g *grpc.Server) {
+	g.RegisterService(&grpcDNSService, &grpcDNS{h: s.handler()})
+}
+
+// grpcDNS answers the queries of the gRPC clients with h.
+type grpcDNS struct {
+	h dns.Handler
+}
+
+func (g *grpcDNS) query(ctx context.Context, packet *wrapperspb.BytesValue) (*wrapperspb.BytesValue, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(packet.GetValue()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid DNS message: %v", err)
+	}
+	if len(m.Question) != 1 {
+		return nil, status.Error(codes.InvalidArgument, "expected a single question")
+	}
+
+	w := &dohWriter{remote: &net.TCPAddr{}}
+	if p, ok := peer.FromContext(ctx); ok {
+		w.remote = tcpAddr(p.Addr.String())
+	}
+	g.h.ServeDNS(w, m)
+	if w.msg == nil {
+		return nil, status.Error(codes.Internal, "no reply")
+	}
+	buf, err := w.msg.Pack()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to pack the reply: %v", err)
+	}
+	return wrapperspb.Bytes(buf), nil
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestGRPCQuery(t *testing.T) {
+	config := &Config{Domain: "cluster.local."}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	g := grpc.NewServer()
+	New(StaticBackend{"a.default.svc.cluster.local.": {{Host: "10.0.0.1"}}}, config).RegisterGRPC(g)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go g.Serve(ln)
+	defer g.Stop()
+
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("a.default.svc.cluster.local.", dns.TypeA)
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := new(wrapperspb.BytesValue)
+	if err := conn.Invoke(context.Background(), GRPCQueryMethod, wrapperspb.Bytes(buf), reply); err != nil {
+		t.Fatal(err)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(reply.GetValue()); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id != m.Id {
+		t.Errorf("expected the ID %d of the query, got %d", m.Id, resp.Id)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Errorf("unexpected answer %v", resp.Answer)
+	}
+
+	err = conn.Invoke(context.Background(), GRPCQueryMethod, wrapperspb.Bytes([]byte("garbage")), reply)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for an invalid message, got %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// InvalidateCache removes the cached replies that may hold the records of
+// names: the replies for the names, for their parents, which may aggregate
+// them, and for the wildcard names. It flushes the whole cache if names is
+// empty. It returns the number of replies removed, -1 for a flush.
+func (s *server) InvalidateCache(names []string) int {
+	if len(names) == 0 {
+		s.rcache.Flush()
+		return -1
+	}
+	stale := make(map[string]bool, len(names))
+	for _, name := range names {
+		name = dns.Fqdn(strings.ToLower(name))
+		for {
+			stale[name] = true
+			i, end := dns.NextLabel(name, 0)
+			if end {
+				break
+			}
+			name = name[i:]
+		}
+	}
+	return s.rcache.RemoveFunc(func(q dns.Question) bool {
+		name := strings.ToLower(q.Name)
+		return stale[name] || strings.HasPrefix(name, "*.") || strings.Contains(name, ".*.")
+	})
+}
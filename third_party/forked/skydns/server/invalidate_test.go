@@ -0,0 +1,49 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"k8s.io/dns/third_party/forked/skydns/cache"
+)
+
+func TestInvalidateCache(t *testing.T) {
+	s := &server{rcache: cache.New(10, 60)}
+	for _, name := range []string{
+		"1-2-3-4.web.default.svc.cluster.local.",
+		"web.default.svc.cluster.local.",
+		"*.default.svc.cluster.local.",
+		"db.default.svc.cluster.local.",
+		"example.com.",
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		s.rcache.InsertMessage(cache.Key(m.Question[0], false, false), m)
+	}
+	cached := func(name string) bool {
+		return s.rcache.Hit(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}, false, false, 1) != nil
+	}
+
+	if removed := s.InvalidateCache([]string{"1-2-3-4.Web.default.svc.cluster.local"}); removed != 3 {
+		t.Errorf("expected 3 replies removed, got %d", removed)
+	}
+	for _, name := range []string{"1-2-3-4.web.default.svc.cluster.local.", "web.default.svc.cluster.local.", "*.default.svc.cluster.local."} {
+		if cached(name) {
+			t.Errorf("expected the reply for %s to be removed", name)
+		}
+	}
+	for _, name := range []string{"db.default.svc.cluster.local.", "example.com."} {
+		if !cached(name) {
+			t.Errorf("expected the reply for %s to be kept", name)
+		}
+	}
+
+	s.InvalidateCache(nil)
+	if cached("example.com.") {
+		t.Errorf("expected the cache to be flushed")
+	}
+}
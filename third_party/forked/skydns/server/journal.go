@@ -0,0 +1,217 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// zoneJournal keeps the records of the domain and its last changes, so that
+// the secondaries can transfer the changes only (IXFR, RFC 1995). Its
+// serial is the time of the last change, in seconds since the epoch, one
+// more than the previous serial if that is not later, so that the replicas
+// that observe the same changes agree on the serials of the domain within
+// seconds. Their journals are still their own: the secondaries must transfer
+// the domain from a single replica.
+type zoneJournal struct {
+	lock sync.RWMutex
+	// size is the number of changes kept.
+	size int
+	// now returns the time the serials are taken from.
+	now func() time.Time
+	// generation is the generation of the backend the records were last
+	// compared at.
+	generation uint64
+	synced     bool
+	serial     uint32
+	records    []dns.RR
+	// changes are the last changes, the oldest first.
+	changes []zoneChange
+}
+
+// zoneChange is a change of the records of a zone, from serial to the next
+// serial.
+type zoneChange struct {
+	serial  uint32
+	deleted []dns.RR
+	added   []dns.RR
+}
+
+func newZoneJournal(size int) *zoneJournal {
+	return &zoneJournal{size: size, now: time.Now, serial: uint32(time.Now().Unix())}
+}
+
+// nextSerial returns the serial of a change at now after serial.
+func nextSerial(serial uint32, now time.Time) uint32 {
+	if next := uint32(now.Unix()); next > serial {
+		return next
+	}
+	return serial + 1
+}
+
+// current returns the serial and records of the zone. The records must not
+// be modified.
+func (j *zoneJournal) current() (uint32, []dns.RR) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return j.serial, j.records
+}
+
+// since returns the current serial and records, and the changes from
+// serial to the current serial, or false if they are not all kept. The
+// records must not be modified.
+func (j *zoneJournal) since(serial uint32) (uint32, []dns.RR, []zoneChange, bool) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	if serial == j.serial {
+		return j.serial, j.records, nil, true
+	}
+	for i, change := range j.changes {
+		if change.serial == serial {
+			return j.serial, j.records, j.changes[i:], true
+		}
+	}
+	return j.serial, j.records, nil, false
+}
+
+// update compares records, those of the backend at generation, to the ones
+// of the journal. It returns whether they changed, and the new serial.
+func (j *zoneJournal) update(generation uint64, records []dns.RR) (bool, uint32) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.generation = generation
+	// The duplicates are answered once.
+	seen := make(map[string]bool, len(records))
+	unique := records[:0]
+	for _, rr := range records {
+		if key := rr.String(); !seen[key] {
+			seen[key] = true
+			unique = append(unique, rr)
+		}
+	}
+	records = unique
+	if !j.synced {
+		j.synced = true
+		j.serial = uint32(j.now().Unix())
+		j.records = records
+		return false, j.serial
+	}
+
+	change := zoneChange{serial: j.serial}
+	previous := make(map[string]bool, len(j.records))
+	for _, rr := range j.records {
+		previous[rr.String()] = true
+	}
+	for _, rr := range records {
+		key := rr.String()
+		if previous[key] {
+			delete(previous, key)
+		} else {
+			change.added = append(change.added, rr)
+		}
+	}
+	for _, rr := range j.records {
+		if previous[rr.String()] {
+			change.deleted = append(change.deleted, rr)
+		}
+	}
+	j.records = records
+	if len(change.added) == 0 && len(change.deleted) == 0 {
+		return false, j.serial
+	}
+
+	j.serial = nextSerial(j.serial, j.now())
+	if j.size > 0 {
+		if len(j.changes) == j.size {
+			j.changes = append(j.changes[:0], j.changes[1:]...)
+		}
+		j.changes = append(j.changes, change)
+	}
+	return true, j.serial
+}
+
+// outdated returns whether the records may have changed since generation.
+func (j *zoneJournal) outdated(generation uint64) bool {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return !j.synced || j.generation != generation
+}
+
+// runJournal compares the records of the domain to the journal every
+// JournalInterval, once the backend has synced, and notifies the
+// secondaries of the changes.
+func (s *server) runJournal() {
+	for range time.Tick(s.config.JournalInterval) {
+		s.updateJournal()
+	}
+}
+
+// updateJournal compares the records of the domain to the journal if the
+// generation of the backend changed. On change, the cached SOA replies are
+// removed and the secondaries notified, by the replica NotifyLeader elects if
+// set.
+func (s *server) updateJournal() {
+	gen := generation(s.backend)
+	if !s.backend.HasSynced() || !s.journal.outdated(gen) {
+		return
+	}
+	var records []dns.RR
+	err := RangeZone(s.backend, s.config.Domain, func(name string, services []msg.Service) bool {
+		for _, service := range services {
+			if rr := s.transferRR(name, service); rr != nil {
+				records = append(records, rr)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		logf("failed to journal %s: %s", s.config.Domain, err)
+		return
+	}
+	changed, serial := s.journal.update(gen, records)
+	if !changed {
+		return
+	}
+	s.rcache.RemoveFunc(func(q dns.Question) bool { return q.Qtype == dns.TypeSOA })
+	if s.config.Verbose {
+		logf("journaled %s at serial %d", s.config.Domain, serial)
+	}
+	if s.config.NotifyLeader == nil || s.config.NotifyLeader() {
+		s.notify(s.config.Domain, serial)
+	}
+}
+
+// notify sends NOTIFY messages (RFC 1996) for zone at serial to the
+// secondaries, signed with the first of the TransferKeys if set, retrying
+// thrice.
+func (s *server) notify(zone string, serial uint32) {
+	c := &dns.Client{Net: "udp", Timeout: s.config.ReadTimeout, TsigSecret: s.config.TsigSecret}
+	for _, target := range s.config.Notify {
+		go func(target string) {
+			m := new(dns.Msg)
+			m.SetNotify(zone)
+			m.Answer = []dns.RR{s.soaWithSerial(zone, serial)}
+			if len(s.config.TransferKeys) > 0 {
+				m.SetTsig(s.config.TransferKeys[0], tsigAlgorithm, tsigFudge, time.Now().Unix())
+			}
+			var err error
+			for attempt := 0; attempt < 3; attempt++ {
+				var resp *dns.Msg
+				if resp, _, err = c.Exchange(m, target); err == nil && resp.Rcode == dns.RcodeSuccess {
+					return
+				}
+				if err == nil {
+					err = fmt.Errorf("answered %s", dns.RcodeToString[resp.Rcode])
+				}
+			}
+			logf("failed to notify %s of serial %d of %s: %s", target, serial, zone, err)
+		}(target)
+	}
+}
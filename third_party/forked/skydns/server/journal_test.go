@@ -0,0 +1,198 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestZoneJournal(t *testing.T) {
+	a := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	j := newZoneJournal(2)
+	now := time.Unix(100, 0)
+	j.now = func() time.Time { return now }
+	if changed, _ := j.update(1, []dns.RR{a("a.cluster.local. 30 IN A 10.0.0.1")}); changed {
+		t.Errorf("first update changed the journal")
+	}
+	if j.outdated(1) || !j.outdated(2) {
+		t.Errorf("outdated(1) = %v, outdated(2) = %v, want false, true", j.outdated(1), j.outdated(2))
+	}
+	if changed, _ := j.update(2, []dns.RR{a("a.cluster.local. 30 IN A 10.0.0.1")}); changed {
+		t.Errorf("update without changes changed the journal")
+	}
+	for i, records := range [][]dns.RR{
+		{a("a.cluster.local. 30 IN A 10.0.0.2")},
+		{a("a.cluster.local. 30 IN A 10.0.0.2"), a("b.cluster.local. 30 IN A 10.0.0.3")},
+		{a("b.cluster.local. 30 IN A 10.0.0.3"), a("b.cluster.local. 30 IN A 10.0.0.3")},
+	} {
+		changed, serial := j.update(uint64(i+3), records)
+		if want := uint32(101 + i); !changed || serial != want {
+			t.Errorf("update %d = %v, %d, want true, %d", i, changed, serial, want)
+		}
+	}
+
+	serial, records, changes, ok := j.since(101)
+	if !ok || serial != 103 || len(records) != 1 || len(changes) != 2 {
+		t.Fatalf("since(101) = %d, %v, %v, %v", serial, records, changes, ok)
+	}
+	if c := changes[0]; c.serial != 101 || len(c.deleted) != 0 || len(c.added) != 1 {
+		t.Errorf("change from 101 = %+v, want b added", c)
+	}
+	if c := changes[1]; c.serial != 102 || len(c.deleted) != 1 || len(c.added) != 0 {
+		t.Errorf("change from 102 = %+v, want a deleted", c)
+	}
+	if _, _, changes, ok := j.since(103); !ok || len(changes) != 0 {
+		t.Errorf("since(103) = %v, %v, want no changes", changes, ok)
+	}
+	// The change from 100 is not kept anymore.
+	if _, _, _, ok := j.since(100); ok {
+		t.Errorf("since(100) succeeded, want the change from 100 trimmed")
+	}
+
+	// The serial is the time of the change once it is later.
+	now = time.Unix(200, 0)
+	if changed, serial := j.update(6, []dns.RR{a("c.cluster.local. 30 IN A 10.0.0.4")}); !changed || serial != 200 {
+		t.Errorf("update at 200 = %v, %d, want true, 200", changed, serial)
+	}
+}
+
+func TestIXFR(t *testing.T) {
+	backend := &generationBackend{StaticBackend: StaticBackend{
+		"web.default.svc.cluster.local.": {{Host: "10.0.0.1", Ttl: 30}},
+	}, generation: 1}
+	config := &Config{Domain: "cluster.local.", NoRec: true, TransferCIDRs: []string{"127.0.0.0/8"}, IXFRJournal: 10}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(backend, config)
+	s.journal.now = func() time.Time { return time.Unix(1000, 0) }
+	s.updateJournal()
+	first, _ := s.journal.current()
+	backend.StaticBackend = StaticBackend{
+		"web.default.svc.cluster.local.": {{Host: "10.0.0.2", Ttl: 30}},
+		"db.default.svc.cluster.local.":  {{Host: "10.0.0.3", Ttl: 30}},
+	}
+	backend.generation++
+	s.updateJournal()
+	addr := serveTCP(t, s)
+
+	ixfr := func(serial uint32) []dns.RR {
+		m := new(dns.Msg)
+		m.SetIxfr("cluster.local.", serial, "ns.dns.cluster.local.", "hostmaster.cluster.local.")
+		envelopes, err := new(dns.Transfer).In(m, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var records []dns.RR
+		for e := range envelopes {
+			if e.Error != nil {
+				t.Fatal(e.Error)
+			}
+			records = append(records, e.RR...)
+		}
+		return records
+	}
+	serialOf := func(rr dns.RR) uint32 {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			t.Fatalf("%s is not a SOA record", rr)
+		}
+		return soa.Serial
+	}
+
+	// SOA(2), SOA(1), deleted, SOA(2), added, SOA(2).
+	records := ixfr(first)
+	if len(records) != 7 {
+		t.Fatalf("IXFR from %d returned %d records, want 7: %v", first, len(records), records)
+	}
+	for i, want := range map[int]uint32{0: first + 1, 1: first, 3: first + 1, 6: first + 1} {
+		if got := serialOf(records[i]); got != want {
+			t.Errorf("record %d has serial %d, want %d", i, got, want)
+		}
+	}
+	if a, ok := records[2].(*dns.A); !ok || a.A.String() != "10.0.0.1" {
+		t.Errorf("deleted record = %s, want the A record of 10.0.0.1", records[2])
+	}
+
+	// The client is up to date.
+	if records := ixfr(first + 1); len(records) != 1 || serialOf(records[0]) != first+1 {
+		t.Errorf("IXFR from the current serial = %v, want its SOA record", records)
+	}
+
+	// Unknown serials get the whole domain.
+	if records := ixfr(first - 1); len(records) != 4 {
+		t.Errorf("IXFR from an unknown serial returned %d records, want 4: %v", len(records), records)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notified := make(chan *dns.Msg, 1)
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+		select {
+		case notified <- req:
+		default:
+		}
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	backend := &generationBackend{StaticBackend: StaticBackend{
+		"web.default.svc.cluster.local.": {{Host: "10.0.0.1", Ttl: 30}},
+	}, generation: 1}
+	config := &Config{Domain: "cluster.local.", Notify: []string{pc.LocalAddr().String()}}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(backend, config)
+	s.updateJournal()
+	backend.StaticBackend = StaticBackend{
+		"web.default.svc.cluster.local.": {{Host: "10.0.0.2", Ttl: 30}},
+	}
+	backend.generation++
+	s.updateJournal()
+
+	select {
+	case req := <-notified:
+		serial, _ := s.journal.current()
+		if req.Opcode != dns.OpcodeNotify || req.Question[0].Name != "cluster.local." {
+			t.Errorf("notified %v, want a NOTIFY of cluster.local.", req)
+		}
+		if soa, ok := req.Answer[0].(*dns.SOA); !ok || soa.Serial != serial {
+			t.Errorf("notified %v, want the SOA record at serial %d", req.Answer, serial)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not notified")
+	}
+
+	// The other replicas do not notify.
+	config.NotifyLeader = func() bool { return false }
+	backend.StaticBackend = StaticBackend{
+		"web.default.svc.cluster.local.": {{Host: "10.0.0.3", Ttl: 30}},
+	}
+	backend.generation++
+	s.updateJournal()
+	select {
+	case req := <-notified:
+		t.Errorf("notified %v by a replica other than the leader", req)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
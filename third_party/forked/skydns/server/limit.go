@@ -0,0 +1,66 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// limitAnswers keeps the first MaxAnswers records of the type queried in a
+// reply sent over UDP, for a name of the served domains, e.g. a headless
+// service with hundreds of endpoints. The records of other types, e.g. the
+// CNAMEs leading to the answers, are kept, as are the address records of
+// the targets of the SRV records kept. The reply is then truncated (TC), so
+// that the clients wanting every record retry over TCP. Signed replies are
+// left as is, as dropping records would invalidate their signatures.
+func (s *server) limitAnswers(w dns.ResponseWriter, m *dns.Msg) {
+	if s.config.MaxAnswers <= 0 || isTCP(w) || len(m.Question) == 0 || len(m.Answer) <= s.config.MaxAnswers {
+		return
+	}
+	qtype := m.Question[0].Qtype
+	if qtype != dns.TypeA && qtype != dns.TypeAAAA && qtype != dns.TypeSRV {
+		return
+	}
+	if !s.inDomain(strings.ToLower(m.Question[0].Name)) {
+		return
+	}
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			return
+		}
+	}
+
+	answer := make([]dns.RR, 0, s.config.MaxAnswers)
+	targets := make(map[string]bool)
+	kept := 0
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == qtype {
+			if kept == s.config.MaxAnswers {
+				continue
+			}
+			kept++
+			if srv, ok := rr.(*dns.SRV); ok {
+				targets[strings.ToLower(srv.Target)] = true
+			}
+		}
+		answer = append(answer, rr)
+	}
+	m.Answer = answer
+	m.Truncated = true
+
+	if qtype != dns.TypeSRV {
+		return
+	}
+	extra := make([]dns.RR, 0, len(m.Extra))
+	for _, rr := range m.Extra {
+		if t := rr.Header().Rrtype; (t == dns.TypeA || t == dns.TypeAAAA) && !targets[strings.ToLower(rr.Header().Name)] {
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	m.Extra = extra
+}
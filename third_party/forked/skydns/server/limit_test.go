@@ -0,0 +1,112 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// tcpRecordingWriter is a recordingWriter for a client over TCP.
+type tcpRecordingWriter struct {
+	recordingWriter
+}
+
+func (w *tcpRecordingWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4242}
+}
+
+func TestMaxAnswers(t *testing.T) {
+	var services []msg.Service
+	for i := 1; i <= 300; i++ {
+		services = append(services, msg.Service{Host: fmt.Sprintf("10.0.%d.%d", i/256, i%256)})
+	}
+	config := &Config{
+		Domain:      "cluster.local.",
+		Nameservers: []string{"127.0.0.1:53"},
+		NoRec:       true,
+		RCache:      10,
+		MaxAnswers:  20,
+	}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(StaticBackend{"big.default.svc.cluster.local.": services}, config)
+
+	// Over UDP, the answer is limited, twice to check the replies from the
+	// cache as well.
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("big.default.svc.cluster.local.", dns.TypeA)
+		w := &recordingWriter{}
+		s.ServeDNS(w, req)
+		if len(w.msg.Answer) != 20 || !w.msg.Truncated {
+			t.Errorf("expected 20 records with TC over UDP, got %d (TC %v)", len(w.msg.Answer), w.msg.Truncated)
+		}
+	}
+
+	// Over TCP, the answer is complete.
+	req := new(dns.Msg)
+	req.SetQuestion("big.default.svc.cluster.local.", dns.TypeA)
+	w := &tcpRecordingWriter{}
+	s.ServeDNS(w, req)
+	if len(w.msg.Answer) != 300 || w.msg.Truncated {
+		t.Errorf("expected 300 records over TCP, got %d (TC %v)", len(w.msg.Answer), w.msg.Truncated)
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	var services []msg.Service
+	for i := 1; i <= 300; i++ {
+		services = append(services, msg.Service{Host: fmt.Sprintf("10.0.%d.%d", i/256, i%256)})
+	}
+	config := &Config{
+		Domain:      "cluster.local.",
+		Nameservers: []string{"127.0.0.1:53"},
+		NoRec:       true,
+	}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(StaticBackend{"big.default.svc.cluster.local.": services}, config)
+
+	req := new(dns.Msg)
+	req.SetQuestion("big.default.svc.cluster.local.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	w := &recordingWriter{}
+	s.ServeDNS(w, req)
+	if !w.msg.Truncated || len(w.msg.Answer) == 0 || w.msg.Len() > 1232 {
+		t.Errorf("expected a truncated reply of at most 1232 bytes, got %d bytes with TC %v", w.msg.Len(), w.msg.Truncated)
+	}
+}
+
+func TestFitKeepsOPT(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("big.default.svc.cluster.local.", dns.TypeA)
+	for i := 1; i <= 300; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("big.default.svc.cluster.local. IN A 10.0.%d.%d", i/256, i%256))
+		m.Answer = append(m.Answer, rr)
+		m.Extra = append(m.Extra, rr)
+	}
+	m.SetEdns0(1232, true)
+
+	if _, truncated := Fit(m, 1232, false); !truncated || !m.Truncated {
+		t.Fatalf("expected the message to be truncated")
+	}
+	if m.Len() >= 1232 {
+		t.Errorf("expected less than %d bytes, got %d", 1232, m.Len())
+	}
+	if len(m.Extra) != 1 || m.IsEdns0() == nil {
+		t.Errorf("expected the OPT record alone in the additional section, got %v", m.Extra)
+	}
+	// One more answer would not fit.
+	if len(m.Answer) == 300 {
+		t.Fatalf("expected fewer answers")
+	}
+}
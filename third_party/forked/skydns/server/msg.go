@@ -13,8 +13,13 @@ import "github.com/miekg/dns"
 // until it fits. When this is case the returned bool is true.
 func Fit(m *dns.Msg, size int, tcp bool) (*dns.Msg, bool) {
 	if m.Len() > size {
-		// Check for OPT Records at the end and keep those. TODO(miek)
+		// Keep the OPT record, which carries the EDNS0 options of the
+		// reply.
+		opt := m.IsEdns0()
 		m.Extra = nil
+		if opt != nil {
+			m.Extra = []dns.RR{opt}
+		}
 	}
 	if m.Len() < size {
 		return m, false
@@ -27,28 +32,19 @@ func Fit(m *dns.Msg, size int, tcp bool) (*dns.Msg, bool) {
 		// fit the udp buffer.
 	}
 
-	// Additional section is gone, binary search until we have length that fits.
-	min, max := 0, len(m.Answer)
-	original := make([]dns.RR, len(m.Answer))
-	copy(original, m.Answer)
-	for {
-		if min == max {
-			break
-		}
-
-		mid := (min + max) / 2
+	// Additional section is gone, binary search the largest number of
+	// answers that fits.
+	original := m.Answer
+	min, max := 0, len(original)
+	for min < max {
+		mid := (min + max + 1) / 2
 		m.Answer = original[:mid]
-
 		if m.Len() < size {
-			min++
-			continue
+			min = mid
+		} else {
+			max = mid - 1
 		}
-		max = mid
-
-	}
-	if max > 1 {
-		max--
 	}
-	m.Answer = m.Answer[:max]
+	m.Answer = original[:min]
 	return m, true
 }
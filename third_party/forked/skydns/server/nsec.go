@@ -0,0 +1,118 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The types denied at the names other than the apex are the ones not asked
+// for among nsecTypes: claiming a type the name has would let the resolvers
+// deny it from their cache (RFC 8198).
+var nsecTypes = []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeSRV, dns.TypePTR, dns.TypeTXT}
+
+// denialNSEC adds to m the NSEC white lies (RFC 4470) denying its question:
+// the records covering only the name and the wildcard at its closest
+// encloser for NXDOMAIN, or the one of the name for NODATA.
+func (s *server) denialNSEC(m *dns.Msg) {
+	qname := strings.ToLower(m.Question[0].Name)
+	if m.Rcode == dns.RcodeNameError {
+		m.Ns = append(m.Ns, s.newNSEC(prevName(qname), nextName(qname), nil))
+		// The closest encloser is qname minus the left most label.
+		idx := dns.Split(qname)
+		if len(idx) > 1 {
+			wildcard := "*." + qname[idx[1]:]
+			m.Ns = append(m.Ns, s.newNSEC(prevName(wildcard), nextName(wildcard), nil))
+		}
+	}
+	if m.Rcode == dns.RcodeSuccess && len(m.Ns) == 1 {
+		// NODATA
+		if _, ok := m.Ns[0].(*dns.SOA); ok {
+			var types []uint16
+			if qname == s.config.Domain {
+				types = []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeDNSKEY}
+			}
+			for _, t := range nsecTypes {
+				if t != m.Question[0].Qtype {
+					types = append(types, t)
+				}
+			}
+			m.Ns = append(m.Ns, s.newNSEC(qname, nextName(qname), types))
+		}
+	}
+}
+
+// newNSEC returns the NSEC record of name, followed by next, for types.
+func (s *server) newNSEC(name, next string, types []uint16) *dns.NSEC {
+	n := new(dns.NSEC)
+	n.Hdr.Name = name
+	n.Hdr.Class = dns.ClassINET
+	n.Hdr.Rrtype = dns.TypeNSEC
+	n.Hdr.Ttl = s.config.MinTtl
+	n.NextDomain = next
+	n.TypeBitMap = append([]uint16{dns.TypeRRSIG, dns.TypeNSEC}, types...)
+	sort.Slice(n.TypeBitMap, func(i, j int) bool { return n.TypeBitMap[i] < n.TypeBitMap[j] })
+	return n
+}
+
+// nextName returns the name immediately following name in the canonical
+// order (RFC 4034, section 6.1): its child \000.
+func nextName(name string) string {
+	wire, ok := packName(name)
+	if !ok || len(wire)+2 > 255 {
+		return name
+	}
+	return `\000.` + name
+}
+
+// prevName returns a name preceding name in the canonical order, with no
+// other name in between but the children of the returned one. The last
+// octet of the left most label is decremented and the label padded with
+// \255, like in the absolute method of RFC 4471.
+func prevName(name string) string {
+	wire, ok := packName(name)
+	if !ok || wire[0] == 0 {
+		return name
+	}
+	label, parent := wire[1:1+wire[0]], wire[1+wire[0]:]
+	last := label[len(label)-1]
+	label = append([]byte{}, label[:len(label)-1]...)
+	if last == 0 {
+		if len(label) == 0 {
+			return unpackName(parent)
+		}
+	} else {
+		last--
+		if last >= 'A' && last <= 'Z' {
+			// Upper case letters sort as lower case ones.
+			last = 'A' - 1
+		}
+		label = append(label, last)
+		for len(label) < 63 && 1+len(label)+len(parent) < 255 {
+			label = append(label, 255)
+		}
+	}
+	return unpackName(append(append([]byte{byte(len(label))}, label...), parent...))
+}
+
+func packName(name string) ([]byte, bool) {
+	wire := make([]byte, 255)
+	n, err := dns.PackDomainName(dns.Fqdn(name), wire, 0, nil, false)
+	if err != nil {
+		return nil, false
+	}
+	return wire[:n], true
+}
+
+func unpackName(wire []byte) string {
+	name, _, err := dns.UnpackDomainName(wire, 0)
+	if err != nil {
+		return "."
+	}
+	return name
+}
@@ -18,6 +18,10 @@ import (
 // Idem for source of synthesis.
 
 func (s *server) Denial(m *dns.Msg) {
+	if s.config.NSEC {
+		s.denialNSEC(m)
+		return
+	}
 	if m.Rcode == dns.RcodeNameError {
 		// ce is qname minus the left label
 		idx := dns.Split(m.Question[0].Name)
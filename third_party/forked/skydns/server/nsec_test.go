@@ -0,0 +1,132 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// canonicalLess returns whether a precedes b in the canonical order of
+// RFC 4034, section 6.1.
+func canonicalLess(a, b string) bool {
+	wa, _ := packName(strings.ToLower(a))
+	wb, _ := packName(strings.ToLower(b))
+	labels := func(wire []byte) (l [][]byte) {
+		for i := 0; wire[i] != 0; i += 1 + int(wire[i]) {
+			l = append([][]byte{wire[i+1 : i+1+int(wire[i])]}, l...)
+		}
+		return l
+	}
+	la, lb := labels(wa), labels(wb)
+	for i := 0; i < len(la) && i < len(lb); i++ {
+		if c := bytes.Compare(la[i], lb[i]); c != 0 {
+			return c < 0
+		}
+	}
+	return len(la) < len(lb)
+}
+
+func TestPrevNextName(t *testing.T) {
+	for _, name := range []string{"a.default.svc.cluster.local.", "*.svc.cluster.local.", "x0.cluster.local.", `b\000.cluster.local.`, "[.cluster.local."} {
+		prev, next := prevName(name), nextName(name)
+		if !canonicalLess(prev, name) {
+			t.Errorf("%s: expected %s to precede it", name, prev)
+		}
+		if !canonicalLess(name, next) {
+			t.Errorf("%s: expected %s to follow it", name, next)
+		}
+		if dns.CountLabel(prev) != dns.CountLabel(name) && name != `b\000.cluster.local.` {
+			t.Errorf("%s: expected a sibling, got %s", name, prev)
+		}
+	}
+}
+
+func TestNSECWhiteLies(t *testing.T) {
+	key := &dns.DNSKEY{Hdr: dns.RR_Header{Name: "cluster.local.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET},
+		Flags: 256, Protocol: 3, Algorithm: dns.ECDSAP256SHA256}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Domain: "cluster.local.", NSEC: true, PubKey: key, PrivKey: priv.(crypto.Signer)}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	h := New(StaticBackend{"a.default.svc.cluster.local.": {{Host: "10.0.0.1"}}}, config).handler()
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		m.SetEdns0(4096, true)
+		w := &dohWriter{remote: &net.TCPAddr{}}
+		h.ServeDNS(w, m)
+		if w.msg == nil {
+			t.Fatalf("%s: no reply", name)
+		}
+		return w.msg
+	}
+	// verify returns the NSEC records of rrs, checking their signatures.
+	verify := func(rrs []dns.RR) (nsecs []*dns.NSEC) {
+		sigs := map[string]*dns.RRSIG{}
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, rr)
+			case *dns.RRSIG:
+				if rr.TypeCovered == dns.TypeNSEC {
+					sigs[rr.Hdr.Name] = rr
+				}
+			}
+		}
+		for _, nsec := range nsecs {
+			sig, ok := sigs[nsec.Hdr.Name]
+			if !ok {
+				t.Errorf("no RRSIG for the NSEC of %s", nsec.Hdr.Name)
+				continue
+			}
+			if err := sig.Verify(key, []dns.RR{nsec}); err != nil {
+				t.Errorf("invalid RRSIG for the NSEC of %s: %v", nsec.Hdr.Name, err)
+			}
+		}
+		return nsecs
+	}
+
+	missing := "b.default.svc.cluster.local."
+	m := query(missing, dns.TypeA)
+	if m.Rcode != dns.RcodeNameError {
+		t.Fatalf("expected NXDOMAIN, got %s", dns.RcodeToString[m.Rcode])
+	}
+	nsecs := verify(m.Ns)
+	if len(nsecs) != 2 {
+		t.Fatalf("expected the NSEC of the name and of the wildcard, got %v", m.Ns)
+	}
+	for i, name := range []string{missing, "*.default.svc.cluster.local."} {
+		if !canonicalLess(nsecs[i].Hdr.Name, name) || !canonicalLess(name, nsecs[i].NextDomain) {
+			t.Errorf("expected %v to cover %s", nsecs[i], name)
+		}
+		if existing := "a.default.svc.cluster.local."; canonicalLess(nsecs[i].Hdr.Name, existing) && canonicalLess(existing, nsecs[i].NextDomain) {
+			t.Errorf("expected %v not to cover the existing name", nsecs[i])
+		}
+	}
+
+	m = query("a.default.svc.cluster.local.", dns.TypeMX)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Fatalf("expected NODATA, got %v", m)
+	}
+	nsecs = verify(m.Ns)
+	if len(nsecs) != 1 || nsecs[0].Hdr.Name != "a.default.svc.cluster.local." {
+		t.Fatalf("expected the NSEC of the name, got %v", m.Ns)
+	}
+	for _, typ := range nsecs[0].TypeBitMap {
+		if typ == dns.TypeMX {
+			t.Errorf("expected MX to be denied, got %v", nsecs[0])
+		}
+	}
+}
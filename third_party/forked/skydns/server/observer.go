@@ -0,0 +1,57 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// QueryObserver is called after every query has been served, with the
+// address of the client and the reply written, nil if none was.
+type QueryObserver func(remote net.Addr, req, resp *dns.Msg)
+
+// ChainObservers returns a QueryObserver calling each of observers in turn.
+func ChainObservers(observers ...QueryObserver) QueryObserver {
+	return func(remote net.Addr, req, resp *dns.Msg) {
+		for _, observe := range observers {
+			observe(remote, req, resp)
+		}
+	}
+}
+
+// handler returns the handler the listeners serve, s itself unless rewrite
+// rules or a QueryObserver are configured. The observer sees the queries as
+// the clients sent them.
+func (s *server) handler() dns.Handler {
+	h := s.autopathHandler(s)
+	if s.config.Rewrites != nil {
+		h = s.config.Rewrites.handler(h)
+	}
+	h = s.subnetHandler(h)
+	if s.config.TsigSecret != nil {
+		h = tsigHandler(h)
+	}
+	if s.config.Observer == nil {
+		return h
+	}
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		ow := &observedWriter{ResponseWriter: w}
+		h.ServeDNS(ow, req)
+		s.config.Observer(w.RemoteAddr(), req, ow.msg)
+	})
+}
+
+// observedWriter keeps the reply written through it.
+type observedWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *observedWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return w.ResponseWriter.WriteMsg(m)
+}
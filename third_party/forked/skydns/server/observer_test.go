@@ -0,0 +1,58 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryObserver(t *testing.T) {
+	var observed []*dns.Msg
+	config := &Config{
+		Domain:      "cluster.local.",
+		Nameservers: []string{"127.0.0.1:53"},
+		NoRec:       true,
+		Observer: func(remote net.Addr, req, resp *dns.Msg) {
+			if remote.String() != "127.0.0.1:4242" {
+				t.Errorf("unexpected remote address %s", remote)
+			}
+			observed = append(observed, resp)
+		},
+	}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(StaticBackend{"a.default.svc.cluster.local.": {{Host: "10.0.0.1"}}}, config)
+
+	for _, name := range []string{"a.default.svc.cluster.local.", "b.default.svc.cluster.local."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		s.handler().ServeDNS(&recordingWriter{}, req)
+	}
+	if len(observed) != 2 {
+		t.Fatalf("expected 2 observed queries, got %d", len(observed))
+	}
+	if observed[0].Rcode != dns.RcodeSuccess || len(observed[0].Answer) != 1 {
+		t.Errorf("unexpected reply %v", observed[0])
+	}
+	if observed[1].Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got %v", observed[1])
+	}
+}
+
+func TestChainObservers(t *testing.T) {
+	var calls []string
+	observer := ChainObservers(
+		func(remote net.Addr, req, resp *dns.Msg) { calls = append(calls, "first") },
+		func(remote net.Addr, req, resp *dns.Msg) { calls = append(calls, "second") },
+	)
+	observer(nil, new(dns.Msg), nil)
+	if len(calls) != 2 || calls[0] != "first" || calls[1] != "second" {
+		t.Errorf("expected both observers in turn, got %v", calls)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// AnswerOrder is how the A and AAAA records of a reply are ordered.
+type AnswerOrder string
+
+const (
+	// OrderNone answers the records in the order of the backend.
+	OrderNone AnswerOrder = "none"
+	// OrderRandom shuffles the records of each reply.
+	OrderRandom AnswerOrder = "random"
+	// OrderRoundRobin rotates the records by one position per reply.
+	OrderRoundRobin AnswerOrder = "round-robin"
+)
+
+// ParseAnswerOrder returns the AnswerOrder named s.
+func ParseAnswerOrder(s string) (AnswerOrder, error) {
+	switch order := AnswerOrder(s); order {
+	case OrderNone, OrderRandom, OrderRoundRobin:
+		return order, nil
+	}
+	return "", fmt.Errorf("invalid answer order %q, must be %s, %s or %s", s, OrderNone, OrderRandom, OrderRoundRobin)
+}
+
+// answerOrder returns the configured AnswerOrder. Without one, RoundRobin
+// shuffles the records as it always did.
+func (s *server) answerOrder() AnswerOrder {
+	if s.config.AnswerOrder != "" {
+		return s.config.AnswerOrder
+	}
+	if s.config.RoundRobin {
+		return OrderRandom
+	}
+	return OrderNone
+}
+
+// rotateAnswers rotates the address records of the reply to an A or AAAA
+// query with OrderRoundRobin.
+func (s *server) rotateAnswers(m *dns.Msg) {
+	if s.answerOrder() != OrderRoundRobin || len(m.Question) == 0 {
+		return
+	}
+	if qtype := m.Question[0].Qtype; qtype == dns.TypeA || qtype == dns.TypeAAAA {
+		s.rotate(m.Answer)
+	}
+}
+
+// rotate rotates the A and AAAA records of rrs among their positions, by
+// one more position than for the previous reply. Other records, e.g. the
+// CNAMEs leading to the addresses, stay in place.
+func (s *server) rotate(rrs []dns.RR) {
+	var positions []int
+	for i, rr := range rrs {
+		if t := rr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+			positions = append(positions, i)
+		}
+	}
+	if len(positions) < 2 {
+		return
+	}
+	offset := int(atomic.AddUint32(&s.rotation, 1) % uint32(len(positions)))
+	addresses := make([]dns.RR, len(positions))
+	for i, p := range positions {
+		addresses[i] = rrs[p]
+	}
+	for i, p := range positions {
+		rrs[p] = addresses[(i+offset)%len(addresses)]
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func answerHosts(m *dns.Msg) []string {
+	var hosts []string
+	for _, rr := range m.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			hosts = append(hosts, a.A.String())
+		}
+	}
+	return hosts
+}
+
+func TestAnswerOrder(t *testing.T) {
+	backend := StaticBackend{"a.default.svc.cluster.local.": {{Host: "10.0.0.1"}, {Host: "10.0.0.2"}, {Host: "10.0.0.3"}}}
+	for _, tc := range []struct {
+		order AnswerOrder
+		first []string
+	}{
+		{OrderNone, []string{"10.0.0.1", "10.0.0.1", "10.0.0.1", "10.0.0.1"}},
+		{OrderRoundRobin, []string{"10.0.0.2", "10.0.0.3", "10.0.0.1", "10.0.0.2"}},
+	} {
+		config := &Config{
+			Domain:      "cluster.local.",
+			Nameservers: []string{"127.0.0.1:53"},
+			NoRec:       true,
+			RCache:      10,
+			// Set to check that AnswerOrder overrides it.
+			RoundRobin:  true,
+			AnswerOrder: tc.order,
+		}
+		if err := SetDefaults(config); err != nil {
+			t.Fatal(err)
+		}
+		s := New(backend, config)
+
+		// The replies from the cache are ordered too.
+		var first []string
+		for i := 0; i < 4; i++ {
+			req := new(dns.Msg)
+			req.SetQuestion("a.default.svc.cluster.local.", dns.TypeA)
+			w := &recordingWriter{}
+			s.ServeDNS(w, req)
+			hosts := answerHosts(w.msg)
+			if len(hosts) != 3 {
+				t.Fatalf("%s: expected 3 records, got %v", tc.order, w.msg)
+			}
+			first = append(first, hosts[0])
+		}
+		if len(first) != len(tc.first) {
+			t.Fatalf("%s: expected %v first, got %v", tc.order, tc.first, first)
+		}
+		for i := range first {
+			if first[i] != tc.first[i] {
+				t.Errorf("%s: expected %v first, got %v", tc.order, tc.first, first)
+				break
+			}
+		}
+	}
+}
+
+func TestInvalidAnswerOrder(t *testing.T) {
+	config := &Config{Domain: "cluster.local.", AnswerOrder: "sorted"}
+	if err := SetDefaults(config); err == nil {
+		t.Errorf("expected an error for answer order %q", config.AnswerOrder)
+	}
+}
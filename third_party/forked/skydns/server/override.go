@@ -0,0 +1,123 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ForwardOverride forwards the queries for a zone to Nameservers until it
+// expires.
+type ForwardOverride struct {
+	Zone        string    `json:"zone"`
+	Nameservers []string  `json:"nameservers"`
+	Expires     time.Time `json:"expires"`
+}
+
+// ForwardOverrides holds temporary per zone forwarders, set at runtime to
+// route around a failing upstream. They take precedence over the stub
+// zones and the default nameservers. It is safe for concurrent use.
+type ForwardOverrides struct {
+	mu        sync.RWMutex
+	overrides map[string]ForwardOverride
+	now       func() time.Time
+}
+
+// MaxForwardOverrideTTL is the longest an override can be set for: they
+// route around failures, the lasting forwarders belong to the stub zones.
+const MaxForwardOverrideTTL = 24 * time.Hour
+
+// NewForwardOverrides returns an empty set of overrides.
+func NewForwardOverrides() *ForwardOverrides {
+	return &ForwardOverrides{
+		overrides: make(map[string]ForwardOverride),
+		now:       time.Now,
+	}
+}
+
+// Set forwards the queries for zone and its subdomains to nameservers, given
+// as ip:port, for ttl, at most MaxForwardOverrideTTL. The root zone and the
+// top-level domains cannot be overridden: a single override would redirect
+// most of the names resolved.
+func (o *ForwardOverrides) Set(zone string, nameservers []string, ttl time.Duration) (ForwardOverride, error) {
+	if _, ok := dns.IsDomainName(zone); !ok {
+		return ForwardOverride{}, fmt.Errorf("invalid zone %q", zone)
+	}
+	if dns.CountLabel(zone) < 2 {
+		return ForwardOverride{}, fmt.Errorf("zone %q is the root zone or a top-level domain, which cannot be overridden", zone)
+	}
+	if len(nameservers) == 0 {
+		return ForwardOverride{}, fmt.Errorf("no nameservers for zone %q", zone)
+	}
+	if ttl <= 0 || ttl > MaxForwardOverrideTTL {
+		return ForwardOverride{}, fmt.Errorf("override of zone %q needs a positive TTL of at most %v", zone, MaxForwardOverrideTTL)
+	}
+	override := ForwardOverride{
+		Zone:        dns.Fqdn(strings.ToLower(zone)),
+		Nameservers: nameservers,
+		Expires:     o.now().Add(ttl),
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	// Drop the expired overrides so they do not pile up.
+	for zone, previous := range o.overrides {
+		if !o.now().Before(previous.Expires) {
+			delete(o.overrides, zone)
+		}
+	}
+	o.overrides[override.Zone] = override
+	return override, nil
+}
+
+// Delete removes the override of zone, and returns whether there was one.
+func (o *ForwardOverrides) Delete(zone string) bool {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, ok := o.overrides[zone]
+	delete(o.overrides, zone)
+	return ok
+}
+
+// List returns the overrides in effect, sorted by zone.
+func (o *ForwardOverrides) List() []ForwardOverride {
+	now := o.now()
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	list := []ForwardOverride{}
+	for _, override := range o.overrides {
+		if now.Before(override.Expires) {
+			list = append(list, override)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Zone < list[j].Zone })
+	return list
+}
+
+// Match returns the nameservers of the longest overridden zone containing
+// name, which must be lower case and fully qualified.
+func (o *ForwardOverrides) Match(name string) ([]string, bool) {
+	if o == nil {
+		return nil, false
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if len(o.overrides) == 0 {
+		return nil, false
+	}
+	now := o.now()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if override, ok := o.overrides[name[off:]]; ok && now.Before(override.Expires) {
+			return override.Nameservers, true
+		}
+	}
+	return nil, false
+}
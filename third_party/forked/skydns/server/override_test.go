@@ -0,0 +1,96 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestForwardOverrides(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	o := NewForwardOverrides()
+	o.now = func() time.Time { return now }
+
+	if _, err := o.Set("Corp.Example.com", []string{"10.0.0.1:53"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Set("eu.corp.example.com.", []string{"10.0.0.2:53"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		ns   string
+	}{
+		{"corp.example.com.", "10.0.0.1:53"},
+		{"www.corp.example.com.", "10.0.0.1:53"},
+		{"www.eu.corp.example.com.", "10.0.0.2:53"},
+		{"example.com.", ""},
+		{"notcorp.example.com.", ""},
+	} {
+		ns, ok := o.Match(tc.name)
+		if tc.ns == "" {
+			if ok {
+				t.Errorf("%s: expected no override, got %v", tc.name, ns)
+			}
+			continue
+		}
+		if !ok || len(ns) != 1 || ns[0] != tc.ns {
+			t.Errorf("%s: expected %s, got %v", tc.name, tc.ns, ns)
+		}
+	}
+
+	list := o.List()
+	if len(list) != 2 || list[0].Zone != "corp.example.com." || list[1].Zone != "eu.corp.example.com." {
+		t.Errorf("unexpected overrides %v", list)
+	}
+
+	// The first override expired, the longer one still applies.
+	now = now.Add(2 * time.Minute)
+	if _, ok := o.Match("www.corp.example.com."); ok {
+		t.Errorf("expected the override of corp.example.com. to have expired")
+	}
+	if ns, ok := o.Match("www.eu.corp.example.com."); !ok || ns[0] != "10.0.0.2:53" {
+		t.Errorf("expected the override of eu.corp.example.com., got %v", ns)
+	}
+	if list := o.List(); len(list) != 1 {
+		t.Errorf("expected 1 override, got %v", list)
+	}
+
+	if !o.Delete("eu.corp.example.com") {
+		t.Errorf("expected the override of eu.corp.example.com. to be deleted")
+	}
+	if o.Delete("eu.corp.example.com.") {
+		t.Errorf("expected no override of eu.corp.example.com. left")
+	}
+
+	var nilOverrides *ForwardOverrides
+	if _, ok := nilOverrides.Match("example.com."); ok {
+		t.Errorf("expected no override")
+	}
+}
+
+func TestForwardOverridesInvalid(t *testing.T) {
+	o := NewForwardOverrides()
+	for _, tc := range []struct {
+		zone string
+		ns   []string
+		ttl  time.Duration
+	}{
+		{"bad..zone.", []string{"10.0.0.1:53"}, time.Minute},
+		{"corp.example.com.", nil, time.Minute},
+		{"corp.example.com.", []string{"10.0.0.1:53"}, 0},
+		{"corp.example.com.", []string{"10.0.0.1:53"}, 87600 * time.Hour},
+		// The root zone and the top-level domains.
+		{".", []string{"10.0.0.1:53"}, time.Minute},
+		{"", []string{"10.0.0.1:53"}, time.Minute},
+		{"com.", []string{"10.0.0.1:53"}, time.Minute},
+	} {
+		if _, err := o.Set(tc.zone, tc.ns, tc.ttl); err == nil {
+			t.Errorf("expected an error for %+v", tc)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// exchanger sends a query to a nameserver and waits for its reply.
+// *dns.Client and *connPool are exchangers.
+type exchanger interface {
+	Exchange(m *dns.Msg, server string) (*dns.Msg, time.Duration, error)
+}
+
+var (
+	errConnClosed = errors.New("upstream connection closed")
+	errConnBusy   = errors.New("too many queries in flight on the upstream connections")
+)
+
+// maxConnInflight bounds the queries in flight on a pooled connection. Once
+// the connections of an upstream all have that many, the queries fail
+// rather than wait for one of the 65536 IDs of a connection to be free.
+const maxConnInflight = 1024
+
+// connPool keeps persistent stream (TCP or TLS) connections to the upstream
+// nameservers and pipelines queries over them, instead of dialing a new
+// connection per query. A connection is added for an upstream when all of
+// its connections have maxInflight queries in flight, up to maxConns, past
+// which they take up to maxConnInflight queries each. An
+// upstream that failed since its last successful reply only gets a single
+// connection, so that a dead upstream is not hammered with dials.
+type connPool struct {
+	client      *dns.Client
+	maxConns    int
+	maxInflight int
+	idleTimeout time.Duration
+
+	mu       sync.Mutex
+	conns    map[string][]*pooledConn
+	failures map[string]int
+}
+
+func newConnPool(client *dns.Client, maxConns, maxInflight int, idleTimeout time.Duration) *connPool {
+	return &connPool{
+		client:      client,
+		maxConns:    maxConns,
+		maxInflight: maxInflight,
+		idleTimeout: idleTimeout,
+		conns:       make(map[string][]*pooledConn),
+		failures:    make(map[string]int),
+	}
+}
+
+// Exchange sends m to server over a pooled connection. A query sent over a
+// reused connection the upstream closed in the meantime is retried once over
+// a new connection.
+func (p *connPool) Exchange(m *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+	pc, reused := p.get(server)
+	r, err := pc.exchange(m, p.client.ReadTimeout)
+	if err == errConnClosed && reused {
+		pc, _ = p.get(server)
+		r, err = pc.exchange(m, p.client.ReadTimeout)
+	}
+
+	// A busy upstream did not fail, it keeps its connections.
+	p.mu.Lock()
+	if err == nil {
+		p.failures[server] = 0
+	} else if err != errConnBusy {
+		p.failures[server]++
+	}
+	p.mu.Unlock()
+	return r, time.Since(start), err
+}
+
+// get returns the least loaded connection to server, dialing a new one if
+// they are all busy and the pool has room for it. reused is false for new
+// connections.
+func (p *connPool) get(server string) (pc *pooledConn, reused bool) {
+	p.mu.Lock()
+	now := time.Now()
+	var live []*pooledConn
+	for _, c := range p.conns[server] {
+		if c.isClosed() {
+			continue
+		}
+		if c.isIdleSince(now.Add(-p.idleTimeout)) {
+			c.close(errConnClosed)
+			continue
+		}
+		live = append(live, c)
+		if pc == nil || c.inflight() < pc.inflight() {
+			pc = c
+		}
+	}
+	p.conns[server] = live
+
+	maxConns := p.maxConns
+	if p.failures[server] > 0 {
+		maxConns = 1
+	}
+	if pc != nil && (pc.inflight() < p.maxInflight || len(live) >= maxConns) {
+		p.mu.Unlock()
+		return pc, true
+	}
+	// The connection is added before being dialed, so that concurrent queries
+	// wait for it rather than dialing connections of their own.
+	pc = newPooledConn(p.client.WriteTimeout)
+	p.conns[server] = append(p.conns[server], pc)
+	p.mu.Unlock()
+
+	pc.dial(p.client, server)
+	return pc, false
+}
+
+// Close closes every pooled connection.
+func (p *connPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for server, conns := range p.conns {
+		for _, c := range conns {
+			c.close(errConnClosed)
+		}
+		delete(p.conns, server)
+	}
+}
+
+// pooledConn is a connection to an upstream shared by concurrent queries.
+// Queries are given an ID unique on the connection, and a reader goroutine
+// hands the replies to the queries waiting for them.
+type pooledConn struct {
+	conn         *dns.Conn
+	writeTimeout time.Duration
+	writeMu      sync.Mutex
+	// ready is closed once the connection is dialed, or failed to be.
+	ready   chan struct{}
+	dialErr error
+
+	mu       sync.Mutex
+	pending  map[uint16]chan *dns.Msg
+	lastUsed time.Time
+	err      error
+}
+
+func newPooledConn(writeTimeout time.Duration) *pooledConn {
+	return &pooledConn{
+		writeTimeout: writeTimeout,
+		ready:        make(chan struct{}),
+		pending:      make(map[uint16]chan *dns.Msg),
+		lastUsed:     time.Now(),
+	}
+}
+
+func (pc *pooledConn) dial(client *dns.Client, server string) {
+	conn, err := client.Dial(server)
+	if err != nil {
+		pc.dialErr = err
+		pc.mu.Lock()
+		pc.err = err
+		pc.mu.Unlock()
+		close(pc.ready)
+		return
+	}
+	pc.mu.Lock()
+	pc.conn = conn
+	closed := pc.err != nil
+	pc.mu.Unlock()
+	close(pc.ready)
+	if closed {
+		// Closed with the pool while dialing.
+		conn.Close()
+		return
+	}
+	go pc.readLoop()
+}
+
+func (pc *pooledConn) exchange(m *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	<-pc.ready
+	if pc.dialErr != nil {
+		return nil, pc.dialErr
+	}
+	ch := make(chan *dns.Msg, 1)
+	id, err := pc.register(ch)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.unregister(id)
+
+	// Only the ID of the query is changed, a shallow copy is enough.
+	q := *m
+	q.Id = id
+	pc.writeMu.Lock()
+	pc.conn.SetWriteDeadline(time.Now().Add(pc.writeTimeout))
+	err = pc.conn.WriteMsg(&q)
+	pc.writeMu.Unlock()
+	if err != nil {
+		pc.close(err)
+		return nil, errConnClosed
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			return nil, errConnClosed
+		}
+		r.Id = m.Id
+		return r, nil
+	case <-timer.C:
+		return nil, errors.New("upstream query timed out")
+	}
+}
+
+// register picks an ID that is not in flight on the connection and
+// associates ch with it, unless maxConnInflight queries are in flight. As
+// most IDs are then free, picking one takes few tries.
+func (pc *pooledConn) register(ch chan *dns.Msg) (uint16, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.err != nil {
+		return 0, errConnClosed
+	}
+	if len(pc.pending) >= maxConnInflight {
+		return 0, errConnBusy
+	}
+	for {
+		id := uint16(rand.Intn(1 << 16))
+		if _, ok := pc.pending[id]; !ok {
+			pc.pending[id] = ch
+			pc.lastUsed = time.Now()
+			return id, nil
+		}
+	}
+}
+
+func (pc *pooledConn) unregister(id uint16) {
+	pc.mu.Lock()
+	delete(pc.pending, id)
+	pc.lastUsed = time.Now()
+	pc.mu.Unlock()
+}
+
+func (pc *pooledConn) readLoop() {
+	pc.conn.SetReadDeadline(time.Time{})
+	for {
+		r, err := pc.conn.ReadMsg()
+		if err != nil {
+			pc.close(err)
+			return
+		}
+		pc.mu.Lock()
+		if ch, ok := pc.pending[r.Id]; ok {
+			delete(pc.pending, r.Id)
+			// Buffered, and a reply is only expected once.
+			ch <- r
+		}
+		pc.mu.Unlock()
+	}
+}
+
+// close closes the connection and fails the queries in flight.
+func (pc *pooledConn) close(err error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.err != nil {
+		return
+	}
+	pc.err = err
+	if pc.conn != nil {
+		pc.conn.Close()
+	}
+	for id, ch := range pc.pending {
+		close(ch)
+		delete(pc.pending, id)
+	}
+}
+
+func (pc *pooledConn) inflight() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.pending)
+}
+
+func (pc *pooledConn) isClosed() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.err != nil
+}
+
+func (pc *pooledConn) isIdleSince(t time.Time) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.pending) == 0 && pc.lastUsed.Before(t)
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTCPUpstream starts a TCP nameserver answering every A query with
+// 10.0.0.1, over TLS with tlsConfig if set, and returns its address along
+// with the number of connections it accepted.
+func startTCPUpstream(t *testing.T, idleTimeout time.Duration, tlsConfig *tls.Config) (string, *int32, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted int32
+	var listener net.Listener = &countingListener{Listener: l, accepted: &accepted}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	server := &dns.Server{
+		Listener: listener,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			m.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30},
+				A:   net.IPv4(10, 0, 0, 1),
+			}}
+			w.WriteMsg(m)
+		}),
+		IdleTimeout: func() time.Duration { return idleTimeout },
+	}
+	go server.ActivateAndServe()
+	return l.Addr().String(), &accepted, func() { server.Shutdown() }
+}
+
+type countingListener struct {
+	net.Listener
+	accepted *int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(l.accepted, 1)
+	}
+	return c, err
+}
+
+func TestConnPoolPipelining(t *testing.T) {
+	addr, accepted, stop := startTCPUpstream(t, time.Minute, nil)
+	defer stop()
+
+	client := &dns.Client{Net: "tcp", ReadTimeout: 2 * time.Second, WriteTimeout: 2 * time.Second}
+	pool := newConnPool(client, 2, 4, time.Minute)
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			m := newExchangeMsg("example.com.", dns.TypeA, 512, false)
+			m.Id = id
+			r, _, err := pool.Exchange(m, addr)
+			if err != nil {
+				t.Errorf("query %d: %v", id, err)
+				return
+			}
+			if r.Id != id || len(r.Answer) != 1 {
+				t.Errorf("query %d: unexpected reply %v", id, r)
+			}
+		}(uint16(i % 3)) // Clients' IDs collide, the pool must not mix their replies up.
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(accepted); n > 2 {
+		t.Errorf("expected at most 2 connections to the upstream, got %d", n)
+	}
+}
+
+func TestConnPoolReconnect(t *testing.T) {
+	addr, accepted, stop := startTCPUpstream(t, 50*time.Millisecond, nil)
+	defer stop()
+
+	client := &dns.Client{Net: "tcp", ReadTimeout: 2 * time.Second, WriteTimeout: 2 * time.Second}
+	pool := newConnPool(client, 1, 16, time.Minute)
+	defer pool.Close()
+
+	m := newExchangeMsg("example.com.", dns.TypeA, 512, false)
+	if _, _, err := pool.Exchange(m, addr); err != nil {
+		t.Fatal(err)
+	}
+	// The upstream closes the idle connection, the next query must not fail.
+	time.Sleep(200 * time.Millisecond)
+	if _, _, err := pool.Exchange(m, addr); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(accepted); n != 2 {
+		t.Errorf("expected 2 connections to the upstream, got %d", n)
+	}
+}
+
+func TestConnPoolTLS(t *testing.T) {
+	cert, roots := selfSignedCertificate(t, "dns.example.com")
+	addr, accepted, stop := startTCPUpstream(t, time.Minute, &tls.Config{Certificates: []tls.Certificate{*cert}})
+	defer stop()
+
+	config := &Config{Domain: "cluster.local.", Nameservers: []string{addr}, UpstreamConns: 1,
+		UpstreamTLS: &tls.Config{RootCAs: roots, ServerName: "dns.example.com"}}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(StaticBackend{}, config)
+	defer s.tlsPool.Close()
+
+	// Queries received over UDP are forwarded over the pooled TLS connection.
+	for i := 0; i < 3; i++ {
+		w := &recordingWriter{}
+		s.ServeDNSForward(w, newExchangeMsg("example.com.", dns.TypeA, 512, false))
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Fatalf("expected an answer forwarded over TLS, got %v", w.msg)
+		}
+	}
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Errorf("expected 1 connection to the upstream, got %d", n)
+	}
+}
+
+func TestConnPoolBusy(t *testing.T) {
+	pc := newPooledConn(time.Second)
+	for i := 0; i < maxConnInflight; i++ {
+		if _, err := pc.register(make(chan *dns.Msg, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := pc.register(make(chan *dns.Msg, 1)); err != errConnBusy {
+		t.Errorf("expected %v past %d queries in flight, got %v", errConnBusy, maxConnInflight, err)
+	}
+
+	config := &Config{Domain: "cluster.local.", UpstreamPipeline: maxConnInflight + 1}
+	if err := SetDefaults(config); err == nil {
+		t.Errorf("expected an error pipelining more than %d queries", maxConnInflight)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/dns/third_party/forked/skydns/metrics"
+)
+
+const (
+	// raceWidth is the number of nameservers a query is raced to.
+	raceWidth = 2
+	// raceExploreEvery is how often, in races, the runner-up is replaced
+	// by another nameserver, so that the latency of the slower ones keeps
+	// being measured and a recovered nameserver gets picked again.
+	raceExploreEvery = 16
+	// latencyWeight is the weight of a new sample in the moving average
+	// of the latency of a nameserver.
+	latencyWeight = 0.2
+)
+
+// upstreamLatencies keeps a moving average of the latency of each
+// nameserver. It is safe for concurrent use.
+type upstreamLatencies struct {
+	mu        sync.Mutex
+	latencies map[string]time.Duration
+	races     uint64
+}
+
+func newUpstreamLatencies() *upstreamLatencies {
+	return &upstreamLatencies{latencies: make(map[string]time.Duration)}
+}
+
+// observe adds a latency sample of nameserver.
+func (u *upstreamLatencies) observe(nameserver string, latency time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	previous, ok := u.latencies[nameserver]
+	if !ok {
+		u.latencies[nameserver] = latency
+		return
+	}
+	u.latencies[nameserver] = time.Duration((1-latencyWeight)*float64(previous) + latencyWeight*float64(latency))
+}
+
+// pick returns the nameservers to race a query to: the fastest ones, those
+// never measured first, and from time to time another one in place of the
+// runner-up.
+func (u *upstreamLatencies) pick(nameservers []string) []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	ranked := append([]string(nil), nameservers...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return u.latencies[ranked[i]] < u.latencies[ranked[j]]
+	})
+	if len(ranked) <= raceWidth {
+		return ranked
+	}
+	u.races++
+	if u.races%raceExploreEvery == 0 {
+		other := raceWidth + int(u.races/raceExploreEvery)%(len(ranked)-raceWidth)
+		ranked[raceWidth-1] = ranked[other]
+	}
+	return ranked[:raceWidth]
+}
+
+// raceResult is the reply of a nameserver to a raced query.
+type raceResult struct {
+	nameserver string
+	r          *dns.Msg
+	err        error
+}
+
+// valid returns whether the reply can be used, rather than waiting for the
+// other nameservers.
+func (r raceResult) valid() bool {
+	return r.err == nil && r.r.Rcode != dns.RcodeServerFailure && r.r.Rcode != dns.RcodeRefused
+}
+
+// raceExchange sends req to the historically fastest nameservers at once
+// and returns the first valid reply. The replies that come later are
+// dropped, after their latency is recorded. If no reply is valid, the last
+// one is returned. Identical queries in flight to a nameserver share their
+// exchange, as the clients are SingleInflight.
+func (s *server) raceExchange(c exchanger, req *dns.Msg, nameservers []string) (*dns.Msg, error) {
+	picked := s.latencies.pick(nameservers)
+	results := make(chan raceResult, len(picked))
+	for _, ns := range picked {
+		go func(ns string) {
+			start := time.Now()
+			r, _, err := c.Exchange(req.Copy(), ns)
+			result := raceResult{nameserver: ns, r: r, err: err}
+			if result.valid() {
+				s.latencies.observe(ns, time.Since(start))
+			} else {
+				// Failures count as twice the timeout, so that a failing
+				// nameserver falls behind the others.
+				s.latencies.observe(ns, 2*s.config.ReadTimeout)
+			}
+			results <- result
+		}(ns)
+	}
+
+	var last raceResult
+	for i := range picked {
+		last = <-results
+		if last.valid() {
+			metrics.ReportRace(last.nameserver, true)
+			// The losers are reported as they are dropped.
+			go func(pending int) {
+				for j := 0; j < pending; j++ {
+					metrics.ReportRace((<-results).nameserver, false)
+				}
+			}(len(picked) - i - 1)
+			return last.r, nil
+		}
+		metrics.ReportRace(last.nameserver, false)
+	}
+	if last.err == nil && last.r == nil {
+		return nil, fmt.Errorf("no nameserver to race")
+	}
+	return last.r, last.err
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// delayedExchanger answers after the delay of each nameserver, with
+// SERVFAIL for the failing ones.
+type delayedExchanger struct {
+	delays  map[string]time.Duration
+	failing map[string]bool
+}
+
+func (e *delayedExchanger) Exchange(m *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	delay, ok := e.delays[server]
+	if !ok {
+		return nil, 0, errors.New("unreachable")
+	}
+	time.Sleep(delay)
+	r := new(dns.Msg)
+	r.SetReply(m)
+	if e.failing[server] {
+		r.Rcode = dns.RcodeServerFailure
+	}
+	r.Answer = []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{server}}}
+	return r, delay, nil
+}
+
+func answeredBy(t *testing.T, r *dns.Msg) string {
+	if r == nil || len(r.Answer) != 1 {
+		t.Fatalf("unexpected reply %v", r)
+	}
+	return r.Answer[0].(*dns.TXT).Txt[0]
+}
+
+func TestRaceExchange(t *testing.T) {
+	s := New(nil, &Config{ReadTimeout: time.Second})
+	e := &delayedExchanger{delays: map[string]time.Duration{
+		"10.0.0.1:53": 50 * time.Millisecond,
+		"10.0.0.2:53": time.Millisecond,
+	}}
+	nameservers := []string{"10.0.0.1:53", "10.0.0.2:53"}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeTXT)
+
+	r, err := s.raceExchange(e, req, nameservers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns := answeredBy(t, r); ns != "10.0.0.2:53" {
+		t.Errorf("expected the fastest nameserver to win, got %s", ns)
+	}
+
+	// A failing nameserver does not win, however fast.
+	e.failing = map[string]bool{"10.0.0.2:53": true}
+	r, err = s.raceExchange(e, req, nameservers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns := answeredBy(t, r); ns != "10.0.0.1:53" {
+		t.Errorf("expected the valid reply, got %s", ns)
+	}
+
+	// Without any valid reply, the last one is returned.
+	e.failing["10.0.0.1:53"] = true
+	r, err = s.raceExchange(e, req, nameservers)
+	if err != nil || r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL, got %v, %v", r, err)
+	}
+}
+
+func TestUpstreamLatenciesPick(t *testing.T) {
+	u := newUpstreamLatencies()
+	nameservers := []string{"a", "b", "c", "d"}
+	u.observe("a", 30*time.Millisecond)
+	u.observe("b", 10*time.Millisecond)
+	u.observe("c", 20*time.Millisecond)
+
+	// Nameservers never measured come first.
+	picked := u.pick(nameservers)
+	if len(picked) != 2 || picked[0] != "d" || picked[1] != "b" {
+		t.Errorf("expected [d b], got %v", picked)
+	}
+	u.observe("d", 40*time.Millisecond)
+	picked = u.pick(nameservers)
+	if len(picked) != 2 || picked[0] != "b" || picked[1] != "c" {
+		t.Errorf("expected [b c], got %v", picked)
+	}
+
+	// From time to time, a slower nameserver replaces the runner-up.
+	explored := false
+	for i := 0; i < raceExploreEvery; i++ {
+		if picked := u.pick(nameservers); picked[1] != "c" {
+			explored = true
+		}
+	}
+	if !explored {
+		t.Errorf("expected the slower nameservers to be raced too")
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"sync"
+
+	"k8s.io/dns/third_party/forked/skydns/msg"
+)
+
+// maxPooledRecords is the capacity past which the slices of records are
+// left to the garbage collector rather than pooled, so that a wildcard
+// query answering thousands of records does not pin them.
+const maxPooledRecords = 256
+
+// recordsBuffers holds the slices the backends append the records of the
+// queries to.
+var recordsBuffers = sync.Pool{New: func() interface{} { return new(recordsBuffer) }}
+
+type recordsBuffer struct {
+	services []msg.Service
+}
+
+// records returns the records of name from the backend, in a buffer to be
+// released once the answer is built. The answers copy the fields of the
+// records, nothing refers to the buffer past the query. Partial and stale
+// records are returned along with ErrPartial and ErrStale.
+func (s *server) records(name string, exact bool) (*recordsBuffer, error) {
+	buf := recordsBuffers.Get().(*recordsBuffer)
+	services, err := AppendRecords(s.backend, buf.services[:0], name, exact)
+	buf.services = services
+	if err != nil && !WithRecords(err) {
+		buf.release()
+		return nil, err
+	}
+	return buf, err
+}
+
+// release clears the records, which refer to the strings of the cache, and
+// returns the buffer to the pool.
+func (buf *recordsBuffer) release() {
+	if cap(buf.services) > maxPooledRecords {
+		buf.services = nil
+	}
+	for i := range buf.services {
+		buf.services[i] = msg.Service{}
+	}
+	buf.services = buf.services[:0]
+	recordsBuffers.Put(buf)
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestReusePort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	// Two servers, e.g. the old and the new process of an upgrade, bind the
+	// same address and both answer.
+	for _, host := range []string{"10.0.0.1", "10.0.0.2"} {
+		config := &Config{Domain: "cluster.local.", DnsAddr: addr, NoUDP: true, ReusePort: true}
+		if err := SetDefaults(config); err != nil {
+			t.Fatal(err)
+		}
+		s := New(StaticBackend{"a.default.svc.cluster.local.": {{Host: host}}}, config)
+		go s.Run()
+	}
+
+	c := &dns.Client{Net: "tcp", Timeout: time.Second}
+	req := new(dns.Msg)
+	req.SetQuestion("a.default.svc.cluster.local.", dns.TypeA)
+	seen := map[string]bool{}
+	deadline := time.Now().Add(10 * time.Second)
+	for len(seen) < 2 && time.Now().Before(deadline) {
+		resp, _, err := c.Exchange(req, addr)
+		if err != nil {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		for _, rr := range resp.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				seen[a.A.String()] = true
+			}
+		}
+	}
+	if len(seen) < 2 {
+		t.Errorf("expected answers from both servers, got %v", seen)
+	}
+}
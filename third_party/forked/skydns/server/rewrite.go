@@ -0,0 +1,111 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// RewriteRule rewrites the name of the queries matching Name to the
+// expansion of Replacement, e.g. "${1}.default.svc.cluster.local." for
+// "^(.*)\.legacy\.local\.$".
+type RewriteRule struct {
+	Name        *regexp.Regexp
+	Replacement string
+}
+
+// Rewrites holds the rules rewriting the names of the queries, like the
+// CoreDNS rewrite plugin: a query is answered as a query for the rewritten
+// name, with the names of the answers rewritten back to the name queried.
+// It lets a name served elsewhere be mapped onto a service of the cluster.
+// It is safe for concurrent use.
+type Rewrites struct {
+	mu    sync.RWMutex
+	rules []RewriteRule
+}
+
+// NewRewrites returns an empty set of rewrite rules.
+func NewRewrites() *Rewrites {
+	return &Rewrites{}
+}
+
+// Set replaces the rewrite rules. The first rule matching a name applies.
+func (r *Rewrites) Set(rules []RewriteRule) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules = rules
+}
+
+// Rewrite returns the rewritten name, lower case and fully qualified, and
+// whether a rule matched name, which must be lower case and fully
+// qualified.
+func (r *Rewrites) Rewrite(name string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rule := range r.rules {
+		match := rule.Name.FindStringSubmatchIndex(name)
+		if match == nil {
+			continue
+		}
+		rewritten := rule.Name.ExpandString(nil, rule.Replacement, name, match)
+		return dns.Fqdn(strings.ToLower(string(rewritten))), true
+	}
+	return "", false
+}
+
+// handler returns h, answering the queries matching a rule as queries for
+// the rewritten name.
+func (r *Rewrites) handler(h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if len(req.Question) != 1 {
+			h.ServeDNS(w, req)
+			return
+		}
+		name := req.Question[0].Name
+		rewritten, ok := r.Rewrite(strings.ToLower(name))
+		if !ok || rewritten == strings.ToLower(name) {
+			h.ServeDNS(w, req)
+			return
+		}
+		logf("rewriting the query for %q to %q", name, rewritten)
+		req = req.Copy()
+		req.Question[0].Name = rewritten
+		h.ServeDNS(&rewriteWriter{ResponseWriter: w, name: name, rewritten: rewritten}, req)
+	})
+}
+
+// rewriteWriter rewrites the names of the answers to a rewritten query back
+// to the name queried.
+type rewriteWriter struct {
+	dns.ResponseWriter
+	// name was queried, and rewritten to rewritten.
+	name      string
+	rewritten string
+}
+
+func (w *rewriteWriter) WriteMsg(m *dns.Msg) error {
+	// The reply may be cached, it is not changed.
+	m = m.Copy()
+	for i := range m.Question {
+		if strings.EqualFold(m.Question[i].Name, w.rewritten) {
+			m.Question[i].Name = w.name
+		}
+	}
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if strings.EqualFold(rr.Header().Name, w.rewritten) {
+				rr.Header().Name = w.name
+			}
+		}
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
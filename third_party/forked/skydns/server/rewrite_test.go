@@ -0,0 +1,91 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRewritesRewrite(t *testing.T) {
+	r := NewRewrites()
+	r.Set([]RewriteRule{
+		{Name: regexp.MustCompile(`^db\.legacy\.local\.$`), Replacement: "postgres.default.svc.cluster.local."},
+		{Name: regexp.MustCompile(`^(.+)\.legacy\.local\.$`), Replacement: "${1}.default.svc.cluster.local"},
+	})
+	for _, tc := range []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"db.legacy.local.", "postgres.default.svc.cluster.local.", true},
+		{"web.legacy.local.", "web.default.svc.cluster.local.", true},
+		{"legacy.local.", "", false},
+		{"web.default.svc.cluster.local.", "", false},
+	} {
+		got, ok := r.Rewrite(tc.name)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("Rewrite(%q) = %q, %v, want %q, %v", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+
+	var nilRewrites *Rewrites
+	if _, ok := nilRewrites.Rewrite("db.legacy.local."); ok {
+		t.Errorf("expected no rewrite without rules")
+	}
+}
+
+func TestRewritesServe(t *testing.T) {
+	var observed []string
+	config := &Config{
+		Domain:      "cluster.local.",
+		Nameservers: []string{"127.0.0.1:53"},
+		NoRec:       true,
+		Rewrites:    NewRewrites(),
+		Observer: func(remote net.Addr, req, resp *dns.Msg) {
+			observed = append(observed, req.Question[0].Name)
+		},
+	}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	config.Rewrites.Set([]RewriteRule{
+		{Name: regexp.MustCompile(`^db\.legacy\.local\.$`), Replacement: "postgres.default.svc.cluster.local."},
+	})
+	s := New(StaticBackend{"postgres.default.svc.cluster.local.": {{Host: "10.0.0.1"}}}, config)
+
+	req := new(dns.Msg)
+	req.SetQuestion("DB.Legacy.Local.", dns.TypeA)
+	w := &recordingWriter{}
+	s.handler().ServeDNS(w, req)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 1 {
+		t.Fatalf("unexpected reply %v", w.msg)
+	}
+	if name := w.msg.Question[0].Name; name != "DB.Legacy.Local." {
+		t.Errorf("expected the question for DB.Legacy.Local., got %s", name)
+	}
+	a, ok := w.msg.Answer[0].(*dns.A)
+	if !ok || a.Hdr.Name != "DB.Legacy.Local." || a.A.String() != "10.0.0.1" {
+		t.Errorf("unexpected answer %v", w.msg.Answer[0])
+	}
+	if req.Question[0].Name != "DB.Legacy.Local." {
+		t.Errorf("the query was changed: %v", req.Question[0])
+	}
+	if len(observed) != 1 || observed[0] != "DB.Legacy.Local." {
+		t.Errorf("expected the original query to be observed, got %v", observed)
+	}
+
+	// Names matching no rule are served as they are.
+	req = new(dns.Msg)
+	req.SetQuestion("web.legacy.local.", dns.TypeA)
+	w = &recordingWriter{}
+	s.handler().ServeDNS(w, req)
+	if w.msg == nil || len(w.msg.Answer) != 0 {
+		t.Errorf("unexpected reply %v", w.msg)
+	}
+}
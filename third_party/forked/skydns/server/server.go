@@ -5,6 +5,7 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"net"
@@ -31,28 +32,52 @@ type server struct {
 	group        *sync.WaitGroup
 	dnsUDPclient *dns.Client // used for forwarding queries
 	dnsTCPclient *dns.Client // used for forwarding queries
+	tcpPool      *connPool   // persistent TCP connections to upstreams, if enabled
+	dnsTLSclient *dns.Client // used for forwarding queries over TLS, if enabled
+	tlsPool      *connPool   // persistent TLS connections to upstreams, if enabled
 	scache       *cache.Cache
 	rcache       *cache.Cache
+	// rotation counts the replies rotated with OrderRoundRobin.
+	rotation uint32
+	// latencies of the nameservers, used to race forwarded queries.
+	latencies *upstreamLatencies
+	// journal, if set, keeps the changes of the records of the domain, see
+	// IXFRJournal and Notify.
+	journal *zoneJournal
 }
 
 // New returns a new SkyDNS server.
 func New(backend Backend, config *Config) *server {
-	return &server{
+	s := &server{
 		backend: backend,
 		config:  config,
 
 		group:        new(sync.WaitGroup),
 		scache:       cache.New(config.SCache, 0),
 		rcache:       cache.New(config.RCache, config.RCacheTtl),
-		dnsUDPclient: &dns.Client{Net: "udp", ReadTimeout: config.ReadTimeout, WriteTimeout: config.ReadTimeout, SingleInflight: true},
-		dnsTCPclient: &dns.Client{Net: "tcp", ReadTimeout: config.ReadTimeout, WriteTimeout: config.ReadTimeout, SingleInflight: true},
+		dnsUDPclient: &dns.Client{Net: "udp", ReadTimeout: config.ReadTimeout, WriteTimeout: config.ReadTimeout, TsigSecret: config.TsigSecret, SingleInflight: true},
+		dnsTCPclient: &dns.Client{Net: "tcp", ReadTimeout: config.ReadTimeout, WriteTimeout: config.ReadTimeout, TsigSecret: config.TsigSecret, SingleInflight: true},
+		latencies:    newUpstreamLatencies(),
 	}
+	if config.UpstreamTLS != nil {
+		s.dnsTLSclient = &dns.Client{Net: "tcp-tls", TLSConfig: config.UpstreamTLS, ReadTimeout: config.ReadTimeout, WriteTimeout: config.ReadTimeout, TsigSecret: config.TsigSecret, SingleInflight: true}
+	}
+	if config.UpstreamConns > 0 && config.ForwardKey == "" {
+		s.tcpPool = newConnPool(s.dnsTCPclient, config.UpstreamConns, config.UpstreamPipeline, config.UpstreamIdleTimeout)
+		if s.dnsTLSclient != nil {
+			s.tlsPool = newConnPool(s.dnsTLSclient, config.UpstreamConns, config.UpstreamPipeline, config.UpstreamIdleTimeout)
+		}
+	}
+	if config.IXFRJournal > 0 || len(config.Notify) > 0 {
+		s.journal = newZoneJournal(config.IXFRJournal)
+	}
+	return s
 }
 
 // Run is a blocking operation that starts the server listening on the DNS ports.
 func (s *server) Run() error {
 	mux := dns.NewServeMux()
-	mux.Handle(".", s)
+	mux.Handle(".", s.handler())
 
 	dnsReadyMsg := func(addr, net string) {
 		if s.config.DNSSEC == "" {
@@ -75,11 +100,12 @@ func (s *server) Run() error {
 			return fmt.Errorf("no UDP or TCP sockets supplied by systemd")
 		}
 		for _, p := range packetConns {
-			if u, ok := p.(*net.UDPConn); ok {
+			if u, ok := p.(*net.UDPConn); ok && !s.config.NoUDP {
 				s.group.Add(1)
 				go func() {
 					defer s.group.Done()
-					if err := dns.ActivateAndServe(nil, u, mux); err != nil {
+					srv := &dns.Server{PacketConn: u, Handler: mux, TsigSecret: s.config.TsigSecret}
+					if err := srv.ActivateAndServe(); err != nil {
 						fatalf("%s", err)
 					}
 				}()
@@ -87,11 +113,12 @@ func (s *server) Run() error {
 			}
 		}
 		for _, l := range listeners {
-			if t, ok := l.(*net.TCPListener); ok {
+			if t, ok := l.(*net.TCPListener); ok && !s.config.NoTCP {
 				s.group.Add(1)
 				go func() {
 					defer s.group.Done()
-					if err := dns.ActivateAndServe(t, nil, mux); err != nil {
+					srv := &dns.Server{Listener: t, Handler: mux, TsigSecret: s.config.TsigSecret}
+					if err := srv.ActivateAndServe(); err != nil {
 						fatalf("%s", err)
 					}
 				}()
@@ -99,22 +126,43 @@ func (s *server) Run() error {
 			}
 		}
 	} else {
+		if !s.config.NoTCP {
+			s.group.Add(1)
+			go func() {
+				defer s.group.Done()
+				srv := &dns.Server{Addr: s.config.DnsAddr, Net: "tcp", Handler: mux, TsigSecret: s.config.TsigSecret, ReusePort: s.config.ReusePort}
+				if err := srv.ListenAndServe(); err != nil {
+					fatalf("%s", err)
+				}
+			}()
+			dnsReadyMsg(s.config.DnsAddr, "tcp")
+		}
+		if !s.config.NoUDP {
+			s.group.Add(1)
+			go func() {
+				defer s.group.Done()
+				srv := &dns.Server{Addr: s.config.DnsAddr, Net: "udp", Handler: mux, TsigSecret: s.config.TsigSecret, ReusePort: s.config.ReusePort}
+				if err := srv.ListenAndServe(); err != nil {
+					fatalf("%s", err)
+				}
+			}()
+			dnsReadyMsg(s.config.DnsAddr, "udp")
+		}
+	}
+	if s.config.DoTAddr != "" {
 		s.group.Add(1)
 		go func() {
 			defer s.group.Done()
-			if err := dns.ListenAndServe(s.config.DnsAddr, "tcp", mux); err != nil {
-				fatalf("%s", err)
-			}
-		}()
-		dnsReadyMsg(s.config.DnsAddr, "tcp")
-		s.group.Add(1)
-		go func() {
-			defer s.group.Done()
-			if err := dns.ListenAndServe(s.config.DnsAddr, "udp", mux); err != nil {
+			srv := &dns.Server{Addr: s.config.DoTAddr, Net: "tcp-tls", TLSConfig: s.config.TLSConfig, Handler: mux, TsigSecret: s.config.TsigSecret, ReusePort: s.config.ReusePort}
+			if err := srv.ListenAndServe(); err != nil {
 				fatalf("%s", err)
 			}
 		}()
-		dnsReadyMsg(s.config.DnsAddr, "udp")
+		dnsReadyMsg(s.config.DoTAddr, "tcp-tls")
+	}
+
+	if s.journal != nil {
+		go s.runJournal()
 	}
 
 	s.group.Wait()
@@ -134,7 +182,7 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	m.SetReply(req)
 	m.Authoritative = true
 	m.RecursionAvailable = true
-	m.Compress = true
+	m.Compress = !s.config.NoCompress
 
 	bufsize := uint16(512)
 	dnssec := false
@@ -144,12 +192,20 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	q := req.Question[0]
 	name := strings.ToLower(q.Name)
 
-	if q.Qtype == dns.TypeANY || !s.backend.HasSynced() {
+	if q.Qtype == dns.TypeANY || !s.backend.HasSynced() || !s.authorized(w, name) {
 		m.Authoritative = false
 		m.Rcode = dns.RcodeRefused
 		m.RecursionAvailable = false
 		m.RecursionDesired = false
 		m.Compress = false
+		switch {
+		case q.Qtype == dns.TypeANY:
+			setExtendedError(m, req, dns.ExtendedErrorCodeNotSupported, "ANY queries are not supported")
+		case !s.backend.HasSynced():
+			setExtendedError(m, req, dns.ExtendedErrorCodeNotReady, "records are not synced yet")
+		default:
+			setExtendedError(m, req, dns.ExtendedErrorCodeProhibited, "query not allowed for this client")
+		}
 		w.WriteMsg(m)
 
 		metrics.ReportRequestCount(m, metrics.Auth)
@@ -159,6 +215,11 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 
+	if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		s.serveTransfer(w, req)
+		return
+	}
+
 	if o := req.IsEdns0(); o != nil {
 		bufsize = o.UDPSize()
 		dnssec = o.Do()
@@ -175,20 +236,28 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		logf("received DNS Request for %q from %q with type %d", q.Name, w.RemoteAddr(), q.Qtype)
 	}
 
-	// Check cache first.
-	m1 := s.rcache.Hit(q, dnssec, tcp, m.Id)
+	// Check cache first. The replies computed from the records are only
+	// hit at the generation of the backend they were computed at.
+	gen := generation(s.backend)
+	m1 := s.rcache.HitGeneration(q, dnssec, tcp, m.Id, gen)
 	if m1 != nil {
+		m1.Compress = !s.config.NoCompress
 		metrics.ReportRequestCount(req, metrics.Cache)
 
-		if send := s.overflowOrTruncated(w, m1, int(bufsize), metrics.Cache); send {
-			return
-		}
-
 		// Still round-robin even with hits from the cache.
 		// Only shuffle A and AAAA records with each other.
 		if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
 			s.RoundRobin(m1.Answer)
 		}
+		s.rotateAnswers(m1)
+		s.sortAnswers(w, req, m1)
+		// The answers are limited once ordered, so that the records
+		// kept vary and the preferred ones are kept.
+		s.limitAnswers(w, m1)
+
+		if send := s.overflowOrTruncated(w, m1, int(bufsize), metrics.Cache); send {
+			return
+		}
 
 		if err := w.WriteMsg(m1); err != nil {
 			logf("failure to return reply %q", err)
@@ -199,12 +268,27 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 
+	// Runtime overrides take precedence over the stub zones and the default
+	// nameservers. Their replies are not cached, so that removing an override
+	// takes effect at once.
+	if q.Qclass != dns.ClassCHAOS && !s.inDomain(name) {
+		if ns, ok := s.config.Overrides.Match(name); ok {
+			metrics.ReportRequestCount(req, metrics.Stub)
+
+			resp := s.ServeDNSStubForward(w, req, ns)
+
+			metrics.ReportDuration(resp, start, metrics.Stub)
+			metrics.ReportErrorCount(resp, metrics.Stub)
+			return
+		}
+	}
+
 	for zone, ns := range *s.config.stub {
 		if strings.HasSuffix(name, "."+zone) || name == zone {
 			metrics.ReportRequestCount(req, metrics.Stub)
 
 			resp := s.ServeDNSStubForward(w, req, ns)
-			if resp != nil {
+			if resp != nil && !subnetScoped(resp) {
 				s.rcache.InsertMessage(cache.Key(q, dnssec, tcp), resp)
 			}
 
@@ -219,12 +303,12 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		name = s.config.Local
 	}
 
-	if q.Qtype == dns.TypePTR && strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.") {
+	if q.Qtype == dns.TypePTR && (strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.")) {
 		metrics.ReportRequestCount(req, metrics.Reverse)
 
 		resp := s.ServeDNSReverse(w, req)
-		if resp != nil {
-			s.rcache.InsertMessage(cache.Key(q, dnssec, tcp), resp)
+		if resp != nil && !subnetScoped(resp) {
+			s.rcache.InsertMessageGeneration(cache.Key(q, dnssec, tcp), resp, gen)
 		}
 
 		metrics.ReportDuration(resp, start, metrics.Reverse)
@@ -232,11 +316,11 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 
-	if q.Qclass != dns.ClassCHAOS && !strings.HasSuffix(name, "."+s.config.Domain) && name != s.config.Domain {
+	if q.Qclass != dns.ClassCHAOS && !s.inDomain(name) {
 		metrics.ReportRequestCount(req, metrics.Rec)
 
 		resp := s.ServeDNSForward(w, req)
-		if resp != nil {
+		if resp != nil && !subnetScoped(resp) {
 			s.rcache.InsertMessage(cache.Key(q, dnssec, tcp), resp)
 		}
 
@@ -247,6 +331,8 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 
 	metrics.ReportCacheMiss(metrics.Response)
 
+	// stale is set when the records answered are stale, see ErrStale.
+	stale := false
 	defer func() {
 		metrics.ReportRequestCount(req, metrics.Auth)
 		metrics.ReportDuration(m, start, metrics.Auth)
@@ -258,6 +344,12 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 			}
 			return
 		}
+		if resp, ok := s.fallthroughForward(w, req, m); ok {
+			if resp != nil && !subnetScoped(resp) {
+				s.rcache.InsertMessageGeneration(cache.Key(q, dnssec, tcp), resp, gen)
+			}
+			return
+		}
 		// Set TTL to the minimum of the RRset and dedup the message, i.e. remove identical RRs.
 		m = s.dedup(m)
 
@@ -281,22 +373,34 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 			}
 		}
 
+		// The whole reply is cached, it is limited and truncated as it
+		// is sent, like the replies from the cache. Partial and stale
+		// replies, see ErrPartial and ErrStale, are not: the next query
+		// may be answered in full and from the synced records.
+		if stale {
+			setExtendedError(m, req, dns.ExtendedErrorCodeStaleAnswer, "records are not synced yet")
+		}
+		if !m.Truncated && !stale {
+			s.rcache.InsertMessageGeneration(cache.Key(q, dnssec, tcp), m, gen)
+		}
+		s.rotateAnswers(m)
+		s.sortAnswers(w, req, m)
+		s.limitAnswers(w, m)
+
 		if send := s.overflowOrTruncated(w, m, int(bufsize), metrics.Auth); send {
 			return
 		}
 
-		s.rcache.InsertMessage(cache.Key(q, dnssec, tcp), m)
-
 		if err := w.WriteMsg(m); err != nil {
 			logf("failure to return reply %q", err)
 		}
 	}()
 
+	if q.Qtype == dns.TypeSOA && name == s.zoneOf(name) {
+		m.Answer = []dns.RR{s.newSOA(name)}
+		return
+	}
 	if name == s.config.Domain {
-		if q.Qtype == dns.TypeSOA {
-			m.Answer = []dns.RR{s.NewSOA()}
-			return
-		}
 		if q.Qtype == dns.TypeDNSKEY {
 			if s.config.PubKey != nil {
 				m.Answer = []dns.RR{s.config.PubKey}
@@ -345,6 +449,19 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 
+	// answered clears the errors returned along with records, which are
+	// answered: partial records truncate the reply, stale ones flag it.
+	answered := func(err error) error {
+		switch {
+		case isPartial(err):
+			m.Truncated = true
+		case isStale(err):
+			stale = true
+		default:
+			return err
+		}
+		return nil
+	}
 	switch q.Qtype {
 	case dns.TypeNS:
 		if name != s.config.Domain {
@@ -352,53 +469,82 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		}
 		// Lookup s.config.DnsDomain
 		records, extra, err := s.NSRecords(q, s.config.dnsDomain)
+		err = answered(err)
 		if isEtcdNameError(err, s) {
 			m = s.NameError(req)
 			return
 		}
+		if isServerFailure(err) {
+			m = s.backendFailure(req, err)
+			return
+		}
 		m.Answer = append(m.Answer, records...)
 		m.Extra = append(m.Extra, extra...)
 	case dns.TypeA, dns.TypeAAAA:
 		records, err := s.AddressRecords(q, name, nil, bufsize, dnssec, false)
+		err = answered(err)
 		if isEtcdNameError(err, s) {
 			m = s.NameError(req)
 			return
 		}
+		if isServerFailure(err) {
+			m = s.backendFailure(req, err)
+			return
+		}
 		m.Answer = append(m.Answer, records...)
 	case dns.TypeTXT:
 		records, err := s.TXTRecords(q, name)
+		err = answered(err)
 		if isEtcdNameError(err, s) {
 			m = s.NameError(req)
 			return
 		}
+		if isServerFailure(err) {
+			m = s.backendFailure(req, err)
+			return
+		}
 		m.Answer = append(m.Answer, records...)
 	case dns.TypeCNAME:
 		records, err := s.CNAMERecords(q, name)
+		err = answered(err)
 		if isEtcdNameError(err, s) {
 			m = s.NameError(req)
 			return
 		}
+		if isServerFailure(err) {
+			m = s.backendFailure(req, err)
+			return
+		}
 		m.Answer = append(m.Answer, records...)
+		if s.config.ChaseCNAME {
+			m.Extra = append(m.Extra, s.cnameGlue(records, bufsize, dnssec)...)
+		}
 	case dns.TypeMX:
 		records, extra, err := s.MXRecords(q, name, bufsize, dnssec)
+		err = answered(err)
 		if isEtcdNameError(err, s) {
 			m = s.NameError(req)
 			return
 		}
+		if isServerFailure(err) {
+			m = s.backendFailure(req, err)
+			return
+		}
 		m.Answer = append(m.Answer, records...)
 		m.Extra = append(m.Extra, extra...)
 	default:
 		fallthrough // also catch other types, so that they return NODATA
 	case dns.TypeSRV:
 		records, extra, err := s.SRVRecords(q, name, bufsize, dnssec)
+		err = answered(err)
 		if err != nil {
 			if isEtcdNameError(err, s) {
 				m = s.NameError(req)
 				return
 			}
 			logf("got error from backend: %s", err)
-			if q.Qtype == dns.TypeSRV { // Otherwise NODATA
-				m = s.ServerFailure(req)
+			if (q.Qtype == dns.TypeSRV && !isNoData(err)) || isServerFailure(err) { // Otherwise NODATA
+				m = s.backendFailure(req, err)
 				return
 			}
 		}
@@ -413,16 +559,17 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	}
 
 	if len(m.Answer) == 0 { // NODATA response
-		m.Ns = []dns.RR{s.NewSOA()}
-		m.Ns[0].Header().Ttl = s.config.MinTtl
+		m.Ns = []dns.RR{s.negativeSOA(name)}
 	}
 }
 
 func (s *server) AddressRecords(q dns.Question, name string, previousRecords []dns.RR, bufsize uint16, dnssec, both bool) (records []dns.RR, err error) {
-	services, err := s.backend.Records(name, false)
-	if err != nil {
+	buf, err := s.records(name, false)
+	if err != nil && !WithRecords(err) {
 		return nil, err
 	}
+	defer buf.release()
+	services := buf.services
 
 	services = msg.Group(services)
 
@@ -450,7 +597,7 @@ func (s *server) AddressRecords(q dns.Question, name string, previousRecords []d
 
 			nextRecords, err := s.AddressRecords(dns.Question{Name: dns.Fqdn(serv.Host), Qtype: q.Qtype, Qclass: q.Qclass},
 				strings.ToLower(dns.Fqdn(serv.Host)), append(previousRecords, newRecord), bufsize, dnssec, both)
-			if err == nil {
+			if err == nil || isStale(err) {
 				// Only have we found something we should add the CNAME and the IP addresses.
 				if len(nextRecords) > 0 {
 					records = append(records, newRecord)
@@ -460,7 +607,7 @@ func (s *server) AddressRecords(q dns.Question, name string, previousRecords []d
 			}
 			// This means we can not complete the CNAME, try to look else where.
 			target := newRecord.Target
-			if dns.IsSubDomain(s.config.Domain, target) {
+			if s.inDomain(target) {
 				// We should already have found it
 				continue
 			}
@@ -480,15 +627,18 @@ func (s *server) AddressRecords(q dns.Question, name string, previousRecords []d
 		}
 	}
 	s.RoundRobin(records)
-	return records, nil
+	// err is nil, or ErrPartial or ErrStale if the records are.
+	return records, err
 }
 
 // NSRecords returns NS records from etcd.
 func (s *server) NSRecords(q dns.Question, name string) (records []dns.RR, extra []dns.RR, err error) {
-	services, err := s.backend.Records(name, false)
-	if err != nil {
+	buf, err := s.records(name, false)
+	if err != nil && !WithRecords(err) {
 		return nil, nil, err
 	}
+	defer buf.release()
+	services := buf.services
 
 	services = msg.Group(services)
 
@@ -507,16 +657,18 @@ func (s *server) NSRecords(q dns.Question, name string) (records []dns.RR, extra
 			extra = append(extra, serv.NewAAAA(serv.Host, ip.To16()))
 		}
 	}
-	return records, extra, nil
+	return records, extra, err
 }
 
 // SRVRecords returns SRV records from etcd.
 // If the Target is not a name but an IP address, a name is created.
 func (s *server) SRVRecords(q dns.Question, name string, bufsize uint16, dnssec bool) (records []dns.RR, extra []dns.RR, err error) {
-	services, err := s.backend.Records(name, false)
-	if err != nil {
+	buf, err := s.records(name, false)
+	if err != nil && !WithRecords(err) {
 		return nil, nil, err
 	}
+	defer buf.release()
+	services := buf.services
 
 	services = msg.Group(services)
 
@@ -554,7 +706,7 @@ func (s *server) SRVRecords(q dns.Question, name string, bufsize uint16, dnssec
 
 			lookup[srv.Target] = true
 
-			if !dns.IsSubDomain(s.config.Domain, srv.Target) {
+			if !s.inDomain(srv.Target) {
 				m1, e1 := s.Lookup(srv.Target, dns.TypeA, bufsize, dnssec)
 				if e1 == nil {
 					extra = append(extra, m1.Answer...)
@@ -575,7 +727,7 @@ func (s *server) SRVRecords(q dns.Question, name string, bufsize uint16, dnssec
 			// view.
 			addr, e1 := s.AddressRecords(dns.Question{srv.Target, dns.ClassINET, dns.TypeA},
 				srv.Target, nil, bufsize, dnssec, true)
-			if e1 == nil {
+			if e1 == nil || isStale(e1) {
 				extra = append(extra, addr...)
 			}
 		case ip.To4() != nil:
@@ -592,16 +744,18 @@ func (s *server) SRVRecords(q dns.Question, name string, bufsize uint16, dnssec
 			extra = append(extra, serv.NewAAAA(srv.Target, ip.To16()))
 		}
 	}
-	return records, extra, nil
+	return records, extra, err
 }
 
 // MXRecords returns MX records from etcd.
 // If the Target is not a name but an IP address, a name is created.
 func (s *server) MXRecords(q dns.Question, name string, bufsize uint16, dnssec bool) (records []dns.RR, extra []dns.RR, err error) {
-	services, err := s.backend.Records(name, false)
-	if err != nil {
+	buf, err := s.records(name, false)
+	if err != nil && !WithRecords(err) {
 		return nil, nil, err
 	}
+	defer buf.release()
+	services := buf.services
 
 	lookup := make(map[string]bool)
 	for _, serv := range services {
@@ -638,7 +792,7 @@ func (s *server) MXRecords(q dns.Question, name string, bufsize uint16, dnssec b
 			// Internal name
 			addr, e1 := s.AddressRecords(dns.Question{mx.Mx, dns.ClassINET, dns.TypeA},
 				mx.Mx, nil, bufsize, dnssec, true)
-			if e1 == nil {
+			if e1 == nil || isStale(e1) {
 				extra = append(extra, addr...)
 			}
 		case ip.To4() != nil:
@@ -651,14 +805,16 @@ func (s *server) MXRecords(q dns.Question, name string, bufsize uint16, dnssec b
 			extra = append(extra, serv.NewAAAA(serv.Host, ip.To16()))
 		}
 	}
-	return records, extra, nil
+	return records, extra, err
 }
 
 func (s *server) CNAMERecords(q dns.Question, name string) (records []dns.RR, err error) {
-	services, err := s.backend.Records(name, true)
-	if err != nil {
+	buf, err := s.records(name, true)
+	if err != nil && !WithRecords(err) {
 		return nil, err
 	}
+	defer buf.release()
+	services := buf.services
 
 	services = msg.Group(services)
 
@@ -668,14 +824,16 @@ func (s *server) CNAMERecords(q dns.Question, name string) (records []dns.RR, er
 			records = append(records, serv.NewCNAME(q.Name, dns.Fqdn(serv.Host)))
 		}
 	}
-	return records, nil
+	return records, err
 }
 
 func (s *server) TXTRecords(q dns.Question, name string) (records []dns.RR, err error) {
-	services, err := s.backend.Records(name, false)
-	if err != nil {
+	buf, err := s.records(name, false)
+	if err != nil && !WithRecords(err) {
 		return nil, err
 	}
+	defer buf.release()
+	services := buf.services
 
 	services = msg.Group(services)
 
@@ -685,33 +843,63 @@ func (s *server) TXTRecords(q dns.Question, name string) (records []dns.RR, err
 		}
 		records = append(records, serv.NewTXT(q.Name))
 	}
-	return records, nil
+	return records, err
 }
 
 func (s *server) PTRRecords(q dns.Question) (records []dns.RR, err error) {
 	name := strings.ToLower(q.Name)
-	serv, err := s.backend.ReverseRecord(name)
+	servs, err := ReverseRecords(s.backend, name)
 	if err != nil {
 		return nil, err
 	}
 
-	records = append(records, serv.NewPTR(q.Name, serv.Ttl))
+	for _, serv := range servs {
+		records = append(records, serv.NewPTR(q.Name, serv.Ttl))
+	}
 	return records, nil
 }
 
 // SOA returns a SOA record for this SkyDNS instance.
 func (s *server) NewSOA() dns.RR {
-	return &dns.SOA{Hdr: dns.RR_Header{Name: s.config.Domain, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: s.config.Ttl},
-		Ns:      appendDomain("ns.dns", s.config.Domain),
+	return s.newSOA(s.config.Domain)
+}
+
+// newSOA returns the SOA record of zone, one of the served domains. The
+// serial of the domain counts its changes if it is journaled.
+func (s *server) newSOA(zone string) *dns.SOA {
+	serial := s.config.SOASerial
+	if s.journal != nil && zone == s.config.Domain {
+		serial, _ = s.journal.current()
+	} else if serial == 0 {
+		serial = uint32(time.Now().Truncate(time.Hour).Unix())
+	}
+	return s.soaWithSerial(zone, serial)
+}
+
+// soaWithSerial returns the SOA record of zone at serial.
+func (s *server) soaWithSerial(zone string, serial uint32) *dns.SOA {
+	return &dns.SOA{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: s.config.Ttl},
+		Ns:      appendDomain("ns.dns", zone),
 		Mbox:    s.config.Hostmaster,
-		Serial:  uint32(time.Now().Truncate(time.Hour).Unix()),
-		Refresh: 28800,
-		Retry:   7200,
-		Expire:  604800,
+		Serial:  serial,
+		Refresh: s.config.SOARefresh,
+		Retry:   s.config.SOARetry,
+		Expire:  s.config.SOAExpire,
 		Minttl:  s.config.MinTtl,
 	}
 }
 
+// negativeSOA returns the SOA record of the zone of name for the authority
+// section of a negative answer. Its TTL is the lesser of its own and of its
+// MINIMUM field, for which the answer is cached (RFC 2308, section 3).
+func (s *server) negativeSOA(name string) dns.RR {
+	soa := s.newSOA(s.zoneOf(name))
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
 func (s *server) isDuplicateCNAME(r *dns.CNAME, records []dns.RR) bool {
 	for _, rec := range records {
 		if v, ok := rec.(*dns.CNAME); ok {
@@ -726,8 +914,7 @@ func (s *server) isDuplicateCNAME(r *dns.CNAME, records []dns.RR) bool {
 func (s *server) NameError(req *dns.Msg) *dns.Msg {
 	m := new(dns.Msg)
 	m.SetRcode(req, dns.RcodeNameError)
-	m.Ns = []dns.RR{s.NewSOA()}
-	m.Ns[0].Header().Ttl = s.config.MinTtl
+	m.Ns = []dns.RR{s.negativeSOA(req.Question[0].Name)}
 	return m
 }
 
@@ -737,8 +924,47 @@ func (s *server) ServerFailure(req *dns.Msg) *dns.Msg {
 	return m
 }
 
+// inDomain returns whether the fully qualified name is answered from the
+// backend: it is in the domain, in one of the extra domains or in one of
+// the fallthrough zones.
+func (s *server) inDomain(name string) bool {
+	if dns.IsSubDomain(s.config.Domain, name) {
+		return true
+	}
+	for _, domain := range s.config.ExtraDomains {
+		if dns.IsSubDomain(domain, name) {
+			return true
+		}
+	}
+	if s.config.LocalZones.Contains(name) {
+		return true
+	}
+	_, ok := s.config.Fallthrough.Match(name)
+	return ok
+}
+
+// zoneOf returns the served domain name is in: the domain, one of the extra
+// domains or one of the local zones, the domain if none.
+func (s *server) zoneOf(name string) string {
+	name = strings.ToLower(name)
+	if dns.IsSubDomain(s.config.Domain, name) {
+		return s.config.Domain
+	}
+	for _, domain := range s.config.ExtraDomains {
+		if dns.IsSubDomain(domain, name) {
+			return domain
+		}
+	}
+	if zone, ok := s.config.LocalZones.Zone(name); ok {
+		return zone
+	}
+	return s.config.Domain
+}
+
 func (s *server) RoundRobin(rrs []dns.RR) {
-	if !s.config.RoundRobin {
+	// Rotations are applied to the replies as they are sent, see
+	// rotateAnswers, so that the cached replies keep the backend order.
+	if s.answerOrder() != OrderRandom {
 		return
 	}
 	// If we have more than 1 CNAME don't touch the packet, because some stub resolver (=glibc)
@@ -871,6 +1097,28 @@ func (s *server) overflowOrTruncated(w dns.ResponseWriter, m *dns.Msg, bufsize i
 	return false
 }
 
+// isServerFailure returns true if the backend asked for a SERVFAIL answer.
+func isServerFailure(err error) bool {
+	return errors.Is(err, ErrBackendUnavailable)
+}
+
+// isPartial returns true if the backend returned part of the records of
+// the name only.
+func isPartial(err error) bool {
+	return errors.Is(err, ErrPartial)
+}
+
+// isStale returns true if the backend returned stale records.
+func isStale(err error) bool {
+	return errors.Is(err, ErrStale)
+}
+
+// isNoData returns true if the backend reported that the name exists
+// without records.
+func isNoData(err error) bool {
+	return errors.Is(err, ErrNoData)
+}
+
 // isTCP returns true if the client is connecting over TCP.
 func isTCP(w dns.ResponseWriter) bool {
 	_, ok := w.RemoteAddr().(*net.TCPAddr)
@@ -878,12 +1126,16 @@ func isTCP(w dns.ResponseWriter) bool {
 }
 
 // etcNameError return a NameError to the client if the error
-// returned from etcd has ErrorCode == 100.
+// returned from etcd has ErrorCode == 100, or if the backend reported the
+// name as not found or invalid.
 func isEtcdNameError(err error, s *server) bool {
 	if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeKeyNotFound {
 		return true
 	}
-	if err != nil {
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrInvalid) {
+		return true
+	}
+	if err != nil && !isNoData(err) {
 		logf("error from backend: %s", err)
 	}
 	return false
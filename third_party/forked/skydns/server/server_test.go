@@ -1370,3 +1370,12 @@ func BenchmarkDNSSECSingleNoCache(b *testing.B) {
 		c.Exchange(m, "127.0.0.1:"+StrPort)
 	}
 }
+
+func TestSetDefaultsListeners(t *testing.T) {
+	if err := SetDefaults(&Config{NoUDP: true}); err != nil {
+		t.Fatalf("expected TCP only config to be valid: %s", err)
+	}
+	if err := SetDefaults(&Config{NoUDP: true, NoTCP: true}); err == nil {
+		t.Fatal("expected an error when disabling both listeners")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestNegativeSOA(t *testing.T) {
+	config := &Config{Domain: "cluster.local.", ExtraDomains: []string{"prod.internal."}, LocalZones: NewZones(),
+		NoRec: true, Ttl: 30, MinTtl: 120, SOASerial: 2024}
+	config.LocalZones.Set([]string{"zone.example."})
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	h := New(StaticBackend{
+		"a.default.svc.cluster.local.": {{Host: "10.0.0.1"}},
+		"a.default.svc.prod.internal.": {{Host: "10.0.0.1"}},
+	}, config).handler()
+
+	for _, tc := range []struct {
+		name  string
+		qtype uint16
+		rcode int
+		zone  string
+	}{
+		{"b.default.svc.cluster.local.", dns.TypeA, dns.RcodeNameError, "cluster.local."},
+		{"a.default.svc.cluster.local.", dns.TypeMX, dns.RcodeSuccess, "cluster.local."},
+		{"b.default.svc.prod.internal.", dns.TypeA, dns.RcodeNameError, "prod.internal."},
+		{"a.default.svc.prod.internal.", dns.TypeTXT, dns.RcodeSuccess, "prod.internal."},
+		{"b.zone.example.", dns.TypeA, dns.RcodeNameError, "zone.example."},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, tc.qtype)
+		w := &dohWriter{remote: &net.TCPAddr{}}
+		h.ServeDNS(w, m)
+		if w.msg == nil {
+			t.Fatalf("%s: no reply", tc.name)
+		}
+		if w.msg.Rcode != tc.rcode || len(w.msg.Answer) != 0 {
+			t.Errorf("%s: expected %s with no answer, got %v", tc.name, dns.RcodeToString[tc.rcode], w.msg)
+			continue
+		}
+		if len(w.msg.Ns) != 1 {
+			t.Errorf("%s: expected a SOA record in authority, got %v", tc.name, w.msg.Ns)
+			continue
+		}
+		soa, ok := w.msg.Ns[0].(*dns.SOA)
+		if !ok {
+			t.Errorf("%s: expected a SOA record in authority, got %v", tc.name, w.msg.Ns[0])
+			continue
+		}
+		if soa.Hdr.Name != tc.zone {
+			t.Errorf("%s: expected the SOA of %s, got %s", tc.name, tc.zone, soa.Hdr.Name)
+		}
+		// The TTL is the lesser of the SOA TTL and MINIMUM (RFC 2308).
+		if soa.Hdr.Ttl != 30 || soa.Minttl != 120 || soa.Serial != 2024 {
+			t.Errorf("%s: unexpected SOA %v", tc.name, soa)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("prod.internal.", dns.TypeSOA)
+	w := &dohWriter{remote: &net.TCPAddr{}}
+	h.ServeDNS(w, m)
+	if w.msg == nil || len(w.msg.Answer) != 1 || w.msg.Answer[0].Header().Name != "prod.internal." {
+		t.Errorf("expected the SOA of prod.internal., got %v", w.msg)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// AnswerSorter filters and orders the address records answered to a client,
+// e.g. to prefer the endpoints close to it. The client is remote, or the
+// *net.IPNet of the EDNS Client Subnet option of its query. It returns the
+// records to answer, which may be answer itself, and whether they depend on
+// the client.
+type AnswerSorter func(remote net.Addr, answer []dns.RR) ([]dns.RR, bool)
+
+// sortAnswers applies the configured AnswerSorter to the reply m to an A or
+// AAAA query req. The client is the subnet of the ECS option of req if any,
+// the reply then being marked as specific to it if the sorter reports that
+// the answer depends on it, and must not be cached afterwards. Otherwise
+// the scope prefix of the reply is left to 0 (RFC 7871, section 7.2.1).
+func (s *server) sortAnswers(w dns.ResponseWriter, req, m *dns.Msg) {
+	if s.config.Sorter == nil || len(m.Question) == 0 || len(m.Answer) < 2 {
+		return
+	}
+	if qtype := m.Question[0].Qtype; qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		return
+	}
+	for _, rr := range m.Answer {
+		// Filtering would invalidate the signature.
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			return
+		}
+	}
+	remote := w.RemoteAddr()
+	e := clientSubnet(req)
+	subnet := subnetNet(e)
+	if subnet != nil {
+		remote = subnet
+	}
+	answer, byClient := s.config.Sorter(remote, m.Answer)
+	m.Answer = answer
+	if subnet != nil && byClient {
+		setSubnetScope(m, e)
+	}
+}
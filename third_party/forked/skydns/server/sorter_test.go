@@ -0,0 +1,45 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAnswerSorter(t *testing.T) {
+	var sorted []int
+	config := &Config{
+		Domain:      "cluster.local.",
+		Nameservers: []string{"127.0.0.1:53"},
+		NoRec:       true,
+		RCache:      10,
+		// Keeps the last record only.
+		Sorter: func(remote net.Addr, answer []dns.RR) ([]dns.RR, bool) {
+			sorted = append(sorted, len(answer))
+			return answer[len(answer)-1:], true
+		},
+	}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(StaticBackend{"a.default.svc.cluster.local.": {{Host: "10.0.0.1"}, {Host: "10.0.0.2"}}}, config)
+
+	// The second reply comes from the cache, which keeps the whole answer.
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("a.default.svc.cluster.local.", dns.TypeA)
+		w := &recordingWriter{}
+		s.ServeDNS(w, req)
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Fatalf("expected 1 record, got %v", w.msg)
+		}
+	}
+	if len(sorted) != 2 || sorted[0] != 2 || sorted[1] != 2 {
+		t.Errorf("expected the sorter to get both records twice, got %v", sorted)
+	}
+}
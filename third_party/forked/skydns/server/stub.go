@@ -68,6 +68,10 @@ func (s *server) UpdateStubZones() {
 
 // ServeDNSStubForward forwards a request to a nameservers and returns the response.
 func (s *server) ServeDNSStubForward(w dns.ResponseWriter, req *dns.Msg, ns []string) *dns.Msg {
+	// The TSIG record only authenticates the query to this server, and must
+	// stay the last one: it is not forwarded.
+	req = s.forwardMsg(w, req, "")
+
 	// Check EDNS0 Stub option, if set drop the packet.
 	option := req.IsEdns0()
 	if option != nil {
@@ -99,12 +103,12 @@ func (s *server) ServeDNSStubForward(w dns.ResponseWriter, req *dns.Msg, ns []st
 	try := 0
 Redo:
 	if isTCP(w) {
-		r, err = exchangeWithRetry(s.dnsTCPclient, req, ns[nsid])
+		r, err = exchangeWithRetry(s.tcpExchanger(), req, ns[nsid])
 	} else {
 		r, err = exchangeWithRetry(s.dnsUDPclient, req, ns[nsid])
 	}
 	if err == nil {
-		r.Compress = true
+		r.Compress = !s.config.NoCompress
 		r.Id = req.Id
 		w.WriteMsg(r)
 		return r
@@ -118,7 +122,7 @@ Redo:
 	}
 
 	logf("failure to forward stub request %q", err)
-	m := s.ServerFailure(req)
+	m := s.upstreamFailure(req)
 	w.WriteMsg(m)
 	return m
 }
@@ -0,0 +1,121 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// tsigAlgorithm signs the forwarded queries and the NOTIFY messages.
+	tsigAlgorithm = dns.HmacSHA256
+	// tsigFudge is the time error permitted in the messages signed.
+	tsigFudge = 300
+)
+
+// setTsigDefaults puts the names of the TSIG keys of config in canonical
+// form, and checks their secrets.
+func setTsigDefaults(config *Config) error {
+	secrets := make(map[string]string, len(config.TsigSecret))
+	for name, secret := range config.TsigSecret {
+		if _, err := base64.StdEncoding.DecodeString(secret); err != nil {
+			return fmt.Errorf("invalid secret of TSIG key %q: %v", name, err)
+		}
+		secrets[dns.CanonicalName(name)] = secret
+	}
+	if len(secrets) == 0 {
+		secrets = nil
+	}
+	config.TsigSecret = secrets
+	for i, name := range config.TransferKeys {
+		config.TransferKeys[i] = dns.CanonicalName(name)
+		if _, ok := secrets[config.TransferKeys[i]]; !ok {
+			return fmt.Errorf("unknown transfer TSIG key %q", name)
+		}
+	}
+	if config.ForwardKey != "" {
+		config.ForwardKey = dns.CanonicalName(config.ForwardKey)
+		if _, ok := secrets[config.ForwardKey]; !ok {
+			return fmt.Errorf("unknown forward TSIG key %q", config.ForwardKey)
+		}
+	}
+	return nil
+}
+
+// tsigHandler answers the queries signed with an invalid TSIG record with
+// NOTAUTH and the TSIG error (RFC 8945, section 5.2), and signs the replies
+// to the others with the key of their query.
+func tsigHandler(h dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		t := req.IsTsig()
+		if t == nil {
+			h.ServeDNS(w, req)
+			return
+		}
+		if err := w.TsigStatus(); err != nil {
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeNotAuth)
+			m.SetTsig(t.Hdr.Name, t.Algorithm, t.Fudge, time.Now().Unix())
+			rr := m.IsTsig()
+			switch {
+			case errors.Is(err, dns.ErrSecret), errors.Is(err, dns.ErrKeyAlg):
+				rr.Error = dns.RcodeBadKey
+			case errors.Is(err, dns.ErrTime):
+				rr.Error = dns.RcodeBadTime
+			default:
+				rr.Error = dns.RcodeBadSig
+			}
+			logf("invalid TSIG of query from %s with key %s: %s", w.RemoteAddr(), t.Hdr.Name, err)
+			w.WriteMsg(m)
+			return
+		}
+		h.ServeDNS(&tsigWriter{ResponseWriter: w, tsig: t}, req)
+	})
+}
+
+// tsigWriter signs the replies written through it with the key of tsig,
+// the TSIG record of the query.
+type tsigWriter struct {
+	dns.ResponseWriter
+	tsig *dns.TSIG
+}
+
+func (w *tsigWriter) WriteMsg(m *dns.Msg) error {
+	if m.IsTsig() == nil {
+		// The reply may be cached, it is not changed.
+		m = m.Copy()
+		m.SetTsig(w.tsig.Hdr.Name, w.tsig.Algorithm, w.tsig.Fudge, time.Now().Unix())
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// signedWith returns whether req is signed with a valid TSIG record of one
+// of keys.
+func signedWith(w dns.ResponseWriter, req *dns.Msg, keys []string) bool {
+	t := req.IsTsig()
+	if t == nil || w.TsigStatus() != nil {
+		return false
+	}
+	name := dns.CanonicalName(t.Hdr.Name)
+	for _, key := range keys {
+		if key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// stripTsig removes the TSIG record of the reply r of an upstream, which
+// only authenticates it to this server.
+func stripTsig(r *dns.Msg) {
+	if r.IsTsig() != nil {
+		r.Extra = r.Extra[:len(r.Extra)-1]
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testTsigSecret  = "c2VjcmV0LW9mLXRoZS10cmFuc2Zlci1rZXk="
+	testTsigSecret2 = "c2VjcmV0LW9mLXRoZS1mb3J3YXJkLWtleQ=="
+)
+
+// serveUDP serves the queries over UDP with h, verifying their TSIG records
+// with secrets, until the test ends, and returns its address.
+func serveUDP(t *testing.T, h dns.Handler, secrets map[string]string) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: h, TsigSecret: secrets}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestTsigQuery(t *testing.T) {
+	config := &Config{Domain: "cluster.local.", NoRec: true, TsigSecret: map[string]string{"Transfer": testTsigSecret}}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(StaticBackend{"web.default.svc.cluster.local.": {{Host: "10.0.0.1", Ttl: 30}}}, config)
+	addr := serveUDP(t, s.handler(), config.TsigSecret)
+
+	m := new(dns.Msg)
+	m.SetQuestion("web.default.svc.cluster.local.", dns.TypeA)
+	m.SetTsig("transfer.", dns.HmacSHA256, tsigFudge, time.Now().Unix())
+	c := &dns.Client{TsigSecret: map[string]string{"transfer.": testTsigSecret}}
+	r, _, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.IsTsig() == nil || len(r.Answer) != 1 {
+		t.Errorf("expected a signed answer, got %v", r)
+	}
+
+	// Signed with another secret.
+	m.SetTsig("transfer.", dns.HmacSHA256, tsigFudge, time.Now().Unix())
+	c.TsigSecret["transfer."] = testTsigSecret2
+	r, _, _ = c.Exchange(m, addr)
+	if r == nil || r.Rcode != dns.RcodeNotAuth || r.IsTsig() == nil || r.IsTsig().Error != dns.RcodeBadSig {
+		t.Errorf("expected NOTAUTH with BADSIG, got %v", r)
+	}
+
+	// The TSIG records are not verified over HTTPS.
+	m.SetTsig("transfer.", dns.HmacSHA256, tsigFudge, time.Now().Unix())
+	w := &dohWriter{remote: &net.TCPAddr{}}
+	s.handler().ServeDNS(w, m)
+	if w.msg.Rcode != dns.RcodeNotAuth || w.msg.IsTsig() == nil || w.msg.IsTsig().Error != dns.RcodeBadKey {
+		t.Errorf("expected NOTAUTH with BADKEY over HTTPS, got %v", w.msg)
+	}
+}
+
+func TestTsigTransfer(t *testing.T) {
+	config := &Config{
+		Domain:        "cluster.local.",
+		NoRec:         true,
+		TransferCIDRs: []string{"127.0.0.0/8"},
+		TsigSecret:    map[string]string{"transfer.": testTsigSecret, "other.": testTsigSecret2},
+		TransferKeys:  []string{"transfer."},
+	}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTCP(t, New(StaticBackend{"web.default.svc.cluster.local.": {{Host: "10.0.0.1", Ttl: 30}}}, config))
+
+	transfer := func(key string) (int, error) {
+		m := new(dns.Msg)
+		m.SetAxfr("cluster.local.")
+		if key != "" {
+			m.SetTsig(key, dns.HmacSHA256, tsigFudge, time.Now().Unix())
+		}
+		tr := &dns.Transfer{TsigSecret: config.TsigSecret}
+		envelopes, err := tr.In(m, addr)
+		if err != nil {
+			return 0, err
+		}
+		records := 0
+		for e := range envelopes {
+			if e.Error != nil {
+				return 0, e.Error
+			}
+			records += len(e.RR)
+		}
+		return records, nil
+	}
+	if records, err := transfer("transfer."); err != nil || records != 3 {
+		t.Errorf("expected the transfer signed with the transfer key to succeed, got %d records, %v", records, err)
+	}
+	for _, key := range []string{"", "other."} {
+		if _, err := transfer(key); err == nil {
+			t.Errorf("expected the transfer signed with %q to be refused", key)
+		}
+	}
+}
+
+func TestForwardTsig(t *testing.T) {
+	upstreamSecrets := map[string]string{"forward.": testTsigSecret2}
+	verified := make(chan bool, 1)
+	upstream := serveUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		t := req.IsTsig()
+		verified <- t != nil && w.TsigStatus() == nil
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30},
+			A:   net.IPv4(10, 0, 0, 1),
+		}}
+		if t != nil {
+			m.SetTsig(t.Hdr.Name, t.Algorithm, t.Fudge, time.Now().Unix())
+		}
+		w.WriteMsg(m)
+	}), upstreamSecrets)
+
+	config := &Config{
+		Domain:      "cluster.local.",
+		Nameservers: []string{upstream},
+		TsigSecret:  map[string]string{"transfer.": testTsigSecret, "forward.": testTsigSecret2},
+		ForwardKey:  "forward.",
+	}
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(StaticBackend{}, config)
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	w := &recordingWriter{}
+	s.handler().ServeDNS(w, m)
+	if !<-verified {
+		t.Errorf("expected the forwarded query to be signed with the forward key")
+	}
+	if w.msg == nil || len(w.msg.Answer) != 1 || w.msg.IsTsig() != nil {
+		t.Errorf("expected the unsigned answer of the upstream, got %v", w.msg)
+	}
+}
+
+func TestSetTsigDefaults(t *testing.T) {
+	for _, config := range []*Config{
+		{TsigSecret: map[string]string{"transfer.": "not base64"}},
+		{TsigSecret: map[string]string{"transfer.": testTsigSecret}, TransferKeys: []string{"other."}},
+		{TsigSecret: map[string]string{"transfer.": testTsigSecret}, ForwardKey: "other."},
+	} {
+		if err := SetDefaults(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Zones is a set of zones that can be replaced while serving. It is safe
+// for concurrent use.
+type Zones struct {
+	mu    sync.RWMutex
+	zones map[string]bool
+}
+
+// NewZones returns an empty set of zones.
+func NewZones() *Zones {
+	return &Zones{zones: make(map[string]bool)}
+}
+
+// Set replaces the zones.
+func (z *Zones) Set(zones []string) {
+	normalized := make(map[string]bool, len(zones))
+	for _, zone := range zones {
+		normalized[dns.Fqdn(strings.ToLower(zone))] = true
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.zones = normalized
+}
+
+// Contains returns whether name, which must be lower case and fully
+// qualified, is in one of the zones.
+func (z *Zones) Contains(name string) bool {
+	_, ok := z.Zone(name)
+	return ok
+}
+
+// Zone returns the closest of the zones name, which must be lower case and
+// fully qualified, is in.
+func (z *Zones) Zone(name string) (string, bool) {
+	if z == nil {
+		return "", false
+	}
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	if len(z.zones) == 0 {
+		return "", false
+	}
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if z.zones[name[off:]] {
+			return name[off:], true
+		}
+	}
+	return "", false
+}
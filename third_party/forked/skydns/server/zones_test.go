@@ -0,0 +1,54 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestZones(t *testing.T) {
+	z := NewZones()
+	z.Set([]string{"Team-A.corp.example", "team-b.corp.example."})
+	for name, expected := range map[string]bool{
+		"team-a.corp.example.":        true,
+		"web.team-a.corp.example.":    true,
+		"web.team-b.corp.example.":    true,
+		"corp.example.":               false,
+		"web.team-c.corp.example.":    false,
+		"web.notteam-a.corp.example.": false,
+	} {
+		if got := z.Contains(name); got != expected {
+			t.Errorf("%s: expected %v, got %v", name, expected, got)
+		}
+	}
+
+	z.Set(nil)
+	if z.Contains("web.team-a.corp.example.") {
+		t.Errorf("expected no zone left")
+	}
+	var nilZones *Zones
+	if nilZones.Contains("example.com.") {
+		t.Errorf("expected no zone")
+	}
+}
+
+func TestLocalZones(t *testing.T) {
+	config := &Config{Domain: "cluster.local.", LocalZones: NewZones()}
+	config.LocalZones.Set([]string{"team-a.corp.example"})
+	if err := SetDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(StaticBackend{"web.team-a.corp.example.": {{Host: "10.0.0.1"}}}, config)
+
+	req := new(dns.Msg)
+	req.SetQuestion("web.team-a.corp.example.", dns.TypeA)
+	w := &recordingWriter{}
+	s.ServeDNS(w, req)
+	if w.msg == nil || len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Errorf("expected 10.0.0.1 from the backend, got %v", w.msg)
+	}
+}